@@ -3,7 +3,9 @@ package command
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -42,15 +44,12 @@ func installSignal(srv server.Server) {
 	for {
 		select {
 		case <-reloadSignalCh:
-			var c config.Config
-			var err error
-			c, err = config.ParseConfig(ConfigFile)
+			rs, err := srv.ReloadConfig()
 			if err != nil {
 				logger.Error("reload error", zap.Error(err))
 				return
 			}
-			srv.ApplyConfig(c)
-			logger.Info("gmqtt reloaded")
+			logger.Info("gmqtt reloaded", zap.Strings("applied", rs.Applied), zap.Strings("require_restart", rs.RequireRestart))
 		case <-stopSignalCh:
 			err := srv.Stop(context.Background())
 			if err != nil {
@@ -64,14 +63,38 @@ func installSignal(srv server.Server) {
 func GetListeners(c config.Config) (tcpListeners []net.Listener, websockets []*server.WsServer, err error) {
 	for _, v := range c.Listeners {
 		var ln net.Listener
+		var filter server.ClientIDFilter
+		filter, err = server.NewClientIDFilter(v.AllowedClientIDs, v.AllowedClientIDPattern)
+		if err != nil {
+			return
+		}
 		if v.Websocket != nil {
 			ws := &server.WsServer{
-				Server: &http.Server{Addr: v.Address},
-				Path:   v.Websocket.Path,
+				Server:           &http.Server{Addr: v.Address},
+				Path:             v.Websocket.Path,
+				ClientIDFilter:   filter,
+				Name:             v.Name,
+				Compression:      v.Websocket.Compression,
+				CompressionLevel: v.Websocket.CompressionLevel,
+				Subprotocols:     v.Websocket.Subprotocols,
+				AllowedOrigins:   v.Websocket.AllowedOrigins,
+				TopicAliasMax:    v.TopicAliasMaximum,
 			}
+			if v.HasPolicy() {
+				ws.Policy = listenerPolicy(v)
+			}
+			opts := socketOptions(v)
+			ws.SocketOptions = &opts
 			if v.TLSOptions != nil {
 				ws.KeyFile = v.Key
 				ws.CertFile = v.Cert
+				if v.Verify {
+					ws.Server.TLSConfig, err = clientCertTLSConfig(v.TLSOptions)
+					if err != nil {
+						return
+					}
+					ws.RequireClientCert = true
+				}
 			}
 			websockets = append(websockets, ws)
 			continue
@@ -82,17 +105,83 @@ func GetListeners(c config.Config) (tcpListeners []net.Listener, websockets []*s
 			if err != nil {
 				return
 			}
-			ln, err = tls.Listen("tcp", v.Address, &tls.Config{
+			tlsCfg := &tls.Config{
 				Certificates: []tls.Certificate{cert},
-			})
+			}
+			if v.Verify {
+				var certCfg *tls.Config
+				certCfg, err = clientCertTLSConfig(v.TLSOptions)
+				if err != nil {
+					return
+				}
+				tlsCfg.ClientCAs = certCfg.ClientCAs
+				tlsCfg.ClientAuth = certCfg.ClientAuth
+			}
+			ln, err = socketOptions(v).Listen(v.Address, c.MQTT.TCPKeepAlive)
+			if err == nil {
+				if v.TLSAutoDetect {
+					ln = server.NewAutoDetectListener(ln, tlsCfg)
+				} else {
+					ln = tls.NewListener(ln, tlsCfg)
+				}
+			}
 		} else {
-			ln, err = net.Listen("tcp", v.Address)
+			ln, err = socketOptions(v).Listen(v.Address, c.MQTT.TCPKeepAlive)
+		}
+		if err != nil {
+			return
+		}
+		if v.TLSOptions != nil && v.Verify {
+			ln = server.NewClientCertListener(ln)
+		}
+		if v.TopicAliasMaximum != nil {
+			ln = server.NewTopicAliasMaxListener(ln, *v.TopicAliasMaximum)
 		}
-		tcpListeners = append(tcpListeners, ln)
+		if v.HasPolicy() {
+			ln = server.NewPolicyListener(ln, *listenerPolicy(v))
+		}
+		tcpListeners = append(tcpListeners, server.NewNamedListener(server.NewClientIDFilterListener(ln, filter), v.Name))
 	}
 	return
 }
 
+// listenerPolicy returns the server.ListenerPolicy of the listener config.
+func listenerPolicy(c *config.ListenerConfig) *server.ListenerPolicy {
+	return &server.ListenerPolicy{
+		ProtocolVersions: c.ProtocolVersions(),
+		MaxPacketSize:    c.MaxPacketSize,
+		AllowAnonymous:   c.AllowAnonymous,
+	}
+}
+
+// socketOptions returns the server.SocketOptions of the listener config.
+func socketOptions(c *config.ListenerConfig) server.SocketOptions {
+	return server.SocketOptions{
+		NoDelay:         c.NoDelay(),
+		ReadBufferSize:  c.ReadBufferSize,
+		WriteBufferSize: c.WriteBufferSize,
+		ReuseAddr:       c.ReuseAddr(),
+	}
+}
+
+// clientCertTLSConfig returns the tls config which verifies the client certificates by the CA certificate.
+// The certificates are verified if given, the connections without a certificate are rejected by the broker with a CONNACK,
+// see server.NewClientCertListener.
+func clientCertTLSConfig(opts *config.TLSOptions) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(opts.CACert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid cacert: %s", opts.CACert)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
 // NewStartCmd creates a *cobra.Command object for start command.
 func NewStartCmd() *cobra.Command {
 	cmd := &cobra.Command{
@@ -117,7 +206,7 @@ func NewStartCmd() *cobra.Command {
 
 			tcpListeners, websockets, err := GetListeners(c)
 			must(err)
-			l, err := c.GetLogger(c.Log)
+			l, level, err := c.GetLoggerWithLevel(c.Log)
 			must(err)
 			logger = l
 
@@ -126,6 +215,10 @@ func NewStartCmd() *cobra.Command {
 				server.WithTCPListener(tcpListeners...),
 				server.WithWebsocketServer(websockets...),
 				server.WithLogger(l),
+				server.WithLogLevel(level),
+				server.WithConfigLoader(func() (config.Config, error) {
+					return config.ParseConfig(ConfigFile)
+				}),
 			)
 
 			err = s.Init()
@@ -12,6 +12,7 @@ import (
 	_ "github.com/DrmagicE/gmqtt/persistence"
 	_ "github.com/DrmagicE/gmqtt/plugin/prometheus"
 	_ "github.com/DrmagicE/gmqtt/topicalias/fifo"
+	_ "github.com/DrmagicE/gmqtt/topicalias/lru"
 )
 
 var (
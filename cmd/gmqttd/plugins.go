@@ -6,6 +6,7 @@ package main
 import (
 	_ "github.com/DrmagicE/gmqtt/plugin/admin"
 	_ "github.com/DrmagicE/gmqtt/plugin/auth"
+	_ "github.com/DrmagicE/gmqtt/plugin/bridge"
 	_ "github.com/DrmagicE/gmqtt/plugin/federation"
 	_ "github.com/DrmagicE/gmqtt/plugin/prometheus"
 )
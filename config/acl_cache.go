@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// DefaultACLCache is the default value of ACLCache
+	DefaultACLCache = ACLCache{
+		TTL:        0,
+		MaxEntries: 1000,
+	}
+)
+
+// ACLCache is the config of the per-client cache of the OnAuthorize hook decisions, keyed by the action and the topic.
+//
+// The cached decisions are used until they expire, so that a permission change takes effect after at most TTL
+// unless the cache is invalidated explicitly, e.g: by the InvalidateACL API of the admin plugin.
+// The cache of each client is bounded by MaxEntries, the least recently used decision is evicted if the cache is full,
+// thus the clients publishing to a large number of distinct topics cost at most MaxEntries entries.
+type ACLCache struct {
+	// TTL is the duration for which the decisions are cached, 0 disables the cache.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxEntries is the maximum number of the decisions cached for each client.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// Enabled reports whether the cache is enabled.
+func (a ACLCache) Enabled() bool {
+	return a.TTL > 0
+}
+
+func (a ACLCache) Validate() error {
+	if a.TTL < 0 {
+		return fmt.Errorf("invalid acl_cache.ttl: %s", a.TTL)
+	}
+	if a.Enabled() && a.MaxEntries <= 0 {
+		return fmt.Errorf("invalid acl_cache.max_entries: %d", a.MaxEntries)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+)
+
+var (
+	// DefaultBanList is the default value of BanList
+	DefaultBanList = BanList{
+		MaxEntries: 10000,
+		Persistent: false,
+	}
+)
+
+// BanList is the config of the temporary ban list, which refuses the CONNECT of the banned client ids and source IPs,
+// e.g: to stop a client reconnecting in a loop after it is kicked by the admin API.
+//
+// The bans are removed lazily once they expire.
+// The list is bounded by MaxEntries, if the list is full, the expired bans are removed and then the ban which expires the earliest is evicted.
+type BanList struct {
+	// MaxEntries is the maximum number of the bans.
+	MaxEntries int `yaml:"max_entries"`
+	// Persistent indicates whether to persist the bans by the persistence, so that the bans survive the broker restart.
+	// It takes effect only if the persistence implements server.BanPersistence, otherwise the bans are kept in memory.
+	Persistent bool `yaml:"persistent"`
+}
+
+func (b BanList) Validate() error {
+	if b.MaxEntries <= 0 {
+		return fmt.Errorf("invalid ban_list.max_entries: %d", b.MaxEntries)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultClientIDPolicy is the default value of ClientIDPolicy, all client ids are allowed and the assigned client ids are random UUIDs.
+var DefaultClientIDPolicy = ClientIDPolicy{}
+
+// ClientIDPolicy is the config of the client ids in the CONNECT packets, e.g: to enforce the naming conventions of the tenants.
+// The client id which does not match Pattern is rejected with "Client Identifier not valid"(0x85),
+// or "Identifier rejected"(0x02) for the MQTT v3.1.1 clients.
+// The empty client id is not matched against Pattern, the server assigns a client id in AssignedFormat instead,
+// and the MQTT v5 clients receive it in the Assigned Client Identifier property of the CONNACK.
+// Whether the empty client id is accepted is controlled by MQTT.AllowZeroLenClientID.
+//
+// The policy can be replaced by the OnClientID hook.
+type ClientIDPolicy struct {
+	// Pattern is the regular expression which the client ids must match entirely, empty means all client ids are allowed.
+	Pattern string `yaml:"pattern"`
+	// AssignedFormat is the format of the assigned client ids, empty means a random UUID.
+	// The supported placeholders are {uuid} (a random UUID), {username} (the username in the CONNECT packet)
+	// and {listener} (the name of the listener). It must contain {uuid} to keep the assigned client ids unique.
+	AssignedFormat string `yaml:"assigned_format"`
+}
+
+func (c ClientIDPolicy) Validate() error {
+	if c.Pattern != "" {
+		if _, err := regexp.Compile(c.Pattern); err != nil {
+			return fmt.Errorf("invalid client_id_policy.pattern: %s", err)
+		}
+	}
+	if c.AssignedFormat != "" && !strings.Contains(c.AssignedFormat, "{uuid}") {
+		return fmt.Errorf("invalid client_id_policy.assigned_format: %s, it must contain {uuid}", c.AssignedFormat)
+	}
+	return nil
+}
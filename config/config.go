@@ -1,14 +1,18 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
 )
 
 var (
@@ -42,12 +46,27 @@ func DefaultConfig() Config {
 		MQTT:      DefaultMQTTConfig,
 		API:       DefaultAPI,
 		Log: LogConfig{
-			Level:  "info",
-			Format: "text",
+			Level:                "info",
+			Format:               "text",
+			ClientErrorRateLimit: 10,
 		},
 		Plugins:           make(pluginConfig),
 		Persistence:       DefaultPersistenceConfig,
 		TopicAliasManager: DefaultTopicAliasManager,
+		ReconnectStorm:    DefaultReconnectStorm,
+		SlowConsumer:      DefaultSlowConsumer,
+		CPUAccounting:     DefaultCPUAccounting,
+		TopicStats:        DefaultTopicStats,
+		MessageBatching:   DefaultMessageBatching,
+		PublishRateLimit:  DefaultPublishRateLimit,
+		ACLCache:          DefaultACLCache,
+		BanList:           DefaultBanList,
+		Redirect:          DefaultRedirect,
+		TopicPolicy:       DefaultTopicPolicy,
+		ClientIDPolicy:    DefaultClientIDPolicy,
+		PublishDedup:      DefaultPublishDedup,
+		MessageTrace:      DefaultMessageTrace,
+		NoSubscriber:      DefaultNoSubscriber,
 	}
 
 	for name, v := range defaultPluginConfig {
@@ -78,6 +97,9 @@ type LogConfig struct {
 	Format string `yaml:"format"`
 	// DumpPacket indicates whether to dump MQTT packet in debug level.
 	DumpPacket bool `yaml:"dump_packet"`
+	// ClientErrorRateLimit is the maximum number of error logs per second for each client and error type.
+	// The suppressed logs are collapsed into a count. 0 means no limit.
+	ClientErrorRateLimit int `yaml:"client_error_rate_limit"`
 }
 
 func (l LogConfig) Validate() error {
@@ -87,6 +109,9 @@ func (l LogConfig) Validate() error {
 	if l.Format != "json" && l.Format != "text" {
 		return fmt.Errorf("invalid log format: %s", l.Format)
 	}
+	if l.ClientErrorRateLimit < 0 {
+		return fmt.Errorf("invalid log client_error_rate_limit: %d", l.ClientErrorRateLimit)
+	}
 	return nil
 }
 
@@ -117,9 +142,26 @@ type Config struct {
 	// PluginOrder is a slice that contains the name of the plugin which will be loaded.
 	// Giving a correct order to the slice is significant,
 	// because it represents the loading order which affect the behavior of the broker.
+	// The order can be adjusted by the plugins which declare the priority or the dependencies,
+	// see server.PluginPriority and server.PluginDependencies.
 	PluginOrder       []string          `yaml:"plugin_order"`
 	Persistence       Persistence       `yaml:"persistence"`
 	TopicAliasManager TopicAliasManager `yaml:"topic_alias_manager"`
+	ReconnectStorm    ReconnectStorm    `yaml:"reconnect_storm"`
+	SlowConsumer      SlowConsumer      `yaml:"slow_consumer"`
+	CPUAccounting     CPUAccounting     `yaml:"cpu_accounting"`
+	TopicStats        TopicStats        `yaml:"topic_stats"`
+	MessageBatching   MessageBatching   `yaml:"message_batching"`
+	PublishRateLimit  PublishRateLimit  `yaml:"publish_rate_limit"`
+	ConnectACL        ConnectACL        `yaml:"connect_acl"`
+	ACLCache          ACLCache          `yaml:"acl_cache"`
+	BanList           BanList           `yaml:"ban_list"`
+	Redirect          Redirect          `yaml:"redirect"`
+	TopicPolicy       TopicPolicy       `yaml:"topic_policy"`
+	PublishDedup      PublishDedup      `yaml:"publish_dedup"`
+	MessageTrace      MessageTrace      `yaml:"message_trace"`
+	ClientIDPolicy    ClientIDPolicy    `yaml:"client_id_policy"`
+	NoSubscriber      NoSubscriber      `yaml:"no_subscriber"`
 }
 
 type GRPC struct {
@@ -134,6 +176,8 @@ type TLSOptions struct {
 	// Key is the path to key file.
 	Key string `yaml:"key"`
 	// Verify indicates whether to verify client cert.
+	// If true, the client certificates are verified by CACert,
+	// and the CONNECT packet without a verified certificate is rejected with "Not authorized".
 	Verify bool `yaml:"verify"`
 }
 
@@ -141,10 +185,91 @@ type ListenerConfig struct {
 	Address     string `yaml:"address"`
 	*TLSOptions `yaml:"tls"`
 	Websocket   *WebsocketOptions `yaml:"websocket"`
+	// TLSAutoDetect indicates whether to accept both TLS and plaintext connections on the address.
+	// The TLS connections are detected by peeking the first byte. It only takes effect when TLSOptions is set.
+	// No-op for websocket listeners.
+	TLSAutoDetect bool `yaml:"tls_auto_detect"`
+	// AllowedClientIDs is the list of client ids which are allowed to connect through the listener.
+	// If both AllowedClientIDs and AllowedClientIDPattern are empty, all client ids are allowed.
+	AllowedClientIDs []string `yaml:"allowed_client_ids"`
+	// AllowedClientIDPattern is the regular expression of the client ids which are allowed to connect through the listener.
+	// A client id is allowed if it is in AllowedClientIDs or matches the pattern.
+	AllowedClientIDPattern string `yaml:"allowed_client_id_pattern"`
+	// Name tags the connections accepted by the listener, e.g: "public" or "internal".
+	// The hooks can read it from server.ClientOptions.Listener to treat the messages differently according to the ingress listener.
+	Name string `yaml:"name"`
+	// TopicAliasMaximum overrides mqtt.topic_alias_maximum for the connections accepted by the listener.
+	// nil means the global setting is used, 0 disables the inbound topic alias of the listener.
+	TopicAliasMaximum *uint16 `yaml:"topic_alias_maximum"`
+	// MQTTVersions is the list of the MQTT versions allowed to connect through the listener, empty means all versions.
+	// The possible values are "3.1", "3.1.1" and "5".
+	MQTTVersions []string `yaml:"mqtt_versions"`
+	// MaxPacketSize overrides mqtt.max_packet_size for the connections accepted by the listener, 0 means the global setting is used.
+	MaxPacketSize uint32 `yaml:"max_packet_size"`
+	// AllowAnonymous indicates whether the CONNECT without username and password is accepted without the authentication hooks,
+	// e.g: for the internal tools on the localhost listener.
+	AllowAnonymous bool `yaml:"allow_anonymous"`
+	// TCPNoDelay sets TCP_NODELAY of the accepted connections, nil means true.
+	TCPNoDelay *bool `yaml:"tcp_no_delay"`
+	// ReadBufferSize sets SO_RCVBUF of the accepted connections in bytes, 0 means the system default.
+	ReadBufferSize int `yaml:"read_buffer_size"`
+	// WriteBufferSize sets SO_SNDBUF of the accepted connections in bytes, 0 means the system default.
+	WriteBufferSize int `yaml:"write_buffer_size"`
+	// SOReuseAddr sets SO_REUSEADDR of the listening socket, nil means true. It is ignored on windows.
+	SOReuseAddr *bool `yaml:"so_reuseaddr"`
+}
+
+// maxSocketBufferSize is the maximum value of ListenerConfig.ReadBufferSize and ListenerConfig.WriteBufferSize.
+const maxSocketBufferSize = 1 << 30
+
+// mqttVersions is the MQTT versions which can be set in ListenerConfig.MQTTVersions.
+var mqttVersions = map[string]packets.Version{
+	"3.1":   packets.Version31,
+	"3.1.1": packets.Version311,
+	"5":     packets.Version5,
+}
+
+// ProtocolVersions returns the MQTT versions of MQTTVersions, the invalid values are ignored.
+func (l *ListenerConfig) ProtocolVersions() []packets.Version {
+	var rs []packets.Version
+	for _, v := range l.MQTTVersions {
+		if pv, ok := mqttVersions[v]; ok {
+			rs = append(rs, pv)
+		}
+	}
+	return rs
+}
+
+// NoDelay returns TCPNoDelay, or true if it is not set.
+func (l *ListenerConfig) NoDelay() bool {
+	return l.TCPNoDelay == nil || *l.TCPNoDelay
+}
+
+// ReuseAddr returns SOReuseAddr, or true if it is not set.
+func (l *ListenerConfig) ReuseAddr() bool {
+	return l.SOReuseAddr == nil || *l.SOReuseAddr
+}
+
+// HasPolicy reports whether any of MQTTVersions, MaxPacketSize and AllowAnonymous is set.
+func (l *ListenerConfig) HasPolicy() bool {
+	return len(l.MQTTVersions) != 0 || l.MaxPacketSize != 0 || l.AllowAnonymous
 }
 
 type WebsocketOptions struct {
 	Path string `yaml:"path"`
+	// Compression indicates whether to negotiate the permessage-deflate extension with the clients.
+	// server_no_context_takeover and client_no_context_takeover are always negotiated, context takeover is not supported.
+	Compression bool `yaml:"compression"`
+	// CompressionLevel is the compression level from 1 (best speed) to 9 (best compression).
+	// 0 means the default level.
+	CompressionLevel int `yaml:"compression_level"`
+	// Subprotocols is the list of the websocket subprotocols supported by the listener, default to ["mqtt"].
+	// The handshake which does not request any of them is rejected.
+	Subprotocols []string `yaml:"subprotocols"`
+	// AllowedOrigins is the list of the origins which are allowed to connect, empty means all origins are allowed.
+	// The wildcard "*" matches any sequence of characters except "/", e.g: "https://*.example.com".
+	// "*" alone matches all origins. The handshake without the Origin header is always allowed.
+	AllowedOrigins []string `yaml:"allowed_origins"`
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -178,6 +303,41 @@ func (c Config) Validate() (err error) {
 	if err != nil {
 		return err
 	}
+	if len(c.Listeners) == 0 {
+		return errors.New("at least one listener must be configured")
+	}
+	for _, v := range c.Listeners {
+		for _, mv := range v.MQTTVersions {
+			if _, ok := mqttVersions[mv]; !ok {
+				return fmt.Errorf("invalid mqtt_versions of listener %s: %s", v.Address, mv)
+			}
+		}
+		if v.MaxPacketSize > packets.MaximumSize {
+			return fmt.Errorf("invalid max_packet_size of listener %s: %d", v.Address, v.MaxPacketSize)
+		}
+		if v.ReadBufferSize < 0 || v.ReadBufferSize > maxSocketBufferSize {
+			return fmt.Errorf("invalid read_buffer_size of listener %s: %d", v.Address, v.ReadBufferSize)
+		}
+		if v.WriteBufferSize < 0 || v.WriteBufferSize > maxSocketBufferSize {
+			return fmt.Errorf("invalid write_buffer_size of listener %s: %d", v.Address, v.WriteBufferSize)
+		}
+		if _, err = regexp.Compile(v.AllowedClientIDPattern); err != nil {
+			return fmt.Errorf("invalid allowed_client_id_pattern of listener %s: %s", v.Address, err)
+		}
+		if v.Websocket != nil && (v.Websocket.CompressionLevel < 0 || v.Websocket.CompressionLevel > 9) {
+			return fmt.Errorf("invalid websocket compression_level of listener %s: %d", v.Address, v.Websocket.CompressionLevel)
+		}
+		if v.TLSOptions != nil && v.Verify && v.CACert == "" {
+			return fmt.Errorf("cacert of listener %s must be set to verify the client certificates", v.Address)
+		}
+		if v.Websocket != nil {
+			for _, o := range v.Websocket.AllowedOrigins {
+				if _, err = path.Match(o, ""); err != nil {
+					return fmt.Errorf("invalid websocket allowed_origins of listener %s: %s", v.Address, o)
+				}
+			}
+		}
+	}
 	err = c.API.Validate()
 	if err != nil {
 		return err
@@ -190,6 +350,66 @@ func (c Config) Validate() (err error) {
 	if err != nil {
 		return err
 	}
+	err = c.ReconnectStorm.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.SlowConsumer.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.CPUAccounting.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.TopicStats.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.MessageBatching.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.PublishRateLimit.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.ConnectACL.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.ACLCache.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.BanList.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.Redirect.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.TopicPolicy.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.PublishDedup.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.MessageTrace.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.ClientIDPolicy.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.NoSubscriber.Validate()
+	if err != nil {
+		return err
+	}
 	for _, conf := range c.Plugins {
 		err := conf.Validate()
 		if err != nil {
@@ -221,7 +441,13 @@ func ParseConfig(filePath string) (c Config, err error) {
 }
 
 func (c Config) GetLogger(config LogConfig) (l *zap.Logger, err error) {
-	var logLevel zapcore.Level
+	l, _, err = c.GetLoggerWithLevel(config)
+	return
+}
+
+// GetLoggerWithLevel returns the logger and its level, the level can be changed at runtime, see server.WithLogLevel.
+func (c Config) GetLoggerWithLevel(config LogConfig) (l *zap.Logger, logLevel zap.AtomicLevel, err error) {
+	logLevel = zap.NewAtomicLevel()
 	err = logLevel.UnmarshalText([]byte(config.Level))
 	if err != nil {
 		return
@@ -234,6 +460,6 @@ func (c Config) GetLogger(config LogConfig) (l *zap.Logger, err error) {
 		core = zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), os.Stdout, logLevel)
 	}
 
-	zaplog := zap.New(core, zap.AddStacktrace(zap.ErrorLevel), zap.AddCaller())
-	return zaplog, nil
+	l = zap.New(core, zap.AddStacktrace(zap.ErrorLevel), zap.AddCaller())
+	return l, logLevel, nil
 }
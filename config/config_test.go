@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -34,3 +36,58 @@ func TestParseConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_Validate_listeners(t *testing.T) {
+	a := assert.New(t)
+	c := DefaultConfig()
+	c.Listeners = nil
+	a.Error(c.Validate())
+
+	c = DefaultConfig()
+	c.Listeners = []*ListenerConfig{{
+		Address:        ":1883",
+		MQTTVersions:   []string{"3.1.1", "5"},
+		MaxPacketSize:  1024,
+		AllowAnonymous: true,
+	}}
+	a.Nil(c.Validate())
+	a.True(c.Listeners[0].HasPolicy())
+	a.Equal([]packets.Version{packets.Version311, packets.Version5}, c.Listeners[0].ProtocolVersions())
+
+	c.Listeners[0].MQTTVersions = []string{"4"}
+	a.Error(c.Validate())
+	c.Listeners[0].MQTTVersions = nil
+	c.Listeners[0].MaxPacketSize = packets.MaximumSize + 1
+	a.Error(c.Validate())
+}
+
+func TestConfig_Validate_clientIDPolicy(t *testing.T) {
+	a := assert.New(t)
+	c := DefaultConfig()
+	c.ClientIDPolicy = ClientIDPolicy{Pattern: "tenant-[a-z]+", AssignedFormat: "{username}-{uuid}"}
+	a.Nil(c.Validate())
+
+	c.ClientIDPolicy.Pattern = "tenant-("
+	a.Error(c.Validate())
+
+	c.ClientIDPolicy.Pattern = ""
+	c.ClientIDPolicy.AssignedFormat = "{username}"
+	a.Error(c.Validate())
+}
+
+func TestConfig_Validate_noSubscriber(t *testing.T) {
+	a := assert.New(t)
+	c := DefaultConfig()
+	c.NoSubscriber.DeadLetterPrefix = ""
+	// the prefix is not validated if the dead letter is disabled.
+	a.Nil(c.Validate())
+
+	c.NoSubscriber.DeadLetter = true
+	a.Error(c.Validate())
+	for _, v := range []string{"$unmatched/#", "$unmatched/+/a", "$unmatched/"} {
+		c.NoSubscriber.DeadLetterPrefix = v
+		a.Error(c.Validate(), v)
+	}
+	c.NoSubscriber.DeadLetterPrefix = "$unmatched/site1"
+	a.Nil(c.Validate())
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path"
+)
+
+// ConnectACL is the static allow/deny list of the connecting clients.
+// It is checked at the very beginning of the CONNECT handling, before any auth hooks,
+// the rejected clients receive the CONNACK with "Not authorized".
+//
+// The precedence rules are:
+//  1. The client is rejected if the client id matches any of DenyClientIDs or the source IP is in any of DenyCIDRs.
+//  2. If AllowClientIDs is not empty, the client is rejected unless the client id matches one of them.
+//  3. If AllowCIDRs is not empty, the client is rejected unless the source IP is in one of them.
+//
+// i.e: deny always wins, and a non-empty allow list means deny by default.
+type ConnectACL struct {
+	// DenyClientIDs is the list of client id patterns which are denied.
+	// The patterns are matched by path.Match, e.g: "test-*". Notice that "*" does not match "/".
+	DenyClientIDs []string `yaml:"deny_client_ids"`
+	// AllowClientIDs is the list of client id patterns which are allowed, empty means all client ids are allowed.
+	AllowClientIDs []string `yaml:"allow_client_ids"`
+	// DenyCIDRs is the list of the source IP ranges in CIDR notation which are denied, e.g: "10.0.0.0/8" or "fd00::/8".
+	DenyCIDRs []string `yaml:"deny_cidrs"`
+	// AllowCIDRs is the list of the source IP ranges in CIDR notation which are allowed, empty means all IPs are allowed.
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+}
+
+// Enabled reports whether any of the lists is set.
+func (c ConnectACL) Enabled() bool {
+	return len(c.DenyClientIDs) != 0 || len(c.AllowClientIDs) != 0 || len(c.DenyCIDRs) != 0 || len(c.AllowCIDRs) != 0
+}
+
+func (c ConnectACL) Validate() error {
+	for _, v := range append(append([]string{}, c.DenyClientIDs...), c.AllowClientIDs...) {
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid connect_acl client id pattern: %s", v)
+		}
+	}
+	for _, v := range append(append([]string{}, c.DenyCIDRs...), c.AllowCIDRs...) {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return fmt.Errorf("invalid connect_acl cidr: %s", v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import "fmt"
+
+var (
+	// DefaultCPUAccounting is the default value of CPUAccounting
+	DefaultCPUAccounting = CPUAccounting{
+		Enable:     false,
+		SampleRate: 10,
+	}
+)
+
+// CPUAccounting is the config of the per-client CPU accounting.
+// If enabled, the server measures the time spent processing the packets of each client,
+// which helps to identify the clients responsible for most of the broker load.
+// The time is sampled to reduce the overhead, thus the result is an estimation.
+type CPUAccounting struct {
+	// Enable indicates whether to enable the CPU accounting.
+	Enable bool `yaml:"enable"`
+	// SampleRate means one of every SampleRate packets will be measured,
+	// and the measured time will be multiplied by SampleRate.
+	// Set to 1 to measure every packet.
+	SampleRate int `yaml:"sample_rate"`
+}
+
+func (c CPUAccounting) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.SampleRate <= 0 {
+		return fmt.Errorf("invalid cpu_accounting.sample_rate: %d", c.SampleRate)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// DefaultMessageBatching is the default value of MessageBatching
+	DefaultMessageBatching = MessageBatching{
+		Enable:   false,
+		MaxCount: 100,
+		MaxBytes: 64 * 1024,
+		MaxDelay: 100 * time.Millisecond,
+	}
+)
+
+// MessageBatching is the config of the server-side message batching.
+// If enabled, the messages matching the subscriptions which opt in batching are aggregated into a single PUBLISH packet.
+// The batch is flushed when any of MaxCount, MaxBytes and MaxDelay is reached.
+type MessageBatching struct {
+	// Enable indicates whether to enable the message batching.
+	Enable bool `yaml:"enable"`
+	// MaxCount is the maximum number of messages in one batch.
+	MaxCount int `yaml:"max_count"`
+	// MaxBytes is the maximum total payload size of the messages in one batch.
+	MaxBytes int `yaml:"max_bytes"`
+	// MaxDelay is the maximum duration that a message waits in the batch.
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+func (m MessageBatching) Validate() error {
+	if !m.Enable {
+		return nil
+	}
+	if m.MaxCount <= 0 {
+		return fmt.Errorf("invalid message_batching.max_count: %d", m.MaxCount)
+	}
+	if m.MaxBytes <= 0 {
+		return fmt.Errorf("invalid message_batching.max_bytes: %d", m.MaxBytes)
+	}
+	if m.MaxDelay <= 0 {
+		return fmt.Errorf("invalid message_batching.max_delay: %s", m.MaxDelay)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+var (
+	// DefaultMessageTrace is the default value of MessageTrace
+	DefaultMessageTrace = MessageTrace{
+		Enable:       false,
+		UserProperty: "gmqtt-trace",
+		BufferSize:   100,
+		MaxEvents:    1000,
+	}
+)
+
+// MessageTrace is the config of the opt-in tracing of the published messages.
+//
+// A message published by a client is traced if it carries the user property named UserProperty,
+// whose value is used as the trace id, or if its topic matches one of TopicFilters.
+// The server generates the trace id for the message without one, and attaches it to the message by the same user property,
+// so that the trace id is carried to the subscribers and the trace can be followed through the persistent queues.
+// The untagged messages are never traced.
+type MessageTrace struct {
+	// Enable indicates whether to enable the message trace.
+	Enable bool `yaml:"enable"`
+	// UserProperty is the name of the user property which carries the trace id.
+	UserProperty string `yaml:"user_property"`
+	// TopicFilters are the topic filters of the messages which are traced without the user property.
+	TopicFilters []string `yaml:"topic_filters"`
+	// BufferSize is the number of the recent traces kept in memory, the oldest trace is evicted if the buffer is full.
+	BufferSize int `yaml:"buffer_size"`
+	// MaxEvents is the maximum number of the events recorded for each trace, the exceeded events are counted but discarded.
+	MaxEvents int `yaml:"max_events"`
+	// Log indicates whether to write every recorded event to the log in the info level.
+	Log bool `yaml:"log"`
+}
+
+func (m MessageTrace) Validate() error {
+	if !m.Enable {
+		return nil
+	}
+	if m.UserProperty == "" {
+		return fmt.Errorf("message_trace.user_property cannot be empty")
+	}
+	for _, v := range m.TopicFilters {
+		if !packets.ValidTopicFilter(true, []byte(v)) {
+			return fmt.Errorf("invalid message_trace.topic_filters: %s", v)
+		}
+	}
+	if m.BufferSize <= 0 {
+		return fmt.Errorf("invalid message_trace.buffer_size: %d", m.BufferSize)
+	}
+	if m.MaxEvents <= 0 {
+		return fmt.Errorf("invalid message_trace.max_events: %d", m.MaxEvents)
+	}
+	return nil
+}
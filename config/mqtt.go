@@ -12,6 +12,46 @@ const (
 	OnlyOnce = "onlyonce"
 )
 
+const (
+	// InflightRedeliver and InflightDrop are the possible values of MQTT.InflightTrimPolicy.
+	InflightRedeliver = "redeliver"
+	InflightDrop      = "drop"
+
+	// UnknownPubrelComplete and UnknownPubrelDisconnect are the possible values of MQTT.UnknownPubrelPolicy.
+	UnknownPubrelComplete   = "pubcomp"
+	UnknownPubrelDisconnect = "disconnect"
+
+	// V3UnsupportedDisconnect and V3UnsupportedDowngrade are the possible values of MQTT.V3UnsupportedPolicy.
+	V3UnsupportedDisconnect = "disconnect"
+	V3UnsupportedDowngrade  = "downgrade"
+
+	// SessionLimitReject and SessionLimitEvictOldest are the possible values of MQTT.SessionLimitPolicy.
+	SessionLimitReject      = "reject"
+	SessionLimitEvictOldest = "evict_oldest"
+
+	// ProtocolComplianceStrict and ProtocolComplianceLenient are the possible values of MQTT.ProtocolCompliance.
+	ProtocolComplianceStrict  = "strict"
+	ProtocolComplianceLenient = "lenient"
+
+	// QueueOverflowDropOldest, QueueOverflowDropNewest and QueueOverflowReject are the possible values of MQTT.QueueOverflowStrategy.
+	QueueOverflowDropOldest = "drop_oldest"
+	QueueOverflowDropNewest = "drop_newest"
+	QueueOverflowReject     = "reject"
+
+	// RetainedLimitEvict and RetainedLimitReject are the possible values of MQTT.RetainedLimitPolicy.
+	RetainedLimitEvict  = "evict"
+	RetainedLimitReject = "reject"
+
+	// SharedSubscriptionRandom and SharedSubscriptionRoundRobin are the possible values of MQTT.SharedSubscriptionStrategy.
+	SharedSubscriptionRandom     = "random"
+	SharedSubscriptionRoundRobin = "round_robin"
+
+	// WriteBufferBlock, WriteBufferDropOldest and WriteBufferDisconnect are the possible values of MQTT.WriteBufferPolicy.
+	WriteBufferBlock      = "block"
+	WriteBufferDropOldest = "drop_oldest"
+	WriteBufferDisconnect = "disconnect"
+)
+
 var (
 	// DefaultMQTTConfig
 	DefaultMQTTConfig = MQTT{
@@ -25,14 +65,28 @@ var (
 		TopicAliasMax:              10,
 		SubscriptionIDAvailable:    true,
 		SharedSubAvailable:         true,
+		SharedSubscriptionStrategy: SharedSubscriptionRandom,
 		WildcardAvailable:          true,
 		RetainAvailable:            true,
+		RetainedLimitPolicy:        RetainedLimitEvict,
 		MaxQueuedMsg:               1000,
+		QueueOverflowStrategy:      QueueOverflowDropOldest,
 		MaxInflight:                100,
 		MaximumQoS:                 2,
+		MaxSubscriptionQoS:         2,
 		QueueQos0Msg:               true,
 		DeliveryMode:               OnlyOnce,
 		AllowZeroLenClientID:       true,
+		InflightTrimPolicy:         InflightRedeliver,
+		UnknownPubrelPolicy:        UnknownPubrelComplete,
+		V3UnsupportedPolicy:        V3UnsupportedDisconnect,
+		SessionLimitPolicy:         SessionLimitReject,
+		ProtocolCompliance:         ProtocolComplianceStrict,
+		TCPKeepAlive:               15 * time.Second,
+		ConnectTimeout:             5 * time.Second,
+		ConnectRejectionBufferSize: 100,
+		WriteBufferSize:            8,
+		WriteBufferPolicy:          WriteBufferBlock,
 	}
 )
 
@@ -48,16 +102,22 @@ type MQTT struct {
 	// InflightExpiry is the lifetime of the "inflight" message in seconds.
 	// If a "inflight" message is not acknowledged by a client in InflightExpiry time, it will be removed when the message queue is full.
 	InflightExpiry time.Duration `yaml:"inflight_expiry"`
-	// MaxPacketSize is the maximum packet size that the server is willing to accept from the client
+	// MaxPacketSize is the maximum packet size that the server is willing to accept from the client.
+	// It is advertised in CONNACK for v5 clients, see server.AuthOptions.MaxPacketSize for how it is enforced.
 	MaxPacketSize uint32 `yaml:"max_packet_size"`
 	// ReceiveMax limits the number of QoS 1 and QoS 2 publications that the server is willing to process concurrently for the client.
 	ReceiveMax uint16 `yaml:"server_receive_maximum"`
-	// MaxKeepAlive is the maximum keep alive time in seconds allows by the server.
+	// MaxKeepAlive is the maximum keep alive time in seconds allows by the server, 0 means no maximum.
 	// If the client requests a keepalive time bigger than MaxKeepalive,
 	// the server will use MaxKeepAlive as the keepalive time.
 	// In this case, if the client version is v5, the server will set MaxKeepalive into CONNACK to inform the client.
-	// But if the client version is 3.x, the server has no way to inform the client that the keepalive time has been changed.
+	// But if the client version is 3.x, the server has no way to inform the client that the keepalive time has been changed,
+	// it just closes the connection if no packet has been received for 1.5 times the MaxKeepAlive.
 	MaxKeepAlive uint16 `yaml:"max_keepalive"`
+	// MinKeepAlive is the minimum keep alive time in seconds allows by the server, 0 means no minimum.
+	// If the client requests a keepalive time smaller than MinKeepAlive, including 0 which disables the keep alive mechanism,
+	// the server will use MinKeepAlive as the keepalive time and inform the v5 client in the same way as MaxKeepAlive.
+	MinKeepAlive uint16 `yaml:"min_keepalive"`
 	// TopicAliasMax indicates the highest value that the server will accept as a Topic Alias sent by the client.
 	// No-op if the client version is MQTTv3.x
 	TopicAliasMax uint16 `yaml:"topic_alias_maximum"`
@@ -66,22 +126,72 @@ type MQTT struct {
 	SubscriptionIDAvailable bool `yaml:"subscription_identifier_available"`
 	// SharedSubAvailable indicates whether the server supports Shared Subscriptions.
 	SharedSubAvailable bool `yaml:"shared_subscription_available"`
+	// SharedSubscriptionStrategy is the strategy to pick the member of a shared subscription group which receives the message.
+	// The possible value can be "random" or "round_robin", default to "random".
+	// In "round_robin" strategy, the members of each shared subscription ($share/{ShareName}/{filter}) receive the messages in turn.
+	SharedSubscriptionStrategy string `yaml:"shared_subscription_strategy"`
 	// WildcardSubAvailable indicates whether the server supports Wildcard Subscriptions.
 	WildcardAvailable bool `yaml:"wildcard_subscription_available"`
 	// RetainAvailable indicates whether the server supports retained messages.
 	RetainAvailable bool `yaml:"retain_available"`
+	// MaxRetainedBytes is the total byte budget of the retained messages, 0 means unlimited.
+	// If the budget is exceeded, the least recently published or matched retained messages will be removed.
+	// No-op if the retained store does not implement retained.BytesLimiter.
+	MaxRetainedBytes uint64 `yaml:"max_retained_bytes"`
+	// MaxRetainedMessages is the maximum number of the retained messages of all topics, 0 means unlimited.
+	// Replacing or removing the retained message of an existing topic is not limited.
+	// No-op if the retained store does not implement retained.Limiter.
+	MaxRetainedMessages int `yaml:"max_retained_messages"`
+	// MaxRetainedMessageBytes is the maximum payload size of a retained message, 0 means unlimited.
+	// The over-sized message is still delivered to the subscribers, but it is not stored as the retained message.
+	// No-op if the retained store does not implement retained.Limiter.
+	MaxRetainedMessageBytes int `yaml:"max_retained_message_bytes"`
+	// RetainedLimitPolicy is the policy for the retained message of a new topic which exceeds MaxRetainedMessages.
+	// The possible value can be "evict" or "reject".
+	// When set to "evict", the least recently published or matched retained message will be removed.
+	// When set to "reject", the message will not be stored as the retained message.
+	// Empty value is the same as "evict".
+	RetainedLimitPolicy string `yaml:"retained_limit_policy"`
+	// RetainedLimitNack indicates whether to reply the "Quota exceeded" PUBACK/PUBREC to the MQTT v5 clients
+	// if the retained message is not stored due to MaxRetainedMessages or MaxRetainedMessageBytes.
+	// The nacked message will not be delivered to the subscribers.
+	RetainedLimitNack bool `yaml:"retained_limit_nack"`
 	// MaxQueuedMsg is the maximum queue length of the outgoing messages.
 	// If the queue is full, some message will be dropped.
 	// The message dropping strategy is described in the document of the persistence/queue.Store interface.
 	MaxQueuedMsg int `yaml:"max_queued_messages"`
+	// QueueOverflowStrategy is the strategy for the QoS 1 and QoS 2 messages when the queue is full
+	// and there is no expired or QoS 0 message to drop. The possible value can be "drop_oldest", "drop_newest" or "reject".
+	// When set to "drop_oldest", the oldest message which is not inflight will be dropped.
+	// When set to "drop_newest", the incoming message will be dropped.
+	// When set to "reject", the incoming message will be dropped and the publisher will not receive the PUBACK or PUBREC,
+	// so that the inflight window of the publisher applies backpressure until it resends the message.
+	// The message is still delivered to the other matched subscribers, they may receive it again when the publisher resends it.
+	// It only applies to QoS 1 and QoS 2 messages, the QoS 0 messages have no acknowledgement to withhold and are always dropped.
+	// The dropped messages are reported with queue.ErrDropQueueFull in any case. Empty value is the same as "drop_oldest".
+	QueueOverflowStrategy string `yaml:"queue_overflow_strategy"`
 	// MaxInflight limits inflight message length of the outgoing messages.
 	// Inflight message is also stored in the message queue, so it must be less than or equal to MaxQueuedMsg.
 	// Inflight message is the QoS 1 or QoS 2 message that has been sent out to a client but not been acknowledged yet.
+	// For MQTT v5 clients, the effective value is the minimum of MaxInflight and the Receive Maximum in the CONNECT packet.
 	MaxInflight uint16 `yaml:"max_inflight"`
 	// MaximumQoS is the highest QOS level permitted for a Publish.
 	MaximumQoS uint8 `yaml:"maximum_qos"`
+	// MaxSubscriptionQoS is the highest QoS level granted to a subscription.
+	// The subscription requesting a higher QoS is downgraded, and the SUBACK carries the granted QoS.
+	MaxSubscriptionQoS uint8 `yaml:"max_subscription_qos"`
+	// NormalizeTopics indicates whether to normalize the topic names and topic filters sent by clients,
+	// the leading and trailing "/" are removed and the repeated "/" are collapsed, e.g: "/a//b/" becomes "a/b".
+	// For shared subscriptions, only the topic filter after the share name is normalized.
+	// Note that "/a" and "a" are different topics in MQTT, enabling it merges them.
+	NormalizeTopics bool `yaml:"normalize_topics"`
 	// QueueQos0Msg indicates whether to store QoS 0 message for a offline session.
 	QueueQos0Msg bool `yaml:"queue_qos0_messages"`
+	// MaxOfflineQos0Msg is the maximum number of QoS 0 messages queued for an offline session if QueueQos0Msg is true,
+	// the oldest QoS 0 messages are dropped on overflow. It does not affect the connected clients.
+	// 0 means the QoS 0 messages are only limited by MaxQueuedMsg.
+	// It requires the queue store to implement queue.Qos0Trimmer, otherwise it is ignored.
+	MaxOfflineQos0Msg int `yaml:"max_offline_qos0_messages"`
 	// DeliveryMode is the delivery mode. The possible value can be "overlap" or "onlyonce".
 	// It is possible for a client’s subscriptions to overlap so that a published message might match multiple filters.
 	// When set to "overlap" , the server will deliver one message for each matching subscription and respecting the subscription’s QoS in each case.
@@ -89,15 +199,173 @@ type MQTT struct {
 	DeliveryMode string `yaml:"delivery_mode"`
 	// AllowZeroLenClientID indicates whether to allow a client to connect with empty client id.
 	AllowZeroLenClientID bool `yaml:"allow_zero_length_clientid"`
+	// InflightTrimPolicy is the policy for the inflight messages exceed the inflight window when a session resumes,
+	// e.g: the client reconnects with a smaller Receive Maximum. The possible value can be "redeliver" or "drop".
+	// The inflight messages within the window are always redelivered with DUP set in order.
+	// When set to "redeliver", the excess messages will be redelivered in order once the window is available.
+	// When set to "drop", the excess PUBLISH messages will be dropped, the excess PUBREL packets are still redelivered.
+	// Empty value is the same as "redeliver".
+	InflightTrimPolicy string `yaml:"inflight_trim_policy"`
+	// UnknownPubrelPolicy is the policy for the PUBREL packets with the packet id that the broker has no QoS 2 state for,
+	// e.g: the state is lost after the broker restarts with the memory persistence. The possible value can be "pubcomp" or "disconnect".
+	// When set to "pubcomp", the broker responds with PUBCOMP, the reason code is "Packet Identifier not found" for v5 clients.
+	// When set to "disconnect", the broker treats it as a protocol error and closes the connection.
+	// It only takes effect when the unack store implements unack.Checker. Empty value is the same as "pubcomp".
+	UnknownPubrelPolicy string `yaml:"unknown_pubrel_policy"`
+	// V3UnsupportedPolicy is the policy for the PUBLISH packets from the v3.x clients which exceed MaximumQoS or set the retain flag
+	// while RetainAvailable is false. The v3.x clients can not learn these limits from the CONNACK.
+	// The possible value can be "disconnect" or "downgrade".
+	// When set to "disconnect", the broker closes the connection, the same as the v5 clients receive DISCONNECT
+	// "QoS not supported" or "Retain not supported".
+	// When set to "downgrade", the message is acknowledged as the client sent it,
+	// but it is delivered with MaximumQoS, or delivered as a non-retained message.
+	// Empty value is the same as "disconnect".
+	V3UnsupportedPolicy string `yaml:"v3_unsupported_policy"`
+	// DropEmptyPayload indicates whether to drop the non-retained PUBLISH with empty payload,
+	// e.g: some devices send empty payloads as heartbeats.
+	// The dropped messages will not be passed to the OnMsgArrived hook nor delivered to the subscribers,
+	// but the publisher still receives a positive acknowledgement.
+	// The retained PUBLISH with empty payload is not affected, it is always used to remove the retained message.
+	DropEmptyPayload bool `yaml:"drop_empty_payload"`
+	// WillMessageAuth indicates whether to pass the will message to the OnAuthorize and OnMsgArrived hooks before delivery,
+	// as if the disconnecting client published it.
+	// It ensures the will message can not escape the permitted topics of the client.
+	// The will message will be discarded if it is not authorized by OnAuthorize, or OnMsgArrived returns error or drops the message.
+	// The bridge and federation plugins forward the will message to other brokers only after it is authorized.
+	WillMessageAuth bool `yaml:"will_message_auth"`
+	// FanoutWorkers is the number of workers which add the routed message to the queues of the matched subscribers.
+	// The subscribers are partitioned by client id, so the messages to each client are still queued in order,
+	// while a slow queue write of one subscriber does not serialize the delivery to the others.
+	// The messages matching only a few subscribers are queued by the publisher directly.
+	// 0 means runtime.GOMAXPROCS, 1 disables the workers.
+	FanoutWorkers int `yaml:"fanout_workers"`
+	// SystemClientID is the reserved client id of the broker itself.
+	// If set, the broker-generated messages (e.g: published through server.Publisher) are passed to the OnMsgArrived hook
+	// on behalf of the system client, so that the hooks can recognize them by server.IsSystemClient.
+	// The clients are not allowed to connect with the reserved client id.
+	// Empty value means the broker-generated messages bypass the OnMsgArrived hook.
+	SystemClientID string `yaml:"system_client_id"`
+	// MaxTopicLength is the maximum length in bytes of the topic names, the will topics and the response topics.
+	// The CONNECT with over-length will topic or will response topic will be rejected with "Topic Name invalid" CONNACK,
+	// and the client will be disconnected with "Topic Name invalid" if it sends the PUBLISH with over-length topic name or response topic.
+	// 0 means no limit.
+	MaxTopicLength int `yaml:"max_topic_length"`
+	// DeliveryRateLimit is the maximum number of messages per second delivered to each client.
+	// The messages are buffered in the queue (subject to MaxQueuedMsg) and delivered one by one at the rate,
+	// it protects the fragile devices from the bursts of messages.
+	// It can be overridden per client by the OnBasicAuth or OnEnhancedAuth hook. 0 means no limit.
+	DeliveryRateLimit int `yaml:"delivery_rate_limit"`
+	// WriteBufferSize is the maximum number of packets buffered for writing to a connected client.
+	// Unlike MaxQueuedMsg which bounds the message queue of the session, it bounds the messages that have been read
+	// from the queue but not been written to the network connection yet, e.g: the client reads its socket slowly.
+	// 0 means the default size 8.
+	WriteBufferSize int `yaml:"write_buffer_size"`
+	// WriteBufferPolicy is the policy for the messages to a connected client when the write buffer is full.
+	// The possible value can be "block", "drop_oldest" or "disconnect".
+	// When set to "block", the delivery waits for the buffer, and the client is disconnected if it waits longer than WriteBufferTimeout.
+	// When set to "drop_oldest", the PUBLISH packets which do not fit in the buffer are held in a pending list of WriteBufferSize,
+	// and the oldest QoS 0 message in the list is dropped when the list is full,
+	// the delivery waits as "block" if there is no QoS 0 message in the list.
+	// When set to "disconnect", the client is disconnected immediately.
+	// The disconnected client gets ErrWriteBufferFull in the OnClosed hook, its session and the QoS 1 and QoS 2 messages are kept
+	// and redelivered after it reconnects. The dropped QoS 0 messages are reported with queue.ErrDropWriteBufferFull.
+	// The messages in the queue are not affected by the policy. Empty value is the same as "block".
+	WriteBufferPolicy string `yaml:"write_buffer_policy"`
+	// WriteBufferTimeout is the maximum duration that the delivery waits for the full write buffer, see WriteBufferPolicy.
+	// 0 means waiting until the client is disconnected otherwise.
+	WriteBufferTimeout time.Duration `yaml:"write_buffer_timeout"`
+	// MaxSessionsPerUsername is the maximum number of sessions for each username,
+	// including the connected sessions and the disconnected sessions which have not expired.
+	// The clients without username are not limited. 0 means no limit.
+	// The username of a session is not persisted, so the sessions restored from the persistence store on startup are not counted
+	// until the clients reconnect.
+	MaxSessionsPerUsername int `yaml:"max_sessions_per_username"`
+	// MaxConnections is the maximum number of network connections of all listeners,
+	// including the connections which have not sent CONNECT. 0 means no limit.
+	// When the limit is reached, the tcp listeners stop accepting until a connection is closed,
+	// so that the new connections wait in the backlog of the kernel, and the websocket servers respond 503 to the new handshakes.
+	MaxConnections int `yaml:"max_connections"`
+	// MaxConnectionsPerIP is the maximum number of network connections for each remote IP. 0 means no limit.
+	// The connection which exceeds the limit will be rejected with "Quota exceeded" CONNACK ("Server unavailable" for MQTTv3.x) after it sends CONNECT.
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+	// TCPKeepAlive is the period of the TCP keep-alive probes on the connections accepted by the tcp listeners of gmqttd.
+	// The half-open connections whose peer vanished without FIN are detected by the kernel and closed,
+	// even if the client does not use the MQTT keep alive. 0 means the system default, a negative value disables the probes.
+	// The connections of the MQTT clients are also closed if no packet is received for 1.5 times the keep alive time.
+	TCPKeepAlive time.Duration `yaml:"tcp_keepalive"`
+	// ConnectTimeout is the maximum time to wait for the CONNECT packet after the connection is accepted,
+	// including the enhanced authentication exchange of MQTTv5.
+	// The connection which sends nothing or only part of the CONNECT packet in time is closed without CONNACK.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// FirstPacketTimeout is the maximum time to wait for the first packet after the CONNACK packet,
+	// the AUTH packets of the enhanced authentication exchange are limited by ConnectTimeout instead.
+	// The client which sends nothing in time is disconnected, even if it does not use the MQTT keep alive.
+	// The keep alive timeout still applies if it is shorter. 0 means no limit.
+	FirstPacketTimeout time.Duration `yaml:"first_packet_timeout"`
+	// ConnectRejectionBufferSize is the number of the recently rejected CONNECTs kept in memory for diagnosis,
+	// the oldest one is overwritten if the buffer is full. 0 means not to keep them.
+	// See server.ClientService.RecentConnectRejections.
+	ConnectRejectionBufferSize int `yaml:"connect_rejection_buffer_size"`
+	// MaxSubscriptionsPerClient is the maximum number of subscriptions for each client. 0 means no limit.
+	// The topic filters in a SUBSCRIBE which exceed the limit will be rejected with "Quota exceeded" (0x80 for MQTTv3.x) in the SUBACK,
+	// while the others still succeed. Replacing an existing subscription is not limited.
+	MaxSubscriptionsPerClient int `yaml:"max_subscriptions_per_client"`
+	// MaxTotalSubscriptions is the maximum number of subscriptions of all clients. 0 means no limit.
+	// It guards the broker against a fleet of clients which exhausts the memory together, even if each of them is within MaxSubscriptionsPerClient.
+	// The topic filters in a SUBSCRIBE which exceed the limit will be rejected with "Quota exceeded" (0x80 for MQTTv3.x) in the SUBACK
+	// until some subscriptions are removed. Replacing an existing subscription is not limited.
+	// The subscriptions added by the plugins or the admin API are not limited, but they are counted.
+	MaxTotalSubscriptions int `yaml:"max_total_subscriptions"`
+	// SessionLimitPolicy is the policy for the CONNECT which exceeds MaxSessionsPerUsername.
+	// The possible value can be "reject" or "evict_oldest".
+	// When set to "reject", the CONNECT will be rejected with "Quota exceeded" CONNACK.
+	// When set to "evict_oldest", the session with the earliest connected time of the username will be terminated,
+	// the client of the evicted session will be disconnected with "Session taken over" if it is connected.
+	// Empty value is the same as "reject".
+	SessionLimitPolicy string `yaml:"session_limit_policy"`
+	// MaxUserProperties is the maximum number of user properties in the CONNECT (including the will properties), PUBLISH and SUBSCRIBE packets.
+	// The packet which exceeds the limit will be treated as a protocol error. 0 means no limit.
+	MaxUserProperties int `yaml:"max_user_properties"`
+	// MaxUserPropertiesBytes is the maximum total bytes of the user property names and values
+	// in the CONNECT (including the will properties), PUBLISH and SUBSCRIBE packets.
+	// The packet which exceeds the limit will be rejected with "Packet too large". 0 means no limit.
+	MaxUserPropertiesBytes int `yaml:"max_user_properties_bytes"`
+	// StrictPublishOrder indicates whether to route the incoming PUBLISH messages strictly in the order of arrival across all clients.
+	// The messages are added into the queues in that order, so that a session receives the messages queued while it is offline
+	// in the original publish order on reconnect, even if they are published by concurrent publishers.
+	// It serializes the routing after the OnMsgArrived hook, a slow hook delays the messages of the other clients that arrive later.
+	// The messages published by server.Publisher and the will messages are not ordered.
+	StrictPublishOrder bool `yaml:"strict_publish_order"`
+	// ProtocolCompliance is the compliance mode of the packet decoder. The possible value can be "strict" or "lenient".
+	// When set to "strict", the packets which violate the specification are rejected with "Malformed Packet" or "Protocol Error".
+	// When set to "lenient", the harmless violations are tolerated for the compatibility of the devices:
+	// the reserved bits of the fixed header and the CONNECT flags are ignored,
+	// the properties which are not valid for the packet type are discarded,
+	// and the last occurrence wins if a property is included more than once.
+	// Empty value is the same as "strict".
+	ProtocolCompliance string `yaml:"protocol_compliance"`
 }
 
 func (c MQTT) Validate() error {
 	if c.MaximumQoS > packets.Qos2 {
 		return fmt.Errorf("invalid maximum_qos: %d", c.MaximumQoS)
 	}
+	if c.MaxSubscriptionQoS > packets.Qos2 {
+		return fmt.Errorf("invalid max_subscription_qos: %d", c.MaxSubscriptionQoS)
+	}
 	if c.MaxQueuedMsg <= 0 {
 		return fmt.Errorf("invalid max_queued_messages : %d", c.MaxQueuedMsg)
 	}
+	if c.MaxOfflineQos0Msg < 0 {
+		return fmt.Errorf("invalid max_offline_qos0_messages : %d", c.MaxOfflineQos0Msg)
+	}
+	if c.QueueOverflowStrategy != "" && c.QueueOverflowStrategy != QueueOverflowDropOldest &&
+		c.QueueOverflowStrategy != QueueOverflowDropNewest && c.QueueOverflowStrategy != QueueOverflowReject {
+		return fmt.Errorf("invalid queue_overflow_strategy: %s", c.QueueOverflowStrategy)
+	}
+	if c.MaxKeepAlive != 0 && c.MinKeepAlive > c.MaxKeepAlive {
+		return fmt.Errorf("min_keepalive %d is bigger than max_keepalive %d", c.MinKeepAlive, c.MaxKeepAlive)
+	}
 	if c.ReceiveMax == 0 {
 		return fmt.Errorf("server_receive_maximum cannot be 0")
 	}
@@ -110,6 +378,82 @@ func (c MQTT) Validate() error {
 	if c.DeliveryMode != Overlap && c.DeliveryMode != OnlyOnce {
 		return fmt.Errorf("invalid delivery_mode: %s", c.DeliveryMode)
 	}
+	if c.SharedSubscriptionStrategy != "" && c.SharedSubscriptionStrategy != SharedSubscriptionRandom && c.SharedSubscriptionStrategy != SharedSubscriptionRoundRobin {
+		return fmt.Errorf("invalid shared_subscription_strategy: %s", c.SharedSubscriptionStrategy)
+	}
+	if c.InflightTrimPolicy != "" && c.InflightTrimPolicy != InflightRedeliver && c.InflightTrimPolicy != InflightDrop {
+		return fmt.Errorf("invalid inflight_trim_policy: %s", c.InflightTrimPolicy)
+	}
+	if c.UnknownPubrelPolicy != "" && c.UnknownPubrelPolicy != UnknownPubrelComplete && c.UnknownPubrelPolicy != UnknownPubrelDisconnect {
+		return fmt.Errorf("invalid unknown_pubrel_policy: %s", c.UnknownPubrelPolicy)
+	}
+	if c.V3UnsupportedPolicy != "" && c.V3UnsupportedPolicy != V3UnsupportedDisconnect && c.V3UnsupportedPolicy != V3UnsupportedDowngrade {
+		return fmt.Errorf("invalid v3_unsupported_policy: %s", c.V3UnsupportedPolicy)
+	}
+	if c.MaxRetainedMessages < 0 {
+		return fmt.Errorf("invalid max_retained_messages: %d", c.MaxRetainedMessages)
+	}
+	if c.MaxRetainedMessageBytes < 0 {
+		return fmt.Errorf("invalid max_retained_message_bytes: %d", c.MaxRetainedMessageBytes)
+	}
+	if c.RetainedLimitPolicy != "" && c.RetainedLimitPolicy != RetainedLimitEvict && c.RetainedLimitPolicy != RetainedLimitReject {
+		return fmt.Errorf("invalid retained_limit_policy: %s", c.RetainedLimitPolicy)
+	}
+	if c.FanoutWorkers < 0 {
+		return fmt.Errorf("invalid fanout_workers: %d", c.FanoutWorkers)
+	}
+	if c.MaxTopicLength < 0 {
+		return fmt.Errorf("invalid max_topic_length: %d", c.MaxTopicLength)
+	}
+	if c.DeliveryRateLimit < 0 {
+		return fmt.Errorf("invalid delivery_rate_limit: %d", c.DeliveryRateLimit)
+	}
+	if c.WriteBufferSize < 0 {
+		return fmt.Errorf("invalid write_buffer_size: %d", c.WriteBufferSize)
+	}
+	if c.WriteBufferPolicy != "" && c.WriteBufferPolicy != WriteBufferBlock &&
+		c.WriteBufferPolicy != WriteBufferDropOldest && c.WriteBufferPolicy != WriteBufferDisconnect {
+		return fmt.Errorf("invalid write_buffer_policy: %s", c.WriteBufferPolicy)
+	}
+	if c.WriteBufferTimeout < 0 {
+		return fmt.Errorf("invalid write_buffer_timeout: %s", c.WriteBufferTimeout)
+	}
+	if c.MaxSessionsPerUsername < 0 {
+		return fmt.Errorf("invalid max_sessions_per_username: %d", c.MaxSessionsPerUsername)
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("invalid max_connections: %d", c.MaxConnections)
+	}
+	if c.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("invalid max_connections_per_ip: %d", c.MaxConnectionsPerIP)
+	}
+	if c.MaxSubscriptionsPerClient < 0 {
+		return fmt.Errorf("invalid max_subscriptions_per_client: %d", c.MaxSubscriptionsPerClient)
+	}
+	if c.MaxTotalSubscriptions < 0 {
+		return fmt.Errorf("invalid max_total_subscriptions: %d", c.MaxTotalSubscriptions)
+	}
+	if c.MaxUserProperties < 0 {
+		return fmt.Errorf("invalid max_user_properties: %d", c.MaxUserProperties)
+	}
+	if c.MaxUserPropertiesBytes < 0 {
+		return fmt.Errorf("invalid max_user_properties_bytes: %d", c.MaxUserPropertiesBytes)
+	}
+	if c.ConnectTimeout <= 0 {
+		return fmt.Errorf("invalid connect_timeout: %s", c.ConnectTimeout)
+	}
+	if c.FirstPacketTimeout < 0 {
+		return fmt.Errorf("invalid first_packet_timeout: %s", c.FirstPacketTimeout)
+	}
+	if c.ConnectRejectionBufferSize < 0 {
+		return fmt.Errorf("invalid connect_rejection_buffer_size: %d", c.ConnectRejectionBufferSize)
+	}
+	if c.SessionLimitPolicy != "" && c.SessionLimitPolicy != SessionLimitReject && c.SessionLimitPolicy != SessionLimitEvictOldest {
+		return fmt.Errorf("invalid session_limit_policy: %s", c.SessionLimitPolicy)
+	}
+	if c.ProtocolCompliance != "" && c.ProtocolCompliance != ProtocolComplianceStrict && c.ProtocolCompliance != ProtocolComplianceLenient {
+		return fmt.Errorf("invalid protocol_compliance: %s", c.ProtocolCompliance)
+	}
 
 	if c.MaxQueuedMsg < int(c.MaxInflight) {
 		return fmt.Errorf("max_queued_message cannot be less than max_inflight")
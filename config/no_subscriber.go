@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+var (
+	// DefaultNoSubscriber is the default value of NoSubscriber
+	DefaultNoSubscriber = NoSubscriber{
+		DeadLetter:       false,
+		DeadLetterPrefix: "$unmatched",
+	}
+)
+
+// NoSubscriber is the config of the messages which are published by the clients but match no subscription.
+// Such messages are acknowledged and discarded as required by the spec, see server.OnNoSubscriber to get notified.
+type NoSubscriber struct {
+	// DeadLetter indicates whether to republish the unmatched messages under DeadLetterPrefix,
+	// which helps to catch the misconfigured publishers sending to the topics nobody listens on.
+	// The retained messages are not republished, because they are kept by the retained store.
+	DeadLetter bool `yaml:"dead_letter"`
+	// DeadLetterPrefix is the topic prefix of the republished messages,
+	// the message published to "a/b" is republished to "{DeadLetterPrefix}/a/b".
+	// The prefix beginning with "$" is recommended, so that the dead letters are not matched by the "#" subscriptions.
+	DeadLetterPrefix string `yaml:"dead_letter_prefix"`
+}
+
+func (n NoSubscriber) Validate() error {
+	if !n.DeadLetter {
+		return nil
+	}
+	if n.DeadLetterPrefix == "" || strings.HasSuffix(n.DeadLetterPrefix, "/") || !packets.ValidTopicName(true, []byte(n.DeadLetterPrefix)) {
+		return fmt.Errorf("invalid no_subscriber.dead_letter_prefix: %s", n.DeadLetterPrefix)
+	}
+	return nil
+}
@@ -14,19 +14,48 @@ const (
 	PersistenceTypeRedis  PersistenceType = "redis"
 )
 
+type InflightGranularity = string
+
+const (
+	// InflightGranularityFull persists every state transition of the inflight messages,
+	// e.g: the packet id assigned when the PUBLISH is sent, the PUBREL which replaces the PUBLISH after PUBREC received.
+	// The inflight state survives a broker crash in the middle of the handshake.
+	InflightGranularityFull InflightGranularity = "full"
+	// InflightGranularityMessage only persists when the message is accepted into the queue and when it is acknowledged.
+	// The inflight state is kept in memory, so the inflight messages will be redelivered as new messages after a broker crash.
+	InflightGranularityMessage InflightGranularity = "message"
+)
+
 var (
 	defaultMaxActive = uint(0)
 	defaultMaxIdle   = uint(1000)
+	// DefaultQueueFlushWindow is the default value of RedisPersistence.QueueFlushWindow.
+	DefaultQueueFlushWindow = 2 * time.Millisecond
+	// DefaultQueueMaxBatch is the default value of RedisPersistence.QueueMaxBatch.
+	DefaultQueueMaxBatch = 500
+	// DefaultQueueOverflowTimeout is the default value of Persistence.QueueOverflowTimeout.
+	DefaultQueueOverflowTimeout = time.Second
+	// DefaultPersistenceHealthCheck is the default value of Persistence.HealthCheck.
+	DefaultPersistenceHealthCheck = PersistenceHealthCheck{
+		Interval:         10 * time.Second,
+		Timeout:          3 * time.Second,
+		FailureThreshold: 3,
+	}
 	// DefaultPersistenceConfig is the default value of Persistence
 	DefaultPersistenceConfig = Persistence{
-		Type: PersistenceTypeMemory,
+		Type:                 PersistenceTypeMemory,
+		InflightGranularity:  InflightGranularityFull,
+		HealthCheck:          DefaultPersistenceHealthCheck,
+		QueueOverflowTimeout: DefaultQueueOverflowTimeout,
 		Redis: RedisPersistence{
-			Addr:        "127.0.0.1:6379",
-			Password:    "",
-			Database:    0,
-			MaxIdle:     &defaultMaxIdle,
-			MaxActive:   &defaultMaxActive,
-			IdleTimeout: 240 * time.Second,
+			Addr:             "127.0.0.1:6379",
+			Password:         "",
+			Database:         0,
+			MaxIdle:          &defaultMaxIdle,
+			MaxActive:        &defaultMaxActive,
+			IdleTimeout:      240 * time.Second,
+			QueueFlushWindow: DefaultQueueFlushWindow,
+			QueueMaxBatch:    DefaultQueueMaxBatch,
 		},
 	}
 )
@@ -36,8 +65,55 @@ type Persistence struct {
 	// Type is the persistence type.
 	// If empty, use "memory" as default.
 	Type PersistenceType `yaml:"type"`
+	// InflightGranularity is the granularity of persisting the inflight state of the outgoing QoS 1 and QoS 2 messages.
+	// Possible values: full, message. It only takes effect on the durable backend, i.e: redis.
+	// If empty, use "full" as default.
+	InflightGranularity InflightGranularity `yaml:"inflight_granularity"`
 	// Redis is the redis configuration and must be set when Type ==  "redis".
 	Redis RedisPersistence `yaml:"redis"`
+	// HealthCheck is the periodic health check of the backend.
+	HealthCheck PersistenceHealthCheck `yaml:"health_check"`
+	// QueueMemoryWindow is the maximum number of messages kept in memory per client when Type == "memory".
+	// The messages beyond the window are spilled to the redis configured by Redis, and paged in when they are delivered.
+	// MQTT.MaxQueuedMsg is the limit of the messages in memory and in redis.
+	// 0 means all messages are kept in memory.
+	QueueMemoryWindow int `yaml:"queue_memory_window"`
+	// QueueOverflowTimeout is the connect, read and write timeout of the redis connections used by the spilled messages.
+	// The messages are spilled and paged in while the queue is locked, and the enqueue holds the server lock,
+	// so a slow redis stalls the message routing of the whole broker until the timeout.
+	// The message which fails to be spilled is dropped. 0 means no timeout.
+	QueueOverflowTimeout time.Duration `yaml:"queue_overflow_timeout"`
+	// MemorySnapshot is the disk snapshot of the memory persistence, it only takes effect when Type == "memory".
+	MemorySnapshot MemorySnapshot `yaml:"memory_snapshot"`
+}
+
+// MemorySnapshot is the config of the disk snapshot of the memory persistence.
+// The sessions, subscriptions, queued messages and retained messages are written into the file
+// in the backup stream format, and are loaded from the file on startup.
+// If the file is corrupted, the error is logged and the broker starts with an empty state.
+type MemorySnapshot struct {
+	// Path is the path of the snapshot file, empty value disables the snapshot.
+	Path string `yaml:"path"`
+	// Interval is the interval between two periodic snapshots.
+	// 0 means the snapshot is only written when the broker stops.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// PersistenceHealthCheck is the config of the periodic health check of the persistence backend.
+// It only takes effect if the persistence implements server.HealthCheckPersistence.
+type PersistenceHealthCheck struct {
+	// Interval is the interval between two probes, 0 disables the health check.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is the timeout of each probe.
+	Timeout time.Duration `yaml:"timeout"`
+	// FailureThreshold is the number of the consecutive failed probes before the backend is considered unhealthy.
+	// The backend is considered healthy again once a probe succeeds.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// RejectPersistentSessions indicates whether to reject the clients which require a persistent session
+	// with the CONNACK "Server unavailable" while the backend is unhealthy.
+	// A session is persistent if the session expiry interval is not 0 for MQTT v5 clients, or clean session is 0 for MQTT v3.1.1 clients.
+	// The clients with non-persistent sessions are still accepted.
+	RejectPersistentSessions bool `yaml:"reject_persistent_sessions"`
 }
 
 // RedisPersistence is the configuration of redis persistence.
@@ -64,12 +140,32 @@ type RedisPersistence struct {
 	// Ff zero, use 240 * time.Second as default.
 	// This value will pass to redis.Pool.IdleTimeout.
 	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// QueueFlushWindow is the maximum duration that the enqueued messages wait to be written into redis.
+	// The messages enqueued within the window are written in one round trip using redis pipelining,
+	// which reduces the round trips of QoS 1 and QoS 2 fan-out significantly.
+	// Notice that the messages which have not been written are lost if the broker crashes.
+	// If zero, each message is written in its own round trip.
+	QueueFlushWindow time.Duration `yaml:"queue_flush_window"`
+	// QueueMaxBatch is the maximum number of the pending messages of all queues,
+	// the messages are written immediately when the limit is reached. 0 means no limit.
+	// It only takes effect when QueueFlushWindow is set.
+	QueueMaxBatch int `yaml:"queue_max_batch"`
+	// VerifyQueueOnInit indicates whether to verify the delivery order of the queue when the session is resumed.
+	// The anomalies are logged, see queue.VerifyElems. It reads the whole queue from redis, so it is disabled by default.
+	VerifyQueueOnInit bool `yaml:"verify_queue_on_init"`
+	// DropDuplicateQueueElems indicates whether to remove the duplicate elems found by the verification.
+	// It only takes effect when VerifyQueueOnInit is true.
+	DropDuplicateQueueElems bool `yaml:"drop_duplicate_queue_elems"`
 }
 
 func (p *Persistence) Validate() error {
 	if p.Type != PersistenceTypeMemory && p.Type != PersistenceTypeRedis {
 		return errors.New("invalid persistence type")
 	}
+	if p.InflightGranularity != "" && p.InflightGranularity != InflightGranularityFull &&
+		p.InflightGranularity != InflightGranularityMessage {
+		return errors.New("invalid persistence inflight_granularity")
+	}
 	_, _, err := net.SplitHostPort(p.Redis.Addr)
 	if err != nil {
 		return err
@@ -77,5 +173,31 @@ func (p *Persistence) Validate() error {
 	if p.Redis.Database < 0 {
 		return errors.New("invalid redis database number")
 	}
+	if p.Redis.QueueFlushWindow < 0 {
+		return errors.New("invalid redis queue_flush_window")
+	}
+	if p.Redis.QueueMaxBatch < 0 {
+		return errors.New("invalid redis queue_max_batch")
+	}
+	if p.QueueMemoryWindow < 0 {
+		return errors.New("invalid persistence queue_memory_window")
+	}
+	if p.QueueOverflowTimeout < 0 {
+		return errors.New("invalid persistence queue_overflow_timeout")
+	}
+	if p.MemorySnapshot.Interval < 0 {
+		return errors.New("invalid persistence memory_snapshot.interval")
+	}
+	if p.HealthCheck.Interval < 0 {
+		return errors.New("invalid persistence health_check.interval")
+	}
+	if p.HealthCheck.Interval > 0 {
+		if p.HealthCheck.Timeout <= 0 {
+			return errors.New("invalid persistence health_check.timeout")
+		}
+		if p.HealthCheck.FailureThreshold <= 0 {
+			return errors.New("invalid persistence health_check.failure_threshold")
+		}
+	}
 	return nil
 }
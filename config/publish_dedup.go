@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// DefaultPublishDedup is the default value of PublishDedup
+	DefaultPublishDedup = PublishDedup{
+		TTL:          0,
+		MaxEntries:   1000,
+		UserProperty: "idempotency-key",
+	}
+)
+
+// PublishDedup is the config of the opt-in deduplication of the QoS 1 messages published by the v5 clients.
+//
+// The publisher attaches an idempotency key to the message by the user property named UserProperty.
+// The server remembers the keys of the routed messages for each client id, the QoS 1 message with a remembered key
+// is acknowledged without being routed again, which approximates exactly-once delivery at the cost of QoS 1.
+// The keys of each client are bounded by MaxEntries, the least recently seen key is evicted if the cache is full.
+// The keys are kept until they expire, so that the message resent after a reconnection is deduplicated as well.
+type PublishDedup struct {
+	// TTL is the duration for which the keys are remembered, 0 disables the deduplication.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxEntries is the maximum number of the keys remembered for each client.
+	MaxEntries int `yaml:"max_entries"`
+	// UserProperty is the name of the user property which carries the idempotency key.
+	UserProperty string `yaml:"user_property"`
+}
+
+// Enabled reports whether the deduplication is enabled.
+func (p PublishDedup) Enabled() bool {
+	return p.TTL > 0
+}
+
+func (p PublishDedup) Validate() error {
+	if p.TTL < 0 {
+		return fmt.Errorf("invalid publish_dedup.ttl: %s", p.TTL)
+	}
+	if !p.Enabled() {
+		return nil
+	}
+	if p.MaxEntries <= 0 {
+		return fmt.Errorf("invalid publish_dedup.max_entries: %d", p.MaxEntries)
+	}
+	if p.UserProperty == "" {
+		return fmt.Errorf("publish_dedup.user_property cannot be empty")
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import "fmt"
+
+// The policies for the QoS 1 and QoS 2 messages which exceed the publish rate limit.
+const (
+	// PublishRateLimitReject rejects the message with the Quota exceeded(0x97) reason code in the PUBACK/PUBREC.
+	// The message is acknowledged and dropped for the MQTT v3.1.1 clients.
+	PublishRateLimitReject = "reject"
+	// PublishRateLimitThrottle stops handling the packets of the client until the message is allowed.
+	PublishRateLimitThrottle = "throttle"
+)
+
+var (
+	// DefaultPublishRateLimit is the default value of PublishRateLimit
+	DefaultPublishRateLimit = PublishRateLimit{
+		MessagesPerSecond: 0,
+		BytesPerSecond:    0,
+		Policy:            PublishRateLimitReject,
+	}
+)
+
+// PublishRateLimit is the config of the inbound PUBLISH rate limit of each client.
+// The QoS 0 messages which exceed the limit are always dropped,
+// the QoS 1 and QoS 2 messages are handled according to the Policy.
+type PublishRateLimit struct {
+	// MessagesPerSecond is the maximum number of PUBLISH packets received from a client per second.
+	// 0 means unlimited.
+	MessagesPerSecond int `yaml:"messages_per_second"`
+	// BytesPerSecond is the maximum payload bytes received from a client per second.
+	// 0 means unlimited.
+	BytesPerSecond int `yaml:"bytes_per_second"`
+	// Policy is the policy for the QoS 1 and QoS 2 messages which exceed the limit, "reject" or "throttle".
+	Policy string `yaml:"policy"`
+}
+
+// Enabled reports whether any of the limits is set.
+func (p PublishRateLimit) Enabled() bool {
+	return p.MessagesPerSecond > 0 || p.BytesPerSecond > 0
+}
+
+func (p PublishRateLimit) Validate() error {
+	if p.MessagesPerSecond < 0 {
+		return fmt.Errorf("invalid publish_rate_limit.messages_per_second: %d", p.MessagesPerSecond)
+	}
+	if p.BytesPerSecond < 0 {
+		return fmt.Errorf("invalid publish_rate_limit.bytes_per_second: %d", p.BytesPerSecond)
+	}
+	if p.Policy != PublishRateLimitReject && p.Policy != PublishRateLimitThrottle {
+		return fmt.Errorf("invalid publish_rate_limit.policy: %s", p.Policy)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// DefaultReconnectStorm is the default value of ReconnectStorm
+	DefaultReconnectStorm = ReconnectStorm{
+		Enable:          false,
+		Threshold:       1000,
+		SustainedPeriod: 10 * time.Second,
+		MitigatedRate:   200,
+		CoolDownPeriod:  30 * time.Second,
+	}
+)
+
+// ReconnectStorm is the config of the reconnect storm detector.
+// The detector measures the rate of new connections, and tightens the accept rate automatically
+// if the rate exceeds Threshold for SustainedPeriod, e.g: when a large number of devices are rebooting at the same time.
+// The mitigation is relaxed once the rate stays below Threshold for CoolDownPeriod.
+type ReconnectStorm struct {
+	// Enable indicates whether to enable the reconnect storm detector.
+	Enable bool `yaml:"enable"`
+	// Threshold is the number of new connections per second above which the detector considers a storm is happening.
+	Threshold int `yaml:"threshold"`
+	// SustainedPeriod is the minimum duration that the new connection rate must exceed Threshold before the mitigation is activated.
+	SustainedPeriod time.Duration `yaml:"sustained_period"`
+	// MitigatedRate is the maximum number of new connections per second that the server will accept while the mitigation is active.
+	// Connections beyond the rate will be closed right after accepted.
+	MitigatedRate int `yaml:"mitigated_rate"`
+	// CoolDownPeriod is the minimum duration that the new connection rate must stay below Threshold before the mitigation is relaxed.
+	CoolDownPeriod time.Duration `yaml:"cool_down_period"`
+}
+
+func (r ReconnectStorm) Validate() error {
+	if !r.Enable {
+		return nil
+	}
+	if r.Threshold <= 0 {
+		return fmt.Errorf("invalid reconnect_storm.threshold: %d", r.Threshold)
+	}
+	if r.MitigatedRate <= 0 {
+		return fmt.Errorf("invalid reconnect_storm.mitigated_rate: %d", r.MitigatedRate)
+	}
+	if r.MitigatedRate > r.Threshold {
+		return fmt.Errorf("reconnect_storm.mitigated_rate cannot be greater than reconnect_storm.threshold")
+	}
+	if r.SustainedPeriod < 0 {
+		return fmt.Errorf("invalid reconnect_storm.sustained_period: %s", r.SustainedPeriod)
+	}
+	if r.CoolDownPeriod < 0 {
+		return fmt.Errorf("invalid reconnect_storm.cool_down_period: %s", r.CoolDownPeriod)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+)
+
+var (
+	// DefaultRedirect is the default value of Redirect
+	DefaultRedirect = Redirect{
+		Enable: false,
+		Ratio:  1,
+	}
+)
+
+// Redirect is the config of the server redirection for load shedding.
+// Once the number of the connected clients reaches Threshold, a Ratio fraction of the new MQTT v5 clients
+// are rejected with the CONNACK "Use another server"(0x9C) or "Server moved"(0x9D),
+// and the Server Reference property points at one of the Servers in turn.
+// The MQTT v3.1.1 clients cannot be redirected, they are always accepted.
+//
+// The policy can be replaced by the OnRedirect hook.
+type Redirect struct {
+	// Enable indicates whether to enable the redirection.
+	Enable bool `yaml:"enable"`
+	// Threshold is the number of the connected clients from which the new clients are redirected.
+	Threshold int `yaml:"threshold"`
+	// Ratio is the fraction of the new clients to be redirected once Threshold is reached, in (0, 1].
+	Ratio float64 `yaml:"ratio"`
+	// Servers is the list of the Server Reference values, e.g: "broker2.example.com:1883".
+	Servers []string `yaml:"servers"`
+	// ServerMoved indicates whether to reply "Server moved"(0x9D) instead of "Use another server"(0x9C),
+	// i.e: the client should use the other server permanently.
+	ServerMoved bool `yaml:"server_moved"`
+}
+
+func (r Redirect) Validate() error {
+	if !r.Enable {
+		return nil
+	}
+	if r.Threshold < 0 {
+		return fmt.Errorf("invalid redirect.threshold: %d", r.Threshold)
+	}
+	if r.Ratio <= 0 || r.Ratio > 1 {
+		return fmt.Errorf("invalid redirect.ratio: %v", r.Ratio)
+	}
+	if len(r.Servers) == 0 {
+		return fmt.Errorf("redirect.servers cannot be empty")
+	}
+	for _, v := range r.Servers {
+		if v == "" {
+			return fmt.Errorf("redirect.servers cannot contain empty value")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// DefaultSlowConsumer is the default value of SlowConsumer
+	DefaultSlowConsumer = SlowConsumer{
+		Enable:        false,
+		HighWaterMark: 1000,
+		Duration:      time.Minute,
+		Disconnect:    true,
+		RemoveSession: false,
+	}
+)
+
+// SlowConsumer is the config of the slow consumer detector.
+// A connected client is considered a slow consumer if the length of its message queue stays above HighWaterMark
+// for longer than Duration, e.g: a client which subscribes but never reads.
+// The detector is based on the queue length statistics, the queues are not polled.
+type SlowConsumer struct {
+	// Enable indicates whether to enable the slow consumer detector.
+	Enable bool `yaml:"enable"`
+	// HighWaterMark is the queue length above which the client is considered falling behind.
+	// It should be less than MQTT.MaxQueuedMsg, otherwise the queue is full before the mark is exceeded.
+	HighWaterMark int `yaml:"high_water_mark"`
+	// Duration is the minimum duration that the queue length must stay above HighWaterMark
+	// before the client is reported as a slow consumer. The duration is counted since the client connected at the earliest.
+	Duration time.Duration `yaml:"duration"`
+	// Disconnect indicates whether to disconnect the slow consumer after the OnSlowConsumer hook has been called.
+	// If false, the slow consumer is only reported, once every Duration while the queue length stays above HighWaterMark.
+	Disconnect bool `yaml:"disconnect"`
+	// RemoveSession indicates whether to remove the session of the disconnected slow consumer, which releases its queued messages.
+	// Otherwise, the session is kept and the queued messages are delivered after the client reconnects.
+	RemoveSession bool `yaml:"remove_session"`
+}
+
+func (s SlowConsumer) Validate() error {
+	if !s.Enable {
+		return nil
+	}
+	if s.HighWaterMark <= 0 {
+		return fmt.Errorf("invalid slow_consumer.high_water_mark: %d", s.HighWaterMark)
+	}
+	if s.Duration <= 0 {
+		return fmt.Errorf("invalid slow_consumer.duration: %s", s.Duration)
+	}
+	return nil
+}
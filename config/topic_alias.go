@@ -4,6 +4,7 @@ type TopicAliasType = string
 
 const (
 	TopicAliasMgrTypeFIFO TopicAliasType = "fifo"
+	TopicAliasMgrTypeLRU  TopicAliasType = "lru"
 )
 
 var (
@@ -16,4 +17,13 @@ var (
 // TopicAliasManager is the config of the topic alias manager.
 type TopicAliasManager struct {
 	Type TopicAliasType
+	// Max is the maximum number of outbound topic aliases cached for each client.
+	// The effective value is the smaller one of Max and the Topic Alias Maximum advertised by the client.
+	// 0 means using the client's Topic Alias Maximum.
+	Max uint16 `yaml:"max"`
+	// PrimeOnResume indicates whether to prime the outbound topic aliases with the most used topics of the previous connection
+	// when a session resumes, so that the first deliveries after reconnect use the aliases immediately.
+	// The full topic name is still sent on the first use of each alias.
+	// It only takes effect when the topic alias manager implements server.TopicAliasPrimer.
+	PrimeOnResume bool `yaml:"prime_on_resume"`
 }
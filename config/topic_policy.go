@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// DefaultTopicPolicy is the default value of TopicPolicy, it has no rules.
+var DefaultTopicPolicy = TopicPolicy{}
+
+// TopicPolicy is the config of the message-property policy of the inbound PUBLISH packets,
+// e.g: the messages of "cmd/#" may only be published at QoS 1 or QoS 2 and may not be retained.
+// It is checked after the authorization, the violating messages are neither retained nor routed,
+// and they are rejected with "Implementation specific error"(0x83) in the PUBACK/PUBREC for the MQTT v5 clients.
+//
+// The policy can be replaced by the OnTopicPolicy hook.
+type TopicPolicy struct {
+	// Rules is the list of the rules, the most specific rule which matches the topic name applies.
+	// The literal level is more specific than "+", which is more specific than "#".
+	// The rules are compared level by level, and the first rule wins if they are equally specific.
+	Rules []TopicPolicyRule `yaml:"rules"`
+}
+
+// TopicPolicyRule is the policy of the topic names which match TopicFilter.
+type TopicPolicyRule struct {
+	// TopicFilter is the topic pattern of the rule, the wildcards "+" and "#" are supported.
+	TopicFilter string `yaml:"topic_filter"`
+	// MinQoS is the minimum QoS of the messages.
+	MinQoS uint8 `yaml:"min_qos"`
+	// MaxQoS is the maximum QoS of the messages, nil means no limit.
+	MaxQoS *uint8 `yaml:"max_qos"`
+	// NoRetain indicates whether the messages must not be retained.
+	NoRetain bool `yaml:"no_retain"`
+}
+
+func (t TopicPolicy) Validate() error {
+	for _, v := range t.Rules {
+		if !packets.ValidTopicFilter(true, []byte(v.TopicFilter)) {
+			return fmt.Errorf("invalid topic_policy.rules.topic_filter: %s", v.TopicFilter)
+		}
+		if v.MinQoS > packets.Qos2 {
+			return fmt.Errorf("invalid topic_policy.rules.min_qos: %d", v.MinQoS)
+		}
+		if v.MaxQoS != nil && (*v.MaxQoS > packets.Qos2 || *v.MaxQoS < v.MinQoS) {
+			return fmt.Errorf("invalid topic_policy.rules.max_qos: %d", *v.MaxQoS)
+		}
+	}
+	return nil
+}
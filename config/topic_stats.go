@@ -0,0 +1,36 @@
+package config
+
+import "fmt"
+
+var (
+	// DefaultTopicStats is the default value of TopicStats
+	DefaultTopicStats = TopicStats{
+		Enable:   false,
+		Capacity: 1000,
+	}
+)
+
+// TopicStats is the config of the per-topic publish statistics.
+// If enabled, the server counts the messages published by the clients for the most published topics,
+// which helps to find the hot topics without instrumenting the clients.
+// The topics are tracked in a fixed number of slots by the Space-Saving algorithm,
+// thus the memory is bounded regardless of the number of the distinct topics,
+// and the counts of the less published topics are estimations.
+type TopicStats struct {
+	// Enable indicates whether to enable the topic statistics.
+	Enable bool `yaml:"enable"`
+	// Capacity is the maximum number of the tracked topics.
+	// The topic published more than 1/Capacity of all messages is guaranteed to be tracked,
+	// so it should be several times larger than the number of the topics to read.
+	Capacity int `yaml:"capacity"`
+}
+
+func (t TopicStats) Validate() error {
+	if !t.Enable {
+		return nil
+	}
+	if t.Capacity <= 0 {
+		return fmt.Errorf("invalid topic_stats.capacity: %d", t.Capacity)
+	}
+	return nil
+}
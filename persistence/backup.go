@@ -0,0 +1,317 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/encoding"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/session"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	redis_sub "github.com/DrmagicE/gmqtt/persistence/subscription/redis"
+)
+
+// The backup stream format:
+// magic | 2 byte version | records | end record
+// Each record is: 1 byte record type | 4 byte payload length | payload
+// The session payload is: client id | 4 byte will delay interval | 8 byte connected at | 4 byte expiry interval | will message,
+// the will message is at the end because encoding.DecodeMessage reads to the end of the buffer.
+// The retained payload is the retained message, the retained records follow the records of the clients.
+// Version 2 adds the retained record, the version 1 stream is still accepted.
+const backupVersion uint16 = 2
+
+var backupMagic = []byte("GMQTTBAK")
+
+const (
+	recordEnd byte = iota
+	recordSession
+	recordSubscription
+	recordElem
+	recordRetained
+)
+
+var errTruncatedBackup = errors.New("invalid backup: unexpected end of stream")
+
+// snapshot is the persisted state of the broker.
+type snapshot struct {
+	sessions      []*gmqtt.Session
+	subscriptions subscription.ClientSubscriptions
+	queues        map[string][]*queue.Elem
+	retained      []*gmqtt.Message
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{
+		subscriptions: make(subscription.ClientSubscriptions),
+		queues:        make(map[string][]*queue.Elem),
+	}
+}
+
+// readSnapshot reads the state of the clients in the session store.
+// The queue function returns the queue store of the given client, nil means the client has no queue.
+func readSnapshot(ss session.Store, subs subscription.Store, getQueue func(clientID string) (queue.Store, error)) (*snapshot, error) {
+	s := newSnapshot()
+	if ss == nil {
+		return s, nil
+	}
+	err := ss.Iterate(func(sess *gmqtt.Session) bool {
+		s.sessions = append(s.sessions, sess)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range s.sessions {
+		if subs != nil {
+			if rs := subscription.GetClientSubscriptions(subs, v.ClientID, subscription.TypeAll); len(rs) != 0 {
+				s.subscriptions[v.ClientID] = rs
+			}
+		}
+		qs, err := getQueue(v.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if qs == nil {
+			continue
+		}
+		sn, ok := qs.(queue.Snapshotter)
+		if !ok {
+			return nil, fmt.Errorf("queue store of client %s does not support snapshot", v.ClientID)
+		}
+		elems, err := sn.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		if len(elems) != 0 {
+			s.queues[v.ClientID] = elems
+		}
+	}
+	return s, nil
+}
+
+func writeRecord(w io.Writer, typ byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// encode writes the snapshot into w in the backup stream format.
+func (s *snapshot) encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(backupMagic)+2)
+	copy(header, backupMagic)
+	binary.BigEndian.PutUint16(header[len(backupMagic):], backupVersion)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	for _, v := range s.sessions {
+		b := &bytes.Buffer{}
+		encodeSession(v, b)
+		if err := writeRecord(bw, recordSession, b.Bytes()); err != nil {
+			return err
+		}
+		for _, sub := range s.subscriptions[v.ClientID] {
+			b := &bytes.Buffer{}
+			encoding.WriteString(b, []byte(v.ClientID))
+			b.Write(redis_sub.EncodeSubscription(sub))
+			if err := writeRecord(bw, recordSubscription, b.Bytes()); err != nil {
+				return err
+			}
+		}
+		for _, elem := range s.queues[v.ClientID] {
+			b := &bytes.Buffer{}
+			encoding.WriteString(b, []byte(v.ClientID))
+			b.Write(elem.Encode())
+			if err := writeRecord(bw, recordElem, b.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, v := range s.retained {
+		b := &bytes.Buffer{}
+		encoding.EncodeMessage(v, b)
+		if err := writeRecord(bw, recordRetained, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := writeRecord(bw, recordEnd, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// decodeSnapshot reads the whole stream, so that a corrupted stream is rejected before anything is restored.
+func decodeSnapshot(r io.Reader) (*snapshot, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(backupMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errTruncatedBackup
+	}
+	if !bytes.Equal(header[:len(backupMagic)], backupMagic) {
+		return nil, errors.New("invalid backup: magic mismatch")
+	}
+	if v := binary.BigEndian.Uint16(header[len(backupMagic):]); v == 0 || v > backupVersion {
+		return nil, fmt.Errorf("unsupported backup version: %d", v)
+	}
+	s := newSnapshot()
+	recordHeader := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(br, recordHeader); err != nil {
+			return nil, errTruncatedBackup
+		}
+		if recordHeader[0] == recordEnd {
+			return s, nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(recordHeader[1:]))
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return nil, errTruncatedBackup
+		}
+		if err := s.decodeRecord(recordHeader[0], bytes.NewBuffer(payload)); err != nil {
+			return nil, fmt.Errorf("invalid backup: %w", err)
+		}
+	}
+}
+
+func encodeSession(sess *gmqtt.Session, b *bytes.Buffer) {
+	encoding.WriteString(b, []byte(sess.ClientID))
+	encoding.WriteUint32(b, sess.WillDelayInterval)
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint64(t, uint64(sess.ConnectedAt.Unix()))
+	b.Write(t)
+	encoding.WriteUint32(b, sess.ExpiryInterval)
+	encoding.EncodeMessage(sess.Will, b)
+}
+
+func decodeSession(b *bytes.Buffer) (sess *gmqtt.Session, err error) {
+	sess = &gmqtt.Session{}
+	cid, err := encoding.ReadString(b)
+	if err != nil {
+		return nil, err
+	}
+	sess.ClientID = string(cid)
+	sess.WillDelayInterval, err = encoding.ReadUint32(b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Len() < 8 {
+		return nil, errors.New("invalid length")
+	}
+	sess.ConnectedAt = time.Unix(int64(binary.BigEndian.Uint64(b.Next(8))), 0)
+	sess.ExpiryInterval, err = encoding.ReadUint32(b)
+	if err != nil {
+		return nil, err
+	}
+	sess.Will, err = encoding.DecodeMessageFromBytes(b.Bytes())
+	return sess, err
+}
+
+func (s *snapshot) decodeRecord(typ byte, b *bytes.Buffer) error {
+	switch typ {
+	case recordSession:
+		sess, err := decodeSession(b)
+		if err != nil {
+			return err
+		}
+		s.sessions = append(s.sessions, sess)
+		return nil
+	case recordRetained:
+		msg, err := encoding.DecodeMessageFromBytes(b.Bytes())
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			return errors.New("empty retained message")
+		}
+		s.retained = append(s.retained, msg)
+		return nil
+	}
+	cid, err := encoding.ReadString(b)
+	if err != nil {
+		return err
+	}
+	clientID := string(cid)
+	if len(s.sessions) == 0 || s.sessions[len(s.sessions)-1].ClientID != clientID {
+		return fmt.Errorf("record of client %s is not following its session", clientID)
+	}
+	switch typ {
+	case recordSubscription:
+		sub, err := redis_sub.DecodeSubscription(b.Bytes())
+		if err != nil {
+			return err
+		}
+		s.subscriptions[clientID] = append(s.subscriptions[clientID], sub)
+	case recordElem:
+		elem := &queue.Elem{}
+		if err := elem.Decode(b.Bytes()); err != nil {
+			return err
+		}
+		s.queues[clientID] = append(s.queues[clientID], elem)
+	default:
+		return fmt.Errorf("unknown record type: %d", typ)
+	}
+	return nil
+}
+
+// restore writes the snapshot into the stores.
+// The queue function returns the queue store of the given client which the elems are added to.
+func (s *snapshot) restore(ss session.Store, subs subscription.Store, getQueue func(clientID string) (queue.Store, error)) error {
+	for _, v := range s.sessions {
+		if err := ss.Set(v); err != nil {
+			return err
+		}
+		if err := subs.UnsubscribeAll(v.ClientID); err != nil {
+			return err
+		}
+		if rs := s.subscriptions[v.ClientID]; len(rs) != 0 {
+			if _, err := subs.Subscribe(v.ClientID, rs...); err != nil {
+				return err
+			}
+		}
+		qs, err := getQueue(v.ClientID)
+		if err != nil {
+			return err
+		}
+		if err = restoreQueue(qs, s.queues[v.ClientID], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreQueue replaces the elems in the queue with the given elems.
+// The inflight elems keep the packet id, so they will be retransmitted after the client reconnects.
+func restoreQueue(qs queue.Store, elems []*queue.Elem, notifier queue.Notifier) error {
+	if notifier == nil {
+		notifier = nopNotifier{}
+	}
+	err := qs.Init(&queue.InitOptions{
+		CleanStart: true,
+		Notifier:   notifier,
+	})
+	if err != nil {
+		return err
+	}
+	for _, v := range elems {
+		if err = qs.Add(v); err != nil {
+			return err
+		}
+	}
+	return qs.Close()
+}
+
+type nopNotifier struct{}
+
+func (nopNotifier) NotifyDropped(elem *queue.Elem, err error) {}
+func (nopNotifier) NotifyInflightAdded(delta int)             {}
+func (nopNotifier) NotifyMsgQueueAdded(delta int)             {}
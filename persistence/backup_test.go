@@ -0,0 +1,185 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+// testBackupRestore backs up the state of src, restores it into dst after calling wipe, and verifies the state of dst.
+func testBackupRestore(t *testing.T, cfg config.Config, src, dst server.Persistence, wipe func()) {
+	a := assert.New(t)
+	ss, err := src.NewSessionStore(cfg)
+	a.Nil(err)
+	subs, err := src.NewSubscriptionStore(cfg)
+	a.Nil(err)
+	sessions := []*gmqtt.Session{
+		{ClientID: "c1", ConnectedAt: time.Unix(100, 0), ExpiryInterval: 10},
+		{
+			ClientID:          "c2",
+			Will:              &gmqtt.Message{Topic: "will", Payload: []byte("bye"), QoS: packets.Qos1},
+			WillDelayInterval: 5,
+			ConnectedAt:       time.Unix(200, 0),
+			ExpiryInterval:    20,
+		},
+	}
+	for _, v := range sessions {
+		a.Nil(ss.Set(v))
+	}
+	a.Nil(subs.Init([]string{"c1", "c2"}))
+	_, err = subs.Subscribe("c1",
+		&gmqtt.Subscription{TopicFilter: "a/b", QoS: packets.Qos1},
+		&gmqtt.Subscription{ShareName: "g", TopicFilter: "x/#", QoS: packets.Qos2, ID: 1})
+	a.Nil(err)
+	_, err = subs.Subscribe("c2", &gmqtt.Subscription{TopicFilter: "#", NoLocal: true})
+	a.Nil(err)
+
+	qs, err := src.NewQueueStore(cfg, nopNotifier{}, "c1")
+	a.Nil(err)
+	a.Nil(qs.Init(&queue.InitOptions{
+		CleanStart:     true,
+		Version:        packets.Version5,
+		ReadBytesLimit: packets.MaximumSize,
+		Notifier:       nopNotifier{},
+	}))
+	for _, topic := range []string{"t1", "t2", "t3"} {
+		a.Nil(qs.Add(&queue.Elem{
+			At: time.Unix(300, 0),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{Topic: topic, QoS: packets.Qos1, Payload: []byte(topic)},
+			},
+		}))
+	}
+	// t1 becomes inflight.
+	_, err = qs.ReadInflight(10)
+	a.Nil(err)
+	_, err = qs.Read([]packets.PacketID{1})
+	a.Nil(err)
+	a.Nil(qs.Close())
+
+	b := &bytes.Buffer{}
+	a.Nil(src.(server.BackupablePersistence).Backup(b))
+
+	wipe()
+	a.Nil(dst.(server.BackupablePersistence).Restore(b))
+	a.Nil(dst.Open())
+	defer dst.Close()
+	a.Equal(server.ErrPersistenceOpened, dst.(server.BackupablePersistence).Restore(bytes.NewReader(nil)))
+
+	dss, err := dst.NewSessionStore(cfg)
+	a.Nil(err)
+	for _, v := range sessions {
+		sess, err := dss.Get(v.ClientID)
+		a.Nil(err)
+		a.Equal(v.ExpiryInterval, sess.ExpiryInterval)
+		a.Equal(v.WillDelayInterval, sess.WillDelayInterval)
+		a.Equal(v.ConnectedAt.Unix(), sess.ConnectedAt.Unix())
+		if v.Will != nil {
+			a.Equal(v.Will.Topic, sess.Will.Topic)
+			a.Equal(v.Will.Payload, sess.Will.Payload)
+		}
+	}
+	dsubs, err := dst.NewSubscriptionStore(cfg)
+	a.Nil(err)
+	a.Nil(dsubs.Init([]string{"c1", "c2"}))
+	for _, cid := range []string{"c1", "c2"} {
+		a.ElementsMatch(subscription.GetClientSubscriptions(subs, cid, subscription.TypeAll),
+			subscription.GetClientSubscriptions(dsubs, cid, subscription.TypeAll))
+	}
+
+	dqs, err := dst.NewQueueStore(cfg, nopNotifier{}, "c1")
+	a.Nil(err)
+	elems, err := dqs.(queue.Snapshotter).Snapshot()
+	a.Nil(err)
+	var topics []string
+	var ids []packets.PacketID
+	for _, v := range elems {
+		topics = append(topics, v.MessageWithID.(*queue.Publish).Topic)
+		ids = append(ids, v.ID())
+		a.EqualValues(300, v.At.Unix())
+	}
+	a.Equal([]string{"t1", "t2", "t3"}, topics)
+	a.Equal([]packets.PacketID{1, 0, 0}, ids)
+}
+
+func TestDecodeSnapshot_invalid(t *testing.T) {
+	a := assert.New(t)
+	s := newSnapshot()
+	s.sessions = []*gmqtt.Session{{ClientID: "c1"}}
+	s.subscriptions["c1"] = []*gmqtt.Subscription{{TopicFilter: "a"}}
+	b := &bytes.Buffer{}
+	a.Nil(s.encode(b))
+	stream := b.Bytes()
+
+	rs, err := decodeSnapshot(bytes.NewReader(stream))
+	a.Nil(err)
+	a.Len(rs.sessions, 1)
+	a.Len(rs.subscriptions["c1"], 1)
+
+	// truncated
+	_, err = decodeSnapshot(bytes.NewReader(stream[:len(stream)-1]))
+	a.Error(err)
+	// unsupported version
+	v := append([]byte{}, stream...)
+	v[len(backupMagic)+1] = byte(backupVersion + 1)
+	_, err = decodeSnapshot(bytes.NewReader(v))
+	a.Error(err)
+	// not a backup
+	_, err = decodeSnapshot(bytes.NewReader([]byte("not a backup stream")))
+	a.Error(err)
+
+	// the queue elem stored by a newer release.
+	elem := &queue.Elem{At: time.Now(), MessageWithID: &queue.Pubrel{PacketID: 1}}
+	s.queues["c1"] = []*queue.Elem{elem}
+	b.Reset()
+	a.Nil(s.encode(b))
+	stream = b.Bytes()
+	i := bytes.Index(stream, elem.Encode())
+	a.True(i > 0)
+	stream[i] = queue.ElemFormatVersion + 1
+	_, err = decodeSnapshot(bytes.NewReader(stream))
+	var ufe *queue.UnsupportedFormatError
+	a.True(errors.As(err, &ufe))
+}
+
+func TestDecodeSnapshot_retained(t *testing.T) {
+	a := assert.New(t)
+	s := newSnapshot()
+	s.sessions = []*gmqtt.Session{{ClientID: "c1"}}
+	s.retained = []*gmqtt.Message{
+		{Topic: "a", Payload: []byte("a"), QoS: packets.Qos1, Retained: true},
+		{Topic: "b", Payload: []byte("b"), Retained: true, ContentType: "text/plain"},
+	}
+	b := &bytes.Buffer{}
+	a.Nil(s.encode(b))
+	rs, err := decodeSnapshot(bytes.NewReader(b.Bytes()))
+	a.Nil(err)
+	a.Len(rs.sessions, 1)
+	if a.Len(rs.retained, 2) {
+		a.Equal("a", rs.retained[0].Topic)
+		a.Equal(packets.Qos1, rs.retained[0].QoS)
+		a.Equal("text/plain", rs.retained[1].ContentType)
+		a.True(rs.retained[1].Retained)
+	}
+
+	// the version 1 stream has no retained records.
+	s.retained = nil
+	b.Reset()
+	a.Nil(s.encode(b))
+	v1 := b.Bytes()
+	v1[len(backupMagic)+1] = 1
+	rs, err = decodeSnapshot(bytes.NewReader(v1))
+	a.Nil(err)
+	a.Len(rs.sessions, 1)
+	a.Empty(rs.retained)
+}
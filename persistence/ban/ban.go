@@ -0,0 +1,37 @@
+package ban
+
+import (
+	"time"
+)
+
+// Type is the type of the banned value.
+type Type string
+
+const (
+	// TypeClientID bans the client id.
+	TypeClientID Type = "client_id"
+	// TypeIP bans the source IP.
+	TypeIP Type = "ip"
+)
+
+// Ban is an entry of the ban list.
+type Ban struct {
+	Type Type
+	// Value is the banned client id or IP.
+	Value     string
+	ExpiresAt time.Time
+}
+
+// IterateFn is the callback function used by Iterate()
+// Return false means to stop the iteration.
+type IterateFn func(ban *Ban) bool
+
+// Store persists the ban list, so that the bans can survive the broker restart.
+type Store interface {
+	// Add adds or replaces the ban with the same Type and Value.
+	Add(ban *Ban) error
+	// Remove removes the ban, it is a no-op if the ban does not exist.
+	Remove(typ Type, value string) error
+	// Iterate iterates all bans in no particular order, including the expired ones.
+	Iterate(fn IterateFn) error
+}
@@ -0,0 +1,51 @@
+package mem
+
+import (
+	"sync"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+)
+
+var _ ban.Store = (*Store)(nil)
+
+type key struct {
+	typ   ban.Type
+	value string
+}
+
+func New() *Store {
+	return &Store{
+		mu:   sync.Mutex{},
+		bans: make(map[key]*ban.Ban),
+	}
+}
+
+type Store struct {
+	mu   sync.Mutex
+	bans map[key]*ban.Ban
+}
+
+func (s *Store) Add(b *ban.Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[key{typ: b.Type, value: b.Value}] = b
+	return nil
+}
+
+func (s *Store) Remove(typ ban.Type, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bans, key{typ: typ, value: value})
+	return nil
+}
+
+func (s *Store) Iterate(fn ban.IterateFn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.bans {
+		if !fn(v) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+)
+
+const (
+	// banKey is the hash of the bans, the field is "{type}:{value}" and the value is the expiry time in unix nanoseconds.
+	banKey = "ban"
+)
+
+var _ ban.Store = (*Store)(nil)
+
+var errInvalidBan = errors.New("invalid ban")
+
+type Store struct {
+	mu   sync.Mutex
+	pool *redis.Pool
+}
+
+func New(pool *redis.Pool) *Store {
+	return &Store{
+		mu:   sync.Mutex{},
+		pool: pool,
+	}
+}
+
+func getField(typ ban.Type, value string) string {
+	return string(typ) + ":" + value
+}
+
+func decodeBan(field string, expiresAt []byte) (*ban.Ban, error) {
+	i := strings.IndexByte(field, ':')
+	if i <= 0 {
+		return nil, errInvalidBan
+	}
+	nano, err := strconv.ParseInt(string(expiresAt), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &ban.Ban{
+		Type:      ban.Type(field[:i]),
+		Value:     field[i+1:],
+		ExpiresAt: time.Unix(0, nano),
+	}, nil
+}
+
+func (s *Store) Add(b *ban.Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := c.Do("hset", banKey, getField(b.Type, b.Value), b.ExpiresAt.UnixNano())
+	return err
+}
+
+func (s *Store) Remove(typ ban.Type, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := c.Do("hdel", banKey, getField(typ, value))
+	return err
+}
+
+func (s *Store) Iterate(fn ban.IterateFn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.pool.Get()
+	defer c.Close()
+	rs, err := redis.ByteSlices(c.Do("hgetall", banKey))
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(rs); i += 2 {
+		b, err := decodeBan(string(rs[i]), rs[i+1])
+		if err != nil {
+			return err
+		}
+		if !fn(b) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package redis
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+)
+
+func TestDecodeBan(t *testing.T) {
+	a := assert.New(t)
+	expiresAt := time.Unix(10, 20)
+	b, err := decodeBan(getField(ban.TypeIP, "::1"), []byte(strconv.FormatInt(expiresAt.UnixNano(), 10)))
+	a.Nil(err)
+	a.Equal(ban.TypeIP, b.Type)
+	a.Equal("::1", b.Value)
+	a.True(expiresAt.Equal(b.ExpiresAt))
+
+	_, err = decodeBan("client_id", []byte("1"))
+	a.Equal(errInvalidBan, err)
+	_, err = decodeBan("client_id:a", []byte("a"))
+	a.Error(err)
+}
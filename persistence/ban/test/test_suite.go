@@ -0,0 +1,68 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+)
+
+func TestSuite(t *testing.T, store ban.Store) {
+	a := assert.New(t)
+	var tt = []*ban.Ban{
+		{
+			Type:      ban.TypeClientID,
+			Value:     "client",
+			ExpiresAt: time.Unix(1, 1),
+		}, {
+			Type:      ban.TypeIP,
+			Value:     "::1",
+			ExpiresAt: time.Unix(2, 0),
+		}, {
+			// the same value of different types are stored separately.
+			Type:      ban.TypeIP,
+			Value:     "client",
+			ExpiresAt: time.Unix(3, 0),
+		},
+	}
+	for _, v := range tt {
+		a.Nil(store.Add(v))
+	}
+	iterate := func() []*ban.Ban {
+		var rs []*ban.Ban
+		a.Nil(store.Iterate(func(b *ban.Ban) bool {
+			rs = append(rs, b)
+			return true
+		}))
+		return rs
+	}
+	rs := iterate()
+	a.Len(rs, 3)
+	for _, v := range rs {
+		var found bool
+		for _, vv := range tt {
+			if v.Type == vv.Type && v.Value == vv.Value {
+				found = true
+				a.True(vv.ExpiresAt.Equal(v.ExpiresAt))
+			}
+		}
+		a.True(found)
+	}
+
+	// replace
+	a.Nil(store.Add(&ban.Ban{Type: ban.TypeClientID, Value: "client", ExpiresAt: time.Unix(5, 0)}))
+	a.Len(iterate(), 3)
+
+	a.Nil(store.Remove(ban.TypeClientID, "client"))
+	a.Nil(store.Remove(ban.TypeClientID, "not_exist"))
+	rs = iterate()
+	a.Len(rs, 2)
+	for _, v := range rs {
+		a.Equal(ban.TypeIP, v.Type)
+	}
+	a.Nil(store.Remove(ban.TypeIP, "::1"))
+	a.Nil(store.Remove(ban.TypeIP, "client"))
+	a.Empty(iterate())
+}
@@ -1,15 +1,30 @@
 package persistence
 
 import (
+	"context"
+	"io"
+	"sync"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+	mem_ban "github.com/DrmagicE/gmqtt/persistence/ban/mem"
 	"github.com/DrmagicE/gmqtt/persistence/queue"
 	mem_queue "github.com/DrmagicE/gmqtt/persistence/queue/mem"
+	redis_queue "github.com/DrmagicE/gmqtt/persistence/queue/redis"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+	mem_scheduled "github.com/DrmagicE/gmqtt/persistence/scheduled/mem"
 	"github.com/DrmagicE/gmqtt/persistence/session"
 	mem_session "github.com/DrmagicE/gmqtt/persistence/session/mem"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	mem_sub "github.com/DrmagicE/gmqtt/persistence/subscription/mem"
 	"github.com/DrmagicE/gmqtt/persistence/unack"
 	mem_unack "github.com/DrmagicE/gmqtt/persistence/unack/mem"
+	"github.com/DrmagicE/gmqtt/retained"
+	retained_trie "github.com/DrmagicE/gmqtt/retained/trie"
 	"github.com/DrmagicE/gmqtt/server"
 )
 
@@ -17,11 +32,39 @@ func init() {
 	server.RegisterPersistenceFactory("memory", NewMemory)
 }
 
+var _ server.BackupablePersistence = (*memory)(nil)
+var _ server.SchedulablePersistence = (*memory)(nil)
+var _ server.BanPersistence = (*memory)(nil)
+var _ server.HealthCheckPersistence = (*memory)(nil)
+var _ server.RetainedPersistence = (*memory)(nil)
+
 func NewMemory(config config.Config) (server.Persistence, error) {
-	return &memory{}, nil
+	return &memory{
+		config: config,
+		queues: make(map[string]*mem_queue.Queue),
+		log:    server.LoggerWithField(zap.String("persistence", "memory")),
+	}, nil
 }
 
 type memory struct {
+	mu     sync.Mutex
+	opened bool
+	config config.Config
+	// pool is the redis pool of the queue overflow, it is nil if config.Persistence.QueueMemoryWindow is 0.
+	pool *redigo.Pool
+	// newOverflow returns the queue overflow of the client, it is nil if config.Persistence.QueueMemoryWindow is 0.
+	newOverflow func(clientID string) queue.Overflow
+	// sessionStore, subStore, queues and retainedStore are the stores created latest, they are read by Backup.
+	sessionStore  session.Store
+	subStore      subscription.Store
+	queues        map[string]*mem_queue.Queue
+	retainedStore retained.Store
+	// restored is the snapshot read by Restore or loaded from the snapshot file, it is loaded into the stores created afterwards.
+	restored *snapshot
+	log      *zap.Logger
+	// snapshotStop and snapshotDone control the periodic snapshot goroutine, see config.MemorySnapshot.
+	snapshotStop chan struct{}
+	snapshotDone chan struct{}
 }
 
 func (m *memory) NewUnackStore(config config.Config, clientID string) (unack.Store, error) {
@@ -31,25 +74,215 @@ func (m *memory) NewUnackStore(config config.Config, clientID string) (unack.Sto
 }
 
 func (m *memory) NewSessionStore(config config.Config) (session.Store, error) {
-	return mem_session.New(), nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := mem_session.New()
+	if m.restored != nil {
+		for _, v := range m.restored.sessions {
+			_ = st.Set(v)
+		}
+		m.restored.sessions = nil
+	}
+	m.sessionStore = st
+	return st, nil
+}
+
+func (m *memory) NewScheduledStore(config config.Config) (scheduled.Store, error) {
+	return mem_scheduled.New(), nil
+}
+
+func (m *memory) NewBanStore(config config.Config) (ban.Store, error) {
+	return mem_ban.New(), nil
+}
+
+// NewRetainedStore implements server.RetainedPersistence.
+func (m *memory) NewRetainedStore(config config.Config) (retained.Store, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := retained_trie.NewStore()
+	if m.restored != nil {
+		for _, v := range m.restored.retained {
+			st.AddOrReplace(v)
+		}
+		m.restored.retained = nil
+	}
+	m.retainedStore = st
+	return st, nil
 }
 
 func (m *memory) Open() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.config.Persistence.QueueMemoryWindow > 0 {
+		// The overflow is read and written under the server lock, see config.Persistence.QueueOverflowTimeout.
+		// The pool does not wait for a connection if MaxActive is reached, the Get fails instead.
+		var opts []redigo.DialOption
+		if timeout := m.config.Persistence.QueueOverflowTimeout; timeout > 0 {
+			opts = append(opts,
+				redigo.DialConnectTimeout(timeout),
+				redigo.DialReadTimeout(timeout),
+				redigo.DialWriteTimeout(timeout))
+		}
+		m.pool = newPool(m.config, opts...)
+		m.pool.MaxIdle = int(*m.config.Persistence.Redis.MaxIdle)
+		m.pool.MaxActive = int(*m.config.Persistence.Redis.MaxActive)
+		m.pool.IdleTimeout = m.config.Persistence.Redis.IdleTimeout
+		conn := m.pool.Get()
+		defer conn.Close()
+		// Test the connection
+		if _, err := conn.Do("PING"); err != nil {
+			m.pool.Close()
+			m.pool = nil
+			return err
+		}
+		pool := m.pool
+		m.newOverflow = func(clientID string) queue.Overflow {
+			return redis_queue.NewOverflow(pool, clientID)
+		}
+	}
+	if m.config.Persistence.MemorySnapshot.Path != "" {
+		m.loadSnapshotFileLocked()
+		if m.config.Persistence.MemorySnapshot.Interval > 0 {
+			m.snapshotStop = make(chan struct{})
+			m.snapshotDone = make(chan struct{})
+			go m.snapshotLoop(m.config.Persistence.MemorySnapshot.Interval, m.snapshotStop, m.snapshotDone)
+		}
+	}
+	m.opened = true
 	return nil
 }
 func (m *memory) NewQueueStore(config config.Config, defaultNotifier queue.Notifier, clientID string) (queue.Store, error) {
-	return mem_queue.New(mem_queue.Options{
-		MaxQueuedMsg:    config.MQTT.MaxQueuedMsg,
-		InflightExpiry:  config.MQTT.InflightExpiry,
-		ClientID:        clientID,
-		DefaultNotifier: defaultNotifier,
-	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	opts := mem_queue.Options{
+		MaxQueuedMsg:     config.MQTT.MaxQueuedMsg,
+		InflightExpiry:   config.MQTT.InflightExpiry,
+		ClientID:         clientID,
+		DefaultNotifier:  defaultNotifier,
+		OverflowStrategy: config.MQTT.QueueOverflowStrategy,
+	}
+	if m.newOverflow != nil {
+		opts.MemoryWindow = config.Persistence.QueueMemoryWindow
+		opts.Overflow = m.newOverflow(clientID)
+	}
+	q, err := mem_queue.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	if m.restored != nil {
+		if elems, ok := m.restored.queues[clientID]; ok {
+			delete(m.restored.queues, clientID)
+			if err = restoreQueue(q, elems, defaultNotifier); err != nil {
+				return nil, err
+			}
+		}
+	}
+	m.queues[clientID] = q
+	return q, nil
 }
 
 func (m *memory) NewSubscriptionStore(config config.Config) (subscription.Store, error) {
-	return mem_sub.NewStore(), nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := mem_sub.NewStore()
+	if m.restored != nil {
+		for clientID, subs := range m.restored.subscriptions {
+			if _, err := st.Subscribe(clientID, subs...); err != nil {
+				return nil, err
+			}
+		}
+		m.restored.subscriptions = nil
+	}
+	m.subStore = st
+	return st, nil
 }
 
+// Ping implements server.HealthCheckPersistence, the memory backend is always healthy
+// unless the redis of the queue overflow is unreachable.
+func (m *memory) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	pool := m.pool
+	m.mu.Unlock()
+	if pool == nil {
+		return nil
+	}
+	return (&redis{pool: pool}).Ping(ctx)
+}
+
+// Close writes the final snapshot if config.MemorySnapshot is set.
 func (m *memory) Close() error {
+	m.mu.Lock()
+	opened, stop, done := m.opened, m.snapshotStop, m.snapshotDone
+	m.snapshotStop, m.snapshotDone = nil, nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	var err error
+	if opened && m.config.Persistence.MemorySnapshot.Path != "" {
+		err = m.writeSnapshotFile()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opened = false
+	if m.pool != nil {
+		if perr := m.pool.Close(); err == nil {
+			err = perr
+		}
+		m.pool = nil
+		m.newOverflow = nil
+	}
+	return err
+}
+
+// Backup implements server.BackupablePersistence.
+func (m *memory) Backup(w io.Writer) error {
+	m.mu.Lock()
+	s, err := m.readSnapshotLocked()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.encode(w)
+}
+
+func (m *memory) readSnapshotLocked() (*snapshot, error) {
+	s, err := readSnapshot(m.sessionStore, m.subStore, func(clientID string) (queue.Store, error) {
+		if q, ok := m.queues[clientID]; ok {
+			return q, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m.retainedStore != nil {
+		m.retainedStore.Iterate(func(message *gmqtt.Message) bool {
+			s.retained = append(s.retained, message)
+			return true
+		})
+	}
+	return s, nil
+}
+
+// Restore implements server.BackupablePersistence.
+// The restored state is loaded into the stores which are created after Restore.
+// The streams of the successive Restore calls are merged.
+func (m *memory) Restore(r io.Reader) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.opened {
+		return server.ErrPersistenceOpened
+	}
+	s, err := decodeSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if m.restored == nil {
+		m.restored = s
+		return nil
+	}
+	m.restored.merge(s)
 	return nil
 }
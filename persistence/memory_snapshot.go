@@ -0,0 +1,78 @@
+package persistence
+
+import (
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// loadSnapshotFileLocked loads the snapshot file into m.restored, the state restored by Restore takes precedence.
+// The missing file is ignored, and the corrupted file is logged and ignored, so that the broker starts with an empty state.
+func (m *memory) loadSnapshotFileLocked() {
+	path := m.config.Persistence.MemorySnapshot.Path
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		m.log.Error("failed to open the snapshot file, start with an empty state", zap.String("path", path), zap.Error(err))
+		return
+	}
+	defer f.Close()
+	s, err := decodeSnapshot(f)
+	if err != nil {
+		m.log.Error("failed to load the snapshot file, start with an empty state", zap.String("path", path), zap.Error(err))
+		return
+	}
+	m.log.Info("snapshot file loaded", zap.String("path", path),
+		zap.Int("session_total", len(s.sessions)), zap.Int("retained_total", len(s.retained)))
+	if m.restored != nil {
+		s.merge(m.restored)
+	}
+	m.restored = s
+}
+
+// writeSnapshotFile writes the snapshot into a temporary file and renames it to the snapshot file,
+// so that the previous snapshot is kept if the broker crashes in the middle of writing.
+func (m *memory) writeSnapshotFile() error {
+	m.mu.Lock()
+	s, err := m.readSnapshotLocked()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	path := m.config.Persistence.MemorySnapshot.Path
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = s.encode(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *memory) snapshotLoop(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := m.writeSnapshotFile(); err != nil {
+				m.log.Error("failed to write the snapshot file", zap.String("path", m.config.Persistence.MemorySnapshot.Path), zap.Error(err))
+			}
+		}
+	}
+}
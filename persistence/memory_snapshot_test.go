@@ -0,0 +1,231 @@
+package persistence
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+	_ "github.com/DrmagicE/gmqtt/topicalias/fifo"
+)
+
+func snapshotConfig(t *testing.T) config.Config {
+	dir, err := ioutil.TempDir("", "gmqtt-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	cfg := config.DefaultConfig()
+	cfg.Persistence.MemorySnapshot.Path = filepath.Join(dir, "snapshot")
+	return cfg
+}
+
+// runServer runs the broker and returns the mqtt address, the broker is stopped by the returned function.
+func runServer(t *testing.T, cfg config.Config) (server.Server, string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(server.WithConfig(cfg), server.WithTCPListener(ln))
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- srv.Run()
+	}()
+	for i := 0; i < 100 && srv.LifecycleState() != server.StateReady; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return srv, ln.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Nil(t, srv.Stop(ctx))
+		assert.Nil(t, <-runErr)
+	}
+}
+
+func TestMemory_snapshotFile(t *testing.T) {
+	a := assert.New(t)
+	cfg := snapshotConfig(t)
+
+	srv, addr, stop := runServer(t, cfg)
+	conn, err := net.Dial("tcp", addr)
+	if !a.Nil(err) {
+		return
+	}
+	defer conn.Close()
+	w, r := packets.NewWriter(conn), packets.NewReader(conn)
+	a.Nil(w.WriteAndFlush(&packets.Connect{
+		Version:       packets.Version311,
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: byte(packets.Version311),
+		CleanStart:    false,
+		KeepAlive:     60,
+		ClientID:      []byte("cid"),
+	}))
+	p, err := r.ReadPacket()
+	a.Nil(err)
+	a.IsType(&packets.Connack{}, p)
+	a.Nil(w.WriteAndFlush(&packets.Subscribe{
+		Version:  packets.Version311,
+		PacketID: 1,
+		Topics:   []packets.Topic{{Name: "a/+", SubOptions: packets.SubOptions{Qos: packets.Qos1}}},
+	}))
+	p, err = r.ReadPacket()
+	a.Nil(err)
+	a.IsType(&packets.Suback{}, p)
+	srv.RetainedService().AddOrReplace(&gmqtt.Message{Topic: "a/b", Payload: []byte("retained"), QoS: packets.Qos1, Retained: true})
+	stop()
+
+	// restart with a fresh server pointed at the snapshot file.
+	srv, _, stop = runServer(t, cfg)
+	defer stop()
+	sess, err := srv.ClientService().GetSession("cid")
+	a.Nil(err)
+	a.NotNil(sess)
+	var subs []*gmqtt.Subscription
+	srv.SubscriptionService().Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+		subs = append(subs, sub)
+		return true
+	}, subscription.IterationOptions{Type: subscription.TypeAll, ClientID: "cid"})
+	if a.Len(subs, 1) {
+		a.Equal("a/+", subs[0].TopicFilter)
+		a.Equal(packets.Qos1, subs[0].QoS)
+	}
+	msg := srv.RetainedService().GetRetainedMessage("a/b")
+	if a.NotNil(msg) {
+		a.Equal([]byte("retained"), msg.Payload)
+		a.True(msg.Retained)
+	}
+}
+
+func TestMemory_snapshotFile_corrupted(t *testing.T) {
+	a := assert.New(t)
+	cfg := snapshotConfig(t)
+	a.Nil(ioutil.WriteFile(cfg.Persistence.MemorySnapshot.Path, []byte("not a snapshot"), 0644))
+
+	m, err := NewMemory(cfg)
+	a.Nil(err)
+	a.Nil(m.Open())
+	ss, err := m.NewSessionStore(cfg)
+	a.Nil(err)
+	a.Nil(ss.Iterate(func(sess *gmqtt.Session) bool {
+		t.Fatalf("unexpected session: %s", sess.ClientID)
+		return true
+	}))
+	rs, err := m.(server.RetainedPersistence).NewRetainedStore(cfg)
+	a.Nil(err)
+	rs.AddOrReplace(&gmqtt.Message{Topic: "a", Payload: []byte("a"), Retained: true})
+
+	// the corrupted file is replaced by the snapshot written on close.
+	a.Nil(m.Close())
+	m, err = NewMemory(cfg)
+	a.Nil(err)
+	a.Nil(m.Open())
+	defer m.Close()
+	rs, err = m.(server.RetainedPersistence).NewRetainedStore(cfg)
+	a.Nil(err)
+	a.NotNil(rs.GetRetainedMessage("a"))
+}
+
+func TestMemory_snapshotFile_interval(t *testing.T) {
+	a := assert.New(t)
+	cfg := snapshotConfig(t)
+	cfg.Persistence.MemorySnapshot.Interval = 10 * time.Millisecond
+
+	m, err := NewMemory(cfg)
+	a.Nil(err)
+	a.Nil(m.Open())
+	defer m.Close()
+	rs, err := m.(server.RetainedPersistence).NewRetainedStore(cfg)
+	a.Nil(err)
+	rs.AddOrReplace(&gmqtt.Message{Topic: "a", Payload: []byte("a"), Retained: true})
+
+	var s *snapshot
+	for i := 0; i < 100 && (s == nil || len(s.retained) == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+		if f, err := os.Open(cfg.Persistence.MemorySnapshot.Path); err == nil {
+			s, _ = decodeSnapshot(f)
+			f.Close()
+		}
+	}
+	if a.NotNil(s) && a.Len(s.retained, 1) {
+		a.Equal("a", s.retained[0].Topic)
+	}
+}
+
+// TestMemory_maxOfflineQos0Msg publishes to a disconnected session and asserts that
+// only the latest QoS 0 messages are delivered on reconnect.
+func TestMemory_maxOfflineQos0Msg(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.DefaultConfig()
+	cfg.MQTT.QueueQos0Msg = true
+	cfg.MQTT.MaxOfflineQos0Msg = 2
+	srv, addr, stop := runServer(t, cfg)
+	defer stop()
+
+	connect := func() (net.Conn, *packets.Reader, *packets.Writer) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, r := packets.NewWriter(conn), packets.NewReader(conn)
+		a.Nil(w.WriteAndFlush(&packets.Connect{
+			Version:       packets.Version311,
+			ProtocolName:  []byte("MQTT"),
+			ProtocolLevel: byte(packets.Version311),
+			CleanStart:    false,
+			KeepAlive:     60,
+			ClientID:      []byte("cid"),
+		}))
+		p, err := r.ReadPacket()
+		a.Nil(err)
+		a.IsType(&packets.Connack{}, p)
+		return conn, r, w
+	}
+	conn, r, w := connect()
+	a.Nil(w.WriteAndFlush(&packets.Subscribe{
+		Version:  packets.Version311,
+		PacketID: 1,
+		Topics:   []packets.Topic{{Name: "a/+", SubOptions: packets.SubOptions{Qos: packets.Qos1}}},
+	}))
+	p, err := r.ReadPacket()
+	a.Nil(err)
+	a.IsType(&packets.Suback{}, p)
+	a.Nil(w.WriteAndFlush(&packets.Disconnect{Version: packets.Version311}))
+	conn.Close()
+	for i := 0; i < 100 && srv.ClientService().GetClient("cid") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, qos := range []uint8{packets.Qos0, packets.Qos1, packets.Qos0, packets.Qos0} {
+		srv.Publisher().Publish(&gmqtt.Message{Topic: "a/b", QoS: qos, Payload: []byte(strconv.Itoa(i))})
+	}
+
+	conn, r, _ = connect()
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var payloads []string
+	for len(payloads) < 3 {
+		p, err := r.ReadPacket()
+		if !a.Nil(err) {
+			break
+		}
+		if pub, ok := p.(*packets.Publish); ok {
+			payloads = append(payloads, string(pub.Payload))
+		}
+	}
+	// the oldest QoS 0 message is dropped, the QoS 1 message is kept.
+	a.Equal([]string{"1", "2", "3"}, payloads)
+}
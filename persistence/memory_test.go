@@ -1,17 +1,26 @@
 package persistence
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 
+	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
+	ban_test "github.com/DrmagicE/gmqtt/persistence/ban/test"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	mem_queue "github.com/DrmagicE/gmqtt/persistence/queue/mem"
 	queue_test "github.com/DrmagicE/gmqtt/persistence/queue/test"
+	scheduled_test "github.com/DrmagicE/gmqtt/persistence/scheduled/test"
 	sess_test "github.com/DrmagicE/gmqtt/persistence/session/test"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	sub_test "github.com/DrmagicE/gmqtt/persistence/subscription/test"
 	unack_test "github.com/DrmagicE/gmqtt/persistence/unack/test"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/server"
 )
 
@@ -27,6 +36,133 @@ func (s *MemorySuite) TestQueue() {
 	a.Nil(err)
 	queue_test.TestQueue(s.T(), qs)
 }
+
+func (s *MemorySuite) TestQueue_messageExpiry() {
+	a := assert.New(s.T())
+	cfg := queue_test.TestServerConfig
+	cfg.MQTT.InflightExpiry = 0
+	qs, err := s.p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+	a.Nil(err)
+	queue_test.TestMessageExpiry(s.T(), qs)
+}
+func (s *MemorySuite) TestQueue_overflowStrategy() {
+	for _, v := range []string{config.QueueOverflowDropOldest, config.QueueOverflowDropNewest, config.QueueOverflowReject} {
+		s.Run(v, func() {
+			cfg := queue_test.TestServerConfig
+			cfg.MQTT.QueueOverflowStrategy = v
+			qs, err := s.p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+			s.Require().Nil(err)
+			queue_test.TestOverflowStrategy(s.T(), qs, v)
+		})
+	}
+}
+
+func (s *MemorySuite) TestQueue_memoryWindow() {
+	q, err := mem_queue.New(mem_queue.Options{
+		MaxQueuedMsg:    queue_test.TestServerConfig.MQTT.MaxQueuedMsg,
+		InflightExpiry:  queue_test.TestServerConfig.MQTT.InflightExpiry,
+		ClientID:        queue_test.TestClientID,
+		DefaultNotifier: queue_test.TestNotifier,
+		MemoryWindow:    2,
+		Overflow:        &queue_test.Overflow{},
+	})
+	s.Require().Nil(err)
+	queue_test.TestMemoryWindow(s.T(), q)
+}
+
+// failingOverflow is the queue_test.Overflow whose Push fails with err if err is not nil.
+type failingOverflow struct {
+	queue_test.Overflow
+	err error
+}
+
+func (f *failingOverflow) Push(elems ...*queue.Elem) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.Overflow.Push(elems...)
+}
+
+// newOverflowMemory returns the opened memory persistence which spills the queues beyond 2 elems to the overflow.
+func newOverflowMemory(overflow queue.Overflow) (server.Persistence, config.Config) {
+	cfg := queue_test.TestServerConfig
+	cfg.Persistence.QueueMemoryWindow = 2
+	p, _ := NewMemory(cfg)
+	p.(*memory).newOverflow = func(clientID string) queue.Overflow {
+		return overflow
+	}
+	return p, cfg
+}
+
+func (s *MemorySuite) TestQueue_memoryWindowPersistence() {
+	p, cfg := newOverflowMemory(&queue_test.Overflow{})
+	qs, err := p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+	s.Require().Nil(err)
+	queue_test.TestMemoryWindow(s.T(), qs)
+}
+
+func (s *MemorySuite) TestQueue_memoryWindowPushError() {
+	a := assert.New(s.T())
+	overflow := &failingOverflow{}
+	p, cfg := newOverflowMemory(overflow)
+	qs, err := p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+	s.Require().Nil(err)
+	a.Nil(qs.Init(&queue.InitOptions{
+		CleanStart:     true,
+		Version:        packets.Version5,
+		ReadBytesLimit: 100,
+		Notifier:       queue_test.TestNotifier,
+	}))
+	newElem := func(topic string) *queue.Elem {
+		return &queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{Topic: topic, QoS: packets.Qos1},
+			},
+		}
+	}
+	a.Nil(qs.Add(newElem("0")))
+	a.Nil(qs.Add(newElem("1")))
+
+	// the elem beyond the window is not queued if it fails to be spilled.
+	overflow.err = errors.New("timeout")
+	a.Equal(overflow.err, qs.Add(newElem("2")))
+	l, err := qs.(queue.Drainer).Len()
+	a.Nil(err)
+	a.Equal(2, l)
+	n, err := overflow.Len()
+	a.Nil(err)
+	a.Equal(0, n)
+
+	overflow.err = nil
+	a.Nil(qs.Add(newElem("3")))
+	l, err = qs.(queue.Drainer).Len()
+	a.Nil(err)
+	a.Equal(3, l)
+	n, err = overflow.Len()
+	a.Nil(err)
+	a.Equal(1, n)
+}
+
+func (s *MemorySuite) TestQueue_qos0Trimmer() {
+	a := assert.New(s.T())
+	qs, err := s.p.NewQueueStore(queue_test.TestServerConfig, queue_test.TestNotifier, queue_test.TestClientID)
+	a.Nil(err)
+	queue_test.TestQos0Trimmer(s.T(), qs)
+}
+
+func (s *MemorySuite) TestQueue_qos0TrimmerMemoryWindow() {
+	q, err := mem_queue.New(mem_queue.Options{
+		MaxQueuedMsg:    queue_test.TestServerConfig.MQTT.MaxQueuedMsg,
+		ClientID:        queue_test.TestClientID,
+		DefaultNotifier: queue_test.TestNotifier,
+		MemoryWindow:    2,
+		Overflow:        &queue_test.Overflow{},
+	})
+	s.Require().Nil(err)
+	queue_test.TestQos0TrimmerMemoryWindow(s.T(), q)
+}
+
 func (s *MemorySuite) TestSubscription() {
 	newFn := func() subscription.Store {
 		st, err := s.p.NewSubscriptionStore(queue_test.TestServerConfig)
@@ -45,6 +181,20 @@ func (s *MemorySuite) TestSession() {
 	sess_test.TestSuite(s.T(), st)
 }
 
+func (s *MemorySuite) TestBan() {
+	a := assert.New(s.T())
+	st, err := s.p.(server.BanPersistence).NewBanStore(queue_test.TestServerConfig)
+	a.Nil(err)
+	ban_test.TestSuite(s.T(), st)
+}
+
+func (s *MemorySuite) TestScheduled() {
+	a := assert.New(s.T())
+	st, err := s.p.(server.SchedulablePersistence).NewScheduledStore(queue_test.TestServerConfig)
+	a.Nil(err)
+	scheduled_test.TestSuite(s.T(), st)
+}
+
 func (s *MemorySuite) TestUnack() {
 	a := assert.New(s.T())
 	st, err := s.p.NewUnackStore(unack_test.TestServerConfig, unack_test.TestClientID)
@@ -52,6 +202,11 @@ func (s *MemorySuite) TestUnack() {
 	unack_test.TestSuite(s.T(), st)
 }
 
+func (s *MemorySuite) TestPing() {
+	a := assert.New(s.T())
+	a.Nil(s.p.(server.HealthCheckPersistence).Ping(context.Background()))
+}
+
 func TestMemory(t *testing.T) {
 	p, err := NewMemory(config.Config{})
 	if err != nil {
@@ -61,3 +216,14 @@ func TestMemory(t *testing.T) {
 		p: p,
 	})
 }
+
+func TestMemory_BackupRestore(t *testing.T) {
+	cfg := config.Config{
+		MQTT: config.MQTT{
+			MaxQueuedMsg: 10,
+		},
+	}
+	src, _ := NewMemory(cfg)
+	dst, _ := NewMemory(cfg)
+	testBackupRestore(t, cfg, src, dst, func() {})
+}
@@ -0,0 +1,178 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/retained"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+// defaultMigrateBatchSize is the default value of PersistenceMigrator.BatchSize.
+const defaultMigrateBatchSize = 100
+
+// MigrateStats is the number of the records migrated by PersistenceMigrator.
+type MigrateStats struct {
+	Sessions         int
+	Subscriptions    int
+	QueuedMessages   int
+	RetainedMessages int
+	// RetainedRejected is the number of the retained messages rejected by the retained.Limiter of the target store.
+	RetainedRejected int
+}
+
+// PersistenceMigrator copies the sessions (including the will messages), subscriptions and queued messages
+// from one Persistence to another, e.g: switching from the memory persistence to the redis persistence.
+// Both Persistence must implement server.BackupablePersistence. The target Persistence must not be opened,
+// see server.BackupablePersistence.Restore.
+//
+// The clients are migrated in the order of the client ids, BatchSize clients at a time.
+// Resume is updated after each batch, so a failed Migrate can be resumed by calling it again with the same PersistenceMigrator,
+// or with a new one which Resume is set to the saved value.
+// The retained messages in the backup stream of the source are restored after the clients,
+// unless both FromRetained and ToRetained are set, in which case they are copied between the two stores instead,
+// e.g: if the retained store is set by server.WithRetainedStore.
+type PersistenceMigrator struct {
+	// BatchSize is the number of clients restored into the target Persistence at a time, default to 100.
+	BatchSize int
+	// Resume is the client id of the last migrated client, the clients sorted before or equal to it are skipped.
+	// Empty value means starting from the first client.
+	Resume string
+	// FromRetained and ToRetained is the source and target retained store.
+	FromRetained retained.Store
+	ToRetained   retained.Store
+	// Stats is the number of the records migrated so far, it is accumulated across the resumed Migrate calls.
+	Stats MigrateStats
+	// retainedDone indicates whether the retained messages have been migrated.
+	retainedDone bool
+}
+
+// Migrate copies the persisted state from the from Persistence to the to Persistence.
+// The state of the migrated clients replaces the existing one in the target persistence, the other clients are kept.
+func (m *PersistenceMigrator) Migrate(from, to server.Persistence) error {
+	src, ok := from.(server.BackupablePersistence)
+	if !ok {
+		return errors.New("the source persistence does not support backup")
+	}
+	dst, ok := to.(server.BackupablePersistence)
+	if !ok {
+		return errors.New("the target persistence does not support restore")
+	}
+	b := &bytes.Buffer{}
+	if err := src.Backup(b); err != nil {
+		return fmt.Errorf("fail to backup the source persistence: %w", err)
+	}
+	s, err := decodeSnapshot(b)
+	if err != nil {
+		return err
+	}
+	sort.Slice(s.sessions, func(i, j int) bool {
+		return s.sessions[i].ClientID < s.sessions[j].ClientID
+	})
+	start := sort.Search(len(s.sessions), func(i int) bool {
+		return s.sessions[i].ClientID > m.Resume
+	})
+	size := m.BatchSize
+	if size <= 0 {
+		size = defaultMigrateBatchSize
+	}
+	for i := start; i < len(s.sessions); i += size {
+		end := i + size
+		if end > len(s.sessions) {
+			end = len(s.sessions)
+		}
+		batch := s.batch(s.sessions[i:end])
+		b.Reset()
+		if err = batch.encode(b); err != nil {
+			return err
+		}
+		if err = dst.Restore(b); err != nil {
+			return fmt.Errorf("fail to restore the clients after %q: %w", m.Resume, err)
+		}
+		m.Resume = s.sessions[end-1].ClientID
+		m.Stats.Sessions += len(batch.sessions)
+		for cid := range batch.subscriptions {
+			m.Stats.Subscriptions += len(batch.subscriptions[cid])
+		}
+		for cid := range batch.queues {
+			m.Stats.QueuedMessages += len(batch.queues[cid])
+		}
+	}
+	if !m.retainedDone {
+		if m.FromRetained != nil && m.ToRetained != nil {
+			m.migrateRetained()
+		} else if len(s.retained) != 0 {
+			rs := newSnapshot()
+			rs.retained = s.retained
+			b.Reset()
+			if err = rs.encode(b); err != nil {
+				return err
+			}
+			if err = dst.Restore(b); err != nil {
+				return fmt.Errorf("fail to restore the retained messages: %w", err)
+			}
+			m.Stats.RetainedMessages += len(rs.retained)
+		}
+		m.retainedDone = true
+	}
+	return nil
+}
+
+func (m *PersistenceMigrator) migrateRetained() {
+	limiter, _ := m.ToRetained.(retained.Limiter)
+	m.FromRetained.Iterate(func(message *gmqtt.Message) bool {
+		if limiter != nil {
+			if limiter.TryAddOrReplace(message) != nil {
+				m.Stats.RetainedRejected++
+				return true
+			}
+		} else {
+			m.ToRetained.AddOrReplace(message)
+		}
+		m.Stats.RetainedMessages++
+		return true
+	})
+}
+
+// batch returns the snapshot of the given sessions.
+func (s *snapshot) batch(sessions []*gmqtt.Session) *snapshot {
+	rs := newSnapshot()
+	rs.sessions = sessions
+	for _, v := range sessions {
+		if subs, ok := s.subscriptions[v.ClientID]; ok {
+			rs.subscriptions[v.ClientID] = subs
+		}
+		if elems, ok := s.queues[v.ClientID]; ok {
+			rs.queues[v.ClientID] = elems
+		}
+	}
+	return rs
+}
+
+// merge merges o into s, the state of the clients in o replaces the one in s.
+func (s *snapshot) merge(o *snapshot) {
+	index := make(map[string]int, len(s.sessions))
+	for k, v := range s.sessions {
+		index[v.ClientID] = k
+	}
+	for _, v := range o.sessions {
+		if k, ok := index[v.ClientID]; ok {
+			s.sessions[k] = v
+		} else {
+			s.sessions = append(s.sessions, v)
+		}
+		delete(s.subscriptions, v.ClientID)
+		delete(s.queues, v.ClientID)
+	}
+	for cid, subs := range o.subscriptions {
+		s.subscriptions[cid] = subs
+	}
+	for cid, elems := range o.queues {
+		s.queues[cid] = elems
+	}
+	// the later retained message of the same topic replaces the earlier one when they are loaded in order.
+	s.retained = append(s.retained, o.retained...)
+}
@@ -0,0 +1,146 @@
+package persistence
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/retained"
+	"github.com/DrmagicE/gmqtt/retained/trie"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+// failingRestore fails the Restore calls after the given number of calls.
+type failingRestore struct {
+	server.Persistence
+	calls int
+}
+
+func (f *failingRestore) Backup(w io.Writer) error {
+	return f.Persistence.(server.BackupablePersistence).Backup(w)
+}
+
+func (f *failingRestore) Restore(r io.Reader) error {
+	if f.calls == 0 {
+		return errors.New("restore error")
+	}
+	f.calls--
+	return f.Persistence.(server.BackupablePersistence).Restore(r)
+}
+
+func TestPersistenceMigrator(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.Config{
+		MQTT: config.MQTT{
+			MaxQueuedMsg: 10,
+		},
+	}
+	src, _ := NewMemory(cfg)
+	ss, err := src.NewSessionStore(cfg)
+	a.Nil(err)
+	subs, err := src.NewSubscriptionStore(cfg)
+	a.Nil(err)
+	for _, cid := range []string{"c3", "c1", "c2"} {
+		a.Nil(ss.Set(&gmqtt.Session{
+			ClientID:    cid,
+			Will:        &gmqtt.Message{Topic: "will/" + cid},
+			ConnectedAt: time.Unix(100, 0),
+		}))
+		_, err = subs.Subscribe(cid, &gmqtt.Subscription{TopicFilter: "a/" + cid, QoS: packets.Qos1})
+		a.Nil(err)
+	}
+	qs, err := src.NewQueueStore(cfg, nopNotifier{}, "c2")
+	a.Nil(err)
+	a.Nil(qs.Init(&queue.InitOptions{CleanStart: true, Version: packets.Version5, Notifier: nopNotifier{}}))
+	for _, topic := range []string{"t1", "t2"} {
+		a.Nil(qs.Add(&queue.Elem{
+			At:            time.Unix(300, 0),
+			MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: topic, QoS: packets.Qos1}},
+		}))
+	}
+	fromRetained, toRetained := trie.NewStore(), trie.NewStore()
+	fromRetained.AddOrReplace(&gmqtt.Message{Topic: "r/1", Payload: []byte("1")})
+	fromRetained.AddOrReplace(&gmqtt.Message{Topic: "r/2", Payload: []byte("2")})
+	toRetained.SetLimits(retained.Limits{MaxMessages: 1, RejectNew: true})
+
+	dst, _ := NewMemory(cfg)
+	m := &PersistenceMigrator{
+		BatchSize:    2,
+		FromRetained: fromRetained,
+		ToRetained:   toRetained,
+	}
+	// the second batch fails.
+	a.Error(m.Migrate(src, &failingRestore{Persistence: dst, calls: 1}))
+	a.Equal("c2", m.Resume)
+	a.Equal(MigrateStats{Sessions: 2, Subscriptions: 2, QueuedMessages: 2}, m.Stats)
+
+	// resume
+	a.Nil(m.Migrate(src, dst))
+	a.Equal("c3", m.Resume)
+	a.Equal(MigrateStats{
+		Sessions:         3,
+		Subscriptions:    3,
+		QueuedMessages:   2,
+		RetainedMessages: 1,
+		RetainedRejected: 1,
+	}, m.Stats)
+	// nothing left to migrate.
+	a.Nil(m.Migrate(src, dst))
+	a.Equal(3, m.Stats.Sessions)
+
+	a.Nil(dst.Open())
+	defer dst.Close()
+	dss, err := dst.NewSessionStore(cfg)
+	a.Nil(err)
+	dsubs, err := dst.NewSubscriptionStore(cfg)
+	a.Nil(err)
+	for _, cid := range []string{"c1", "c2", "c3"} {
+		sess, err := dss.Get(cid)
+		a.Nil(err)
+		a.Equal("will/"+cid, sess.Will.Topic)
+		a.Equal(subscription.GetClientSubscriptions(subs, cid, subscription.TypeAll),
+			subscription.GetClientSubscriptions(dsubs, cid, subscription.TypeAll))
+	}
+	dqs, err := dst.NewQueueStore(cfg, nopNotifier{}, "c2")
+	a.Nil(err)
+	elems, err := dqs.(queue.Snapshotter).Snapshot()
+	a.Nil(err)
+	a.Len(elems, 2)
+
+	// not backupable
+	a.Error((&PersistenceMigrator{}).Migrate(struct{ server.Persistence }{src}, dst))
+}
+
+func TestPersistenceMigrator_retainedStream(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.Config{
+		MQTT: config.MQTT{
+			MaxQueuedMsg: 10,
+		},
+	}
+	src, _ := NewMemory(cfg)
+	rs, err := src.(server.RetainedPersistence).NewRetainedStore(cfg)
+	a.Nil(err)
+	rs.AddOrReplace(&gmqtt.Message{Topic: "r/1", Payload: []byte("1")})
+	rs.AddOrReplace(&gmqtt.Message{Topic: "r/2", Payload: []byte("2")})
+
+	dst, _ := NewMemory(cfg)
+	m := &PersistenceMigrator{}
+	a.Nil(m.Migrate(src, dst))
+	a.Equal(MigrateStats{RetainedMessages: 2}, m.Stats)
+
+	a.Nil(dst.Open())
+	defer dst.Close()
+	drs, err := dst.(server.RetainedPersistence).NewRetainedStore(cfg)
+	a.Nil(err)
+	a.Equal([]byte("1"), drs.GetRetainedMessage("r/1").Payload)
+	a.Equal([]byte("2"), drs.GetRetainedMessage("r/2").Payload)
+}
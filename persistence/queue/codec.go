@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// PayloadCodec transforms the payloads of the queued messages at rest, e.g: compression or encryption.
+// The payload is encoded before the message is added to the Store and decoded after it is read,
+// so that the subscribers always receive the original payload.
+// Only the payload is transformed, the other fields such as the payload format indicator are stored as they are.
+// The implementation must be safe for concurrent use.
+type PayloadCodec interface {
+	// Version identifies the codec and its format, it is stored with every encoded elem, see Elem.Codec.
+	// It must not be 0 and must be changed once the format changes,
+	// so that the elems encoded by another codec can be detected after a restart rather than being delivered as garbage.
+	Version() uint8
+	// Encode returns the encoded payload, it must not modify the given payload.
+	Encode(payload []byte) ([]byte, error)
+	// Decode returns the original payload of the encoded one, it must not modify the given payload.
+	Decode(payload []byte) ([]byte, error)
+}
+
+// EncodePayload encodes the payload of the elem with the codec and records the codec version in Elem.Codec.
+// The message of the elem is replaced with a copy rather than modified in place.
+// It is a no-op if codec is nil, the elem is a pubrel or QoS 0 message, or the elem has been encoded.
+func EncodePayload(codec PayloadCodec, elem *Elem) error {
+	pub, ok := elem.MessageWithID.(*Publish)
+	if codec == nil || !ok || pub.QoS == packets.Qos0 || elem.Codec != 0 {
+		return nil
+	}
+	payload, err := codec.Encode(pub.Payload)
+	if err != nil {
+		return err
+	}
+	msg := *pub.Message
+	msg.Payload = payload
+	elem.MessageWithID = &Publish{Message: &msg}
+	elem.Codec = codec.Version()
+	return nil
+}
+
+// DecodePayload returns the publish message of the elem with the original payload, the elem is not modified.
+// If the elem is not encoded, the message of the elem is returned as it is.
+// ErrDropCodecMismatch is returned if the elem is encoded by another codec, or codec is nil.
+// It panics if the elem is not a publish elem.
+func DecodePayload(codec PayloadCodec, elem *Elem) (*gmqtt.Message, error) {
+	pub := elem.MessageWithID.(*Publish)
+	if elem.Codec == 0 {
+		return pub.Message, nil
+	}
+	if codec == nil || codec.Version() != elem.Codec {
+		return nil, ErrDropCodecMismatch
+	}
+	payload, err := codec.Decode(pub.Payload)
+	if err != nil {
+		return nil, err
+	}
+	msg := *pub.Message
+	msg.Payload = payload
+	return &msg, nil
+}
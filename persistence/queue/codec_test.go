@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// reverseCodec reverses the payload.
+type reverseCodec struct {
+	version uint8
+}
+
+func (r *reverseCodec) Version() uint8 {
+	return r.version
+}
+
+func (r *reverseCodec) Encode(payload []byte) ([]byte, error) {
+	return reverse(payload), nil
+}
+
+func (r *reverseCodec) Decode(payload []byte) ([]byte, error) {
+	return reverse(payload), nil
+}
+
+func reverse(b []byte) []byte {
+	rs := make([]byte, len(b))
+	for i := range b {
+		rs[len(b)-1-i] = b[i]
+	}
+	return rs
+}
+
+type errCodec struct {
+	reverseCodec
+}
+
+func (e *errCodec) Decode(payload []byte) ([]byte, error) {
+	return nil, errors.New("corrupted")
+}
+
+func TestEncodePayload(t *testing.T) {
+	a := assert.New(t)
+	codec := &reverseCodec{version: 1}
+	msg := &gmqtt.Message{
+		QoS:           packets.Qos1,
+		Payload:       []byte("abc"),
+		PayloadFormat: packets.PayloadFormatString,
+	}
+	elem := &Elem{MessageWithID: &Publish{Message: msg}}
+	a.Nil(EncodePayload(codec, elem))
+	a.EqualValues(1, elem.Codec)
+	a.Equal([]byte("cba"), elem.MessageWithID.(*Publish).Payload)
+	a.Equal(packets.PayloadFormatString, elem.MessageWithID.(*Publish).PayloadFormat)
+	// the original message is not modified
+	a.Equal([]byte("abc"), msg.Payload)
+	// encode only once
+	a.Nil(EncodePayload(codec, elem))
+	a.Equal([]byte("cba"), elem.MessageWithID.(*Publish).Payload)
+
+	decoded, err := DecodePayload(codec, elem)
+	a.Nil(err)
+	a.Equal(msg, decoded)
+	a.Equal([]byte("cba"), elem.MessageWithID.(*Publish).Payload)
+
+	// the codec has been changed
+	_, err = DecodePayload(&reverseCodec{version: 2}, elem)
+	a.Equal(ErrDropCodecMismatch, err)
+	_, err = DecodePayload(nil, elem)
+	a.Equal(ErrDropCodecMismatch, err)
+	_, err = DecodePayload(&errCodec{reverseCodec{version: 1}}, elem)
+	a.Error(err)
+}
+
+func TestEncodePayload_bypass(t *testing.T) {
+	a := assert.New(t)
+	codec := &reverseCodec{version: 1}
+	for _, elem := range []*Elem{
+		{MessageWithID: &Publish{Message: &gmqtt.Message{QoS: packets.Qos0, Payload: []byte("abc")}}},
+		{MessageWithID: &Pubrel{PacketID: 1}},
+	} {
+		a.Nil(EncodePayload(codec, elem))
+		a.EqualValues(0, elem.Codec)
+	}
+	elem := &Elem{MessageWithID: &Publish{Message: &gmqtt.Message{QoS: packets.Qos1, Payload: []byte("abc")}}}
+	a.Nil(EncodePayload(nil, elem))
+	a.EqualValues(0, elem.Codec)
+	// the elems which are not encoded are delivered as they are
+	msg, err := DecodePayload(codec, elem)
+	a.Nil(err)
+	a.Equal([]byte("abc"), msg.Payload)
+}
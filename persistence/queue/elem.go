@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/DrmagicE/gmqtt"
@@ -45,9 +46,39 @@ type Elem struct {
 	// Expiry represents the expiry time.
 	// Empty means never expire.
 	Expiry time.Time
+	// Seq is the enqueue sequence of the elem, which is increased monotonically per client.
+	// It is assigned by the Store which tracks the order, e.g: the redis queue. 0 means not tracked.
+	Seq uint64
+	// Codec is the version of the PayloadCodec which has encoded the payload, 0 means the payload is not encoded.
+	Codec uint8
 	MessageWithID
 }
 
+const (
+	// ElemFormatVersion is the format version of the encoded elem, see Elem.Encode.
+	// The version is stored in the first byte so that the elems stored by the prior releases can still be decoded.
+	ElemFormatVersion byte = 2
+	// elemFormatV1 is the first byte of the elem encoded in the first format, which has no format version.
+	elemFormatV1 byte = 0
+)
+
+// UnsupportedFormatError is returned by Elem.Decode if the elem is encoded in an unknown format,
+// e.g: it is stored by a newer release.
+type UnsupportedFormatError struct {
+	Version byte
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("unsupported queue elem format version: %d", e.Version)
+}
+
+const (
+	// seqFlag is set in the identifier byte if the encoded elem has the 8 byte sequence.
+	seqFlag byte = 0x80
+	// codecFlag is set in the identifier byte if the encoded elem has the 1 byte codec version.
+	codecFlag byte = 0x40
+)
+
 // Encode encodes the publish structure into bytes and write it to the buffer
 func (p *Publish) Encode(b *bytes.Buffer) {
 	encoding.EncodeMessage(p.Message, b)
@@ -72,41 +103,99 @@ func (p *Pubrel) Decode(b *bytes.Buffer) (err error) {
 	return
 }
 
-// Encode encode the elem structure into bytes.
-// Format: 8 byte timestamp | 1 byte identifier| data
+// Encode encode the elem structure into bytes in the ElemFormatVersion format.
+// Format: 1 byte format version | 8 byte timestamp | 8 byte expiry | 1 byte identifier | data
+// If Seq is set, the seqFlag is set in the identifier and the 8 byte sequence is followed.
+// If Codec is set, the codecFlag is set in the identifier and the 1 byte codec version is followed.
 func (e *Elem) Encode() []byte {
 	b := bytes.NewBuffer(make([]byte, 0, 100))
-	rs := make([]byte, 19)
-	binary.BigEndian.PutUint64(rs[0:9], uint64(e.At.Unix()))
-	binary.BigEndian.PutUint64(rs[9:18], uint64(e.Expiry.Unix()))
+	rs := make([]byte, 18, 27)
+	rs[0] = ElemFormatVersion
+	binary.BigEndian.PutUint64(rs[1:9], uint64(e.At.Unix()))
+	binary.BigEndian.PutUint64(rs[9:17], uint64(e.Expiry.Unix()))
+	var flag byte
+	if e.Seq != 0 {
+		flag = seqFlag
+		rs = rs[:26]
+		binary.BigEndian.PutUint64(rs[18:26], e.Seq)
+	}
+	if e.Codec != 0 {
+		flag |= codecFlag
+		rs = append(rs, e.Codec)
+	}
 	switch m := e.MessageWithID.(type) {
 	case *Publish:
-		rs[18] = 0
+		rs[17] = 0 | flag
 		b.Write(rs)
 		m.Encode(b)
 	case *Pubrel:
-		rs[18] = 1
+		rs[17] = 1 | flag
 		b.Write(rs)
 		m.Encode(b)
 	}
 	return b.Bytes()
 }
 
+// Decode decodes the elem in the ElemFormatVersion format or any prior format.
+// It returns an UnsupportedFormatError if the elem is encoded in an unknown format, e.g: by a newer release.
 func (e *Elem) Decode(b []byte) (err error) {
+	if len(b) == 0 {
+		return errors.New("invalid input length")
+	}
+	switch b[0] {
+	case elemFormatV1:
+		return e.decodeV1(b)
+	case ElemFormatVersion:
+		if len(b) < 18 {
+			return errors.New("invalid input length")
+		}
+		e.At = time.Unix(int64(binary.BigEndian.Uint64(b[1:9])), 0)
+		e.Expiry = time.Unix(int64(binary.BigEndian.Uint64(b[9:17])), 0)
+		return e.decodeData(b[17], b[18:])
+	default:
+		return &UnsupportedFormatError{Version: b[0]}
+	}
+}
+
+// decodeV1 decodes the elem in the first format which has no format version.
+// Format: 8 byte timestamp | 1 byte padding | 8 byte expiry | 1 byte padding | 1 byte identifier | data
+// The format is recognized by the first byte, which is the highest byte of the timestamp and is always 0.
+func (e *Elem) decodeV1(b []byte) (err error) {
 	if len(b) < 19 {
 		return errors.New("invalid input length")
 	}
-	e.At = time.Unix(int64(binary.BigEndian.Uint64(b[0:9])), 0)
-	e.Expiry = time.Unix(int64(binary.BigEndian.Uint64(b[9:19])), 0)
-	switch b[18] {
+	e.At = time.Unix(int64(binary.BigEndian.Uint64(b[0:8])), 0)
+	e.Expiry = time.Unix(int64(binary.BigEndian.Uint64(b[9:17])), 0)
+	return e.decodeData(b[18], b[19:])
+}
+
+// decodeData decodes the optional sequence, the optional codec version and the message according to the identifier.
+func (e *Elem) decodeData(identifier byte, data []byte) (err error) {
+	e.Seq = 0
+	if identifier&seqFlag != 0 {
+		if len(data) < 8 {
+			return errors.New("invalid input length")
+		}
+		e.Seq = binary.BigEndian.Uint64(data[0:8])
+		data = data[8:]
+	}
+	e.Codec = 0
+	if identifier&codecFlag != 0 {
+		if len(data) < 1 {
+			return errors.New("invalid input length")
+		}
+		e.Codec = data[0]
+		data = data[1:]
+	}
+	switch identifier &^ (seqFlag | codecFlag) {
 	case 0: // publish
 		p := &Publish{}
-		buf := bytes.NewBuffer(b[19:])
+		buf := bytes.NewBuffer(data)
 		err = p.Decode(buf)
 		e.MessageWithID = p
 	case 1: // pubrel
 		p := &Pubrel{}
-		buf := bytes.NewBuffer(b[19:])
+		buf := bytes.NewBuffer(data)
 		err = p.Decode(buf)
 		e.MessageWithID = p
 	default:
@@ -1,6 +1,9 @@
 package queue
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"testing"
 	"time"
 
@@ -69,6 +72,124 @@ func TestElem_Encode_Pubrel(t *testing.T) {
 	assertElemEqual(a, e, de)
 }
 
+func TestElem_Encode_Seq(t *testing.T) {
+	a := assert.New(t)
+	for _, v := range []MessageWithID{
+		&Pubrel{PacketID: 2},
+		&Publish{Message: &gmqtt.Message{Topic: "a", Payload: []byte("b")}},
+	} {
+		e := &Elem{
+			At:            time.Unix(time.Now().Unix(), 0),
+			Seq:           1<<40 + 1,
+			MessageWithID: v,
+		}
+		rs := e.Encode()
+		de := &Elem{}
+		a.Nil(de.Decode(rs))
+		assertElemEqual(a, e, de)
+		a.Equal(e.Seq, de.Seq)
+		// truncated sequence
+		a.Error(de.Decode(rs[:22]))
+	}
+}
+
+func TestElem_Encode_Codec(t *testing.T) {
+	a := assert.New(t)
+	for _, seq := range []uint64{0, 1} {
+		e := &Elem{
+			At:            time.Unix(time.Now().Unix(), 0),
+			Seq:           seq,
+			Codec:         3,
+			MessageWithID: &Publish{Message: &gmqtt.Message{QoS: 1, Topic: "a", Payload: []byte("b")}},
+		}
+		rs := e.Encode()
+		de := &Elem{}
+		a.Nil(de.Decode(rs))
+		assertElemEqual(a, e, de)
+		// the elems encoded before the codec is introduced
+		e.Codec = 0
+		a.Nil(de.Decode(e.Encode()))
+		a.EqualValues(0, de.Codec)
+	}
+}
+
+// encodeV1 encodes the elem in the first format, which has no format version.
+func encodeV1(e *Elem) []byte {
+	b := bytes.NewBuffer(make([]byte, 0, 100))
+	rs := make([]byte, 19, 28)
+	binary.BigEndian.PutUint64(rs[0:9], uint64(e.At.Unix()))
+	binary.BigEndian.PutUint64(rs[9:18], uint64(e.Expiry.Unix()))
+	var flag byte
+	if e.Seq != 0 {
+		flag = seqFlag
+		rs = rs[:27]
+		binary.BigEndian.PutUint64(rs[19:27], e.Seq)
+	}
+	if e.Codec != 0 {
+		flag |= codecFlag
+		rs = append(rs, e.Codec)
+	}
+	switch m := e.MessageWithID.(type) {
+	case *Publish:
+		rs[18] = 0 | flag
+		b.Write(rs)
+		m.Encode(b)
+	case *Pubrel:
+		rs[18] = 1 | flag
+		b.Write(rs)
+		m.Encode(b)
+	}
+	return b.Bytes()
+}
+
+func TestElem_Decode_V1(t *testing.T) {
+	a := assert.New(t)
+	for _, v := range []*Elem{
+		{
+			At:            time.Unix(time.Now().Unix(), 0),
+			Expiry:        time.Unix(time.Now().Add(time.Hour).Unix(), 0),
+			MessageWithID: &Publish{Message: &gmqtt.Message{QoS: 1, Topic: "a", Payload: []byte("b"), PacketID: 1}},
+		},
+		{
+			At:            time.Unix(time.Now().Unix(), 0),
+			Seq:           1<<40 + 1,
+			Codec:         3,
+			MessageWithID: &Publish{Message: &gmqtt.Message{QoS: 1, Topic: "a", Payload: []byte("b")}},
+		},
+		{
+			At:            time.Unix(time.Now().Unix(), 0),
+			Seq:           2,
+			MessageWithID: &Pubrel{PacketID: 2},
+		},
+	} {
+		b := encodeV1(v)
+		a.EqualValues(0, b[0])
+		de := &Elem{}
+		a.Nil(de.Decode(b))
+		assertElemEqual(a, v, de)
+		// the elem is written back in the current format.
+		a.Equal(ElemFormatVersion, de.Encode()[0])
+	}
+}
+
+func TestElem_Decode_UnsupportedFormat(t *testing.T) {
+	a := assert.New(t)
+	e := &Elem{
+		At:            time.Now(),
+		MessageWithID: &Pubrel{PacketID: 2},
+	}
+	b := e.Encode()
+	b[0] = ElemFormatVersion + 1
+	var ufe *UnsupportedFormatError
+	err := (&Elem{}).Decode(b)
+	a.True(errors.As(err, &ufe))
+	a.Equal(ElemFormatVersion+1, ufe.Version)
+	a.EqualError(err, "unsupported queue elem format version: 3")
+
+	a.Error((&Elem{}).Decode(nil))
+	a.Error((&Elem{}).Decode([]byte{ElemFormatVersion, 1, 2}))
+}
+
 func Benchmark_Encode_Publish(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		e := &Elem{
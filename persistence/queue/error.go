@@ -10,6 +10,9 @@ var (
 	ErrDropQueueFull            = errors.New("the message queue is full")
 	ErrDropExpired              = errors.New("the message is expired")
 	ErrDropExpiredInflight      = errors.New("the inflight message is expired")
+	ErrDropInflightTrimmed      = errors.New("the inflight message exceeds the inflight window")
+	ErrDropCodecMismatch        = errors.New("the message is encoded by another payload codec")
+	ErrDropWriteBufferFull      = errors.New("the write buffer of the client is full")
 )
 
 // InternalError wraps the error of the backend storage.
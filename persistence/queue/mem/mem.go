@@ -7,18 +7,34 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/DrmagicE/gmqtt/config"
 	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/server"
 )
 
 var _ queue.Store = (*Queue)(nil)
+var _ queue.AgeReader = (*Queue)(nil)
+var _ queue.Drainer = (*Queue)(nil)
+var _ queue.Snapshotter = (*Queue)(nil)
+var _ queue.Iterator = (*Queue)(nil)
+var _ queue.Qos0Trimmer = (*Queue)(nil)
 
 type Options struct {
 	MaxQueuedMsg    int
 	InflightExpiry  time.Duration
 	ClientID        string
 	DefaultNotifier queue.Notifier
+	// OverflowStrategy is the strategy when the queue is full, see config.MQTT.QueueOverflowStrategy.
+	// If empty, use config.QueueOverflowDropOldest as default.
+	OverflowStrategy string
+	// MemoryWindow is the maximum number of elems kept in memory, the elems beyond the window are spilled to Overflow
+	// and paged in on read. MaxQueuedMsg is the limit of the elems in memory and in Overflow.
+	// 0 means all elems are kept in memory.
+	MemoryWindow int
+	// Overflow is the backend of the spilled elems, it must be set if MemoryWindow is not 0.
+	Overflow queue.Overflow
 }
 
 type Queue struct {
@@ -37,17 +53,32 @@ type Queue struct {
 	log            *zap.Logger
 	inflightExpiry time.Duration
 	notifier       queue.Notifier
+	// overflowStrategy is the strategy when the queue is full.
+	overflowStrategy string
+	// window is the maximum number of elems in l, 0 means no limit.
+	window   int
+	overflow queue.Overflow
+	// spilled is the number of elems in overflow, they are behind all elems in l.
+	spilled int
+	// qos0 and spilledQos0 are the number of non-inflight QoS 0 elems in l and in overflow, see TrimQos0.
+	qos0        int
+	spilledQos0 int
+	clock       clock.Clock
 }
 
 func New(opts Options) (*Queue, error) {
 	return &Queue{
-		clientID:       opts.ClientID,
-		cond:           sync.NewCond(&sync.Mutex{}),
-		l:              list.New(),
-		max:            opts.MaxQueuedMsg,
-		inflightExpiry: opts.InflightExpiry,
-		notifier:       opts.DefaultNotifier,
-		log:            server.LoggerWithField(zap.String("queue", "memory")),
+		clientID:         opts.ClientID,
+		cond:             sync.NewCond(&sync.Mutex{}),
+		l:                list.New(),
+		max:              opts.MaxQueuedMsg,
+		inflightExpiry:   opts.InflightExpiry,
+		notifier:         opts.DefaultNotifier,
+		overflowStrategy: opts.OverflowStrategy,
+		window:           opts.MemoryWindow,
+		overflow:         opts.Overflow,
+		clock:            clock.New(),
+		log:              server.LoggerWithField(zap.String("queue", "memory")),
 	}, nil
 }
 
@@ -66,52 +97,176 @@ func (q *Queue) Init(opts *queue.InitOptions) error {
 	q.inflightDrained = false
 	if opts.CleanStart {
 		q.l = list.New()
+		if q.overflow != nil {
+			if err := q.overflow.Clean(); err != nil {
+				return err
+			}
+		}
+		q.spilled = 0
+		q.qos0, q.spilledQos0 = 0, 0
+	} else if q.overflow != nil {
+		n, err := q.overflow.Len()
+		if err != nil {
+			return err
+		}
+		q.spilled = n
+		// the overflow may be left by the previous process.
+		q.spilledQos0 = 0
+		err = q.overflow.Iterate(func(elem *queue.Elem) (bool, error) {
+			if isQos0(elem) {
+				q.spilledQos0++
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
 	}
 	q.readBytesLimit = opts.ReadBytesLimit
 	q.version = opts.Version
 	q.current = q.l.Front()
 	q.notifier = opts.Notifier
+	if opts.Clock != nil {
+		q.clock = opts.Clock
+	}
 	q.cond.Signal()
 	return nil
 }
 
-func (*Queue) Clean() error {
+func (q *Queue) Clean() error {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.overflow == nil {
+		return nil
+	}
+	q.spilled = 0
+	q.spilledQos0 = 0
+	return q.overflow.Clean()
+}
+
+// isQos0 reports whether the elem is a non-inflight QoS 0 message.
+func isQos0(elem *queue.Elem) bool {
+	pub, ok := elem.MessageWithID.(*queue.Publish)
+	return ok && pub.ID() == 0 && pub.QoS == packets.Qos0
+}
+
+// remove removes the element from l.
+func (q *Queue) remove(e *list.Element) {
+	if isQos0(e.Value.(*queue.Elem)) {
+		q.qos0--
+	}
+	q.l.Remove(e)
+}
+
+// spill reports whether the elem to be added should be spilled to the overflow.
+// The elems in memory must be ahead of the spilled elems to keep the delivery order.
+func (q *Queue) spill() bool {
+	return q.window > 0 && (q.spilled != 0 || q.l.Len() >= q.window)
+}
+
+func (q *Queue) pushBack(elem *queue.Elem) error {
+	if q.spill() {
+		if err := q.overflow.Push(elem); err != nil {
+			return err
+		}
+		q.spilled++
+		if isQos0(elem) {
+			q.spilledQos0++
+		}
+		return nil
+	}
+	if isQos0(elem) {
+		q.qos0++
+	}
+	e := q.l.PushBack(elem)
+	if q.current == nil {
+		q.current = e
+	}
+	return nil
+}
+
+// pageIn moves the spilled elems into memory to fill up the window, at least n elems are moved if available.
+func (q *Queue) pageIn(n int) error {
+	if m := q.window - q.l.Len(); m > n {
+		n = m
+	}
+	elems, err := q.overflow.Pop(n)
+	if err != nil {
+		return err
+	}
+	if len(elems) < n {
+		q.spilled = 0
+	} else {
+		q.spilled -= len(elems)
+	}
+	for _, v := range elems {
+		if isQos0(v) {
+			q.spilledQos0--
+			q.qos0++
+		}
+		e := q.l.PushBack(v)
+		if q.current == nil {
+			q.current = e
+		}
+	}
 	return nil
 }
 
 func (q *Queue) Add(elem *queue.Elem) (err error) {
-	now := time.Now()
+	now := q.clock.Now()
 	var dropErr error
 	var dropElem *list.Element
 	var drop bool
+	// dropSpilled indicates the head of the spilled elems should be dropped.
+	var dropSpilled bool
+	// reject indicates the elem is rejected according to the overflow strategy.
+	var reject bool
 	q.cond.L.Lock()
 	defer func() {
 		q.cond.L.Unlock()
 		q.cond.Signal()
 	}()
 	defer func() {
+		if reject {
+			return
+		}
 		if drop {
 			if dropErr == queue.ErrDropExpiredInflight {
 				q.notifier.NotifyInflightAdded(-1)
 			}
-			if dropElem == nil {
+			if dropSpilled {
+				elems, popErr := q.overflow.Pop(1)
+				if popErr != nil || len(elems) == 0 {
+					q.notifier.NotifyDropped(elem, dropErr)
+					return
+				}
+				q.spilled--
+				if isQos0(elems[0]) {
+					q.spilledQos0--
+				}
+				q.notifier.NotifyDropped(elems[0], dropErr)
+			} else if dropElem == nil {
 				q.notifier.NotifyDropped(elem, dropErr)
 				return
+			} else {
+				if dropElem == q.current {
+					q.current = q.current.Next()
+				}
+				q.remove(dropElem)
+				q.notifier.NotifyDropped(dropElem.Value.(*queue.Elem), dropErr)
 			}
-			if dropElem == q.current {
-				q.current = q.current.Next()
+		}
+		if err = q.pushBack(elem); err != nil {
+			if drop {
+				q.notifier.NotifyMsgQueueAdded(-1)
 			}
-			q.l.Remove(dropElem)
-			q.notifier.NotifyDropped(dropElem.Value.(*queue.Elem), dropErr)
-		} else {
-			q.notifier.NotifyMsgQueueAdded(1)
+			return
 		}
-		e := q.l.PushBack(elem)
-		if q.current == nil {
-			q.current = e
+		if !drop {
+			q.notifier.NotifyMsgQueueAdded(1)
 		}
 	}()
-	if q.l.Len() >= q.max {
+	if q.l.Len()+q.spilled >= q.max {
 		// set default drop error
 		dropErr = queue.ErrDropQueueFull
 		drop = true
@@ -126,7 +281,11 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 		}
 
 		// drop the current elem if there is no more non-inflight messages.
-		if q.inflightDrained && q.current == nil {
+		if q.inflightDrained && q.current == nil && q.spilled == 0 {
+			if q.reject(elem) {
+				drop, reject = false, true
+				return queue.ErrDropQueueFull
+			}
 			return
 		}
 		for e := q.current; e != nil; e = e.Next() {
@@ -149,10 +308,18 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 		if elem.MessageWithID.(*queue.Publish).QoS == packets.Qos0 {
 			return
 		}
+		if q.reject(elem) {
+			drop, reject = false, true
+			return queue.ErrDropQueueFull
+		}
+		if q.overflowStrategy == config.QueueOverflowDropNewest {
+			return
+		}
 
 		if q.inflightDrained {
 			// drop the front message
 			dropElem = q.current
+			dropSpilled = q.current == nil
 			return
 		}
 		// the messages in the queue are all inflight messages, drop the current elem
@@ -161,6 +328,11 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 	return nil
 }
 
+// reject reports whether the elem should be rejected instead of dropped when the queue is full.
+func (q *Queue) reject(elem *queue.Elem) bool {
+	return q.overflowStrategy == config.QueueOverflowReject && elem.MessageWithID.(*queue.Publish).QoS > packets.Qos0
+}
+
 func (q *Queue) Replace(elem *queue.Elem) (replaced bool, err error) {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
@@ -175,13 +347,21 @@ func (q *Queue) Replace(elem *queue.Elem) (replaced bool, err error) {
 }
 
 func (q *Queue) Read(pids []packets.PacketID) (rs []*queue.Elem, err error) {
-	now := time.Now()
+	now := q.clock.Now()
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 	if !q.inflightDrained {
 		panic("must call ReadInflight to drain all inflight messages before Read")
 	}
-	for (q.l.Len() == 0 || q.current == nil) && !q.closed {
+	for !q.closed {
+		if q.current == nil && q.spilled != 0 {
+			if err = q.pageIn(len(pids)); err != nil {
+				return nil, err
+			}
+		}
+		if q.current != nil {
+			break
+		}
 		q.cond.Wait()
 	}
 	if q.closed {
@@ -199,7 +379,7 @@ func (q *Queue) Read(pids []packets.PacketID) (rs []*queue.Elem, err error) {
 		if queue.ElemExpiry(now, v.Value.(*queue.Elem)) {
 			q.current = q.current.Next()
 			q.notifier.NotifyDropped(v.Value.(*queue.Elem), queue.ErrDropExpired)
-			q.l.Remove(v)
+			q.remove(v)
 			msgQueueDelta--
 			continue
 		}
@@ -208,7 +388,7 @@ func (q *Queue) Read(pids []packets.PacketID) (rs []*queue.Elem, err error) {
 		if size := pub.TotalBytes(q.version); size > q.readBytesLimit {
 			q.current = q.current.Next()
 			q.notifier.NotifyDropped(v.Value.(*queue.Elem), queue.ErrDropExceedsMaxPacketSize)
-			q.l.Remove(v)
+			q.remove(v)
 			msgQueueDelta--
 			continue
 		}
@@ -216,11 +396,12 @@ func (q *Queue) Read(pids []packets.PacketID) (rs []*queue.Elem, err error) {
 		// remove qos 0 message after read
 		if pub.QoS == 0 {
 			q.current = q.current.Next()
-			q.l.Remove(v)
+			q.remove(v)
 			msgQueueDelta--
 		} else {
 			pub.SetID(pids[pflag])
 			// When the message becomes inflight message, update the expiry time.
+			v.Value.(*queue.Elem).Expiry = time.Time{}
 			if q.inflightExpiry != 0 {
 				v.Value.(*queue.Elem).Expiry = now.Add(q.inflightExpiry)
 			}
@@ -249,7 +430,7 @@ func (q *Queue) ReadInflight(maxSize uint) (rs []*queue.Elem, err error) {
 	for i := 0; i < length && q.current != nil; i++ {
 		if e := q.current.Value.(*queue.Elem); e.ID() != 0 {
 			if q.inflightExpiry != 0 {
-				e.Expiry = time.Now().Add(q.inflightExpiry)
+				e.Expiry = q.clock.Now().Add(q.inflightExpiry)
 			}
 			rs = append(rs, e)
 			q.current = q.current.Next()
@@ -268,7 +449,7 @@ func (q *Queue) Remove(pid packets.PacketID) error {
 	unread := q.current
 	for e := q.l.Front(); e != nil && e != unread; e = e.Next() {
 		if e.Value.(*queue.Elem).ID() == pid {
-			q.l.Remove(e)
+			q.remove(e)
 			q.notifier.NotifyMsgQueueAdded(-1)
 			q.notifier.NotifyInflightAdded(-1)
 			return nil
@@ -276,3 +457,151 @@ func (q *Queue) Remove(pid packets.PacketID) error {
 	}
 	return nil
 }
+
+// OldestQueuedAt implements queue.AgeReader.
+func (q *Queue) OldestQueuedAt() time.Time {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.current != nil {
+		return q.current.Value.(*queue.Elem).At
+	}
+	var at time.Time
+	if q.spilled != 0 {
+		_ = q.overflow.Iterate(func(elem *queue.Elem) (bool, error) {
+			at = elem.At
+			return false, nil
+		})
+	}
+	return at
+}
+
+// Len implements queue.Drainer.
+func (q *Queue) Len() (int, error) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.l.Len() + q.spilled, nil
+}
+
+// Snapshot implements queue.Snapshotter.
+func (q *Queue) Snapshot() ([]*queue.Elem, error) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	elems := make([]*queue.Elem, 0, q.l.Len()+q.spilled)
+	for e := q.l.Front(); e != nil; e = e.Next() {
+		elems = append(elems, e.Value.(*queue.Elem))
+	}
+	if q.spilled == 0 {
+		return elems, nil
+	}
+	err := q.overflow.Iterate(func(elem *queue.Elem) (bool, error) {
+		elems = append(elems, elem)
+		return true, nil
+	})
+	return elems, err
+}
+
+// Iterate implements queue.Iterator.
+func (q *Queue) Iterate(fn func(elem *queue.Elem) (bool, error)) error {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for e := q.l.Front(); e != nil; e = e.Next() {
+		cont, err := fn(e.Value.(*queue.Elem))
+		if err != nil || !cont {
+			return err
+		}
+	}
+	if q.spilled == 0 {
+		return nil
+	}
+	return q.overflow.Iterate(fn)
+}
+
+// TrimQos0 implements queue.Qos0Trimmer.
+// The QoS 0 elems are counted as they are added and removed, so the queue is only walked if there are elems to drop.
+// The elems in memory are older than the spilled elems, they are dropped first.
+func (q *Queue) TrimQos0(max int) error {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for e := q.current; e != nil && q.qos0 != 0 && q.qos0+q.spilledQos0 > max; {
+		next := e.Next()
+		if elem := e.Value.(*queue.Elem); isQos0(elem) {
+			if e == q.current {
+				q.current = next
+			}
+			q.remove(e)
+			q.notifier.NotifyDropped(elem, queue.ErrDropQueueFull)
+			q.notifier.NotifyMsgQueueAdded(-1)
+		}
+		e = next
+	}
+	if q.spilledQos0 == 0 || q.qos0+q.spilledQos0 <= max {
+		return nil
+	}
+	return q.trimSpilledQos0(max)
+}
+
+// trimSpilledQos0 drops the oldest spilled QoS 0 elems until at most max QoS 0 elems are left in the queue.
+// The overflow can only be popped from the head, so the spilled elems are popped and the others are pushed back in order.
+func (q *Queue) trimSpilledQos0(max int) error {
+	elems, err := q.overflow.Pop(q.spilled)
+	if err != nil {
+		return err
+	}
+	var kept, dropped []*queue.Elem
+	for _, v := range elems {
+		if isQos0(v) && q.qos0+q.spilledQos0 > max {
+			q.spilledQos0--
+			dropped = append(dropped, v)
+			continue
+		}
+		kept = append(kept, v)
+	}
+	q.spilled = 0
+	for _, v := range dropped {
+		q.notifier.NotifyDropped(v, queue.ErrDropQueueFull)
+	}
+	removed := len(dropped)
+	if len(kept) != 0 {
+		if err = q.overflow.Push(kept...); err != nil {
+			// the popped elems are lost.
+			q.spilledQos0 = 0
+			for _, v := range kept {
+				q.notifier.NotifyDropped(v, &queue.InternalError{Err: err})
+			}
+			removed += len(kept)
+		} else {
+			q.spilled = len(kept)
+		}
+	}
+	q.notifier.NotifyMsgQueueAdded(-removed)
+	return err
+}
+
+// Drain implements queue.Drainer.
+func (q *Queue) Drain() ([]*queue.Elem, error) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	elems := make([]*queue.Elem, 0, q.l.Len()+q.spilled)
+	var inflight int
+	for e := q.l.Front(); e != nil; e = e.Next() {
+		elem := e.Value.(*queue.Elem)
+		if elem.ID() != 0 {
+			inflight++
+		}
+		elems = append(elems, elem)
+	}
+	if q.spilled != 0 {
+		spilled, err := q.overflow.Pop(q.spilled)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, spilled...)
+		q.spilled = 0
+	}
+	q.l = list.New()
+	q.current = nil
+	q.qos0, q.spilledQos0 = 0, 0
+	q.notifier.NotifyMsgQueueAdded(-len(elems))
+	q.notifier.NotifyInflightAdded(-inflight)
+	return elems, nil
+}
@@ -3,6 +3,7 @@ package queue
 import (
 	"time"
 
+	"github.com/DrmagicE/gmqtt/pkg/clock"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 )
 
@@ -15,6 +16,9 @@ type InitOptions struct {
 	// ReadBytesLimit indicates the maximum publish size that is allow to read.
 	ReadBytesLimit uint32
 	Notifier       Notifier
+	// Clock is the time source to check the expiry of the messages, nil means the wall clock.
+	// The implementation should use the wall clock before the first Init.
+	Clock clock.Clock
 }
 
 // Store represents a queue store for one client.
@@ -35,6 +39,10 @@ type Store interface {
 	// 3. Drop expired non-inflight message.
 	// 4. Drop qos0 message.
 	// 5. Drop the front message.
+	// The implementation should apply the overflow strategy (see config.MQTT.QueueOverflowStrategy) to the QoS 1 and QoS 2 elem
+	// when none of 1, 3 and 4 applies:
+	// "drop_newest" drops the given elem instead of the front message,
+	// "reject" does not drop any elem nor notify, but returns ErrDropQueueFull, and the caller is responsible for reporting the drop.
 	// See queue.mem for more details.
 	Add(elem *Elem) error
 	// Replace replaces the PUBLISH with the PUBREL with the same packet id.
@@ -46,6 +54,8 @@ type Store interface {
 	// 1. expired messages
 	// 2. publish message which exceeds the InitOptions.ReadBytesLimit
 	// while reading.
+	// The qos1 and qos2 messages become inflight after read, their Expiry is reset to the inflight expiry (if any),
+	// because the message expiry no longer applies once the delivery has started.
 	// The caller must call ReadInflight first to read all inflight message before calling this method.
 	// Calling this method will be blocked until there are any new messages can be read or the store has been closed.
 	// If the store has been closed, returns nil, ErrClosed.
@@ -60,6 +70,68 @@ type Store interface {
 	Remove(pid packets.PacketID) error
 }
 
+// AgeReader is an optional interface for Store to report how long the undelivered messages have been waiting.
+type AgeReader interface {
+	// OldestQueuedAt returns the Elem.At of the next message to be read, i.e: the oldest message waiting for delivery.
+	// It returns zero time if there is no such message.
+	OldestQueuedAt() time.Time
+}
+
+// Drainer is an optional interface for Store to move the queued messages to another client.
+// It is required by server.ClientService.MigrateQueue.
+type Drainer interface {
+	// Len returns the number of elems in the queue, including the inflight ones.
+	Len() (int, error)
+	// Drain removes all elems from the queue and returns them in order, including the inflight ones.
+	// The inflight elems are the elems with non-zero packet id.
+	// It is only called when the client is disconnected.
+	Drain() ([]*Elem, error)
+}
+
+// Snapshotter is an optional interface for Store to read the queued messages without removing them.
+// It is required by server.BackupablePersistence.
+type Snapshotter interface {
+	// Snapshot returns all elems in the queue in order, including the inflight ones.
+	Snapshot() ([]*Elem, error)
+}
+
+// Iterator is an optional interface for Store to walk through the queued messages without removing them,
+// e.g: to inspect the queue of a client.
+type Iterator interface {
+	// Iterate calls fn for each elem in the queue in delivery order, including the inflight ones.
+	// The iteration stops if fn returns false or an error, and the error is returned by Iterate.
+	// fn must not modify the elem or call the methods of the Store.
+	Iterate(fn func(elem *Elem) (bool, error)) error
+}
+
+// Qos0Trimmer is an optional interface for Store to bound the QoS 0 messages queued for an offline session,
+// see config.MQTT.MaxOfflineQos0Msg.
+type Qos0Trimmer interface {
+	// TrimQos0 drops the oldest non-inflight QoS 0 elems until at most max of them are left in the queue.
+	// The dropped elems are reported to the Notifier with ErrDropQueueFull.
+	// It is called for every QoS 0 message queued for an offline session,
+	// so the implementation should not walk the queue unless there are elems to drop.
+	TrimQos0(max int) error
+}
+
+// Overflow is the backend of the elems spilled from the memory window of a queue, see mem.Options.MemoryWindow.
+// The spilled elems are never inflight, they are kept in the enqueue order.
+// The methods are called while the queue is locked, and Push is called by the enqueue which holds the server lock,
+// so the implementation must bound the time of its I/O.
+type Overflow interface {
+	// Push appends the elems to the tail.
+	Push(elems ...*Elem) error
+	// Pop removes and returns at most n elems from the head.
+	Pop(n int) ([]*Elem, error)
+	// Len returns the number of elems.
+	Len() (int, error)
+	// Iterate calls fn for each elem from the head without removing them.
+	// The iteration stops if fn returns false or an error, and the error is returned by Iterate.
+	Iterate(fn func(elem *Elem) (bool, error)) error
+	// Clean removes all elems.
+	Clean() error
+}
+
 type Notifier interface {
 	// NotifyDropped will be called when the element in the queue is dropped.
 	// The err indicates the reason of why it is dropped.
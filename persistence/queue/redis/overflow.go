@@ -0,0 +1,134 @@
+package redis
+
+import (
+	redigo "github.com/gomodule/redigo/redis"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+const (
+	overflowPrefix = "queue_overflow:"
+)
+
+var _ queue.Overflow = (*Overflow)(nil)
+
+func getOverflowKey(clientID string) string {
+	return overflowPrefix + clientID
+}
+
+// Overflow is the redis implementation of queue.Overflow, the elems are stored in a redis list per client.
+type Overflow struct {
+	pool     *redigo.Pool
+	clientID string
+}
+
+// NewOverflow returns the overflow of the client.
+func NewOverflow(pool *redigo.Pool, clientID string) *Overflow {
+	return &Overflow{
+		pool:     pool,
+		clientID: clientID,
+	}
+}
+
+// Push implements queue.Overflow.
+func (o *Overflow) Push(elems ...*queue.Elem) error {
+	if len(elems) == 0 {
+		return nil
+	}
+	conn := o.pool.Get()
+	defer conn.Close()
+	args := make([]interface{}, 0, len(elems)+1)
+	args = append(args, getOverflowKey(o.clientID))
+	for _, e := range elems {
+		args = append(args, e.Encode())
+	}
+	_, err := conn.Do("rpush", args...)
+	if err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// Pop implements queue.Overflow.
+func (o *Overflow) Pop(n int) ([]*queue.Elem, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	conn := o.pool.Get()
+	defer conn.Close()
+	key := getOverflowKey(o.clientID)
+	err := conn.Send("multi")
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	_ = conn.Send("lrange", key, 0, n-1)
+	_ = conn.Send("ltrim", key, n, -1)
+	rs, err := redigo.Values(conn.Do("exec"))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	vs, err := redigo.Values(rs[0], nil)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return decodeElems(vs)
+}
+
+// Len implements queue.Overflow.
+func (o *Overflow) Len() (int, error) {
+	conn := o.pool.Get()
+	defer conn.Close()
+	l, err := redigo.Int(conn.Do("llen", getOverflowKey(o.clientID)))
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return l, nil
+}
+
+// Iterate implements queue.Overflow.
+func (o *Overflow) Iterate(fn func(elem *queue.Elem) (bool, error)) error {
+	conn := o.pool.Get()
+	defer conn.Close()
+	for start := 0; ; start += iteratePageSize {
+		rs, err := redigo.Values(conn.Do("lrange", getOverflowKey(o.clientID), start, start+iteratePageSize-1))
+		if err != nil {
+			return wrapError(err)
+		}
+		elems, err := decodeElems(rs)
+		if err != nil {
+			return err
+		}
+		for _, e := range elems {
+			cont, err := fn(e)
+			if err != nil || !cont {
+				return err
+			}
+		}
+		if len(rs) < iteratePageSize {
+			return nil
+		}
+	}
+}
+
+// Clean implements queue.Overflow.
+func (o *Overflow) Clean() error {
+	conn := o.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("del", getOverflowKey(o.clientID))
+	if err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+func decodeElems(vs []interface{}) ([]*queue.Elem, error) {
+	elems := make([]*queue.Elem, 0, len(vs))
+	for _, v := range vs {
+		e := &queue.Elem{}
+		if err := e.Decode(v.([]byte)); err != nil {
+			return nil, err
+		}
+		elems = append(elems, e)
+	}
+	return elems, nil
+}
@@ -0,0 +1,156 @@
+package redis
+
+import (
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+// Pipeline batches the enqueued messages of the queues which share it,
+// and writes them into redis using pipelining, one RPUSH command for each queue.
+// The messages are flushed after the flush window elapses or the number of the pending messages reaches the max batch size.
+//
+// A single RPUSH with multiple values is atomic in redis, so the readers never observe a torn batch.
+// The queue flushes its own pending messages before reading from redis, so the messages are always read in the enqueue order.
+type Pipeline struct {
+	pool     *redigo.Pool
+	window   time.Duration
+	maxBatch int
+	log      *zap.Logger
+	// flushMu serializes the flushes, so that the batches of the same queue are written in order.
+	flushMu sync.Mutex
+
+	mu sync.Mutex
+	// dirty is the queues which have pending messages.
+	dirty []*Queue
+	// size is the number of the pending messages in all dirty queues.
+	size  int
+	timer *time.Timer
+	// kicked indicates whether a flush has been triggered by the max batch size.
+	kicked bool
+	closed bool
+}
+
+// NewPipeline returns a new Pipeline. If maxBatch <= 0, the messages are flushed only when the flush window elapses.
+func NewPipeline(pool *redigo.Pool, window time.Duration, maxBatch int) *Pipeline {
+	return &Pipeline{
+		pool:     pool,
+		window:   window,
+		maxBatch: maxBatch,
+		log:      server.LoggerWithField(zap.String("queue", "redis_pipeline")),
+	}
+}
+
+// add marks the queue as dirty with n more pending messages, must be called with the queue lock held.
+func (p *Pipeline) add(q *Queue, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !q.inPipeline {
+		q.inPipeline = true
+		p.dirty = append(p.dirty, q)
+	}
+	p.size += n
+	if p.closed {
+		// the messages will be flushed by the queue itself.
+		return
+	}
+	if p.maxBatch > 0 && p.size >= p.maxBatch {
+		if !p.kicked {
+			p.kicked = true
+			p.stopTimerLocked()
+			go p.Flush()
+		}
+		return
+	}
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.window, p.Flush)
+	}
+}
+
+func (p *Pipeline) stopTimerLocked() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// Flush writes the pending messages of all dirty queues into redis in one round trip.
+func (p *Pipeline) Flush() {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+	p.mu.Lock()
+	dirty := p.dirty
+	p.dirty = nil
+	p.size = 0
+	p.kicked = false
+	p.stopTimerLocked()
+	for _, q := range dirty {
+		q.inPipeline = false
+	}
+	p.mu.Unlock()
+	if len(dirty) == 0 {
+		return
+	}
+
+	batches := make([]*pipelineBatch, 0, len(dirty))
+	for _, q := range dirty {
+		if b := q.takePending(); b != nil {
+			batches = append(batches, b)
+		}
+	}
+	if len(batches) == 0 {
+		return
+	}
+	conn := p.pool.Get()
+	defer conn.Close()
+	var err error
+	for _, b := range batches {
+		if err = conn.Send("rpush", b.args...); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = conn.Flush()
+	}
+	for _, b := range batches {
+		if err == nil {
+			_, replyErr := conn.Receive()
+			if _, ok := replyErr.(redigo.Error); ok {
+				// the command is rejected by redis, retrying will not help.
+				p.log.Error("failed to flush the queue pipeline", zap.String("client_id", b.q.clientID), zap.Error(replyErr))
+				b.q.finishPending(b, replyErr, false)
+				continue
+			}
+			// the connection is broken, the rest replies can not be received.
+			err = replyErr
+		}
+		if err != nil {
+			p.log.Error("failed to flush the queue pipeline, retry later", zap.String("client_id", b.q.clientID), zap.Error(err))
+			b.q.finishPending(b, err, true)
+			continue
+		}
+		b.q.finishPending(b, nil, false)
+	}
+}
+
+// Close stops the flush timer and writes the remaining pending messages into redis.
+func (p *Pipeline) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.stopTimerLocked()
+	p.mu.Unlock()
+	p.Flush()
+}
+
+// pipelineBatch is the pending messages of a queue which is being flushed.
+type pipelineBatch struct {
+	q     *Queue
+	elems []*queue.Elem
+	// args is the arguments of the RPUSH command.
+	args []interface{}
+}
@@ -7,6 +7,8 @@ import (
 	redigo "github.com/gomodule/redigo/redis"
 	"go.uber.org/zap"
 
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
 	"github.com/DrmagicE/gmqtt/pkg/codes"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/server"
@@ -19,6 +21,14 @@ const (
 )
 
 var _ queue.Store = (*Queue)(nil)
+var _ queue.AgeReader = (*Queue)(nil)
+var _ queue.Drainer = (*Queue)(nil)
+var _ queue.Snapshotter = (*Queue)(nil)
+var _ queue.Iterator = (*Queue)(nil)
+var _ queue.Verifier = (*Queue)(nil)
+
+// iteratePageSize is the number of elems read from redis in one round trip by Iterate.
+const iteratePageSize = 100
 
 func getKey(clientID string) string {
 	return queuePrefix + clientID
@@ -30,6 +40,30 @@ type Options struct {
 	InflightExpiry  time.Duration
 	Pool            *redigo.Pool
 	DefaultNotifier queue.Notifier
+	// InflightGranularity is the granularity of persisting the inflight state.
+	// See config.InflightGranularityFull and config.InflightGranularityMessage for details.
+	// If empty, use config.InflightGranularityFull as default.
+	InflightGranularity config.InflightGranularity
+	// Pipeline batches the enqueued messages of the queues which share it.
+	// If nil, each message is written into redis in its own round trip.
+	Pipeline *Pipeline
+	// OverflowStrategy is the strategy when the queue is full, see config.MQTT.QueueOverflowStrategy.
+	// If empty, use config.QueueOverflowDropOldest as default.
+	OverflowStrategy string
+	// VerifyOnInit indicates whether to verify the order of the elems when the queue is initialized without clean start.
+	VerifyOnInit bool
+	// DropDuplicates indicates whether to remove the duplicate elems found by the verification on Init.
+	DropDuplicates bool
+}
+
+// deletedElem is set to the elems to be removed by lrem.
+const deletedElem = "__deleted__"
+
+// inflightElem is the in-memory inflight state in config.InflightGranularityMessage mode.
+type inflightElem struct {
+	// raw is the bytes stored in redis.
+	raw  []byte
+	elem *queue.Elem
 }
 
 type Queue struct {
@@ -51,24 +85,63 @@ type Queue struct {
 	log            *zap.Logger
 	inflightExpiry time.Duration
 	notifier       queue.Notifier
+	// memInflight indicates whether the inflight state is kept in memory instead of redis.
+	memInflight bool
+	// inflight is the in-memory inflight state if memInflight is true,
+	// the index of the elem is the same as the index in the redis list.
+	inflight []*inflightElem
+	// headAt caches the Elem.At of the element at current index, it is valid only if headCached is true.
+	headAt     time.Time
+	headCached bool
+	clock      clock.Clock
+
+	// pipeline is nil if the pipelining is disabled.
+	pipeline *Pipeline
+	// pending is the enqueued elems which have not been written into redis yet, they are counted in len.
+	pending []*queue.Elem
+	// flushing indicates whether a batch of the pending elems is being written by the pipeline.
+	flushing bool
+	// flushed is broadcast when the pipeline finishes writing the batch.
+	flushed *sync.Cond
+	// inPipeline indicates whether the queue is in the dirty list of the pipeline, guarded by the pipeline mutex.
+	inPipeline bool
+	// overflowStrategy is the strategy when the queue is full.
+	overflowStrategy string
+	// seq is the Elem.Seq of the last enqueued elem.
+	seq            uint64
+	verifyOnInit   bool
+	dropDuplicates bool
 }
 
 func New(opts Options) (*Queue, error) {
+	mu := &sync.Mutex{}
 	return &Queue{
-		cond:            sync.NewCond(&sync.Mutex{}),
-		clientID:        opts.ClientID,
-		max:             opts.MaxQueuedMsg,
-		len:             0,
-		pool:            opts.Pool,
-		closed:          false,
-		inflightDrained: false,
-		current:         0,
-		inflightExpiry:  opts.InflightExpiry,
-		notifier:        opts.DefaultNotifier,
-		log:             server.LoggerWithField(zap.String("queue", "redis")),
+		cond:             sync.NewCond(mu),
+		flushed:          sync.NewCond(mu),
+		pipeline:         opts.Pipeline,
+		clientID:         opts.ClientID,
+		max:              opts.MaxQueuedMsg,
+		len:              0,
+		pool:             opts.Pool,
+		closed:           false,
+		inflightDrained:  false,
+		current:          0,
+		inflightExpiry:   opts.InflightExpiry,
+		notifier:         opts.DefaultNotifier,
+		memInflight:      opts.InflightGranularity == config.InflightGranularityMessage,
+		overflowStrategy: opts.OverflowStrategy,
+		verifyOnInit:     opts.VerifyOnInit,
+		dropDuplicates:   opts.DropDuplicates,
+		clock:            clock.New(),
+		log:              server.LoggerWithField(zap.String("queue", "redis")),
 	}, nil
 }
 
+// reject reports whether the elem should be rejected instead of dropped when the queue is full.
+func (q *Queue) reject(elem *queue.Elem) bool {
+	return q.overflowStrategy == config.QueueOverflowReject && elem.MessageWithID.(*queue.Publish).QoS > packets.Qos0
+}
+
 func wrapError(err error) *codes.Error {
 	return &codes.Error{
 		Code: codes.UnspecifiedError,
@@ -89,6 +162,79 @@ func (q *Queue) Close() error {
 	return nil
 }
 
+// takePending takes the pending elems to be written by the pipeline.
+func (q *Queue) takePending() *pipelineBatch {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	b := &pipelineBatch{
+		q:     q,
+		elems: q.pending,
+		args:  q.rpushArgs(q.pending),
+	}
+	q.pending = nil
+	q.flushing = true
+	return b
+}
+
+// finishPending is called after the pipeline writes the batch.
+// If retry is true, the elems are put back to be written in the next flush, otherwise the failed elems are dropped.
+func (q *Queue) finishPending(b *pipelineBatch, err error, retry bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.flushing = false
+	q.flushed.Broadcast()
+	if err == nil {
+		return
+	}
+	if retry {
+		q.pending = append(b.elems, q.pending...)
+		q.pipeline.add(q, len(b.elems))
+		return
+	}
+	q.len -= len(b.elems)
+	q.headCached = false
+	for _, e := range b.elems {
+		q.notifier.NotifyDropped(e, wrapError(err))
+	}
+	q.notifier.NotifyMsgQueueAdded(-len(b.elems))
+}
+
+func (q *Queue) rpushArgs(elems []*queue.Elem) []interface{} {
+	args := make([]interface{}, 0, len(elems)+1)
+	args = append(args, getKey(q.clientID))
+	for _, e := range elems {
+		args = append(args, e.Encode())
+	}
+	return args
+}
+
+// flushLocked writes the pending elems into redis, so that the subsequent reads observe all enqueued elems in order.
+func (q *Queue) flushLocked(conn redigo.Conn) error {
+	for q.flushing {
+		q.flushed.Wait()
+	}
+	if len(q.pending) == 0 {
+		return nil
+	}
+	_, err := conn.Do("rpush", q.rpushArgs(q.pending)...)
+	if err != nil {
+		return wrapError(err)
+	}
+	q.pending = nil
+	return nil
+}
+
+// discardPendingLocked discards the pending elems before the queue is deleted.
+func (q *Queue) discardPendingLocked() {
+	for q.flushing {
+		q.flushed.Wait()
+	}
+	q.pending = nil
+}
+
 func (q *Queue) setLen(conn redigo.Conn) error {
 	l, err := conn.Do("llen", getKey(q.clientID))
 	if err != nil {
@@ -105,10 +251,19 @@ func (q *Queue) Init(opts *queue.InitOptions) error {
 	defer conn.Close()
 
 	if opts.CleanStart {
+		q.discardPendingLocked()
 		_, err := conn.Do("del", getKey(q.clientID))
 		if err != nil {
 			return wrapError(err)
 		}
+		q.inflight = nil
+	} else {
+		if err := q.flushLocked(conn); err != nil {
+			return err
+		}
+		if err := q.initSeq(conn); err != nil {
+			return err
+		}
 	}
 	err := q.setLen(conn)
 	if err != nil {
@@ -119,38 +274,159 @@ func (q *Queue) Init(opts *queue.InitOptions) error {
 	q.closed = false
 	q.inflightDrained = false
 	q.current = 0
+	q.headCached = false
 	q.readCache = make(map[packets.PacketID][]byte)
 	q.notifier = opts.Notifier
+	if opts.Clock != nil {
+		q.clock = opts.Clock
+	}
 	q.cond.Signal()
 	return nil
 }
 
+// initSeq restores the sequence from the elems in redis, and verifies the elems if verifyOnInit is true.
+func (q *Queue) initSeq(conn redigo.Conn) error {
+	if !q.verifyOnInit {
+		b, err := redigo.Bytes(conn.Do("lindex", getKey(q.clientID), -1))
+		if err == redigo.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return wrapError(err)
+		}
+		e := &queue.Elem{}
+		if err = e.Decode(b); err != nil {
+			return err
+		}
+		if e.Seq > q.seq {
+			q.seq = e.Seq
+		}
+		return nil
+	}
+	elems, err := q.readElems(conn)
+	if err != nil {
+		return err
+	}
+	for _, v := range elems {
+		if v.Seq > q.seq {
+			q.seq = v.Seq
+		}
+	}
+	anomalies := queue.VerifyElems(elems)
+	var duplicates int
+	for _, v := range anomalies {
+		q.log.Warn("queue order anomaly found",
+			zap.String("client_id", q.clientID),
+			zap.String("type", string(v.Type)),
+			zap.Int("index", v.Index),
+			zap.Uint64("seq", v.Seq),
+			zap.Uint16("packet_id", v.PacketID))
+		if q.dropDuplicates && v.Type == queue.AnomalyDuplicate {
+			duplicates++
+			if _, err = conn.Do("lset", getKey(q.clientID), v.Index, deletedElem); err != nil {
+				return wrapError(err)
+			}
+		}
+	}
+	if duplicates != 0 {
+		if _, err = conn.Do("lrem", getKey(q.clientID), 0, deletedElem); err != nil {
+			return wrapError(err)
+		}
+		q.log.Warn("duplicate elems removed", zap.String("client_id", q.clientID), zap.Int("removed", duplicates))
+	}
+	return nil
+}
+
+// readElems reads and decodes all elems stored in redis.
+func (q *Queue) readElems(conn redigo.Conn) ([]*queue.Elem, error) {
+	rs, err := redigo.Values(conn.Do("lrange", getKey(q.clientID), 0, -1))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	elems := make([]*queue.Elem, 0, len(rs))
+	for _, v := range rs {
+		e := &queue.Elem{}
+		if err = e.Decode(v.([]byte)); err != nil {
+			return nil, err
+		}
+		elems = append(elems, e)
+	}
+	return elems, nil
+}
+
+// Verify implements queue.Verifier.
+// The queue is only locked to flush the pending elems, the elems are read by a single lrange which is atomic in redis.
+// In config.InflightGranularityMessage mode, the packet ids of the inflight elems are kept in memory, thus they are not verified.
+func (q *Queue) Verify() ([]queue.Anomaly, error) {
+	conn := q.pool.Get()
+	defer conn.Close()
+	q.cond.L.Lock()
+	err := q.flushLocked(conn)
+	q.cond.L.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	elems, err := q.readElems(conn)
+	if err != nil {
+		return nil, err
+	}
+	return queue.VerifyElems(elems), nil
+}
+
 func (q *Queue) Clean() error {
+	q.cond.L.Lock()
+	q.discardPendingLocked()
+	q.inflight = nil
+	q.headCached = false
+	q.cond.L.Unlock()
 	conn := q.pool.Get()
 	defer conn.Close()
 	_, err := conn.Do("del", getKey(q.clientID))
 	return err
 }
 
+// removeInflight removes the in-memory inflight elem with the given index.
+func (q *Queue) removeInflight(index int) {
+	q.inflight = append(q.inflight[:index], q.inflight[index+1:]...)
+}
+
 func (q *Queue) Add(elem *queue.Elem) (err error) {
-	now := time.Now()
+	now := q.clock.Now()
 	conn := q.pool.Get()
 	q.cond.L.Lock()
 	var dropErr error
 	var dropBytes []byte
 	var dropElem *queue.Elem
 	var drop bool
+	// reject indicates the elem is rejected according to the overflow strategy.
+	var reject bool
+	// dropInflight is the index of the dropped in-memory inflight elem.
+	dropInflight := -1
 	defer func() {
 		conn.Close()
 		q.cond.L.Unlock()
 		q.cond.Signal()
 	}()
 
+	q.seq++
+	elem.Seq = q.seq
+	// the head changes if the queue has no message to read or any message is dropped.
+	if q.current >= q.len {
+		q.headCached = false
+	}
 	defer func() {
+		if reject {
+			return
+		}
 		if drop {
+			q.headCached = false
 			if dropErr == queue.ErrDropExpiredInflight {
 				q.notifier.NotifyInflightAdded(-1)
 				q.current--
+				if dropInflight != -1 {
+					q.removeInflight(dropInflight)
+					delete(q.readCache, dropElem.ID())
+				}
 			}
 			if dropBytes == nil {
 				q.notifier.NotifyDropped(elem, dropErr)
@@ -162,6 +438,11 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 		} else {
 			q.notifier.NotifyMsgQueueAdded(1)
 			q.len++
+			if q.pipeline != nil {
+				q.pending = append(q.pending, elem)
+				q.pipeline.add(q, 1)
+				return
+			}
 		}
 		_ = conn.Send("rpush", getKey(q.clientID), elem.Encode())
 		err = conn.Flush()
@@ -170,6 +451,10 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 		// set default drop error
 		dropErr = queue.ErrDropQueueFull
 		drop = true
+		// the pending elems have to be in redis before deciding which one to drop.
+		if err = q.flushLocked(conn); err != nil {
+			return
+		}
 		var rs []interface{}
 		// drop expired inflight message
 		rs, err = redigo.Values(conn.Do("lrange", getKey(q.clientID), 0, q.len))
@@ -186,11 +471,19 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 				return
 			}
 			// inflight message
-			if i < q.current && queue.ElemExpiry(now, e) {
-				dropBytes = b
-				dropElem = e
-				dropErr = queue.ErrDropExpiredInflight
-				return
+			if i < q.current {
+				if q.memInflight {
+					e = q.inflight[i].elem
+				}
+				if queue.ElemExpiry(now, e) {
+					dropBytes = b
+					dropElem = e
+					dropErr = queue.ErrDropExpiredInflight
+					if q.memInflight {
+						dropInflight = i
+					}
+					return
+				}
 			}
 			// non-inflight message
 			if i >= q.current {
@@ -215,6 +508,10 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 		}
 		// drop the current elem if there is no more non-inflight messages.
 		if q.inflightDrained && q.current >= q.len {
+			if q.reject(elem) {
+				drop, reject = false, true
+				return queue.ErrDropQueueFull
+			}
 			return
 		}
 		rs, err = redigo.Values(conn.Do("lrange", getKey(q.clientID), q.current, q.len))
@@ -227,7 +524,11 @@ func (q *Queue) Add(elem *queue.Elem) (err error) {
 		if elem.MessageWithID.(*queue.Publish).QoS == packets.Qos0 {
 			return
 		}
-		if frontElem != nil {
+		if q.reject(elem) {
+			drop, reject = false, true
+			return queue.ErrDropQueueFull
+		}
+		if frontElem != nil && q.overflowStrategy != config.QueueOverflowDropNewest {
 			// drop the front message
 			dropBytes = frontBytes
 			dropElem = frontElem
@@ -246,7 +547,17 @@ func (q *Queue) Replace(elem *queue.Elem) (replaced bool, err error) {
 		q.cond.L.Unlock()
 	}()
 	id := elem.ID()
-	eb := elem.Encode()
+	if q.memInflight {
+		for _, v := range q.inflight[:q.current] {
+			if v.elem.ID() == id {
+				// the replaced elem keeps the sequence.
+				elem.Seq = v.elem.Seq
+				v.elem = elem
+				return true, nil
+			}
+		}
+		return false, nil
+	}
 	stop := q.current - 1
 	if stop < 0 {
 		stop = 0
@@ -263,6 +574,9 @@ func (q *Queue) Replace(elem *queue.Elem) (replaced bool, err error) {
 			return false, err
 		}
 		if e.ID() == elem.ID() {
+			// the replaced elem keeps the sequence.
+			elem.Seq = e.Seq
+			eb := elem.Encode()
 			_, err = conn.Do("lset", getKey(q.clientID), k, eb)
 			if err != nil {
 				return false, err
@@ -276,7 +590,7 @@ func (q *Queue) Replace(elem *queue.Elem) (replaced bool, err error) {
 }
 
 func (q *Queue) Read(pids []packets.PacketID) (elems []*queue.Elem, err error) {
-	now := time.Now()
+	now := q.clock.Now()
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 	conn := q.pool.Get()
@@ -290,6 +604,10 @@ func (q *Queue) Read(pids []packets.PacketID) (elems []*queue.Elem, err error) {
 	if q.closed {
 		return nil, queue.ErrClosed
 	}
+	q.headCached = false
+	if err = q.flushLocked(conn); err != nil {
+		return nil, err
+	}
 	rs, err := redigo.Values(conn.Do("lrange", getKey(q.clientID), q.current, q.current+len(pids)-1))
 	if err != nil {
 		return nil, wrapError(err)
@@ -337,16 +655,22 @@ func (q *Queue) Read(pids []packets.PacketID) (elems []*queue.Elem, err error) {
 			}
 		} else {
 			e.MessageWithID.SetID(pids[pflag])
+			// When the message becomes inflight message, update the expiry time.
+			e.Expiry = time.Time{}
 			if q.inflightExpiry != 0 {
 				e.Expiry = now.Add(q.inflightExpiry)
 			}
 			pflag++
-			nb := e.Encode()
-
-			err = conn.Send("lset", getKey(q.clientID), q.current, nb)
+			if q.memInflight {
+				q.inflight = append(q.inflight, &inflightElem{raw: b, elem: e})
+				q.readCache[e.MessageWithID.ID()] = b
+			} else {
+				nb := e.Encode()
+				err = conn.Send("lset", getKey(q.clientID), q.current, nb)
+				q.readCache[e.MessageWithID.ID()] = nb
+			}
 			q.current++
 			inflightDelta++
-			q.readCache[e.MessageWithID.ID()] = nb
 		}
 		elems = append(elems, e)
 	}
@@ -359,8 +683,19 @@ func (q *Queue) Read(pids []packets.PacketID) (elems []*queue.Elem, err error) {
 func (q *Queue) ReadInflight(maxSize uint) (elems []*queue.Elem, err error) {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
+	q.headCached = false
+	if q.memInflight && q.current < len(q.inflight) {
+		elems = q.readMemInflight(maxSize)
+		maxSize -= uint(len(elems))
+		if maxSize == 0 {
+			return elems, nil
+		}
+	}
 	conn := q.pool.Get()
 	defer conn.Close()
+	if err = q.flushLocked(conn); err != nil {
+		return nil, err
+	}
 	rs, err := redigo.Values(conn.Do("lrange", getKey(q.clientID), q.current, q.current+int(maxSize)-1))
 	if len(rs) == 0 {
 		q.inflightDrained = true
@@ -379,8 +714,14 @@ func (q *Queue) ReadInflight(maxSize uint) (elems []*queue.Elem, err error) {
 		}
 		id := e.MessageWithID.ID()
 		if id != 0 {
-			if q.inflightExpiry != 0 {
-				e.Expiry = time.Now().Add(q.inflightExpiry)
+			if q.memInflight {
+				// the inflight message persisted in full granularity, keep it in memory from now on.
+				if q.inflightExpiry != 0 {
+					e.Expiry = q.clock.Now().Add(q.inflightExpiry)
+				}
+				q.inflight = append(q.inflight, &inflightElem{raw: b, elem: e})
+			} else if q.inflightExpiry != 0 {
+				e.Expiry = q.clock.Now().Add(q.inflightExpiry)
 				b = e.Encode()
 				_, err = conn.Do("lset", getKey(q.clientID), beginIndex+index, b)
 				if err != nil {
@@ -398,6 +739,20 @@ func (q *Queue) ReadInflight(maxSize uint) (elems []*queue.Elem, err error) {
 	return
 }
 
+// readMemInflight reads at most maxSize inflight messages from memory.
+func (q *Queue) readMemInflight(maxSize uint) (elems []*queue.Elem) {
+	for q.current < len(q.inflight) && uint(len(elems)) < maxSize {
+		v := q.inflight[q.current]
+		if q.inflightExpiry != 0 {
+			v.elem.Expiry = q.clock.Now().Add(q.inflightExpiry)
+		}
+		elems = append(elems, v.elem)
+		q.readCache[v.elem.ID()] = v.raw
+		q.current++
+	}
+	return elems
+}
+
 func (q *Queue) Remove(pid packets.PacketID) error {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
@@ -411,8 +766,164 @@ func (q *Queue) Remove(pid packets.PacketID) error {
 		q.notifier.NotifyMsgQueueAdded(-1)
 		q.notifier.NotifyInflightAdded(-1)
 		delete(q.readCache, pid)
+		if q.memInflight {
+			for k, v := range q.inflight {
+				if v.elem.ID() == pid {
+					q.removeInflight(k)
+					break
+				}
+			}
+		}
 		q.len--
 		q.current--
 	}
 	return nil
 }
+
+// OldestQueuedAt implements queue.AgeReader.
+// The result is cached until the head of the queue changes.
+func (q *Queue) OldestQueuedAt() time.Time {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.current >= q.len {
+		return time.Time{}
+	}
+	if q.headCached {
+		return q.headAt
+	}
+	conn := q.pool.Get()
+	defer conn.Close()
+	if err := q.flushLocked(conn); err != nil {
+		q.log.Warn("failed to flush the queue", zap.String("client_id", q.clientID), zap.Error(err))
+		return time.Time{}
+	}
+	b, err := redigo.Bytes(conn.Do("lindex", getKey(q.clientID), q.current))
+	if err != nil {
+		q.log.Warn("failed to read the head of the queue", zap.String("client_id", q.clientID), zap.Error(err))
+		return time.Time{}
+	}
+	e := &queue.Elem{}
+	if err = e.Decode(b); err != nil {
+		q.log.Warn("failed to decode the head of the queue", zap.String("client_id", q.clientID), zap.Error(err))
+		return time.Time{}
+	}
+	q.headAt = e.At
+	q.headCached = true
+	return q.headAt
+}
+
+// Len implements queue.Drainer.
+func (q *Queue) Len() (int, error) {
+	conn := q.pool.Get()
+	defer conn.Close()
+	q.cond.L.Lock()
+	err := q.flushLocked(conn)
+	q.cond.L.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	l, err := redigo.Int(conn.Do("llen", getKey(q.clientID)))
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return l, nil
+}
+
+// readAllLocked reads all elems in the queue, the in-memory inflight state takes precedence over the bytes in redis.
+func (q *Queue) readAllLocked(conn redigo.Conn) ([]*queue.Elem, error) {
+	if err := q.flushLocked(conn); err != nil {
+		return nil, err
+	}
+	rs, err := redigo.Values(conn.Do("lrange", getKey(q.clientID), 0, -1))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	elems := make([]*queue.Elem, 0, len(rs))
+	for index, v := range rs {
+		var e *queue.Elem
+		if q.memInflight && index < len(q.inflight) {
+			e = q.inflight[index].elem
+		} else {
+			e = &queue.Elem{}
+			if err = e.Decode(v.([]byte)); err != nil {
+				return nil, err
+			}
+		}
+		elems = append(elems, e)
+	}
+	return elems, nil
+}
+
+// Snapshot implements queue.Snapshotter.
+func (q *Queue) Snapshot() ([]*queue.Elem, error) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	conn := q.pool.Get()
+	defer conn.Close()
+	return q.readAllLocked(conn)
+}
+
+// Iterate implements queue.Iterator.
+// The elems are read from redis page by page, the queue is locked during the iteration to keep the pages consistent.
+func (q *Queue) Iterate(fn func(elem *queue.Elem) (bool, error)) error {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	conn := q.pool.Get()
+	defer conn.Close()
+	if err := q.flushLocked(conn); err != nil {
+		return err
+	}
+	for start := 0; ; start += iteratePageSize {
+		rs, err := redigo.Values(conn.Do("lrange", getKey(q.clientID), start, start+iteratePageSize-1))
+		if err != nil {
+			return wrapError(err)
+		}
+		for k, v := range rs {
+			var e *queue.Elem
+			if index := start + k; q.memInflight && index < len(q.inflight) {
+				e = q.inflight[index].elem
+			} else {
+				e = &queue.Elem{}
+				if err = e.Decode(v.([]byte)); err != nil {
+					return err
+				}
+			}
+			cont, err := fn(e)
+			if err != nil || !cont {
+				return err
+			}
+		}
+		if len(rs) < iteratePageSize {
+			return nil
+		}
+	}
+}
+
+// Drain implements queue.Drainer.
+func (q *Queue) Drain() ([]*queue.Elem, error) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	conn := q.pool.Get()
+	defer conn.Close()
+	elems, err := q.readAllLocked(conn)
+	if err != nil {
+		return nil, err
+	}
+	var inflight int
+	for _, e := range elems {
+		if e.ID() != 0 {
+			inflight++
+		}
+	}
+	_, err = conn.Do("del", getKey(q.clientID))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	q.len = 0
+	q.current = 0
+	q.inflight = nil
+	q.headCached = false
+	q.notifier.NotifyMsgQueueAdded(-len(elems))
+	q.notifier.NotifyInflightAdded(-inflight)
+	return elems, nil
+}
@@ -1,6 +1,8 @@
 package test
 
 import (
+	"errors"
+	"strconv"
 	"testing"
 	"time"
 
@@ -217,6 +219,9 @@ func TestQueue(t *testing.T, store queue.Store) {
 	testCleanStart(a, store)
 	testReadExceedsDrop(a, store)
 	testClose(a, store)
+	testOldestQueuedAt(a, store)
+	testIterate(a, store)
+	testDrain(a, store)
 }
 
 func testDrop(a *assert.Assertions, store queue.Store) {
@@ -670,3 +675,442 @@ func testClose(a *assert.Assertions, store queue.Store) {
 		a.Equal(queue.ErrClosed, r.err)
 	}
 }
+
+func testOldestQueuedAt(a *assert.Assertions, store queue.Store) {
+	r, ok := store.(queue.AgeReader)
+	if !ok {
+		return
+	}
+	initNotifierLen()
+	a.NoError(initStore(store))
+	a.True(r.OldestQueuedAt().IsZero())
+
+	now := time.Now()
+	var elems []*queue.Elem
+	for i := 2; i > 0; i-- {
+		elem := &queue.Elem{
+			At: now.Add(-time.Duration(i) * time.Second),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{
+					QoS:     packets.Qos1,
+					Topic:   "/t_age",
+					Payload: []byte("t_age"),
+				},
+			},
+		}
+		elems = append(elems, elem)
+		a.NoError(store.Add(elem))
+	}
+	// the redis store encodes the time in seconds.
+	a.Equal(elems[0].At.Unix(), r.OldestQueuedAt().Unix())
+
+	rs, err := store.ReadInflight(5)
+	a.NoError(err)
+	a.Len(rs, 0)
+	rs, err = store.Read([]packets.PacketID{1})
+	a.NoError(err)
+	a.Len(rs, 1)
+	a.Equal(elems[1].At.Unix(), r.OldestQueuedAt().Unix())
+
+	rs, err = store.Read([]packets.PacketID{2})
+	a.NoError(err)
+	a.Len(rs, 1)
+	a.True(r.OldestQueuedAt().IsZero())
+	initNotifierLen()
+}
+
+func testIterate(a *assert.Assertions, store queue.Store) {
+	it, ok := store.(queue.Iterator)
+	if !ok {
+		return
+	}
+	initNotifierLen()
+	a.NoError(initStore(store))
+	a.NoError(add(store))
+	TestNotifier.msgQueueLen = len(initElems)
+
+	var rs []*queue.Elem
+	a.NoError(it.Iterate(func(elem *queue.Elem) (bool, error) {
+		rs = append(rs, elem)
+		return true, nil
+	}))
+	if a.Len(rs, len(initElems)) {
+		for k, v := range rs {
+			assertMsgEqual(a, initElems[k], v)
+		}
+	}
+	// stop early
+	var n int
+	a.NoError(it.Iterate(func(elem *queue.Elem) (bool, error) {
+		n++
+		return n < 2, nil
+	}))
+	a.Equal(2, n)
+	errStop := errors.New("stop")
+	a.Equal(errStop, it.Iterate(func(elem *queue.Elem) (bool, error) {
+		return true, errStop
+	}))
+	// the elems are not removed.
+	n = 0
+	a.NoError(it.Iterate(func(elem *queue.Elem) (bool, error) {
+		n++
+		return true, nil
+	}))
+	a.Equal(len(initElems), n)
+	initNotifierLen()
+}
+
+func testDrain(a *assert.Assertions, store queue.Store) {
+	d, ok := store.(queue.Drainer)
+	if !ok {
+		return
+	}
+	initNotifierLen()
+	a.NoError(initStore(store))
+	a.NoError(add(store))
+	TestNotifier.msgQueueLen = len(initElems)
+	a.NoError(store.Close())
+
+	l, err := d.Len()
+	a.NoError(err)
+	a.Equal(len(initElems), l)
+	rs, err := d.Drain()
+	a.NoError(err)
+	a.Len(rs, len(initElems))
+	for k, v := range rs {
+		assertMsgEqual(a, initElems[k], v)
+	}
+	assertQueueLen(a, 0, 0)
+
+	l, err = d.Len()
+	a.NoError(err)
+	a.Zero(l)
+	reconnect(a, false, store)
+	rs, err = store.ReadInflight(5)
+	a.NoError(err)
+	a.Len(rs, 0)
+	initNotifierLen()
+}
+
+// TestMessageExpiry tests the message expiry of the store which is created without inflight expiry.
+func TestMessageExpiry(t *testing.T, store queue.Store) {
+	initDrop()
+	initNotifierLen()
+	a := assert.New(t)
+	a.NoError(initStore(store))
+	now := time.Now()
+	expired := &queue.Elem{
+		At:     now.Add(-2 * time.Hour),
+		Expiry: now.Add(-time.Hour),
+		MessageWithID: &queue.Publish{
+			Message: &gmqtt.Message{Topic: "expired", QoS: packets.Qos1},
+		},
+	}
+	valid := &queue.Elem{
+		At:     now,
+		Expiry: now.Add(time.Hour),
+		MessageWithID: &queue.Publish{
+			Message: &gmqtt.Message{Topic: "valid", QoS: packets.Qos1},
+		},
+	}
+	a.NoError(store.Add(expired))
+	a.NoError(store.Add(valid))
+	e, err := store.ReadInflight(10)
+	a.NoError(err)
+	a.Empty(e)
+
+	// the expired message in the backlog is dropped.
+	e, err = store.Read([]packets.PacketID{1, 2})
+	a.NoError(err)
+	if a.Len(e, 1) {
+		a.Equal("valid", e[0].MessageWithID.(*queue.Publish).Topic)
+		a.True(e[0].Expiry.IsZero())
+	}
+	assertDrop(a, expired, queue.ErrDropExpired)
+
+	// the delivery of the inflight message has started, it is not dropped by the message expiry.
+	reconnect(a, false, store)
+	e, err = store.ReadInflight(10)
+	a.NoError(err)
+	if a.Len(e, 1) {
+		a.Equal("valid", e[0].MessageWithID.(*queue.Publish).Topic)
+		a.EqualValues(1, e[0].ID())
+		a.True(e[0].Expiry.IsZero())
+	}
+	a.Empty(TestNotifier.dropElem)
+}
+
+// TestOverflowStrategy tests the store created with the given config.MQTT.QueueOverflowStrategy and TestServerConfig.
+func TestOverflowStrategy(t *testing.T, store queue.Store, strategy string) {
+	initDrop()
+	initNotifierLen()
+	a := assert.New(t)
+	a.NoError(initStore(store))
+	// drain the inflight messages as the connected client does, so that the front message can be dropped.
+	e, err := store.ReadInflight(10)
+	a.NoError(err)
+	a.Empty(e)
+	newElem := func(topic string, qos uint8) *queue.Elem {
+		return &queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{Topic: topic, QoS: qos, Payload: []byte(topic)},
+			},
+		}
+	}
+	// the queue is exactly full, nothing is dropped.
+	for i := 0; i < TestServerConfig.MQTT.MaxQueuedMsg; i++ {
+		a.NoError(store.Add(newElem(strconv.Itoa(i), packets.Qos1)))
+	}
+	a.Empty(TestNotifier.dropElem)
+	assertQueueLen(a, 0, TestServerConfig.MQTT.MaxQueuedMsg)
+
+	// the qos0 message is always dropped.
+	qos0 := newElem("qos0", packets.Qos0)
+	a.NoError(store.Add(qos0))
+	assertDrop(a, qos0, queue.ErrDropQueueFull)
+
+	incoming := newElem("incoming", packets.Qos1)
+	expected := []string{"0", "1", "2", "3", "4"}
+	err = store.Add(incoming)
+	switch strategy {
+	case config.QueueOverflowDropNewest:
+		a.NoError(err)
+		assertDrop(a, incoming, queue.ErrDropQueueFull)
+	case config.QueueOverflowReject:
+		a.Equal(queue.ErrDropQueueFull, err)
+		a.Empty(TestNotifier.dropElem)
+	default:
+		a.NoError(err)
+		assertDrop(a, newElem("0", packets.Qos1), queue.ErrDropQueueFull)
+		expected = []string{"1", "2", "3", "4", "incoming"}
+	}
+	assertQueueLen(a, 0, TestServerConfig.MQTT.MaxQueuedMsg)
+
+	e, err = store.Read([]packets.PacketID{1, 2, 3, 4, 5})
+	a.NoError(err)
+	var topics []string
+	for _, v := range e {
+		topics = append(topics, v.MessageWithID.(*queue.Publish).Topic)
+	}
+	a.Equal(expected, topics)
+}
+
+// Overflow is the in-memory queue.Overflow for testing.
+type Overflow struct {
+	elems []*queue.Elem
+}
+
+func (o *Overflow) Push(elems ...*queue.Elem) error {
+	o.elems = append(o.elems, elems...)
+	return nil
+}
+
+func (o *Overflow) Pop(n int) ([]*queue.Elem, error) {
+	if n > len(o.elems) {
+		n = len(o.elems)
+	}
+	rs := o.elems[:n:n]
+	o.elems = o.elems[n:]
+	return rs, nil
+}
+
+func (o *Overflow) Len() (int, error) {
+	return len(o.elems), nil
+}
+
+func (o *Overflow) Iterate(fn func(elem *queue.Elem) (bool, error)) error {
+	for _, v := range o.elems {
+		cont, err := fn(v)
+		if err != nil || !cont {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Overflow) Clean() error {
+	o.elems = nil
+	return nil
+}
+
+// TestMemoryWindow tests the store which keeps 2 elems in memory and spills the others to the overflow.
+// The maximum queue length is TestServerConfig.MQTT.MaxQueuedMsg.
+func TestMemoryWindow(t *testing.T, store queue.Store) {
+	initDrop()
+	initNotifierLen()
+	a := assert.New(t)
+	a.NoError(initStore(store))
+	e, err := store.ReadInflight(10)
+	a.NoError(err)
+	a.Empty(e)
+	newElem := func(topic string) *queue.Elem {
+		return &queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{Topic: topic, QoS: packets.Qos1, Payload: []byte(topic)},
+			},
+		}
+	}
+	topics := func(elems []*queue.Elem) []string {
+		var rs []string
+		for _, v := range elems {
+			rs = append(rs, v.MessageWithID.(*queue.Publish).Topic)
+		}
+		return rs
+	}
+	// enqueue past the memory window, the limit is the combined length.
+	for i := 0; i < TestServerConfig.MQTT.MaxQueuedMsg; i++ {
+		a.NoError(store.Add(newElem(strconv.Itoa(i))))
+	}
+	a.Empty(TestNotifier.dropElem)
+	assertQueueLen(a, 0, 5)
+	if s, ok := store.(queue.Snapshotter); ok {
+		elems, err := s.Snapshot()
+		a.NoError(err)
+		a.Equal([]string{"0", "1", "2", "3", "4"}, topics(elems))
+	}
+	l, err := store.(queue.Drainer).Len()
+	a.NoError(err)
+	a.Equal(5, l)
+
+	// the elems in memory become inflight.
+	e, err = store.Read([]packets.PacketID{1, 2, 3})
+	a.NoError(err)
+	a.Equal([]string{"0", "1"}, topics(e))
+	assertQueueLen(a, 2, 5)
+
+	// the queue is full, the front of the spilled elems is dropped.
+	a.NoError(store.Add(newElem("5")))
+	assertDrop(a, newElem("2"), queue.ErrDropQueueFull)
+	assertQueueLen(a, 2, 5)
+
+	// the spilled elems survive the reconnection.
+	reconnect(a, false, store)
+	e, err = store.ReadInflight(10)
+	a.NoError(err)
+	a.Equal([]string{"0", "1"}, topics(e))
+	e, err = store.ReadInflight(10)
+	a.NoError(err)
+	a.Empty(e)
+	a.NoError(store.Remove(1))
+	a.NoError(store.Remove(2))
+
+	// drain the queue, the spilled elems are paged in the delivery order.
+	var read []string
+	for pid := packets.PacketID(3); len(read) < 3; pid++ {
+		e, err = store.Read([]packets.PacketID{pid})
+		a.NoError(err)
+		a.Len(e, 1)
+		read = append(read, topics(e)...)
+		a.NoError(store.Remove(pid))
+	}
+	a.Equal([]string{"3", "4", "5"}, read)
+	assertQueueLen(a, 0, 0)
+	l, err = store.(queue.Drainer).Len()
+	a.NoError(err)
+	a.Equal(0, l)
+
+	// clean start removes the spilled elems.
+	for i := 0; i < 4; i++ {
+		a.NoError(store.Add(newElem(strconv.Itoa(i))))
+	}
+	reconnect(a, true, store)
+	l, err = store.(queue.Drainer).Len()
+	a.NoError(err)
+	a.Equal(0, l)
+}
+
+// TestQos0Trimmer tests the store which implements queue.Qos0Trimmer.
+func TestQos0Trimmer(t *testing.T, store queue.Store) {
+	initDrop()
+	initNotifierLen()
+	a := assert.New(t)
+	a.NoError(initStore(store))
+	newElem := func(topic string, qos uint8) *queue.Elem {
+		return &queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{Topic: topic, QoS: qos, Payload: []byte(topic)},
+			},
+		}
+	}
+	a.NoError(store.Add(newElem("0", packets.Qos0)))
+	a.NoError(store.Add(newElem("1", packets.Qos1)))
+	a.NoError(store.Add(newElem("2", packets.Qos0)))
+	a.NoError(store.Add(newElem("3", packets.Qos0)))
+	a.NoError(store.Add(newElem("4", packets.Qos0)))
+	assertQueueLen(a, 0, 5)
+
+	// the oldest QoS 0 elems are dropped, the QoS 1 elem is kept.
+	a.NoError(store.(queue.Qos0Trimmer).TrimQos0(2))
+	a.Len(TestNotifier.dropElem, 2)
+	a.Equal("0", TestNotifier.dropElem[0].MessageWithID.(*queue.Publish).Topic)
+	a.Equal("2", TestNotifier.dropElem[1].MessageWithID.(*queue.Publish).Topic)
+	a.Equal(queue.ErrDropQueueFull, TestNotifier.dropErr)
+	initDrop()
+	assertQueueLen(a, 0, 3)
+
+	// nothing to drop.
+	a.NoError(store.(queue.Qos0Trimmer).TrimQos0(2))
+	a.Empty(TestNotifier.dropElem)
+
+	reconnect(a, false, store)
+	e, err := store.ReadInflight(10)
+	a.NoError(err)
+	a.Empty(e)
+	e, err = store.Read([]packets.PacketID{1, 2, 3})
+	a.NoError(err)
+	var topics []string
+	for _, v := range e {
+		topics = append(topics, v.MessageWithID.(*queue.Publish).Topic)
+	}
+	a.Equal([]string{"1", "3", "4"}, topics)
+}
+
+// TestQos0TrimmerMemoryWindow tests the store which implements queue.Qos0Trimmer
+// and keeps 2 elems in memory, the spilled QoS 0 elems are counted as well.
+func TestQos0TrimmerMemoryWindow(t *testing.T, store queue.Store) {
+	initDrop()
+	initNotifierLen()
+	a := assert.New(t)
+	a.NoError(initStore(store))
+	newElem := func(topic string, qos uint8) *queue.Elem {
+		return &queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{Topic: topic, QoS: qos, Payload: []byte(topic)},
+			},
+		}
+	}
+	trimmer := store.(queue.Qos0Trimmer)
+	// "0" and "1" are in memory, the others are spilled.
+	for i, qos := range []uint8{packets.Qos0, packets.Qos1, packets.Qos0, packets.Qos1, packets.Qos0} {
+		a.NoError(store.Add(newElem(strconv.Itoa(i), qos)))
+		a.NoError(trimmer.TrimQos0(2))
+	}
+	a.Len(TestNotifier.dropElem, 1)
+	a.Equal("0", TestNotifier.dropElem[0].MessageWithID.(*queue.Publish).Topic)
+	assertQueueLen(a, 0, 4)
+
+	// the spilled QoS 0 elems are dropped once there is none in memory.
+	a.NoError(trimmer.TrimQos0(1))
+	a.Len(TestNotifier.dropElem, 2)
+	a.Equal("2", TestNotifier.dropElem[1].MessageWithID.(*queue.Publish).Topic)
+	a.Equal(queue.ErrDropQueueFull, TestNotifier.dropErr)
+	assertQueueLen(a, 0, 3)
+
+	e, err := store.ReadInflight(10)
+	a.NoError(err)
+	a.Empty(e)
+	var topics []string
+	for len(topics) < 3 {
+		e, err = store.Read([]packets.PacketID{1, 2, 3})
+		a.NoError(err)
+		for _, v := range e {
+			topics = append(topics, v.MessageWithID.(*queue.Publish).Topic)
+		}
+	}
+	a.Equal([]string{"1", "3", "4"}, topics)
+	assertQueueLen(a, 2, 2)
+}
@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// AnomalyType is the type of the ordering anomaly found by Verifier.
+type AnomalyType string
+
+const (
+	// AnomalyDuplicate means the elem has the same Elem.Seq as a previous one, i.e: the message is enqueued twice.
+	AnomalyDuplicate AnomalyType = "duplicate"
+	// AnomalyOutOfOrder means the Elem.Seq of the elem is less than a previous one.
+	AnomalyOutOfOrder AnomalyType = "out_of_order"
+	// AnomalyDuplicatePacketID means the inflight elem has the same packet id as a previous inflight one.
+	AnomalyDuplicatePacketID AnomalyType = "duplicate_packet_id"
+	// AnomalyInflightGap means the inflight elem is behind a non-inflight one,
+	// the inflight elems are expected to be at the head of the queue.
+	AnomalyInflightGap AnomalyType = "inflight_gap"
+)
+
+// Anomaly is an ordering anomaly of the elems in the queue.
+type Anomaly struct {
+	Type AnomalyType
+	// Index is the index of the elem in the queue.
+	Index int
+	// Seq is the Elem.Seq of the elem.
+	Seq uint64
+	// PacketID is the packet id of the elem, 0 means the elem is not inflight.
+	PacketID packets.PacketID
+}
+
+// Verifier is an optional interface for Store to verify the delivery order of the elems, e.g: for a suspect session.
+type Verifier interface {
+	// Verify checks the elems in the queue and returns the ordering anomalies, see VerifyElems.
+	// It must not block the normal reads and writes of the queue for the whole verification.
+	Verify() ([]Anomaly, error)
+}
+
+// VerifyElems checks the elems in the delivery order and returns the anomalies, the elems with zero Seq are not checked by sequence.
+func VerifyElems(elems []*Elem) []Anomaly {
+	var rs []Anomaly
+	var maxSeq uint64
+	seqs := make(map[uint64]struct{}, len(elems))
+	ids := make(map[packets.PacketID]struct{})
+	queued := false
+	for k, v := range elems {
+		id := v.ID()
+		if v.Seq != 0 {
+			if _, ok := seqs[v.Seq]; ok {
+				rs = append(rs, Anomaly{Type: AnomalyDuplicate, Index: k, Seq: v.Seq, PacketID: id})
+			} else if v.Seq < maxSeq {
+				rs = append(rs, Anomaly{Type: AnomalyOutOfOrder, Index: k, Seq: v.Seq, PacketID: id})
+			}
+			seqs[v.Seq] = struct{}{}
+			if v.Seq > maxSeq {
+				maxSeq = v.Seq
+			}
+		}
+		if id == 0 {
+			queued = true
+			continue
+		}
+		if queued {
+			rs = append(rs, Anomaly{Type: AnomalyInflightGap, Index: k, Seq: v.Seq, PacketID: id})
+		}
+		if _, ok := ids[id]; ok {
+			rs = append(rs, Anomaly{Type: AnomalyDuplicatePacketID, Index: k, Seq: v.Seq, PacketID: id})
+		}
+		ids[id] = struct{}{}
+	}
+	return rs
+}
@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+)
+
+func TestVerifyElems(t *testing.T) {
+	a := assert.New(t)
+	newElem := func(seq uint64, id uint16) *Elem {
+		return &Elem{
+			Seq:           seq,
+			MessageWithID: &Publish{Message: &gmqtt.Message{Topic: "t", PacketID: id}},
+		}
+	}
+	elems := []*Elem{
+		{Seq: 1, MessageWithID: &Pubrel{PacketID: 1}},
+		newElem(2, 2),
+		newElem(4, 0),
+		newElem(3, 0),
+		// legacy elem without sequence
+		newElem(0, 0),
+		newElem(4, 0),
+		newElem(5, 2),
+		newElem(6, 0),
+	}
+	a.Equal([]Anomaly{
+		{Type: AnomalyOutOfOrder, Index: 3, Seq: 3},
+		{Type: AnomalyDuplicate, Index: 5, Seq: 4},
+		{Type: AnomalyInflightGap, Index: 6, Seq: 5, PacketID: 2},
+		{Type: AnomalyDuplicatePacketID, Index: 6, Seq: 5, PacketID: 2},
+	}, VerifyElems(elems))
+
+	a.Nil(VerifyElems([]*Elem{newElem(1, 1), newElem(3, 0), newElem(0, 0), newElem(4, 0)}))
+}
@@ -1,17 +1,28 @@
 package persistence
 
 import (
+	"context"
+	"io"
+	"time"
+
 	redigo "github.com/gomodule/redigo/redis"
 
+	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+	redis_ban "github.com/DrmagicE/gmqtt/persistence/ban/redis"
 	"github.com/DrmagicE/gmqtt/persistence/queue"
 	redis_queue "github.com/DrmagicE/gmqtt/persistence/queue/redis"
+	redis_retained "github.com/DrmagicE/gmqtt/persistence/retained/redis"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+	redis_scheduled "github.com/DrmagicE/gmqtt/persistence/scheduled/redis"
 	"github.com/DrmagicE/gmqtt/persistence/session"
 	redis_sess "github.com/DrmagicE/gmqtt/persistence/session/redis"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	redis_sub "github.com/DrmagicE/gmqtt/persistence/subscription/redis"
 	"github.com/DrmagicE/gmqtt/persistence/unack"
 	redis_unack "github.com/DrmagicE/gmqtt/persistence/unack/redis"
+	"github.com/DrmagicE/gmqtt/retained"
 	"github.com/DrmagicE/gmqtt/server"
 )
 
@@ -19,6 +30,12 @@ func init() {
 	server.RegisterPersistenceFactory("redis", NewRedis)
 }
 
+var _ server.BackupablePersistence = (*redis)(nil)
+var _ server.SchedulablePersistence = (*redis)(nil)
+var _ server.BanPersistence = (*redis)(nil)
+var _ server.HealthCheckPersistence = (*redis)(nil)
+var _ server.RetainedPersistence = (*redis)(nil)
+
 func NewRedis(config config.Config) (server.Persistence, error) {
 	return &redis{
 		config: config,
@@ -27,8 +44,11 @@ func NewRedis(config config.Config) (server.Persistence, error) {
 
 type redis struct {
 	pool         *redigo.Pool
+	opened       bool
 	config       config.Config
 	onMsgDropped server.OnMsgDropped
+	// pipeline is nil if config.RedisPersistence.QueueFlushWindow is zero.
+	pipeline *redis_queue.Pipeline
 }
 
 func (r *redis) NewUnackStore(config config.Config, clientID string) (unack.Store, error) {
@@ -42,11 +62,24 @@ func (r *redis) NewSessionStore(config config.Config) (session.Store, error) {
 	return redis_sess.New(r.pool), nil
 }
 
-func newPool(config config.Config) *redigo.Pool {
+func (r *redis) NewScheduledStore(config config.Config) (scheduled.Store, error) {
+	return redis_scheduled.New(r.pool), nil
+}
+
+func (r *redis) NewBanStore(config config.Config) (ban.Store, error) {
+	return redis_ban.New(r.pool), nil
+}
+
+// NewRetainedStore implements server.RetainedPersistence.
+func (r *redis) NewRetainedStore(config config.Config) (retained.Store, error) {
+	return redis_retained.New(r.pool)
+}
+
+func newPool(config config.Config, opts ...redigo.DialOption) *redigo.Pool {
 	return &redigo.Pool{
 		// Dial or DialContext must be set. When both are set, DialContext takes precedence over Dial.
 		Dial: func() (redigo.Conn, error) {
-			c, err := redigo.Dial("tcp", config.Persistence.Redis.Addr)
+			c, err := redigo.Dial("tcp", config.Persistence.Redis.Addr, opts...)
 			if err != nil {
 				return nil, err
 			}
@@ -73,17 +106,28 @@ func (r *redis) Open() error {
 	defer conn.Close()
 	// Test the connection
 	_, err := conn.Do("PING")
-
-	return err
+	if err != nil {
+		return err
+	}
+	if window := r.config.Persistence.Redis.QueueFlushWindow; window > 0 {
+		r.pipeline = redis_queue.NewPipeline(r.pool, window, r.config.Persistence.Redis.QueueMaxBatch)
+	}
+	r.opened = true
+	return nil
 }
 
 func (r *redis) NewQueueStore(config config.Config, defaultNotifier queue.Notifier, clientID string) (queue.Store, error) {
 	return redis_queue.New(redis_queue.Options{
-		MaxQueuedMsg:    config.MQTT.MaxQueuedMsg,
-		InflightExpiry:  config.MQTT.InflightExpiry,
-		ClientID:        clientID,
-		Pool:            r.pool,
-		DefaultNotifier: defaultNotifier,
+		MaxQueuedMsg:        config.MQTT.MaxQueuedMsg,
+		InflightExpiry:      config.MQTT.InflightExpiry,
+		ClientID:            clientID,
+		Pool:                r.pool,
+		DefaultNotifier:     defaultNotifier,
+		InflightGranularity: config.Persistence.InflightGranularity,
+		Pipeline:            r.pipeline,
+		OverflowStrategy:    config.MQTT.QueueOverflowStrategy,
+		VerifyOnInit:        config.Persistence.Redis.VerifyQueueOnInit,
+		DropDuplicates:      config.Persistence.Redis.DropDuplicateQueueElems,
 	})
 }
 
@@ -92,5 +136,96 @@ func (r *redis) NewSubscriptionStore(config config.Config) (subscription.Store,
 }
 
 func (r *redis) Close() error {
+	if r.pipeline != nil {
+		r.pipeline.Close()
+		r.pipeline = nil
+	}
+	r.opened = false
 	return r.pool.Close()
 }
+
+// Ping implements server.HealthCheckPersistence, it round-trips a PING to redis.
+func (r *redis) Ping(ctx context.Context) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_, err = redigo.DoWithTimeout(conn, time.Until(deadline), "PING")
+	} else {
+		_, err = conn.Do("PING")
+	}
+	return err
+}
+
+// withPool calls fn with the pool of the opened persistence, or with a temporary pool if it is not opened.
+func (r *redis) withPool(fn func(pool *redigo.Pool) error) error {
+	if r.opened {
+		return fn(r.pool)
+	}
+	pool := newPool(r.config)
+	defer pool.Close()
+	return fn(pool)
+}
+
+// Backup implements server.BackupablePersistence.
+// Notice that in config.InflightGranularityMessage mode,
+// the inflight state of the connected clients which has not been persisted yet is not included.
+func (r *redis) Backup(w io.Writer) error {
+	var s *snapshot
+	err := r.withPool(func(pool *redigo.Pool) (err error) {
+		ss := redis_sess.New(pool)
+		var cids []string
+		err = ss.Iterate(func(session *gmqtt.Session) bool {
+			cids = append(cids, session.ClientID)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		subs := redis_sub.New(pool)
+		if err = subs.Init(cids); err != nil {
+			return err
+		}
+		s, err = readSnapshot(ss, subs, func(clientID string) (queue.Store, error) {
+			return redis_queue.New(redis_queue.Options{
+				ClientID: clientID,
+				Pool:     pool,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		s.retained, err = redis_retained.Load(pool)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.encode(w)
+}
+
+// Restore implements server.BackupablePersistence.
+func (r *redis) Restore(rd io.Reader) error {
+	if r.opened {
+		return server.ErrPersistenceOpened
+	}
+	s, err := decodeSnapshot(rd)
+	if err != nil {
+		return err
+	}
+	return r.withPool(func(pool *redigo.Pool) error {
+		err := s.restore(redis_sess.New(pool), redis_sub.New(pool), func(clientID string) (queue.Store, error) {
+			return redis_queue.New(redis_queue.Options{
+				MaxQueuedMsg: r.config.MQTT.MaxQueuedMsg,
+				ClientID:     clientID,
+				Pool:         pool,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return redis_retained.Save(pool, s.retained)
+	})
+}
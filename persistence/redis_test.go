@@ -3,19 +3,28 @@
 package persistence
 
 import (
+	"context"
 	"os/exec"
+	"strconv"
 	"testing"
 	"time"
 
+	redigo "github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 
+	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
+	ban_test "github.com/DrmagicE/gmqtt/persistence/ban/test"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	redis_queue "github.com/DrmagicE/gmqtt/persistence/queue/redis"
 	queue_test "github.com/DrmagicE/gmqtt/persistence/queue/test"
+	scheduled_test "github.com/DrmagicE/gmqtt/persistence/scheduled/test"
 	sess_test "github.com/DrmagicE/gmqtt/persistence/session/test"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	sub_test "github.com/DrmagicE/gmqtt/persistence/subscription/test"
 	unack_test "github.com/DrmagicE/gmqtt/persistence/unack/test"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/server"
 )
 
@@ -75,6 +84,233 @@ func (s *RedisSuite) TestQueue() {
 	queue_test.TestQueue(s.T(), qs)
 }
 
+func (s *RedisSuite) TestQueue_messageGranularity() {
+	a := assert.New(s.T())
+	cfg := queue_test.TestServerConfig
+	cfg.Persistence.Redis = redisConfig
+	cfg.Persistence.InflightGranularity = config.InflightGranularityMessage
+	qs, err := s.p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+	a.Nil(err)
+	queue_test.TestQueue(s.T(), qs)
+}
+
+func (s *RedisSuite) TestQueue_pipeline() {
+	a := assert.New(s.T())
+	cfg := queue_test.TestServerConfig
+	cfg.Persistence.Redis = redisConfig
+	pipeline := redis_queue.NewPipeline(s.p.(*redis).pool, time.Millisecond, 2)
+	defer pipeline.Close()
+	qs, err := redis_queue.New(redis_queue.Options{
+		MaxQueuedMsg:    cfg.MQTT.MaxQueuedMsg,
+		InflightExpiry:  cfg.MQTT.InflightExpiry,
+		ClientID:        queue_test.TestClientID,
+		Pool:            s.p.(*redis).pool,
+		DefaultNotifier: queue_test.TestNotifier,
+		Pipeline:        pipeline,
+	})
+	a.Nil(err)
+	queue_test.TestQueue(s.T(), qs)
+}
+
+func (s *RedisSuite) TestQueue_pipelineOrder() {
+	a := assert.New(s.T())
+	pool := s.p.(*redis).pool
+	pipeline := redis_queue.NewPipeline(pool, time.Millisecond, 3)
+	defer pipeline.Close()
+	var queues []queue.Store
+	for _, v := range []string{"c1", "c2"} {
+		qs, err := redis_queue.New(redis_queue.Options{
+			MaxQueuedMsg:    100,
+			ClientID:        v,
+			Pool:            pool,
+			DefaultNotifier: queue_test.TestNotifier,
+			Pipeline:        pipeline,
+		})
+		a.Nil(err)
+		a.Nil(qs.Init(&queue.InitOptions{
+			CleanStart:     true,
+			Version:        packets.Version5,
+			ReadBytesLimit: packets.MaximumSize,
+			Notifier:       queue_test.TestNotifier,
+		}))
+		_, err = qs.ReadInflight(1)
+		a.Nil(err)
+		queues = append(queues, qs)
+	}
+	// the messages are flushed by both the max batch size and the flush window.
+	for i := 0; i < 50; i++ {
+		for _, qs := range queues {
+			a.Nil(qs.Add(&queue.Elem{
+				At: time.Now(),
+				MessageWithID: &queue.Publish{
+					Message: &gmqtt.Message{QoS: packets.Qos1, Topic: strconv.Itoa(i)},
+				},
+			}))
+		}
+		if i%10 == 0 {
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+	for _, qs := range queues {
+		var topics []string
+		for len(topics) < 50 {
+			pids := make([]packets.PacketID, 7)
+			for k := range pids {
+				pids[k] = packets.PacketID(len(topics) + k + 1)
+			}
+			elems, err := qs.Read(pids)
+			a.Nil(err)
+			for _, v := range elems {
+				topics = append(topics, v.MessageWithID.(*queue.Publish).Topic)
+			}
+		}
+		for i, v := range topics {
+			a.Equal(strconv.Itoa(i), v)
+		}
+		l, err := qs.(queue.Drainer).Len()
+		a.Nil(err)
+		a.Equal(50, l)
+	}
+}
+
+func (s *RedisSuite) TestQueue_messageExpiry() {
+	a := assert.New(s.T())
+	cfg := queue_test.TestServerConfig
+	cfg.Persistence.Redis = redisConfig
+	cfg.MQTT.InflightExpiry = 0
+	qs, err := s.p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+	a.Nil(err)
+	queue_test.TestMessageExpiry(s.T(), qs)
+}
+
+func (s *RedisSuite) TestQueue_overflowStrategy() {
+	for _, v := range []string{config.QueueOverflowDropOldest, config.QueueOverflowDropNewest, config.QueueOverflowReject} {
+		s.Run(v, func() {
+			cfg := queue_test.TestServerConfig
+			cfg.Persistence.Redis = redisConfig
+			cfg.MQTT.QueueOverflowStrategy = v
+			qs, err := s.p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+			s.Require().Nil(err)
+			queue_test.TestOverflowStrategy(s.T(), qs, v)
+		})
+	}
+}
+
+func (s *RedisSuite) TestQueue_memoryWindow() {
+	cfg := queue_test.TestServerConfig
+	cfg.Persistence.Redis = redisConfig
+	cfg.Persistence.QueueMemoryWindow = 2
+	p, err := NewMemory(cfg)
+	s.Require().Nil(err)
+	s.Require().Nil(p.Open())
+	defer p.Close()
+	qs, err := p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+	s.Require().Nil(err)
+	queue_test.TestMemoryWindow(s.T(), qs)
+}
+
+func (s *RedisSuite) TestQueue_iterate() {
+	a := assert.New(s.T())
+	qs, err := redis_queue.New(redis_queue.Options{
+		MaxQueuedMsg:    1000,
+		ClientID:        queue_test.TestClientID,
+		Pool:            s.p.(*redis).pool,
+		DefaultNotifier: nopNotifier{},
+	})
+	a.Nil(err)
+	a.Nil(qs.Init(&queue.InitOptions{
+		CleanStart:     true,
+		Version:        packets.Version5,
+		ReadBytesLimit: packets.MaximumSize,
+		Notifier:       nopNotifier{},
+	}))
+	// more than one page
+	for i := 0; i < 250; i++ {
+		a.Nil(qs.Add(&queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{QoS: packets.Qos1, Topic: strconv.Itoa(i)},
+			},
+		}))
+	}
+	var topics []string
+	a.Nil(qs.Iterate(func(elem *queue.Elem) (bool, error) {
+		topics = append(topics, elem.MessageWithID.(*queue.Publish).Topic)
+		return true, nil
+	}))
+	if a.Len(topics, 250) {
+		for i, v := range topics {
+			a.Equal(strconv.Itoa(i), v)
+		}
+	}
+}
+
+func (s *RedisSuite) TestQueue_verify() {
+	a := assert.New(s.T())
+	pool := s.p.(*redis).pool
+	newQueue := func(verify bool) *redis_queue.Queue {
+		qs, err := redis_queue.New(redis_queue.Options{
+			MaxQueuedMsg:    100,
+			ClientID:        queue_test.TestClientID,
+			Pool:            pool,
+			DefaultNotifier: nopNotifier{},
+			VerifyOnInit:    verify,
+			DropDuplicates:  verify,
+		})
+		a.Nil(err)
+		return qs
+	}
+	qs := newQueue(false)
+	a.Nil(qs.Init(&queue.InitOptions{
+		CleanStart:     true,
+		Version:        packets.Version5,
+		ReadBytesLimit: packets.MaximumSize,
+		Notifier:       nopNotifier{},
+	}))
+	for i := 0; i < 3; i++ {
+		a.Nil(qs.Add(&queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{QoS: packets.Qos1, Topic: strconv.Itoa(i)},
+			},
+		}))
+	}
+	anomalies, err := qs.Verify()
+	a.Nil(err)
+	a.Empty(anomalies)
+
+	// enqueue the second elem twice.
+	conn := pool.Get()
+	b, err := redigo.Bytes(conn.Do("lindex", "queue:"+queue_test.TestClientID, 1))
+	a.Nil(err)
+	_, err = conn.Do("rpush", "queue:"+queue_test.TestClientID, b)
+	a.Nil(err)
+	conn.Close()
+	anomalies, err = qs.Verify()
+	a.Nil(err)
+	a.Equal([]queue.Anomaly{{Type: queue.AnomalyDuplicate, Index: 3, Seq: 2}}, anomalies)
+
+	// the duplicate is removed on reload, and the sequence continues.
+	qs = newQueue(true)
+	a.Nil(qs.Init(&queue.InitOptions{
+		Version:        packets.Version5,
+		ReadBytesLimit: packets.MaximumSize,
+		Notifier:       nopNotifier{},
+	}))
+	l, err := qs.Len()
+	a.Nil(err)
+	a.Equal(3, l)
+	elem := &queue.Elem{
+		At:            time.Now(),
+		MessageWithID: &queue.Publish{Message: &gmqtt.Message{QoS: packets.Qos1, Topic: "3"}},
+	}
+	a.Nil(qs.Add(elem))
+	a.EqualValues(4, elem.Seq)
+	anomalies, err = qs.Verify()
+	a.Nil(err)
+	a.Empty(anomalies)
+}
+
 func (s *RedisSuite) TestSubscription() {
 	newFn := func() subscription.Store {
 		st, err := s.p.NewSubscriptionStore(config.Config{})
@@ -86,6 +322,38 @@ func (s *RedisSuite) TestSubscription() {
 	sub_test.TestSuite(s.T(), newFn)
 }
 
+func (s *RedisSuite) TestSubscription_compact() {
+	a := assert.New(s.T())
+	st, err := s.p.NewSubscriptionStore(config.Config{})
+	a.Nil(err)
+	_, err = st.Subscribe("c1",
+		&gmqtt.Subscription{TopicFilter: "a"},
+		&gmqtt.Subscription{ShareName: "g", TopicFilter: "b"})
+	a.Nil(err)
+	_, err = st.Subscribe("c2", &gmqtt.Subscription{TopicFilter: "c"})
+	a.Nil(err)
+	c := s.p.(*redis).pool.Get()
+	defer c.Close()
+	// the subscription of c1 is missing in redis.
+	_, err = c.Do("hdel", "sub:c1", "a")
+	a.Nil(err)
+
+	pruned, err := st.(subscription.Compactor).Compact(func(clientID string) (bool, error) {
+		return clientID == "c1", nil
+	})
+	a.Nil(err)
+	a.Equal(2, pruned)
+	rs := subscription.GetClientSubscriptions(st, "c1", subscription.TypeAll)
+	if a.Len(rs, 1) {
+		a.Equal("$share/g/b", rs[0].GetFullTopicName())
+	}
+	a.Empty(subscription.GetClientSubscriptions(st, "c2", subscription.TypeAll))
+	n, err := redigo.Int(c.Do("exists", "sub:c2"))
+	a.Nil(err)
+	a.Equal(0, n)
+	a.EqualValues(1, st.GetStats().SubscriptionsCurrent)
+}
+
 func (s *RedisSuite) TestSession() {
 	a := assert.New(s.T())
 	st, err := s.p.NewSessionStore(config.Config{})
@@ -93,6 +361,20 @@ func (s *RedisSuite) TestSession() {
 	sess_test.TestSuite(s.T(), st)
 }
 
+func (s *RedisSuite) TestBan() {
+	a := assert.New(s.T())
+	st, err := s.p.(server.BanPersistence).NewBanStore(config.Config{})
+	a.Nil(err)
+	ban_test.TestSuite(s.T(), st)
+}
+
+func (s *RedisSuite) TestScheduled() {
+	a := assert.New(s.T())
+	st, err := s.p.(server.SchedulablePersistence).NewScheduledStore(config.Config{})
+	a.Nil(err)
+	scheduled_test.TestSuite(s.T(), st)
+}
+
 func (s *RedisSuite) TestUnack() {
 	a := assert.New(s.T())
 	st, err := s.p.NewUnackStore(unack_test.TestServerConfig, unack_test.TestClientID)
@@ -100,10 +382,208 @@ func (s *RedisSuite) TestUnack() {
 	unack_test.TestSuite(s.T(), st)
 }
 
+func (s *RedisSuite) TestBackupRestore() {
+	cfg := config.Config{
+		MQTT: config.MQTT{
+			MaxQueuedMsg: 10,
+		},
+		Persistence: config.Persistence{
+			Type:  config.PersistenceTypeRedis,
+			Redis: redisConfig,
+		},
+	}
+	dst, err := NewRedis(cfg)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	testBackupRestore(s.T(), cfg, s.p, dst, func() {
+		conn := s.p.(*redis).pool.Get()
+		defer conn.Close()
+		_, _ = conn.Do("FLUSHDB")
+	})
+}
+
+func (s *RedisSuite) TestPing() {
+	a := assert.New(s.T())
+	a.Nil(s.p.(server.HealthCheckPersistence).Ping(context.Background()))
+}
+
 func TestRedis(t *testing.T) {
 	suite.Run(t, &RedisSuite{})
 }
 
+// BenchmarkRedisQueue_inflightGranularity compares the QoS 2 outgoing flow in different inflight granularity.
+func BenchmarkRedisQueue_inflightGranularity(b *testing.B) {
+	_, err := runContainer()
+	if err != nil {
+		b.Skipf("fail to start redis container: %s", err)
+	}
+	defer stopContainer()
+	time.Sleep(2 * time.Second) // wait for redis start
+	for _, g := range []config.InflightGranularity{config.InflightGranularityFull, config.InflightGranularityMessage} {
+		b.Run(g, func(b *testing.B) {
+			benchmarkQos2Flow(b, g)
+		})
+	}
+}
+
+// BenchmarkRedisQueue_pipeline compares the single-op and pipelined enqueue under 10k msg/s publish load,
+// each message is fanned out to 10 subscribers. ns/publish is the time spent enqueuing one message.
+func BenchmarkRedisQueue_pipeline(b *testing.B) {
+	_, err := runContainer()
+	if err != nil {
+		b.Skipf("fail to start redis container: %s", err)
+	}
+	defer stopContainer()
+	time.Sleep(2 * time.Second) // wait for redis start
+	b.Run("single", func(b *testing.B) {
+		benchmarkEnqueue(b, 0)
+	})
+	b.Run("pipelined", func(b *testing.B) {
+		benchmarkEnqueue(b, config.DefaultQueueFlushWindow)
+	})
+}
+
+func benchmarkEnqueue(b *testing.B, window time.Duration) {
+	rc := redisConfig
+	rc.QueueFlushWindow = window
+	rc.QueueMaxBatch = config.DefaultQueueMaxBatch
+	cfg := config.Config{
+		MQTT: config.MQTT{
+			MaxQueuedMsg: b.N + 1,
+		},
+		Persistence: config.Persistence{
+			Type:  config.PersistenceTypeRedis,
+			Redis: rc,
+		},
+	}
+	p, err := NewRedis(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = p.Open(); err != nil {
+		b.Fatal("fail to open redis", err)
+	}
+	defer p.Close()
+	var queues []queue.Store
+	for i := 0; i < 10; i++ {
+		qs, err := p.NewQueueStore(cfg, queue_test.TestNotifier, strconv.Itoa(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = qs.Init(&queue.InitOptions{
+			CleanStart:     true,
+			Version:        packets.Version5,
+			ReadBytesLimit: packets.MaximumSize,
+			Notifier:       queue_test.TestNotifier,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		queues = append(queues, qs)
+	}
+	// 10k msg/s
+	ticker := time.NewTicker(100 * time.Microsecond)
+	defer ticker.Stop()
+	var busy time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-ticker.C
+		start := time.Now()
+		for _, qs := range queues {
+			err = qs.Add(&queue.Elem{
+				At: start,
+				MessageWithID: &queue.Publish{
+					Message: &gmqtt.Message{
+						QoS:     packets.Qos1,
+						Topic:   "/benchmark",
+						Payload: []byte("benchmark"),
+					},
+				},
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		busy += time.Since(start)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(busy.Nanoseconds())/float64(b.N), "ns/publish")
+}
+
+func benchmarkQos2Flow(b *testing.B, granularity config.InflightGranularity) {
+	cfg := config.Config{
+		MQTT: config.MQTT{
+			MaxQueuedMsg: 1000,
+		},
+		Persistence: config.Persistence{
+			Type:                config.PersistenceTypeRedis,
+			Redis:               redisConfig,
+			InflightGranularity: granularity,
+		},
+	}
+	p, err := NewRedis(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = p.Open(); err != nil {
+		b.Fatal("fail to open redis", err)
+	}
+	defer p.Close()
+	qs, err := p.NewQueueStore(cfg, queue_test.TestNotifier, queue_test.TestClientID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = qs.Init(&queue.InitOptions{
+		CleanStart:     true,
+		Version:        packets.Version5,
+		ReadBytesLimit: packets.MaximumSize,
+		Notifier:       queue_test.TestNotifier,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	// drain the inflight messages
+	if _, err = qs.ReadInflight(1); err != nil {
+		b.Fatal(err)
+	}
+	pids := []packets.PacketID{1}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = qs.Add(&queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{
+					QoS:     packets.Qos2,
+					Topic:   "/benchmark",
+					Payload: []byte("benchmark"),
+				},
+			},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		// PUBLISH sent
+		if _, err = qs.Read(pids); err != nil {
+			b.Fatal(err)
+		}
+		// PUBREC received
+		_, err = qs.Replace(&queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Pubrel{
+				PacketID: pids[0],
+			},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		// PUBCOMP received
+		if err = qs.Remove(pids[0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func runContainer() (string, error) {
 	_ = exec.Command("/bin/sh", "-c", "docker rm -f gmqtt-testing").Run()
 	cmd := exec.Command("/bin/sh", "-c", "docker run -d --name gmqtt-testing -p 6379:6379 redis")
@@ -0,0 +1,145 @@
+package redis
+
+import (
+	"bytes"
+
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/encoding"
+	"github.com/DrmagicE/gmqtt/retained"
+	"github.com/DrmagicE/gmqtt/retained/trie"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+const (
+	// retainedKey is the hash of the retained messages, the field is the topic name.
+	retainedKey = "retained"
+)
+
+var (
+	_ retained.Store          = (*Store)(nil)
+	_ retained.StatsReader    = (*Store)(nil)
+	_ retained.BytesLimiter   = (*Store)(nil)
+	_ retained.Limiter        = (*Store)(nil)
+	_ retained.StoredAtReader = (*Store)(nil)
+)
+
+// memStore is the in-memory store which serves the reads and applies the limits.
+type memStore interface {
+	retained.Store
+	retained.StatsReader
+	retained.BytesLimiter
+	retained.Limiter
+	retained.StoredAtReader
+	SetOnEvicted(fn func(topicName string))
+}
+
+// Store keeps the retained messages in memory for matching, and writes them through to redis,
+// so that they are restored after the broker restarts.
+// The redis errors are logged, because the retained.Store interface does not return errors.
+// The stored time is not persisted, the messages loaded from redis are stored at the time when the Store is created.
+type Store struct {
+	memStore
+	pool *redis.Pool
+	log  *zap.Logger
+}
+
+// New returns the Store with the retained messages loaded from redis.
+func New(pool *redis.Pool) (*Store, error) {
+	msgs, err := Load(pool)
+	if err != nil {
+		return nil, err
+	}
+	mem := trie.NewStore()
+	for _, v := range msgs {
+		mem.AddOrReplace(v)
+	}
+	s := &Store{
+		memStore: mem,
+		pool:     pool,
+		log:      server.LoggerWithField(zap.String("retained", "redis")),
+	}
+	mem.SetOnEvicted(func(topicName string) {
+		s.do("hdel", retainedKey, topicName)
+	})
+	return s, nil
+}
+
+// Load reads all retained messages from redis.
+func Load(pool *redis.Pool) ([]*gmqtt.Message, error) {
+	c := pool.Get()
+	defer c.Close()
+	rs, err := redis.ByteSlices(c.Do("hgetall", retainedKey))
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*gmqtt.Message, 0, len(rs)/2)
+	for i := 0; i+1 < len(rs); i += 2 {
+		msg, err := encoding.DecodeMessageFromBytes(rs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// Save adds or replaces the retained messages in redis.
+func Save(pool *redis.Pool, msgs []*gmqtt.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	c := pool.Get()
+	defer c.Close()
+	args := make([]interface{}, 0, 1+2*len(msgs))
+	args = append(args, retainedKey)
+	for _, v := range msgs {
+		args = append(args, v.Topic, encodeMessage(v))
+	}
+	_, err := c.Do("hset", args...)
+	return err
+}
+
+func encodeMessage(msg *gmqtt.Message) []byte {
+	b := &bytes.Buffer{}
+	encoding.EncodeMessage(msg, b)
+	return b.Bytes()
+}
+
+func (s *Store) do(cmd string, args ...interface{}) {
+	c := s.pool.Get()
+	defer c.Close()
+	if _, err := c.Do(cmd, args...); err != nil {
+		s.log.Error("fail to persist the retained message", zap.String("command", cmd), zap.Error(err))
+	}
+}
+
+// AddOrReplace implements retained.Store.
+func (s *Store) AddOrReplace(message *gmqtt.Message) {
+	_ = s.TryAddOrReplace(message)
+}
+
+// TryAddOrReplace implements retained.Limiter.
+func (s *Store) TryAddOrReplace(message *gmqtt.Message) error {
+	if err := s.memStore.TryAddOrReplace(message); err != nil {
+		return err
+	}
+	s.do("hset", retainedKey, message.Topic, encodeMessage(message))
+	return nil
+}
+
+// Remove implements retained.Store.
+func (s *Store) Remove(topicName string) {
+	s.memStore.Remove(topicName)
+	s.do("hdel", retainedKey, topicName)
+}
+
+// ClearAll implements retained.Store.
+func (s *Store) ClearAll() {
+	s.memStore.ClearAll()
+	s.do("del", retainedKey)
+}
@@ -0,0 +1,132 @@
+package redis
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/retained"
+)
+
+// fakeRedis is an in-process redis server which supports the hash commands used by Store.
+type fakeRedis struct {
+	mu     sync.Mutex
+	hashes map[string]map[string][]byte
+}
+
+func (f *fakeRedis) apply(cmd string, args []interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := args[0].(string)
+	switch strings.ToLower(cmd) {
+	case "hgetall":
+		var rs []interface{}
+		for k, v := range f.hashes[key] {
+			rs = append(rs, []byte(k), v)
+		}
+		return rs, nil
+	case "hset":
+		if f.hashes[key] == nil {
+			f.hashes[key] = make(map[string][]byte)
+		}
+		for i := 1; i+1 < len(args); i += 2 {
+			f.hashes[key][args[i].(string)] = args[i+1].([]byte)
+		}
+		return int64(1), nil
+	case "hdel":
+		for _, v := range args[1:] {
+			delete(f.hashes[key], v.(string))
+		}
+		return int64(1), nil
+	case "del":
+		delete(f.hashes, key)
+		return int64(1), nil
+	}
+	return nil, errors.New("ERR unknown command '" + cmd + "'")
+}
+
+func (f *fakeRedis) fields() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rs []string
+	for k := range f.hashes[retainedKey] {
+		rs = append(rs, k)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+// fakeConn implements redigo.Conn, only Do is supported.
+type fakeConn struct {
+	redigo.Conn
+	srv *fakeRedis
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	return nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// the pool flushes the connection when it is returned.
+		return nil, nil
+	}
+	return c.srv.apply(cmd, args)
+}
+
+func newFakePool(fs *fakeRedis) *redigo.Pool {
+	return &redigo.Pool{
+		Dial: func() (redigo.Conn, error) {
+			return &fakeConn{srv: fs}, nil
+		},
+	}
+}
+
+func TestStore(t *testing.T) {
+	a := assert.New(t)
+	fs := &fakeRedis{hashes: make(map[string]map[string][]byte)}
+	pool := newFakePool(fs)
+	a.Nil(Save(pool, []*gmqtt.Message{
+		{Topic: "a", Payload: []byte("1"), QoS: 1},
+		{Topic: "b", Payload: []byte("2")},
+	}))
+
+	s, err := New(pool)
+	a.Nil(err)
+	a.Equal([]byte("1"), s.GetRetainedMessage("a").Payload)
+	a.EqualValues(1, s.GetRetainedMessage("a").QoS)
+	a.Len(s.GetMatchedMessages("#"), 2)
+
+	// the writes go through to redis.
+	a.Nil(s.TryAddOrReplace(&gmqtt.Message{Topic: "c", Payload: []byte("3")}))
+	s.Remove("a")
+	a.Equal([]string{"b", "c"}, fs.fields())
+
+	// the evicted messages are removed from redis as well.
+	s.SetLimits(retained.Limits{MaxMessages: 1})
+	a.Len(s.GetMatchedMessages("#"), 1)
+	a.Len(fs.fields(), 1)
+
+	// the messages rejected by the limits are not written.
+	s.SetLimits(retained.Limits{MaxMessages: 1, RejectNew: true})
+	a.Equal(retained.ErrExceedsMaxMessages, s.TryAddOrReplace(&gmqtt.Message{Topic: "d", Payload: []byte("4")}))
+	a.Len(fs.fields(), 1)
+
+	msgs, err := Load(pool)
+	a.Nil(err)
+	a.Len(msgs, 1)
+
+	s.ClearAll()
+	a.Nil(fs.fields())
+	a.Len(s.GetMatchedMessages("#"), 0)
+}
@@ -0,0 +1,46 @@
+package mem
+
+import (
+	"sync"
+
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+)
+
+var _ scheduled.Store = (*Store)(nil)
+
+func New() *Store {
+	return &Store{
+		mu:   sync.Mutex{},
+		msgs: make(map[string]*scheduled.Message),
+	}
+}
+
+type Store struct {
+	mu   sync.Mutex
+	msgs map[string]*scheduled.Message
+}
+
+func (s *Store) Add(msg *scheduled.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs[msg.ID] = msg
+	return nil
+}
+
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.msgs, id)
+	return nil
+}
+
+func (s *Store) Iterate(fn scheduled.IterateFn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.msgs {
+		if !fn(v) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/DrmagicE/gmqtt/persistence/encoding"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+)
+
+const (
+	// scheduledKey is the hash of the scheduled messages, the field is the id of the message.
+	scheduledKey = "scheduled"
+)
+
+var _ scheduled.Store = (*Store)(nil)
+
+var errInvalidMessage = errors.New("invalid scheduled message")
+
+type Store struct {
+	mu   sync.Mutex
+	pool *redis.Pool
+}
+
+func New(pool *redis.Pool) *Store {
+	return &Store{
+		mu:   sync.Mutex{},
+		pool: pool,
+	}
+}
+
+func encodeMessage(msg *scheduled.Message) []byte {
+	b := &bytes.Buffer{}
+	at := make([]byte, 8)
+	binary.BigEndian.PutUint64(at, uint64(msg.DeliverAt.UnixNano()))
+	b.Write(at)
+	encoding.EncodeMessage(msg.Message, b)
+	return b.Bytes()
+}
+
+func decodeMessage(id string, b []byte) (*scheduled.Message, error) {
+	if len(b) < 8 {
+		return nil, errInvalidMessage
+	}
+	msg, err := encoding.DecodeMessageFromBytes(b[8:])
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, errInvalidMessage
+	}
+	return &scheduled.Message{
+		ID:        id,
+		DeliverAt: time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))),
+		Message:   msg,
+	}, nil
+}
+
+func (s *Store) Add(msg *scheduled.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := c.Do("hset", scheduledKey, msg.ID, encodeMessage(msg))
+	return err
+}
+
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := c.Do("hdel", scheduledKey, id)
+	return err
+}
+
+func (s *Store) Iterate(fn scheduled.IterateFn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.pool.Get()
+	defer c.Close()
+	rs, err := redis.ByteSlices(c.Do("hgetall", scheduledKey))
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(rs); i += 2 {
+		msg, err := decodeMessage(string(rs[i]), rs[i+1])
+		if err != nil {
+			return err
+		}
+		if !fn(msg) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+)
+
+func TestEncodeDecodeMessage(t *testing.T) {
+	a := assert.New(t)
+	msg := &scheduled.Message{
+		ID:        "id",
+		DeliverAt: time.Unix(10, 20),
+		Message: &gmqtt.Message{
+			QoS:           1,
+			Retained:      true,
+			Topic:         "topic",
+			Payload:       []byte("payload"),
+			MessageExpiry: 10,
+		},
+	}
+	rs, err := decodeMessage("id", encodeMessage(msg))
+	a.Nil(err)
+	a.Equal(msg.ID, rs.ID)
+	a.True(msg.DeliverAt.Equal(rs.DeliverAt))
+	a.Equal(msg.Message.Topic, rs.Message.Topic)
+	a.Equal(msg.Message.Payload, rs.Message.Payload)
+	a.Equal(msg.Message.QoS, rs.Message.QoS)
+	a.True(rs.Message.Retained)
+	a.EqualValues(10, rs.Message.MessageExpiry)
+
+	_, err = decodeMessage("id", []byte{1, 2})
+	a.Equal(errInvalidMessage, err)
+	_, err = decodeMessage("id", make([]byte, 8))
+	a.Equal(errInvalidMessage, err)
+}
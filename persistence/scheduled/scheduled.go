@@ -0,0 +1,29 @@
+package scheduled
+
+import (
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+)
+
+// Message is a message parked until DeliverAt.
+type Message struct {
+	// ID is the unique id of the scheduled message.
+	ID        string
+	DeliverAt time.Time
+	Message   *gmqtt.Message
+}
+
+// IterateFn is the callback function used by Iterate()
+// Return false means to stop the iteration.
+type IterateFn func(msg *Message) bool
+
+// Store persists the scheduled messages, so that the pending messages can survive the broker restart.
+type Store interface {
+	// Add adds or replaces the scheduled message with the same ID.
+	Add(msg *Message) error
+	// Remove removes the scheduled message, it is a no-op if the message does not exist.
+	Remove(id string) error
+	// Iterate iterates all scheduled messages in no particular order.
+	Iterate(fn IterateFn) error
+}
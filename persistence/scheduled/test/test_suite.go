@@ -0,0 +1,62 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+)
+
+func TestSuite(t *testing.T, store scheduled.Store) {
+	a := assert.New(t)
+	var tt = []*scheduled.Message{
+		{
+			ID:        "id1",
+			DeliverAt: time.Unix(1, 1),
+			Message: &gmqtt.Message{
+				Topic:   "topicA",
+				Payload: []byte("abc"),
+				QoS:     1,
+			},
+		}, {
+			ID:        "id2",
+			DeliverAt: time.Unix(2, 0),
+			Message: &gmqtt.Message{
+				Topic:    "topicB",
+				Payload:  []byte("def"),
+				Retained: true,
+			},
+		},
+	}
+	for _, v := range tt {
+		a.Nil(store.Add(v))
+	}
+	iterate := func() map[string]*scheduled.Message {
+		rs := make(map[string]*scheduled.Message)
+		a.Nil(store.Iterate(func(msg *scheduled.Message) bool {
+			rs[msg.ID] = msg
+			return true
+		}))
+		return rs
+	}
+	rs := iterate()
+	a.Len(rs, 2)
+	for _, v := range tt {
+		a.True(v.DeliverAt.Equal(rs[v.ID].DeliverAt))
+		a.Equal(v.Message.Topic, rs[v.ID].Message.Topic)
+		a.Equal(v.Message.Payload, rs[v.ID].Message.Payload)
+		a.Equal(v.Message.QoS, rs[v.ID].Message.QoS)
+		a.Equal(v.Message.Retained, rs[v.ID].Message.Retained)
+	}
+
+	a.Nil(store.Remove("id1"))
+	a.Nil(store.Remove("not_exist"))
+	rs = iterate()
+	a.Len(rs, 1)
+	a.Contains(rs, "id2")
+	a.Nil(store.Remove("id2"))
+	a.Empty(iterate())
+}
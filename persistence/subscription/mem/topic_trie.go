@@ -89,6 +89,30 @@ func (t *topicTrie) find(topicFilter string) *topicNode {
 	return nil
 }
 
+// lookup walks through the trie and returns the node of the given topic levels.
+// Unlike find, the node is returned even if there is no subscription on it. Return nil if not found.
+func (t *topicTrie) lookup(topicSlice []string) *topicNode {
+	var pNode = t
+	for _, lv := range topicSlice {
+		if pNode = pNode.children[lv]; pNode == nil {
+			return nil
+		}
+	}
+	return pNode
+}
+
+// count returns the number of subscriptions of the node and its descendants.
+func (t *topicNode) count() uint64 {
+	n := uint64(len(t.clients))
+	for _, c := range t.shared {
+		n += uint64(len(c))
+	}
+	for _, c := range t.children {
+		n += c.count()
+	}
+	return n
+}
+
 // unsubscribe
 func (t *topicTrie) unsubscribe(clientID string, topicName string, shareName string) {
 	topicSlice := strings.Split(topicName, "/")
@@ -9,6 +9,8 @@ import (
 )
 
 var _ subscription.Store = (*TrieDB)(nil)
+var _ subscription.Compactor = (*TrieDB)(nil)
+var _ subscription.Counter = (*TrieDB)(nil)
 
 // TrieDB implement the subscription.Interface, it use trie tree to store topics.
 type TrieDB struct {
@@ -375,6 +377,49 @@ func (db *TrieDB) UnsubscribeAll(clientID string) error {
 	return nil
 }
 
+// ClientIDsLocked returns the ids of the clients which have subscriptions.
+func (db *TrieDB) ClientIDsLocked() []string {
+	ids := make(map[string]struct{})
+	for _, index := range []map[string]map[string]*topicNode{db.userIndex, db.systemIndex, db.sharedIndex} {
+		for clientID := range index {
+			ids[clientID] = struct{}{}
+		}
+	}
+	rs := make([]string, 0, len(ids))
+	for clientID := range ids {
+		rs = append(rs, clientID)
+	}
+	return rs
+}
+
+// CountLocked is the non thread-safe version of Count.
+func (db *TrieDB) CountLocked(topicPrefix string) uint64 {
+	topicPrefix = strings.TrimSuffix(topicPrefix, "/#")
+	if topicPrefix == "" || topicPrefix == "#" {
+		return db.stats.SubscriptionsCurrent
+	}
+	topicSlice := strings.Split(topicPrefix, "/")
+	var n uint64
+	for _, trie := range []*topicTrie{db.userTrie, db.systemTrie, db.sharedTrie} {
+		if node := trie.lookup(topicSlice); node != nil {
+			n += node.count()
+		}
+	}
+	return n
+}
+
+// Count implements subscription.Counter.
+func (db *TrieDB) Count(topicPrefix string) (uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.CountLocked(topicPrefix), nil
+}
+
+// Compact is a no-op, the memory store has no persisted state to drift from.
+func (db *TrieDB) Compact(exists func(clientID string) (bool, error)) (int, error) {
+	return 0, nil
+}
+
 // getMatchedTopicFilter return a map key by clientID that contain all matched topic for the given topicName.
 func (db *TrieDB) getMatchedTopicFilter(topicName string) subscription.ClientSubscriptions {
 	// system topic
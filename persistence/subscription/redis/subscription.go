@@ -18,6 +18,8 @@ const (
 )
 
 var _ subscription.Store = (*sub)(nil)
+var _ subscription.Compactor = (*sub)(nil)
+var _ subscription.Counter = (*sub)(nil)
 
 func EncodeSubscription(sub *gmqtt.Subscription) []byte {
 	w := &bytes.Buffer{}
@@ -28,6 +30,7 @@ func EncodeSubscription(sub *gmqtt.Subscription) []byte {
 	encoding.WriteBool(w, sub.NoLocal)
 	encoding.WriteBool(w, sub.RetainAsPublished)
 	w.WriteByte(sub.RetainHandling)
+	encoding.WriteBool(w, sub.Batch)
 	return w.Bytes()
 }
 
@@ -64,6 +67,13 @@ func DecodeSubscription(b []byte) (*gmqtt.Subscription, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Batch is optional for the subscriptions encoded by the previous version.
+	if r.Len() != 0 {
+		sub.Batch, err = encoding.ReadBool(r)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return sub, nil
 }
 
@@ -79,6 +89,9 @@ type sub struct {
 	mu       *sync.Mutex
 	memStore *mem.TrieDB
 	pool     *redigo.Pool
+	// subscribed records the clients which subscribe during Compact, nil if Compact is not running.
+	// It is guarded by mu.
+	subscribed map[string]struct{}
 }
 
 // Init loads the subscriptions of given clientIDs from backend into memory.
@@ -100,7 +113,7 @@ func (s *sub) Init(clientIDs []string) error {
 			if err != nil {
 				return err
 			}
-			s.memStore.SubscribeLocked(strings.TrimLeft(v, subPrefix), sub)
+			s.memStore.SubscribeLocked(v, sub)
 		}
 	}
 	return nil
@@ -114,8 +127,17 @@ func (s *sub) Close() error {
 func (s *sub) Subscribe(clientID string, subscriptions ...*gmqtt.Subscription) (rs subscription.SubscribeResult, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.subscribed != nil {
+		s.subscribed[clientID] = struct{}{}
+	}
 	c := s.pool.Get()
 	defer c.Close()
+	// The subscriptions are committed in one transaction, the queued commands are discarded by redis
+	// if the connection is broken before EXEC.
+	err = c.Send("multi")
+	if err != nil {
+		return nil, err
+	}
 	// hset sub:clientID topicFilter xxx
 	for _, v := range subscriptions {
 		err = c.Send("hset", subPrefix+clientID, subscription.GetFullTopicName(v.ShareName, v.TopicFilter), EncodeSubscription(v))
@@ -123,10 +145,15 @@ func (s *sub) Subscribe(clientID string, subscriptions ...*gmqtt.Subscription) (
 			return nil, err
 		}
 	}
-	err = c.Flush()
+	replies, err := redigo.Values(c.Do("exec"))
 	if err != nil {
 		return nil, err
 	}
+	for _, v := range replies {
+		if e, ok := v.(redigo.Error); ok {
+			return nil, e
+		}
+	}
 	rs = s.memStore.SubscribeLocked(clientID, subscriptions...)
 	return rs, nil
 }
@@ -169,6 +196,125 @@ func (s *sub) GetStats() subscription.Stats {
 	return s.memStore.GetStatusLocked()
 }
 
+// Count implements subscription.Counter, the subscriptions are counted with the in-memory index.
+func (s *sub) Count(topicPrefix string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.memStore.CountLocked(topicPrefix), nil
+}
+
+// Compact implements subscription.Compactor.
+// The persisted subscriptions in redis are authoritative, the in-memory index of each client is rebuilt from them.
+func (s *sub) Compact(exists func(clientID string) (bool, error)) (pruned int, err error) {
+	c := s.pool.Get()
+	defer c.Close()
+	clientIDs := make(map[string]struct{})
+	cursor := 0
+	for {
+		rs, err := redigo.Values(c.Do("scan", cursor, "match", subPrefix+"*", "count", 1000))
+		if err != nil {
+			return pruned, err
+		}
+		cursor, err = redigo.Int(rs[0], nil)
+		if err != nil {
+			return pruned, err
+		}
+		keys, err := redigo.Strings(rs[1], nil)
+		if err != nil {
+			return pruned, err
+		}
+		for _, v := range keys {
+			clientIDs[strings.TrimPrefix(v, subPrefix)] = struct{}{}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	s.mu.Lock()
+	for _, v := range s.memStore.ClientIDsLocked() {
+		clientIDs[v] = struct{}{}
+	}
+	s.subscribed = make(map[string]struct{})
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.subscribed = nil
+		s.mu.Unlock()
+	}()
+
+	for clientID := range clientIDs {
+		n, err := s.compactClient(c, clientID, exists)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+func (s *sub) compactClient(c redigo.Conn, clientID string, exists func(clientID string) (bool, error)) (pruned int, err error) {
+	// exists must be called without holding mu, because it may acquire the locks of the caller,
+	// e.g: the server lock which is held while iterating the subscriptions to deliver a message.
+	s.mu.Lock()
+	delete(s.subscribed, clientID)
+	s.mu.Unlock()
+	ok, err := exists(clientID)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the client which subscribes after the check is not pruned.
+	if _, subscribed := s.subscribed[clientID]; subscribed {
+		ok = true
+	}
+	current := make(map[string]struct{})
+	s.memStore.IterateLocked(func(clientID string, sub *gmqtt.Subscription) bool {
+		current[subscription.GetFullTopicName(sub.ShareName, sub.TopicFilter)] = struct{}{}
+		return true
+	}, subscription.IterationOptions{
+		Type:     subscription.TypeAll,
+		ClientID: clientID,
+	})
+	if !ok {
+		n, err := redigo.Int(c.Do("hlen", subPrefix+clientID))
+		if err != nil {
+			return 0, err
+		}
+		if _, err = c.Do("del", subPrefix+clientID); err != nil {
+			return 0, err
+		}
+		s.memStore.UnsubscribeAllLocked(clientID)
+		if len(current) > n {
+			n = len(current)
+		}
+		return n, nil
+	}
+	rs, err := redigo.Values(c.Do("hgetall", subPrefix+clientID))
+	if err != nil {
+		return 0, err
+	}
+	var subs []*gmqtt.Subscription
+	for i := 1; i < len(rs); i = i + 2 {
+		sub, err := DecodeSubscription(rs[i].([]byte))
+		if err != nil {
+			return 0, err
+		}
+		delete(current, subscription.GetFullTopicName(sub.ShareName, sub.TopicFilter))
+		subs = append(subs, sub)
+	}
+	// the rest are not persisted.
+	if len(current) != 0 {
+		topics := make([]string, 0, len(current))
+		for v := range current {
+			topics = append(topics, v)
+		}
+		s.memStore.UnsubscribeLocked(clientID, topics...)
+	}
+	s.memStore.SubscribeLocked(clientID, subs...)
+	return len(current), nil
+}
+
 func (s *sub) GetClientStats(clientID string) (subscription.Stats, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
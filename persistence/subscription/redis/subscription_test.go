@@ -1,11 +1,20 @@
 package redis
 
 import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	redigo "github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
 )
 
 func TestEncodeDecodeSubscription(t *testing.T) {
@@ -27,6 +36,7 @@ func TestEncodeDecodeSubscription(t *testing.T) {
 			NoLocal:           false,
 			RetainAsPublished: true,
 			RetainHandling:    1,
+			Batch:             true,
 		},
 	}
 
@@ -36,4 +46,280 @@ func TestEncodeDecodeSubscription(t *testing.T) {
 		a.Nil(err)
 		a.Equal(v, sub)
 	}
+
+	// the previous encoding without the Batch field.
+	b := EncodeSubscription(tt[0])
+	sub, err := DecodeSubscription(b[:len(b)-1])
+	a.Nil(err)
+	a.Equal(tt[0], sub)
+}
+
+// fakeRedis is an in-process redis server which supports the commands used by Subscribe.
+// crashAfter injects a connection failure after the given number of commands have been processed, negative means never.
+type fakeRedis struct {
+	mu         sync.Mutex
+	hashes     map[string]map[string][]byte
+	crashAfter int
+}
+
+func (f *fakeRedis) apply(cmd fakeCmd) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch cmd.name {
+	case "scan":
+		var keys []interface{}
+		for k := range f.hashes {
+			keys = append(keys, []byte(k))
+		}
+		return []interface{}{[]byte("0"), keys}
+	case "hgetall":
+		var rs []interface{}
+		for k, v := range f.hashes[cmd.args[0].(string)] {
+			rs = append(rs, []byte(k), v)
+		}
+		return rs
+	case "hlen":
+		return int64(len(f.hashes[cmd.args[0].(string)]))
+	case "del":
+		delete(f.hashes, cmd.args[0].(string))
+		return int64(1)
+	case "hset":
+		key := cmd.args[0].(string)
+		if f.hashes[key] == nil {
+			f.hashes[key] = make(map[string][]byte)
+		}
+		f.hashes[key][cmd.args[1].(string)] = cmd.args[2].([]byte)
+		return int64(1)
+	}
+	return redigo.Error("ERR unknown command '" + cmd.name + "'")
+}
+
+func (f *fakeRedis) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rs []string
+	for k := range f.hashes {
+		rs = append(rs, k)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+func (f *fakeRedis) fields(key string) []string {
+	var rs []string
+	for k := range f.hashes[key] {
+		rs = append(rs, k)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+type fakeCmd struct {
+	name string
+	args []interface{}
+}
+
+// fakeConn implements redigo.Conn, the commands take effect when they are flushed.
+type fakeConn struct {
+	srv     *fakeRedis
+	pending []fakeCmd
+	replies []interface{}
+	inMulti bool
+	queued  []fakeCmd
+	err     error
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	return c.err
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.pending = append(c.pending, fakeCmd{name: strings.ToLower(cmd), args: args})
+	return nil
+}
+
+func (c *fakeConn) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	for _, cmd := range c.pending {
+		if c.srv.crashAfter == 0 {
+			// the connection is broken, redis discards the commands queued in the transaction.
+			c.err = io.ErrUnexpectedEOF
+			c.pending = nil
+			c.queued = nil
+			return c.err
+		}
+		c.srv.crashAfter--
+		c.replies = append(c.replies, c.process(cmd))
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *fakeConn) process(cmd fakeCmd) interface{} {
+	switch cmd.name {
+	case "multi":
+		c.inMulti = true
+		return "OK"
+	case "exec":
+		rs := make([]interface{}, 0, len(c.queued))
+		for _, v := range c.queued {
+			rs = append(rs, c.srv.apply(v))
+		}
+		c.inMulti, c.queued = false, nil
+		return rs
+	case "discard":
+		c.inMulti, c.queued = false, nil
+		return "OK"
+	}
+	if c.inMulti {
+		c.queued = append(c.queued, cmd)
+		return "QUEUED"
+	}
+	return c.srv.apply(cmd)
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		if c.err != nil {
+			return nil, c.err
+		}
+		return nil, errors.New("no reply")
+	}
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	if e, ok := r.(redigo.Error); ok {
+		return nil, e
+	}
+	return r, nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	if cmd != "" {
+		if err = c.Send(cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.Flush(); err != nil {
+		return nil, err
+	}
+	for len(c.replies) != 0 {
+		reply, err = c.Receive()
+	}
+	return reply, err
+}
+
+func TestSub_Subscribe_commitBoundary(t *testing.T) {
+	subs := []*gmqtt.Subscription{
+		{TopicFilter: "a", QoS: 1},
+		{ShareName: "g", TopicFilter: "b", QoS: 2},
+		{TopicFilter: "c"},
+	}
+	// multi, hset * 3, exec
+	commands := len(subs) + 2
+	for crashAfter := 0; crashAfter <= commands; crashAfter++ {
+		t.Run(strconv.Itoa(crashAfter), func(t *testing.T) {
+			a := assert.New(t)
+			fs := &fakeRedis{hashes: make(map[string]map[string][]byte), crashAfter: -1}
+			s := New(&redigo.Pool{
+				Dial: func() (redigo.Conn, error) {
+					return &fakeConn{srv: fs}, nil
+				},
+			})
+			_, err := s.Subscribe("cid", &gmqtt.Subscription{TopicFilter: "existing"})
+			a.Nil(err)
+
+			fs.crashAfter = crashAfter
+			rs, err := s.Subscribe("cid", subs...)
+			stats, _ := s.GetClientStats("cid")
+			if crashAfter < commands {
+				// crashed before the commit, nothing is added.
+				a.Error(err)
+				a.Nil(rs)
+				a.Equal([]string{"existing"}, fs.fields(subPrefix+"cid"))
+				a.EqualValues(1, stats.SubscriptionsCurrent)
+				return
+			}
+			a.Nil(err)
+			a.Len(rs, len(subs))
+			a.Equal([]string{"$share/g/b", "a", "c", "existing"}, fs.fields(subPrefix+"cid"))
+			a.EqualValues(4, stats.SubscriptionsCurrent)
+		})
+	}
+}
+
+func TestSub_Compact(t *testing.T) {
+	a := assert.New(t)
+	fs := &fakeRedis{hashes: make(map[string]map[string][]byte), crashAfter: -1}
+	s := New(&redigo.Pool{
+		Dial: func() (redigo.Conn, error) {
+			return &fakeConn{srv: fs}, nil
+		},
+	})
+	for _, v := range []string{"live", "orphan", "late"} {
+		_, err := s.Subscribe(v, &gmqtt.Subscription{TopicFilter: "a"})
+		a.Nil(err)
+	}
+	// srvMu simulates the server lock, which is held while iterating the subscriptions to deliver a message,
+	// and acquired by the exists function to look up the clients.
+	var srvMu sync.Mutex
+	stop := make(chan struct{})
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			srvMu.Lock()
+			s.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+				return true
+			}, subscription.IterationOptions{Type: subscription.TypeAll, TopicName: "a", MatchType: subscription.MatchFilter})
+			srvMu.Unlock()
+		}
+	}()
+	done := make(chan struct{})
+	var pruned int
+	var err error
+	go func() {
+		defer close(done)
+		pruned, err = s.Compact(func(clientID string) (bool, error) {
+			srvMu.Lock()
+			defer srvMu.Unlock()
+			// yield while holding the lock, so that the delivery blocks on it.
+			time.Sleep(time.Millisecond)
+			if clientID == "late" {
+				// the client subscribes after the check.
+				go func() {
+					_, _ = s.Subscribe("late", &gmqtt.Subscription{TopicFilter: "b"})
+				}()
+				time.Sleep(10 * time.Millisecond)
+			}
+			return clientID == "live", nil
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		a.FailNow("deadlock between Compact and Iterate")
+	}
+	close(stop)
+	<-delivered
+	a.Nil(err)
+	a.Equal(1, pruned)
+	a.Equal([]string{subPrefix + "late", subPrefix + "live"}, fs.keys())
+	stats, _ := s.GetClientStats("orphan")
+	a.Zero(stats.SubscriptionsCurrent)
+	stats, _ = s.GetClientStats("late")
+	a.EqualValues(2, stats.SubscriptionsCurrent)
 }
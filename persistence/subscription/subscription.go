@@ -98,6 +98,11 @@ type Store interface {
 	// Notice:
 	// This method will succeed even if the client is not exists, the subscriptions
 	// will affect the new client with the client id.
+	// If the client has already subscribed the topic filter (with the same share name for shared subscriptions),
+	// the subscription options are updated in place and AlreadyExisted is set to true in the result.
+	// In particular, a client never joins a shared subscription group more than once.
+	// The subscriptions are added atomically, either all of them are added or none of them is added if it returns an error.
+	// The result is in the same order as the given subscriptions.
 	Subscribe(clientID string, subscriptions ...*gmqtt.Subscription) (rs SubscribeResult, err error)
 	// Unsubscribe removes subscriptions of a specific client.
 	Unsubscribe(clientID string, topics ...string) error
@@ -115,6 +120,26 @@ type Store interface {
 	StatsReader
 }
 
+// Compactor is an optional interface for Store to remove the orphaned subscriptions,
+// e.g: the subscriptions left behind by a crash.
+type Compactor interface {
+	// Compact rebuilds the in-memory index from the persisted subscriptions,
+	// and removes the subscriptions of the clients whose session no longer exists.
+	// The exists function reports whether the session of the given client exists,
+	// it is called without holding the locks of the store, so it can acquire the locks of the caller.
+	// It is safe to call while the broker is running, the locks are only held for one client at a time.
+	// It returns the number of the removed subscriptions.
+	Compact(exists func(clientID string) (bool, error)) (pruned int, err error)
+}
+
+// Counter is an optional interface for Store to count the subscriptions of a topic subtree without iterating them.
+type Counter interface {
+	// Count returns the number of the subscriptions whose topic filter is topicPrefix or below it,
+	// e.g: "fleet" and "fleet/#" both count the subscriptions of "fleet", "fleet/+/status", "$share/g/fleet/#" and so on.
+	// The wildcards in topicPrefix are treated as normal topic levels. Empty topicPrefix counts all subscriptions.
+	Count(topicPrefix string) (uint64, error)
+}
+
 // GetTopicMatched returns the subscriptions that match the passed topic.
 func GetTopicMatched(store Store, topicFilter string, t IterationType) ClientSubscriptions {
 	rs := make(ClientSubscriptions)
@@ -287,7 +287,136 @@ func TestSuite(t *testing.T, new func() subscription.Store) {
 	t.Run("testGetStatus", func(t *testing.T) {
 		testGetClientStats(t, store3)
 	})
+
+	store4 := new()
+	a.Nil(store4.Init(nil))
+	defer store4.Close()
+	t.Run("testSharedResubscribe", func(t *testing.T) {
+		testSharedResubscribe(t, store4)
+	})
+
+	store6 := new()
+	a.Nil(store6.Init(nil))
+	defer store6.Close()
+	t.Run("testResubscribe", func(t *testing.T) {
+		testResubscribe(t, store6)
+	})
+
+	if _, ok := new().(subscription.Counter); ok {
+		store5 := new()
+		a.Nil(store5.Init(nil))
+		defer store5.Close()
+		t.Run("testCount", func(t *testing.T) {
+			testCount(t, store5)
+		})
+	}
+}
+
+func testCount(t *testing.T, store subscription.Store) {
+	a := assert.New(t)
+	subs := map[string][]string{
+		"id0": {"fleet", "fleet/#", "fleet/+/status", "fleetx/a", "$share/g/fleet/a/b", "$SYS/fleet/a"},
+		"id1": {"fleet/a/b", "$share/g/fleet/a/b", "/fleet", "other"},
+	}
+	for clientID, topics := range subs {
+		for _, v := range topics {
+			_, err := store.Subscribe(clientID, subscription.FromTopic(packets.Topic{Name: v}, 0))
+			a.NoError(err)
+		}
+	}
+	counter := store.(subscription.Counter)
+	var tt = []struct {
+		prefix string
+		count  uint64
+	}{
+		{prefix: "", count: 10},
+		{prefix: "#", count: 10},
+		{prefix: "fleet", count: 6},
+		{prefix: "fleet/#", count: 6},
+		{prefix: "fleet/a", count: 3},
+		{prefix: "fleet/+", count: 1},
+		{prefix: "$SYS", count: 1},
+		{prefix: "not_exist", count: 0},
+		{prefix: "fleet/a/b/c", count: 0},
+	}
+	for _, v := range tt {
+		n, err := counter.Count(v.prefix)
+		a.NoError(err)
+		a.Equal(v.count, n, v.prefix)
+	}
+	a.NoError(store.Unsubscribe("id0", "fleet/#", "$share/g/fleet/a/b"))
+	n, err := counter.Count("fleet")
+	a.NoError(err)
+	a.EqualValues(4, n)
 }
+
+func testSharedResubscribe(t *testing.T, store subscription.Store) {
+	a := assert.New(t)
+	sub := &gmqtt.Subscription{
+		ShareName:   "group",
+		TopicFilter: "topic/resubscribe",
+		QoS:         packets.Qos0,
+	}
+	rs, err := store.Subscribe("client1", sub)
+	a.Nil(err)
+	a.False(rs[0].AlreadyExisted)
+	_, err = store.Subscribe("client2", sub)
+	a.Nil(err)
+
+	// resubscribe with different options
+	resub := sub.Copy()
+	resub.QoS = packets.Qos2
+	resub.NoLocal = true
+	rs, err = store.Subscribe("client1", resub)
+	a.Nil(err)
+	a.True(rs[0].AlreadyExisted)
+
+	got := subscription.GetTopicMatched(store, sub.TopicFilter, subscription.TypeShared)
+	a.Len(got, 2)
+	a.Equal([]*gmqtt.Subscription{resub}, got["client1"])
+	a.Equal([]*gmqtt.Subscription{sub}, got["client2"])
+
+	stats := store.GetStats()
+	a.EqualValues(2, stats.SubscriptionsTotal)
+	a.EqualValues(2, stats.SubscriptionsCurrent)
+	clientStats, err := store.GetClientStats("client1")
+	a.Nil(err)
+	a.EqualValues(1, clientStats.SubscriptionsTotal)
+	a.EqualValues(1, clientStats.SubscriptionsCurrent)
+}
+
+// testResubscribe tests AlreadyExisted, which is used to determine whether to send the retained messages with Retain Handling 1.
+func testResubscribe(t *testing.T, store subscription.Store) {
+	a := assert.New(t)
+	for _, topic := range []string{"topic/resubscribe", "$SYS/resubscribe"} {
+		sub := &gmqtt.Subscription{
+			TopicFilter:    topic,
+			QoS:            packets.Qos1,
+			RetainHandling: 1,
+		}
+		rs, err := store.Subscribe("client1", sub)
+		a.Nil(err)
+		a.False(rs[0].AlreadyExisted)
+		// the identical filter of another client is a new subscription.
+		rs, err = store.Subscribe("client2", sub)
+		a.Nil(err)
+		a.False(rs[0].AlreadyExisted)
+
+		// resubscribe with different options
+		resub := sub.Copy()
+		resub.QoS = packets.Qos2
+		rs, err = store.Subscribe("client1", resub)
+		a.Nil(err)
+		a.True(rs[0].AlreadyExisted)
+		a.Equal([]*gmqtt.Subscription{resub}, subscription.GetTopicMatched(store, topic, subscription.TypeAll)["client1"])
+
+		a.Nil(store.Unsubscribe("client1", topic))
+		rs, err = store.Subscribe("client1", sub)
+		a.Nil(err)
+		a.False(rs[0].AlreadyExisted)
+	}
+}
+
 func testGetTopic(t *testing.T, store subscription.Store) {
 	a := assert.New(t)
 
@@ -6,6 +6,7 @@ import (
 )
 
 var _ unack.Store = (*Store)(nil)
+var _ unack.Checker = (*Store)(nil)
 
 type Store struct {
 	clientID     string
@@ -42,3 +43,9 @@ func (s *Store) Remove(id packets.PacketID) error {
 	delete(s.unackpublish, id)
 	return nil
 }
+
+// Exist implements unack.Checker.
+func (s *Store) Exist(id packets.PacketID) (bool, error) {
+	_, ok := s.unackpublish[id]
+	return ok, nil
+}
@@ -12,6 +12,7 @@ const (
 )
 
 var _ unack.Store = (*Store)(nil)
+var _ unack.Checker = (*Store)(nil)
 
 type Store struct {
 	clientID     string
@@ -73,3 +74,14 @@ func (s *Store) Remove(id packets.PacketID) error {
 	delete(s.unackpublish, id)
 	return nil
 }
+
+// Exist implements unack.Checker.
+// It always checks the backend store, because the cache is not loaded when the session resumes.
+func (s *Store) Exist(id packets.PacketID) (bool, error) {
+	if _, ok := s.unackpublish[id]; ok {
+		return true, nil
+	}
+	c := s.pool.Get()
+	defer c.Close()
+	return redis.Bool(c.Do("hexists", getKey(s.clientID), id))
+}
@@ -50,5 +50,27 @@ func TestSuite(t *testing.T, store unack.Store) {
 		a.Nil(err)
 		a.False(rs)
 	}
+	testExist(t, store)
+}
+
+func testExist(t *testing.T, store unack.Store) {
+	a := assert.New(t)
+	checker, ok := store.(unack.Checker)
+	if !ok {
+		return
+	}
+	a.Nil(store.Init(true))
+	exist, err := checker.Exist(1)
+	a.Nil(err)
+	a.False(exist)
+	_, err = store.Set(1)
+	a.Nil(err)
+	exist, err = checker.Exist(1)
+	a.Nil(err)
+	a.True(exist)
+	a.Nil(store.Remove(1))
+	exist, err = checker.Exist(1)
+	a.Nil(err)
+	a.False(exist)
 
 }
@@ -17,3 +17,10 @@ type Store interface {
 	// Remove removes the given id from store.
 	Remove(id packets.PacketID) error
 }
+
+// Checker is an optional interface for Store to check whether the given id exists.
+// The broker uses it to detect the PUBREL for unknown packet id, see config.MQTT.UnknownPubrelPolicy.
+type Checker interface {
+	// Exist returns whether the given id exists in store.
+	Exist(id packets.PacketID) (bool, error)
+}
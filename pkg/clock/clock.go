@@ -0,0 +1,54 @@
+// Package clock provides the time source of the time-based features, e.g: session expiry, message expiry,
+// delayed will messages, scheduled messages and bans, so that they can be tested deterministically with a fake clock.
+package clock
+
+import (
+	"time"
+)
+
+// Clock is the source of the current time and the timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer creates a new Timer that will send the current time on its channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the timer created by Clock, see time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing, see time.Timer.Stop.
+	Stop() bool
+	// Reset changes the timer to expire after duration d, see time.Timer.Reset.
+	Reset(d time.Duration) bool
+}
+
+// New returns the Clock of the wall-clock time.
+func New() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{Timer: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (r *realTimer) C() <-chan time.Time {
+	return r.Timer.C
+}
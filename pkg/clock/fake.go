@@ -0,0 +1,138 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is the Clock whose time only moves by Advance or Set, it is used in tests.
+// The timers fire in the goroutine which moves the time, in the order of their deadlines.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake returns the Fake clock at the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now implements Clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After implements Clock.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer implements Clock.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{
+		clock: f,
+		c:     make(chan time.Time, 1),
+	}
+	f.resetLocked(t, d)
+	return t
+}
+
+// Advance moves the time forward by d and fires the due timers.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the time to now and fires the due timers, the time never goes backward.
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Before(f.now) {
+		return
+	}
+	f.now = now
+	sort.SliceStable(f.timers, func(i, j int) bool {
+		return f.timers[i].deadline.Before(f.timers[j].deadline)
+	})
+	n := 0
+	for _, t := range f.timers {
+		if t.deadline.After(now) {
+			f.timers[n] = t
+			n++
+			continue
+		}
+		t.active = false
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+	f.timers = f.timers[:n]
+}
+
+// Timers returns the number of the active timers, it can be used to wait for a goroutine to start a timer.
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+func (f *Fake) resetLocked(t *fakeTimer, d time.Duration) {
+	t.deadline = f.now.Add(d)
+	if d <= 0 {
+		t.active = false
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		return
+	}
+	if !t.active {
+		t.active = true
+		f.timers = append(f.timers, t)
+	}
+}
+
+func (f *Fake) stopLocked(t *fakeTimer) bool {
+	if !t.active {
+		return false
+	}
+	t.active = false
+	for i, v := range f.timers {
+		if v == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.stopLocked(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.stopLocked(t)
+	t.clock.resetLocked(t, d)
+	return active
+}
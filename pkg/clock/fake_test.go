@@ -0,0 +1,52 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(1000, 0)
+	f := NewFake(now)
+	a.Equal(now, f.Now())
+
+	t1 := f.NewTimer(2 * time.Second)
+	t2 := f.After(time.Second)
+	t3 := f.NewTimer(3 * time.Second)
+	a.Equal(3, f.Timers())
+	a.True(t3.Stop())
+	a.False(t3.Stop())
+
+	f.Advance(time.Second)
+	a.Equal(now.Add(time.Second), <-t2)
+	select {
+	case <-t1.C():
+		a.FailNow("unexpected fire")
+	default:
+	}
+	f.Advance(time.Second)
+	a.Equal(now.Add(2*time.Second), <-t1.C())
+	a.Equal(0, f.Timers())
+
+	// the timer can be reused.
+	a.False(t1.Reset(time.Second))
+	a.True(t1.Reset(2 * time.Second))
+	f.Advance(time.Second)
+	select {
+	case <-t1.C():
+		a.FailNow("unexpected fire")
+	default:
+	}
+	f.Advance(time.Second)
+	a.Equal(now.Add(4*time.Second), <-t1.C())
+
+	// the time never goes backward.
+	f.Set(now)
+	a.Equal(now.Add(4*time.Second), f.Now())
+
+	// fire immediately.
+	a.Equal(now.Add(4*time.Second), <-f.After(0))
+}
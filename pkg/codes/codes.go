@@ -5,8 +5,9 @@ import (
 )
 
 var (
-	ErrMalformed = &Error{Code: MalformedPacket}
-	ErrProtocol  = &Error{Code: ProtocolError}
+	ErrMalformed      = &Error{Code: MalformedPacket}
+	ErrProtocol       = &Error{Code: ProtocolError}
+	ErrPacketTooLarge = &Error{Code: PacketTooLarge}
 )
 
 // There are the possible Code in v311 connack packet.
@@ -45,6 +46,7 @@ const (
 	ServerUnavailable           Code = 0x88
 	ServerBusy                  Code = 0x89
 	Banned                      Code = 0x8A
+	ServerShuttingDown          Code = 0x8B
 	BadAuthMethod               Code = 0x8C
 	KeepAliveTimeout            Code = 0x8D
 	SessionTakenOver            Code = 0x8E
@@ -0,0 +1,87 @@
+// Package otelsink provides the server.MetricSink which records the metrics by the OpenTelemetry metric API.
+// It is a separate module, so that the broker does not depend on the OpenTelemetry modules unless the sink is used.
+package otelsink
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// Sink records the counters by Int64Counter, the gauges by Float64Gauge and the timings by Float64Histogram in milliseconds.
+// The instruments are created by the meter on the first use of each metric name, and the tags are recorded as the attributes.
+// The instruments which can not be created are replaced by the no-op ones, as the metrics are best effort.
+// The Sink is not safe for concurrent use, which is fine because the server calls the sink in a single goroutine.
+type Sink struct {
+	meter    metric.Meter
+	prefix   string
+	counters map[string]metric.Int64Counter
+	gauges   map[string]metric.Float64Gauge
+	timings  map[string]metric.Float64Histogram
+}
+
+// New returns the Sink which records the metrics by the meter.
+// The prefix is prepended to the metric names with a dot, empty prefix means no prefix.
+func New(meter metric.Meter, prefix string) *Sink {
+	if prefix != "" && prefix[len(prefix)-1] != '.' {
+		prefix += "."
+	}
+	return &Sink{
+		meter:    meter,
+		prefix:   prefix,
+		counters: make(map[string]metric.Int64Counter),
+		gauges:   make(map[string]metric.Float64Gauge),
+		timings:  make(map[string]metric.Float64Histogram),
+	}
+}
+
+// RecordCounter implements server.MetricSink.
+func (s *Sink) RecordCounter(name string, delta int64, tags map[string]string) {
+	c, ok := s.counters[name]
+	if !ok {
+		var err error
+		if c, err = s.meter.Int64Counter(s.prefix + name); err != nil || c == nil {
+			c = noop.Int64Counter{}
+		}
+		s.counters[name] = c
+	}
+	c.Add(context.Background(), delta, attributes(tags))
+}
+
+// RecordGauge implements server.MetricSink.
+func (s *Sink) RecordGauge(name string, value float64, tags map[string]string) {
+	g, ok := s.gauges[name]
+	if !ok {
+		var err error
+		if g, err = s.meter.Float64Gauge(s.prefix + name); err != nil || g == nil {
+			g = noop.Float64Gauge{}
+		}
+		s.gauges[name] = g
+	}
+	g.Record(context.Background(), value, attributes(tags))
+}
+
+// RecordTiming implements server.MetricSink, the duration is recorded in milliseconds.
+func (s *Sink) RecordTiming(name string, d time.Duration, tags map[string]string) {
+	h, ok := s.timings[name]
+	if !ok {
+		var err error
+		if h, err = s.meter.Float64Histogram(s.prefix+name, metric.WithUnit("ms")); err != nil || h == nil {
+			h = noop.Float64Histogram{}
+		}
+		s.timings[name] = h
+	}
+	h.Record(context.Background(), float64(d)/float64(time.Millisecond), attributes(tags))
+}
+
+// attributes returns the tags as the attributes of the measurement.
+func attributes(tags map[string]string) metric.MeasurementOption {
+	kvs := make([]attribute.KeyValue, 0, len(tags))
+	for k, v := range tags {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	return metric.WithAttributes(kvs...)
+}
@@ -0,0 +1,55 @@
+package otelsink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+var _ server.MetricSink = (*Sink)(nil)
+
+func TestSink(t *testing.T) {
+	a := assert.New(t)
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+	s := New(provider.Meter("gmqtt"), "gmqtt")
+
+	s.RecordCounter("messages.dropped", 1, map[string]string{"reason": "queue_full", "qos": "1"})
+	s.RecordCounter("messages.dropped", 2, map[string]string{"reason": "queue_full", "qos": "1"})
+	s.RecordGauge("sessions.active", 10, nil)
+	s.RecordGauge("sessions.active", 8, nil)
+	s.RecordTiming("messages.delivery_latency", 1500*time.Microsecond, nil)
+
+	var rm metricdata.ResourceMetrics
+	a.Nil(reader.Collect(context.Background(), &rm))
+	if !a.Len(rm.ScopeMetrics, 1) {
+		return
+	}
+	metrics := make(map[string]metricdata.Aggregation)
+	for _, v := range rm.ScopeMetrics[0].Metrics {
+		metrics[v.Name] = v.Data
+	}
+
+	dropped := metrics["gmqtt.messages.dropped"].(metricdata.Sum[int64])
+	if a.Len(dropped.DataPoints, 1) {
+		a.EqualValues(3, dropped.DataPoints[0].Value)
+		a.Equal(attribute.NewSet(attribute.String("qos", "1"), attribute.String("reason", "queue_full")), dropped.DataPoints[0].Attributes)
+	}
+	active := metrics["gmqtt.sessions.active"].(metricdata.Gauge[float64])
+	if a.Len(active.DataPoints, 1) {
+		a.EqualValues(8, active.DataPoints[0].Value)
+	}
+	latency := metrics["gmqtt.messages.delivery_latency"].(metricdata.Histogram[float64])
+	if a.Len(latency.DataPoints, 1) {
+		a.EqualValues(1, latency.DataPoints[0].Count)
+		a.Equal(1.5, latency.DataPoints[0].Sum)
+	}
+}
@@ -53,7 +53,7 @@ func (a *Auth) Unpack(r io.Reader) error {
 		return codes.ErrProtocol
 	}
 	a.Properties = &Properties{}
-	return a.Properties.Unpack(bufr, AUTH)
+	return a.Properties.unpack(bufr, AUTH, a.FixHeader.lenient)
 }
 
 func NewAuthPacket(fh *FixHeader, r io.Reader) (*Auth, error) {
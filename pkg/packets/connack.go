@@ -69,7 +69,7 @@ func (c *Connack) Unpack(r io.Reader) error {
 			return codes.ErrProtocol
 		}
 		c.Properties = &Properties{}
-		return c.Properties.Unpack(bufr, CONNACK)
+		return c.Properties.unpack(bufr, CONNACK, c.FixHeader.lenient)
 	}
 	return nil
 
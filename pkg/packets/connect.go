@@ -160,7 +160,7 @@ func (c *Connect) Unpack(r io.Reader) (err error) {
 		return codes.ErrMalformed
 	}
 	reserved := 1 & connectFlags
-	if reserved != 0 { //[MQTT-3.1.2-3]
+	if reserved != 0 && !c.FixHeader.lenient { //[MQTT-3.1.2-3]
 		return codes.ErrMalformed
 	}
 	c.CleanStart = (1 & (connectFlags >> 1)) > 0
@@ -184,7 +184,7 @@ func (c *Connect) Unpack(r io.Reader) (err error) {
 		// resolve properties
 		c.Properties = &Properties{}
 		c.WillProperties = &Properties{}
-		if err := c.Properties.Unpack(bufr, CONNECT); err != nil {
+		if err := c.Properties.unpack(bufr, CONNECT, c.FixHeader.lenient); err != nil {
 			return err
 		}
 	}
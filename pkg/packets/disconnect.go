@@ -64,7 +64,7 @@ func (d *Disconnect) Unpack(r io.Reader) error {
 		if !ValidateCode(DISCONNECT, d.Code) {
 			return codes.ErrProtocol
 		}
-		return d.Properties.Unpack(bufr, DISCONNECT)
+		return d.Properties.unpack(bufr, DISCONNECT, d.FixHeader.lenient)
 	}
 	return nil
 }
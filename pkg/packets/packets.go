@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"sync/atomic"
 	"unicode/utf8"
 
 	"github.com/DrmagicE/gmqtt/pkg/codes"
@@ -100,6 +101,8 @@ type FixHeader struct {
 	PacketType   byte
 	Flags        byte
 	RemainLength int
+	// lenient indicates whether the packet is decoded in lenient mode, see Reader.SetLenient.
+	lenient bool
 }
 
 // Packet defines the interface for structs intended to hold
@@ -146,6 +149,9 @@ type SubOptions struct {
 type Reader struct {
 	bufr    *bufio.Reader
 	version Version
+	lenient bool
+	// maxPacketSize is the maximum packet size, 0 means unlimited. Use atomic to access.
+	maxPacketSize uint32
 }
 
 // Writer is used to encode MQTT packet into bytes and write it to bufio.Writer.
@@ -176,6 +182,25 @@ func (r *Reader) SetVersion(version Version) {
 	r.version = version
 }
 
+// SetLenient sets whether to tolerate the harmless protocol violations when decoding packets.
+// In lenient mode, the Reader:
+//  1. ignores the reserved bits of the fixed header and the CONNECT flags;
+//  2. discards the properties which are not valid for the packet type;
+//  3. keeps the last occurrence of the property which is included more than once.
+//
+// The Reader rejects all of them by default.
+func (r *Reader) SetLenient(lenient bool) {
+	r.lenient = lenient
+}
+
+// SetMaxPacketSize sets the maximum size of the packets to be read, including the fixed header. 0 means unlimited.
+// ReadPacket returns codes.ErrPacketTooLarge once the remaining length of the packet exceeds the limit,
+// without reading the rest of the packet.
+// It is safe to call SetMaxPacketSize concurrently with ReadPacket.
+func (r *Reader) SetMaxPacketSize(size uint32) {
+	atomic.StoreUint32(&r.maxPacketSize, size)
+}
+
 // NewWriter returns a new Writer.
 func NewWriter(w io.Writer) *Writer {
 	if bufw, ok := w.(*bufio.Writer); ok {
@@ -191,11 +216,20 @@ func (r *Reader) ReadPacket() (Packet, error) {
 	if err != nil {
 		return nil, err
 	}
-	fh := &FixHeader{PacketType: first >> 4, Flags: first & 15} //设置FixHeader
+	fh := &FixHeader{PacketType: first >> 4, Flags: first & 15, lenient: r.lenient} //设置FixHeader
+	if flags, ok := reservedFlags(fh.PacketType); ok && fh.Flags != flags {
+		if !r.lenient {
+			return nil, codes.ErrMalformed
+		}
+		fh.Flags = flags
+	}
 	length, err := EncodeRemainLength(r.bufr)
 	if err != nil {
 		return nil, err
 	}
+	if max := atomic.LoadUint32(&r.maxPacketSize); max != 0 && uint64(fixHeaderLength(length))+uint64(length) > uint64(max) {
+		return nil, codes.ErrPacketTooLarge
+	}
 	fh.RemainLength = length
 	packet, err := NewPacket(fh, r.version, r.bufr)
 	if err != nil {
@@ -238,16 +272,12 @@ func (w *Writer) WriteAndFlush(packet Packet) error {
 
 // Pack encodes the FixHeader struct into bytes and writes it into io.Writer.
 func (fh *FixHeader) Pack(w io.Writer) error {
-	var err error
-	b := make([]byte, 1)
-	packetType := fh.PacketType << 4
-	b[0] = packetType | fh.Flags
-	length, err := DecodeRemainLength(fh.RemainLength)
+	b := make([]byte, maxFixHeaderLength)
+	start, err := fh.encode(b)
 	if err != nil {
 		return err
 	}
-	b = append(b, length...)
-	_, err = w.Write(b)
+	_, err = w.Write(b[start:])
 	return err
 }
 
@@ -390,6 +420,23 @@ func DecodeUTF8String(buf []byte) (b []byte, size int, err error) {
 	return payload, length + 2, nil
 }
 
+// reservedFlags returns the flags of the fixed header which are required by the given packet type.
+// The flags of PUBLISH are not reserved.
+func reservedFlags(packetType byte) (flags byte, ok bool) {
+	switch packetType {
+	case PUBLISH:
+		return 0, false
+	case PUBREL:
+		return FlagPubrel, true
+	case SUBSCRIBE:
+		return FlagSubscribe, true
+	case UNSUBSCRIBE:
+		return FlagUnsubscribe, true
+	default:
+		return FlagReserved, true
+	}
+}
+
 // NewPacket returns a packet representing the decoded MQTT packet and an error.
 func NewPacket(fh *FixHeader, version Version, r io.Reader) (Packet, error) {
 	switch fh.PacketType {
@@ -444,7 +491,9 @@ func ValidUTF8(p []byte) bool {
 		if ru >= '\u007f' && ru <= '\u009f' {
 			return false
 		}
-		if ru == utf8.RuneError {
+		// RuneError with size 1 means the bytes are malformed, e.g: overlong encodings, surrogates.
+		// Otherwise, it is the U+FFFD character which is allowed.
+		if ru == utf8.RuneError && size == 1 {
 			return false
 		}
 		if !utf8.ValidRune(ru) {
@@ -458,95 +507,22 @@ func ValidUTF8(p []byte) bool {
 }
 
 // ValidTopicName returns whether the bytes is a valid non-shared topic filter.[MQTT-4.7.1-1].
+// See ValidateTopic for details.
 func ValidTopicName(mustUTF8 bool, p []byte) bool {
-	for len(p) > 0 {
-		ru, size := utf8.DecodeRune(p)
-		if mustUTF8 && ru == utf8.RuneError {
-			return false
-		}
-		if size == 1 {
-			//主题名不允许使用通配符
-			if p[0] == byte('+') || p[0] == byte('#') {
-				return false
-			}
-		}
-		p = p[size:]
-	}
-	return true
+	return validateTopicName(mustUTF8, p) == nil
 }
 
 // ValidV5Topic returns whether the given bytes is a valid MQTT V5 topic
+// See ValidateFilter for details.
 func ValidV5Topic(p []byte) bool {
-	if len(p) == 0 {
-		return false
-	}
-	if bytes.HasPrefix(p, []byte("$share/")) {
-		if len(p) < 9 {
-			return false
-		}
-		if p[7] != '/' {
-			subp := p[7:]
-			for len(subp) > 0 {
-				ru, size := utf8.DecodeRune(subp)
-				if ru == utf8.RuneError {
-					return false
-				}
-				if size == 1 {
-					if subp[0] == '/' {
-						return ValidTopicFilter(true, subp[1:])
-					}
-					if subp[0] == byte('+') || subp[0] == byte('#') {
-						return false
-					}
-				}
-				subp = subp[size:]
-			}
-
-		}
-		return false
-	}
-	return ValidTopicFilter(true, p)
+	return validateV5Filter(p) == nil
 }
 
-// ValidTopicFilter 验证主题过滤器是否合法
-//
-// ValidTopicFilter  returns whether the bytes is a valid topic filter. [MQTT-4.7.1-2]  [MQTT-4.7.1-3]
 // ValidTopicFilter 验证主题过滤器是否合法
 //
 // ValidTopicFilter  returns whether the bytes is a valid topic filter. [MQTT-4.7.1-2]  [MQTT-4.7.1-3]
 func ValidTopicFilter(mustUTF8 bool, p []byte) bool {
-	if len(p) == 0 {
-		return false
-	}
-	var prevByte byte //前一个字节
-	var isSetPrevByte bool
-
-	for len(p) > 0 {
-		ru, size := utf8.DecodeRune(p)
-		if mustUTF8 && ru == utf8.RuneError {
-			return false
-		}
-		plen := len(p)
-		if p[0] == byte('#') && plen != 1 { // #一定是最后一个字符
-			return false
-		}
-		if size == 1 && isSetPrevByte {
-			// + 前（如果有前后字节）,一定是'/' [MQTT-4.7.1-2]  [MQTT-4.7.1-3]
-			if (p[0] == byte('+') || p[0] == byte('#')) && prevByte != byte('/') {
-				return false
-			}
-
-			if plen > 1 { // p[0] 不是最后一个字节
-				if p[0] == byte('+') && p[1] != byte('/') { // + 后（如果有字节）,一定是 '/'
-					return false
-				}
-			}
-		}
-		prevByte = p[0]
-		isSetPrevByte = true
-		p = p[size:]
-	}
-	return true
+	return validateTopicFilter(mustUTF8, p) == nil
 }
 
 // TopicMatch returns whether the topic and topic filter is matched.
@@ -659,16 +635,21 @@ func TotalBytes(p Packet) uint32 {
 	if header == nil {
 		return 0
 	}
+	return fixHeaderLength(header.RemainLength) + uint32(header.RemainLength)
+
+}
+
+// fixHeaderLength returns the length of the fixed header with the given remaining length.
+func fixHeaderLength(remainLength int) uint32 {
 	var headerLength uint32
-	if header.RemainLength <= 127 {
+	if remainLength <= 127 {
 		headerLength = 2
-	} else if header.RemainLength <= 16383 {
+	} else if remainLength <= 16383 {
 		headerLength = 3
-	} else if header.RemainLength <= 2097151 {
+	} else if remainLength <= 2097151 {
 		headerLength = 4
-	} else if header.RemainLength <= 268435455 {
+	} else if remainLength <= 268435455 {
 		headerLength = 5
 	}
-	return headerLength + uint32(header.RemainLength)
-
+	return headerLength
 }
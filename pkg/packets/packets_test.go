@@ -3,7 +3,11 @@ package packets
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"io"
 	"testing"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
 )
 
 func appendPacket(firstByte byte, b ...[]byte) []byte {
@@ -93,6 +97,8 @@ var topicFilterTest = []struct {
 	{input: "sport/tennis/#/rank", want: false},
 	{input: "//1", want: true},
 	{input: "/+1", want: false},
+	{input: "+1", want: false},
+	{input: "+/1", want: true},
 	{input: "+", want: true},
 	{input: "#", want: true},
 	{input: "sport/tennis/#", want: true},
@@ -207,6 +213,44 @@ func TestValidUTF8(t *testing.T) {
 	}
 }
 
+// malformedUTF8Topics are the topics which are not well-formed UTF-8 or contain the null character.
+var malformedUTF8Topics = [][]byte{
+	[]byte("a/\x00/b"),       // embedded null
+	[]byte("a/\xc0\xaf"),     // overlong encoding of '/'
+	[]byte("a/\xe0\x80\xaf"), // 3-byte overlong encoding of '/'
+	[]byte("a/\xf0\x80\x80\xaf"),
+	[]byte("a/\xed\xa0\x80"),     // surrogate half U+D800
+	[]byte("a/\xf4\x90\x80\x80"), // greater than U+10FFFF
+	[]byte("a/\xe2\x82"),         // truncated sequence
+	[]byte("a/\xff"),
+	[]byte("\x80"), // unexpected continuation byte
+}
+
+// rawUTF8String returns the length-prefixed bytes without validation.
+func rawUTF8String(b []byte) []byte {
+	rs := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(rs, uint16(len(b)))
+	return append(rs, b...)
+}
+
+func TestValidUTF8_malformed(t *testing.T) {
+	for _, v := range malformedUTF8Topics {
+		if ValidUTF8(v) {
+			t.Fatalf("ValidUTF8(%v) error,want %t, but %t", v, false, true)
+		}
+		if ValidTopicName(true, v) {
+			t.Fatalf("ValidTopicName(%v) error,want %t, but %t", v, false, true)
+		}
+		if ValidTopicFilter(true, v) {
+			t.Fatalf("ValidTopicFilter(%v) error,want %t, but %t", v, false, true)
+		}
+	}
+	// U+FFFD is a valid character.
+	if !ValidUTF8([]byte("a/\xef\xbf\xbd")) || !ValidTopicName(true, []byte("a/\xef\xbf\xbd")) {
+		t.Fatalf("U+FFFD must be valid")
+	}
+}
+
 //Subscribable Topic Filter
 func TestValidTopicFilter(t *testing.T) {
 	for _, v := range topicFilterTest {
@@ -240,3 +284,105 @@ func TestTopicMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestReader_SetLenient(t *testing.T) {
+	var tt = []struct {
+		name     string
+		version  Version
+		buf      []byte
+		strict   codes.Code
+		lenience func(p Packet) bool
+	}{
+		{
+			name:    "reserved bits of the fixed header",
+			version: Version311,
+			buf:     appendPacket(0x41, []byte{0, 1}),
+			strict:  codes.MalformedPacket,
+			lenience: func(p Packet) bool {
+				return p.(*Puback).FixHeader.Flags == FlagReserved
+			},
+		},
+		{
+			name:    "reserved bit of the connect flags",
+			version: Version311,
+			buf:     appendPacket(0x10, []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x03, 0, 60}, []byte{0, 1, 'c'}),
+			strict:  codes.MalformedPacket,
+			lenience: func(p Packet) bool {
+				return p.(*Connect).CleanStart
+			},
+		},
+		{
+			name:    "duplicated property",
+			version: Version5,
+			buf:     appendPacket(0x30, []byte{0, 1, 'a'}, []byte{10, PropMessageExpiry, 0, 0, 0, 1, PropMessageExpiry, 0, 0, 0, 2}, []byte("payload")),
+			strict:  codes.ProtocolError,
+			lenience: func(p Packet) bool {
+				return *p.(*Publish).Properties.MessageExpiry == 2
+			},
+		},
+		{
+			name:    "invalid property for the packet type",
+			version: Version5,
+			buf:     appendPacket(0x30, []byte{0, 1, 'a'}, []byte{5, PropSessionExpiryInterval, 0, 0, 0, 1}, []byte("payload")),
+			strict:  codes.ProtocolError,
+			lenience: func(p Packet) bool {
+				pub := p.(*Publish)
+				return pub.Properties.SessionExpiryInterval == nil && string(pub.Payload) == "payload"
+			},
+		},
+	}
+	for _, v := range tt {
+		r := NewReader(bytes.NewBuffer(v.buf))
+		r.SetVersion(v.version)
+		_, err := r.ReadPacket()
+		if ce, ok := err.(*codes.Error); !ok || ce.Code != v.strict {
+			t.Fatalf("%s: strict mode error, want %v, but %v", v.name, v.strict, err)
+		}
+
+		r = NewReader(bytes.NewBuffer(v.buf))
+		r.SetVersion(v.version)
+		r.SetLenient(true)
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("%s: lenient mode error, want nil, but %v", v.name, err)
+		}
+		if !v.lenience(p) {
+			t.Fatalf("%s: unexpected packet in lenient mode: %v", v.name, p)
+		}
+	}
+}
+
+// unreadable fails the test if it is read.
+type unreadable struct {
+	t *testing.T
+}
+
+func (u unreadable) Read(p []byte) (int, error) {
+	u.t.Fatal("the payload of the oversized packet must not be read")
+	return 0, nil
+}
+
+func TestReader_SetMaxPacketSize(t *testing.T) {
+	pub := appendPacket(0x30, []byte{0, 1, 'a'}, []byte("payload"))
+	r := NewReader(bytes.NewReader(pub))
+	r.SetMaxPacketSize(uint32(len(pub)))
+	if _, err := r.ReadPacket(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the remaining length claims 65535 bytes, only the fixed header is available.
+	header := []byte{0x30, 0xff, 0xff, 0x03}
+	r = NewReader(io.MultiReader(bytes.NewReader(header), unreadable{t: t}))
+	r.SetMaxPacketSize(1024)
+	_, err := r.ReadPacket()
+	if err != codes.ErrPacketTooLarge {
+		t.Fatalf("ReadPacket error want %v, got %v", codes.ErrPacketTooLarge, err)
+	}
+
+	// unlimited
+	r = NewReader(bytes.NewReader(pub))
+	r.SetMaxPacketSize(0)
+	if _, err = r.ReadPacket(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,168 @@
+package packets
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+// maxFixHeaderLength is the maximum length of the fixed header,
+// which is 1 byte packet type and flags and up to 4 bytes remaining length.
+const maxFixHeaderLength = 5
+
+// maxPooledBufferSize is the maximum capacity of the buffer returned to bufferPool,
+// the larger buffer is left to the GC, so that a few large packets do not pin the memory.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool pools the scratch buffers to encode and decode the packets on the hot path.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns the buffer to bufferPool.
+// The caller must not retain any slice of the buffer, including the decoded fields which reference it.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// readRemaining reads the remaining length bytes of the packet into a pooled buffer.
+// The returned bytes are only valid until putBuffer is called with the returned buffer.
+func readRemaining(r io.Reader, length int) ([]byte, *bytes.Buffer, error) {
+	b := getBuffer()
+	b.Grow(length)
+	rest := b.Bytes()[:length]
+	if _, err := io.ReadFull(r, rest); err != nil {
+		putBuffer(b)
+		return nil, nil, codes.ErrMalformed
+	}
+	return rest, b, nil
+}
+
+var reservedFixHeader [maxFixHeaderLength]byte
+
+// newPacketBuffer returns a pooled buffer to encode the packet, see writePacketBuffer.
+func newPacketBuffer() *bytes.Buffer {
+	b := getBuffer()
+	b.Write(reservedFixHeader[:])
+	return b
+}
+
+// writePacketBuffer writes the fixed header and the variable header and payload encoded in b to w,
+// and returns b to the pool. The first maxFixHeaderLength bytes of b are reserved for the fixed header.
+func writePacketBuffer(w io.Writer, fh *FixHeader, b *bytes.Buffer) error {
+	defer putBuffer(b)
+	buf := b.Bytes()
+	fh.RemainLength = len(buf) - maxFixHeaderLength
+	start, err := fh.encode(buf[:maxFixHeaderLength])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf[start:])
+	return err
+}
+
+// encode encodes the fixed header into the end of b, and returns the start offset.
+func (fh *FixHeader) encode(b []byte) (int, error) {
+	var length [maxFixHeaderLength - 1]byte
+	n, err := encodeRemainLength(length[:], fh.RemainLength)
+	if err != nil {
+		return 0, err
+	}
+	start := len(b) - n - 1
+	b[start] = fh.PacketType<<4 | fh.Flags
+	copy(b[start+1:], length[:n])
+	return start, nil
+}
+
+// encodeRemainLength encodes the remaining length into b, and returns the number of bytes written.
+func encodeRemainLength(b []byte, length int) (int, error) {
+	if length < 0 || length >= 268435456 {
+		return 0, codes.ErrMalformed
+	}
+	var n int
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b[n] = digit
+		n++
+		if length == 0 {
+			return n, nil
+		}
+	}
+}
+
+// writeRemainLength writes the variable byte integer to w, the length must be valid.
+func writeRemainLength(w *bytes.Buffer, length int) {
+	var b [maxFixHeaderLength - 1]byte
+	n, _ := encodeRemainLength(b[:], length)
+	w.Write(b[:n])
+}
+
+// detacher copies the decoded byte slices out of the pooled buffer into one allocation.
+// The capacity of b must be large enough to hold all the copies, see Properties.bytesLen.
+type detacher struct {
+	b []byte
+}
+
+func newDetacher(size int) detacher {
+	return detacher{b: make([]byte, 0, size)}
+}
+
+// copy returns the copy of s, the copy of the empty s is an empty slice rather than nil.
+// The copy has no spare capacity, so appending to it does not overwrite the other copies.
+func (d *detacher) copy(s []byte) []byte {
+	if s == nil {
+		return nil
+	}
+	start := len(d.b)
+	d.b = append(d.b, s...)
+	return d.b[start:len(d.b):len(d.b)]
+}
+
+// bytesLen returns the total length of the byte slices of the properties.
+func (p *Properties) bytesLen() int {
+	if p == nil {
+		return 0
+	}
+	n := len(p.ContentType) + len(p.ResponseTopic) + len(p.CorrelationData) + len(p.AssignedClientID) +
+		len(p.AuthMethod) + len(p.AuthData) + len(p.ResponseInfo) + len(p.ServerReference) + len(p.ReasonString)
+	for _, v := range p.User {
+		n += len(v.K) + len(v.V)
+	}
+	return n
+}
+
+// detach copies the byte slices of the properties, so that they do not reference the pooled buffer.
+func (p *Properties) detach(d *detacher) {
+	if p == nil {
+		return
+	}
+	p.ContentType = d.copy(p.ContentType)
+	p.ResponseTopic = d.copy(p.ResponseTopic)
+	p.CorrelationData = d.copy(p.CorrelationData)
+	p.AssignedClientID = d.copy(p.AssignedClientID)
+	p.AuthMethod = d.copy(p.AuthMethod)
+	p.AuthData = d.copy(p.AuthData)
+	p.ResponseInfo = d.copy(p.ResponseInfo)
+	p.ServerReference = d.copy(p.ServerReference)
+	p.ReasonString = d.copy(p.ReasonString)
+	for i := range p.User {
+		p.User[i].K = d.copy(p.User[i].K)
+		p.User[i].V = d.copy(p.User[i].V)
+	}
+}
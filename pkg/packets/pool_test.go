@@ -0,0 +1,147 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// repeatReader reads b repeatedly.
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.b[r.off:])
+	r.off = (r.off + n) % len(r.b)
+	return n, nil
+}
+
+func benchPublish() *Publish {
+	return &Publish{
+		Version:   Version5,
+		Qos:       Qos1,
+		PacketID:  1,
+		TopicName: []byte("sensors/room-1/temperature"),
+		Payload:   bytes.Repeat([]byte("p"), 256),
+		Properties: &Properties{
+			ContentType: []byte("text/plain"),
+			User:        []UserProperty{{K: []byte("k"), V: []byte("v")}},
+		},
+	}
+}
+
+func encodePackets(t testing.TB, pkts ...Packet) []byte {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	for _, v := range pkts {
+		if err := w.WritePacket(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkReadPacket(b *testing.B, pkt Packet) {
+	r := NewReader(&repeatReader{b: encodePackets(b, pkt)})
+	r.SetVersion(Version5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadPacket(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkWritePacket(b *testing.B, pkt Packet) {
+	w := NewWriter(ioutil.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := w.WritePacket(pkt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReader_ReadPacket_publish(b *testing.B) {
+	benchmarkReadPacket(b, benchPublish())
+}
+
+func BenchmarkReader_ReadPacket_puback(b *testing.B) {
+	benchmarkReadPacket(b, &Puback{Version: Version5, PacketID: 1})
+}
+
+func BenchmarkWriter_WritePacket_publish(b *testing.B) {
+	benchmarkWritePacket(b, benchPublish())
+}
+
+func BenchmarkWriter_WritePacket_puback(b *testing.B) {
+	benchmarkWritePacket(b, &Puback{Version: Version5, PacketID: 1})
+}
+
+// TestReader_ReadPacket_handoff decodes the publish packets with the pooled buffers while the decoded messages
+// are read by other goroutines, run with -race to detect the decoded fields referencing the pooled buffers.
+func TestReader_ReadPacket_handoff(t *testing.T) {
+	a := assert.New(t)
+	const n = 200
+	var pkts []Packet
+	for i := 0; i < n; i++ {
+		pkts = append(pkts, &Publish{
+			Version:   Version5,
+			Qos:       Qos1,
+			PacketID:  PacketID(i + 1),
+			TopicName: []byte(fmt.Sprintf("topic/%03d", i)),
+			Payload:   bytes.Repeat([]byte{byte(i)}, 512),
+			Properties: &Properties{
+				CorrelationData: []byte(fmt.Sprintf("correlation/%03d", i)),
+				User:            []UserProperty{{K: []byte("k"), V: []byte(fmt.Sprintf("v/%03d", i))}},
+			},
+		}, &Puback{Version: Version5, PacketID: PacketID(i + 1), Code: 0x10, Properties: &Properties{
+			ReasonString: []byte(fmt.Sprintf("reason/%03d", i)),
+		}})
+	}
+	r := NewReader(bytes.NewReader(encodePackets(t, pkts...)))
+	r.SetVersion(Version5)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		pub, err := r.ReadPacket()
+		a.Nil(err)
+		ack, err := r.ReadPacket()
+		a.Nil(err)
+		wg.Add(1)
+		go func(i int, pub *Publish, ack *Puback) {
+			defer wg.Done()
+			// encode the packet concurrently, which uses the pooled buffers as well.
+			a.Nil(pub.Pack(ioutil.Discard))
+			a.Equal(fmt.Sprintf("topic/%03d", i), string(pub.TopicName))
+			a.Equal(bytes.Repeat([]byte{byte(i)}, 512), pub.Payload)
+			a.Equal(fmt.Sprintf("correlation/%03d", i), string(pub.Properties.CorrelationData))
+			a.Equal(fmt.Sprintf("v/%03d", i), string(pub.Properties.User[0].V))
+			a.Equal(fmt.Sprintf("reason/%03d", i), string(ack.Properties.ReasonString))
+		}(i, pub.(*Publish), ack.(*Puback))
+	}
+	wg.Wait()
+}
+
+func TestPublish_Unpack_noSpareCapacity(t *testing.T) {
+	a := assert.New(t)
+	r := NewReader(bytes.NewReader(encodePackets(t, benchPublish())))
+	r.SetVersion(Version5)
+	p, err := r.ReadPacket()
+	a.Nil(err)
+	pub := p.(*Publish)
+	// appending to the topic name must not overwrite the payload.
+	_ = append(pub.TopicName, 'x')
+	a.Equal(benchPublish().Payload, pub.Payload)
+	a.Equal(len(pub.TopicName), cap(pub.TopicName))
+}
@@ -41,7 +41,12 @@ const (
 )
 
 func errMorethanOnce(property byte) error {
-	return fmt.Errorf("property %v presents more than once", property)
+	return &codes.Error{
+		Code: codes.ProtocolError,
+		ErrorDetails: codes.ErrorDetails{
+			ReasonString: []byte(fmt.Sprintf("property %v presents more than once", property)),
+		},
+	}
 }
 
 type UserProperty struct {
@@ -219,11 +224,11 @@ func (p *Properties) PackWillProperties(bufw *bytes.Buffer) {
 // Pack takes all the defined properties for an Properties and produces
 // a slice of bytes representing the wire format for the Info
 func (p *Properties) Pack(bufw *bytes.Buffer, packetType byte) {
-	newBufw := &bytes.Buffer{}
+	newBufw := getBuffer()
 	defer func() {
-		b, _ := DecodeRemainLength(newBufw.Len())
-		bufw.Write(b)
+		writeRemainLength(bufw, newBufw.Len())
 		newBufw.WriteTo(bufw)
+		putBuffer(newBufw)
 	}()
 	if p == nil {
 		return
@@ -237,8 +242,7 @@ func (p *Properties) Pack(bufw *bytes.Buffer, packetType byte) {
 	if len(p.SubscriptionIdentifier) != 0 {
 		for _, v := range p.SubscriptionIdentifier {
 			newBufw.WriteByte(PropSubscriptionIdentifier)
-			b, _ := DecodeRemainLength(int(v))
-			newBufw.Write(b)
+			writeRemainLength(newBufw, int(v))
 		}
 	}
 	propertyWriteUint32(PropSessionExpiryInterval, p.SessionExpiryInterval, newBufw)
@@ -331,6 +335,13 @@ func (p *Properties) UnpackWillProperties(bufr *bytes.Buffer) error {
 // filling in the appropriate entries in the struct, it returns the number
 // of bytes used to store the Prop data and any error in decoding them
 func (p *Properties) Unpack(bufr *bytes.Buffer, packetType byte) error {
+	return p.unpack(bufr, packetType, false)
+}
+
+// unpack is the implementation of Unpack.
+// If lenient is true, the properties which are not valid for the packet type are discarded
+// and the last occurrence wins if a property (except the user property) is included more than once.
+func (p *Properties) unpack(bufr *bytes.Buffer, packetType byte, lenient bool) error {
 	var err error
 	length, err := EncodeRemainLength(bufr)
 	// 整个buffer最多只能读到length这么长
@@ -354,94 +365,17 @@ func (p *Properties) Unpack(bufr *bytes.Buffer, packetType byte) error {
 			break
 		}
 
+		dst := p
 		if !ValidateID(packetType, propType) {
-			return codes.ErrProtocol
-		}
-
-		switch propType {
-		case PropPayloadFormat:
-			p.PayloadFormat, err = propertyReadBool(p.PayloadFormat, newBufr, propType)
-		case PropMessageExpiry:
-			p.MessageExpiry, err = propertyReadUint32(p.MessageExpiry, newBufr, propType, nil)
-		case PropContentType:
-			p.ContentType, err = propertyReadUTF8String(p.ContentType, newBufr, propType, nil)
-		case PropResponseTopic:
-			p.ResponseTopic, err = propertyReadUTF8String(p.ResponseTopic, newBufr, propType, func(u []byte) bool {
-				return ValidTopicName(true, u) // [MQTT-3.3.2-14]
-			})
-		case PropCorrelationData:
-			p.CorrelationData, err = propertyReadBinary(p.CorrelationData, newBufr, propType, nil)
-		case PropSubscriptionIdentifier:
-			if len(p.SubscriptionIdentifier) != 0 {
-				return codes.ErrProtocol
-			}
-			si, err := EncodeRemainLength(newBufr)
-			if err != nil {
-				return codes.ErrMalformed
-			}
-			if si == 0 {
+			if !lenient {
 				return codes.ErrProtocol
 			}
-			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, uint32(si))
-		case PropSessionExpiryInterval:
-			p.SessionExpiryInterval, err = propertyReadUint32(p.SessionExpiryInterval, newBufr, propType, nil)
-		case PropAssignedClientID:
-			p.AssignedClientID, err = propertyReadUTF8String(p.AssignedClientID, newBufr, propType, nil)
-		case PropServerKeepAlive:
-			p.ServerKeepAlive, err = propertyReadUint16(p.ServerKeepAlive, newBufr, propType, nil)
-		case PropAuthMethod:
-			p.AuthMethod, err = propertyReadUTF8String(p.AuthMethod, newBufr, propType, nil)
-		case PropAuthData:
-			p.AuthData, err = propertyReadUTF8String(p.AuthData, newBufr, propType, nil)
-		case PropRequestProblemInfo:
-			p.RequestProblemInfo, err = propertyReadBool(p.RequestProblemInfo, newBufr, propType)
-		case PropWillDelayInterval:
-			p.WillDelayInterval, err = propertyReadUint32(p.WillDelayInterval, newBufr, propType, nil)
-		case PropRequestResponseInfo:
-			p.RequestResponseInfo, err = propertyReadBool(p.RequestResponseInfo, newBufr, propType)
-		case PropResponseInfo:
-			p.ResponseInfo, err = propertyReadUTF8String(p.ResponseInfo, newBufr, propType, nil)
-		case PropServerReference:
-			p.ServerReference, err = propertyReadUTF8String(p.ServerReference, newBufr, propType, nil)
-		case PropReasonString:
-			p.ReasonString, err = propertyReadUTF8String(p.ReasonString, newBufr, propType, nil)
-		case PropReceiveMaximum:
-			p.ReceiveMaximum, err = propertyReadUint16(p.ReceiveMaximum, newBufr, propType, func(u uint16) bool {
-				return u != 0
-			})
-		case PropTopicAliasMaximum:
-			p.TopicAliasMaximum, err = propertyReadUint16(p.TopicAliasMaximum, newBufr, propType, nil)
-		case PropTopicAlias:
-			p.TopicAlias, err = propertyReadUint16(p.TopicAlias, newBufr, propType, func(u uint16) bool {
-				return u != 0 // [MQTT-3.3.2-8]
-			})
-		case PropMaximumQoS:
-			p.MaximumQoS, err = propertyReadBool(p.MaximumQoS, newBufr, propType)
-		case PropRetainAvailable:
-			p.RetainAvailable, err = propertyReadBool(p.RetainAvailable, newBufr, propType)
-		case PropUser:
-			k, err := readUTF8String(true, newBufr)
-			if err != nil {
-				return codes.ErrMalformed
-			}
-			v, err := readUTF8String(true, newBufr)
-			if err != nil {
-				return codes.ErrMalformed
-			}
-			p.User = append(p.User, UserProperty{K: k, V: v})
-		case PropMaximumPacketSize:
-			p.MaximumPacketSize, err = propertyReadUint32(p.MaximumPacketSize, newBufr, propType, func(u uint32) bool {
-				return u != 0
-			})
-		case PropWildcardSubAvailable:
-			p.WildcardSubAvailable, err = propertyReadBool(p.WildcardSubAvailable, newBufr, propType)
-		case PropSubIDAvailable:
-			p.SubIDAvailable, err = propertyReadBool(p.SubIDAvailable, newBufr, propType)
-		case PropSharedSubAvailable:
-			p.SharedSubAvailable, err = propertyReadBool(p.SharedSubAvailable, newBufr, propType)
-		default:
-			return codes.ErrMalformed
+			// read the property into a scratch struct to discard it.
+			dst = &Properties{}
+		} else if lenient {
+			p.unset(propType)
 		}
+		err = dst.readProperty(propType, newBufr)
 	}
 	if p.AuthData != nil && p.AuthMethod == nil {
 		return codes.ErrMalformed
@@ -449,6 +383,153 @@ func (p *Properties) Unpack(bufr *bytes.Buffer, packetType byte) error {
 	return nil
 }
 
+// readProperty reads the value of the given property type from bufr.
+func (p *Properties) readProperty(propType byte, newBufr *bytes.Buffer) (err error) {
+	switch propType {
+	case PropPayloadFormat:
+		p.PayloadFormat, err = propertyReadBool(p.PayloadFormat, newBufr, propType)
+	case PropMessageExpiry:
+		p.MessageExpiry, err = propertyReadUint32(p.MessageExpiry, newBufr, propType, nil)
+	case PropContentType:
+		p.ContentType, err = propertyReadUTF8String(p.ContentType, newBufr, propType, nil)
+	case PropResponseTopic:
+		p.ResponseTopic, err = propertyReadUTF8String(p.ResponseTopic, newBufr, propType, func(u []byte) bool {
+			return ValidTopicName(true, u) // [MQTT-3.3.2-14]
+		})
+	case PropCorrelationData:
+		p.CorrelationData, err = propertyReadBinary(p.CorrelationData, newBufr, propType, nil)
+	case PropSubscriptionIdentifier:
+		if len(p.SubscriptionIdentifier) != 0 {
+			return codes.ErrProtocol
+		}
+		si, err := EncodeRemainLength(newBufr)
+		if err != nil {
+			return codes.ErrMalformed
+		}
+		if si == 0 {
+			return codes.ErrProtocol
+		}
+		p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, uint32(si))
+	case PropSessionExpiryInterval:
+		p.SessionExpiryInterval, err = propertyReadUint32(p.SessionExpiryInterval, newBufr, propType, nil)
+	case PropAssignedClientID:
+		p.AssignedClientID, err = propertyReadUTF8String(p.AssignedClientID, newBufr, propType, nil)
+	case PropServerKeepAlive:
+		p.ServerKeepAlive, err = propertyReadUint16(p.ServerKeepAlive, newBufr, propType, nil)
+	case PropAuthMethod:
+		p.AuthMethod, err = propertyReadUTF8String(p.AuthMethod, newBufr, propType, nil)
+	case PropAuthData:
+		p.AuthData, err = propertyReadUTF8String(p.AuthData, newBufr, propType, nil)
+	case PropRequestProblemInfo:
+		p.RequestProblemInfo, err = propertyReadBool(p.RequestProblemInfo, newBufr, propType)
+	case PropWillDelayInterval:
+		p.WillDelayInterval, err = propertyReadUint32(p.WillDelayInterval, newBufr, propType, nil)
+	case PropRequestResponseInfo:
+		p.RequestResponseInfo, err = propertyReadBool(p.RequestResponseInfo, newBufr, propType)
+	case PropResponseInfo:
+		p.ResponseInfo, err = propertyReadUTF8String(p.ResponseInfo, newBufr, propType, nil)
+	case PropServerReference:
+		p.ServerReference, err = propertyReadUTF8String(p.ServerReference, newBufr, propType, nil)
+	case PropReasonString:
+		p.ReasonString, err = propertyReadUTF8String(p.ReasonString, newBufr, propType, nil)
+	case PropReceiveMaximum:
+		p.ReceiveMaximum, err = propertyReadUint16(p.ReceiveMaximum, newBufr, propType, func(u uint16) bool {
+			return u != 0
+		})
+	case PropTopicAliasMaximum:
+		p.TopicAliasMaximum, err = propertyReadUint16(p.TopicAliasMaximum, newBufr, propType, nil)
+	case PropTopicAlias:
+		p.TopicAlias, err = propertyReadUint16(p.TopicAlias, newBufr, propType, func(u uint16) bool {
+			return u != 0 // [MQTT-3.3.2-8]
+		})
+	case PropMaximumQoS:
+		p.MaximumQoS, err = propertyReadBool(p.MaximumQoS, newBufr, propType)
+	case PropRetainAvailable:
+		p.RetainAvailable, err = propertyReadBool(p.RetainAvailable, newBufr, propType)
+	case PropUser:
+		k, err := readUTF8String(true, newBufr)
+		if err != nil {
+			return codes.ErrMalformed
+		}
+		v, err := readUTF8String(true, newBufr)
+		if err != nil {
+			return codes.ErrMalformed
+		}
+		p.User = append(p.User, UserProperty{K: k, V: v})
+	case PropMaximumPacketSize:
+		p.MaximumPacketSize, err = propertyReadUint32(p.MaximumPacketSize, newBufr, propType, func(u uint32) bool {
+			return u != 0
+		})
+	case PropWildcardSubAvailable:
+		p.WildcardSubAvailable, err = propertyReadBool(p.WildcardSubAvailable, newBufr, propType)
+	case PropSubIDAvailable:
+		p.SubIDAvailable, err = propertyReadBool(p.SubIDAvailable, newBufr, propType)
+	case PropSharedSubAvailable:
+		p.SharedSubAvailable, err = propertyReadBool(p.SharedSubAvailable, newBufr, propType)
+	default:
+		return codes.ErrMalformed
+	}
+	return err
+}
+
+// unset clears the given property. The user property is not cleared as it is allowed to appear multiple times.
+func (p *Properties) unset(propType byte) {
+	switch propType {
+	case PropPayloadFormat:
+		p.PayloadFormat = nil
+	case PropMessageExpiry:
+		p.MessageExpiry = nil
+	case PropContentType:
+		p.ContentType = nil
+	case PropResponseTopic:
+		p.ResponseTopic = nil
+	case PropCorrelationData:
+		p.CorrelationData = nil
+	case PropSubscriptionIdentifier:
+		p.SubscriptionIdentifier = nil
+	case PropSessionExpiryInterval:
+		p.SessionExpiryInterval = nil
+	case PropAssignedClientID:
+		p.AssignedClientID = nil
+	case PropServerKeepAlive:
+		p.ServerKeepAlive = nil
+	case PropAuthMethod:
+		p.AuthMethod = nil
+	case PropAuthData:
+		p.AuthData = nil
+	case PropRequestProblemInfo:
+		p.RequestProblemInfo = nil
+	case PropWillDelayInterval:
+		p.WillDelayInterval = nil
+	case PropRequestResponseInfo:
+		p.RequestResponseInfo = nil
+	case PropResponseInfo:
+		p.ResponseInfo = nil
+	case PropServerReference:
+		p.ServerReference = nil
+	case PropReasonString:
+		p.ReasonString = nil
+	case PropReceiveMaximum:
+		p.ReceiveMaximum = nil
+	case PropTopicAliasMaximum:
+		p.TopicAliasMaximum = nil
+	case PropTopicAlias:
+		p.TopicAlias = nil
+	case PropMaximumQoS:
+		p.MaximumQoS = nil
+	case PropRetainAvailable:
+		p.RetainAvailable = nil
+	case PropMaximumPacketSize:
+		p.MaximumPacketSize = nil
+	case PropWildcardSubAvailable:
+		p.WildcardSubAvailable = nil
+	case PropSubIDAvailable:
+		p.SubIDAvailable = nil
+	case PropSharedSubAvailable:
+		p.SharedSubAvailable = nil
+	}
+}
+
 // ValidProperties is a map of the various properties and the
 // PacketTypes that is valid for server to unpack.
 var ValidProperties = map[byte]map[byte]struct{}{
@@ -50,7 +50,7 @@ func NewPublishPacket(fh *FixHeader, version Version, r io.Reader) (*Publish, er
 // Pack encodes the packet struct into bytes and writes it into io.Writer.
 func (p *Publish) Pack(w io.Writer) error {
 	p.FixHeader = &FixHeader{PacketType: PUBLISH}
-	bufw := &bytes.Buffer{}
+	bufw := newPacketBuffer()
 	var dup, retain byte
 	dup = 0
 	retain = 0
@@ -69,25 +69,17 @@ func (p *Publish) Pack(w io.Writer) error {
 		p.Properties.Pack(bufw, PUBLISH)
 	}
 	bufw.Write(p.Payload)
-	p.FixHeader.RemainLength = bufw.Len()
-	err := p.FixHeader.Pack(w)
-	if err != nil {
-		return err
-	}
-	_, err = bufw.WriteTo(w)
-
-	return err
-
+	return writePacketBuffer(w, p.FixHeader, bufw)
 }
 
 // Unpack read the packet bytes from io.Reader and decodes it into the packet struct.
 func (p *Publish) Unpack(r io.Reader) error {
-	var err error
-	restBuffer := make([]byte, p.FixHeader.RemainLength)
-	_, err = io.ReadFull(r, restBuffer)
+	restBuffer, pooled, err := readRemaining(r, p.FixHeader.RemainLength)
 	if err != nil {
-		return codes.ErrMalformed
+		return err
 	}
+	// the decoded fields must not reference the pooled buffer after return.
+	defer putBuffer(pooled)
 	bufr := bytes.NewBuffer(restBuffer)
 	p.TopicName, err = readUTF8String(true, bufr)
 	if err != nil {
@@ -104,11 +96,16 @@ func (p *Publish) Unpack(r io.Reader) error {
 	}
 	if p.Version == Version5 {
 		p.Properties = &Properties{}
-		if err := p.Properties.Unpack(bufr, PUBLISH); err != nil {
+		if err := p.Properties.unpack(bufr, PUBLISH, p.FixHeader.lenient); err != nil {
 			return err
 		}
 	}
-	p.Payload = bufr.Next(bufr.Len())
+	// The message is handed off to the subscriber queues, which must not reference the pooled buffer.
+	payload := bufr.Next(bufr.Len())
+	d := newDetacher(len(p.TopicName) + len(payload) + p.Properties.bytesLen())
+	p.TopicName = d.copy(p.TopicName)
+	p.Payload = d.copy(payload)
+	p.Properties.detach(&d)
 	return nil
 }
 
@@ -142,6 +142,23 @@ func TestReadPublishPacket_V5(t *testing.T) {
 	})
 }
 
+func TestReadPublishPacket_malformedUTF8Topic(t *testing.T) {
+	a := assert.New(t)
+	for _, version := range []Version{Version311, Version5} {
+		for _, topic := range malformedUTF8Topics {
+			b := [][]byte{rawUTF8String(topic)}
+			if version == Version5 {
+				b = append(b, []byte{0})
+			}
+			b = append(b, []byte("payload"))
+			r := NewReader(bytes.NewBuffer(appendPacket(0x30, b...)))
+			r.SetVersion(version)
+			_, err := r.ReadPacket()
+			a.Equal(codes.ErrMalformed, err, "version: %d, topic: %v", version, topic)
+		}
+	}
+}
+
 func TestReadWritePublishPacket_V311(t *testing.T) {
 	a := assert.New(t)
 	var tt = []struct {
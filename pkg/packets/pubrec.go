@@ -42,28 +42,23 @@ func (p *Pubrec) NewPubrel() *Pubrel {
 // Pack encodes the packet struct into bytes and writes it into io.Writer.
 func (p *Pubrec) Pack(w io.Writer) error {
 	p.FixHeader = &FixHeader{PacketType: PUBREC, Flags: FlagReserved}
-	bufw := &bytes.Buffer{}
+	bufw := newPacketBuffer()
 	writeUint16(bufw, p.PacketID)
 	if p.Version == Version5 && (p.Code != codes.Success || p.Properties != nil) {
 		bufw.WriteByte(p.Code)
 		p.Properties.Pack(bufw, PUBREC)
 	}
-	p.FixHeader.RemainLength = bufw.Len()
-	err := p.FixHeader.Pack(w)
-	if err != nil {
-		return err
-	}
-	_, err = bufw.WriteTo(w)
-	return err
+	return writePacketBuffer(w, p.FixHeader, bufw)
 }
 
 // Unpack read the packet bytes from io.Reader and decodes it into the packet struct.
 func (p *Pubrec) Unpack(r io.Reader) error {
-	restBuffer := make([]byte, p.FixHeader.RemainLength)
-	_, err := io.ReadFull(r, restBuffer)
+	restBuffer, pooled, err := readRemaining(r, p.FixHeader.RemainLength)
 	if err != nil {
-		return codes.ErrMalformed
+		return err
 	}
+	// the decoded fields must not reference the pooled buffer after return.
+	defer putBuffer(pooled)
 	bufr := bytes.NewBuffer(restBuffer)
 	p.PacketID, err = readUint16(bufr)
 	if err != nil {
@@ -81,7 +76,11 @@ func (p *Pubrec) Unpack(r io.Reader) error {
 		if !ValidateCode(PUBREC, p.Code) {
 			return codes.ErrProtocol
 		}
-		return p.Properties.Unpack(bufr, PUBREC)
+		if err := p.Properties.unpack(bufr, PUBREC, p.FixHeader.lenient); err != nil {
+			return err
+		}
+		d := newDetacher(p.Properties.bytesLen())
+		p.Properties.detach(&d)
 	}
 	return nil
 
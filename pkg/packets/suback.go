@@ -66,7 +66,7 @@ func (p *Suback) Unpack(r io.Reader) error {
 	}
 	if p.Version == Version5 {
 		p.Properties = &Properties{}
-		err = p.Properties.Unpack(bufr, SUBACK)
+		err = p.Properties.unpack(bufr, SUBACK, p.FixHeader.lenient)
 		if err != nil {
 			return err
 		}
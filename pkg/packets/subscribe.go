@@ -105,7 +105,7 @@ func (p *Subscribe) Unpack(r io.Reader) (err error) {
 	}
 	if p.Version == Version5 {
 		p.Properties = &Properties{}
-		if err := p.Properties.Unpack(bufr, SUBSCRIBE); err != nil {
+		if err := p.Properties.unpack(bufr, SUBSCRIBE, p.FixHeader.lenient); err != nil {
 			return err
 		}
 	}
@@ -136,6 +136,14 @@ func (p *Subscribe) Unpack(r io.Reader) (err error) {
 			topic.NoLocal = (1 & (opts >> 2)) > 0
 			topic.RetainAsPublished = (1 & (opts >> 3)) > 0
 			topic.RetainHandling = (3 & (opts >> 4))
+			// It is a Protocol Error to send a Retain Handling value of 3.
+			if topic.RetainHandling == 3 {
+				return codes.ErrProtocol
+			}
+			// It is a Protocol Error to set the No Local bit to 1 on a Shared Subscription. [MQTT-3.8.3-4]
+			if topic.NoLocal && bytes.HasPrefix(topicFilter, []byte(sharePrefix)) {
+				return codes.ErrProtocol
+			}
 		} else {
 			topic.Qos = opts
 			if topic.Qos > Qos2 {
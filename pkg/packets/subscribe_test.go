@@ -7,6 +7,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
 )
 
 func TestReadWriteSubscribe_V5(t *testing.T) {
@@ -127,3 +129,47 @@ func TestReadWriteSubscribe_V311(t *testing.T) {
 	})
 
 }
+
+func TestReadSubscribePacket_malformedUTF8Topic(t *testing.T) {
+	a := assert.New(t)
+	for _, version := range []Version{Version311, Version5} {
+		for _, topic := range malformedUTF8Topics {
+			b := [][]byte{{0, 10}}
+			if version == Version5 {
+				b = append(b, []byte{0})
+			}
+			b = append(b, append(rawUTF8String(topic), 1))
+			r := NewReader(bytes.NewBuffer(appendPacket(0x82, b...)))
+			r.SetVersion(version)
+			_, err := r.ReadPacket()
+			a.Equal(codes.ErrMalformed, err, "version: %d, topic: %v", version, topic)
+		}
+	}
+}
+
+func TestReadSubscribePacket_invalidOptions_V5(t *testing.T) {
+	a := assert.New(t)
+	var tt = []struct {
+		topic  string
+		option byte
+		err    error
+	}{
+		// nl = 1, qos = 1
+		{topic: "$share/group/topic", option: 0x05, err: codes.ErrProtocol},
+		// retain Handling = 2, rap = 1, qos = 1
+		{topic: "$share/group/topic", option: 0x29},
+		{topic: "topic", option: 0x05},
+		// retain Handling = 3
+		{topic: "topic", option: 0x30, err: codes.ErrProtocol},
+	}
+	for _, v := range tt {
+		topic, _, _ := EncodeUTF8String([]byte(v.topic))
+		r := NewReader(bytes.NewBuffer(appendPacket(0x82, []byte{0, 10}, []byte{0}, topic, []byte{v.option})))
+		r.SetVersion(Version5)
+		p, err := r.ReadPacket()
+		a.Equal(v.err, err, "topic: %s, option: %x", v.topic, v.option)
+		if v.err == nil {
+			a.Equal(v.topic, p.(*Subscribe).Topics[0].Name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// The errors returned by ValidateTopic and ValidateFilter.
+var (
+	ErrEmptyTopic         = errors.New("topic must be at least one character long")
+	ErrTopicNullCharacter = errors.New("topic must not contain the null character")
+	ErrTopicInvalidUTF8   = errors.New("topic must be well-formed UTF-8")
+	ErrTopicWildcard      = errors.New("topic name must not contain wildcards")
+	ErrMalformedWildcard  = errors.New("wildcard must occupy an entire level and '#' must be the last level")
+	ErrInvalidShareName   = errors.New("share name must not be empty or contain '/', '+' or '#'")
+)
+
+const sharePrefix = "$share/"
+
+// ValidateTopic returns an error if the topic is not a valid topic name of PUBLISH packets.
+// The topic name must be a non-empty well-formed UTF-8 string without the null character and wildcards. [MQTT-4.7.3-1] [MQTT-4.7.3-2]
+func ValidateTopic(topic string) error {
+	if len(topic) == 0 {
+		return ErrEmptyTopic
+	}
+	return validateTopicName(true, []byte(topic))
+}
+
+// ValidateFilter returns an error if the filter is not a valid topic filter of SUBSCRIBE packets.
+// The '+' wildcard must occupy an entire level and the '#' wildcard must be the last level. [MQTT-4.7.1-1] [MQTT-4.7.1-2]
+// Shared subscriptions in the form of "$share/{ShareName}/{filter}" are supported. [MQTT-4.8.2-1] [MQTT-4.8.2-2]
+func ValidateFilter(filter string) error {
+	return validateV5Filter([]byte(filter))
+}
+
+// NormalizeTopic removes the leading and trailing '/' and collapses the repeated '/' of the topic name or topic filter,
+// e.g: "/a//b/" is normalized to "a/b". For shared subscriptions, only the topic filter after the share name is normalized.
+// Note that it changes the meaning of the topic in MQTT, "/a" and "a" are different topics.
+// The topic is returned unchanged if nothing is left after normalization, e.g: "/".
+func NormalizeTopic(topic string) string {
+	prefix := ""
+	if strings.HasPrefix(topic, sharePrefix) {
+		if i := strings.IndexByte(topic[len(sharePrefix):], '/'); i != -1 {
+			prefix = topic[:len(sharePrefix)+i+1]
+		}
+	}
+	levels := strings.Split(topic[len(prefix):], "/")
+	n := 0
+	for _, v := range levels {
+		if v != "" {
+			levels[n] = v
+			n++
+		}
+	}
+	if n == 0 {
+		return topic
+	}
+	return prefix + strings.Join(levels[:n], "/")
+}
+
+// validateUTF8Topic validates the characters of the topic. [MQTT-4.7.3-2]
+func validateUTF8Topic(p []byte) error {
+	for len(p) > 0 {
+		ru, size := utf8.DecodeRune(p)
+		if ru == utf8.RuneError && size <= 1 {
+			return ErrTopicInvalidUTF8
+		}
+		if ru == '\u0000' {
+			return ErrTopicNullCharacter
+		}
+		p = p[size:]
+	}
+	return nil
+}
+
+// validateTopicName validates the topic name. The empty topic name is allowed here,
+// it is checked by the caller as it is valid in PUBLISH packets with the topic alias.
+func validateTopicName(mustUTF8 bool, p []byte) error {
+	if mustUTF8 {
+		if err := validateUTF8Topic(p); err != nil {
+			return err
+		}
+	}
+	if bytes.IndexByte(p, '+') != -1 || bytes.IndexByte(p, '#') != -1 {
+		return ErrTopicWildcard
+	}
+	return nil
+}
+
+// validateTopicFilter validates the non-shared topic filter level by level.
+func validateTopicFilter(mustUTF8 bool, p []byte) error {
+	if len(p) == 0 {
+		return ErrEmptyTopic
+	}
+	if mustUTF8 {
+		if err := validateUTF8Topic(p); err != nil {
+			return err
+		}
+	}
+	for {
+		level := p
+		i := bytes.IndexByte(p, '/')
+		if i != -1 {
+			level = p[:i]
+		}
+		if bytes.IndexByte(level, '+') != -1 && len(level) != 1 {
+			return ErrMalformedWildcard
+		}
+		if bytes.IndexByte(level, '#') != -1 && (len(level) != 1 || i != -1) {
+			return ErrMalformedWildcard
+		}
+		if i == -1 {
+			return nil
+		}
+		p = p[i+1:]
+	}
+}
+
+// validateV5Filter validates the topic filter which can be a shared subscription.
+func validateV5Filter(p []byte) error {
+	if !bytes.HasPrefix(p, []byte(sharePrefix)) {
+		return validateTopicFilter(true, p)
+	}
+	p = p[len(sharePrefix):]
+	i := bytes.IndexByte(p, '/')
+	if i <= 0 {
+		return ErrInvalidShareName
+	}
+	if err := validateTopicName(true, p[:i]); err != nil {
+		if err == ErrTopicWildcard {
+			return ErrInvalidShareName
+		}
+		return err
+	}
+	return validateTopicFilter(true, p[i+1:])
+}
@@ -0,0 +1,78 @@
+package packets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTopic(t *testing.T) {
+	var tt = []struct {
+		topic string
+		err   error
+	}{
+		{topic: "a/b", err: nil},
+		{topic: "/a//b/", err: nil},
+		{topic: "$share/a/b", err: nil},
+		{topic: "", err: ErrEmptyTopic},
+		{topic: "a/\x00/b", err: ErrTopicNullCharacter},
+		{topic: "a/\xc0\xaf", err: ErrTopicInvalidUTF8},
+		{topic: "a/+", err: ErrTopicWildcard},
+		{topic: "a/#", err: ErrTopicWildcard},
+		{topic: "a+b", err: ErrTopicWildcard},
+	}
+	for _, v := range tt {
+		assert.Equal(t, v.err, ValidateTopic(v.topic), v.topic)
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	var tt = []struct {
+		filter string
+		err    error
+	}{
+		{filter: "a/b", err: nil},
+		{filter: "+", err: nil},
+		{filter: "#", err: nil},
+		{filter: "+/+/#", err: nil},
+		{filter: "//", err: nil},
+		{filter: "$share/g/a/+", err: nil},
+		{filter: "$share/g/#", err: nil},
+		{filter: "", err: ErrEmptyTopic},
+		{filter: "a/\x00", err: ErrTopicNullCharacter},
+		{filter: "a/\xff", err: ErrTopicInvalidUTF8},
+		{filter: "+x", err: ErrMalformedWildcard},
+		{filter: "a/b+", err: ErrMalformedWildcard},
+		{filter: "a/#/b", err: ErrMalformedWildcard},
+		{filter: "a#", err: ErrMalformedWildcard},
+		{filter: "#/", err: ErrMalformedWildcard},
+		{filter: "$share/g", err: ErrInvalidShareName},
+		{filter: "$share//a", err: ErrInvalidShareName},
+		{filter: "$share/+/a", err: ErrInvalidShareName},
+		{filter: "$share/g\x00/a", err: ErrTopicNullCharacter},
+		{filter: "$share/g/", err: ErrEmptyTopic},
+		{filter: "$share/g/a/#/b", err: ErrMalformedWildcard},
+	}
+	for _, v := range tt {
+		assert.Equal(t, v.err, ValidateFilter(v.filter), v.filter)
+	}
+}
+
+func TestNormalizeTopic(t *testing.T) {
+	var tt = []struct {
+		topic    string
+		expected string
+	}{
+		{topic: "a/b", expected: "a/b"},
+		{topic: "/a//b/", expected: "a/b"},
+		{topic: "a///+//#", expected: "a/+/#"},
+		{topic: "/", expected: "/"},
+		{topic: "//", expected: "//"},
+		{topic: "$share/g//a//b/", expected: "$share/g/a/b"},
+		{topic: "$share/g/", expected: "$share/g/"},
+		{topic: "$SYS//broker", expected: "$SYS/broker"},
+	}
+	for _, v := range tt {
+		assert.Equal(t, v.expected, NormalizeTopic(v.topic), v.topic)
+	}
+}
@@ -56,7 +56,7 @@ func (p *Unsuback) Unpack(r io.Reader) error {
 	}
 
 	p.Properties = &Properties{}
-	err = p.Properties.Unpack(bufr, UNSUBACK)
+	err = p.Properties.unpack(bufr, UNSUBACK, p.FixHeader.lenient)
 	if err != nil {
 		return err
 	}
@@ -80,7 +80,7 @@ func (u *Unsubscribe) Unpack(r io.Reader) error {
 
 	if u.Version == Version5 {
 		u.Properties = &Properties{}
-		if err := u.Properties.Unpack(bufr, UNSUBSCRIBE); err != nil {
+		if err := u.Properties.unpack(bufr, UNSUBSCRIBE, u.FixHeader.lenient); err != nil {
 			return err
 		}
 	}
@@ -7,6 +7,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
 )
 
 func TestReadWriteUnsubscribe_V5(t *testing.T) {
@@ -103,3 +105,20 @@ func TestReadWriteUnsubscribe_V311(t *testing.T) {
 	})
 
 }
+
+func TestReadUnsubscribePacket_malformedUTF8Topic(t *testing.T) {
+	a := assert.New(t)
+	for _, version := range []Version{Version311, Version5} {
+		for _, topic := range malformedUTF8Topics {
+			b := [][]byte{{0, 10}}
+			if version == Version5 {
+				b = append(b, []byte{0})
+			}
+			b = append(b, rawUTF8String(topic))
+			r := NewReader(bytes.NewBuffer(appendPacket(0xa2, b...)))
+			r.SetVersion(version)
+			_, err := r.ReadPacket()
+			a.Equal(codes.ErrMalformed, err, "version: %d, topic: %v", version, topic)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Package statsd provides the server.MetricSink which pushes the metrics to a StatsD server over UDP.
+package statsd
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sink sends each metric in a UDP datagram in the StatsD line format, e.g: "gmqtt.messages.sent:1|c".
+// The tags are appended in the DogStatsD format, e.g: "gmqtt.messages.dropped:1|c|#qos:1,reason:queue_full".
+// The write errors are ignored, as the metrics are best effort.
+type Sink struct {
+	conn   net.Conn
+	prefix string
+	buf    []byte
+}
+
+// New returns the Sink which sends the metrics to the StatsD server at addr.
+// The prefix is prepended to the metric names with a dot, empty prefix means no prefix.
+func New(addr string, prefix string) (*Sink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &Sink{
+		conn:   conn,
+		prefix: prefix,
+	}, nil
+}
+
+// RecordCounter implements server.MetricSink.
+func (s *Sink) RecordCounter(name string, delta int64, tags map[string]string) {
+	s.send(name, strconv.FormatInt(delta, 10), "c", tags)
+}
+
+// RecordGauge implements server.MetricSink.
+func (s *Sink) RecordGauge(name string, value float64, tags map[string]string) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+// RecordTiming implements server.MetricSink, the duration is sent in milliseconds.
+func (s *Sink) RecordTiming(name string, d time.Duration, tags map[string]string) {
+	s.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+// Close closes the UDP connection.
+func (s *Sink) Close() error {
+	return s.conn.Close()
+}
+
+// send is not safe for concurrent use, which is fine because the server calls the sink in a single goroutine.
+func (s *Sink) send(name, value, typ string, tags map[string]string) {
+	b := append(s.buf[:0], s.prefix...)
+	b = append(b, name...)
+	b = append(b, ':')
+	b = append(b, value...)
+	b = append(b, '|')
+	b = append(b, typ...)
+	if len(tags) != 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = append(b, "|#"...)
+		for i, k := range keys {
+			if i != 0 {
+				b = append(b, ',')
+			}
+			b = append(b, k...)
+			b = append(b, ':')
+			b = append(b, tags[k]...)
+		}
+	}
+	s.buf = b
+	_, _ = s.conn.Write(b)
+}
@@ -0,0 +1,43 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+var _ server.MetricSink = (*Sink)(nil)
+
+func TestSink(t *testing.T) {
+	a := assert.New(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !a.Nil(err) {
+		return
+	}
+	defer pc.Close()
+	s, err := New(pc.LocalAddr().String(), "gmqtt")
+	if !a.Nil(err) {
+		return
+	}
+	defer s.Close()
+
+	s.RecordCounter("messages.dropped", 1, map[string]string{"reason": "queue_full", "qos": "1"})
+	s.RecordGauge("sessions.active", 10, nil)
+	s.RecordTiming("messages.delivery_latency", 1500*time.Microsecond, nil)
+
+	buf := make([]byte, 1024)
+	for _, expected := range []string{
+		"gmqtt.messages.dropped:1|c|#qos:1,reason:queue_full",
+		"gmqtt.sessions.active:10|g",
+		"gmqtt.messages.delivery_latency:1.5|ms",
+	} {
+		_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		a.Nil(err)
+		a.Equal(expected, string(buf[:n]))
+	}
+}
@@ -1,6 +1,8 @@
 package admin
 
 import (
+	"context"
+
 	"go.uber.org/zap"
 
 	"github.com/DrmagicE/gmqtt/config"
@@ -19,6 +21,27 @@ func New(config config.Config) (server.Plugin, error) {
 	return &Admin{}, nil
 }
 
+// Options is the option of the admin plugin.
+type Options func(a *Admin)
+
+// WithIndexKeyFunc sets the KeyFunc for the client and subscription indexes.
+// By default, the indexes are keyed by the full client id, use HashKeyFunc to bound the key size when client ids are long.
+func WithIndexKeyFunc(fn KeyFunc) Options {
+	return func(a *Admin) {
+		a.indexKeyFunc = fn
+	}
+}
+
+// NewAdmin returns the admin plugin with the given options.
+// It can be passed to server.WithPlugin to use the admin plugin with a customized setting.
+func NewAdmin(opts ...Options) *Admin {
+	a := &Admin{}
+	for _, fn := range opts {
+		fn(a)
+	}
+	return a
+}
+
 var log *zap.Logger
 
 // Admin providers gRPC and HTTP API that enables the external system to interact with the broker.
@@ -26,7 +49,34 @@ type Admin struct {
 	statsReader   server.StatsReader
 	publisher     server.Publisher
 	clientService server.ClientService
+	// retainedService is the retained store of the broker.
+	retainedService server.RetainedService
+	scheduleService server.ScheduleService
+	// messageTracer is nil if config.MessageTrace is disabled.
+	messageTracer server.MessageTracer
 	store         *store
+	// events fans out the client and subscription events to the EventService subscribers.
+	events *eventHub
+	// lifecycleState returns the lifecycle state of the broker.
+	lifecycleState func() server.LifecycleState
+	// checkAccess runs the auth hooks of the broker in dry-run mode.
+	checkAccess func(ctx context.Context, req *server.AccessRequest) (*server.AccessDecision, error)
+	// resolveSubscribers returns the subscriptions which match the topic name in dry-run mode.
+	resolveSubscribers func(req *server.ResolveRequest) []server.ResolvedSubscriber
+	// listListeners returns the statistics of the listeners of the broker.
+	listListeners func() []server.ListenerStats
+	// drain drains the broker.
+	drain func(ctx context.Context) error
+	// persistenceHealth returns the health state of the persistence backend.
+	persistenceHealth func() server.PersistenceHealth
+	// reloadConfig reloads the config of the broker.
+	reloadConfig func() (*server.ReloadResult, error)
+	// getConfig returns the current config of the broker.
+	getConfig func() config.Config
+	// listSessions lists the sessions of the broker, see server.SessionIterator.
+	listSessions func(opts server.ListSessionsOptions) ([]*server.SessionInfo, int, error)
+	// indexKeyFunc is the KeyFunc for the client and subscription indexes, nil means keyed by the full id.
+	indexKeyFunc KeyFunc
 }
 
 func (a *Admin) registerHTTP(g server.APIRegistrar) (err error) {
@@ -42,6 +92,26 @@ func (a *Admin) registerHTTP(g server.APIRegistrar) (err error) {
 	if err != nil {
 		return err
 	}
+	err = g.RegisterHTTPHandler(RegisterBrokerServiceHandlerFromEndpoint)
+	if err != nil {
+		return err
+	}
+	err = g.RegisterHTTPHandler(RegisterRetainedServiceHandlerFromEndpoint)
+	if err != nil {
+		return err
+	}
+	err = g.RegisterHTTPHandler(RegisterEventServiceHandlerFromEndpoint)
+	if err != nil {
+		return err
+	}
+	err = g.RegisterHTTPHandler(RegisterStatsServiceHandlerFromEndpoint)
+	if err != nil {
+		return err
+	}
+	err = g.RegisterHTTPHandler(RegisterConfigServiceHandlerFromEndpoint)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -51,15 +121,34 @@ func (a *Admin) Load(service server.Server) error {
 	RegisterClientServiceServer(apiRegistrar, &clientService{a: a})
 	RegisterSubscriptionServiceServer(apiRegistrar, &subscriptionService{a: a})
 	RegisterPublishServiceServer(apiRegistrar, &publisher{a: a})
+	RegisterBrokerServiceServer(apiRegistrar, &brokerService{a: a})
+	RegisterRetainedServiceServer(apiRegistrar, &retainedService{a: a})
+	RegisterEventServiceServer(apiRegistrar, &eventService{a: a})
+	RegisterStatsServiceServer(apiRegistrar, &statsService{a: a})
+	RegisterConfigServiceServer(apiRegistrar, &configService{a: a})
 	err := a.registerHTTP(apiRegistrar)
 	if err != nil {
 		return err
 	}
 	a.statsReader = service.StatsManager()
-	a.store = newStore(a.statsReader, service.GetConfig())
+	a.store = newStore(a.statsReader, service.GetConfig(), a.indexKeyFunc)
 	a.store.subscriptionService = service.SubscriptionService()
+	a.store.clock = service.Clock()
+	a.events = newEventHub()
 	a.publisher = service.Publisher()
+	a.retainedService = service.RetainedService()
+	a.scheduleService = service.ScheduleService()
+	a.messageTracer = service.MessageTracer()
 	a.clientService = service.ClientService()
+	a.lifecycleState = service.LifecycleState
+	a.checkAccess = service.CheckAccess
+	a.resolveSubscribers = service.ResolveSubscribers
+	a.listListeners = service.ListListeners
+	a.drain = service.Drain
+	a.persistenceHealth = service.PersistenceHealth
+	a.reloadConfig = service.ReloadConfig
+	a.getConfig = service.GetConfig
+	a.listSessions = service.SessionIterator().ListSessions
 	return nil
 }
 
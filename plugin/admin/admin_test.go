@@ -0,0 +1,127 @@
+package admin
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	_ "github.com/DrmagicE/gmqtt/persistence"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+	_ "github.com/DrmagicE/gmqtt/topicalias/fifo"
+)
+
+// freeAddr returns a free local TCP address.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestAdmin_stop starts the broker with the admin plugin and asserts that stopping it
+// leaks no goroutines and frees the listen addresses.
+func TestAdmin_stop(t *testing.T) {
+	a := assert.New(t)
+	n := runtime.NumGoroutine()
+
+	grpcAddr, httpAddr := freeAddr(t), freeAddr(t)
+	cfg := config.DefaultConfig()
+	cfg.API.GRPC = []*config.Endpoint{{Address: "tcp://" + grpcAddr}}
+	cfg.API.HTTP = []*config.Endpoint{{Address: "tcp://" + httpAddr, Map: "tcp://" + grpcAddr}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	mqttAddr := ln.Addr().String()
+	srv := server.New(
+		server.WithConfig(cfg),
+		server.WithTCPListener(ln),
+		server.WithPlugin(NewAdmin()),
+	)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- srv.Run()
+	}()
+
+	// connect a session.
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", mqttAddr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.Nil(err) {
+		return
+	}
+	defer conn.Close()
+	w := packets.NewWriter(conn)
+	a.Nil(w.WriteAndFlush(&packets.Connect{
+		Version:       packets.Version311,
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: byte(packets.Version311),
+		CleanStart:    true,
+		KeepAlive:     60,
+		ClientID:      []byte("cid"),
+	}))
+	p, err := packets.NewReader(conn).ReadPacket()
+	a.Nil(err)
+	a.IsType(&packets.Connack{}, p)
+
+	// call the API through the HTTP gateway, which dials the gRPC server.
+	httpClient := &http.Client{Transport: &http.Transport{}}
+	status := 0
+	// the gateway may be backing off if it dials before the gRPC server is listening.
+	for i := 0; i < 300 && status != http.StatusOK; i++ {
+		if resp, err := httpClient.Get("http://" + httpAddr + "/v1/listeners"); err == nil {
+			_, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			status = resp.StatusCode
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(http.StatusOK, status)
+	httpClient.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.Nil(srv.Stop(ctx))
+	select {
+	case err := <-runErr:
+		a.Nil(err)
+	case <-time.After(5 * time.Second):
+		a.FailNow("Run does not return after Stop")
+	}
+	a.Equal(server.StateStopped, srv.LifecycleState())
+
+	// the session is closed by the broker.
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	a.NotNil(err)
+	conn.Close()
+
+	// the listen addresses are freed.
+	for _, addr := range []string{grpcAddr, httpAddr, mqttAddr} {
+		l, err := net.Listen("tcp", addr)
+		if a.Nil(err, addr) {
+			l.Close()
+		}
+	}
+
+	// the closing goroutines, e.g: the gRPC connections of the gateway, may not have exited right after Stop returns.
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.LessOrEqual(runtime.NumGoroutine(), n) {
+		buf := make([]byte, 1<<20)
+		t.Log(string(buf[:runtime.Stack(buf, true)]))
+	}
+}
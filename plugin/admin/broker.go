@@ -0,0 +1,180 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+type brokerService struct {
+	a *Admin
+}
+
+func (b *brokerService) mustEmbedUnimplementedBrokerServiceServer() {
+	return
+}
+
+// GetReconnectStorm returns the state of the reconnect storm detector.
+func (b *brokerService) GetReconnectStorm(ctx context.Context, req *empty.Empty) (*GetReconnectStormResponse, error) {
+	sts := b.a.statsReader.GetGlobalStats().ConnectionStats
+	return &GetReconnectStormResponse{
+		Enable:        b.a.store.config.ReconnectStorm.Enable,
+		Mitigating:    sts.ReconnectStormMitigating == 1,
+		RejectedTotal: sts.ReconnectStormRejectedTotal,
+	}, nil
+}
+
+// Health returns the lifecycle state of the broker.
+// An Unavailable error will be returned if the broker has been stopped.
+func (b *brokerService) Health(ctx context.Context, req *empty.Empty) (*HealthResponse, error) {
+	state := b.a.lifecycleState()
+	if state == server.StateStopped {
+		return nil, ErrUnavailable(ReasonBrokerNotReady, state.String())
+	}
+	return &HealthResponse{
+		State: state.String(),
+	}, nil
+}
+
+// Readiness returns the lifecycle state of the broker.
+// An Unavailable error will be returned if the broker is not ready to serve.
+func (b *brokerService) Readiness(ctx context.Context, req *empty.Empty) (*HealthResponse, error) {
+	state := b.a.lifecycleState()
+	if state != server.StateReady {
+		return nil, ErrUnavailable(ReasonBrokerNotReady, state.String())
+	}
+	return &HealthResponse{
+		State: state.String(),
+	}, nil
+}
+
+// CheckAccess runs the auth hooks of the broker in dry-run mode and returns the decision.
+func (b *brokerService) CheckAccess(ctx context.Context, req *CheckAccessRequest) (*CheckAccessResponse, error) {
+	accessReq := &server.AccessRequest{
+		ClientID: req.ClientId,
+		Username: req.Username,
+		Password: req.Password,
+		Version:  packets.Version(req.Version),
+		Topic:    req.Topic,
+		QoS:      packets.QoS(req.Qos),
+	}
+	switch req.Action {
+	case AccessAction_ACCESS_ACTION_CONNECT:
+		accessReq.Action = server.AccessConnect
+	case AccessAction_ACCESS_ACTION_SUBSCRIBE:
+		if !packets.ValidV5Topic([]byte(req.Topic)) {
+			return nil, ErrInvalidArgument("topic", "")
+		}
+		accessReq.Action = server.AccessSubscribe
+	case AccessAction_ACCESS_ACTION_PUBLISH:
+		if !packets.ValidTopicName(false, []byte(req.Topic)) {
+			return nil, ErrInvalidArgument("topic", "")
+		}
+		accessReq.Action = server.AccessPublish
+	default:
+		return nil, ErrInvalidArgument("action", "")
+	}
+	if req.Qos > uint32(packets.Qos2) {
+		return nil, ErrInvalidArgument("qos", "")
+	}
+	if v := packets.Version(req.Version); v != 0 && v != packets.Version31 && v != packets.Version311 && v != packets.Version5 {
+		return nil, ErrInvalidArgument("version", "")
+	}
+	decision, err := b.a.checkAccess(ctx, accessReq)
+	if err != nil {
+		return nil, err
+	}
+	return &CheckAccessResponse{
+		Allowed:   decision.Allowed,
+		Code:      uint32(decision.Code),
+		Reason:    decision.Reason,
+		Rule:      decision.Rule,
+		Connected: decision.Connected,
+	}, nil
+}
+
+// SnapshotStats returns the lifetime and interval counters of the broker, and resets the interval counters if required.
+func (b *brokerService) SnapshotStats(ctx context.Context, req *SnapshotStatsRequest) (*SnapshotStatsResponse, error) {
+	resetter, ok := b.a.statsReader.(server.StatsResetter)
+	if !ok {
+		return nil, ErrUnimplemented("the stats reader does not support snapshot")
+	}
+	// validate before reset
+	names := statsCounters(server.GlobalStats{})
+	for k, v := range req.Counters {
+		if _, ok := names[v]; !ok {
+			return nil, ErrInvalidArgument(fmt.Sprintf("counters[%d]", k), "unknown counter: "+v)
+		}
+	}
+	snapshot := resetter.SnapshotStats(req.ResetInterval)
+	return &SnapshotStatsResponse{
+		Lifetime:      selectCounters(statsCounters(snapshot.Lifetime), req.Counters),
+		Interval:      selectCounters(statsCounters(snapshot.Interval), req.Counters),
+		Gauges:        statsGauges(snapshot.Lifetime),
+		IntervalStart: timestamppb.New(snapshot.IntervalStart),
+	}, nil
+}
+
+// ListListeners returns the active listeners and their statistics.
+func (b *brokerService) ListListeners(ctx context.Context, req *empty.Empty) (*ListListenersResponse, error) {
+	resp := &ListListenersResponse{}
+	for _, v := range b.a.listListeners() {
+		resp.Listeners = append(resp.Listeners, &Listener{
+			Address:            v.Address,
+			Type:               v.Type,
+			Tls:                v.TLS,
+			ConnectionsCurrent: v.ConnectionsCurrent,
+			AcceptErrorsTotal:  v.AcceptErrorsTotal,
+		})
+	}
+	return resp, nil
+}
+
+// Drain drains the broker, see server.Server.Drain.
+// Drained is false if the timeout is reached before all connected clients are drained.
+func (b *brokerService) Drain(ctx context.Context, req *DrainRequest) (*DrainResponse, error) {
+	if req.Timeout != nil {
+		if err := req.Timeout.CheckValid(); err != nil || req.Timeout.AsDuration() < 0 {
+			return nil, ErrInvalidArgument("timeout", "")
+		}
+		if d := req.Timeout.AsDuration(); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+	}
+	err := b.a.drain(ctx)
+	return &DrainResponse{
+		Drained: err == nil,
+	}, nil
+}
+
+// Healthz returns the lifecycle state of the broker and the health state of the persistence backend.
+// An Unavailable error will be returned if the broker has been stopped.
+// The persistence health is reported in the response rather than as an error, so that the last error can be read.
+func (b *brokerService) Healthz(ctx context.Context, req *empty.Empty) (*HealthzResponse, error) {
+	state := b.a.lifecycleState()
+	if state == server.StateStopped {
+		return nil, ErrUnavailable(ReasonBrokerNotReady, state.String())
+	}
+	ph := b.a.persistenceHealth()
+	resp := &HealthzResponse{
+		State:                          state.String(),
+		PersistenceCheckEnabled:        ph.Enabled,
+		PersistenceHealthy:             ph.Healthy,
+		PersistenceConsecutiveFailures: uint32(ph.ConsecutiveFailures),
+		PersistenceLastError:           ph.LastError,
+	}
+	if !ph.LastCheck.IsZero() {
+		resp.PersistenceLastCheck = timestamppb.New(ph.LastCheck)
+	}
+	if !ph.LastErrorTime.IsZero() {
+		resp.PersistenceLastErrorTime = timestamppb.New(ph.LastErrorTime)
+	}
+	return resp, nil
+}
@@ -0,0 +1,338 @@
+package admin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+func TestBrokerService_GetReconnectStorm(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := server.NewMockStatsReader(ctrl)
+	cfg := config.DefaultConfig()
+	cfg.ReconnectStorm.Enable = true
+	admin := &Admin{
+		statsReader: sr,
+		store:       newStore(sr, cfg, nil),
+	}
+	b := &brokerService{a: admin}
+
+	sts := server.GlobalStats{}
+	sts.ConnectionStats.ReconnectStormMitigating = 1
+	sts.ConnectionStats.ReconnectStormRejectedTotal = 10
+	sr.EXPECT().GetGlobalStats().Return(sts)
+
+	resp, err := b.GetReconnectStorm(context.Background(), &empty.Empty{})
+	a.Nil(err)
+	a.Equal(&GetReconnectStormResponse{
+		Enable:        true,
+		Mitigating:    true,
+		RejectedTotal: 10,
+	}, resp)
+}
+
+func TestBrokerService_Health_Readiness(t *testing.T) {
+	var tt = []struct {
+		state   server.LifecycleState
+		healthy bool
+		ready   bool
+	}{
+		{state: server.StateStarting, healthy: true, ready: false},
+		{state: server.StateRestoring, healthy: true, ready: false},
+		{state: server.StateReady, healthy: true, ready: true},
+		{state: server.StateDraining, healthy: true, ready: false},
+		{state: server.StateStopped, healthy: false, ready: false},
+	}
+	for _, v := range tt {
+		t.Run(v.state.String(), func(t *testing.T) {
+			a := assert.New(t)
+			b := &brokerService{a: &Admin{
+				lifecycleState: func() server.LifecycleState {
+					return v.state
+				},
+			}}
+			resp, err := b.Health(context.Background(), &empty.Empty{})
+			if v.healthy {
+				a.Nil(err)
+				a.Equal(v.state.String(), resp.State)
+			} else {
+				a.Equal(codes.Unavailable, status.Code(err))
+			}
+			resp, err = b.Readiness(context.Background(), &empty.Empty{})
+			if v.ready {
+				a.Nil(err)
+				a.Equal(v.state.String(), resp.State)
+			} else {
+				a.Equal(codes.Unavailable, status.Code(err))
+			}
+		})
+	}
+}
+
+func TestBrokerService_CheckAccess(t *testing.T) {
+	a := assert.New(t)
+	var got *server.AccessRequest
+	b := &brokerService{a: &Admin{
+		checkAccess: func(ctx context.Context, req *server.AccessRequest) (*server.AccessDecision, error) {
+			got = req
+			return &server.AccessDecision{
+				Code:      0x87,
+				Reason:    "denied",
+				Rule:      "rule",
+				Connected: true,
+			}, nil
+		},
+	}}
+	resp, err := b.CheckAccess(context.Background(), &CheckAccessRequest{
+		ClientId: "cid",
+		Username: "user",
+		Topic:    "a/+",
+		Action:   AccessAction_ACCESS_ACTION_SUBSCRIBE,
+		Qos:      1,
+		Version:  4,
+	})
+	a.Nil(err)
+	a.Equal(&server.AccessRequest{
+		ClientID: "cid",
+		Username: "user",
+		Version:  4,
+		Action:   server.AccessSubscribe,
+		Topic:    "a/+",
+		QoS:      1,
+	}, got)
+	a.Equal(&CheckAccessResponse{
+		Code:      0x87,
+		Reason:    "denied",
+		Rule:      "rule",
+		Connected: true,
+	}, resp)
+}
+
+func TestBrokerService_CheckAccess_InvalidArgument(t *testing.T) {
+	var tt = []struct {
+		name  string
+		field string
+		req   *CheckAccessRequest
+	}{
+		{
+			name:  "unspecified_action",
+			field: "action",
+			req:   &CheckAccessRequest{ClientId: "cid"},
+		},
+		{
+			name:  "invalid_topic_filter",
+			field: "topic",
+			req:   &CheckAccessRequest{Topic: "a/#/b", Action: AccessAction_ACCESS_ACTION_SUBSCRIBE},
+		},
+		{
+			name:  "invalid_topic_name",
+			field: "topic",
+			req:   &CheckAccessRequest{Topic: "a/+", Action: AccessAction_ACCESS_ACTION_PUBLISH},
+		},
+		{
+			name:  "invalid_qos",
+			field: "qos",
+			req:   &CheckAccessRequest{Topic: "a", Qos: 3, Action: AccessAction_ACCESS_ACTION_PUBLISH},
+		},
+		{
+			name:  "invalid_version",
+			field: "version",
+			req:   &CheckAccessRequest{Version: 6, Action: AccessAction_ACCESS_ACTION_CONNECT},
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			b := &brokerService{a: &Admin{}}
+			_, err := b.CheckAccess(context.Background(), v.req)
+			s, ok := status.FromError(err)
+			a.True(ok)
+			a.Equal(codes.InvalidArgument, s.Code())
+			a.Contains(s.Message(), v.field)
+		})
+	}
+}
+
+type testStatsResetter struct {
+	server.StatsReader
+	snapshot server.StatsSnapshot
+	reset    bool
+}
+
+func (t *testStatsResetter) SnapshotStats(reset bool) server.StatsSnapshot {
+	t.reset = reset
+	return t.snapshot
+}
+
+func TestBrokerService_SnapshotStats(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := &testStatsResetter{StatsReader: server.NewMockStatsReader(ctrl)}
+	sr.snapshot.Lifetime.ConnectionStats.ConnectedTotal = 10
+	sr.snapshot.Lifetime.ConnectionStats.ActiveCurrent = 3
+	sr.snapshot.Lifetime.MessageStats.Qos1.ReceivedTotal = 20
+	sr.snapshot.Interval.ConnectionStats.ConnectedTotal = 2
+	sr.snapshot.Interval.ConnectionStats.ActiveCurrent = 3
+	sr.snapshot.Interval.MessageStats.Qos1.ReceivedTotal = 5
+	sr.snapshot.IntervalStart = time.Unix(0, 0)
+	b := &brokerService{a: &Admin{statsReader: sr}}
+
+	resp, err := b.SnapshotStats(context.Background(), &SnapshotStatsRequest{
+		ResetInterval: true,
+		Counters:      []string{"clients_connected_total", "messages_received_total"},
+	})
+	a.Nil(err)
+	a.True(sr.reset)
+	a.Equal(map[string]uint64{
+		"clients_connected_total": 10,
+		"messages_received_total": 20,
+	}, resp.Lifetime)
+	a.Equal(map[string]uint64{
+		"clients_connected_total": 2,
+		"messages_received_total": 5,
+	}, resp.Interval)
+	a.EqualValues(3, resp.Gauges["sessions_active_current"])
+	a.EqualValues(0, resp.IntervalStart.AsTime().Unix())
+
+	resp, err = b.SnapshotStats(context.Background(), &SnapshotStatsRequest{})
+	a.Nil(err)
+	a.False(sr.reset)
+	a.Len(resp.Lifetime, len(statsCounters(server.GlobalStats{})))
+
+	// unknown counter
+	sr.reset = true
+	_, err = b.SnapshotStats(context.Background(), &SnapshotStatsRequest{
+		ResetInterval: false,
+		Counters:      []string{"unknown"},
+	})
+	s, ok := status.FromError(err)
+	a.True(ok)
+	a.Equal(codes.InvalidArgument, s.Code())
+	// must not reset on invalid argument
+	a.True(sr.reset)
+
+	// not supported
+	b = &brokerService{a: &Admin{statsReader: server.NewMockStatsReader(ctrl)}}
+	_, err = b.SnapshotStats(context.Background(), &SnapshotStatsRequest{})
+	s, ok = status.FromError(err)
+	a.True(ok)
+	a.Equal(codes.Unimplemented, s.Code())
+}
+
+func TestBrokerService_ListListeners(t *testing.T) {
+	a := assert.New(t)
+	b := &brokerService{a: &Admin{
+		listListeners: func() []server.ListenerStats {
+			return []server.ListenerStats{
+				{
+					Address:            "127.0.0.1:1883",
+					Type:               server.ListenerTypeTCP,
+					ConnectionsCurrent: 10,
+					AcceptErrorsTotal:  1,
+				}, {
+					Address:            ":8883",
+					Type:               server.ListenerTypeWebsocketTLS,
+					TLS:                true,
+					ConnectionsCurrent: 2,
+				},
+			}
+		},
+	}}
+	resp, err := b.ListListeners(context.Background(), &empty.Empty{})
+	a.Nil(err)
+	a.Len(resp.Listeners, 2)
+	a.Equal("127.0.0.1:1883", resp.Listeners[0].Address)
+	a.Equal("tcp", resp.Listeners[0].Type)
+	a.False(resp.Listeners[0].Tls)
+	a.EqualValues(10, resp.Listeners[0].ConnectionsCurrent)
+	a.EqualValues(1, resp.Listeners[0].AcceptErrorsTotal)
+	a.Equal("wss", resp.Listeners[1].Type)
+	a.True(resp.Listeners[1].Tls)
+	a.EqualValues(2, resp.Listeners[1].ConnectionsCurrent)
+}
+
+func TestBrokerService_Drain(t *testing.T) {
+	a := assert.New(t)
+	var deadline bool
+	b := &brokerService{a: &Admin{
+		drain: func(ctx context.Context) error {
+			_, deadline = ctx.Deadline()
+			if deadline {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	}}
+	resp, err := b.Drain(context.Background(), &DrainRequest{})
+	a.Nil(err)
+	a.True(resp.Drained)
+	a.False(deadline)
+
+	resp, err = b.Drain(context.Background(), &DrainRequest{Timeout: durationpb.New(time.Millisecond)})
+	a.Nil(err)
+	a.False(resp.Drained)
+	a.True(deadline)
+
+	_, err = b.Drain(context.Background(), &DrainRequest{Timeout: durationpb.New(-time.Second)})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func TestBrokerService_Healthz(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	state := server.StateReady
+	ph := server.PersistenceHealth{
+		Healthy: true,
+	}
+	b := &brokerService{a: &Admin{
+		lifecycleState: func() server.LifecycleState {
+			return state
+		},
+		persistenceHealth: func() server.PersistenceHealth {
+			return ph
+		},
+	}}
+	resp, err := b.Healthz(context.Background(), &empty.Empty{})
+	a.Nil(err)
+	a.Equal(&HealthzResponse{
+		State:              state.String(),
+		PersistenceHealthy: true,
+	}, resp)
+
+	ph = server.PersistenceHealth{
+		Enabled:             true,
+		Healthy:             false,
+		ConsecutiveFailures: 3,
+		LastCheck:           now,
+		LastError:           "connection refused",
+		LastErrorTime:       now,
+	}
+	resp, err = b.Healthz(context.Background(), &empty.Empty{})
+	a.Nil(err)
+	a.True(resp.PersistenceCheckEnabled)
+	a.False(resp.PersistenceHealthy)
+	a.EqualValues(3, resp.PersistenceConsecutiveFailures)
+	a.Equal("connection refused", resp.PersistenceLastError)
+	a.True(now.Equal(resp.PersistenceLastCheck.AsTime()))
+	a.True(now.Equal(resp.PersistenceLastErrorTime.AsTime()))
+
+	state = server.StateStopped
+	_, err = b.Healthz(context.Background(), &empty.Empty{})
+	a.Equal(codes.Unavailable, status.Code(err))
+}
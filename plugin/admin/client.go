@@ -2,8 +2,20 @@ package admin
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"net"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	mqtt_codes "github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
 )
 
 type clientService struct {
@@ -14,17 +26,87 @@ func (c *clientService) mustEmbedUnimplementedClientServiceServer() {
 	return
 }
 
+// clientSortBy maps the sort keys of the client list to the sort keys of server.SessionIterator.
+var clientSortBy = map[ClientSortBy]server.SessionSortBy{
+	ClientSortBy_CLIENT_SORT_BY_UNSPECIFIED:           server.SessionSortByClientID,
+	ClientSortBy_CLIENT_SORT_BY_CONNECTED_AT:          server.SessionSortByConnectedAt,
+	ClientSortBy_CLIENT_SORT_BY_SUBSCRIPTIONS_CURRENT: server.SessionSortBySubscriptionsCurrent,
+	ClientSortBy_CLIENT_SORT_BY_QUEUE_LEN:             server.SessionSortByQueueLen,
+	ClientSortBy_CLIENT_SORT_BY_MESSAGE_DROPPED:       server.SessionSortByMessageDropped,
+}
+
 // List lists clients information which the session is valid in the broker (both connected and disconnected).
+// The sessions are listed by server.SessionIterator, the unsorted list is ordered by the client id.
 func (c *clientService) List(ctx context.Context, req *ListClientRequest) (*ListClientResponse, error) {
+	if req.ConnectedOnly && req.DisconnectedOnly {
+		return nil, ErrInvalidArgument("connected_only", "cannot be set together with disconnected_only")
+	}
+	sortBy, ok := clientSortBy[req.SortBy]
+	if !ok {
+		return nil, ErrInvalidArgument("sort_by", "unknown sort key")
+	}
 	page, pageSize := GetPage(req.Page, req.PageSize)
-	clients, total, err := c.a.store.GetClients(page, pageSize)
+	opts := server.ListSessionsOptions{
+		Page:     page,
+		PageSize: pageSize,
+		Filter: server.SessionFilter{
+			Username:         req.Username,
+			UsernamePrefix:   req.UsernamePrefix,
+			ConnectedOnly:    req.ConnectedOnly,
+			DisconnectedOnly: req.DisconnectedOnly,
+		},
+		SortBy:     sortBy,
+		Descending: req.Descending,
+		Fill:       c.a.store.fillSession,
+	}
+	if req.IdleLongerThan != nil {
+		d := req.IdleLongerThan.AsDuration()
+		if err := req.IdleLongerThan.CheckValid(); err != nil || d < 0 {
+			return nil, ErrInvalidArgument("idle_longer_than", "")
+		}
+		if d > 0 {
+			opts.Filter.IdleBefore = time.Now().Add(-d)
+		}
+	}
+	// the page token is the client id of the last client in the previous page, see server.ListSessionsOptions.After.
+	keyset := req.SortBy == ClientSortBy_CLIENT_SORT_BY_UNSPECIFIED && !req.Descending
+	if req.PageToken != "" {
+		if !keyset {
+			return nil, ErrInvalidArgument("page_token", "cannot be set together with sort_by or descending")
+		}
+		if req.Page > 1 {
+			return nil, ErrInvalidArgument("page", "cannot be set together with page_token")
+		}
+		after, err := decodeKeyPageToken(req.PageToken)
+		if err != nil {
+			return nil, ErrInvalidArgument("page_token", "")
+		}
+		opts.After = after
+		// one more client is listed to tell whether there is a next page.
+		opts.PageSize++
+	}
+	sessions, total, err := c.a.listSessions(opts)
 	if err != nil {
-		return &ListClientResponse{}, err
+		return nil, ErrInternal("list clients", err)
 	}
-	return &ListClientResponse{
-		Clients:    clients,
-		TotalCount: total,
-	}, nil
+	more := (page-1)*pageSize+uint(len(sessions)) < uint(total)
+	if opts.After != "" {
+		more = uint(len(sessions)) > pageSize
+	}
+	if uint(len(sessions)) > pageSize {
+		sessions = sessions[:pageSize]
+	}
+	resp := &ListClientResponse{
+		Clients:    make([]*Client, 0, len(sessions)),
+		TotalCount: uint32(total),
+	}
+	for _, v := range sessions {
+		resp.Clients = append(resp.Clients, c.a.store.newClientFromSession(v))
+	}
+	if keyset && more && len(sessions) != 0 {
+		resp.NextPageToken = encodeKeyPageToken(sessions[len(sessions)-1].ClientID)
+	}
+	return resp, nil
 }
 
 // Get returns the client information for given request client id.
@@ -41,18 +123,471 @@ func (c *clientService) Get(ctx context.Context, req *GetClientRequest) (*GetCli
 	}, nil
 }
 
+// newDisconnect returns the DISCONNECT packet sent to the force disconnected v5 clients.
+func newDisconnect(reasonCode uint32, reasonString string) (*packets.Disconnect, error) {
+	code := mqtt_codes.AdminAction
+	if reasonCode != 0 {
+		// the codes below 0x80 are either success or only sent by the clients.
+		if reasonCode < 0x80 || reasonCode > 0xFF || !packets.ValidateCode(packets.DISCONNECT, byte(reasonCode)) {
+			return nil, ErrInvalidArgument("reason_code", "invalid disconnect reason code")
+		}
+		code = mqtt_codes.Code(reasonCode)
+	}
+	dis := &packets.Disconnect{
+		Version:    packets.Version5,
+		Code:       code,
+		Properties: &packets.Properties{},
+	}
+	if reasonString != "" {
+		dis.Properties.ReasonString = []byte(reasonString)
+	}
+	return dis, nil
+}
+
+// disconnect force disconnects the client, the v5 client receives the DISCONNECT packet before closing.
+// It returns whether the client has been disconnected, it is always true if cleanSession is true.
+func (c *clientService) disconnect(clientID string, cleanSession bool, dis *packets.Disconnect) bool {
+	if cleanSession {
+		c.a.clientService.TerminateSessionWithDisconnect(clientID, dis)
+		return true
+	}
+	client := c.a.clientService.GetClient(clientID)
+	if client == nil {
+		return false
+	}
+	if client.Version() == packets.Version5 {
+		client.Disconnect(dis)
+	} else {
+		client.Close()
+	}
+	return true
+}
+
+// banExpiresAt returns the expiry time of the ban, zero time means no ban is requested.
+func banExpiresAt(d *durationpb.Duration) (time.Time, error) {
+	if d == nil {
+		return time.Time{}, nil
+	}
+	if err := d.CheckValid(); err != nil || d.AsDuration() <= 0 {
+		return time.Time{}, ErrInvalidArgument("ban_duration", "must be positive")
+	}
+	return time.Now().Add(d.AsDuration()), nil
+}
+
+// ban bans the client id, and the remote IP of the client if banIP is true and the client is connected.
+// It must be called before disconnecting the client, so that the client cannot reconnect in between.
+func (c *clientService) ban(clientID string, banIP bool, expiresAt time.Time) error {
+	err := c.a.clientService.Ban(&ban.Ban{Type: ban.TypeClientID, Value: clientID, ExpiresAt: expiresAt})
+	if err != nil {
+		return ErrInternal("ban client", err)
+	}
+	if !banIP {
+		return nil
+	}
+	client := c.a.clientService.GetClient(clientID)
+	if client == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(client.Connection().RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	err = c.a.clientService.Ban(&ban.Ban{Type: ban.TypeIP, Value: host, ExpiresAt: expiresAt})
+	if err != nil {
+		return ErrInternal("ban client", err)
+	}
+	return nil
+}
+
 // Delete force disconnect.
 func (c *clientService) Delete(ctx context.Context, req *DeleteClientRequest) (*empty.Empty, error) {
 	if req.ClientId == "" {
 		return nil, ErrInvalidArgument("client_id", "")
 	}
-	if req.CleanSession {
-		c.a.clientService.TerminateSession(req.ClientId)
-	} else {
-		client := c.a.clientService.GetClient(req.ClientId)
-		if client != nil {
-			client.Close()
+	dis, err := newDisconnect(req.ReasonCode, req.ReasonString)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := banExpiresAt(req.BanDuration)
+	if err != nil {
+		return nil, err
+	}
+	if !expiresAt.IsZero() {
+		if err := c.ban(req.ClientId, req.BanIp, expiresAt); err != nil {
+			return nil, err
 		}
 	}
+	c.disconnect(req.ClientId, req.CleanSession, dis)
 	return &empty.Empty{}, nil
 }
+
+// BatchDelete disconnects the clients for given client ids or filter in the same way as Delete.
+func (c *clientService) BatchDelete(ctx context.Context, req *BatchDeleteRequest) (*BatchDeleteResponse, error) {
+	hasFilter := req.Username != "" || req.ConnectedBefore != nil
+	if len(req.ClientIds) != 0 && hasFilter {
+		return nil, ErrInvalidArgument("client_ids", "cannot be set together with the filter")
+	}
+	if len(req.ClientIds) == 0 && !hasFilter {
+		return nil, ErrInvalidArgument("client_ids", "either client_ids or the filter must be set")
+	}
+	filter := server.SessionFilter{
+		Username:       req.Username,
+		UsernamePrefix: req.UsernamePrefix,
+	}
+	if req.ConnectedBefore != nil {
+		if err := req.ConnectedBefore.CheckValid(); err != nil {
+			return nil, ErrInvalidArgument("connected_before", err.Error())
+		}
+		filter.ConnectedBefore = req.ConnectedBefore.AsTime()
+	}
+	expiresAt, err := banExpiresAt(req.BanDuration)
+	if err != nil {
+		return nil, err
+	}
+	// iterate the snapshot of the matched clients, the clients connected during the iteration are not disconnected.
+	ids := c.a.store.GetClientIDs(req.ClientIds)
+	if hasFilter {
+		sessions, _, err := c.a.listSessions(server.ListSessionsOptions{
+			PageSize: math.MaxInt32,
+			Filter:   filter,
+			Fill:     c.a.store.fillSession,
+		})
+		if err != nil {
+			return nil, ErrInternal("list clients", err)
+		}
+		for _, v := range sessions {
+			ids = append(ids, v.ClientID)
+		}
+	}
+	resp := &BatchDeleteResponse{
+		Matched: uint32(len(ids)),
+	}
+	dis, _ := newDisconnect(0, "")
+	for _, v := range ids {
+		if !expiresAt.IsZero() {
+			if err := c.ban(v, req.BanIp, expiresAt); err != nil {
+				return nil, err
+			}
+		}
+		if c.disconnect(v, req.CleanSession, dis) {
+			resp.Disconnected++
+		}
+	}
+	return resp, nil
+}
+
+// MigrateQueue moves the queued messages of the disconnected session to another session.
+func (c *clientService) MigrateQueue(ctx context.Context, req *MigrateQueueRequest) (*MigrateQueueResponse, error) {
+	if req.FromClientId == "" {
+		return nil, ErrInvalidArgument("from_client_id", "")
+	}
+	if req.ToClientId == "" {
+		return nil, ErrInvalidArgument("to_client_id", "")
+	}
+	if req.FromClientId == req.ToClientId {
+		return nil, ErrInvalidArgument("to_client_id", "cannot be the same as from_client_id")
+	}
+	n, err := c.a.clientService.MigrateQueue(req.FromClientId, req.ToClientId, server.MigrateQueueOptions{
+		IncludeInflight: req.IncludeInflight,
+		Append:          req.Append,
+	})
+	switch err {
+	case nil:
+	case server.ErrSessionNotFound:
+		return nil, ErrNotFound
+	case server.ErrSessionConnected:
+		return nil, ErrFailedPrecondition(ReasonClientConnected, err.Error())
+	case server.ErrQueueNotEmpty:
+		return nil, ErrFailedPrecondition(ReasonQueueNotEmpty, err.Error())
+	case server.ErrMigrateNotSupported:
+		return nil, ErrUnimplemented(err.Error())
+	default:
+		return nil, ErrInternal("migrate queue", err)
+	}
+	return &MigrateQueueResponse{
+		Migrated: uint32(n),
+	}, nil
+}
+
+// GetSubscriptions lists the subscriptions of the client.
+func (c *clientService) GetSubscriptions(ctx context.Context, req *GetClientSubscriptionsRequest) (*GetClientSubscriptionsResponse, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "cannot be empty")
+	}
+	return &GetClientSubscriptionsResponse{
+		Subscriptions: c.a.store.GetClientSubscriptions(req.ClientId),
+	}, nil
+}
+
+// maxPeekQueueLimit is the maximum PeekQueueRequest.Limit.
+const maxPeekQueueLimit = 1000
+
+// PeekQueue lists the queued messages of the client in delivery order without removing them.
+func (c *clientService) PeekQueue(ctx context.Context, req *PeekQueueRequest) (*PeekQueueResponse, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "cannot be empty")
+	}
+	if req.Limit > maxPeekQueueLimit {
+		return nil, ErrInvalidArgument("limit", fmt.Sprintf("must not be greater than %d", maxPeekQueueLimit))
+	}
+	_, limit := GetPage(0, req.Limit)
+	rs := make([]*QueuedMessage, 0)
+	err := c.a.clientService.IterateQueue(req.ClientId, func(elem *queue.Elem) (bool, error) {
+		rs = append(rs, newQueuedMessage(elem))
+		return uint(len(rs)) < limit, nil
+	})
+	switch err {
+	case nil:
+	case server.ErrSessionNotFound:
+		return nil, ErrNotFound
+	case server.ErrIterateNotSupported:
+		return nil, ErrUnimplemented(err.Error())
+	default:
+		return nil, ErrInternal("peek queue", err)
+	}
+	return &PeekQueueResponse{
+		Messages: rs,
+	}, nil
+}
+
+func newQueuedMessage(elem *queue.Elem) *QueuedMessage {
+	m := &QueuedMessage{
+		PacketId: uint32(elem.ID()),
+		QueuedAt: timestamppb.New(elem.At),
+	}
+	if !elem.Expiry.IsZero() {
+		m.Expiry = timestamppb.New(elem.Expiry)
+	}
+	switch v := elem.MessageWithID.(type) {
+	case *queue.Publish:
+		m.TopicName = v.Topic
+		m.Qos = uint32(v.QoS)
+		m.PayloadSize = uint32(len(v.Payload))
+		m.Retained = v.Retained
+	case *queue.Pubrel:
+		m.Pubrel = true
+	}
+	return m
+}
+
+// GetClientInflight lists the inflight messages of the client.
+// The inflight messages are at the head of the queue, so that the iteration stops at the first message which is not inflight.
+func (c *clientService) GetClientInflight(ctx context.Context, req *GetClientInflightRequest) (*GetClientInflightResponse, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "cannot be empty")
+	}
+	now := time.Now()
+	rs := make([]*InflightMessage, 0)
+	err := c.a.clientService.IterateQueue(req.ClientId, func(elem *queue.Elem) (bool, error) {
+		if elem.ID() == 0 {
+			return false, nil
+		}
+		rs = append(rs, newInflightMessage(elem, now))
+		return true, nil
+	})
+	switch err {
+	case nil:
+	case server.ErrSessionNotFound:
+		return nil, ErrNotFound
+	case server.ErrIterateNotSupported:
+		return nil, ErrUnimplemented(err.Error())
+	default:
+		return nil, ErrInternal("get inflight messages", err)
+	}
+	return &GetClientInflightResponse{
+		Messages: rs,
+	}, nil
+}
+
+// VerifyQueue checks the delivery order of the queued messages of the client.
+func (c *clientService) VerifyQueue(ctx context.Context, req *VerifyQueueRequest) (*VerifyQueueResponse, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "cannot be empty")
+	}
+	anomalies, err := c.a.clientService.VerifyQueue(req.ClientId)
+	switch err {
+	case nil:
+	case server.ErrSessionNotFound:
+		return nil, ErrNotFound
+	case server.ErrVerifyNotSupported:
+		return nil, ErrUnimplemented(err.Error())
+	default:
+		return nil, ErrInternal("verify queue", err)
+	}
+	rs := make([]*QueueAnomaly, 0, len(anomalies))
+	for _, v := range anomalies {
+		rs = append(rs, &QueueAnomaly{
+			Type:     string(v.Type),
+			Index:    uint32(v.Index),
+			Seq:      v.Seq,
+			PacketId: uint32(v.PacketID),
+		})
+	}
+	return &VerifyQueueResponse{
+		Anomalies: rs,
+	}, nil
+}
+
+// InvalidateACL removes the cached authorization decisions of the client, or all clients if client_id is empty.
+func (c *clientService) InvalidateACL(ctx context.Context, req *InvalidateACLRequest) (*empty.Empty, error) {
+	c.a.clientService.InvalidateACL(req.ClientId)
+	return &empty.Empty{}, nil
+}
+
+// ExpireSession expires the session of the disconnected client immediately.
+func (c *clientService) ExpireSession(ctx context.Context, req *ExpireSessionRequest) (*empty.Empty, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "cannot be empty")
+	}
+	err := c.a.clientService.ExpireSession(req.ClientId)
+	switch err {
+	case nil:
+	case server.ErrSessionNotFound:
+		return nil, ErrNotFound
+	case server.ErrClientConnected:
+		return nil, ErrFailedPrecondition(ReasonClientConnected, err.Error())
+	default:
+		return nil, ErrInternal("expire session", err)
+	}
+	return &empty.Empty{}, nil
+}
+
+// SetSessionExpiry sets the session expiry interval of the client.
+func (c *clientService) SetSessionExpiry(ctx context.Context, req *SetSessionExpiryRequest) (*empty.Empty, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "cannot be empty")
+	}
+	err := c.a.clientService.SetSessionExpiry(req.ClientId, req.SessionExpiry)
+	switch err {
+	case nil:
+	case server.ErrSessionNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, ErrInternal("set session expiry", err)
+	}
+	c.a.store.setSessionExpiry(req.ClientId, req.SessionExpiry)
+	return &empty.Empty{}, nil
+}
+
+// ListBans lists the temporary bans which have not expired.
+func (c *clientService) ListBans(ctx context.Context, req *ListBansRequest) (*ListBansResponse, error) {
+	bans := c.a.clientService.ListBans()
+	offset, n := GetOffsetN(GetPage(req.Page, req.PageSize))
+	rs := make([]*Ban, 0)
+	for i := offset; i < uint(len(bans)) && uint(len(rs)) < n; i++ {
+		rs = append(rs, &Ban{
+			Type:      string(bans[i].Type),
+			Value:     bans[i].Value,
+			ExpiresAt: timestamppb.New(bans[i].ExpiresAt),
+		})
+	}
+	return &ListBansResponse{
+		Bans:       rs,
+		TotalCount: uint32(len(bans)),
+	}, nil
+}
+
+// ClearBans removes the ban for given type and value, or all bans if the type is empty.
+func (c *clientService) ClearBans(ctx context.Context, req *ClearBansRequest) (*ClearBansResponse, error) {
+	switch ban.Type(req.Type) {
+	case "":
+		if req.Value != "" {
+			return nil, ErrInvalidArgument("value", "cannot be set without type")
+		}
+	case ban.TypeClientID, ban.TypeIP:
+		if req.Value == "" {
+			return nil, ErrInvalidArgument("value", "cannot be empty")
+		}
+	default:
+		return nil, ErrInvalidArgument("type", "unknown ban type")
+	}
+	return &ClearBansResponse{
+		Cleared: uint32(c.a.clientService.ClearBans(ban.Type(req.Type), req.Value)),
+	}, nil
+}
+
+func newInflightMessage(elem *queue.Elem, now time.Time) *InflightMessage {
+	m := &InflightMessage{
+		PacketId:  uint32(elem.ID()),
+		Direction: InflightDirection_INFLIGHT_DIRECTION_OUTBOUND,
+		Since:     timestamppb.New(elem.At),
+		Duration:  durationpb.New(now.Sub(elem.At)),
+	}
+	switch v := elem.MessageWithID.(type) {
+	case *queue.Publish:
+		m.TopicName = v.Topic
+		m.Qos = uint32(v.QoS)
+	case *queue.Pubrel:
+		m.Pubrel = true
+	}
+	return m
+}
+
+// ListByAddr lists the connected clients whose remote IP matches the given IP or CIDR.
+func (c *clientService) ListByAddr(ctx context.Context, req *ListClientByAddrRequest) (*ListClientByAddrResponse, error) {
+	ipNet, err := parseIPOrCIDR(req.IpOrCidr)
+	if err != nil {
+		return nil, ErrInvalidArgument("ip_or_cidr", err.Error())
+	}
+	return &ListClientByAddrResponse{
+		Clients: c.a.store.GetClientsByAddr(ipNet),
+	}, nil
+}
+
+// GetRecentRejections lists the recently rejected CONNECTs, the most recent one first.
+func (c *clientService) GetRecentRejections(ctx context.Context, req *GetRecentRejectionsRequest) (*GetRecentRejectionsResponse, error) {
+	var rejections []server.ConnectRejection
+	for _, v := range c.a.clientService.RecentConnectRejections() {
+		if req.ClientId == "" || v.ClientID == req.ClientId {
+			rejections = append(rejections, v)
+		}
+	}
+	offset, n := GetOffsetN(GetPage(req.Page, req.PageSize))
+	rs := make([]*ConnectRejection, 0)
+	for i := offset; i < uint(len(rejections)) && uint(len(rs)) < n; i++ {
+		v := rejections[i]
+		rs = append(rs, &ConnectRejection{
+			ClientId:   v.ClientID,
+			Username:   v.Username,
+			RemoteAddr: v.RemoteAddr,
+			Version:    int32(v.Version),
+			Code:       uint32(v.Code),
+			Reason:     v.Reason,
+			RejectedAt: timestamppb.New(v.RejectedAt),
+		})
+	}
+	return &GetRecentRejectionsResponse{
+		Rejections: rs,
+		TotalCount: uint32(len(rejections)),
+	}, nil
+}
+
+// TransferSession moves the subscriptions and the queued messages of the disconnected session to another client id.
+func (c *clientService) TransferSession(ctx context.Context, req *TransferSessionRequest) (*TransferSessionResponse, error) {
+	if req.FromClientId == "" {
+		return nil, ErrInvalidArgument("from_client_id", "")
+	}
+	if req.ToClientId == "" {
+		return nil, ErrInvalidArgument("to_client_id", "")
+	}
+	if req.FromClientId == req.ToClientId {
+		return nil, ErrInvalidArgument("to_client_id", "cannot be the same as from_client_id")
+	}
+	rs, err := c.a.clientService.TransferSession(req.FromClientId, req.ToClientId)
+	switch err {
+	case nil:
+	case server.ErrSessionNotFound:
+		return nil, ErrNotFound
+	case server.ErrClientConnected:
+		return nil, ErrFailedPrecondition(ReasonClientConnected, err.Error())
+	case server.ErrMigrateNotSupported:
+		return nil, ErrUnimplemented(err.Error())
+	default:
+		return nil, ErrInternal("transfer session", err)
+	}
+	return &TransferSessionResponse{
+		Subscriptions: uint32(rs.Subscriptions),
+		Messages:      uint32(rs.Messages),
+		Created:       rs.Created,
+	}, nil
+}
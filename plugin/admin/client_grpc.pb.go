@@ -25,6 +25,46 @@ type ClientServiceClient interface {
 	Get(ctx context.Context, in *GetClientRequest, opts ...grpc.CallOption) (*GetClientResponse, error)
 	// Disconnect the client for given client id.
 	Delete(ctx context.Context, in *DeleteClientRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	// Disconnect the clients for given client ids or filter.
+	// At least one of client_ids, username and connected_before must be set.
+	BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchDeleteResponse, error)
+	// Move the queued messages of the disconnected session to another session.
+	MigrateQueue(ctx context.Context, in *MigrateQueueRequest, opts ...grpc.CallOption) (*MigrateQueueResponse, error)
+	// List the connected clients whose remote IP matches the given IP or CIDR.
+	ListByAddr(ctx context.Context, in *ListClientByAddrRequest, opts ...grpc.CallOption) (*ListClientByAddrResponse, error)
+	// List the subscriptions of the client for given client id.
+	// Return empty list if the client has no subscriptions.
+	GetSubscriptions(ctx context.Context, in *GetClientSubscriptionsRequest, opts ...grpc.CallOption) (*GetClientSubscriptionsResponse, error)
+	// PeekQueue lists the queued messages of the client without removing them.
+	PeekQueue(ctx context.Context, in *PeekQueueRequest, opts ...grpc.CallOption) (*PeekQueueResponse, error)
+	// GetClientInflight lists the inflight messages of the client without changing the delivery state.
+	GetClientInflight(ctx context.Context, in *GetClientInflightRequest, opts ...grpc.CallOption) (*GetClientInflightResponse, error)
+	// VerifyQueue checks the delivery order of the queued messages of the client.
+	VerifyQueue(ctx context.Context, in *VerifyQueueRequest, opts ...grpc.CallOption) (*VerifyQueueResponse, error)
+	// InvalidateACL removes the cached authorization decisions, so that the permission changes take effect immediately.
+	InvalidateACL(ctx context.Context, in *InvalidateACLRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	// List the temporary bans which have not expired.
+	ListBans(ctx context.Context, in *ListBansRequest, opts ...grpc.CallOption) (*ListBansResponse, error)
+	// Remove the ban for given type and value, or all bans if type is empty.
+	ClearBans(ctx context.Context, in *ClearBansRequest, opts ...grpc.CallOption) (*ClearBansResponse, error)
+	// Expire the session of the disconnected client immediately, without waiting for the session expiry interval.
+	// The subscriptions, the queued messages and the session are removed as the session expires.
+	// Return FailedPrecondition error when the client is connected, use Delete instead.
+	// Return NotFound error when the session not found.
+	ExpireSession(ctx context.Context, in *ExpireSessionRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	// List the recently rejected CONNECTs with the reasons, to diagnose why a client can not connect.
+	// Only the latest connect_rejection_buffer_size rejections are kept.
+	GetRecentRejections(ctx context.Context, in *GetRecentRejectionsRequest, opts ...grpc.CallOption) (*GetRecentRejectionsResponse, error)
+	// Set the session expiry interval of the client in seconds.
+	// For the disconnected client, the session expires at the disconnect time plus the new interval,
+	// it expires immediately if the time has passed, e.g: the interval is 0.
+	// For the connected client, the new interval is applied when the client disconnects,
+	// unless the client sets the Session Expiry Interval in the DISCONNECT packet.
+	// Return NotFound error when the session not found.
+	SetSessionExpiry(ctx context.Context, in *SetSessionExpiryRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	// Move the subscriptions and the queued messages of the disconnected session to another session,
+	// e.g: when a device is re-provisioned with a new client id.
+	TransferSession(ctx context.Context, in *TransferSessionRequest, opts ...grpc.CallOption) (*TransferSessionResponse, error)
 }
 
 type clientServiceClient struct {
@@ -62,6 +102,132 @@ func (c *clientServiceClient) Delete(ctx context.Context, in *DeleteClientReques
 	return out, nil
 }
 
+func (c *clientServiceClient) BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchDeleteResponse, error) {
+	out := new(BatchDeleteResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/BatchDelete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) MigrateQueue(ctx context.Context, in *MigrateQueueRequest, opts ...grpc.CallOption) (*MigrateQueueResponse, error) {
+	out := new(MigrateQueueResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/MigrateQueue", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) ListByAddr(ctx context.Context, in *ListClientByAddrRequest, opts ...grpc.CallOption) (*ListClientByAddrResponse, error) {
+	out := new(ListClientByAddrResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/ListByAddr", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) GetSubscriptions(ctx context.Context, in *GetClientSubscriptionsRequest, opts ...grpc.CallOption) (*GetClientSubscriptionsResponse, error) {
+	out := new(GetClientSubscriptionsResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/GetSubscriptions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) PeekQueue(ctx context.Context, in *PeekQueueRequest, opts ...grpc.CallOption) (*PeekQueueResponse, error) {
+	out := new(PeekQueueResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/PeekQueue", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) GetClientInflight(ctx context.Context, in *GetClientInflightRequest, opts ...grpc.CallOption) (*GetClientInflightResponse, error) {
+	out := new(GetClientInflightResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/GetClientInflight", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) VerifyQueue(ctx context.Context, in *VerifyQueueRequest, opts ...grpc.CallOption) (*VerifyQueueResponse, error) {
+	out := new(VerifyQueueResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/VerifyQueue", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) InvalidateACL(ctx context.Context, in *InvalidateACLRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/InvalidateACL", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) ListBans(ctx context.Context, in *ListBansRequest, opts ...grpc.CallOption) (*ListBansResponse, error) {
+	out := new(ListBansResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/ListBans", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) ClearBans(ctx context.Context, in *ClearBansRequest, opts ...grpc.CallOption) (*ClearBansResponse, error) {
+	out := new(ClearBansResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/ClearBans", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) ExpireSession(ctx context.Context, in *ExpireSessionRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/ExpireSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) GetRecentRejections(ctx context.Context, in *GetRecentRejectionsRequest, opts ...grpc.CallOption) (*GetRecentRejectionsResponse, error) {
+	out := new(GetRecentRejectionsResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/GetRecentRejections", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) SetSessionExpiry(ctx context.Context, in *SetSessionExpiryRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/SetSessionExpiry", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientServiceClient) TransferSession(ctx context.Context, in *TransferSessionRequest, opts ...grpc.CallOption) (*TransferSessionResponse, error) {
+	out := new(TransferSessionResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.ClientService/TransferSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ClientServiceServer is the server API for ClientService service.
 // All implementations must embed UnimplementedClientServiceServer
 // for forward compatibility
@@ -73,6 +239,46 @@ type ClientServiceServer interface {
 	Get(context.Context, *GetClientRequest) (*GetClientResponse, error)
 	// Disconnect the client for given client id.
 	Delete(context.Context, *DeleteClientRequest) (*empty.Empty, error)
+	// Disconnect the clients for given client ids or filter.
+	// At least one of client_ids, username and connected_before must be set.
+	BatchDelete(context.Context, *BatchDeleteRequest) (*BatchDeleteResponse, error)
+	// Move the queued messages of the disconnected session to another session.
+	MigrateQueue(context.Context, *MigrateQueueRequest) (*MigrateQueueResponse, error)
+	// List the connected clients whose remote IP matches the given IP or CIDR.
+	ListByAddr(context.Context, *ListClientByAddrRequest) (*ListClientByAddrResponse, error)
+	// List the subscriptions of the client for given client id.
+	// Return empty list if the client has no subscriptions.
+	GetSubscriptions(context.Context, *GetClientSubscriptionsRequest) (*GetClientSubscriptionsResponse, error)
+	// PeekQueue lists the queued messages of the client without removing them.
+	PeekQueue(context.Context, *PeekQueueRequest) (*PeekQueueResponse, error)
+	// GetClientInflight lists the inflight messages of the client without changing the delivery state.
+	GetClientInflight(context.Context, *GetClientInflightRequest) (*GetClientInflightResponse, error)
+	// VerifyQueue checks the delivery order of the queued messages of the client.
+	VerifyQueue(context.Context, *VerifyQueueRequest) (*VerifyQueueResponse, error)
+	// InvalidateACL removes the cached authorization decisions, so that the permission changes take effect immediately.
+	InvalidateACL(context.Context, *InvalidateACLRequest) (*empty.Empty, error)
+	// List the temporary bans which have not expired.
+	ListBans(context.Context, *ListBansRequest) (*ListBansResponse, error)
+	// Remove the ban for given type and value, or all bans if type is empty.
+	ClearBans(context.Context, *ClearBansRequest) (*ClearBansResponse, error)
+	// Expire the session of the disconnected client immediately, without waiting for the session expiry interval.
+	// The subscriptions, the queued messages and the session are removed as the session expires.
+	// Return FailedPrecondition error when the client is connected, use Delete instead.
+	// Return NotFound error when the session not found.
+	ExpireSession(context.Context, *ExpireSessionRequest) (*empty.Empty, error)
+	// List the recently rejected CONNECTs with the reasons, to diagnose why a client can not connect.
+	// Only the latest connect_rejection_buffer_size rejections are kept.
+	GetRecentRejections(context.Context, *GetRecentRejectionsRequest) (*GetRecentRejectionsResponse, error)
+	// Set the session expiry interval of the client in seconds.
+	// For the disconnected client, the session expires at the disconnect time plus the new interval,
+	// it expires immediately if the time has passed, e.g: the interval is 0.
+	// For the connected client, the new interval is applied when the client disconnects,
+	// unless the client sets the Session Expiry Interval in the DISCONNECT packet.
+	// Return NotFound error when the session not found.
+	SetSessionExpiry(context.Context, *SetSessionExpiryRequest) (*empty.Empty, error)
+	// Move the subscriptions and the queued messages of the disconnected session to another session,
+	// e.g: when a device is re-provisioned with a new client id.
+	TransferSession(context.Context, *TransferSessionRequest) (*TransferSessionResponse, error)
 	mustEmbedUnimplementedClientServiceServer()
 }
 
@@ -89,6 +295,48 @@ func (UnimplementedClientServiceServer) Get(context.Context, *GetClientRequest)
 func (UnimplementedClientServiceServer) Delete(context.Context, *DeleteClientRequest) (*empty.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
 }
+func (UnimplementedClientServiceServer) BatchDelete(context.Context, *BatchDeleteRequest) (*BatchDeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchDelete not implemented")
+}
+func (UnimplementedClientServiceServer) MigrateQueue(context.Context, *MigrateQueueRequest) (*MigrateQueueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MigrateQueue not implemented")
+}
+func (UnimplementedClientServiceServer) ListByAddr(context.Context, *ListClientByAddrRequest) (*ListClientByAddrResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListByAddr not implemented")
+}
+func (UnimplementedClientServiceServer) GetSubscriptions(context.Context, *GetClientSubscriptionsRequest) (*GetClientSubscriptionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSubscriptions not implemented")
+}
+func (UnimplementedClientServiceServer) PeekQueue(context.Context, *PeekQueueRequest) (*PeekQueueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PeekQueue not implemented")
+}
+func (UnimplementedClientServiceServer) GetClientInflight(context.Context, *GetClientInflightRequest) (*GetClientInflightResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClientInflight not implemented")
+}
+func (UnimplementedClientServiceServer) VerifyQueue(context.Context, *VerifyQueueRequest) (*VerifyQueueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyQueue not implemented")
+}
+func (UnimplementedClientServiceServer) InvalidateACL(context.Context, *InvalidateACLRequest) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InvalidateACL not implemented")
+}
+func (UnimplementedClientServiceServer) ListBans(context.Context, *ListBansRequest) (*ListBansResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBans not implemented")
+}
+func (UnimplementedClientServiceServer) ClearBans(context.Context, *ClearBansRequest) (*ClearBansResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClearBans not implemented")
+}
+func (UnimplementedClientServiceServer) ExpireSession(context.Context, *ExpireSessionRequest) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExpireSession not implemented")
+}
+func (UnimplementedClientServiceServer) GetRecentRejections(context.Context, *GetRecentRejectionsRequest) (*GetRecentRejectionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRecentRejections not implemented")
+}
+func (UnimplementedClientServiceServer) SetSessionExpiry(context.Context, *SetSessionExpiryRequest) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSessionExpiry not implemented")
+}
+func (UnimplementedClientServiceServer) TransferSession(context.Context, *TransferSessionRequest) (*TransferSessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransferSession not implemented")
+}
 func (UnimplementedClientServiceServer) mustEmbedUnimplementedClientServiceServer() {}
 
 // UnsafeClientServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -156,6 +404,258 @@ func _ClientService_Delete_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ClientService_BatchDelete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchDeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).BatchDelete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/BatchDelete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).BatchDelete(ctx, req.(*BatchDeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_MigrateQueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MigrateQueueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).MigrateQueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/MigrateQueue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).MigrateQueue(ctx, req.(*MigrateQueueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_ListByAddr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListClientByAddrRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).ListByAddr(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/ListByAddr",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).ListByAddr(ctx, req.(*ListClientByAddrRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_GetSubscriptions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetClientSubscriptionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).GetSubscriptions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/GetSubscriptions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).GetSubscriptions(ctx, req.(*GetClientSubscriptionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_PeekQueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeekQueueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).PeekQueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/PeekQueue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).PeekQueue(ctx, req.(*PeekQueueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_GetClientInflight_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetClientInflightRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).GetClientInflight(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/GetClientInflight",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).GetClientInflight(ctx, req.(*GetClientInflightRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_VerifyQueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyQueueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).VerifyQueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/VerifyQueue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).VerifyQueue(ctx, req.(*VerifyQueueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_InvalidateACL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InvalidateACLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).InvalidateACL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/InvalidateACL",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).InvalidateACL(ctx, req.(*InvalidateACLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_ListBans_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBansRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).ListBans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/ListBans",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).ListBans(ctx, req.(*ListBansRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_ClearBans_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClearBansRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).ClearBans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/ClearBans",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).ClearBans(ctx, req.(*ClearBansRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_ExpireSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExpireSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).ExpireSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/ExpireSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).ExpireSession(ctx, req.(*ExpireSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_GetRecentRejections_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRecentRejectionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).GetRecentRejections(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/GetRecentRejections",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).GetRecentRejections(ctx, req.(*GetRecentRejectionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_SetSessionExpiry_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetSessionExpiryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).SetSessionExpiry(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/SetSessionExpiry",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).SetSessionExpiry(ctx, req.(*SetSessionExpiryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientService_TransferSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransferSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServiceServer).TransferSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.ClientService/TransferSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServiceServer).TransferSession(ctx, req.(*TransferSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _ClientService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "gmqtt.admin.api.ClientService",
 	HandlerType: (*ClientServiceServer)(nil),
@@ -172,6 +672,62 @@ var _ClientService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Delete",
 			Handler:    _ClientService_Delete_Handler,
 		},
+		{
+			MethodName: "BatchDelete",
+			Handler:    _ClientService_BatchDelete_Handler,
+		},
+		{
+			MethodName: "MigrateQueue",
+			Handler:    _ClientService_MigrateQueue_Handler,
+		},
+		{
+			MethodName: "ListByAddr",
+			Handler:    _ClientService_ListByAddr_Handler,
+		},
+		{
+			MethodName: "GetSubscriptions",
+			Handler:    _ClientService_GetSubscriptions_Handler,
+		},
+		{
+			MethodName: "PeekQueue",
+			Handler:    _ClientService_PeekQueue_Handler,
+		},
+		{
+			MethodName: "GetClientInflight",
+			Handler:    _ClientService_GetClientInflight_Handler,
+		},
+		{
+			MethodName: "VerifyQueue",
+			Handler:    _ClientService_VerifyQueue_Handler,
+		},
+		{
+			MethodName: "InvalidateACL",
+			Handler:    _ClientService_InvalidateACL_Handler,
+		},
+		{
+			MethodName: "ListBans",
+			Handler:    _ClientService_ListBans_Handler,
+		},
+		{
+			MethodName: "ClearBans",
+			Handler:    _ClientService_ClearBans_Handler,
+		},
+		{
+			MethodName: "ExpireSession",
+			Handler:    _ClientService_ExpireSession_Handler,
+		},
+		{
+			MethodName: "GetRecentRejections",
+			Handler:    _ClientService_GetRecentRejections_Handler,
+		},
+		{
+			MethodName: "SetSessionExpiry",
+			Handler:    _ClientService_SetSessionExpiry_Handler,
+		},
+		{
+			MethodName: "TransferSession",
+			Handler:    _ClientService_TransferSession_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "client.proto",
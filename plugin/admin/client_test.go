@@ -2,16 +2,26 @@ package admin
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	mqtt_codes "github.com/DrmagicE/gmqtt/pkg/codes"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/server"
 )
@@ -42,19 +52,15 @@ func TestClientService_List_Get(t *testing.T) {
 	cs := server.NewMockClientService(ctrl)
 	sr := server.NewMockStatsReader(ctrl)
 
-	admin := &Admin{
-		statsReader:   sr,
-		clientService: cs,
-		store:         newStore(sr, mockConfig),
-	}
-	c := &clientService{
-		a: admin,
-	}
+	c, it := newTestAdminClient(sr, cs)
+	admin := c.a
 	now := time.Now()
+	addr := net.TCPAddr{}
 	client := server.NewMockClient(ctrl)
 	client.EXPECT().Version().Return(packets.Version5).AnyTimes()
 	client.EXPECT().Connection().Return(&dummyConn{}).AnyTimes()
 	client.EXPECT().ConnectedAt().Return(now).AnyTimes()
+	client.EXPECT().ConnID().Return("conn").AnyTimes()
 	created := admin.OnSessionCreatedWrapper(func(ctx context.Context, client server.Client) {})
 	for i := 0; i < 10; i++ {
 		sr.EXPECT().GetClientStats(strconv.Itoa(i)).AnyTimes()
@@ -82,6 +88,20 @@ func TestClientService_List_Get(t *testing.T) {
 			SharedSubAvailable:   true,
 		})
 		created(context.Background(), client)
+		it.sessions = append(it.sessions, &server.SessionInfo{
+			ClientID:      strconv.Itoa(i),
+			Connected:     true,
+			Username:      strconv.Itoa(i),
+			ConnID:        "conn",
+			Version:       packets.Version5,
+			KeepAlive:     uint16(i),
+			RemoteAddr:    addr.String(),
+			LocalAddr:     addr.String(),
+			ConnectedAt:   now,
+			SessionExpiry: uint32(i),
+			MaxInflight:   uint16(i),
+			MaxQueue:      mockConfig.MQTT.MaxQueuedMsg,
+		})
 	}
 
 	resp, err := c.List(context.Background(), &ListClientRequest{
@@ -91,9 +111,9 @@ func TestClientService_List_Get(t *testing.T) {
 	a.Nil(err)
 	a.Len(resp.Clients, 10)
 	for k, v := range resp.Clients {
-		addr := net.TCPAddr{}
 		a.Equal(&Client{
 			ClientId:             strconv.Itoa(k),
+			ConnId:               "conn",
 			Username:             strconv.Itoa(k),
 			KeepAlive:            int32(k),
 			Version:              int32(packets.Version5),
@@ -139,12 +159,14 @@ func TestClientService_Delete(t *testing.T) {
 	admin := &Admin{
 		statsReader:   sr,
 		clientService: cs,
-		store:         newStore(sr, mockConfig),
+		store:         newStore(sr, mockConfig, nil),
 	}
 	c := &clientService{
 		a: admin,
 	}
+	// v3 client is closed directly.
 	client := server.NewMockClient(ctrl)
+	client.EXPECT().Version().Return(packets.Version311)
 	client.EXPECT().Close()
 	cs.EXPECT().GetClient("1").Return(client)
 	_, err := c.Delete(context.Background(), &DeleteClientRequest{
@@ -152,6 +174,43 @@ func TestClientService_Delete(t *testing.T) {
 		CleanSession: false,
 	})
 	a.Nil(err)
+
+	// v5 client receives the DISCONNECT packet.
+	v5Client := server.NewMockClient(ctrl)
+	v5Client.EXPECT().Version().Return(packets.Version5).Times(2)
+	cs.EXPECT().GetClient("2").Return(v5Client).Times(2)
+	v5Client.EXPECT().Disconnect(&packets.Disconnect{
+		Version:    packets.Version5,
+		Code:       mqtt_codes.AdminAction,
+		Properties: &packets.Properties{},
+	})
+	_, err = c.Delete(context.Background(), &DeleteClientRequest{
+		ClientId: "2",
+	})
+	a.Nil(err)
+	v5Client.EXPECT().Disconnect(&packets.Disconnect{
+		Version: packets.Version5,
+		Code:    mqtt_codes.ServerBusy,
+		Properties: &packets.Properties{
+			ReasonString: []byte("maintenance"),
+		},
+	})
+	_, err = c.Delete(context.Background(), &DeleteClientRequest{
+		ClientId:     "2",
+		ReasonCode:   uint32(mqtt_codes.ServerBusy),
+		ReasonString: "maintenance",
+	})
+	a.Nil(err)
+
+	for _, v := range []uint32{0x04, 0x01, 0x198} {
+		_, err = c.Delete(context.Background(), &DeleteClientRequest{
+			ClientId:   "2",
+			ReasonCode: v,
+		})
+		s, ok := status.FromError(err)
+		a.True(ok)
+		a.Equal(codes.InvalidArgument, s.Code())
+	}
 }
 
 func TestClientService_Delete_CleanSession(t *testing.T) {
@@ -165,15 +224,1205 @@ func TestClientService_Delete_CleanSession(t *testing.T) {
 	admin := &Admin{
 		statsReader:   sr,
 		clientService: cs,
-		store:         newStore(sr, mockConfig),
+		store:         newStore(sr, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	cs.EXPECT().TerminateSessionWithDisconnect("1", &packets.Disconnect{
+		Version:    packets.Version5,
+		Code:       mqtt_codes.AdminAction,
+		Properties: &packets.Properties{},
+	})
+	_, err := c.Delete(context.Background(), &DeleteClientRequest{
+		ClientId:     "1",
+		CleanSession: true,
+	})
+	a.Nil(err)
+}
+
+func TestClientService_Delete_Ban(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
 	}
 	c := &clientService{
 		a: admin,
 	}
-	cs.EXPECT().TerminateSession("1")
+	client := server.NewMockClient(ctrl)
+	client.EXPECT().Connection().Return(&remoteAddrConn{
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1883},
+	})
+	var bans []*ban.Ban
+	cs.EXPECT().Ban(gomock.Any()).DoAndReturn(func(b *ban.Ban) error {
+		bans = append(bans, b)
+		return nil
+	}).Times(2)
+	gomock.InOrder(
+		cs.EXPECT().GetClient("1").Return(client),
+		cs.EXPECT().TerminateSessionWithDisconnect("1", gomock.Any()),
+	)
+	before := time.Now()
 	_, err := c.Delete(context.Background(), &DeleteClientRequest{
 		ClientId:     "1",
 		CleanSession: true,
+		BanDuration:  durationpb.New(time.Hour),
+		BanIp:        true,
+	})
+	a.Nil(err)
+	if a.Len(bans, 2) {
+		a.Equal(ban.TypeClientID, bans[0].Type)
+		a.Equal("1", bans[0].Value)
+		a.Equal(ban.TypeIP, bans[1].Type)
+		a.Equal("10.0.0.1", bans[1].Value)
+		a.False(bans[0].ExpiresAt.Before(before.Add(time.Hour)))
+		a.Equal(bans[0].ExpiresAt, bans[1].ExpiresAt)
+	}
+
+	// the client is not disconnected if the ban fails.
+	cs.EXPECT().Ban(gomock.Any()).Return(errors.New("error"))
+	_, err = c.Delete(context.Background(), &DeleteClientRequest{
+		ClientId:    "2",
+		BanDuration: durationpb.New(time.Hour),
+	})
+	a.Equal(codes.Internal, status.Code(err))
+
+	for _, v := range []*durationpb.Duration{durationpb.New(0), durationpb.New(-time.Second)} {
+		_, err = c.Delete(context.Background(), &DeleteClientRequest{
+			ClientId:    "1",
+			BanDuration: v,
+		})
+		a.Equal(codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientService_ListBans_ClearBans(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	cs.EXPECT().ListBans().Return([]*ban.Ban{
+		{Type: ban.TypeClientID, Value: "a", ExpiresAt: expiresAt},
+		{Type: ban.TypeClientID, Value: "b", ExpiresAt: expiresAt},
+		{Type: ban.TypeIP, Value: "10.0.0.1", ExpiresAt: expiresAt},
+	})
+	resp, err := c.ListBans(context.Background(), &ListBansRequest{
+		PageSize: 2,
+		Page:     2,
+	})
+	a.Nil(err)
+	a.EqualValues(3, resp.TotalCount)
+	if a.Len(resp.Bans, 1) {
+		a.Equal("ip", resp.Bans[0].Type)
+		a.Equal("10.0.0.1", resp.Bans[0].Value)
+		a.True(expiresAt.Equal(resp.Bans[0].ExpiresAt.AsTime()))
+	}
+
+	cs.EXPECT().ClearBans(ban.TypeIP, "10.0.0.1").Return(1)
+	cr, err := c.ClearBans(context.Background(), &ClearBansRequest{Type: "ip", Value: "10.0.0.1"})
+	a.Nil(err)
+	a.EqualValues(1, cr.Cleared)
+
+	cs.EXPECT().ClearBans(ban.Type(""), "").Return(2)
+	cr, err = c.ClearBans(context.Background(), &ClearBansRequest{})
+	a.Nil(err)
+	a.EqualValues(2, cr.Cleared)
+
+	for _, v := range []*ClearBansRequest{
+		{Value: "a"},
+		{Type: "client_id"},
+		{Type: "unknown", Value: "a"},
+	} {
+		_, err = c.ClearBans(context.Background(), v)
+		a.Equal(codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientService_GetRecentRejections(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	now := time.Now()
+	rejections := []server.ConnectRejection{
+		{ClientID: "a", RemoteAddr: "10.0.0.1:1000", Version: packets.Version5, Code: mqtt_codes.NotAuthorized, Reason: "banned", RejectedAt: now},
+		{ClientID: "b", RemoteAddr: "10.0.0.2:1000", Version: packets.Version311, Code: mqtt_codes.V3BadUsernameorPassword, Reason: "bad user name or password", RejectedAt: now},
+		{ClientID: "a", Username: "u", RemoteAddr: "10.0.0.1:1001", Version: packets.Version5, Code: mqtt_codes.BadUserNameOrPassword, Reason: "bad user name or password", RejectedAt: now.Add(-time.Second)},
+	}
+	cs.EXPECT().RecentConnectRejections().Return(rejections).Times(2)
+
+	resp, err := c.GetRecentRejections(context.Background(), &GetRecentRejectionsRequest{
+		PageSize: 2,
+		Page:     2,
+	})
+	a.Nil(err)
+	a.EqualValues(3, resp.TotalCount)
+	if a.Len(resp.Rejections, 1) {
+		a.Equal("a", resp.Rejections[0].ClientId)
+		a.Equal("u", resp.Rejections[0].Username)
+	}
+
+	resp, err = c.GetRecentRejections(context.Background(), &GetRecentRejectionsRequest{
+		ClientId: "a",
+	})
+	a.Nil(err)
+	a.EqualValues(2, resp.TotalCount)
+	if a.Len(resp.Rejections, 2) {
+		a.Equal(&ConnectRejection{
+			ClientId:   "a",
+			RemoteAddr: "10.0.0.1:1000",
+			Version:    int32(packets.Version5),
+			Code:       uint32(mqtt_codes.NotAuthorized),
+			Reason:     "banned",
+			RejectedAt: timestamppb.New(now),
+		}, resp.Rejections[0])
+		a.Equal("10.0.0.1:1001", resp.Rejections[1].RemoteAddr)
+	}
+}
+
+func TestClientService_BatchDelete(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	c, it := newTestAdminClient(nil, cs)
+	admin := c.a
+	now := time.Now()
+	clients := make(map[string]*server.MockClient)
+	for _, v := range []struct {
+		clientID    string
+		username    string
+		connectedAt time.Time
+	}{
+		{clientID: "1", username: "tenant-a-1", connectedAt: now.Add(-2 * time.Hour)},
+		{clientID: "2", username: "tenant-a-2", connectedAt: now},
+		{clientID: "3", username: "tenant-b", connectedAt: now.Add(-2 * time.Hour)},
+		{clientID: "4", username: "tenant-a-4", connectedAt: now.Add(-2 * time.Hour)},
+	} {
+		client := server.NewMockClient(ctrl)
+		client.EXPECT().Version().Return(packets.Version5).AnyTimes()
+		client.EXPECT().Connection().Return(&dummyConn{}).AnyTimes()
+		client.EXPECT().ConnectedAt().Return(v.connectedAt).AnyTimes()
+		client.EXPECT().ConnID().Return("").AnyTimes()
+		client.EXPECT().ClientOptions().Return(&server.ClientOptions{ClientID: v.clientID, Username: v.username}).AnyTimes()
+		admin.store.addClient(client)
+		clients[v.clientID] = client
+	}
+	admin.store.setClientDisconnected("4", nil)
+	// the filter is applied by the iterator.
+	it.sessions = []*server.SessionInfo{{ClientID: "1", Connected: true}, {ClientID: "4"}}
+
+	// 1 and 4 match, only 1 is connected.
+	clients["1"].EXPECT().Disconnect(gomock.Any())
+	cs.EXPECT().GetClient("1").Return(clients["1"])
+	cs.EXPECT().GetClient("4").Return(nil)
+	resp, err := c.BatchDelete(context.Background(), &BatchDeleteRequest{
+		Username:        "tenant-a",
+		UsernamePrefix:  true,
+		ConnectedBefore: timestamppb.New(now.Add(-time.Hour)),
 	})
 	a.Nil(err)
+	a.EqualValues(2, resp.Matched)
+	a.EqualValues(1, resp.Disconnected)
+	a.Equal("tenant-a", it.opts.Filter.Username)
+	a.True(it.opts.Filter.UsernamePrefix)
+	a.True(now.Add(-time.Hour).Equal(it.opts.Filter.ConnectedBefore))
+
+	// the unknown and duplicated client ids are ignored.
+	cs.EXPECT().TerminateSessionWithDisconnect("2", gomock.Any())
+	cs.EXPECT().TerminateSessionWithDisconnect("3", gomock.Any())
+	resp, err = c.BatchDelete(context.Background(), &BatchDeleteRequest{
+		ClientIds:    []string{"2", "3", "2", "unknown"},
+		CleanSession: true,
+	})
+	a.Nil(err)
+	a.EqualValues(2, resp.Matched)
+	a.EqualValues(2, resp.Disconnected)
+
+	for _, v := range []*BatchDeleteRequest{
+		{},
+		{CleanSession: true},
+		{ClientIds: []string{"1"}, Username: "tenant-a"},
+	} {
+		_, err = c.BatchDelete(context.Background(), v)
+		s, ok := status.FromError(err)
+		a.True(ok)
+		a.Equal(codes.InvalidArgument, s.Code())
+	}
+}
+
+func TestClientService_MigrateQueue(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	cs.EXPECT().MigrateQueue("old", "new", server.MigrateQueueOptions{IncludeInflight: true}).Return(2, nil)
+	resp, err := c.MigrateQueue(context.Background(), &MigrateQueueRequest{
+		FromClientId:    "old",
+		ToClientId:      "new",
+		IncludeInflight: true,
+	})
+	a.Nil(err)
+	a.EqualValues(2, resp.Migrated)
+
+	var tt = []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: server.ErrSessionNotFound, code: codes.NotFound},
+		{err: server.ErrSessionConnected, code: codes.FailedPrecondition},
+		{err: server.ErrQueueNotEmpty, code: codes.FailedPrecondition},
+		{err: server.ErrMigrateNotSupported, code: codes.Unimplemented},
+	}
+	for _, v := range tt {
+		cs.EXPECT().MigrateQueue("old", "new", server.MigrateQueueOptions{}).Return(0, v.err)
+		_, err = c.MigrateQueue(context.Background(), &MigrateQueueRequest{
+			FromClientId: "old",
+			ToClientId:   "new",
+		})
+		a.Equal(v.code, status.Code(err))
+	}
+
+	for _, v := range []*MigrateQueueRequest{
+		{ToClientId: "new"},
+		{FromClientId: "old"},
+		{FromClientId: "old", ToClientId: "old"},
+	} {
+		_, err = c.MigrateQueue(context.Background(), v)
+		a.Equal(codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientService_TransferSession(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	cs.EXPECT().TransferSession("old", "new").Return(server.TransferSessionResult{
+		Subscriptions: 2,
+		Messages:      3,
+		Created:       true,
+	}, nil)
+	resp, err := c.TransferSession(context.Background(), &TransferSessionRequest{
+		FromClientId: "old",
+		ToClientId:   "new",
+	})
+	a.Nil(err)
+	a.EqualValues(2, resp.Subscriptions)
+	a.EqualValues(3, resp.Messages)
+	a.True(resp.Created)
+
+	var tt = []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: server.ErrSessionNotFound, code: codes.NotFound},
+		{err: server.ErrClientConnected, code: codes.FailedPrecondition},
+		{err: server.ErrMigrateNotSupported, code: codes.Unimplemented},
+		{err: errors.New("error"), code: codes.Internal},
+	}
+	for _, v := range tt {
+		cs.EXPECT().TransferSession("old", "new").Return(server.TransferSessionResult{}, v.err)
+		_, err = c.TransferSession(context.Background(), &TransferSessionRequest{
+			FromClientId: "old",
+			ToClientId:   "new",
+		})
+		a.Equal(v.code, status.Code(err))
+	}
+
+	for _, v := range []*TransferSessionRequest{
+		{ToClientId: "new"},
+		{FromClientId: "old"},
+		{FromClientId: "old", ToClientId: "old"},
+	} {
+		_, err = c.TransferSession(context.Background(), v)
+		a.Equal(codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientService_PeekQueue(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	now := time.Unix(100, 0)
+	elems := []*queue.Elem{
+		{At: now, MessageWithID: &queue.Pubrel{PacketID: 1}},
+		{At: now, Expiry: now.Add(time.Hour), MessageWithID: &queue.Publish{
+			Message: &gmqtt.Message{Topic: "a", QoS: packets.Qos1, Payload: []byte("abc"), Retained: true},
+		}},
+		{At: now, MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "b"}}},
+	}
+	cs.EXPECT().IterateQueue("cid", gomock.Any()).DoAndReturn(func(clientID string, fn func(elem *queue.Elem) (bool, error)) error {
+		for _, v := range elems {
+			if cont, err := fn(v); err != nil || !cont {
+				return err
+			}
+		}
+		return nil
+	})
+	resp, err := c.PeekQueue(context.Background(), &PeekQueueRequest{
+		ClientId: "cid",
+		Limit:    2,
+	})
+	a.Nil(err)
+	a.Equal([]*QueuedMessage{
+		{PacketId: 1, Pubrel: true, QueuedAt: timestamppb.New(now)},
+		{TopicName: "a", Qos: 1, PayloadSize: 3, Retained: true, QueuedAt: timestamppb.New(now), Expiry: timestamppb.New(now.Add(time.Hour))},
+	}, resp.Messages)
+
+	var tt = []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: server.ErrSessionNotFound, code: codes.NotFound},
+		{err: server.ErrIterateNotSupported, code: codes.Unimplemented},
+	}
+	for _, v := range tt {
+		cs.EXPECT().IterateQueue("cid", gomock.Any()).Return(v.err)
+		_, err = c.PeekQueue(context.Background(), &PeekQueueRequest{
+			ClientId: "cid",
+		})
+		a.Equal(v.code, status.Code(err))
+	}
+
+	for _, v := range []*PeekQueueRequest{
+		{},
+		{ClientId: "cid", Limit: maxPeekQueueLimit + 1},
+	} {
+		_, err = c.PeekQueue(context.Background(), v)
+		a.Equal(codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientService_VerifyQueue(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	cs.EXPECT().VerifyQueue("cid").Return([]queue.Anomaly{
+		{Type: queue.AnomalyDuplicate, Index: 3, Seq: 5},
+		{Type: queue.AnomalyDuplicatePacketID, Index: 4, Seq: 6, PacketID: 2},
+	}, nil)
+	resp, err := c.VerifyQueue(context.Background(), &VerifyQueueRequest{
+		ClientId: "cid",
+	})
+	a.Nil(err)
+	a.Equal([]*QueueAnomaly{
+		{Type: "duplicate", Index: 3, Seq: 5},
+		{Type: "duplicate_packet_id", Index: 4, Seq: 6, PacketId: 2},
+	}, resp.Anomalies)
+
+	var tt = []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: server.ErrSessionNotFound, code: codes.NotFound},
+		{err: server.ErrVerifyNotSupported, code: codes.Unimplemented},
+		{err: errors.New("error"), code: codes.Internal},
+	}
+	for _, v := range tt {
+		cs.EXPECT().VerifyQueue("cid").Return(nil, v.err)
+		_, err = c.VerifyQueue(context.Background(), &VerifyQueueRequest{
+			ClientId: "cid",
+		})
+		a.Equal(v.code, status.Code(err))
+	}
+
+	_, err = c.VerifyQueue(context.Background(), &VerifyQueueRequest{})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientService_InvalidateACL(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	cs.EXPECT().InvalidateACL("cid")
+	_, err := c.InvalidateACL(context.Background(), &InvalidateACLRequest{ClientId: "cid"})
+	a.Nil(err)
+
+	cs.EXPECT().InvalidateACL("")
+	_, err = c.InvalidateACL(context.Background(), &InvalidateACLRequest{})
+	a.Nil(err)
+}
+
+func TestClientService_ExpireSession(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	cs.EXPECT().ExpireSession("cid").Return(nil)
+	_, err := c.ExpireSession(context.Background(), &ExpireSessionRequest{ClientId: "cid"})
+	a.Nil(err)
+
+	var tt = []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: server.ErrSessionNotFound, code: codes.NotFound},
+		{err: server.ErrClientConnected, code: codes.FailedPrecondition},
+		{err: errors.New("error"), code: codes.Internal},
+	}
+	for _, v := range tt {
+		cs.EXPECT().ExpireSession("cid").Return(v.err)
+		_, err = c.ExpireSession(context.Background(), &ExpireSessionRequest{ClientId: "cid"})
+		a.Equal(v.code, status.Code(err))
+	}
+
+	_, err = c.ExpireSession(context.Background(), &ExpireSessionRequest{})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientService_SetSessionExpiry(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	client := server.NewMockClient(ctrl)
+	client.EXPECT().ClientOptions().Return(&server.ClientOptions{
+		ClientID:      "cid",
+		SessionExpiry: 10,
+	}).AnyTimes()
+	client.EXPECT().ConnID().Return("conn").AnyTimes()
+	client.EXPECT().Version().Return(packets.Version5).AnyTimes()
+	client.EXPECT().Connection().Return(&dummyConn{}).AnyTimes()
+	client.EXPECT().ConnectedAt().Return(time.Now()).AnyTimes()
+	admin.store.addClient(client)
+
+	cs.EXPECT().SetSessionExpiry("cid", uint32(60)).Return(nil)
+	_, err := c.SetSessionExpiry(context.Background(), &SetSessionExpiryRequest{ClientId: "cid", SessionExpiry: 60})
+	a.Nil(err)
+	a.EqualValues(60, admin.store.getClientByIDLocked("cid").SessionExpiry)
+
+	var tt = []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: server.ErrSessionNotFound, code: codes.NotFound},
+		{err: errors.New("error"), code: codes.Internal},
+	}
+	for _, v := range tt {
+		cs.EXPECT().SetSessionExpiry("cid", uint32(0)).Return(v.err)
+		_, err = c.SetSessionExpiry(context.Background(), &SetSessionExpiryRequest{ClientId: "cid"})
+		a.Equal(v.code, status.Code(err))
+	}
+	a.EqualValues(60, admin.store.getClientByIDLocked("cid").SessionExpiry)
+
+	_, err = c.SetSessionExpiry(context.Background(), &SetSessionExpiryRequest{})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientService_errorCodes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	ctx := context.Background()
+	iterateQueue := func(clientID string, fn func(elem *queue.Elem) (bool, error)) error {
+		return nil
+	}
+	var tt = []struct {
+		name   string
+		expect func()
+		call   func() error
+		code   codes.Code
+		reason string
+	}{
+		{
+			name: "list_invalid_filter",
+			call: func() error {
+				_, err := c.List(ctx, &ListClientRequest{ConnectedOnly: true, DisconnectedOnly: true})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: ReasonInvalidArgument,
+		},
+		{
+			name: "get_empty_client_id",
+			call: func() error {
+				_, err := c.Get(ctx, &GetClientRequest{})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: ReasonInvalidArgument,
+		},
+		{
+			name: "get_not_found",
+			call: func() error {
+				_, err := c.Get(ctx, &GetClientRequest{ClientId: "cid"})
+				return err
+			},
+			code:   codes.NotFound,
+			reason: ReasonNotFound,
+		},
+		{
+			name: "delete_empty_client_id",
+			call: func() error {
+				_, err := c.Delete(ctx, &DeleteClientRequest{})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: ReasonInvalidArgument,
+		},
+		{
+			name: "delete_ban_failed",
+			expect: func() {
+				cs.EXPECT().Ban(gomock.Any()).Return(errors.New("error"))
+			},
+			call: func() error {
+				_, err := c.Delete(ctx, &DeleteClientRequest{ClientId: "cid", BanDuration: durationpb.New(time.Minute)})
+				return err
+			},
+			code:   codes.Internal,
+			reason: ReasonInternal,
+		},
+		{
+			name: "batch_delete_no_target",
+			call: func() error {
+				_, err := c.BatchDelete(ctx, &BatchDeleteRequest{})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: ReasonInvalidArgument,
+		},
+		{
+			name: "migrate_queue_connected",
+			expect: func() {
+				cs.EXPECT().MigrateQueue("a", "b", gomock.Any()).Return(0, server.ErrSessionConnected)
+			},
+			call: func() error {
+				_, err := c.MigrateQueue(ctx, &MigrateQueueRequest{FromClientId: "a", ToClientId: "b"})
+				return err
+			},
+			code:   codes.FailedPrecondition,
+			reason: ReasonClientConnected,
+		},
+		{
+			name: "migrate_queue_not_empty",
+			expect: func() {
+				cs.EXPECT().MigrateQueue("a", "b", gomock.Any()).Return(0, server.ErrQueueNotEmpty)
+			},
+			call: func() error {
+				_, err := c.MigrateQueue(ctx, &MigrateQueueRequest{FromClientId: "a", ToClientId: "b"})
+				return err
+			},
+			code:   codes.FailedPrecondition,
+			reason: ReasonQueueNotEmpty,
+		},
+		{
+			name: "migrate_queue_not_supported",
+			expect: func() {
+				cs.EXPECT().MigrateQueue("a", "b", gomock.Any()).Return(0, server.ErrMigrateNotSupported)
+			},
+			call: func() error {
+				_, err := c.MigrateQueue(ctx, &MigrateQueueRequest{FromClientId: "a", ToClientId: "b"})
+				return err
+			},
+			code:   codes.Unimplemented,
+			reason: ReasonNotSupported,
+		},
+		{
+			name: "migrate_queue_internal",
+			expect: func() {
+				cs.EXPECT().MigrateQueue("a", "b", gomock.Any()).Return(0, errors.New("error"))
+			},
+			call: func() error {
+				_, err := c.MigrateQueue(ctx, &MigrateQueueRequest{FromClientId: "a", ToClientId: "b"})
+				return err
+			},
+			code:   codes.Internal,
+			reason: ReasonInternal,
+		},
+		{
+			name: "peek_queue_not_found",
+			expect: func() {
+				cs.EXPECT().IterateQueue("cid", gomock.Any()).Return(server.ErrSessionNotFound)
+			},
+			call: func() error {
+				_, err := c.PeekQueue(ctx, &PeekQueueRequest{ClientId: "cid"})
+				return err
+			},
+			code:   codes.NotFound,
+			reason: ReasonNotFound,
+		},
+		{
+			name: "peek_queue_limit",
+			call: func() error {
+				_, err := c.PeekQueue(ctx, &PeekQueueRequest{ClientId: "cid", Limit: maxPeekQueueLimit + 1})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: ReasonInvalidArgument,
+		},
+		{
+			name: "get_client_inflight_not_supported",
+			expect: func() {
+				cs.EXPECT().IterateQueue("cid", gomock.Any()).Return(server.ErrIterateNotSupported)
+			},
+			call: func() error {
+				_, err := c.GetClientInflight(ctx, &GetClientInflightRequest{ClientId: "cid"})
+				return err
+			},
+			code:   codes.Unimplemented,
+			reason: ReasonNotSupported,
+		},
+		{
+			name: "get_client_inflight_ok",
+			expect: func() {
+				cs.EXPECT().IterateQueue("cid", gomock.Any()).DoAndReturn(iterateQueue)
+			},
+			call: func() error {
+				_, err := c.GetClientInflight(ctx, &GetClientInflightRequest{ClientId: "cid"})
+				return err
+			},
+			code: codes.OK,
+		},
+		{
+			name: "verify_queue_not_supported",
+			expect: func() {
+				cs.EXPECT().VerifyQueue("cid").Return(nil, server.ErrVerifyNotSupported)
+			},
+			call: func() error {
+				_, err := c.VerifyQueue(ctx, &VerifyQueueRequest{ClientId: "cid"})
+				return err
+			},
+			code:   codes.Unimplemented,
+			reason: ReasonNotSupported,
+		},
+		{
+			name: "expire_session_connected",
+			expect: func() {
+				cs.EXPECT().ExpireSession("cid").Return(server.ErrClientConnected)
+			},
+			call: func() error {
+				_, err := c.ExpireSession(ctx, &ExpireSessionRequest{ClientId: "cid"})
+				return err
+			},
+			code:   codes.FailedPrecondition,
+			reason: ReasonClientConnected,
+		},
+		{
+			name: "clear_bans_unknown_type",
+			call: func() error {
+				_, err := c.ClearBans(ctx, &ClearBansRequest{Type: "unknown", Value: "a"})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: ReasonInvalidArgument,
+		},
+		{
+			name: "list_by_addr_invalid",
+			call: func() error {
+				_, err := c.ListByAddr(ctx, &ListClientByAddrRequest{IpOrCidr: "invalid"})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: ReasonInvalidArgument,
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			if v.expect != nil {
+				v.expect()
+			}
+			err := v.call()
+			a.Equal(v.code, status.Code(err))
+			a.Equal(v.reason, errorReason(err))
+		})
+	}
+}
+
+func TestClientService_GetClientInflight(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		clientService: cs,
+		store:         newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	at := time.Now().Add(-time.Minute)
+	elems := []*queue.Elem{
+		{At: at, MessageWithID: &queue.Pubrel{PacketID: 1}},
+		{At: at, MessageWithID: &queue.Publish{
+			Message: &gmqtt.Message{Topic: "a", QoS: packets.Qos2, PacketID: 2},
+		}},
+		{At: at, MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "b"}}},
+	}
+	iterate := func(elems []*queue.Elem) func(clientID string, fn func(elem *queue.Elem) (bool, error)) error {
+		return func(clientID string, fn func(elem *queue.Elem) (bool, error)) error {
+			for _, v := range elems {
+				if cont, err := fn(v); err != nil || !cont {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	cs.EXPECT().IterateQueue("cid", gomock.Any()).DoAndReturn(iterate(elems))
+	resp, err := c.GetClientInflight(context.Background(), &GetClientInflightRequest{
+		ClientId: "cid",
+	})
+	a.Nil(err)
+	if a.Len(resp.Messages, 2) {
+		a.EqualValues(1, resp.Messages[0].PacketId)
+		a.True(resp.Messages[0].Pubrel)
+		a.Equal(InflightDirection_INFLIGHT_DIRECTION_OUTBOUND, resp.Messages[0].Direction)
+		a.Equal(timestamppb.New(at), resp.Messages[0].Since)
+		a.True(resp.Messages[0].Duration.AsDuration() >= time.Minute)
+
+		a.EqualValues(2, resp.Messages[1].PacketId)
+		a.False(resp.Messages[1].Pubrel)
+		a.Equal("a", resp.Messages[1].TopicName)
+		a.EqualValues(packets.Qos2, resp.Messages[1].Qos)
+	}
+
+	// no inflight messages
+	cs.EXPECT().IterateQueue("cid", gomock.Any()).DoAndReturn(iterate(elems[2:]))
+	resp, err = c.GetClientInflight(context.Background(), &GetClientInflightRequest{
+		ClientId: "cid",
+	})
+	a.Nil(err)
+	a.NotNil(resp.Messages)
+	a.Len(resp.Messages, 0)
+
+	var tt = []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: server.ErrSessionNotFound, code: codes.NotFound},
+		{err: server.ErrIterateNotSupported, code: codes.Unimplemented},
+	}
+	for _, v := range tt {
+		cs.EXPECT().IterateQueue("cid", gomock.Any()).Return(v.err)
+		_, err = c.GetClientInflight(context.Background(), &GetClientInflightRequest{
+			ClientId: "cid",
+		})
+		a.Equal(v.code, status.Code(err))
+	}
+
+	_, err = c.GetClientInflight(context.Background(), &GetClientInflightRequest{})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+type remoteAddrConn struct {
+	dummyConn
+	remoteAddr net.Addr
+}
+
+func (r *remoteAddrConn) RemoteAddr() net.Addr {
+	return r.remoteAddr
+}
+
+// fakeSessionIterator lists the sessions in the order of the client id.
+// The filter and the sort key are only recorded, their semantics are tested with server.SessionIterator.
+type fakeSessionIterator struct {
+	sessions []*server.SessionInfo
+	opts     server.ListSessionsOptions
+}
+
+func (f *fakeSessionIterator) ListSessions(opts server.ListSessionsOptions) ([]*server.SessionInfo, int, error) {
+	f.opts = opts
+	all := append([]*server.SessionInfo(nil), f.sessions...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ClientID < all[j].ClientID
+	})
+	if opts.Fill != nil {
+		for _, v := range all {
+			opts.Fill(v)
+		}
+	}
+	rest := all[sort.Search(len(all), func(i int) bool {
+		return opts.After == "" || all[i].ClientID > opts.After
+	}):]
+	page, pageSize := opts.Page, opts.PageSize
+	if page == 0 {
+		page = server.DefaultPage
+	}
+	if pageSize == 0 {
+		pageSize = server.DefaultPageSize
+	}
+	offset, n := GetOffsetN(page, pageSize)
+	if offset > uint(len(rest)) {
+		offset = uint(len(rest))
+	}
+	end := offset + n
+	if end > uint(len(rest)) {
+		end = uint(len(rest))
+	}
+	return rest[offset:end], len(all), nil
+}
+
+func (f *fakeSessionIterator) remove(clientID string) {
+	for i, v := range f.sessions {
+		if v.ClientID == clientID {
+			f.sessions = append(f.sessions[:i], f.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// newTestAdminClient returns the client service whose client list is served by the fakeSessionIterator.
+func newTestAdminClient(sr server.StatsReader, cs server.ClientService) (*clientService, *fakeSessionIterator) {
+	it := &fakeSessionIterator{}
+	return &clientService{
+		a: &Admin{
+			statsReader:   sr,
+			clientService: cs,
+			store:         newStore(sr, mockConfig, nil),
+			listSessions:  it.ListSessions,
+		},
+	}, it
+}
+
+func TestClientService_List_filter(t *testing.T) {
+	a := assert.New(t)
+	c, it := newTestAdminClient(nil, nil)
+	idle := time.Now()
+	_, err := c.List(context.Background(), &ListClientRequest{
+		Username:         "tenant-a",
+		UsernamePrefix:   true,
+		DisconnectedOnly: true,
+		IdleLongerThan:   durationpb.New(time.Minute),
+	})
+	a.Nil(err)
+	a.Equal("tenant-a", it.opts.Filter.Username)
+	a.True(it.opts.Filter.UsernamePrefix)
+	a.False(it.opts.Filter.ConnectedOnly)
+	a.True(it.opts.Filter.DisconnectedOnly)
+	a.WithinDuration(idle.Add(-time.Minute), it.opts.Filter.IdleBefore, time.Second)
+
+	_, err = c.List(context.Background(), &ListClientRequest{ConnectedOnly: true})
+	a.Nil(err)
+	a.Equal(server.SessionFilter{ConnectedOnly: true}, it.opts.Filter)
+
+	for _, v := range []*ListClientRequest{
+		{ConnectedOnly: true, DisconnectedOnly: true},
+		{IdleLongerThan: durationpb.New(-time.Minute)},
+	} {
+		_, err = c.List(context.Background(), v)
+		a.Equal(codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientService_List_disconnected(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := server.NewMockStatsReader(ctrl)
+	sr.EXPECT().GetClientStats(gomock.Any()).AnyTimes()
+	c, it := newTestAdminClient(sr, nil)
+	now := time.Unix(time.Now().Unix(), 0)
+	client := server.NewMockClient(ctrl)
+	client.EXPECT().Version().Return(packets.Version311).AnyTimes()
+	client.EXPECT().Connection().Return(&dummyConn{}).AnyTimes()
+	client.EXPECT().ConnectedAt().Return(now.Add(-time.Hour)).AnyTimes()
+	client.EXPECT().ConnID().Return("conn").AnyTimes()
+	client.EXPECT().ClientOptions().Return(&server.ClientOptions{ClientID: "known", Username: "user", KeepAlive: 30}).AnyTimes()
+	c.a.store.addClient(client)
+	c.a.store.setClientDisconnected("known", errors.New("keep alive timeout"))
+
+	it.sessions = []*server.SessionInfo{
+		{ClientID: "known", ConnectedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), SessionExpiry: 7200},
+		{ClientID: "restored", ConnectedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), SessionExpiry: 3600},
+	}
+	resp, err := c.List(context.Background(), &ListClientRequest{})
+	a.Nil(err)
+	if a.Len(resp.Clients, 2) {
+		// the fields of the last connection are filled from the store.
+		known := resp.Clients[0]
+		a.Equal("user", known.Username)
+		a.Equal("conn", known.ConnId)
+		a.EqualValues(packets.Version311, known.Version)
+		a.EqualValues(30, known.KeepAlive)
+		a.NotNil(known.DisconnectedAt)
+		a.Equal("keep alive timeout", known.DisconnectReason)
+		// the session which is unknown to the store disconnected the expiry interval before it expires.
+		restored := resp.Clients[1]
+		a.Equal("", restored.Username)
+		a.Equal(now.Unix(), restored.DisconnectedAt.AsTime().Unix())
+	}
+	// the username of the last connection can be filtered.
+	s := &server.SessionInfo{ClientID: "known"}
+	it.opts.Fill(s)
+	a.Equal("user", s.Username)
+	s = &server.SessionInfo{ClientID: "known", Connected: true, Username: "new"}
+	it.opts.Fill(s)
+	a.Equal("new", s.Username)
+}
+
+func TestClientService_List_pageToken(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := server.NewMockStatsReader(ctrl)
+	sr.EXPECT().GetClientStats(gomock.Any()).AnyTimes()
+	c, it := newTestAdminClient(sr, nil)
+	add := func(clientID string) {
+		it.sessions = append(it.sessions, &server.SessionInfo{ClientID: clientID, Connected: true})
+	}
+	for i := 0; i < 10; i++ {
+		add(fmt.Sprintf("c%02d", i))
+	}
+	// listAll lists all pages by the page token and calls mutate between the pages.
+	listAll := func(req *ListClientRequest, mutate func(page int)) (ids []string) {
+		for page := 0; ; page++ {
+			resp, err := c.List(context.Background(), req)
+			a.Nil(err)
+			a.EqualValues(len(it.sessions), resp.TotalCount)
+			for _, v := range resp.Clients {
+				ids = append(ids, v.ClientId)
+			}
+			if resp.NextPageToken == "" {
+				return ids
+			}
+			req.PageToken = resp.NextPageToken
+			mutate(page)
+		}
+	}
+	ids := listAll(&ListClientRequest{PageSize: 3}, func(page int) {
+		switch page {
+		case 0:
+			// remove the last client in the returned page and the first client in the next page.
+			it.remove("c02")
+			it.remove("c03")
+		case 1:
+			add("c10")
+		}
+	})
+	a.Equal([]string{"c00", "c01", "c02", "c04", "c05", "c06", "c07", "c08", "c09", "c10"}, ids)
+
+	// the first page by page number also returns the token of the next page.
+	resp, err := c.List(context.Background(), &ListClientRequest{Page: 1, PageSize: 4})
+	a.Nil(err)
+	a.Len(resp.Clients, 4)
+	resp, err = c.List(context.Background(), &ListClientRequest{PageSize: 4, PageToken: resp.NextPageToken})
+	a.Nil(err)
+	a.Equal("c06", resp.Clients[0].ClientId)
+	// the last page by page number has no next page.
+	resp, err = c.List(context.Background(), &ListClientRequest{Page: 3, PageSize: 4})
+	a.Nil(err)
+	a.Len(resp.Clients, 1)
+	a.Empty(resp.NextPageToken)
+
+	for _, v := range []*ListClientRequest{
+		{PageToken: "!"},
+		{PageToken: encodeKeyPageToken("c00"), Page: 2},
+		{PageToken: encodeKeyPageToken("c00"), SortBy: ClientSortBy_CLIENT_SORT_BY_CONNECTED_AT},
+		{PageToken: encodeKeyPageToken("c00"), Descending: true},
+	} {
+		_, err = c.List(context.Background(), v)
+		a.Equal(codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestClientService_List_sort(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := server.NewMockStatsReader(ctrl)
+	sr.EXPECT().GetClientStats(gomock.Any()).AnyTimes()
+	c, it := newTestAdminClient(sr, nil)
+	for i := 0; i < 3; i++ {
+		it.sessions = append(it.sessions, &server.SessionInfo{ClientID: strconv.Itoa(i), Connected: true})
+	}
+	for k, v := range clientSortBy {
+		resp, err := c.List(context.Background(), &ListClientRequest{SortBy: k, Descending: true, PageSize: 2})
+		a.Nil(err)
+		a.Equal(v, it.opts.SortBy)
+		a.True(it.opts.Descending)
+		// the sorted list does not support the page token.
+		a.Empty(resp.NextPageToken)
+	}
+
+	_, err := c.List(context.Background(), &ListClientRequest{SortBy: ClientSortBy(100)})
+	s, ok := status.FromError(err)
+	a.True(ok)
+	a.Equal(codes.InvalidArgument, s.Code())
+}
+
+func TestClientService_ListByAddr(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := server.NewMockStatsReader(ctrl)
+	sr.EXPECT().GetClientStats(gomock.Any()).AnyTimes()
+	admin := &Admin{
+		statsReader: sr,
+		store:       newStore(sr, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	for clientID, addr := range map[string]net.Addr{
+		"a":            &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 1000},
+		"b":            &net.TCPAddr{IP: net.ParseIP("192.168.1.200"), Port: 1001},
+		"c":            &net.TCPAddr{IP: net.ParseIP("192.168.2.10"), Port: 1002},
+		"d":            &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1003},
+		"disconnected": &net.TCPAddr{IP: net.ParseIP("192.168.1.11"), Port: 1004},
+		"unix":         &net.UnixAddr{Name: "/tmp/gmqtt.sock", Net: "unix"},
+	} {
+		client := server.NewMockClient(ctrl)
+		client.EXPECT().Version().Return(packets.Version5).AnyTimes()
+		client.EXPECT().Connection().Return(&remoteAddrConn{remoteAddr: addr}).AnyTimes()
+		client.EXPECT().ConnectedAt().Return(time.Now()).AnyTimes()
+		client.EXPECT().ConnID().Return("").AnyTimes()
+		client.EXPECT().ClientOptions().Return(&server.ClientOptions{ClientID: clientID}).AnyTimes()
+		admin.store.addClient(client)
+	}
+	admin.store.setClientDisconnected("disconnected", nil)
+
+	clientIDs := func(ipOrCIDR string) (ids []string) {
+		resp, err := c.ListByAddr(context.Background(), &ListClientByAddrRequest{IpOrCidr: ipOrCIDR})
+		a.Nil(err)
+		for _, v := range resp.Clients {
+			ids = append(ids, v.ClientId)
+		}
+		return ids
+	}
+	a.ElementsMatch([]string{"a", "b"}, clientIDs("192.168.1.0/24"))
+	a.ElementsMatch([]string{"a", "b", "c"}, clientIDs("192.168.0.0/16"))
+	a.ElementsMatch([]string{"a"}, clientIDs("192.168.1.10"))
+	a.ElementsMatch([]string{"d"}, clientIDs("2001:db8::/32"))
+	a.ElementsMatch([]string{"d"}, clientIDs("2001:db8::1"))
+	a.Empty(clientIDs("10.0.0.0/8"))
+
+	for _, v := range []string{"", "192.168.1", "192.168.1.0/33", "abc"} {
+		_, err := c.ListByAddr(context.Background(), &ListClientByAddrRequest{IpOrCidr: v})
+		s, ok := status.FromError(err)
+		a.True(ok)
+		a.Equal(codes.InvalidArgument, s.Code())
+	}
+}
+
+func TestClientService_GetSubscriptions(t *testing.T) {
+	a := assert.New(t)
+	admin := &Admin{
+		store: newStore(nil, mockConfig, nil),
+	}
+	c := &clientService{
+		a: admin,
+	}
+	admin.store.addSubscription("a", &gmqtt.Subscription{TopicFilter: "t/2", QoS: 1})
+	admin.store.addSubscription("a", &gmqtt.Subscription{ShareName: "g", TopicFilter: "t/1"})
+	admin.store.addSubscription("a", &gmqtt.Subscription{TopicFilter: "t/3"})
+	// the client id which begins with the other client id and "_".
+	admin.store.addSubscription("a_b", &gmqtt.Subscription{TopicFilter: "t/4"})
+	admin.store.removeSubscription("a", "t/3")
+
+	resp, err := c.GetSubscriptions(context.Background(), &GetClientSubscriptionsRequest{ClientId: "a"})
+	a.Nil(err)
+	var topics []string
+	for _, v := range resp.Subscriptions {
+		a.Equal("a", v.ClientId)
+		topics = append(topics, v.TopicName)
+	}
+	a.Equal([]string{"$share/g/t/1", "t/2"}, topics)
+	a.EqualValues(1, resp.Subscriptions[1].Qos)
+
+	resp, err = c.GetSubscriptions(context.Background(), &GetClientSubscriptionsRequest{ClientId: "notexist"})
+	a.Nil(err)
+	a.NotNil(resp.Subscriptions)
+	a.Empty(resp.Subscriptions)
+
+	_, err = c.GetSubscriptions(context.Background(), &GetClientSubscriptionsRequest{})
+	s, ok := status.FromError(err)
+	a.True(ok)
+	a.Equal(codes.InvalidArgument, s.Code())
 }
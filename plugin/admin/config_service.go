@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"context"
+
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+type configService struct {
+	a *Admin
+}
+
+func (c *configService) mustEmbedUnimplementedConfigServiceServer() {
+	return
+}
+
+// Reload re-reads the configuration file and applies the reloadable fields to the running broker.
+func (c *configService) Reload(ctx context.Context, req *ReloadRequest) (*ReloadResponse, error) {
+	rs, err := c.a.reloadConfig()
+	if err == server.ErrConfigLoaderNotSet {
+		return nil, ErrUnimplemented("the broker does not support reloading the configuration")
+	}
+	if err != nil {
+		return nil, ErrFailedPrecondition(ReasonInvalidConfig, err.Error())
+	}
+	return &ReloadResponse{
+		Applied:        rs.Applied,
+		RequireRestart: rs.RequireRestart,
+	}, nil
+}
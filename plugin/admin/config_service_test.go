@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+func TestConfigService_Reload(t *testing.T) {
+	a := assert.New(t)
+	var rs *server.ReloadResult
+	var err error
+	c := &configService{a: &Admin{
+		reloadConfig: func() (*server.ReloadResult, error) {
+			return rs, err
+		},
+	}}
+	rs = &server.ReloadResult{
+		Applied:        []string{"publish_rate_limit"},
+		RequireRestart: []string{"listeners"},
+	}
+	resp, e := c.Reload(context.Background(), &ReloadRequest{})
+	a.Nil(e)
+	a.Equal([]string{"publish_rate_limit"}, resp.Applied)
+	a.Equal([]string{"listeners"}, resp.RequireRestart)
+
+	rs, err = nil, errors.New("invalid log level: abc")
+	_, e = c.Reload(context.Background(), &ReloadRequest{})
+	a.Equal(codes.FailedPrecondition, status.Code(e))
+	a.Equal(ReasonInvalidConfig, errorReason(e))
+
+	err = server.ErrConfigLoaderNotSet
+	_, e = c.Reload(context.Background(), &ReloadRequest{})
+	a.Equal(codes.Unimplemented, status.Code(e))
+}
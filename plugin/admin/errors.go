@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorDomain is the domain of the errdetails.ErrorInfo attached to the errors returned by the admin services.
+const ErrorDomain = "gmqtt.admin"
+
+// The reasons of the errdetails.ErrorInfo attached to the errors returned by the admin services,
+// so that the clients can program against the errors rather than matching the error messages.
+const (
+	ReasonNotFound           = "NOT_FOUND"
+	ReasonInvalidArgument    = "INVALID_ARGUMENT"
+	ReasonClientConnected    = "CLIENT_CONNECTED"
+	ReasonQueueNotEmpty      = "QUEUE_NOT_EMPTY"
+	ReasonNotSupported       = "NOT_SUPPORTED"
+	ReasonBrokerNotReady     = "BROKER_NOT_READY"
+	ReasonTraceDisabled      = "TRACE_DISABLED"
+	ReasonTopicStatsDisabled = "TOPIC_STATS_DISABLED"
+	ReasonInvalidConfig      = "INVALID_CONFIG"
+	ReasonMessageRejected    = "MESSAGE_REJECTED"
+	ReasonQueueFull          = "QUEUE_FULL"
+	ReasonInternal           = "INTERNAL"
+)
+
+// ErrNotFound represents a not found error.
+var ErrNotFound = newError(codes.NotFound, ReasonNotFound, "not found")
+
+// newError returns the status error with the errdetails.ErrorInfo of the reason attached.
+func newError(code codes.Code, reason string, msg string, details ...proto.Message) error {
+	st := status.New(code, msg)
+	details = append([]proto.Message{&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: ErrorDomain,
+	}}, details...)
+	if rs, err := st.WithDetails(details...); err == nil {
+		st = rs
+	}
+	return st.Err()
+}
+
+// ErrInvalidArgument is a wrapper function for easier invalid argument error handling.
+// The name and the msg are attached as the field violation of errdetails.BadRequest.
+func ErrInvalidArgument(name string, msg string) error {
+	errString := "invalid " + name
+	if msg != "" {
+		errString = errString + ":" + msg
+	}
+	return newError(codes.InvalidArgument, ReasonInvalidArgument, errString, &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: name, Description: msg},
+		},
+	})
+}
+
+// ErrFailedPrecondition returns the FailedPrecondition error of the reason,
+// it indicates that the request can not be executed in the current state, e.g: the client is connected.
+func ErrFailedPrecondition(reason string, msg string) error {
+	return newError(codes.FailedPrecondition, reason, msg)
+}
+
+// ErrUnimplemented returns the Unimplemented error, it indicates that the operation is not supported by the backend,
+// e.g: the persistence does not support iterating the queue.
+func ErrUnimplemented(msg string) error {
+	return newError(codes.Unimplemented, ReasonNotSupported, msg)
+}
+
+// ErrUnavailable returns the Unavailable error of the reason.
+func ErrUnavailable(reason string, msg string) error {
+	return newError(codes.Unavailable, reason, msg)
+}
+
+// ErrResourceExhausted returns the ResourceExhausted error of the reason, the request can be retried later.
+func ErrResourceExhausted(reason string, msg string) error {
+	return newError(codes.ResourceExhausted, reason, msg)
+}
+
+// ErrInternal returns the Internal error of the failed action.
+func ErrInternal(action string, err error) error {
+	return newError(codes.Internal, ReasonInternal, "failed to "+action+": "+err.Error())
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorReason returns the reason of the errdetails.ErrorInfo attached to the error.
+func errorReason(err error) string {
+	for _, v := range status.Convert(err).Details() {
+		if info, ok := v.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestErrors(t *testing.T) {
+	a := assert.New(t)
+	var tt = []struct {
+		err    error
+		code   codes.Code
+		reason string
+		msg    string
+	}{
+		{err: ErrNotFound, code: codes.NotFound, reason: ReasonNotFound, msg: "not found"},
+		{err: ErrInvalidArgument("limit", "too big"), code: codes.InvalidArgument, reason: ReasonInvalidArgument, msg: "invalid limit:too big"},
+		{err: ErrFailedPrecondition(ReasonQueueNotEmpty, "queue is not empty"), code: codes.FailedPrecondition, reason: ReasonQueueNotEmpty, msg: "queue is not empty"},
+		{err: ErrUnimplemented("not supported"), code: codes.Unimplemented, reason: ReasonNotSupported, msg: "not supported"},
+		{err: ErrUnavailable(ReasonBrokerNotReady, "starting"), code: codes.Unavailable, reason: ReasonBrokerNotReady, msg: "starting"},
+		{err: ErrInternal("subscribe", errors.New("error")), code: codes.Internal, reason: ReasonInternal, msg: "failed to subscribe: error"},
+	}
+	for _, v := range tt {
+		st := status.Convert(v.err)
+		a.Equal(v.code, st.Code())
+		a.Equal(v.msg, st.Message())
+		a.Equal(v.reason, errorReason(v.err))
+	}
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, v := range status.Convert(ErrInvalidArgument("limit", "too big")).Details() {
+		if br, ok := v.(*errdetails.BadRequest); ok {
+			violations = br.FieldViolations
+		}
+	}
+	if a.Len(violations, 1) {
+		a.Equal("limit", violations[0].Field)
+		a.Equal("too big", violations[0].Description)
+	}
+}
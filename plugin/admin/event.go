@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// eventBufferSize is the number of the events buffered for each subscriber.
+const eventBufferSize = 1024
+
+// eventHub fans out the events to the subscribers.
+// Publishing never blocks, so that a slow subscriber can not stall the hooks of the broker.
+type eventHub struct {
+	mu   sync.RWMutex
+	subs map[*eventSubscriber]struct{}
+}
+
+type eventSubscriber struct {
+	// types is the event types to receive, nil means all types.
+	types map[EventType]struct{}
+	ch    chan *Event
+	// dropped is the number of events dropped since the last received event.
+	dropped uint32
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+func (h *eventHub) subscribe(types []EventType, bufferSize int) *eventSubscriber {
+	s := &eventSubscriber{
+		ch: make(chan *Event, bufferSize),
+	}
+	if len(types) != 0 {
+		s.types = make(map[EventType]struct{})
+		for _, v := range types {
+			s.types[v] = struct{}{}
+		}
+	}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *eventHub) unsubscribe(s *eventSubscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+// publish sends the event to the subscribers, it is safe to call on a nil hub.
+func (h *eventHub) publish(ev *Event) {
+	if h == nil {
+		return
+	}
+	ev.Time = timestamppb.New(time.Now())
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if s.types != nil {
+			if _, ok := s.types[ev.Type]; !ok {
+				continue
+			}
+		}
+		s.send(ev)
+	}
+}
+
+// send adds the event to the buffer, the oldest event is dropped if the buffer is full.
+func (s *eventSubscriber) send(ev *Event) {
+	for {
+		select {
+		case s.ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+			atomic.AddUint32(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+// receive returns the event to send to the subscriber,
+// the number of the events dropped before it is set into the returned event.
+func (s *eventSubscriber) receive(ev *Event) *Event {
+	dropped := atomic.SwapUint32(&s.dropped, 0)
+	if dropped == 0 {
+		return ev
+	}
+	// the event is shared by all subscribers.
+	ev = proto.Clone(ev).(*Event)
+	ev.Dropped = dropped
+	return ev
+}
+
+type eventService struct {
+	a *Admin
+}
+
+func (e *eventService) mustEmbedUnimplementedEventServiceServer() {
+	return
+}
+
+// Subscribe streams the events until the client cancels the request.
+func (e *eventService) Subscribe(req *SubscribeEventRequest, stream EventService_SubscribeServer) error {
+	for _, v := range req.Types {
+		if _, ok := EventType_name[int32(v)]; !ok || v == EventType_EVENT_TYPE_UNSPECIFIED {
+			return ErrInvalidArgument("types", "unknown event type")
+		}
+	}
+	s := e.a.events.subscribe(req.Types, eventBufferSize)
+	defer e.a.events.unsubscribe(s)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-s.ch:
+			if err := stream.Send(s.receive(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
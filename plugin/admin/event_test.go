@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+type testEventStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *Event
+}
+
+func (t *testEventStream) Context() context.Context {
+	return t.ctx
+}
+
+func (t *testEventStream) Send(ev *Event) error {
+	t.events <- ev
+	return nil
+}
+
+func TestEventHub_publish(t *testing.T) {
+	a := assert.New(t)
+	h := newEventHub()
+	all := h.subscribe(nil, 10)
+	connected := h.subscribe([]EventType{EventType_EVENT_TYPE_CLIENT_CONNECTED}, 10)
+
+	h.publish(&Event{Type: EventType_EVENT_TYPE_CLIENT_CONNECTED, ClientId: "1"})
+	h.publish(&Event{Type: EventType_EVENT_TYPE_SUBSCRIPTION_ADDED, ClientId: "1"})
+	a.Len(all.ch, 2)
+	a.Len(connected.ch, 1)
+	ev := <-connected.ch
+	a.Equal("1", ev.ClientId)
+	a.NotNil(ev.Time)
+
+	h.unsubscribe(all)
+	h.publish(&Event{Type: EventType_EVENT_TYPE_CLIENT_CONNECTED, ClientId: "2"})
+	a.Len(all.ch, 2)
+	a.Len(connected.ch, 1)
+
+	var nilHub *eventHub
+	nilHub.publish(&Event{Type: EventType_EVENT_TYPE_CLIENT_CONNECTED})
+}
+
+func TestEventHub_dropOldest(t *testing.T) {
+	a := assert.New(t)
+	h := newEventHub()
+	s := h.subscribe(nil, 2)
+	done := make(chan struct{})
+	go func() {
+		// nobody is receiving, publish must not block.
+		for i := 0; i < 5; i++ {
+			h.publish(&Event{Type: EventType_EVENT_TYPE_CLIENT_CONNECTED, ClientId: strconv.Itoa(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked by the slow subscriber")
+	}
+
+	ev := s.receive(<-s.ch)
+	a.Equal("3", ev.ClientId)
+	a.EqualValues(3, ev.Dropped)
+	ev = s.receive(<-s.ch)
+	a.Equal("4", ev.ClientId)
+	a.EqualValues(0, ev.Dropped)
+}
+
+func TestEventService_Subscribe(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	admin := &Admin{
+		store:  newStore(nil, mockConfig, nil),
+		events: newEventHub(),
+	}
+	es := &eventService{a: admin}
+
+	err := es.Subscribe(&SubscribeEventRequest{
+		Types: []EventType{EventType_EVENT_TYPE_UNSPECIFIED},
+	}, &testEventStream{ctx: context.Background()})
+	s, ok := status.FromError(err)
+	a.True(ok)
+	a.Equal(codes.InvalidArgument, s.Code())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &testEventStream{ctx: ctx, events: make(chan *Event, 10)}
+	errCh := make(chan error)
+	go func() {
+		errCh <- es.Subscribe(&SubscribeEventRequest{}, stream)
+	}()
+	// wait for the subscriber to be registered.
+	a.Eventually(func() bool {
+		admin.events.mu.RLock()
+		defer admin.events.mu.RUnlock()
+		return len(admin.events.subs) == 1
+	}, time.Second, time.Millisecond)
+
+	client := server.NewMockClient(ctrl)
+	client.EXPECT().ClientOptions().Return(&server.ClientOptions{ClientID: "id"}).AnyTimes()
+	client.EXPECT().Version().Return(packets.Version5).AnyTimes()
+	client.EXPECT().ConnectedAt().Return(time.Now()).AnyTimes()
+	client.EXPECT().ConnID().Return("").AnyTimes()
+	client.EXPECT().Connection().Return(&dummyConn{}).AnyTimes()
+
+	admin.OnSessionCreatedWrapper(func(ctx context.Context, client server.Client) {})(context.Background(), client)
+	admin.OnSubscribedWrapper(func(ctx context.Context, client server.Client, subscription *gmqtt.Subscription) {})(
+		context.Background(), client, &gmqtt.Subscription{TopicFilter: "a/b", QoS: 1})
+	admin.OnUnsubscribedWrapper(func(ctx context.Context, client server.Client, topicName string) {})(
+		context.Background(), client, "a/b")
+	admin.OnClosedWrapper(func(ctx context.Context, client server.Client, err error) {})(
+		context.Background(), client, errors.New("connection lost"))
+
+	ev := <-stream.events
+	a.Equal(EventType_EVENT_TYPE_CLIENT_CONNECTED, ev.Type)
+	a.Equal("id", ev.ClientId)
+	ev = <-stream.events
+	a.Equal(EventType_EVENT_TYPE_SUBSCRIPTION_ADDED, ev.Type)
+	a.Equal("a/b", ev.Subscription.TopicName)
+	a.EqualValues(1, ev.Subscription.Qos)
+	ev = <-stream.events
+	a.Equal(EventType_EVENT_TYPE_SUBSCRIPTION_REMOVED, ev.Type)
+	a.Equal("a/b", ev.Subscription.TopicName)
+	ev = <-stream.events
+	a.Equal(EventType_EVENT_TYPE_CLIENT_DISCONNECTED, ev.Type)
+	a.Equal("connection lost", ev.Reason)
+	c := admin.store.getClientByIDLocked("id")
+	a.NotNil(c.DisconnectedAt)
+	a.Equal("connection lost", c.DisconnectReason)
+
+	cancel()
+	a.Nil(<-errCh)
+	a.Len(admin.events.subs, 0)
+}
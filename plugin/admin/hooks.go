@@ -21,21 +21,38 @@ func (a *Admin) HookWrapper() server.HookWrapper {
 func (a *Admin) OnSessionCreatedWrapper(pre server.OnSessionCreated) server.OnSessionCreated {
 	return func(ctx context.Context, client server.Client) {
 		pre(ctx, client)
-		a.store.addClient(client)
+		clientID := a.store.addClient(client)
+		a.events.publish(&Event{
+			Type:     EventType_EVENT_TYPE_CLIENT_CONNECTED,
+			ClientId: clientID,
+		})
 	}
 }
 
 func (a *Admin) OnSessionResumedWrapper(pre server.OnSessionResumed) server.OnSessionResumed {
 	return func(ctx context.Context, client server.Client) {
 		pre(ctx, client)
-		a.store.addClient(client)
+		clientID := a.store.addClient(client)
+		a.events.publish(&Event{
+			Type:     EventType_EVENT_TYPE_CLIENT_CONNECTED,
+			ClientId: clientID,
+		})
 	}
 }
 
 func (a *Admin) OnClosedWrapper(pre server.OnClosed) server.OnClosed {
 	return func(ctx context.Context, client server.Client, err error) {
 		pre(ctx, client, err)
-		a.store.setClientDisconnected(client.ClientOptions().ClientID)
+		clientID := client.ClientOptions().ClientID
+		a.store.setClientDisconnected(clientID, err)
+		ev := &Event{
+			Type:     EventType_EVENT_TYPE_CLIENT_DISCONNECTED,
+			ClientId: clientID,
+		}
+		if err != nil {
+			ev.Reason = err.Error()
+		}
+		a.events.publish(ev)
 	}
 }
 
@@ -49,13 +66,28 @@ func (a *Admin) OnSessionTerminatedWrapper(pre server.OnSessionTerminated) serve
 func (a *Admin) OnSubscribedWrapper(pre server.OnSubscribed) server.OnSubscribed {
 	return func(ctx context.Context, client server.Client, subscription *gmqtt.Subscription) {
 		pre(ctx, client, subscription)
-		a.store.addSubscription(client.ClientOptions().ClientID, subscription)
+		clientID := client.ClientOptions().ClientID
+		a.store.addSubscription(clientID, subscription)
+		a.events.publish(&Event{
+			Type:         EventType_EVENT_TYPE_SUBSCRIPTION_ADDED,
+			ClientId:     clientID,
+			Subscription: newSubscriptionInfo(clientID, subscription),
+		})
 	}
 }
 
 func (a *Admin) OnUnsubscribedWrapper(pre server.OnUnsubscribed) server.OnUnsubscribed {
 	return func(ctx context.Context, client server.Client, topicName string) {
 		pre(ctx, client, topicName)
-		a.store.removeSubscription(client.ClientOptions().ClientID, topicName)
+		clientID := client.ClientOptions().ClientID
+		a.store.removeSubscription(clientID, topicName)
+		a.events.publish(&Event{
+			Type:     EventType_EVENT_TYPE_SUBSCRIPTION_REMOVED,
+			ClientId: clientID,
+			Subscription: &Subscription{
+				TopicName: topicName,
+				ClientId:  clientID,
+			},
+		})
 	}
 }
@@ -2,11 +2,16 @@ package admin
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
 )
 
 type publisher struct {
@@ -18,8 +23,14 @@ func (p *publisher) mustEmbedUnimplementedPublishServiceServer() {
 }
 
 // Publish publishes a message into broker.
-func (p *publisher) Publish(ctx context.Context, req *PublishRequest) (resp *empty.Empty, err error) {
-	if !packets.ValidTopicName(false, []byte(req.TopicName)) {
+// The retained message is stored in the same way as it is published by a client, see server.Publisher.PublishRetained:
+// the retained message with empty payload removes the existing retained message of the topic.
+// The message rejected by the topic policy, the OnMsgArrived hook or the retained limits returns FailedPrecondition
+// with the reason MESSAGE_REJECTED.
+// If deliver_at or delay_seconds is set, the message is scheduled by server.ScheduleService
+// and the retained message is stored when it is published.
+func (p *publisher) Publish(ctx context.Context, req *PublishRequest) (resp *PublishResponse, err error) {
+	if req.TopicName == "" || !packets.ValidTopicName(false, []byte(req.TopicName)) {
 		return nil, ErrInvalidArgument("topic_name", "")
 	}
 	if req.Qos > uint32(packets.Qos2) {
@@ -31,6 +42,18 @@ func (p *publisher) Publish(ctx context.Context, req *PublishRequest) (resp *emp
 	if req.ResponseTopic != "" && !packets.ValidV5Topic([]byte(req.ResponseTopic)) {
 		return nil, ErrInvalidArgument("response_topic", "")
 	}
+	var deliverAt time.Time
+	if req.DeliverAt != nil {
+		if req.DelaySeconds != 0 {
+			return nil, ErrInvalidArgument("delay_seconds", "cannot be set together with deliver_at")
+		}
+		if err := req.DeliverAt.CheckValid(); err != nil {
+			return nil, ErrInvalidArgument("deliver_at", err.Error())
+		}
+		deliverAt = req.DeliverAt.AsTime()
+	} else if req.DelaySeconds != 0 {
+		deliverAt = time.Now().Add(time.Duration(req.DelaySeconds) * time.Second)
+	}
 	var userPpt []packets.UserProperty
 	for _, v := range req.UserProperties {
 		userPpt = append(userPpt, packets.UserProperty{
@@ -39,7 +62,7 @@ func (p *publisher) Publish(ctx context.Context, req *PublishRequest) (resp *emp
 		})
 	}
 
-	p.a.publisher.Publish(&gmqtt.Message{
+	msg := &gmqtt.Message{
 		Dup:             false,
 		QoS:             byte(req.Qos),
 		Retained:        req.Retained,
@@ -51,6 +74,190 @@ func (p *publisher) Publish(ctx context.Context, req *PublishRequest) (resp *emp
 		PayloadFormat:   packets.PayloadFormat(req.PayloadFormat),
 		ResponseTopic:   req.ResponseTopic,
 		UserProperties:  userPpt,
-	})
+	}
+	if deliverAt.After(time.Now()) {
+		id, err := p.a.scheduleService.Schedule(msg, deliverAt)
+		if err != nil {
+			return nil, ErrInternal("schedule message", err)
+		}
+		return &PublishResponse{ScheduledId: id}, nil
+	}
+	if err := p.a.publisher.PublishRetained(msg); err != nil {
+		return nil, ErrFailedPrecondition(ReasonMessageRejected, err.Error())
+	}
+	return &PublishResponse{}, nil
+}
+
+// publishStreamPollInterval is the interval to check the queues of the subscribers while PublishStream is waiting.
+const publishStreamPollInterval = 10 * time.Millisecond
+
+// publishStreamWaitTimeout is the maximum time PublishStream waits for the queues of the subscribers of a message.
+var publishStreamWaitTimeout = 5 * time.Second
+
+// PublishStream publishes the stream of messages in order, each request is handled in the same way as Publish.
+// Before publishing a message, the stream waits until the queues of the connected subscribers which would receive it
+// are not full, so that the messages are not dropped if the subscribers fall behind.
+// The stream is slowed down by the gRPC flow control rather than buffered while it is waiting.
+// If the queues are still full after publishStreamWaitTimeout, the stream is aborted with ResourceExhausted
+// and the reason QUEUE_FULL, the messages before it have been published and the rest can be retried.
+// The queues of the disconnected subscribers are not waited for, because they are not drained until the clients reconnect.
+// The invalid requests are skipped and counted as rejected, the summary is returned when the client closes the stream.
+func (p *publisher) PublishStream(stream PublishService_PublishStreamServer) error {
+	start := time.Now()
+	resp := &PublishStreamResponse{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			resp.Duration = durationpb.New(time.Since(start))
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.waitQueueCapacity(stream.Context(), req); err != nil {
+			return err
+		}
+		if _, err := p.Publish(stream.Context(), req); err != nil {
+			resp.RejectedCount++
+			continue
+		}
+		resp.PublishedCount++
+	}
+}
+
+// waitQueueCapacity blocks until the queues of the connected subscribers which would receive the message are not full.
+func (p *publisher) waitQueueCapacity(ctx context.Context, req *PublishRequest) error {
+	if p.a.resolveSubscribers == nil || req.TopicName == "" || !packets.ValidTopicName(false, []byte(req.TopicName)) {
+		return nil
+	}
+	deadline := time.Now().Add(publishStreamWaitTimeout)
+	for {
+		full := p.fullSubscriber(req)
+		if full == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrResourceExhausted(ReasonQueueFull, "the queue of the subscriber "+full+" is full")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(publishStreamPollInterval):
+		}
+	}
+}
+
+// fullSubscriber returns the client id of a connected subscriber which queue is full, or empty if there is none.
+func (p *publisher) fullSubscriber(req *PublishRequest) string {
+	max := uint64(p.a.getConfig().MQTT.MaxQueuedMsg)
+	for _, v := range p.a.resolveSubscribers(&server.ResolveRequest{
+		TopicName: req.TopicName,
+		QoS:       packets.QoS(req.Qos),
+	}) {
+		if !v.Receives || p.a.clientService.GetClient(v.ClientID) == nil {
+			continue
+		}
+		if sts, ok := p.a.statsReader.GetClientStats(v.ClientID); ok && sts.MessageStats.QueuedCurrent >= max {
+			return v.ClientID
+		}
+	}
+	return ""
+}
+
+// ListScheduled lists the pending scheduled messages, sorted by the delivery time.
+func (p *publisher) ListScheduled(ctx context.Context, req *ListScheduledRequest) (*ListScheduledResponse, error) {
+	msgs := p.a.scheduleService.List()
+	total := uint32(len(msgs))
+	offset, n := GetOffsetN(GetPage(req.Page, req.PageSize))
+	if offset >= uint(len(msgs)) {
+		msgs = msgs[:0]
+	} else {
+		end := offset + n
+		if end > uint(len(msgs)) {
+			end = uint(len(msgs))
+		}
+		msgs = msgs[offset:end]
+	}
+	rs := make([]*ScheduledMessage, 0, len(msgs))
+	for _, v := range msgs {
+		rs = append(rs, &ScheduledMessage{
+			Id:        v.ID,
+			DeliverAt: timestamppb.New(v.DeliverAt),
+			TopicName: v.Message.Topic,
+			Payload:   string(v.Message.Payload),
+			Qos:       uint32(v.Message.QoS),
+			Retained:  v.Message.Retained,
+		})
+	}
+	return &ListScheduledResponse{
+		ScheduledMessages: rs,
+		TotalCount:        total,
+	}, nil
+}
+
+// CancelScheduled cancels the pending scheduled message.
+func (p *publisher) CancelScheduled(ctx context.Context, req *CancelScheduledRequest) (*empty.Empty, error) {
+	if req.Id == "" {
+		return nil, ErrInvalidArgument("id", "cannot be empty")
+	}
+	err := p.a.scheduleService.Cancel(req.Id)
+	if err == server.ErrScheduledNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, ErrInternal("cancel scheduled message", err)
+	}
 	return &empty.Empty{}, nil
 }
+
+// ListTraces lists the recent traces of the traced messages, the most recently started one first.
+// If id is set, only the trace of the id is returned.
+func (p *publisher) ListTraces(ctx context.Context, req *ListTracesRequest) (*ListTracesResponse, error) {
+	if p.a.messageTracer == nil {
+		return nil, ErrFailedPrecondition(ReasonTraceDisabled, "the message trace is disabled")
+	}
+	traces := p.a.messageTracer.Recent()
+	if req.Id != "" {
+		var found []server.MessageTrace
+		for _, v := range traces {
+			if v.ID == req.Id {
+				found = append(found, v)
+			}
+		}
+		traces = found
+	}
+	total := uint32(len(traces))
+	offset, n := GetOffsetN(GetPage(req.Page, req.PageSize))
+	if offset >= uint(len(traces)) {
+		traces = traces[:0]
+	} else {
+		end := offset + n
+		if end > uint(len(traces)) {
+			end = uint(len(traces))
+		}
+		traces = traces[offset:end]
+	}
+	rs := make([]*MessageTrace, 0, len(traces))
+	for _, v := range traces {
+		events := make([]*TraceEvent, 0, len(v.Events))
+		for _, e := range v.Events {
+			events = append(events, &TraceEvent{
+				Stage:    e.Stage.String(),
+				Time:     timestamppb.New(e.At),
+				ClientId: e.ClientID,
+				Reason:   e.Reason,
+			})
+		}
+		rs = append(rs, &MessageTrace{
+			Id:              v.ID,
+			TopicName:       v.Topic,
+			StartedAt:       timestamppb.New(v.StartedAt),
+			Events:          events,
+			DiscardedEvents: uint32(v.DiscardedEvents),
+		})
+	}
+	return &ListTracesResponse{
+		Traces:     rs,
+		TotalCount: total,
+	}, nil
+}
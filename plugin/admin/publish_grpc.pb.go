@@ -18,8 +18,17 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type PublishServiceClient interface {
-	// Publish message to broker
-	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	// Publish message to broker, or schedule it if deliver_at or delay_seconds is set.
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+	// List the pending scheduled messages, sorted by the delivery time.
+	ListScheduled(ctx context.Context, in *ListScheduledRequest, opts ...grpc.CallOption) (*ListScheduledResponse, error)
+	// Cancel the pending scheduled message.
+	CancelScheduled(ctx context.Context, in *CancelScheduledRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	// List the recent traces of the traced messages, the most recently started one first.
+	ListTraces(ctx context.Context, in *ListTracesRequest, opts ...grpc.CallOption) (*ListTracesResponse, error)
+	// Publish a stream of messages to broker, the messages are published in order through the same path as Publish.
+	// The invalid requests are skipped and counted in the response.
+	PublishStream(ctx context.Context, opts ...grpc.CallOption) (PublishService_PublishStreamClient, error)
 }
 
 type publishServiceClient struct {
@@ -30,8 +39,8 @@ func NewPublishServiceClient(cc grpc.ClientConnInterface) PublishServiceClient {
 	return &publishServiceClient{cc}
 }
 
-func (c *publishServiceClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
-	out := new(empty.Empty)
+func (c *publishServiceClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error) {
+	out := new(PublishResponse)
 	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.PublishService/Publish", in, out, opts...)
 	if err != nil {
 		return nil, err
@@ -39,12 +48,82 @@ func (c *publishServiceClient) Publish(ctx context.Context, in *PublishRequest,
 	return out, nil
 }
 
+func (c *publishServiceClient) ListScheduled(ctx context.Context, in *ListScheduledRequest, opts ...grpc.CallOption) (*ListScheduledResponse, error) {
+	out := new(ListScheduledResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.PublishService/ListScheduled", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *publishServiceClient) CancelScheduled(ctx context.Context, in *CancelScheduledRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.PublishService/CancelScheduled", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *publishServiceClient) ListTraces(ctx context.Context, in *ListTracesRequest, opts ...grpc.CallOption) (*ListTracesResponse, error) {
+	out := new(ListTracesResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.PublishService/ListTraces", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *publishServiceClient) PublishStream(ctx context.Context, opts ...grpc.CallOption) (PublishService_PublishStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_PublishService_serviceDesc.Streams[0], "/gmqtt.admin.api.PublishService/PublishStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &publishServicePublishStreamClient{stream}
+	return x, nil
+}
+
+type PublishService_PublishStreamClient interface {
+	Send(*PublishRequest) error
+	CloseAndRecv() (*PublishStreamResponse, error)
+	grpc.ClientStream
+}
+
+type publishServicePublishStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *publishServicePublishStreamClient) Send(m *PublishRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *publishServicePublishStreamClient) CloseAndRecv() (*PublishStreamResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PublishStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // PublishServiceServer is the server API for PublishService service.
 // All implementations must embed UnimplementedPublishServiceServer
 // for forward compatibility
 type PublishServiceServer interface {
-	// Publish message to broker
-	Publish(context.Context, *PublishRequest) (*empty.Empty, error)
+	// Publish message to broker, or schedule it if deliver_at or delay_seconds is set.
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	// List the pending scheduled messages, sorted by the delivery time.
+	ListScheduled(context.Context, *ListScheduledRequest) (*ListScheduledResponse, error)
+	// Cancel the pending scheduled message.
+	CancelScheduled(context.Context, *CancelScheduledRequest) (*empty.Empty, error)
+	// List the recent traces of the traced messages, the most recently started one first.
+	ListTraces(context.Context, *ListTracesRequest) (*ListTracesResponse, error)
+	// Publish a stream of messages to broker, the messages are published in order through the same path as Publish.
+	// The invalid requests are skipped and counted in the response.
+	PublishStream(PublishService_PublishStreamServer) error
 	mustEmbedUnimplementedPublishServiceServer()
 }
 
@@ -52,9 +131,21 @@ type PublishServiceServer interface {
 type UnimplementedPublishServiceServer struct {
 }
 
-func (UnimplementedPublishServiceServer) Publish(context.Context, *PublishRequest) (*empty.Empty, error) {
+func (UnimplementedPublishServiceServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
 }
+func (UnimplementedPublishServiceServer) ListScheduled(context.Context, *ListScheduledRequest) (*ListScheduledResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListScheduled not implemented")
+}
+func (UnimplementedPublishServiceServer) CancelScheduled(context.Context, *CancelScheduledRequest) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelScheduled not implemented")
+}
+func (UnimplementedPublishServiceServer) ListTraces(context.Context, *ListTracesRequest) (*ListTracesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTraces not implemented")
+}
+func (UnimplementedPublishServiceServer) PublishStream(PublishService_PublishStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method PublishStream not implemented")
+}
 func (UnimplementedPublishServiceServer) mustEmbedUnimplementedPublishServiceServer() {}
 
 // UnsafePublishServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -86,6 +177,86 @@ func _PublishService_Publish_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _PublishService_ListScheduled_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListScheduledRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PublishServiceServer).ListScheduled(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.PublishService/ListScheduled",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PublishServiceServer).ListScheduled(ctx, req.(*ListScheduledRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PublishService_CancelScheduled_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelScheduledRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PublishServiceServer).CancelScheduled(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.PublishService/CancelScheduled",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PublishServiceServer).CancelScheduled(ctx, req.(*CancelScheduledRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PublishService_ListTraces_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTracesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PublishServiceServer).ListTraces(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.PublishService/ListTraces",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PublishServiceServer).ListTraces(ctx, req.(*ListTracesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PublishService_PublishStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PublishServiceServer).PublishStream(&publishServicePublishStreamServer{stream})
+}
+
+type PublishService_PublishStreamServer interface {
+	SendAndClose(*PublishStreamResponse) error
+	Recv() (*PublishRequest, error)
+	grpc.ServerStream
+}
+
+type publishServicePublishStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *publishServicePublishStreamServer) SendAndClose(m *PublishStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *publishServicePublishStreamServer) Recv() (*PublishRequest, error) {
+	m := new(PublishRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _PublishService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "gmqtt.admin.api.PublishService",
 	HandlerType: (*PublishServiceServer)(nil),
@@ -94,7 +265,25 @@ var _PublishService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Publish",
 			Handler:    _PublishService_Publish_Handler,
 		},
+		{
+			MethodName: "ListScheduled",
+			Handler:    _PublishService_ListScheduled_Handler,
+		},
+		{
+			MethodName: "CancelScheduled",
+			Handler:    _PublishService_CancelScheduled_Handler,
+		},
+		{
+			MethodName: "ListTraces",
+			Handler:    _PublishService_ListTraces_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PublishStream",
+			Handler:       _PublishService_PublishStream_Handler,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "publish.proto",
 }
@@ -2,13 +2,22 @@ package admin
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/server"
 )
@@ -41,7 +50,7 @@ func TestPublisher_Publish(t *testing.T) {
 			},
 		},
 	}
-	mp.EXPECT().Publish(msg)
+	mp.EXPECT().PublishRetained(msg).Return(nil)
 	_, err := pub.Publish(context.Background(), &PublishRequest{
 		TopicName:       msg.Topic,
 		Payload:         string(msg.Payload),
@@ -60,6 +69,17 @@ func TestPublisher_Publish(t *testing.T) {
 		},
 	})
 	a.Nil(err)
+
+	// the message rejected by the broker.
+	mp.EXPECT().PublishRetained(&gmqtt.Message{Retained: true, Topic: "topic", Payload: []byte{}, CorrelationData: []byte{}}).Return(errors.New("rejected"))
+	_, err = pub.Publish(context.Background(), &PublishRequest{
+		TopicName: "topic",
+		Retained:  true,
+	})
+	s, ok := status.FromError(err)
+	a.True(ok)
+	a.Equal(codes.FailedPrecondition, s.Code())
+	a.Contains(s.Message(), "rejected")
 }
 
 func TestPublisher_Publish_InvalidArgument(t *testing.T) {
@@ -76,6 +96,13 @@ func TestPublisher_Publish_InvalidArgument(t *testing.T) {
 				Qos:       2,
 			},
 		},
+		{
+			name:  "empty_topic_name",
+			field: "topic_name",
+			req: &PublishRequest{
+				Qos: 1,
+			},
+		},
 		{
 			name:  "invalid_qos",
 			field: "qos",
@@ -103,6 +130,23 @@ func TestPublisher_Publish_InvalidArgument(t *testing.T) {
 				ResponseTopic: "#/",
 			},
 		},
+		{
+			name:  "deliver_at_and_delay_seconds",
+			field: "delay_seconds",
+			req: &PublishRequest{
+				TopicName:    "a",
+				DeliverAt:    timestamppb.Now(),
+				DelaySeconds: 1,
+			},
+		},
+		{
+			name:  "invalid_deliver_at",
+			field: "deliver_at",
+			req: &PublishRequest{
+				TopicName: "a",
+				DeliverAt: &timestamppb.Timestamp{Nanos: -1},
+			},
+		},
 	}
 	for _, v := range tt {
 		t.Run(v.name, func(t *testing.T) {
@@ -123,3 +167,328 @@ func TestPublisher_Publish_InvalidArgument(t *testing.T) {
 	}
 
 }
+
+func TestPublisher_Publish_scheduled(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mp := server.NewMockPublisher(ctrl)
+	ms := server.NewMockScheduleService(ctrl)
+	pub := &publisher{
+		a: &Admin{
+			publisher:       mp,
+			scheduleService: ms,
+		},
+	}
+	msg := &gmqtt.Message{Topic: "topic", Payload: []byte("abc"), Retained: true, CorrelationData: []byte{}}
+	deliverAt := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	ms.EXPECT().Schedule(msg, deliverAt.UTC()).Return("id", nil)
+	resp, err := pub.Publish(context.Background(), &PublishRequest{
+		TopicName: "topic",
+		Payload:   "abc",
+		Retained:  true,
+		DeliverAt: timestamppb.New(deliverAt),
+	})
+	a.Nil(err)
+	a.Equal("id", resp.ScheduledId)
+
+	ms.EXPECT().Schedule(msg, gomock.Any()).DoAndReturn(func(msg *gmqtt.Message, at time.Time) (string, error) {
+		a.WithinDuration(time.Now().Add(10*time.Second), at, time.Second)
+		return "id2", nil
+	})
+	resp, err = pub.Publish(context.Background(), &PublishRequest{
+		TopicName:    "topic",
+		Payload:      "abc",
+		Retained:     true,
+		DelaySeconds: 10,
+	})
+	a.Nil(err)
+	a.Equal("id2", resp.ScheduledId)
+
+	ms.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return("", errors.New("error"))
+	_, err = pub.Publish(context.Background(), &PublishRequest{
+		TopicName:    "topic",
+		DelaySeconds: 10,
+	})
+	a.Equal(codes.Internal, status.Code(err))
+
+	// the message is published immediately if deliver_at is in the past.
+	mp.EXPECT().PublishRetained(&gmqtt.Message{Topic: "topic", Payload: []byte("abc"), CorrelationData: []byte{}}).Return(nil)
+	resp, err = pub.Publish(context.Background(), &PublishRequest{
+		TopicName: "topic",
+		Payload:   "abc",
+		DeliverAt: timestamppb.New(time.Now().Add(-time.Hour)),
+	})
+	a.Nil(err)
+	a.Empty(resp.ScheduledId)
+}
+
+func TestPublisher_ListScheduled(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ms := server.NewMockScheduleService(ctrl)
+	pub := &publisher{
+		a: &Admin{
+			scheduleService: ms,
+		},
+	}
+	now := time.Unix(100, 0)
+	ms.EXPECT().List().Return([]*scheduled.Message{
+		{ID: "1", DeliverAt: now, Message: &gmqtt.Message{Topic: "a", Payload: []byte("a"), QoS: 1}},
+		{ID: "2", DeliverAt: now.Add(time.Second), Message: &gmqtt.Message{Topic: "b", Retained: true}},
+	}).Times(2)
+	resp, err := pub.ListScheduled(context.Background(), &ListScheduledRequest{PageSize: 1, Page: 2})
+	a.Nil(err)
+	a.EqualValues(2, resp.TotalCount)
+	a.Len(resp.ScheduledMessages, 1)
+	a.Equal("2", resp.ScheduledMessages[0].Id)
+	a.True(resp.ScheduledMessages[0].Retained)
+	a.True(now.Add(time.Second).Equal(resp.ScheduledMessages[0].DeliverAt.AsTime()))
+
+	resp, err = pub.ListScheduled(context.Background(), &ListScheduledRequest{PageSize: 1, Page: 3})
+	a.Nil(err)
+	a.Empty(resp.ScheduledMessages)
+}
+
+func TestPublisher_CancelScheduled(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ms := server.NewMockScheduleService(ctrl)
+	pub := &publisher{
+		a: &Admin{
+			scheduleService: ms,
+		},
+	}
+	_, err := pub.CancelScheduled(context.Background(), &CancelScheduledRequest{})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+
+	ms.EXPECT().Cancel("id").Return(nil)
+	_, err = pub.CancelScheduled(context.Background(), &CancelScheduledRequest{Id: "id"})
+	a.Nil(err)
+
+	ms.EXPECT().Cancel("id").Return(server.ErrScheduledNotFound)
+	_, err = pub.CancelScheduled(context.Background(), &CancelScheduledRequest{Id: "id"})
+	a.Equal(ErrNotFound, err)
+
+	ms.EXPECT().Cancel("id").Return(errors.New("error"))
+	_, err = pub.CancelScheduled(context.Background(), &CancelScheduledRequest{Id: "id"})
+	a.Equal(codes.Internal, status.Code(err))
+}
+
+type testMessageTracer []server.MessageTrace
+
+func (t testMessageTracer) Recent() []server.MessageTrace {
+	return t
+}
+
+func TestPublisher_ListTraces(t *testing.T) {
+	a := assert.New(t)
+	pub := &publisher{
+		a: &Admin{},
+	}
+	_, err := pub.ListTraces(context.Background(), &ListTracesRequest{})
+	a.Equal(codes.FailedPrecondition, status.Code(err))
+
+	now := time.Unix(100, 0)
+	pub.a.messageTracer = testMessageTracer{
+		{ID: "2", Topic: "b", StartedAt: now.Add(time.Second)},
+		{ID: "1", Topic: "a", StartedAt: now, DiscardedEvents: 1, Events: []server.TraceEvent{
+			{Stage: server.TraceReceived, At: now, ClientID: "pub"},
+			{Stage: server.TraceDropped, At: now, ClientID: "sub", Reason: "the message queue is full"},
+		}},
+	}
+	resp, err := pub.ListTraces(context.Background(), &ListTracesRequest{PageSize: 1, Page: 2})
+	a.Nil(err)
+	a.EqualValues(2, resp.TotalCount)
+	a.Len(resp.Traces, 1)
+	tr := resp.Traces[0]
+	a.Equal("1", tr.Id)
+	a.Equal("a", tr.TopicName)
+	a.EqualValues(1, tr.DiscardedEvents)
+	a.True(now.Equal(tr.StartedAt.AsTime()))
+	a.Len(tr.Events, 2)
+	a.Equal("dropped", tr.Events[1].Stage)
+	a.Equal("sub", tr.Events[1].ClientId)
+	a.Equal("the message queue is full", tr.Events[1].Reason)
+
+	resp, err = pub.ListTraces(context.Background(), &ListTracesRequest{Id: "2"})
+	a.Nil(err)
+	a.EqualValues(1, resp.TotalCount)
+	a.Equal("2", resp.Traces[0].Id)
+
+	resp, err = pub.ListTraces(context.Background(), &ListTracesRequest{Id: "3"})
+	a.Nil(err)
+	a.Empty(resp.Traces)
+}
+
+func TestPublisher_waitQueueCapacity(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	timeout := publishStreamWaitTimeout
+	publishStreamWaitTimeout = 50 * time.Millisecond
+	defer func() {
+		publishStreamWaitTimeout = timeout
+	}()
+
+	sr := server.NewMockStatsReader(ctrl)
+	cs := server.NewMockClientService(ctrl)
+	cfg := config.DefaultConfig()
+	cfg.MQTT.MaxQueuedMsg = 2
+	pub := &publisher{
+		a: &Admin{
+			statsReader:   sr,
+			clientService: cs,
+			getConfig: func() config.Config {
+				return cfg
+			},
+			resolveSubscribers: func(req *server.ResolveRequest) []server.ResolvedSubscriber {
+				return []server.ResolvedSubscriber{
+					{ClientID: "online", Receives: true},
+					{ClientID: "offline", Receives: true},
+					{ClientID: "not_selected"},
+				}
+			},
+		},
+	}
+	queued := func(n uint64) server.ClientStats {
+		var sts server.ClientStats
+		sts.MessageStats.QueuedCurrent = n
+		return sts
+	}
+	cs.EXPECT().GetClient("online").Return(server.NewMockClient(ctrl)).AnyTimes()
+	cs.EXPECT().GetClient("offline").Return(nil).AnyTimes()
+
+	// waits until the queue of the connected subscriber has capacity.
+	gomock.InOrder(
+		sr.EXPECT().GetClientStats("online").Return(queued(2), true).Times(2),
+		sr.EXPECT().GetClientStats("online").Return(queued(1), true),
+	)
+	a.Nil(pub.waitQueueCapacity(context.Background(), &PublishRequest{TopicName: "a"}))
+
+	// the queue is still full after the timeout.
+	sr.EXPECT().GetClientStats("online").Return(queued(2), true).AnyTimes()
+	err := pub.waitQueueCapacity(context.Background(), &PublishRequest{TopicName: "a"})
+	a.Equal(codes.ResourceExhausted, status.Code(err))
+
+	// the stream is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.Equal(context.Canceled, pub.waitQueueCapacity(ctx, &PublishRequest{TopicName: "a"}))
+}
+
+// TestPublisher_PublishStream streams the messages to a running broker and asserts that they are routed to the subscriber in order.
+func TestPublisher_PublishStream(t *testing.T) {
+	a := assert.New(t)
+	const n = 10000
+
+	grpcAddr := freeAddr(t)
+	cfg := config.DefaultConfig()
+	cfg.API.GRPC = []*config.Endpoint{{Address: "tcp://" + grpcAddr}}
+	cfg.API.HTTP = nil
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	srv := server.New(
+		server.WithConfig(cfg),
+		server.WithTCPListener(ln),
+		server.WithPlugin(NewAdmin()),
+	)
+	go srv.Run()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Nil(srv.Stop(ctx))
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", ln.Addr().String()); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.Nil(err) {
+		return
+	}
+	defer conn.Close()
+	w, r := packets.NewWriter(conn), packets.NewReader(conn)
+	a.Nil(w.WriteAndFlush(&packets.Connect{
+		Version:       packets.Version311,
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: byte(packets.Version311),
+		CleanStart:    true,
+		KeepAlive:     60,
+		ClientID:      []byte("sub"),
+	}))
+	p, err := r.ReadPacket()
+	a.Nil(err)
+	a.IsType(&packets.Connack{}, p)
+	a.Nil(w.WriteAndFlush(&packets.Subscribe{
+		Version:  packets.Version311,
+		PacketID: 1,
+		Topics:   []packets.Topic{{Name: "stream/#"}},
+	}))
+	p, err = r.ReadPacket()
+	a.Nil(err)
+	a.IsType(&packets.Suback{}, p)
+
+	received := make(chan []string, 1)
+	go func() {
+		var payloads []string
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for len(payloads) < n {
+			p, err := r.ReadPacket()
+			if err != nil {
+				break
+			}
+			if pub, ok := p.(*packets.Publish); ok {
+				payloads = append(payloads, string(pub.Payload))
+			}
+		}
+		received <- payloads
+	}()
+
+	var cc *grpc.ClientConn
+	cc, err = grpc.Dial(grpcAddr, grpc.WithInsecure())
+	if !a.Nil(err) {
+		return
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the gRPC server may not be listening yet.
+	var stream PublishService_PublishStreamClient
+	for i := 0; i < 100; i++ {
+		if stream, err = NewPublishServiceClient(cc).PublishStream(ctx, grpc.WaitForReady(true)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.Nil(err) {
+		return
+	}
+	var expected []string
+	for i := 0; i < n; i++ {
+		payload := fmt.Sprintf("%05d", i)
+		expected = append(expected, payload)
+		a.Nil(stream.Send(&PublishRequest{TopicName: "stream/" + payload[4:], Payload: payload}))
+		if i == n/2 {
+			// the invalid request is skipped.
+			a.Nil(stream.Send(&PublishRequest{TopicName: "stream/+"}))
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if !a.Nil(err) {
+		return
+	}
+	a.EqualValues(n, resp.PublishedCount)
+	a.EqualValues(1, resp.RejectedCount)
+	a.True(resp.Duration.AsDuration() > 0)
+
+	a.Equal(expected, <-received)
+}
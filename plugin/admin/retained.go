@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"context"
+	"sort"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/retained"
+)
+
+type retainedService struct {
+	a *Admin
+}
+
+func (r *retainedService) mustEmbedUnimplementedRetainedServiceServer() {
+	return
+}
+
+// List lists the retained messages in the broker, sorted by the topic name.
+// The messages are read from the retained store of the broker on each call.
+func (r *retainedService) List(ctx context.Context, req *ListRetainedRequest) (*ListRetainedResponse, error) {
+	rs := make([]*RetainedMessage, 0)
+	r.a.retainedService.Iterate(func(message *gmqtt.Message) bool {
+		rs = append(rs, &RetainedMessage{
+			TopicName:   message.Topic,
+			PayloadSize: uint32(len(message.Payload)),
+			Qos:         uint32(message.QoS),
+		})
+		return true
+	})
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].TopicName < rs[j].TopicName
+	})
+	total := uint32(len(rs))
+	offset, n := GetOffsetN(GetPage(req.Page, req.PageSize))
+	if offset >= uint(len(rs)) {
+		rs = rs[:0]
+	} else {
+		end := offset + n
+		if end > uint(len(rs)) {
+			end = uint(len(rs))
+		}
+		rs = rs[offset:end]
+	}
+	if sr, ok := r.a.retainedService.(retained.StoredAtReader); ok {
+		for _, v := range rs {
+			if storedAt, ok := sr.StoredAt(v.TopicName); ok {
+				v.StoredAt = timestamppb.New(storedAt)
+			}
+		}
+	}
+	return &ListRetainedResponse{
+		RetainedMessages: rs,
+		TotalCount:       total,
+	}, nil
+}
+
+// Delete deletes the retained message of the topic name.
+// If filter is set, the retained messages matching the topic filter are deleted.
+func (r *retainedService) Delete(ctx context.Context, req *DeleteRetainedRequest) (*DeleteRetainedResponse, error) {
+	if req.Filter {
+		if !packets.ValidTopicFilter(true, []byte(req.TopicName)) {
+			return nil, ErrInvalidArgument("topic_name", "")
+		}
+		msgs := r.a.retainedService.GetMatchedMessages(req.TopicName)
+		for _, v := range msgs {
+			r.a.retainedService.Remove(v.Topic)
+		}
+		return &DeleteRetainedResponse{
+			Deleted: uint32(len(msgs)),
+		}, nil
+	}
+	if req.TopicName == "" || !packets.ValidTopicName(true, []byte(req.TopicName)) {
+		return nil, ErrInvalidArgument("topic_name", "")
+	}
+	if r.a.retainedService.GetRetainedMessage(req.TopicName) == nil {
+		return nil, ErrNotFound
+	}
+	r.a.retainedService.Remove(req.TopicName)
+	return &DeleteRetainedResponse{
+		Deleted: 1,
+	}, nil
+}
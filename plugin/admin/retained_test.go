@@ -0,0 +1,97 @@
+package admin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/retained/trie"
+)
+
+func newRetainedService() *retainedService {
+	s := trie.NewStore()
+	for _, v := range []string{"sensor/2/temp", "sensor/1/temp", "sensor/1/humidity", "device/1", "$SYS/uptime"} {
+		s.AddOrReplace(&gmqtt.Message{
+			Topic:    v,
+			QoS:      1,
+			Retained: true,
+			Payload:  []byte(v),
+		})
+	}
+	return &retainedService{
+		a: &Admin{
+			retainedService: s,
+		},
+	}
+}
+
+func TestRetainedService_List(t *testing.T) {
+	a := assert.New(t)
+	r := newRetainedService()
+
+	resp, err := r.List(context.Background(), &ListRetainedRequest{})
+	a.Nil(err)
+	a.EqualValues(5, resp.TotalCount)
+	var topics []string
+	for _, v := range resp.RetainedMessages {
+		topics = append(topics, v.TopicName)
+		a.EqualValues(len(v.TopicName), v.PayloadSize)
+		a.EqualValues(1, v.Qos)
+		a.NotNil(v.StoredAt)
+	}
+	a.Equal([]string{"$SYS/uptime", "device/1", "sensor/1/humidity", "sensor/1/temp", "sensor/2/temp"}, topics)
+
+	resp, err = r.List(context.Background(), &ListRetainedRequest{Page: 2, PageSize: 3})
+	a.Nil(err)
+	a.EqualValues(5, resp.TotalCount)
+	a.Len(resp.RetainedMessages, 2)
+	a.Equal("sensor/1/temp", resp.RetainedMessages[0].TopicName)
+
+	resp, err = r.List(context.Background(), &ListRetainedRequest{Page: 3, PageSize: 3})
+	a.Nil(err)
+	a.EqualValues(5, resp.TotalCount)
+	a.Empty(resp.RetainedMessages)
+}
+
+func TestRetainedService_Delete(t *testing.T) {
+	a := assert.New(t)
+	r := newRetainedService()
+	store := r.a.retainedService
+
+	resp, err := r.Delete(context.Background(), &DeleteRetainedRequest{TopicName: "device/1"})
+	a.Nil(err)
+	a.EqualValues(1, resp.Deleted)
+	a.Nil(store.GetRetainedMessage("device/1"))
+
+	_, err = r.Delete(context.Background(), &DeleteRetainedRequest{TopicName: "device/1"})
+	a.Equal(ErrNotFound, err)
+
+	resp, err = r.Delete(context.Background(), &DeleteRetainedRequest{TopicName: "sensor/1/#", Filter: true})
+	a.Nil(err)
+	a.EqualValues(2, resp.Deleted)
+	a.Nil(store.GetRetainedMessage("sensor/1/temp"))
+	a.Nil(store.GetRetainedMessage("sensor/1/humidity"))
+	a.NotNil(store.GetRetainedMessage("sensor/2/temp"))
+
+	// the wildcards do not match the system topics.
+	resp, err = r.Delete(context.Background(), &DeleteRetainedRequest{TopicName: "#", Filter: true})
+	a.Nil(err)
+	a.EqualValues(1, resp.Deleted)
+	a.NotNil(store.GetRetainedMessage("$SYS/uptime"))
+
+	for _, v := range []*DeleteRetainedRequest{
+		{TopicName: ""},
+		{TopicName: "sensor/+"},
+		{TopicName: "", Filter: true},
+		{TopicName: "sensor/#/a", Filter: true},
+	} {
+		_, err = r.Delete(context.Background(), v)
+		s, ok := status.FromError(err)
+		a.True(ok)
+		a.Equal(codes.InvalidArgument, s.Code())
+	}
+}
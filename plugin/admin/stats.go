@@ -0,0 +1,190 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+type statsService struct {
+	a *Admin
+}
+
+func (s *statsService) mustEmbedUnimplementedStatsServiceServer() {
+	return
+}
+
+// GetGlobalStats returns the broker-wide aggregate statistics.
+func (s *statsService) GetGlobalStats(ctx context.Context, req *empty.Empty) (*GetGlobalStatsResponse, error) {
+	sts := s.a.statsReader.GetGlobalStats()
+	msg := sts.MessageStats
+	return &GetGlobalStatsResponse{
+		ClientsConnected:           sts.ConnectionStats.ActiveCurrent,
+		SessionsTotal:              sts.ConnectionStats.ActiveCurrent + sts.ConnectionStats.InactiveCurrent,
+		SubscriptionsCurrent:       sts.SubscriptionStats.SubscriptionsCurrent,
+		SubscriptionsTotal:         sts.SubscriptionStats.SubscriptionsTotal,
+		MessagesReceivedTotal:      msg.Qos0.ReceivedTotal + msg.Qos1.ReceivedTotal + msg.Qos2.ReceivedTotal,
+		MessagesSentTotal:          msg.Qos0.SentTotal + msg.Qos1.SentTotal + msg.Qos2.SentTotal,
+		MessagesDroppedTotal:       msg.GetDroppedTotal(),
+		MessagesInflightCurrent:    msg.InflightCurrent,
+		MessagesQueuedCurrent:      msg.QueuedCurrent,
+		PacketsReceivedBytesTotal:  sts.PacketStats.BytesReceived.Total,
+		PacketsSentBytesTotal:      sts.PacketStats.BytesSent.Total,
+		RetainedMessagesCurrent:    sts.RetainedStats.RetainedMessages,
+		RetainedBytesCurrent:       sts.RetainedStats.RetainedBytes,
+		ConnectionsCurrent:         sts.ConnectionStats.ConnectionsCurrent,
+		SubscriptionsRejectedTotal: sts.ConnectionStats.SubscriptionsRejectedTotal,
+		RetainedEvictedTotal:       sts.RetainedStats.EvictedTotal,
+		RetainedRejectedTotal:      sts.RetainedStats.RejectedTotal,
+	}, nil
+}
+
+// GetClientStats returns the statistics of the client.
+func (s *statsService) GetClientStats(ctx context.Context, req *GetClientStatsRequest) (*GetClientStatsResponse, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "")
+	}
+	sts, ok := s.a.statsReader.GetClientStats(req.ClientId)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &GetClientStatsResponse{
+		Stats: newClientStats(sts),
+	}, nil
+}
+
+// ResetClientStats resets the counters of the client statistics at the stats reader,
+// and returns the statistics right before the reset.
+func (s *statsService) ResetClientStats(ctx context.Context, req *ResetClientStatsRequest) (*ResetClientStatsResponse, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "")
+	}
+	resetter, ok := s.a.statsReader.(server.ClientStatsResetter)
+	if !ok {
+		return nil, ErrUnimplemented("the stats reader does not support reset")
+	}
+	sts, ok := resetter.ResetClientStats(req.ClientId)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &ResetClientStatsResponse{
+		Stats: newClientStats(sts),
+	}, nil
+}
+
+// maxTopTopicsLimit is the maximum TopTopicsRequest.Limit.
+const maxTopTopicsLimit = 1000
+
+// TopTopics returns the most published topics, see config.TopicStats.
+func (s *statsService) TopTopics(ctx context.Context, req *TopTopicsRequest) (*TopTopicsResponse, error) {
+	if req.Limit > maxTopTopicsLimit {
+		return nil, ErrInvalidArgument("limit", fmt.Sprintf("must not be greater than %d", maxTopTopicsLimit))
+	}
+	reader, ok := s.a.statsReader.(server.TopTopicsReader)
+	if !ok {
+		return nil, ErrUnimplemented("the stats reader does not support topic statistics")
+	}
+	_, limit := GetPage(0, req.Limit)
+	topics, enabled := reader.TopTopics(int(limit))
+	if !enabled {
+		return nil, ErrFailedPrecondition(ReasonTopicStatsDisabled, "the topic statistics is disabled")
+	}
+	rs := make([]*TopicStats, 0, len(topics))
+	for _, v := range topics {
+		rs = append(rs, &TopicStats{
+			TopicName:    v.TopicName,
+			PublishTotal: v.PublishTotal,
+			PublishBytes: v.PublishBytes,
+			Error:        v.Error,
+		})
+	}
+	return &TopTopicsResponse{
+		Topics: rs,
+	}, nil
+}
+
+func newClientStats(sts server.ClientStats) *ClientStats {
+	rs := &ClientStats{
+		SubscriptionsCurrent:     uint32(sts.SubscriptionStats.SubscriptionsCurrent),
+		SubscriptionsTotal:       uint32(sts.SubscriptionStats.SubscriptionsTotal),
+		PacketsReceivedBytes:     sts.PacketStats.BytesReceived.Total,
+		PacketsReceivedNums:      sts.PacketStats.ReceivedTotal.Total,
+		PacketsSendBytes:         sts.PacketStats.BytesSent.Total,
+		PacketsSendNums:          sts.PacketStats.SentTotal.Total,
+		MessageDropped:           sts.MessageStats.GetDroppedTotal(),
+		InflightLen:              uint32(sts.MessageStats.InflightCurrent),
+		QueueLen:                 uint32(sts.MessageStats.QueuedCurrent),
+		CpuReadNanoseconds:       sts.CPUStats.ReadNanoseconds,
+		CpuWriteNanoseconds:      sts.CPUStats.WriteNanoseconds,
+		OldestQueuedMessageAge:   durationpb.New(sts.MessageStats.OldestQueuedMessageAge(time.Now())),
+		PublishMessagesPerSecond: sts.PublishRateStats.MessagesPerSecond,
+		PublishBytesPerSecond:    sts.PublishRateStats.BytesPerSecond,
+		PublishLimitedTotal:      sts.PublishRateStats.LimitedTotal,
+	}
+	if !sts.LastPacketReceivedAt.IsZero() {
+		rs.LastPacketReceivedAt = timestamppb.New(sts.LastPacketReceivedAt)
+	}
+	return rs
+}
+
+// statsCounters returns the resettable counters of the global statistics.
+func statsCounters(sts server.GlobalStats) map[string]uint64 {
+	conn := sts.ConnectionStats
+	msg := sts.MessageStats
+	return map[string]uint64{
+		"packets_received_bytes_total":         sts.PacketStats.BytesReceived.Total,
+		"packets_received_total":               sts.PacketStats.ReceivedTotal.Total,
+		"packets_sent_bytes_total":             sts.PacketStats.BytesSent.Total,
+		"packets_sent_total":                   sts.PacketStats.SentTotal.Total,
+		"clients_connected_total":              conn.ConnectedTotal,
+		"clients_disconnected_total":           conn.DisconnectedTotal,
+		"sessions_created_total":               conn.SessionCreatedTotal,
+		"sessions_terminated_taken_over_total": conn.SessionTerminated.TakenOver,
+		"sessions_terminated_expired_total":    conn.SessionTerminated.Expired,
+		"sessions_terminated_normal_total":     conn.SessionTerminated.Normal,
+		"reconnect_storm_rejected_total":       conn.ReconnectStormRejectedTotal,
+		"error_logs_suppressed_total":          conn.ErrorLogsSuppressedTotal,
+		"persistence_rejected_total":           conn.PersistenceRejectedTotal,
+		"messages_received_total":              msg.Qos0.ReceivedTotal + msg.Qos1.ReceivedTotal + msg.Qos2.ReceivedTotal,
+		"messages_sent_total":                  msg.Qos0.SentTotal + msg.Qos1.SentTotal + msg.Qos2.SentTotal,
+		"messages_dropped_total":               msg.GetDroppedTotal(),
+		"subscriptions_total":                  sts.SubscriptionStats.SubscriptionsTotal,
+		"subscriptions_rejected_total":         conn.SubscriptionsRejectedTotal,
+		"retained_evicted_total":               sts.RetainedStats.EvictedTotal,
+		"retained_rejected_total":              sts.RetainedStats.RejectedTotal,
+	}
+}
+
+// statsGauges returns the gauges of the global statistics.
+func statsGauges(sts server.GlobalStats) map[string]uint64 {
+	return map[string]uint64{
+		"sessions_active_current":    sts.ConnectionStats.ActiveCurrent,
+		"sessions_inactive_current":  sts.ConnectionStats.InactiveCurrent,
+		"connections_current":        sts.ConnectionStats.ConnectionsCurrent,
+		"reconnect_storm_mitigating": sts.ConnectionStats.ReconnectStormMitigating,
+		"persistence_unhealthy":      sts.ConnectionStats.PersistenceUnhealthy,
+		"messages_inflight_current":  sts.MessageStats.InflightCurrent,
+		"messages_queued_current":    sts.MessageStats.QueuedCurrent,
+		"subscriptions_current":      sts.SubscriptionStats.SubscriptionsCurrent,
+		"retained_bytes_current":     sts.RetainedStats.RetainedBytes,
+		"retained_messages_current":  sts.RetainedStats.RetainedMessages,
+	}
+}
+
+// selectCounters returns the counters for the given names, returns all counters if names is empty.
+func selectCounters(counters map[string]uint64, names []string) map[string]uint64 {
+	if len(names) == 0 {
+		return counters
+	}
+	rs := make(map[string]uint64, len(names))
+	for _, v := range names {
+		rs[v] = counters[v]
+	}
+	return rs
+}
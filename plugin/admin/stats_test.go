@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+func TestStatsService_GetGlobalStats(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := server.NewMockStatsReader(ctrl)
+	s := &statsService{a: &Admin{statsReader: sr}}
+
+	sts := server.GlobalStats{}
+	sts.ConnectionStats.ActiveCurrent = 3
+	sts.ConnectionStats.InactiveCurrent = 2
+	sts.SubscriptionStats.SubscriptionsCurrent = 4
+	sts.SubscriptionStats.SubscriptionsTotal = 6
+	sts.MessageStats.Qos0.ReceivedTotal = 1
+	sts.MessageStats.Qos1.ReceivedTotal = 2
+	sts.MessageStats.Qos2.SentTotal = 3
+	sts.MessageStats.Qos1.DroppedTotal.Internal = 1
+	sts.MessageStats.QueuedCurrent = 5
+	sts.PacketStats.BytesReceived.Total = 100
+	sts.PacketStats.BytesSent.Total = 200
+	sts.RetainedStats.RetainedMessages = 7
+	sts.RetainedStats.RetainedBytes = 300
+	sts.ConnectionStats.ConnectionsCurrent = 8
+	sts.ConnectionStats.SubscriptionsRejectedTotal = 9
+	sts.RetainedStats.EvictedTotal = 10
+	sts.RetainedStats.RejectedTotal = 11
+	sr.EXPECT().GetGlobalStats().Return(sts)
+
+	resp, err := s.GetGlobalStats(context.Background(), &empty.Empty{})
+	a.Nil(err)
+	a.Equal(&GetGlobalStatsResponse{
+		ClientsConnected:           3,
+		SessionsTotal:              5,
+		SubscriptionsCurrent:       4,
+		SubscriptionsTotal:         6,
+		MessagesReceivedTotal:      3,
+		MessagesSentTotal:          3,
+		MessagesDroppedTotal:       1,
+		MessagesQueuedCurrent:      5,
+		PacketsReceivedBytesTotal:  100,
+		PacketsSentBytesTotal:      200,
+		RetainedMessagesCurrent:    7,
+		RetainedBytesCurrent:       300,
+		ConnectionsCurrent:         8,
+		SubscriptionsRejectedTotal: 9,
+		RetainedEvictedTotal:       10,
+		RetainedRejectedTotal:      11,
+	}, resp)
+}
+
+func TestStatsService_GetClientStats(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sr := server.NewMockStatsReader(ctrl)
+	s := &statsService{a: &Admin{statsReader: sr}}
+
+	_, err := s.GetClientStats(context.Background(), &GetClientStatsRequest{})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+
+	sr.EXPECT().GetClientStats("unknown").Return(server.ClientStats{}, false)
+	_, err = s.GetClientStats(context.Background(), &GetClientStatsRequest{ClientId: "unknown"})
+	a.Equal(ErrNotFound, err)
+
+	sts := server.ClientStats{}
+	sts.SubscriptionStats.SubscriptionsCurrent = 1
+	sts.PacketStats.ReceivedTotal.Total = 2
+	sts.MessageStats.QueuedCurrent = 3
+	sr.EXPECT().GetClientStats("cid").Return(sts, true)
+	resp, err := s.GetClientStats(context.Background(), &GetClientStatsRequest{ClientId: "cid"})
+	a.Nil(err)
+	a.EqualValues(1, resp.Stats.SubscriptionsCurrent)
+	a.EqualValues(2, resp.Stats.PacketsReceivedNums)
+	a.EqualValues(3, resp.Stats.QueueLen)
+	a.Nil(resp.Stats.LastPacketReceivedAt)
+}
+
+type testClientStatsResetter struct {
+	server.StatsReader
+	sts   server.ClientStats
+	reset []string
+}
+
+func (t *testClientStatsResetter) ResetClientStats(clientID string) (server.ClientStats, bool) {
+	if clientID != "cid" {
+		return server.ClientStats{}, false
+	}
+	t.reset = append(t.reset, clientID)
+	return t.sts, true
+}
+
+func TestStatsService_ResetClientStats(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the stats reader does not implement server.ClientStatsResetter
+	s := &statsService{a: &Admin{statsReader: server.NewMockStatsReader(ctrl)}}
+	_, err := s.ResetClientStats(context.Background(), &ResetClientStatsRequest{ClientId: "cid"})
+	a.Equal(codes.Unimplemented, status.Code(err))
+
+	sr := &testClientStatsResetter{StatsReader: server.NewMockStatsReader(ctrl)}
+	sr.sts.PacketStats.SentTotal.Total = 5
+	s = &statsService{a: &Admin{statsReader: sr}}
+
+	_, err = s.ResetClientStats(context.Background(), &ResetClientStatsRequest{})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+
+	_, err = s.ResetClientStats(context.Background(), &ResetClientStatsRequest{ClientId: "unknown"})
+	a.Equal(ErrNotFound, err)
+
+	resp, err := s.ResetClientStats(context.Background(), &ResetClientStatsRequest{ClientId: "cid"})
+	a.Nil(err)
+	a.EqualValues(5, resp.Stats.PacketsSendNums)
+	a.Equal([]string{"cid"}, sr.reset)
+}
+
+type testTopTopicsReader struct {
+	server.StatsReader
+	topics  []server.TopicStats
+	enabled bool
+	n       int
+}
+
+func (t *testTopTopicsReader) TopTopics(n int) ([]server.TopicStats, bool) {
+	t.n = n
+	if !t.enabled {
+		return nil, false
+	}
+	return t.topics, true
+}
+
+func TestStatsService_TopTopics(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the stats reader does not implement server.TopTopicsReader
+	s := &statsService{a: &Admin{statsReader: server.NewMockStatsReader(ctrl)}}
+	_, err := s.TopTopics(context.Background(), &TopTopicsRequest{})
+	a.Equal(codes.Unimplemented, status.Code(err))
+
+	sr := &testTopTopicsReader{StatsReader: server.NewMockStatsReader(ctrl)}
+	s = &statsService{a: &Admin{statsReader: sr}}
+	_, err = s.TopTopics(context.Background(), &TopTopicsRequest{})
+	a.Equal(codes.FailedPrecondition, status.Code(err))
+	a.Equal(ReasonTopicStatsDisabled, errorReason(err))
+
+	_, err = s.TopTopics(context.Background(), &TopTopicsRequest{Limit: maxTopTopicsLimit + 1})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+
+	sr.enabled = true
+	sr.topics = []server.TopicStats{
+		{TopicName: "a", PublishTotal: 10, PublishBytes: 100},
+		{TopicName: "b", PublishTotal: 5, PublishBytes: 20, Error: 2},
+	}
+	resp, err := s.TopTopics(context.Background(), &TopTopicsRequest{})
+	a.Nil(err)
+	// default limit
+	a.Equal(20, sr.n)
+	a.Len(resp.Topics, 2)
+	a.Equal("a", resp.Topics[0].TopicName)
+	a.EqualValues(10, resp.Topics[0].PublishTotal)
+	a.EqualValues(100, resp.Topics[0].PublishBytes)
+	a.Equal("b", resp.Topics[1].TopicName)
+	a.EqualValues(2, resp.Topics[1].Error)
+
+	_, err = s.TopTopics(context.Background(), &TopTopicsRequest{Limit: 1})
+	a.Nil(err)
+	a.Equal(1, sr.n)
+}
@@ -2,39 +2,63 @@ package admin
 
 import (
 	"container/list"
+	"net"
+	"sort"
 	"sync"
+	"time"
 
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/server"
 )
 
 type store struct {
-	clientMu            sync.RWMutex
-	clientIndexer       *Indexer
-	subMu               sync.RWMutex
-	subIndexer          *Indexer
+	clientMu      sync.RWMutex
+	clientIndexer *Indexer
+	subMu         sync.RWMutex
+	subIndexer    *Indexer
+	// clientSubs indexes the subscriptions by client id and topic name, it is guarded by subMu.
+	clientSubs          map[string]map[string]*Subscription
 	config              config.Config
 	statsReader         server.StatsReader
 	subscriptionService server.SubscriptionService
+	// clock is the time source of the broker, see server.WithClock.
+	clock clock.Clock
 }
 
-func newStore(statsReader server.StatsReader, config config.Config) *store {
-	return &store{
+func newStore(statsReader server.StatsReader, config config.Config, keyFunc KeyFunc) *store {
+	s := &store{
 		clientIndexer: NewIndexer(),
 		subIndexer:    NewIndexer(),
+		clientSubs:    make(map[string]map[string]*Subscription),
 		statsReader:   statsReader,
 		config:        config,
+		clock:         clock.New(),
 	}
+	if keyFunc != nil {
+		s.clientIndexer = NewIndexerWithKeyFunc(keyFunc, func(value interface{}) string {
+			return value.(*Client).ClientId
+		})
+		s.subIndexer = NewIndexerWithKeyFunc(keyFunc, func(value interface{}) string {
+			sub := value.(*Subscription)
+			return subscriptionKey(sub.ClientId, sub.TopicName)
+		})
+	}
+	return s
 }
 
-func (s *store) addSubscription(clientID string, sub *gmqtt.Subscription) {
-	s.subMu.Lock()
-	defer s.subMu.Unlock()
+func subscriptionKey(clientID string, topicName string) string {
+	return clientID + "_" + topicName
+}
 
-	subInfo := &Subscription{
+func newSubscriptionInfo(clientID string, sub *gmqtt.Subscription) *Subscription {
+	return &Subscription{
 		TopicName:         sub.GetFullTopicName(),
 		Id:                sub.ID,
 		Qos:               uint32(sub.QoS),
@@ -43,32 +67,73 @@ func (s *store) addSubscription(clientID string, sub *gmqtt.Subscription) {
 		RetainHandling:    uint32(sub.RetainHandling),
 		ClientId:          clientID,
 	}
-	key := clientID + "_" + sub.GetFullTopicName()
-	s.subIndexer.Set(key, subInfo)
+}
+
+func (s *store) addSubscription(clientID string, sub *gmqtt.Subscription) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
 
+	subInfo := newSubscriptionInfo(clientID, sub)
+	s.subIndexer.Set(subscriptionKey(clientID, sub.GetFullTopicName()), subInfo)
+	if s.clientSubs[clientID] == nil {
+		s.clientSubs[clientID] = make(map[string]*Subscription)
+	}
+	s.clientSubs[clientID][subInfo.TopicName] = subInfo
 }
 
 func (s *store) removeSubscription(clientID string, topicName string) {
 	s.subMu.Lock()
 	defer s.subMu.Unlock()
-	s.subIndexer.Remove(clientID + "_" + topicName)
+	s.subIndexer.Remove(subscriptionKey(clientID, topicName))
+	if subs := s.clientSubs[clientID]; subs != nil {
+		delete(subs, topicName)
+		if len(subs) == 0 {
+			delete(s.clientSubs, clientID)
+		}
+	}
+}
+
+// removeClientSubscriptions removes all subscriptions of the client.
+func (s *store) removeClientSubscriptions(clientID string) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for topicName := range s.clientSubs[clientID] {
+		s.subIndexer.Remove(subscriptionKey(clientID, topicName))
+	}
+	delete(s.clientSubs, clientID)
 }
 
-func (s *store) addClient(client server.Client) {
+// addClient adds the client into the store and returns the client id.
+func (s *store) addClient(client server.Client) string {
 	c := newClientInfo(client, uint32(s.config.MQTT.MaxQueuedMsg))
 	s.clientMu.Lock()
 	s.clientIndexer.Set(c.ClientId, c)
 	s.clientMu.Unlock()
+	return c.ClientId
 }
 
-func (s *store) setClientDisconnected(clientID string) {
+// setClientDisconnected marks the client as disconnected, reason is the error which closed the connection, if any.
+func (s *store) setClientDisconnected(clientID string, reason error) {
 	s.clientMu.Lock()
 	defer s.clientMu.Unlock()
 	l := s.clientIndexer.GetByID(clientID)
 	if l == nil {
 		return
 	}
-	l.Value.(*Client).DisconnectedAt = timestamppb.Now()
+	c := l.Value.(*Client)
+	c.DisconnectedAt = timestamppb.New(s.clock.Now())
+	if reason != nil {
+		c.DisconnectReason = reason.Error()
+	}
+}
+
+// setSessionExpiry updates the session expiry interval of the client.
+func (s *store) setSessionExpiry(clientID string, expiry uint32) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	if c := s.getClientByIDLocked(clientID); c != nil {
+		c.SessionExpiry = expiry
+	}
 }
 
 func (s *store) removeClient(clientID string) {
@@ -82,7 +147,7 @@ func (s *store) GetClientByID(clientID string) *Client {
 	s.clientMu.RLock()
 	defer s.clientMu.RUnlock()
 	c := s.getClientByIDLocked(clientID)
-	fillClientInfo(c, s.statsReader)
+	s.fillClientInfo(c)
 	return c
 }
 
@@ -90,6 +155,7 @@ func newClientInfo(client server.Client, maxQueue uint32) *Client {
 	clientOptions := client.ClientOptions()
 	rs := &Client{
 		ClientId:       clientOptions.ClientID,
+		ConnId:         client.ConnID(),
 		Username:       clientOptions.Username,
 		KeepAlive:      int32(clientOptions.KeepAlive),
 		Version:        int32(client.Version()),
@@ -111,11 +177,11 @@ func (s *store) getClientByIDLocked(clientID string) *Client {
 	return nil
 }
 
-func fillClientInfo(c *Client, stsReader server.StatsReader) {
+func (s *store) fillClientInfo(c *Client) {
 	if c == nil {
 		return
 	}
-	sts, ok := stsReader.GetClientStats(c.ClientId)
+	sts, ok := s.statsReader.GetClientStats(c.ClientId)
 	if !ok {
 		return
 	}
@@ -128,32 +194,209 @@ func fillClientInfo(c *Client, stsReader server.StatsReader) {
 	c.MessageDropped = sts.MessageStats.GetDroppedTotal()
 	c.InflightLen = uint32(sts.MessageStats.InflightCurrent)
 	c.QueueLen = uint32(sts.MessageStats.QueuedCurrent)
+	c.OldestQueuedMessageAge = durationpb.New(sts.MessageStats.OldestQueuedMessageAge(s.clock.Now()))
+	c.CpuReadNanoseconds = sts.CPUStats.ReadNanoseconds
+	c.CpuWriteNanoseconds = sts.CPUStats.WriteNanoseconds
+	c.PublishMessagesPerSecond = sts.PublishRateStats.MessagesPerSecond
+	c.PublishBytesPerSecond = sts.PublishRateStats.BytesPerSecond
+	c.PublishLimitedTotal = sts.PublishRateStats.LimitedTotal
+	if !sts.LastPacketReceivedAt.IsZero() {
+		c.LastPacketReceivedAt = timestamppb.New(sts.LastPacketReceivedAt)
+	}
 }
 
-// GetClients
-func (s *store) GetClients(page, pageSize uint) (rs []*Client, total uint32, err error) {
-	rs = make([]*Client, 0)
+// fillSession fills the fields of the last connection of the disconnected session, which the broker does not keep.
+// It is the ListSessionsOptions.Fill of the client list.
+func (s *store) fillSession(v *server.SessionInfo) {
+	if v.Connected {
+		return
+	}
+	s.clientMu.RLock()
+	defer s.clientMu.RUnlock()
+	c := s.getClientByIDLocked(v.ClientID)
+	if c == nil {
+		return
+	}
+	v.Username = c.Username
+	v.ConnID = c.ConnId
+	v.Version = packets.Version(c.Version)
+	v.KeepAlive = uint16(c.KeepAlive)
+	v.RemoteAddr = c.RemoteAddr
+	v.LocalAddr = c.LocalAddr
+}
+
+// newClientFromSession returns the client information of the session listed by server.SessionIterator.
+func (s *store) newClientFromSession(v *server.SessionInfo) *Client {
+	c := &Client{
+		ClientId:      v.ClientID,
+		ConnId:        v.ConnID,
+		Username:      v.Username,
+		KeepAlive:     int32(v.KeepAlive),
+		Version:       int32(v.Version),
+		RemoteAddr:    v.RemoteAddr,
+		LocalAddr:     v.LocalAddr,
+		ConnectedAt:   timestamppb.New(v.ConnectedAt),
+		SessionExpiry: v.SessionExpiry,
+		MaxInflight:   uint32(v.MaxInflight),
+		MaxQueue:      uint32(v.MaxQueue),
+	}
+	if !v.Connected {
+		s.clientMu.RLock()
+		if rec := s.getClientByIDLocked(v.ClientID); rec != nil && rec.DisconnectedAt != nil {
+			c.DisconnectedAt = rec.DisconnectedAt
+			c.DisconnectReason = rec.DisconnectReason
+		}
+		s.clientMu.RUnlock()
+		if c.DisconnectedAt == nil {
+			// the session was not disconnected since the plugin was loaded, e.g: it is restored from the persistence.
+			// The session expires the expiry interval after the disconnection.
+			at := v.ConnectedAt
+			if !v.ExpiresAt.IsZero() {
+				at = v.ExpiresAt.Add(-time.Duration(v.SessionExpiry) * time.Second)
+			}
+			c.DisconnectedAt = timestamppb.New(at)
+		}
+	}
+	s.fillClientInfo(c)
+	return c
+}
+
+// GetClientIDs returns the given ids which are in the store, the duplicated ids are ignored.
+func (s *store) GetClientIDs(ids []string) []string {
+	s.clientMu.RLock()
+	defer s.clientMu.RUnlock()
+	var rs []string
+	seen := make(map[string]struct{}, len(ids))
+	for _, v := range ids {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		if c := s.getClientByIDLocked(v); c != nil {
+			rs = append(rs, v)
+		}
+	}
+	return rs
+}
+
+// paginate calls fn for the elements of the indexer in the page which match the predicate, nil match matches all elements.
+// It returns the total number of the matched elements, and the cursor of the last element in the page if there are more matched elements.
+// The matched elements have to be scanned to count the total unless match is nil.
+func paginate(idx *Indexer, p pageCursor, match func(elem *list.Element) bool, fn func(elem *list.Element)) (total uint32, next uint64) {
+	var n uint
+	var last *list.Element
+	var more bool
+	collect := func(elem *list.Element) bool {
+		if n == p.n {
+			more = true
+			return false
+		}
+		fn(elem)
+		last = elem
+		n++
+		return true
+	}
+	if match == nil {
+		if p.cursor != 0 {
+			idx.IterateAfter(collect, p.cursor)
+		} else {
+			idx.Iterate(func(elem *list.Element) {
+				collect(elem)
+			}, p.offset, p.n+1)
+		}
+		total = uint32(idx.Len())
+	} else {
+		var skipped uint
+		idx.Iterate(func(elem *list.Element) {
+			if !match(elem) {
+				return
+			}
+			total++
+			if more {
+				return
+			}
+			if p.cursor != 0 {
+				if idx.Cursor(elem) <= p.cursor {
+					return
+				}
+			} else if skipped < p.offset {
+				skipped++
+				return
+			}
+			collect(elem)
+		}, 0, uint(idx.Len()))
+	}
+	if more && last != nil {
+		next = idx.Cursor(last)
+	}
+	return total, next
+}
+
+// GetClientsByAddr returns the connected clients whose remote IP is in the given network.
+func (s *store) GetClientsByAddr(ipNet *net.IPNet) []*Client {
+	rs := make([]*Client, 0)
 	fn := func(elem *list.Element) {
 		c := elem.Value.(*Client)
-		fillClientInfo(c, s.statsReader)
-		rs = append(rs, elem.Value.(*Client))
+		if c.DisconnectedAt != nil {
+			return
+		}
+		host, _, err := net.SplitHostPort(c.RemoteAddr)
+		if err != nil {
+			return
+		}
+		if ip := net.ParseIP(host); ip != nil && ipNet.Contains(ip) {
+			s.fillClientInfo(c)
+			rs = append(rs, c)
+		}
 	}
 	s.clientMu.RLock()
 	defer s.clientMu.RUnlock()
-	offset, n := GetOffsetN(page, pageSize)
-	s.clientIndexer.Iterate(fn, offset, n)
-	return rs, uint32(s.clientIndexer.Len()), nil
+	s.clientIndexer.Iterate(fn, 0, uint(s.clientIndexer.Len()))
+	return rs
+}
+
+// GetSubscription returns the subscription of the client for the given topic name, nil if not found.
+func (s *store) GetSubscription(clientID string, topicName string) *Subscription {
+	s.subMu.RLock()
+	defer s.subMu.RUnlock()
+	if i := s.subIndexer.GetByID(subscriptionKey(clientID, topicName)); i != nil {
+		return i.Value.(*Subscription)
+	}
+	return nil
 }
 
-// GetSubscriptions
-func (s *store) GetSubscriptions(page, pageSize uint) (rs []*Subscription, total uint32, err error) {
+// GetClientSubscriptions returns the subscriptions of the client sorted by the topic name.
+func (s *store) GetClientSubscriptions(clientID string) []*Subscription {
+	s.subMu.RLock()
+	defer s.subMu.RUnlock()
+	rs := make([]*Subscription, 0, len(s.clientSubs[clientID]))
+	for _, v := range s.clientSubs[clientID] {
+		rs = append(rs, v)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].TopicName < rs[j].TopicName
+	})
+	return rs
+}
+
+// GetSubscriptions returns the subscriptions in the given page, the total number of the subscriptions,
+// and the cursor of the last returned subscription if there are more subscriptions, see paginate.
+// If matchTopic is not empty, only the subscriptions whose topic filter matches matchTopic are returned,
+// and total is the number of the matched subscriptions.
+func (s *store) GetSubscriptions(p pageCursor, matchTopic string) (rs []*Subscription, total uint32, next uint64, err error) {
 	rs = make([]*Subscription, 0)
 	fn := func(elem *list.Element) {
 		rs = append(rs, elem.Value.(*Subscription))
 	}
 	s.subMu.RLock()
 	defer s.subMu.RUnlock()
-	offset, n := GetOffsetN(page, pageSize)
-	s.subIndexer.Iterate(fn, offset, n)
-	return rs, uint32(s.subIndexer.Len()), nil
+	var match func(elem *list.Element) bool
+	if matchTopic != "" {
+		match = func(elem *list.Element) bool {
+			_, topicFilter := subscription.SplitTopic(elem.Value.(*Subscription).TopicName)
+			return packets.TopicMatch([]byte(matchTopic), []byte(topicFilter))
+		}
+	}
+	total, next = paginate(s.subIndexer, p, match, fn)
+	return rs, total, next, nil
 }
@@ -7,12 +7,11 @@ import (
 	"strings"
 
 	"github.com/golang/protobuf/ptypes/empty"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
 )
 
 type subscriptionService struct {
@@ -25,14 +24,21 @@ func (s *subscriptionService) mustEmbedUnimplementedSubscriptionServiceServer()
 
 // List lists subscriptions in the broker.
 func (s *subscriptionService) List(ctx context.Context, req *ListSubscriptionRequest) (*ListSubscriptionResponse, error) {
-	page, pageSize := GetPage(req.Page, req.PageSize)
-	subs, total, err := s.a.store.GetSubscriptions(page, pageSize)
+	if req.MatchTopic != "" && !packets.ValidTopicName(true, []byte(req.MatchTopic)) {
+		return nil, ErrInvalidArgument("match_topic", "")
+	}
+	p, err := getPageCursor(req.Page, req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	subs, total, next, err := s.a.store.GetSubscriptions(p, req.MatchTopic)
 	if err != nil {
 		return &ListSubscriptionResponse{}, err
 	}
 	return &ListSubscriptionResponse{
 		Subscriptions: subs,
 		TotalCount:    total,
+		NextPageToken: encodePageToken(next),
 	}, nil
 }
 
@@ -120,6 +126,23 @@ func (s *subscriptionService) Filter(ctx context.Context, req *FilterSubscriptio
 	return resp, nil
 }
 
+// Get returns the subscription of the client for the given topic filter.
+func (s *subscriptionService) Get(ctx context.Context, req *GetSubscriptionRequest) (*GetSubscriptionResponse, error) {
+	if req.ClientId == "" {
+		return nil, ErrInvalidArgument("client_id", "cannot be empty")
+	}
+	if !packets.ValidV5Topic([]byte(req.TopicName)) {
+		return nil, ErrInvalidArgument("topic_name", "")
+	}
+	sub := s.a.store.GetSubscription(req.ClientId, req.TopicName)
+	if sub == nil {
+		return nil, ErrNotFound
+	}
+	return &GetSubscriptionResponse{
+		Subscription: sub,
+	}, nil
+}
+
 // Subscribe makes subscriptions for the given client.
 func (s *subscriptionService) Subscribe(ctx context.Context, req *SubscribeRequest) (resp *SubscribeResponse, err error) {
 	if req.ClientId == "" {
@@ -148,7 +171,7 @@ func (s *subscriptionService) Subscribe(ctx context.Context, req *SubscribeReque
 	}
 	rs, err := s.a.store.subscriptionService.Subscribe(req.ClientId, subs...)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to subscribe: %s", err.Error())
+		return nil, ErrInternal("subscribe", err)
 	}
 	resp = &SubscribeResponse{
 		New: make([]bool, 0),
@@ -161,22 +184,125 @@ func (s *subscriptionService) Subscribe(ctx context.Context, req *SubscribeReque
 }
 
 // Unsubscribe unsubscribe topic for the given client.
+// The subscriptions are removed in the same way as an UNSUBSCRIBE packet, so that the OnUnsubscribed hook is called,
+// but the client is not notified, see server.ClientService.Unsubscribe.
+// It returns ErrNotFound if any of the topics is not subscribed, the other topics are still unsubscribed.
 func (s *subscriptionService) Unsubscribe(ctx context.Context, req *UnsubscribeRequest) (resp *empty.Empty, err error) {
 	if req.ClientId == "" {
 		return nil, ErrInvalidArgument("client_id", "cannot be empty")
 	}
-	if len(req.Topics) == 0 {
-		return nil, ErrInvalidArgument("topics", "zero length topics")
+	if len(req.Topics) == 0 && req.TopicName == "" {
+		return nil, ErrInvalidArgument("topic_name", "cannot be empty")
 	}
-
 	for k, v := range req.Topics {
 		if !packets.ValidV5Topic([]byte(v)) {
 			return nil, ErrInvalidArgument(fmt.Sprintf("topics[%d]", k), "")
 		}
 	}
-	err = s.a.store.subscriptionService.Unsubscribe(req.ClientId, req.Topics...)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unsubscribe: %s", err.Error()))
+	topics := req.Topics
+	if req.TopicName != "" {
+		if !packets.ValidV5Topic([]byte(req.TopicName)) {
+			return nil, ErrInvalidArgument("topic_name", "")
+		}
+		topics = append(topics, req.TopicName)
+	}
+	var notFound bool
+	for _, v := range topics {
+		err = s.a.clientService.Unsubscribe(req.ClientId, v)
+		if err == server.ErrSubscriptionNotFound {
+			notFound = true
+			continue
+		}
+		if err != nil {
+			return nil, ErrInternal("unsubscribe", err)
+		}
+	}
+	if notFound {
+		return nil, ErrNotFound
 	}
 	return &empty.Empty{}, nil
 }
+
+// Compact removes the orphaned subscriptions from the subscription store.
+// A client is orphaned if it is not connected and has no session.
+func (s *subscriptionService) Compact(ctx context.Context, req *empty.Empty) (*CompactSubscriptionResponse, error) {
+	c, ok := s.a.store.subscriptionService.(subscription.Compactor)
+	if !ok {
+		return nil, ErrUnimplemented("the subscription store does not support compaction")
+	}
+	var orphans []string
+	pruned, err := c.Compact(func(clientID string) (bool, error) {
+		if s.a.clientService.GetClient(clientID) != nil {
+			return true, nil
+		}
+		sess, err := s.a.clientService.GetSession(clientID)
+		if err != nil {
+			return false, err
+		}
+		// the redis session store returns an empty session if not found.
+		if sess != nil && sess.ClientID != "" {
+			return true, nil
+		}
+		orphans = append(orphans, clientID)
+		return false, nil
+	})
+	for _, v := range orphans {
+		s.a.store.removeClientSubscriptions(v)
+	}
+	if err != nil {
+		return nil, ErrInternal("compact", err)
+	}
+	return &CompactSubscriptionResponse{
+		Pruned: uint32(pruned),
+	}, nil
+}
+
+// Count returns the number of the subscriptions under the topic subtree without iterating them.
+func (s *subscriptionService) Count(ctx context.Context, req *CountSubscriptionRequest) (*CountSubscriptionResponse, error) {
+	c, ok := s.a.store.subscriptionService.(subscription.Counter)
+	if !ok {
+		return nil, ErrUnimplemented("the subscription store does not support counting")
+	}
+	if req.TopicPrefix != "" && !packets.ValidTopicFilter(true, []byte(req.TopicPrefix)) {
+		return nil, ErrInvalidArgument("topic_prefix", "")
+	}
+	n, err := c.Count(req.TopicPrefix)
+	if err != nil {
+		return nil, ErrInternal("count", err)
+	}
+	return &CountSubscriptionResponse{
+		Count: n,
+	}, nil
+}
+
+// ResolveSubscribers returns the subscribers which would receive a message published to the topic name,
+// without delivering the message or changing the round robin state of the shared subscriptions,
+// see server.Server.ResolveSubscribers for details.
+func (s *subscriptionService) ResolveSubscribers(ctx context.Context, req *ResolveSubscribersRequest) (*ResolveSubscribersResponse, error) {
+	if !packets.ValidTopicName(true, []byte(req.TopicName)) {
+		return nil, ErrInvalidArgument("topic_name", "")
+	}
+	if req.Qos > uint32(packets.Qos2) {
+		return nil, ErrInvalidArgument("qos", "")
+	}
+	rs := s.a.resolveSubscribers(&server.ResolveRequest{
+		TopicName:   req.TopicName,
+		QoS:         packets.QoS(req.Qos),
+		PublisherID: req.PublisherId,
+	})
+	resp := &ResolveSubscribersResponse{
+		Subscribers: make([]*ResolvedSubscriber, 0, len(rs)),
+	}
+	for _, v := range rs {
+		resp.Subscribers = append(resp.Subscribers, &ResolvedSubscriber{
+			ClientId:        v.ClientID,
+			TopicName:       v.TopicFilter,
+			ShareName:       v.ShareName,
+			Qos:             uint32(v.QoS),
+			SubscriptionIds: v.SubscriptionIDs,
+			Receives:        v.Receives,
+			NoLocal:         v.NoLocal,
+		})
+	}
+	return resp, nil
+}
@@ -22,10 +22,19 @@ type SubscriptionServiceClient interface {
 	List(ctx context.Context, in *ListSubscriptionRequest, opts ...grpc.CallOption) (*ListSubscriptionResponse, error)
 	// Filter subscriptions, paging is not supported in this API.
 	Filter(ctx context.Context, in *FilterSubscriptionRequest, opts ...grpc.CallOption) (*FilterSubscriptionResponse, error)
+	// Get the subscription of the client for the given topic filter.
+	Get(ctx context.Context, in *GetSubscriptionRequest, opts ...grpc.CallOption) (*GetSubscriptionResponse, error)
 	// Subscribe topics for the client.
 	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (*SubscribeResponse, error)
-	// Unsubscribe topics for the client.
+	// Unsubscribe topics for the client, as if the client sent the UNSUBSCRIBE packet.
 	Unsubscribe(ctx context.Context, in *UnsubscribeRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+	// Compact rebuilds the subscription index from the persisted subscriptions,
+	// and removes the subscriptions of the clients whose session no longer exists.
+	Compact(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*CompactSubscriptionResponse, error)
+	// Count the subscriptions under the topic subtree without listing them.
+	Count(ctx context.Context, in *CountSubscriptionRequest, opts ...grpc.CallOption) (*CountSubscriptionResponse, error)
+	// ResolveSubscribers returns the subscribers which would receive a message published to the topic name, without delivering the message.
+	ResolveSubscribers(ctx context.Context, in *ResolveSubscribersRequest, opts ...grpc.CallOption) (*ResolveSubscribersResponse, error)
 }
 
 type subscriptionServiceClient struct {
@@ -54,6 +63,15 @@ func (c *subscriptionServiceClient) Filter(ctx context.Context, in *FilterSubscr
 	return out, nil
 }
 
+func (c *subscriptionServiceClient) Get(ctx context.Context, in *GetSubscriptionRequest, opts ...grpc.CallOption) (*GetSubscriptionResponse, error) {
+	out := new(GetSubscriptionResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.SubscriptionService/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *subscriptionServiceClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (*SubscribeResponse, error) {
 	out := new(SubscribeResponse)
 	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.SubscriptionService/Subscribe", in, out, opts...)
@@ -72,6 +90,33 @@ func (c *subscriptionServiceClient) Unsubscribe(ctx context.Context, in *Unsubsc
 	return out, nil
 }
 
+func (c *subscriptionServiceClient) Compact(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*CompactSubscriptionResponse, error) {
+	out := new(CompactSubscriptionResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.SubscriptionService/Compact", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *subscriptionServiceClient) Count(ctx context.Context, in *CountSubscriptionRequest, opts ...grpc.CallOption) (*CountSubscriptionResponse, error) {
+	out := new(CountSubscriptionResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.SubscriptionService/Count", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *subscriptionServiceClient) ResolveSubscribers(ctx context.Context, in *ResolveSubscribersRequest, opts ...grpc.CallOption) (*ResolveSubscribersResponse, error) {
+	out := new(ResolveSubscribersResponse)
+	err := c.cc.Invoke(ctx, "/gmqtt.admin.api.SubscriptionService/ResolveSubscribers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // SubscriptionServiceServer is the server API for SubscriptionService service.
 // All implementations must embed UnimplementedSubscriptionServiceServer
 // for forward compatibility
@@ -80,10 +125,19 @@ type SubscriptionServiceServer interface {
 	List(context.Context, *ListSubscriptionRequest) (*ListSubscriptionResponse, error)
 	// Filter subscriptions, paging is not supported in this API.
 	Filter(context.Context, *FilterSubscriptionRequest) (*FilterSubscriptionResponse, error)
+	// Get the subscription of the client for the given topic filter.
+	Get(context.Context, *GetSubscriptionRequest) (*GetSubscriptionResponse, error)
 	// Subscribe topics for the client.
 	Subscribe(context.Context, *SubscribeRequest) (*SubscribeResponse, error)
-	// Unsubscribe topics for the client.
+	// Unsubscribe topics for the client, as if the client sent the UNSUBSCRIBE packet.
 	Unsubscribe(context.Context, *UnsubscribeRequest) (*empty.Empty, error)
+	// Compact rebuilds the subscription index from the persisted subscriptions,
+	// and removes the subscriptions of the clients whose session no longer exists.
+	Compact(context.Context, *empty.Empty) (*CompactSubscriptionResponse, error)
+	// Count the subscriptions under the topic subtree without listing them.
+	Count(context.Context, *CountSubscriptionRequest) (*CountSubscriptionResponse, error)
+	// ResolveSubscribers returns the subscribers which would receive a message published to the topic name, without delivering the message.
+	ResolveSubscribers(context.Context, *ResolveSubscribersRequest) (*ResolveSubscribersResponse, error)
 	mustEmbedUnimplementedSubscriptionServiceServer()
 }
 
@@ -97,12 +151,24 @@ func (UnimplementedSubscriptionServiceServer) List(context.Context, *ListSubscri
 func (UnimplementedSubscriptionServiceServer) Filter(context.Context, *FilterSubscriptionRequest) (*FilterSubscriptionResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Filter not implemented")
 }
+func (UnimplementedSubscriptionServiceServer) Get(context.Context, *GetSubscriptionRequest) (*GetSubscriptionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
 func (UnimplementedSubscriptionServiceServer) Subscribe(context.Context, *SubscribeRequest) (*SubscribeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
 }
 func (UnimplementedSubscriptionServiceServer) Unsubscribe(context.Context, *UnsubscribeRequest) (*empty.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Unsubscribe not implemented")
 }
+func (UnimplementedSubscriptionServiceServer) Compact(context.Context, *empty.Empty) (*CompactSubscriptionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Compact not implemented")
+}
+func (UnimplementedSubscriptionServiceServer) Count(context.Context, *CountSubscriptionRequest) (*CountSubscriptionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Count not implemented")
+}
+func (UnimplementedSubscriptionServiceServer) ResolveSubscribers(context.Context, *ResolveSubscribersRequest) (*ResolveSubscribersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolveSubscribers not implemented")
+}
 func (UnimplementedSubscriptionServiceServer) mustEmbedUnimplementedSubscriptionServiceServer() {}
 
 // UnsafeSubscriptionServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -152,6 +218,24 @@ func _SubscriptionService_Filter_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _SubscriptionService_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSubscriptionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SubscriptionServiceServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.SubscriptionService/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SubscriptionServiceServer).Get(ctx, req.(*GetSubscriptionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _SubscriptionService_Subscribe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(SubscribeRequest)
 	if err := dec(in); err != nil {
@@ -188,6 +272,60 @@ func _SubscriptionService_Unsubscribe_Handler(srv interface{}, ctx context.Conte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _SubscriptionService_Compact_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SubscriptionServiceServer).Compact(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.SubscriptionService/Compact",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SubscriptionServiceServer).Compact(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SubscriptionService_Count_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CountSubscriptionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SubscriptionServiceServer).Count(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.SubscriptionService/Count",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SubscriptionServiceServer).Count(ctx, req.(*CountSubscriptionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SubscriptionService_ResolveSubscribers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveSubscribersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SubscriptionServiceServer).ResolveSubscribers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gmqtt.admin.api.SubscriptionService/ResolveSubscribers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SubscriptionServiceServer).ResolveSubscribers(ctx, req.(*ResolveSubscribersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _SubscriptionService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "gmqtt.admin.api.SubscriptionService",
 	HandlerType: (*SubscriptionServiceServer)(nil),
@@ -200,6 +338,10 @@ var _SubscriptionService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Filter",
 			Handler:    _SubscriptionService_Filter_Handler,
 		},
+		{
+			MethodName: "Get",
+			Handler:    _SubscriptionService_Get_Handler,
+		},
 		{
 			MethodName: "Subscribe",
 			Handler:    _SubscriptionService_Subscribe_Handler,
@@ -208,6 +350,18 @@ var _SubscriptionService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Unsubscribe",
 			Handler:    _SubscriptionService_Unsubscribe_Handler,
 		},
+		{
+			MethodName: "Compact",
+			Handler:    _SubscriptionService_Compact_Handler,
+		},
+		{
+			MethodName: "Count",
+			Handler:    _SubscriptionService_Count_Handler,
+		},
+		{
+			MethodName: "ResolveSubscribers",
+			Handler:    _SubscriptionService_ResolveSubscribers_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "subscription.proto",
@@ -2,10 +2,13 @@ package admin
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
@@ -21,7 +24,7 @@ func TestSubscriptionService_List(t *testing.T) {
 	ss := server.NewMockSubscriptionService(ctrl)
 	client := server.NewMockClient(ctrl)
 	admin := &Admin{
-		store: newStore(nil, mockConfig),
+		store: newStore(nil, mockConfig, nil),
 	}
 	sub := &subscriptionService{
 		a: admin,
@@ -56,6 +59,108 @@ func TestSubscriptionService_List(t *testing.T) {
 	a.EqualValues(subsc.NoLocal, rs.NoLocal)
 }
 
+func TestSubscriptionService_List_matchTopic(t *testing.T) {
+	a := assert.New(t)
+	admin := &Admin{
+		store: newStore(nil, mockConfig, nil),
+	}
+	sub := &subscriptionService{
+		a: admin,
+	}
+	for _, v := range []struct {
+		clientID string
+		sub      *gmqtt.Subscription
+	}{
+		{clientID: "a", sub: &gmqtt.Subscription{TopicFilter: "sensor/+/temp"}},
+		{clientID: "b", sub: &gmqtt.Subscription{TopicFilter: "sensor/#"}},
+		{clientID: "c", sub: &gmqtt.Subscription{ShareName: "g", TopicFilter: "sensor/1/temp"}},
+		{clientID: "d", sub: &gmqtt.Subscription{TopicFilter: "sensor/2/temp"}},
+		{clientID: "e", sub: &gmqtt.Subscription{TopicFilter: "#"}},
+		{clientID: "f", sub: &gmqtt.Subscription{TopicFilter: "$SYS/#"}},
+	} {
+		admin.store.addSubscription(v.clientID, v.sub)
+	}
+	list := func(req *ListSubscriptionRequest) (ids []string, total uint32) {
+		resp, err := sub.List(context.Background(), req)
+		a.Nil(err)
+		for _, v := range resp.Subscriptions {
+			ids = append(ids, v.ClientId)
+		}
+		return ids, resp.TotalCount
+	}
+
+	ids, total := list(&ListSubscriptionRequest{})
+	a.Equal([]string{"a", "b", "c", "d", "e", "f"}, ids)
+	a.EqualValues(6, total)
+
+	ids, total = list(&ListSubscriptionRequest{MatchTopic: "sensor/1/temp"})
+	a.Equal([]string{"a", "b", "c", "e"}, ids)
+	a.EqualValues(4, total)
+
+	ids, total = list(&ListSubscriptionRequest{MatchTopic: "sensor/1/temp", Page: 2, PageSize: 3})
+	a.Equal([]string{"e"}, ids)
+	a.EqualValues(4, total)
+
+	// the wildcards at the first level do not match the topics beginning with $.
+	ids, total = list(&ListSubscriptionRequest{MatchTopic: "$SYS/broker"})
+	a.Equal([]string{"f"}, ids)
+	a.EqualValues(1, total)
+
+	_, err := sub.List(context.Background(), &ListSubscriptionRequest{MatchTopic: "sensor/+"})
+	s, ok := status.FromError(err)
+	a.True(ok)
+	a.Equal(codes.InvalidArgument, s.Code())
+}
+
+func TestSubscriptionService_List_pageToken(t *testing.T) {
+	a := assert.New(t)
+	admin := &Admin{
+		store: newStore(nil, mockConfig, nil),
+	}
+	sub := &subscriptionService{
+		a: admin,
+	}
+	for _, v := range []string{"a", "b", "c", "d", "e"} {
+		admin.store.addSubscription(v, &gmqtt.Subscription{TopicFilter: "t/1"})
+		admin.store.addSubscription(v, &gmqtt.Subscription{TopicFilter: "t/2"})
+	}
+	// listAll lists all pages by the page token and calls mutate between the pages.
+	listAll := func(req *ListSubscriptionRequest, mutate func(page int)) (keys []string) {
+		for page := 0; ; page++ {
+			resp, err := sub.List(context.Background(), req)
+			a.Nil(err)
+			for _, v := range resp.Subscriptions {
+				keys = append(keys, subscriptionKey(v.ClientId, v.TopicName))
+			}
+			if resp.NextPageToken == "" {
+				return keys
+			}
+			req.PageToken = resp.NextPageToken
+			mutate(page)
+		}
+	}
+	keys := listAll(&ListSubscriptionRequest{PageSize: 4}, func(page int) {
+		if page == 0 {
+			admin.store.removeClientSubscriptions("a")
+			admin.store.removeClientSubscriptions("b")
+			admin.store.removeSubscription("c", "t/1")
+			admin.store.addSubscription("f", &gmqtt.Subscription{TopicFilter: "t/1"})
+		}
+	})
+	a.Equal([]string{"a_t/1", "a_t/2", "b_t/1", "b_t/2", "c_t/2", "d_t/1", "d_t/2", "e_t/1", "e_t/2", "f_t/1"}, keys)
+
+	keys = listAll(&ListSubscriptionRequest{PageSize: 1, MatchTopic: "t/1"}, func(page int) {
+		if page == 0 {
+			admin.store.removeSubscription("d", "t/1")
+			admin.store.addSubscription("g", &gmqtt.Subscription{TopicFilter: "t/+"})
+		}
+	})
+	a.Equal([]string{"d_t/1", "e_t/1", "f_t/1", "g_t/+"}, keys)
+
+	_, err := sub.List(context.Background(), &ListSubscriptionRequest{PageToken: "invalid"})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+}
+
 func TestSubscriptionService_Filter(t *testing.T) {
 	a := assert.New(t)
 	ctrl := gomock.NewController(t)
@@ -63,7 +168,7 @@ func TestSubscriptionService_Filter(t *testing.T) {
 
 	ss := server.NewMockSubscriptionService(ctrl)
 	admin := &Admin{
-		store: newStore(nil, mockConfig),
+		store: newStore(nil, mockConfig, nil),
 	}
 	sub := &subscriptionService{
 		a: admin,
@@ -185,7 +290,7 @@ func TestSubscriptionService_Filter_InvalidArgument(t *testing.T) {
 
 			ss := server.NewMockSubscriptionService(ctrl)
 			admin := &Admin{
-				store: newStore(nil, mockConfig),
+				store: newStore(nil, mockConfig, nil),
 			}
 			sub := &subscriptionService{
 				a: admin,
@@ -201,6 +306,102 @@ func TestSubscriptionService_Filter_InvalidArgument(t *testing.T) {
 
 }
 
+func TestSubscriptionService_Get(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	client := server.NewMockClient(ctrl)
+	admin := &Admin{
+		store: newStore(nil, mockConfig, nil),
+	}
+	sub := &subscriptionService{
+		a: admin,
+	}
+	client.EXPECT().ClientOptions().Return(&server.ClientOptions{ClientID: "id"})
+	subscribe := admin.OnSubscribedWrapper(func(ctx context.Context, client server.Client, subscription *gmqtt.Subscription) {})
+	subsc := &gmqtt.Subscription{
+		ShareName:         "abc",
+		TopicFilter:       "t",
+		ID:                1,
+		QoS:               2,
+		NoLocal:           true,
+		RetainAsPublished: true,
+		RetainHandling:    2,
+	}
+	subscribe(context.Background(), client, subsc)
+
+	resp, err := sub.Get(context.Background(), &GetSubscriptionRequest{
+		ClientId:  "id",
+		TopicName: "$share/abc/t",
+	})
+	a.Nil(err)
+	rs := resp.Subscription
+	a.EqualValues("id", rs.ClientId)
+	a.EqualValues(subsc.GetFullTopicName(), rs.TopicName)
+	a.EqualValues(subsc.ID, rs.Id)
+	a.EqualValues(subsc.QoS, rs.Qos)
+	a.EqualValues(subsc.NoLocal, rs.NoLocal)
+	a.EqualValues(subsc.RetainAsPublished, rs.RetainAsPublished)
+	a.EqualValues(subsc.RetainHandling, rs.RetainHandling)
+
+	// the share name is part of the key.
+	_, err = sub.Get(context.Background(), &GetSubscriptionRequest{
+		ClientId:  "id",
+		TopicName: "t",
+	})
+	a.Equal(ErrNotFound, err)
+	_, err = sub.Get(context.Background(), &GetSubscriptionRequest{
+		ClientId:  "id2",
+		TopicName: "$share/abc/t",
+	})
+	a.Equal(ErrNotFound, err)
+}
+
+func TestSubscriptionService_Get_InvalidArgument(t *testing.T) {
+	var tt = []struct {
+		name  string
+		field string
+		req   *GetSubscriptionRequest
+	}{
+		{
+			name:  "empty_client_id",
+			field: "client_id",
+			req: &GetSubscriptionRequest{
+				TopicName: "t",
+			},
+		},
+		{
+			name:  "empty_topic_name",
+			field: "topic_name",
+			req: &GetSubscriptionRequest{
+				ClientId: "id",
+			},
+		},
+		{
+			name:  "invalid_topic_name",
+			field: "topic_name",
+			req: &GetSubscriptionRequest{
+				ClientId:  "id",
+				TopicName: "##",
+			},
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			sub := &subscriptionService{
+				a: &Admin{
+					store: newStore(nil, mockConfig, nil),
+				},
+			}
+			_, err := sub.Get(context.Background(), v.req)
+			a.NotNil(err)
+			a.Contains(err.Error(), v.field)
+		})
+	}
+}
+
 func TestSubscriptionService_Subscribe(t *testing.T) {
 	a := assert.New(t)
 	ctrl := gomock.NewController(t)
@@ -208,7 +409,7 @@ func TestSubscriptionService_Subscribe(t *testing.T) {
 
 	ss := server.NewMockSubscriptionService(ctrl)
 	admin := &Admin{
-		store: newStore(nil, mockConfig),
+		store: newStore(nil, mockConfig, nil),
 	}
 	sub := &subscriptionService{
 		a: admin,
@@ -220,7 +421,7 @@ func TestSubscriptionService_Subscribe(t *testing.T) {
 			TopicName:         "$share/a/b",
 			Id:                1,
 			Qos:               2,
-			NoLocal:           true,
+			NoLocal:           false,
 			RetainAsPublished: true,
 			RetainHandling:    2,
 		}, {
@@ -298,6 +499,18 @@ func TestSubscriptionService_Subscribe_InvalidArgument(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "shared_no_local",
+			req: &SubscribeRequest{
+				ClientId: "cid",
+				Subscriptions: []*Subscription{
+					{
+						TopicName: "$share/a/b",
+						NoLocal:   true,
+					},
+				},
+			},
+		},
 	}
 	for _, v := range tt {
 		t.Run(v.name, func(t *testing.T) {
@@ -307,7 +520,7 @@ func TestSubscriptionService_Subscribe_InvalidArgument(t *testing.T) {
 
 			ss := server.NewMockSubscriptionService(ctrl)
 			admin := &Admin{
-				store: newStore(nil, mockConfig),
+				store: newStore(nil, mockConfig, nil),
 			}
 			sub := &subscriptionService{
 				a: admin,
@@ -326,25 +539,44 @@ func TestSubscriptionService_Unsubscribe(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	ss := server.NewMockSubscriptionService(ctrl)
+	cs := server.NewMockClientService(ctrl)
 	admin := &Admin{
-		store: newStore(nil, mockConfig),
+		store:         newStore(nil, mockConfig, nil),
+		clientService: cs,
 	}
 	sub := &subscriptionService{
 		a: admin,
 	}
-	sub.a.store.subscriptionService = ss
 
-	topics := []string{
-		"a", "b",
-	}
-	ss.EXPECT().Unsubscribe("cid", topics)
+	gomock.InOrder(
+		cs.EXPECT().Unsubscribe("cid", "a"),
+		cs.EXPECT().Unsubscribe("cid", "b"),
+		cs.EXPECT().Unsubscribe("cid", "$share/g/c"),
+	)
 	_, err := sub.Unsubscribe(context.Background(), &UnsubscribeRequest{
-		ClientId: "cid",
-		Topics:   topics,
+		ClientId:  "cid",
+		Topics:    []string{"a", "b"},
+		TopicName: "$share/g/c",
 	})
 	a.Nil(err)
 
+	// the other topics are still unsubscribed.
+	gomock.InOrder(
+		cs.EXPECT().Unsubscribe("cid", "a").Return(server.ErrSubscriptionNotFound),
+		cs.EXPECT().Unsubscribe("cid", "b"),
+	)
+	_, err = sub.Unsubscribe(context.Background(), &UnsubscribeRequest{
+		ClientId: "cid",
+		Topics:   []string{"a", "b"},
+	})
+	a.Equal(codes.NotFound, status.Code(err))
+
+	cs.EXPECT().Unsubscribe("cid", "a").Return(errors.New("error"))
+	_, err = sub.Unsubscribe(context.Background(), &UnsubscribeRequest{
+		ClientId:  "cid",
+		TopicName: "a",
+	})
+	a.Equal(codes.Internal, status.Code(err))
 }
 
 func TestSubscriptionService_Unsubscribe_InvalidArgument(t *testing.T) {
@@ -366,6 +598,19 @@ func TestSubscriptionService_Unsubscribe_InvalidArgument(t *testing.T) {
 				Topics:   []string{"+", "##"},
 			},
 		},
+		{
+			name: "empty_topic_name",
+			req: &UnsubscribeRequest{
+				ClientId: "cid",
+			},
+		},
+		{
+			name: "invalid_single_topic_name",
+			req: &UnsubscribeRequest{
+				ClientId:  "cid",
+				TopicName: "##",
+			},
+		},
 	}
 	for _, v := range tt {
 		t.Run(v.name, func(t *testing.T) {
@@ -375,7 +620,7 @@ func TestSubscriptionService_Unsubscribe_InvalidArgument(t *testing.T) {
 
 			ss := server.NewMockSubscriptionService(ctrl)
 			admin := &Admin{
-				store: newStore(nil, mockConfig),
+				store: newStore(nil, mockConfig, nil),
 			}
 			sub := &subscriptionService{
 				a: admin,
@@ -383,8 +628,146 @@ func TestSubscriptionService_Unsubscribe_InvalidArgument(t *testing.T) {
 			sub.a.store.subscriptionService = ss
 
 			_, err := sub.Unsubscribe(context.Background(), v.req)
-			a.NotNil(err)
+			a.Equal(codes.InvalidArgument, status.Code(err))
 		})
 	}
 
 }
+
+type compactorSubscriptionService struct {
+	*server.MockSubscriptionService
+	compact func(exists func(clientID string) (bool, error)) (int, error)
+}
+
+func (c *compactorSubscriptionService) Compact(exists func(clientID string) (bool, error)) (int, error) {
+	return c.compact(exists)
+}
+
+func TestSubscriptionService_Compact(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cs := server.NewMockClientService(ctrl)
+	admin := &Admin{
+		store:         newStore(nil, mockConfig, nil),
+		clientService: cs,
+	}
+	sub := &subscriptionService{
+		a: admin,
+	}
+	sub.a.store.subscriptionService = server.NewMockSubscriptionService(ctrl)
+	_, err := sub.Compact(context.Background(), nil)
+	a.Equal(codes.Unimplemented, status.Code(err))
+
+	for _, v := range []string{"online", "offline", "orphan"} {
+		admin.store.addSubscription(v, &gmqtt.Subscription{TopicFilter: "a"})
+	}
+	cs.EXPECT().GetClient("online").Return(server.NewMockClient(ctrl))
+	cs.EXPECT().GetClient("offline").Return(nil)
+	cs.EXPECT().GetSession("offline").Return(&gmqtt.Session{ClientID: "offline"}, nil)
+	cs.EXPECT().GetClient("orphan").Return(nil)
+	cs.EXPECT().GetSession("orphan").Return(&gmqtt.Session{}, nil)
+	sub.a.store.subscriptionService = &compactorSubscriptionService{
+		MockSubscriptionService: server.NewMockSubscriptionService(ctrl),
+		compact: func(exists func(clientID string) (bool, error)) (int, error) {
+			for _, v := range []string{"online", "offline", "orphan"} {
+				ok, err := exists(v)
+				a.Nil(err)
+				a.Equal(v != "orphan", ok)
+			}
+			return 1, nil
+		},
+	}
+	resp, err := sub.Compact(context.Background(), nil)
+	a.Nil(err)
+	a.EqualValues(1, resp.Pruned)
+	a.Len(admin.store.GetClientSubscriptions("online"), 1)
+	a.Len(admin.store.GetClientSubscriptions("offline"), 1)
+	a.Empty(admin.store.GetClientSubscriptions("orphan"))
+	a.Nil(admin.store.GetSubscription("orphan", "a"))
+}
+
+type counterSubscriptionService struct {
+	*server.MockSubscriptionService
+	count func(topicPrefix string) (uint64, error)
+}
+
+func (c *counterSubscriptionService) Count(topicPrefix string) (uint64, error) {
+	return c.count(topicPrefix)
+}
+
+func TestSubscriptionService_Count(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	admin := &Admin{
+		store: newStore(nil, mockConfig, nil),
+	}
+	sub := &subscriptionService{
+		a: admin,
+	}
+	sub.a.store.subscriptionService = server.NewMockSubscriptionService(ctrl)
+	_, err := sub.Count(context.Background(), &CountSubscriptionRequest{TopicPrefix: "fleet"})
+	a.Equal(codes.Unimplemented, status.Code(err))
+
+	sub.a.store.subscriptionService = &counterSubscriptionService{
+		MockSubscriptionService: server.NewMockSubscriptionService(ctrl),
+		count: func(topicPrefix string) (uint64, error) {
+			a.Equal("fleet/#", topicPrefix)
+			return 3, nil
+		},
+	}
+	resp, err := sub.Count(context.Background(), &CountSubscriptionRequest{TopicPrefix: "fleet/#"})
+	a.Nil(err)
+	a.EqualValues(3, resp.Count)
+
+	_, err = sub.Count(context.Background(), &CountSubscriptionRequest{TopicPrefix: "fleet/#/a"})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+
+	sub.a.store.subscriptionService = &counterSubscriptionService{
+		MockSubscriptionService: server.NewMockSubscriptionService(ctrl),
+		count: func(topicPrefix string) (uint64, error) {
+			return 0, errors.New("error")
+		},
+	}
+	_, err = sub.Count(context.Background(), &CountSubscriptionRequest{})
+	a.Equal(codes.Internal, status.Code(err))
+}
+
+func TestSubscriptionService_ResolveSubscribers(t *testing.T) {
+	a := assert.New(t)
+	var got *server.ResolveRequest
+	sub := &subscriptionService{
+		a: &Admin{
+			resolveSubscribers: func(req *server.ResolveRequest) []server.ResolvedSubscriber {
+				got = req
+				return []server.ResolvedSubscriber{
+					{ClientID: "c1", TopicFilter: "a/+", QoS: 1, SubscriptionIDs: []uint32{1}, Receives: true},
+					{ClientID: "c2", TopicFilter: "$share/g/a/#", ShareName: "g", QoS: 1},
+				}
+			},
+		},
+	}
+	resp, err := sub.ResolveSubscribers(context.Background(), &ResolveSubscribersRequest{
+		TopicName:   "a/b",
+		Qos:         2,
+		PublisherId: "pub",
+	})
+	a.Nil(err)
+	a.Equal(&server.ResolveRequest{TopicName: "a/b", QoS: 2, PublisherID: "pub"}, got)
+	a.Len(resp.Subscribers, 2)
+	a.Equal("c1", resp.Subscribers[0].ClientId)
+	a.Equal("a/+", resp.Subscribers[0].TopicName)
+	a.EqualValues(1, resp.Subscribers[0].Qos)
+	a.Equal([]uint32{1}, resp.Subscribers[0].SubscriptionIds)
+	a.True(resp.Subscribers[0].Receives)
+	a.Equal("g", resp.Subscribers[1].ShareName)
+	a.False(resp.Subscribers[1].Receives)
+
+	_, err = sub.ResolveSubscribers(context.Background(), &ResolveSubscribersRequest{TopicName: "a/#"})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+	_, err = sub.ResolveSubscribers(context.Background(), &ResolveSubscribersRequest{TopicName: "a/b", Qos: 3})
+	a.Equal(codes.InvalidArgument, status.Code(err))
+}
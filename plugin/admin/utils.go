@@ -2,47 +2,125 @@ package admin
 
 import (
 	"container/list"
-
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"encoding/base64"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-// ErrNotFound represents a not found error.
-var ErrNotFound = status.Error(codes.NotFound, "not found")
+// KeyFunc returns the index key for the given id.
+// It can be used to bound the memory usage of the index when the ids are long, e.g: returns the hash of the id.
+// Different ids are allowed to have the same key, the collisions are resolved by IDFunc.
+type KeyFunc func(id string) string
+
+// IDFunc returns the id of the value stored in the Indexer.
+type IDFunc func(value interface{}) string
+
+// HashKeyFunc is a KeyFunc that returns the 64-bit FNV-1a hash of the id.
+func HashKeyFunc(id string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	return string(h.Sum(nil))
+}
 
 // Indexer provides a index for a ordered list that supports queries in O(1).
 // All methods are not concurrency-safe.
 type Indexer struct {
 	index map[string]*list.Element
 	rows  *list.List
+	// keyFunc and idFunc are nil if the index is keyed by the id.
+	keyFunc KeyFunc
+	idFunc  IDFunc
+	// collisions stores the elements whose key is already used by another element in index.
+	collisions map[string][]*list.Element
+	positions  *positions
 }
 
 // NewIndexer is the constructor of Indexer.
 func NewIndexer() *Indexer {
 	return &Indexer{
-		index: make(map[string]*list.Element),
-		rows:  list.New(),
+		index:     make(map[string]*list.Element),
+		rows:      list.New(),
+		positions: newPositions(),
 	}
 }
 
+// NewIndexerWithKeyFunc returns an Indexer which uses keyFunc to build index keys.
+// idFunc is used to get the id of the stored values to resolve the key collisions.
+func NewIndexerWithKeyFunc(keyFunc KeyFunc, idFunc IDFunc) *Indexer {
+	i := NewIndexer()
+	i.keyFunc = keyFunc
+	i.idFunc = idFunc
+	i.collisions = make(map[string][]*list.Element)
+	return i
+}
+
+func (i *Indexer) key(id string) string {
+	if i.keyFunc == nil {
+		return id
+	}
+	return i.keyFunc(id)
+}
+
+// find returns the element for the given id and the index of the element in collisions, -1 if the element is in index.
+func (i *Indexer) find(key, id string) (elem *list.Element, pos int) {
+	elem = i.index[key]
+	if elem == nil || i.idFunc == nil || i.idFunc(elem.Value) == id {
+		return elem, -1
+	}
+	for k, v := range i.collisions[key] {
+		if i.idFunc(v.Value) == id {
+			return v, k
+		}
+	}
+	return nil, -1
+}
+
 // Set sets the value for the id.
 func (i *Indexer) Set(id string, value interface{}) {
-	if e, ok := i.index[id]; ok {
+	key := i.key(id)
+	if e, _ := i.find(key, id); e != nil {
 		e.Value = value
+		return
+	}
+	elem := i.rows.PushBack(value)
+	i.positions.push(elem)
+	if _, ok := i.index[key]; ok {
+		i.collisions[key] = append(i.collisions[key], elem)
 	} else {
-		elem := i.rows.PushBack(value)
-		i.index[id] = elem
+		i.index[key] = elem
 	}
 }
 
 // Remove removes and returns the value for the given id.
 // Return nil if not found.
 func (i *Indexer) Remove(id string) *list.Element {
-	elem := i.index[id]
-	if elem != nil {
-		i.rows.Remove(elem)
+	key := i.key(id)
+	elem, pos := i.find(key, id)
+	if elem == nil {
+		return nil
+	}
+	i.rows.Remove(elem)
+	i.positions.remove(elem)
+	c := i.collisions[key]
+	if pos == -1 {
+		if len(c) == 0 {
+			delete(i.index, key)
+			return elem
+		}
+		// promote the first collided element
+		i.index[key] = c[0]
+		pos = 0
+	}
+	c = append(c[:pos], c[pos+1:]...)
+	if len(c) == 0 {
+		delete(i.collisions, key)
+	} else {
+		i.collisions[key] = c
 	}
-	delete(i.index, id)
 	return elem
 }
 
@@ -52,7 +130,8 @@ func (i *Indexer) Remove(id string) *list.Element {
 // because the Set method can modify the Value for *list.Element when updating the Value for the same id.
 // If the caller needs the Value in *list.Element, it must get the Value before the next Set is called.
 func (i *Indexer) GetByID(id string) *list.Element {
-	return i.index[id]
+	elem, _ := i.find(i.key(id), id)
+	return elem
 }
 
 // Iterate iterates at most n elements in the list begin from offset.
@@ -60,26 +139,172 @@ func (i *Indexer) GetByID(id string) *list.Element {
 // because the Set method can modify the Value for *list.Element when updating the Value for the same id.
 // If the caller needs the Value in *list.Element, it must get the Value before the next Set is called.
 func (i *Indexer) Iterate(fn func(elem *list.Element), offset, n uint) {
-	if i.rows.Len() < int(offset) {
+	if uint(i.rows.Len()) <= offset {
 		return
 	}
 	var j uint
-	for e := i.rows.Front(); e != nil; e = e.Next() {
-		if j >= offset && j < offset+n {
-			fn(e)
-		}
-		if j == offset+n {
-			break
-		}
+	for e := i.positions.seek(int(offset)); e != nil && j < n; e = e.Next() {
+		fn(e)
 		j++
 	}
 }
 
+// Cursor returns the cursor of the element, which is the position of the element that is stable across the insertions and removals.
+// The cursors increase in the list order and are never reused, see IterateAfter.
+// Returns 0 if the element is not in the list.
+func (i *Indexer) Cursor(elem *list.Element) uint64 {
+	return i.positions.seqOf(elem)
+}
+
+// IterateAfter iterates the elements in the list after the element of the cursor until fn returns false.
+// The iteration begins from the first element if cursor is 0.
+// The element of the cursor does not need to be in the list, e.g: it has been removed since the cursor was returned.
+// Notice: Any access to the *list.Element in fn also require the mutex, see Iterate.
+func (i *Indexer) IterateAfter(fn func(elem *list.Element) bool, cursor uint64) {
+	for e := i.positions.after(cursor); e != nil && fn(e); e = e.Next() {
+	}
+}
+
 // Len returns the length of list.
 func (i *Indexer) Len() int {
 	return i.rows.Len()
 }
 
+// minCompactSlots is the minimum number of slots to trigger the compaction of positions.
+const minCompactSlots = 1024
+
+// positions records the positions of the elements in the list of Indexer, so that Iterate can seek to the offset in O(log n).
+// The elements are stored in slots in the list order, the slot of a removed element is set to nil,
+// and a Fenwick tree over the slots counts the elements before a position.
+// The slots are compacted once more than half of them are removed.
+// Each slot also records the sequence number of the element, which is used as the cursor of the element.
+type positions struct {
+	slots []*list.Element
+	// seqs is the sequence numbers of the slots, they increase in the slot order and are kept for the removed slots until compaction.
+	seqs    []uint64
+	nextSeq uint64
+	slot    map[*list.Element]int
+	// tree is the 1-based Fenwick tree, tree[0] is unused.
+	tree []int
+	live int
+}
+
+func newPositions() *positions {
+	return &positions{
+		slot: make(map[*list.Element]int),
+		tree: []int{0},
+	}
+}
+
+// prefix returns the number of elements in the first i slots.
+func (p *positions) prefix(i int) (n int) {
+	for ; i > 0; i -= i & -i {
+		n += p.tree[i]
+	}
+	return n
+}
+
+// push appends the element which has been pushed back to the list.
+func (p *positions) push(elem *list.Element) {
+	p.nextSeq++
+	p.add(elem, p.nextSeq)
+}
+
+func (p *positions) add(elem *list.Element, seq uint64) {
+	p.slot[elem] = len(p.slots)
+	p.slots = append(p.slots, elem)
+	p.seqs = append(p.seqs, seq)
+	i := len(p.slots)
+	p.tree = append(p.tree, p.prefix(i-1)-p.prefix(i-(i&-i))+1)
+	p.live++
+}
+
+// remove removes the element which has been removed from the list.
+func (p *positions) remove(elem *list.Element) {
+	s, ok := p.slot[elem]
+	if !ok {
+		return
+	}
+	delete(p.slot, elem)
+	p.slots[s] = nil
+	for i := s + 1; i < len(p.tree); i += i & -i {
+		p.tree[i]--
+	}
+	p.live--
+	if len(p.slots) >= minCompactSlots && p.live*2 < len(p.slots) {
+		p.compact()
+	}
+}
+
+func (p *positions) compact() {
+	slots, seqs := p.slots, p.seqs
+	p.slots = make([]*list.Element, 0, p.live)
+	p.seqs = make([]uint64, 0, p.live)
+	p.tree = make([]int, 1, p.live+1)
+	p.live = 0
+	for k, v := range slots {
+		if v != nil {
+			p.add(v, seqs[k])
+		}
+	}
+}
+
+// seqOf returns the sequence number of the element, 0 if not found.
+func (p *positions) seqOf(elem *list.Element) uint64 {
+	if s, ok := p.slot[elem]; ok {
+		return p.seqs[s]
+	}
+	return 0
+}
+
+// after returns the first element whose sequence number is greater than seq, nil if not found.
+func (p *positions) after(seq uint64) *list.Element {
+	for i := sort.Search(len(p.seqs), func(i int) bool {
+		return p.seqs[i] > seq
+	}); i < len(p.slots); i++ {
+		if p.slots[i] != nil {
+			return p.slots[i]
+		}
+	}
+	return nil
+}
+
+// seek returns the element at the given offset of the list, nil if the offset is out of range.
+func (p *positions) seek(offset int) *list.Element {
+	if offset < 0 || offset >= p.live {
+		return nil
+	}
+	// find the smallest position whose prefix is greater than offset.
+	pos, rem := 0, offset+1
+	step := 1
+	for step*2 < len(p.tree) {
+		step *= 2
+	}
+	for ; step > 0; step /= 2 {
+		if pos+step < len(p.tree) && p.tree[pos+step] < rem {
+			pos += step
+			rem -= p.tree[pos]
+		}
+	}
+	return p.slots[pos]
+}
+
+// parseIPOrCIDR parses the IP address or the CIDR into network, the IP address is treated as a single host network.
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("invalid IP address or CIDR")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
 // GetPage gets page and pageSize from request params.
 func GetPage(reqPage, reqPageSize uint32) (page, pageSize uint) {
 	page = 1
@@ -99,11 +324,55 @@ func GetOffsetN(page, pageSize uint) (offset, n uint) {
 	return
 }
 
-// ErrInvalidArgument is a wrapper function for easier invalid argument error handling.
-func ErrInvalidArgument(name string, msg string) error {
-	errString := "invalid " + name
-	if msg != "" {
-		errString = errString + ":" + msg
+// pageCursor is the position of the page in the list, either the page number or the cursor decoded from the page token.
+type pageCursor struct {
+	offset, n uint
+	// cursor is the cursor of the last element in the previous page, 0 means the page is located by offset.
+	cursor uint64
+}
+
+// getPageCursor gets the pageCursor from request params.
+// The page token cannot be set together with the page number, except for page 1.
+func getPageCursor(reqPage, reqPageSize uint32, pageToken string) (pageCursor, error) {
+	var p pageCursor
+	p.offset, p.n = GetOffsetN(GetPage(reqPage, reqPageSize))
+	if pageToken == "" {
+		return p, nil
+	}
+	if reqPage > 1 {
+		return p, ErrInvalidArgument("page", "cannot be set together with page_token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err == nil {
+		p.cursor, err = strconv.ParseUint(string(b), 10, 64)
+	}
+	if err != nil || p.cursor == 0 {
+		return p, ErrInvalidArgument("page_token", "")
+	}
+	return p, nil
+}
+
+// decodeKeyPageToken returns the key of the last element in the previous page, see encodeKeyPageToken.
+func decodeKeyPageToken(pageToken string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return "", err
+	}
+	if len(b) == 0 {
+		return "", errors.New("empty page token")
+	}
+	return string(b), nil
+}
+
+// encodeKeyPageToken returns the opaque page token of the list which is paged by the key of the elements, e.g: the client id.
+func encodeKeyPageToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// encodePageToken returns the opaque page token of the cursor, empty if cursor is 0.
+func encodePageToken(cursor uint64) string {
+	if cursor == 0 {
+		return ""
 	}
-	return status.Error(codes.InvalidArgument, errString)
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(cursor, 10)))
 }
@@ -2,10 +2,15 @@ package admin
 
 import (
 	"container/list"
+	"fmt"
+	"math/rand"
+	"net/http"
 	"strconv"
 	"testing"
 
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/status"
 )
 
 func TestIndexer(t *testing.T) {
@@ -35,3 +40,150 @@ func TestIndexer(t *testing.T) {
 	a.Equal([]int{4, 6}, rs)
 
 }
+
+func TestIndexer_Iterate_afterRemove(t *testing.T) {
+	a := assert.New(t)
+	i := NewIndexer()
+	var ids []string
+	for j := 0; j < 5000; j++ {
+		ids = append(ids, strconv.Itoa(j))
+		i.Set(strconv.Itoa(j), j)
+	}
+	r := rand.New(rand.NewSource(1))
+	// remove most of the elements to trigger the compaction.
+	for removed := 1; len(ids) > 100; removed++ {
+		k := r.Intn(len(ids))
+		a.NotNil(i.Remove(ids[k]))
+		ids = append(ids[:k], ids[k+1:]...)
+		if removed%10 == 0 {
+			id := "new" + strconv.Itoa(removed)
+			ids = append(ids, id)
+			i.Set(id, removed)
+		}
+	}
+	a.Less(len(i.positions.slots), 2*len(ids)+minCompactSlots)
+	var all []*list.Element
+	for e := i.rows.Front(); e != nil; e = e.Next() {
+		all = append(all, e)
+	}
+	for offset := 0; offset <= len(all)+1; offset++ {
+		var rs []*list.Element
+		i.Iterate(func(elem *list.Element) {
+			rs = append(rs, elem)
+		}, uint(offset), 7)
+		if offset >= len(all) {
+			a.Empty(rs)
+			continue
+		}
+		end := offset + 7
+		if end > len(all) {
+			end = len(all)
+		}
+		a.Equal(all[offset:end], rs)
+	}
+}
+
+func BenchmarkIndexer_Iterate(b *testing.B) {
+	i := NewIndexer()
+	for j := 0; j < 200000; j++ {
+		i.Set(strconv.Itoa(j), j)
+	}
+	for _, offset := range []uint{0, 100000} {
+		b.Run(fmt.Sprintf("offset_%d", offset), func(b *testing.B) {
+			for j := 0; j < b.N; j++ {
+				i.Iterate(func(elem *list.Element) {}, offset, 20)
+			}
+		})
+	}
+}
+
+func TestIndexer_IterateAfter(t *testing.T) {
+	a := assert.New(t)
+	i := NewIndexer()
+	next := 0
+	for ; next < 3000; next++ {
+		i.Set(strconv.Itoa(next), next)
+	}
+	// values returns the values after the cursor, at most n.
+	values := func(cursor uint64, n int) (rs []int, last uint64) {
+		i.IterateAfter(func(elem *list.Element) bool {
+			if len(rs) == n {
+				return false
+			}
+			rs = append(rs, elem.Value.(int))
+			last = i.Cursor(elem)
+			return true
+		}, cursor)
+		return rs, last
+	}
+	rs, cursor := values(0, 10)
+	a.Equal([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, rs)
+	a.Equal(cursor, i.Cursor(i.GetByID("9")))
+
+	// the element of the cursor is removed, and most of the elements are removed to trigger the compaction.
+	for j := 5; j < 2500; j++ {
+		i.Remove(strconv.Itoa(j))
+	}
+	// update in place
+	i.Set("2600", -1)
+	i.Set(strconv.Itoa(next), next)
+	rs, cursor = values(cursor, 3)
+	a.Equal([]int{2500, 2501, 2502}, rs)
+	rs, _ = values(cursor, 1000)
+	a.Len(rs, 498)
+	a.Equal(-1, rs[97])
+	a.Equal(next, rs[len(rs)-1])
+
+	a.Zero(i.Cursor(&list.Element{}))
+	rs, _ = values(cursor+10000, 1)
+	a.Empty(rs)
+}
+
+func TestIndexer_KeyFuncCollision(t *testing.T) {
+	a := assert.New(t)
+	type row struct {
+		id    string
+		value int
+	}
+	// all ids share the same key
+	i := NewIndexerWithKeyFunc(func(id string) string {
+		return "key"
+	}, func(value interface{}) string {
+		return value.(*row).id
+	})
+	for j := 0; j < 10; j++ {
+		i.Set(strconv.Itoa(j), &row{id: strconv.Itoa(j), value: j})
+	}
+	a.EqualValues(10, i.Len())
+	for j := 0; j < 10; j++ {
+		a.Equal(j, i.GetByID(strconv.Itoa(j)).Value.(*row).value)
+	}
+	i.Set("3", &row{id: "3", value: 30})
+	a.EqualValues(10, i.Len())
+	a.Equal(30, i.GetByID("3").Value.(*row).value)
+
+	// remove the element in index, the first collided element should be promoted.
+	a.Equal(0, i.Remove("0").Value.(*row).value)
+	a.Nil(i.GetByID("0"))
+	a.Nil(i.Remove("0"))
+	a.Equal(5, i.Remove("5").Value.(*row).value)
+	a.Nil(i.GetByID("5"))
+	for _, j := range []int{1, 2, 4, 6, 7, 8, 9} {
+		a.Equal(j, i.GetByID(strconv.Itoa(j)).Value.(*row).value)
+	}
+	a.Nil(i.GetByID("10"))
+	a.EqualValues(8, i.Len())
+}
+
+func TestHashKeyFunc(t *testing.T) {
+	a := assert.New(t)
+	a.Len(HashKeyFunc("a-very-long-client-id-that-takes-a-lot-of-memory"), 8)
+	a.Equal(HashKeyFunc("id"), HashKeyFunc("id"))
+	a.NotEqual(HashKeyFunc("id1"), HashKeyFunc("id2"))
+}
+
+func TestErrors_httpStatus(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(http.StatusBadRequest, runtime.HTTPStatusFromCode(status.Code(ErrInvalidArgument("page", ""))))
+	a.Equal(http.StatusNotFound, runtime.HTTPStatusFromCode(status.Code(ErrNotFound)))
+}
@@ -0,0 +1,384 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+var _ server.Plugin = (*Bridge)(nil)
+
+const Name = "bridge"
+
+// originKey is the user property key which marks the messages bridged by a bridge, the value is the client id of the bridge.
+// The messages marked by the bridge itself are never bridged again, which prevents the messages from looping between the brokers.
+const originKey = "gmqtt-bridge-origin"
+
+// defaultMaxInflight is the maximum number of the QoS 1 messages waiting for the PUBACK,
+// it is lowered to the receive maximum of the remote broker.
+const defaultMaxInflight = 100
+
+var errClosed = errors.New("bridge closed")
+
+func init() {
+	server.RegisterPlugin(Name, New)
+	config.RegisterDefaultPluginConfig(Name, &DefaultConfig)
+}
+
+func New(config config.Config) (server.Plugin, error) {
+	cfg := *config.Plugins[Name].(*Config)
+	if cfg.Address == "" {
+		return nil, errors.New("missing bridge address")
+	}
+	if cfg.ClientID == "" {
+		hostName, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientID = "gmqtt-bridge-" + hostName
+	}
+	return newBridge(cfg), nil
+}
+
+var log = zap.NewNop()
+
+// Bridge connects to the remote broker as a client and bridges the messages of the configured topic filters in both directions.
+type Bridge struct {
+	config    Config
+	publisher server.Publisher
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// conn is the current connection to the remote broker.
+	conn net.Conn
+	// connected indicates whether the connection to the remote broker is ready for forwarding.
+	connected bool
+	// queue is the messages waiting to be forwarded to the remote broker.
+	queue []*gmqtt.Message
+	// inflight is the QoS 1 messages waiting for the PUBACK in the sending order, they are queued again if the connection is lost.
+	inflight    []*gmqtt.Message
+	maxInflight int
+	maxQoS      uint8
+	nextID      packets.PacketID
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBridge(cfg Config) *Bridge {
+	b := &Bridge{
+		config: cfg,
+		exit:   make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *Bridge) Load(service server.Server) error {
+	log = server.LoggerWithField(zap.String("plugin", Name))
+	b.publisher = service.Publisher()
+	b.wg.Add(1)
+	go b.run()
+	return nil
+}
+
+func (b *Bridge) Unload() error {
+	b.mu.Lock()
+	close(b.exit)
+	if b.conn != nil {
+		_ = b.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+func (b *Bridge) Name() string {
+	return Name
+}
+
+// run keeps the connection to the remote broker, it reconnects with backoff upon failure.
+func (b *Bridge) run() {
+	defer b.wg.Done()
+	backoff := b.config.ReconnectMinBackoff
+	for {
+		ready, err := b.serve()
+		select {
+		case <-b.exit:
+			return
+		default:
+		}
+		if ready {
+			backoff = b.config.ReconnectMinBackoff
+		}
+		log.Warn("bridge connection lost",
+			zap.String("address", b.config.Address),
+			zap.Duration("reconnect_in", backoff),
+			zap.Error(err))
+		select {
+		case <-b.exit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > b.config.ReconnectMaxBackoff {
+			backoff = b.config.ReconnectMaxBackoff
+		}
+	}
+}
+
+// serve connects to the remote broker and bridges the messages until the connection is lost.
+// ready reports whether the connection has been established.
+func (b *Bridge) serve() (ready bool, err error) {
+	conn, err := net.DialTimeout("tcp", b.config.Address, b.config.ConnectTimeout)
+	if err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	select {
+	case <-b.exit:
+		b.mu.Unlock()
+		_ = conn.Close()
+		return false, errClosed
+	default:
+	}
+	b.conn = conn
+	b.mu.Unlock()
+	defer func() {
+		_ = conn.Close()
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+	}()
+
+	s := newSession(b, conn)
+	maxInflight, maxQoS, err := s.handshake()
+	if err != nil {
+		return false, err
+	}
+	log.Info("bridge connected", zap.String("address", b.config.Address), zap.String("client_id", b.config.ClientID))
+	b.setConnected(maxInflight, maxQoS)
+
+	errs := make(chan error, 3)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs <- s.readLoop()
+	}()
+	go func() {
+		defer wg.Done()
+		errs <- s.writeLoop()
+	}()
+	if b.config.KeepAlive > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.pingLoop(done)
+		}()
+	}
+	err = <-errs
+	close(done)
+	_ = conn.Close()
+	b.setDisconnected()
+	wg.Wait()
+	return true, err
+}
+
+func (b *Bridge) setConnected(maxInflight int, maxQoS uint8) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connected = true
+	b.maxInflight = maxInflight
+	b.maxQoS = maxQoS
+	b.cond.Broadcast()
+}
+
+// setDisconnected queues the inflight messages again in front of the queued ones, and drops the queued QoS 0 messages.
+func (b *Bridge) setDisconnected() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connected = false
+	queue := make([]*gmqtt.Message, 0, len(b.inflight)+len(b.queue))
+	for _, v := range b.inflight {
+		v.PacketID = 0
+		queue = append(queue, v)
+	}
+	for _, v := range b.queue {
+		if v.QoS != packets.Qos0 {
+			queue = append(queue, v)
+		}
+	}
+	b.queue = queue
+	b.inflight = nil
+	b.cond.Broadcast()
+}
+
+// enqueue adds the message to be forwarded to the remote broker.
+// The QoS 0 message is dropped if the connection is not ready, and any message is dropped if the buffer is full.
+func (b *Bridge) enqueue(msg *gmqtt.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if (msg.QoS == packets.Qos0 && !b.connected) || len(b.queue) >= b.config.MaxBuffered {
+		if ce := log.Check(zapcore.DebugLevel, "message not forwarded"); ce != nil {
+			ce.Write(zap.String("topic", msg.Topic), zap.Uint8("qos", msg.QoS), zap.Bool("connected", b.connected))
+		}
+		return
+	}
+	b.queue = append(b.queue, msg)
+	b.cond.Signal()
+}
+
+// next returns the PUBLISH packet of the next message to be forwarded, the QoS 1 message is moved into the inflight list.
+// It blocks until there is a message to be sent, and returns nil once the connection is lost.
+func (b *Bridge) next() *packets.Publish {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.connected && (len(b.queue) == 0 || b.qosLocked(b.queue[0]) != packets.Qos0 && len(b.inflight) >= b.maxInflight) {
+		b.cond.Wait()
+	}
+	if !b.connected {
+		return nil
+	}
+	msg := b.queue[0]
+	b.queue[0] = nil
+	b.queue = b.queue[1:]
+	msg.QoS = b.qosLocked(msg)
+	if msg.QoS != packets.Qos0 {
+		msg.PacketID = b.nextPacketIDLocked()
+		b.inflight = append(b.inflight, msg)
+	}
+	return gmqtt.MessageToPublish(msg, packets.Version5)
+}
+
+// qosLocked returns the QoS of the message downgraded to the maximum QoS of the remote broker.
+func (b *Bridge) qosLocked(msg *gmqtt.Message) uint8 {
+	if msg.QoS > b.maxQoS {
+		return b.maxQoS
+	}
+	return msg.QoS
+}
+
+func (b *Bridge) nextPacketIDLocked() packets.PacketID {
+	for {
+		b.nextID++
+		if b.nextID == 0 {
+			b.nextID = 1
+		}
+		inUse := false
+		for _, v := range b.inflight {
+			if v.PacketID == b.nextID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return b.nextID
+		}
+	}
+}
+
+// ack removes the inflight message of the packet id.
+func (b *Bridge) ack(id packets.PacketID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, v := range b.inflight {
+		if v.PacketID == id {
+			b.inflight = append(b.inflight[:k], b.inflight[k+1:]...)
+			b.cond.Signal()
+			return
+		}
+	}
+}
+
+// isOrigin reports whether the message is bridged by the bridge with the client id.
+func isOrigin(msg *gmqtt.Message, clientID string) bool {
+	for _, v := range msg.UserProperties {
+		if string(v.K) == originKey && string(v.V) == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bridge) markOrigin(msg *gmqtt.Message) {
+	msg.UserProperties = append(msg.UserProperties, packets.UserProperty{
+		K: []byte(originKey),
+		V: []byte(b.config.ClientID),
+	})
+}
+
+// toRemote returns the remote topic of the local topic, ok is false if the topic does not match the rule.
+func (r Rule) toRemote(topic string) (remote string, ok bool) {
+	if !packets.TopicMatch([]byte(topic), []byte(r.TopicFilter)) {
+		return "", false
+	}
+	return r.RemotePrefix + strings.TrimPrefix(topic, r.LocalPrefix), true
+}
+
+// toLocal returns the local topic of the remote topic, ok is false if the topic does not match the rule.
+func (r Rule) toLocal(topic string) (local string, ok bool) {
+	if !packets.TopicMatch([]byte(topic), []byte(r.TopicFilter)) {
+		return "", false
+	}
+	return r.LocalPrefix + strings.TrimPrefix(topic, r.RemotePrefix), true
+}
+
+// forward adds the local message to be forwarded if it matches any forward rule, the first matched rule applies.
+func (b *Bridge) forward(msg *gmqtt.Message) {
+	if isOrigin(msg, b.config.ClientID) {
+		return
+	}
+	for _, r := range b.config.Forward {
+		topic, ok := r.toRemote(msg.Topic)
+		if !ok {
+			continue
+		}
+		m := msg.Copy()
+		m.Topic = topic
+		m.Dup = false
+		m.PacketID = 0
+		m.SubscriptionIdentifier = nil
+		if m.QoS > r.QoS {
+			m.QoS = r.QoS
+		}
+		b.markOrigin(m)
+		b.enqueue(m)
+		return
+	}
+}
+
+// publishLocal publishes the message received from the remote broker to the local broker as a normal publish,
+// the retained message is stored by server.Publisher.PublishRetained.
+func (b *Bridge) publishLocal(p *packets.Publish) {
+	msg := gmqtt.MessageFromPublish(p)
+	if isOrigin(msg, b.config.ClientID) {
+		return
+	}
+	for _, r := range b.config.Subscribe {
+		topic, ok := r.toLocal(msg.Topic)
+		if !ok {
+			continue
+		}
+		msg.Topic = topic
+		msg.Dup = false
+		msg.PacketID = 0
+		msg.SubscriptionIdentifier = nil
+		b.markOrigin(msg)
+		if err := b.publisher.PublishRetained(msg); err != nil {
+			log.Warn("message from the remote broker rejected", zap.String("topic", msg.Topic), zap.Error(err))
+		}
+		return
+	}
+}
@@ -0,0 +1,398 @@
+package bridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	_ "github.com/DrmagicE/gmqtt/persistence"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+	_ "github.com/DrmagicE/gmqtt/topicalias/fifo"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	a := assert.New(t)
+	valid := DefaultConfig
+	valid.Address = "127.0.0.1:1883"
+	valid.Forward = []Rule{{TopicFilter: "up/#", QoS: 1, LocalPrefix: "up/", RemotePrefix: "hub/"}}
+	valid.Subscribe = []Rule{{TopicFilter: "hub/down/+", RemotePrefix: "hub/"}}
+	a.Nil(valid.Validate())
+	a.Nil(DefaultConfig.Validate())
+
+	for _, fn := range []func(c *Config){
+		func(c *Config) { c.Address = "127.0.0.1" },
+		func(c *Config) { c.KeepAlive = -time.Second },
+		func(c *Config) { c.ConnectTimeout = 0 },
+		func(c *Config) { c.ReconnectMaxBackoff = c.ReconnectMinBackoff / 2 },
+		func(c *Config) { c.MaxBuffered = 0 },
+		func(c *Config) { c.Forward[0].TopicFilter = "up/#/a" },
+		func(c *Config) { c.Forward[0].TopicFilter = "$share/g/up/#" },
+		func(c *Config) { c.Forward[0].QoS = 2 },
+		func(c *Config) { c.Forward[0].TopicFilter = "a/#" },
+		func(c *Config) { c.Subscribe[0].LocalPrefix = "+/" },
+		func(c *Config) { c.Subscribe[0].TopicFilter = "down/+" },
+	} {
+		c := valid
+		c.Forward = []Rule{valid.Forward[0]}
+		c.Subscribe = []Rule{valid.Subscribe[0]}
+		fn(&c)
+		a.Error(c.Validate())
+	}
+}
+
+func TestRule(t *testing.T) {
+	a := assert.New(t)
+	r := Rule{TopicFilter: "up/#", LocalPrefix: "up/", RemotePrefix: "hub/site1/"}
+	remote, ok := r.toRemote("up/a/b")
+	a.True(ok)
+	a.Equal("hub/site1/a/b", remote)
+	_, ok = r.toRemote("down/a")
+	a.False(ok)
+
+	r = Rule{TopicFilter: "hub/site1/#", LocalPrefix: "down/", RemotePrefix: "hub/site1/"}
+	local, ok := r.toLocal("hub/site1/a")
+	a.True(ok)
+	a.Equal("down/a", local)
+
+	// no rewrite
+	r = Rule{TopicFilter: "#"}
+	local, ok = r.toLocal("a/b")
+	a.True(ok)
+	a.Equal("a/b", local)
+}
+
+// remoteBroker is the fake remote broker which accepts the bridge connection.
+type remoteBroker struct {
+	a    *assert.Assertions
+	ln   net.Listener
+	conn net.Conn
+	r    *packets.Reader
+	w    *packets.Writer
+}
+
+func (rb *remoteBroker) read() packets.Packet {
+	_ = rb.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := rb.r.ReadPacket()
+	rb.a.Nil(err)
+	return p
+}
+
+func (rb *remoteBroker) write(p packets.Packet) {
+	rb.a.Nil(rb.w.WriteAndFlush(p))
+}
+
+// accept accepts the bridge connection and responds to the CONNECT and SUBSCRIBE packets.
+func (rb *remoteBroker) accept() {
+	conn, err := rb.ln.Accept()
+	rb.a.Nil(err)
+	rb.conn = conn
+	rb.r = packets.NewReader(conn)
+	rb.r.SetVersion(packets.Version5)
+	rb.w = packets.NewWriter(conn)
+
+	connect := rb.read().(*packets.Connect)
+	rb.a.Equal(packets.Version5, connect.Version)
+	rb.a.Equal("bridge", string(connect.ClientID))
+	rb.a.Equal("user", string(connect.Username))
+	rb.write(connect.NewConnackPacket(codes.Success, false))
+
+	sub := rb.read().(*packets.Subscribe)
+	rb.a.Equal([]packets.Topic{{
+		SubOptions: packets.SubOptions{Qos: 1, NoLocal: true, RetainAsPublished: true},
+		Name:       "hub/down/#",
+	}}, sub.Topics)
+	suback := sub.NewSuback()
+	suback.Payload = []codes.Code{codes.GrantedQoS1}
+	rb.write(suback)
+}
+
+func newPublish(topic string, qos uint8, id packets.PacketID, userProperties ...packets.UserProperty) *packets.Publish {
+	return &packets.Publish{
+		Version:    packets.Version5,
+		Qos:        qos,
+		PacketID:   id,
+		TopicName:  []byte(topic),
+		Payload:    []byte("payload"),
+		Properties: &packets.Properties{User: userProperties},
+	}
+}
+
+func TestBridge(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer ln.Close()
+	rb := &remoteBroker{a: a, ln: ln}
+
+	cfg := DefaultConfig
+	cfg.Address = ln.Addr().String()
+	cfg.ClientID = "bridge"
+	cfg.Username = "user"
+	cfg.KeepAlive = 0
+	cfg.ReconnectMinBackoff = 10 * time.Millisecond
+	cfg.Forward = []Rule{{TopicFilter: "up/#", QoS: 1, LocalPrefix: "up/", RemotePrefix: "hub/up/"}}
+	cfg.Subscribe = []Rule{{TopicFilter: "hub/down/#", QoS: 1, LocalPrefix: "down/", RemotePrefix: "hub/down/"}}
+	b := newBridge(cfg)
+
+	published := make(chan *gmqtt.Message, 10)
+	pub := server.NewMockPublisher(ctrl)
+	pub.EXPECT().PublishRetained(gomock.Any()).Do(func(msg *gmqtt.Message) {
+		published <- msg
+	}).Return(nil).AnyTimes()
+	srv := server.NewMockServer(ctrl)
+	srv.EXPECT().Publisher().Return(pub)
+
+	// the QoS 1 message is buffered during the outage, and the QoS 0 message is dropped.
+	b.forward(&gmqtt.Message{Topic: "up/a", QoS: packets.Qos1, Payload: []byte("a")})
+	b.forward(&gmqtt.Message{Topic: "up/b", Payload: []byte("b")})
+	// not matched
+	b.forward(&gmqtt.Message{Topic: "other", QoS: packets.Qos1})
+
+	a.Nil(b.Load(srv))
+	rb.accept()
+	p := rb.read().(*packets.Publish)
+	a.Equal("hub/up/a", string(p.TopicName))
+	a.Equal(packets.Qos1, p.Qos)
+	a.Equal([]packets.UserProperty{{K: []byte(originKey), V: []byte("bridge")}}, p.Properties.User)
+
+	// the message is sent again after reconnecting if it has not been acknowledged.
+	_ = rb.conn.Close()
+	rb.accept()
+	p = rb.read().(*packets.Publish)
+	a.Equal("hub/up/a", string(p.TopicName))
+	rb.write(p.NewPuback(codes.Success, nil))
+
+	// the QoS is downgraded to the rule.
+	b.forward(&gmqtt.Message{Topic: "up/c", QoS: packets.Qos2})
+	p = rb.read().(*packets.Publish)
+	a.Equal("hub/up/c", string(p.TopicName))
+	a.Equal(packets.Qos1, p.Qos)
+	rb.write(p.NewPuback(codes.Success, nil))
+
+	// the message forwarded by the bridge itself is not published locally.
+	rb.write(newPublish("hub/down/a", packets.Qos1, 1, packets.UserProperty{K: []byte(originKey), V: []byte("bridge")}))
+	a.Equal(packets.PacketID(1), rb.read().(*packets.Puback).PacketID)
+	rb.write(newPublish("hub/down/b", packets.Qos1, 2))
+	a.Equal(packets.PacketID(2), rb.read().(*packets.Puback).PacketID)
+	select {
+	case msg := <-published:
+		a.Equal("down/b", msg.Topic)
+		a.True(isOrigin(msg, "bridge"))
+		// the remote message is not forwarded back.
+		b.forward(msg)
+		b.mu.Lock()
+		a.Empty(b.queue)
+		b.mu.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not published")
+	}
+	a.Empty(published)
+
+	a.Nil(b.Unload())
+}
+
+func TestBridge_enqueue(t *testing.T) {
+	a := assert.New(t)
+	cfg := DefaultConfig
+	cfg.MaxBuffered = 2
+	b := newBridge(cfg)
+	for _, v := range []string{"a", "b", "c"} {
+		b.enqueue(&gmqtt.Message{Topic: v, QoS: packets.Qos1})
+	}
+	a.Len(b.queue, 2)
+
+	b.setConnected(1, packets.Qos1)
+	b.enqueue(&gmqtt.Message{Topic: "d"})
+	a.Len(b.queue, 2)
+	b.queue = b.queue[:1]
+	b.enqueue(&gmqtt.Message{Topic: "d"})
+	a.Equal(packets.PacketID(1), b.next().PacketID)
+	// the QoS 0 message is sent while the inflight list is full.
+	a.Equal("d", string(b.next().TopicName))
+
+	b.enqueue(&gmqtt.Message{Topic: "e"})
+	b.setDisconnected()
+	// the inflight message is queued again and the QoS 0 message is dropped.
+	if a.Len(b.queue, 1) {
+		a.Equal("a", b.queue[0].Topic)
+		a.Equal(packets.PacketID(0), b.queue[0].PacketID)
+	}
+	a.Nil(b.next())
+}
+
+func TestBridge_OnMsgArrivedWrapper(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cfg := DefaultConfig
+	cfg.Forward = []Rule{{TopicFilter: "#", QoS: 1}}
+	b := newBridge(cfg)
+	fn := b.OnMsgArrivedWrapper(func(ctx context.Context, client server.Client, req *server.MsgArrivedRequest) error {
+		return nil
+	})
+	client := server.NewMockClient(ctrl)
+	a.Nil(fn(context.Background(), client, &server.MsgArrivedRequest{
+		Message: &gmqtt.Message{Topic: "a", QoS: packets.Qos1},
+	}))
+	a.Len(b.queue, 1)
+}
+
+// authPlugin rejects the messages published to the denied topic, and reports the topics it receives.
+type authPlugin struct {
+	denied  string
+	arrived chan string
+}
+
+func (p *authPlugin) Load(service server.Server) error {
+	return nil
+}
+
+func (p *authPlugin) Unload() error {
+	return nil
+}
+
+func (p *authPlugin) Name() string {
+	return "auth"
+}
+
+func (p *authPlugin) HookWrapper() server.HookWrapper {
+	return server.HookWrapper{
+		OnMsgArrivedWrapper: func(pre server.OnMsgArrived) server.OnMsgArrived {
+			return func(ctx context.Context, client server.Client, req *server.MsgArrivedRequest) error {
+				p.arrived <- req.Message.Topic
+				if req.Message.Topic == p.denied {
+					return codes.NewError(codes.NotAuthorized)
+				}
+				return pre(ctx, client, req)
+			}
+		},
+	}
+}
+
+// runServer runs the broker with the plugins, it returns the MQTT address and the function to stop the broker.
+func runServer(a *assert.Assertions, cfg config.Config, plugins ...server.Plugin) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	srv := server.New(
+		server.WithConfig(cfg),
+		server.WithTCPListener(ln),
+		server.WithPlugin(plugins...),
+	)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- srv.Run()
+	}()
+	return ln.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Nil(srv.Stop(ctx))
+		a.Nil(<-runErr)
+	}
+}
+
+// disconnectWithWill connects a client with the will message and closes the connection without DISCONNECT,
+// so that the will message is published.
+func disconnectWithWill(a *assert.Assertions, addr string, clientID string, willTopic string) {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.Nil(err) {
+		return
+	}
+	defer conn.Close()
+	a.Nil(packets.NewWriter(conn).WriteAndFlush(&packets.Connect{
+		Version:       packets.Version311,
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: byte(packets.Version311),
+		CleanStart:    true,
+		KeepAlive:     60,
+		ClientID:      []byte(clientID),
+		WillFlag:      true,
+		WillQos:       packets.Qos1,
+		WillTopic:     []byte(willTopic),
+		WillMsg:       []byte("will"),
+	}))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.NewReader(conn).ReadPacket()
+	a.Nil(err)
+	a.IsType(&packets.Connack{}, p)
+}
+
+// newWillTestBridge returns the bridge which forwards the "up/" topics to rb.
+func newWillTestBridge(a *assert.Assertions) (*Bridge, *remoteBroker) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	rb := &remoteBroker{a: a, ln: ln}
+	cfg := DefaultConfig
+	cfg.Address = ln.Addr().String()
+	cfg.ClientID = "bridge"
+	cfg.Username = "user"
+	cfg.KeepAlive = 0
+	cfg.Forward = []Rule{{TopicFilter: "up/#", QoS: 1, LocalPrefix: "up/", RemotePrefix: "hub/up/"}}
+	cfg.Subscribe = []Rule{{TopicFilter: "hub/down/#", QoS: 1, LocalPrefix: "down/", RemotePrefix: "hub/down/"}}
+	return newBridge(cfg), rb
+}
+
+// assertNoPacket asserts that the remote broker receives nothing more.
+func (rb *remoteBroker) assertNoPacket() {
+	_ = rb.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := rb.r.ReadPacket()
+	rb.a.Error(err)
+}
+
+func TestBridge_willMessage(t *testing.T) {
+	a := assert.New(t)
+	b, rb := newWillTestBridge(a)
+	defer rb.ln.Close()
+	addr, stop := runServer(a, config.DefaultConfig(), b)
+	defer stop()
+	rb.accept()
+
+	// the will message is forwarded once by OnWillPublish.
+	disconnectWithWill(a, addr, "c1", "up/will")
+	p := rb.read().(*packets.Publish)
+	a.Equal("hub/up/will", string(p.TopicName))
+	a.Equal([]byte("will"), p.Payload)
+	rb.write(p.NewPuback(codes.Success, nil))
+	rb.assertNoPacket()
+}
+
+func TestBridge_willMessageAuth(t *testing.T) {
+	a := assert.New(t)
+	b, rb := newWillTestBridge(a)
+	defer rb.ln.Close()
+	auth := &authPlugin{denied: "up/denied", arrived: make(chan string, 10)}
+
+	cfg := config.DefaultConfig()
+	cfg.MQTT.WillMessageAuth = true
+	// the bridge forwards the messages which have been authorized by the inner hook.
+	addr, stop := runServer(a, cfg, b, auth)
+	defer stop()
+	rb.accept()
+
+	disconnectWithWill(a, addr, "c1", "up/denied")
+	a.Equal("up/denied", <-auth.arrived)
+	disconnectWithWill(a, addr, "c2", "up/allowed")
+	a.Equal("up/allowed", <-auth.arrived)
+
+	// the unauthorized will message is not forwarded, and the authorized one is forwarded once.
+	p := rb.read().(*packets.Publish)
+	a.Equal("hub/up/allowed", string(p.TopicName))
+	rb.write(p.NewPuback(codes.Success, nil))
+	rb.assertNoPacket()
+}
@@ -0,0 +1,133 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// Rule is a topic filter to be bridged.
+type Rule struct {
+	// TopicFilter is the topic filter of the bridged messages.
+	// For the forward rules, it is matched against the local topics.
+	// For the subscribe rules, it is subscribed on the remote broker.
+	// Shared subscriptions are not supported.
+	TopicFilter string `yaml:"topic_filter"`
+	// QoS is the maximum QoS of the bridged messages, the messages of higher QoS are downgraded to it.
+	// Possible values: 0, 1.
+	QoS uint8 `yaml:"qos"`
+	// LocalPrefix and RemotePrefix rewrite the topic of the bridged messages.
+	// For the forward rules, the LocalPrefix of the local topic is replaced by the RemotePrefix,
+	// and vice versa for the subscribe rules.
+	// The TopicFilter must begin with the LocalPrefix for the forward rules, or the RemotePrefix for the subscribe rules.
+	LocalPrefix  string `yaml:"local_prefix"`
+	RemotePrefix string `yaml:"remote_prefix"`
+}
+
+func (r Rule) validate(field string, filterPrefix string) error {
+	if !packets.ValidTopicFilter(true, []byte(r.TopicFilter)) || strings.HasPrefix(r.TopicFilter, "$share/") {
+		return fmt.Errorf("invalid %s topic_filter: %s", field, r.TopicFilter)
+	}
+	if r.QoS > packets.Qos1 {
+		return fmt.Errorf("invalid %s qos: %d", field, r.QoS)
+	}
+	if !strings.HasPrefix(r.TopicFilter, filterPrefix) {
+		return fmt.Errorf("%s topic_filter %s must begin with the prefix %s", field, r.TopicFilter, filterPrefix)
+	}
+	for _, v := range []string{r.LocalPrefix, r.RemotePrefix} {
+		if strings.ContainsAny(v, "#+") {
+			return fmt.Errorf("invalid %s prefix: %s", field, v)
+		}
+	}
+	return nil
+}
+
+// Config is the configuration for the bridge plugin.
+type Config struct {
+	// Address is the TCP address of the remote broker, e.g: broker.example.com:1883.
+	// The remote broker must support MQTT v5.
+	Address string `yaml:"address"`
+	// ClientID is the client id used to connect to the remote broker. Defaults to "gmqtt-bridge-" + hostname.
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// KeepAlive is the keep alive interval of the connection to the remote broker. 0 means disabled.
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// ConnectTimeout is the timeout of dialing, connecting and subscribing to the remote broker.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// ReconnectMinBackoff and ReconnectMaxBackoff are the bounds of the reconnect backoff,
+	// the backoff doubles after each failed attempt.
+	ReconnectMinBackoff time.Duration `yaml:"reconnect_min_backoff"`
+	ReconnectMaxBackoff time.Duration `yaml:"reconnect_max_backoff"`
+	// MaxBuffered is the maximum number of the messages waiting to be forwarded to the remote broker.
+	// During the outage, the QoS 1 messages are buffered and the QoS 0 messages are dropped.
+	// The new messages are dropped if the buffer is full.
+	MaxBuffered int `yaml:"max_buffered"`
+	// Forward is the rules of the local messages forwarded to the remote broker.
+	Forward []Rule `yaml:"forward"`
+	// Subscribe is the rules of the remote messages published to the local broker.
+	Subscribe []Rule `yaml:"subscribe"`
+}
+
+// Validate validates the configuration, and return an error if it is invalid.
+func (c *Config) Validate() error {
+	if c.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return errors.New("invalid address")
+		}
+	}
+	if c.KeepAlive < 0 || c.KeepAlive > 65535*time.Second {
+		return fmt.Errorf("invalid keep_alive: %s", c.KeepAlive)
+	}
+	if c.ConnectTimeout <= 0 {
+		return fmt.Errorf("invalid connect_timeout: %s", c.ConnectTimeout)
+	}
+	if c.ReconnectMinBackoff <= 0 || c.ReconnectMaxBackoff < c.ReconnectMinBackoff {
+		return fmt.Errorf("invalid reconnect backoff: %s-%s", c.ReconnectMinBackoff, c.ReconnectMaxBackoff)
+	}
+	if c.MaxBuffered <= 0 {
+		return fmt.Errorf("invalid max_buffered: %d", c.MaxBuffered)
+	}
+	for _, v := range c.Forward {
+		if err := v.validate("forward", v.LocalPrefix); err != nil {
+			return err
+		}
+	}
+	for _, v := range c.Subscribe {
+		if err := v.validate("subscribe", v.RemotePrefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultConfig is the default configuration.
+var DefaultConfig = Config{
+	KeepAlive:           60 * time.Second,
+	ConnectTimeout:      10 * time.Second,
+	ReconnectMinBackoff: time.Second,
+	ReconnectMaxBackoff: time.Minute,
+	MaxBuffered:         1000,
+}
+
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type cfg Config
+	df := cfg(DefaultConfig)
+	var v = &struct {
+		Bridge *cfg `yaml:"bridge"`
+	}{
+		Bridge: &df,
+	}
+	if err := unmarshal(v); err != nil {
+		return err
+	}
+	if v.Bridge == nil {
+		v.Bridge = &df
+	}
+	*c = Config(*v.Bridge)
+	return nil
+}
@@ -0,0 +1,39 @@
+package bridge
+
+import (
+	"context"
+
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+func (b *Bridge) HookWrapper() server.HookWrapper {
+	return server.HookWrapper{
+		OnMsgArrivedWrapper:  b.OnMsgArrivedWrapper,
+		OnWillPublishWrapper: b.OnWillPublishWrapper,
+	}
+}
+
+func (b *Bridge) OnMsgArrivedWrapper(pre server.OnMsgArrived) server.OnMsgArrived {
+	return func(ctx context.Context, client server.Client, req *server.MsgArrivedRequest) error {
+		err := pre(ctx, client, req)
+		if err != nil {
+			return err
+		}
+		// do not forward the message in dry-run mode.
+		// The broker-generated messages are not forwarded either, they include the messages received from the remote broker.
+		if req.Message != nil && !server.IsDryRun(ctx) && !server.IsSystemClient(client) {
+			b.forward(req.Message)
+		}
+		return nil
+	}
+}
+
+func (b *Bridge) OnWillPublishWrapper(pre server.OnWillPublish) server.OnWillPublish {
+	return func(ctx context.Context, clientID string, req *server.WillMsgRequest) {
+		pre(ctx, clientID, req)
+		// the will message is forwarded by OnMsgArrived after it is authorized.
+		if req.Message != nil && !server.IsWillAuthPending(ctx) {
+			b.forward(req.Message)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// subscribePacketID is the packet id of the SUBSCRIBE packet, it is sent before any PUBLISH packet.
+const subscribePacketID packets.PacketID = 1
+
+// session is a connection to the remote broker.
+type session struct {
+	b    *Bridge
+	conn net.Conn
+	r    *packets.Reader
+	// wmu guards w, the packets are written by the read loop, the write loop and the ping loop.
+	wmu sync.Mutex
+	w   *packets.Writer
+}
+
+func newSession(b *Bridge, conn net.Conn) *session {
+	s := &session{
+		b:    b,
+		conn: conn,
+		r:    packets.NewReader(conn),
+		w:    packets.NewWriter(conn),
+	}
+	s.r.SetVersion(packets.Version5)
+	return s
+}
+
+func (s *session) write(p packets.Packet) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.w.WriteAndFlush(p)
+}
+
+// handshake sends the CONNECT packet and the SUBSCRIBE packet of the subscribe rules,
+// it returns the flow control limits of the remote broker.
+func (s *session) handshake() (maxInflight int, maxQoS uint8, err error) {
+	cfg := s.b.config
+	_ = s.conn.SetDeadline(time.Now().Add(cfg.ConnectTimeout))
+	connect := &packets.Connect{
+		Version:       packets.Version5,
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: byte(packets.Version5),
+		CleanStart:    true,
+		KeepAlive:     uint16(cfg.KeepAlive / time.Second),
+		ClientID:      []byte(cfg.ClientID),
+		Properties:    &packets.Properties{},
+	}
+	if cfg.Username != "" {
+		connect.UsernameFlag = true
+		connect.Username = []byte(cfg.Username)
+	}
+	if cfg.Password != "" {
+		connect.PasswordFlag = true
+		connect.Password = []byte(cfg.Password)
+	}
+	if err = s.write(connect); err != nil {
+		return
+	}
+	p, err := s.r.ReadPacket()
+	if err != nil {
+		return
+	}
+	connack, ok := p.(*packets.Connack)
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpected packet: %s", p)
+	}
+	if connack.Code != codes.Success {
+		return 0, 0, fmt.Errorf("connection refused by the remote broker: %d", connack.Code)
+	}
+	maxInflight, maxQoS = defaultMaxInflight, packets.Qos1
+	if ppt := connack.Properties; ppt != nil {
+		if ppt.ReceiveMaximum != nil && int(*ppt.ReceiveMaximum) < maxInflight {
+			maxInflight = int(*ppt.ReceiveMaximum)
+		}
+		if ppt.MaximumQoS != nil && *ppt.MaximumQoS < maxQoS {
+			maxQoS = *ppt.MaximumQoS
+		}
+	}
+	if err = s.subscribe(); err != nil {
+		return
+	}
+	_ = s.conn.SetDeadline(time.Time{})
+	return maxInflight, maxQoS, nil
+}
+
+// subscribe subscribes the subscribe rules and waits for the SUBACK, the rejected subscriptions are logged only.
+func (s *session) subscribe() error {
+	rules := s.b.config.Subscribe
+	if len(rules) == 0 {
+		return nil
+	}
+	sub := &packets.Subscribe{
+		Version:    packets.Version5,
+		PacketID:   subscribePacketID,
+		Properties: &packets.Properties{},
+	}
+	for _, v := range rules {
+		sub.Topics = append(sub.Topics, packets.Topic{
+			SubOptions: packets.SubOptions{
+				Qos: v.QoS,
+				// do not receive the messages forwarded by the bridge itself.
+				NoLocal:           true,
+				RetainAsPublished: true,
+			},
+			Name: v.TopicFilter,
+		})
+	}
+	if err := s.write(sub); err != nil {
+		return err
+	}
+	for {
+		p, err := s.r.ReadPacket()
+		if err != nil {
+			return err
+		}
+		// the remote broker may send the matched messages before the SUBACK.
+		suback, ok := p.(*packets.Suback)
+		if !ok {
+			if err = s.handle(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if suback.PacketID != subscribePacketID {
+			return fmt.Errorf("unexpected packet: %s", p)
+		}
+		for k, v := range suback.Payload {
+			if v >= codes.UnspecifiedError && k < len(rules) {
+				log.Warn("bridge subscription rejected by the remote broker",
+					zap.String("topic_filter", rules[k].TopicFilter),
+					zap.Uint8("code", v))
+			}
+		}
+		return nil
+	}
+}
+
+// handle handles the packet received from the remote broker.
+func (s *session) handle(p packets.Packet) error {
+	switch v := p.(type) {
+	case *packets.Publish:
+		if v.Qos > packets.Qos1 {
+			return fmt.Errorf("unexpected QoS %d of the publish", v.Qos)
+		}
+		s.b.publishLocal(v)
+		if v.Qos == packets.Qos1 {
+			return s.write(v.NewPuback(codes.Success, nil))
+		}
+	case *packets.Puback:
+		if v.Code >= codes.UnspecifiedError {
+			log.Warn("bridge message rejected by the remote broker", zap.Uint16("pid", v.PacketID), zap.Uint8("code", v.Code))
+		}
+		s.b.ack(v.PacketID)
+	case *packets.Disconnect:
+		return fmt.Errorf("disconnected by the remote broker: %d", v.Code)
+	}
+	return nil
+}
+
+func (s *session) readLoop() error {
+	keepAlive := s.b.config.KeepAlive
+	for {
+		if keepAlive > 0 {
+			_ = s.conn.SetReadDeadline(time.Now().Add(keepAlive + keepAlive/2))
+		}
+		p, err := s.r.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if err = s.handle(p); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) writeLoop() error {
+	for {
+		pub := s.b.next()
+		if pub == nil {
+			return errors.New("connection lost")
+		}
+		if err := s.write(pub); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) pingLoop(done chan struct{}) error {
+	ticker := time.NewTicker(s.b.config.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			if err := s.write(&packets.Pingreq{}); err != nil {
+				return err
+			}
+		}
+	}
+}
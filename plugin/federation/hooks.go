@@ -181,7 +181,9 @@ func (f *Federation) OnMsgArrivedWrapper(pre server.OnMsgArrived) server.OnMsgAr
 		if err != nil {
 			return err
 		}
-		if req.Message != nil {
+		// do not forward the message in dry-run mode.
+		// The broker-generated messages are not forwarded either, they include the messages received from other nodes.
+		if req.Message != nil && !server.IsDryRun(ctx) && !server.IsSystemClient(client) {
 			drop, opts := f.sendMessage(req.Message)
 			if drop {
 				req.Drop()
@@ -219,7 +221,8 @@ func (f *Federation) OnSessionTerminatedWrapper(pre server.OnSessionTerminated)
 func (f *Federation) OnWillPublishWrapper(pre server.OnWillPublish) server.OnWillPublish {
 	return func(ctx context.Context, clientID string, req *server.WillMsgRequest) {
 		pre(ctx, clientID, req)
-		if req.Message != nil {
+		// the will message is forwarded by OnMsgArrived after it is authorized.
+		if req.Message != nil && !server.IsWillAuthPending(ctx) {
 			drop, opts := f.sendMessage(req.Message)
 			if drop {
 				req.Drop()
@@ -3,6 +3,7 @@ package prometheus
 import (
 	"errors"
 	"net"
+	"strings"
 )
 
 // Config is the configuration for the prometheus plugin.
@@ -19,6 +20,9 @@ func (c *Config) Validate() error {
 	if err != nil {
 		return errors.New("invalid listen_address")
 	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return errors.New("invalid path")
+	}
 	return nil
 }
 
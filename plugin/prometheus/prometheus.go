@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/DrmagicE/gmqtt/config"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/retained"
 	"github.com/DrmagicE/gmqtt/server"
 )
 
@@ -81,6 +83,7 @@ func (p *Prometheus) Collect(m chan<- prometheus.Metric) {
 	collectPacketsStats(&st.PacketStats, m)
 	collectClientStats(&st.ConnectionStats, m)
 	collectSubscriptionStats(&st.SubscriptionStats, m)
+	collectRetainedStats(&st.RetainedStats, m)
 	collectMessageStats(&st.MessageStats, m)
 }
 
@@ -275,6 +278,12 @@ func collectClientStats(c *server.ConnectionStats, m chan<- prometheus.Metric) {
 		prometheus.CounterValue,
 		float64(atomic.LoadUint64(&c.ConnectedTotal)),
 	)
+	// every connected client has an active session.
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"clients_connected", "", nil, nil),
+		prometheus.GaugeValue,
+		float64(atomic.LoadUint64(&c.ActiveCurrent)),
+	)
 	m <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc(metricPrefix+"sessions_created_total", "", nil, nil),
 		prometheus.CounterValue,
@@ -310,10 +319,47 @@ func collectClientStats(c *server.ConnectionStats, m chan<- prometheus.Metric) {
 		prometheus.CounterValue,
 		float64(atomic.LoadUint64(&c.DisconnectedTotal)),
 	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"connections_current", "", nil, nil),
+		prometheus.GaugeValue,
+		float64(atomic.LoadUint64(&c.ConnectionsCurrent)),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"reconnect_storm_mitigating", "", nil, nil),
+		prometheus.GaugeValue,
+		float64(atomic.LoadUint64(&c.ReconnectStormMitigating)),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"reconnect_storm_rejected_total", "", nil, nil),
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.ReconnectStormRejectedTotal)),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"error_logs_suppressed_total", "", nil, nil),
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.ErrorLogsSuppressedTotal)),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"persistence_unhealthy", "", nil, nil),
+		prometheus.GaugeValue,
+		float64(atomic.LoadUint64(&c.PersistenceUnhealthy)),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"persistence_rejected_total", "", nil, nil),
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.PersistenceRejectedTotal)),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"subscriptions_rejected_total", "", nil, nil),
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.SubscriptionsRejectedTotal)),
+	)
 }
 func collectMessageStats(ms *server.MessageStats, m chan<- prometheus.Metric) {
 	collectMessageStatsDropped(ms, m)
+	collectMessageStatsInflight(ms, m)
 	collectMessageStatsQueued(ms, m)
+	collectMessageStatsQueuedAge(ms, m)
 	collectMessageStatsReceived(ms, m)
 	collectMessageStatsSent(ms, m)
 }
@@ -341,6 +387,24 @@ func collectQoSDropped(metricName string, qos string, stats *server.MessageQosSt
 		prometheus.CounterValue,
 		float64(atomic.LoadUint64(&stats.DroppedTotal.ExceedsMaxPacketSize)), qos, "exceeds_max_size",
 	)
+
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricName, "", []string{"qos", "type"}, nil),
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&stats.DroppedTotal.InflightExpired)), qos, "inflight_expired",
+	)
+
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricName, "", []string{"qos", "type"}, nil),
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&stats.DroppedTotal.InflightTrimmed)), qos, "inflight_trimmed",
+	)
+
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricName, "", []string{"qos", "type"}, nil),
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&stats.DroppedTotal.WriteBufferFull)), qos, "write_buffer_full",
+	)
 }
 
 func collectMessageStatsDropped(ms *server.MessageStats, m chan<- prometheus.Metric) {
@@ -350,6 +414,15 @@ func collectMessageStatsDropped(ms *server.MessageStats, m chan<- prometheus.Met
 	collectQoSDropped(metricName, "2", &ms.Qos2, m)
 }
 
+func collectMessageStatsInflight(ms *server.MessageStats, m chan<- prometheus.Metric) {
+	metricName := metricPrefix + "messages_inflight_current"
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricName, "", nil, nil),
+		prometheus.GaugeValue,
+		float64(atomic.LoadUint64(&ms.InflightCurrent)),
+	)
+}
+
 func collectMessageStatsQueued(ms *server.MessageStats, m chan<- prometheus.Metric) {
 	metricName := metricPrefix + "messages_queued_current"
 	m <- prometheus.MustNewConstMetric(
@@ -358,6 +431,18 @@ func collectMessageStatsQueued(ms *server.MessageStats, m chan<- prometheus.Metr
 		float64(atomic.LoadUint64(&ms.QueuedCurrent)),
 	)
 }
+
+// collectMessageStatsQueuedAge collects the age of the oldest message waiting for delivery among all clients.
+// Use the admin API to find out which client is falling behind.
+func collectMessageStatsQueuedAge(ms *server.MessageStats, m chan<- prometheus.Metric) {
+	metricName := metricPrefix + "messages_queued_oldest_age_seconds"
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricName, "", nil, nil),
+		prometheus.GaugeValue,
+		ms.OldestQueuedMessageAge(time.Now()).Seconds(),
+	)
+}
+
 func collectMessageStatsReceived(ms *server.MessageStats, m chan<- prometheus.Metric) {
 	metricName := metricPrefix + "messages_received_total"
 	m <- prometheus.MustNewConstMetric(
@@ -407,3 +492,26 @@ func collectSubscriptionStats(s *subscription.Stats, m chan<- prometheus.Metric)
 		float64(atomic.LoadUint64(&s.SubscriptionsCurrent)),
 	)
 }
+
+func collectRetainedStats(s *retained.Stats, m chan<- prometheus.Metric) {
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"retained_messages_current", "", nil, nil),
+		prometheus.GaugeValue,
+		float64(s.RetainedMessages),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"retained_bytes_current", "", nil, nil),
+		prometheus.GaugeValue,
+		float64(s.RetainedBytes),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"retained_evicted_total", "", nil, nil),
+		prometheus.CounterValue,
+		float64(s.EvictedTotal),
+	)
+	m <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(metricPrefix+"retained_rejected_total", "", nil, nil),
+		prometheus.CounterValue,
+		float64(s.RejectedTotal),
+	)
+}
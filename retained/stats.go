@@ -0,0 +1,69 @@
+package retained
+
+import (
+	"errors"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+)
+
+var (
+	// ErrExceedsMaxMessageBytes will be returned by Limiter.TryAddOrReplace if the payload exceeds Limits.MaxMessageBytes.
+	ErrExceedsMaxMessageBytes = errors.New("retained message exceeds the maximum payload size")
+	// ErrExceedsMaxMessages will be returned by Limiter.TryAddOrReplace if Limits.MaxMessages is reached and Limits.RejectNew is set.
+	ErrExceedsMaxMessages = errors.New("maximum number of retained messages exceeded")
+)
+
+// Stats is the statistics of the retained message store.
+type Stats struct {
+	// RetainedMessages is the number of the retained messages.
+	RetainedMessages uint64
+	// RetainedBytes is the total size in bytes of all retained messages.
+	RetainedBytes uint64
+	// EvictedTotal is the number of retained messages that have been evicted due to the byte budget or the count limit.
+	EvictedTotal uint64
+	// RejectedTotal is the number of retained messages that are not stored due to the Limits.
+	RejectedTotal uint64
+}
+
+// StatsReader is an optional interface for the Store implementation to provide statistics.
+type StatsReader interface {
+	// GetStats returns the statistics of the store.
+	GetStats() Stats
+}
+
+// BytesLimiter is an optional interface for the Store implementation to support the total byte budget of retained messages.
+type BytesLimiter interface {
+	// SetMaxBytes sets the byte budget, 0 means unlimited.
+	// If the total size of the retained messages exceeds the budget,
+	// the least recently published or matched retained messages will be removed until the total size is within the budget.
+	SetMaxBytes(maxBytes uint64)
+}
+
+// Limits is the limits of the retained messages, see config.MQTT.MaxRetainedMessages for details.
+type Limits struct {
+	// MaxMessages is the maximum number of the retained messages, 0 means unlimited.
+	MaxMessages int
+	// MaxMessageBytes is the maximum payload size of a retained message, 0 means unlimited.
+	MaxMessageBytes int
+	// RejectNew indicates whether to reject the message of a new topic when MaxMessages is reached,
+	// instead of evicting the least recently published or matched retained message.
+	RejectNew bool
+}
+
+// Limiter is an optional interface for the Store implementation to support the Limits.
+// If implemented, AddOrReplace should also apply the limits and drop the message silently if exceeded.
+type Limiter interface {
+	// SetLimits sets the limits. If there are more than MaxMessages messages,
+	// the least recently published or matched retained messages will be removed.
+	SetLimits(limits Limits)
+	// TryAddOrReplace is the same as AddOrReplace, except that it returns ErrExceedsMaxMessageBytes or ErrExceedsMaxMessages
+	// if the message is not stored due to the limits. Replacing the message of an existing topic never exceeds MaxMessages.
+	TryAddOrReplace(message *gmqtt.Message) error
+}
+
+// StoredAtReader is an optional interface for the Store implementation to provide the time when the retained messages were stored.
+type StoredAtReader interface {
+	// StoredAt returns the time when the retained message of the topic name was stored, false if not found.
+	StoredAt(topicName string) (time.Time, bool)
+}
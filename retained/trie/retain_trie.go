@@ -1,7 +1,9 @@
 package trie
 
 import (
+	"container/list"
 	"strings"
+	"time"
 
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/retained"
@@ -19,6 +21,12 @@ type topicNode struct {
 	msg       *gmqtt.Message
 	parent    *topicNode // pointer of parent node
 	topicName string
+	// elem is the position of the node in the LRU list of trieDB.
+	elem *list.Element
+	// size is the size of msg in bytes.
+	size uint64
+	// storedAt is the time when msg was stored.
+	storedAt time.Time
 }
 
 // newTopicTrie create a new trie tree
@@ -59,18 +67,18 @@ func (t *topicTrie) find(topicName string) *topicNode {
 	return nil
 }
 
-// matchTopic walk through the tire and call the fn callback for each message witch match the topic filter.
-func (t *topicTrie) matchTopic(topicSlice []string, fn retained.IterateFn) {
+// matchTopic walk through the tire and call the fn callback for each node witch message match the topic filter.
+func (t *topicTrie) matchTopic(topicSlice []string, fn func(node *topicNode) bool) {
 	endFlag := len(topicSlice) == 1
 	switch topicSlice[0] {
 	case "#":
-		t.preOrderTraverse(fn)
+		t.preOrderTraverseNode(fn)
 	case "+":
 		// 当前层的所有
 		for _, v := range t.children {
 			if endFlag {
 				if v.msg != nil {
-					fn(v.msg)
+					fn(v)
 				}
 			} else {
 				v.matchTopic(topicSlice[1:], fn)
@@ -80,7 +88,7 @@ func (t *topicTrie) matchTopic(topicSlice []string, fn retained.IterateFn) {
 		if n := t.children[topicSlice[0]]; n != nil {
 			if endFlag {
 				if n.msg != nil {
-					fn(n.msg)
+					fn(n)
 				}
 			} else {
 				n.matchTopic(topicSlice[1:], fn)
@@ -89,11 +97,12 @@ func (t *topicTrie) matchTopic(topicSlice []string, fn retained.IterateFn) {
 	}
 }
 
-func (t *topicTrie) getMatchedMessages(topicFilter string) []*gmqtt.Message {
+// getMatchedNodes returns the nodes which message match the topic filter.
+func (t *topicTrie) getMatchedNodes(topicFilter string) []*topicNode {
 	topicLv := strings.Split(topicFilter, "/")
-	var rs []*gmqtt.Message
-	t.matchTopic(topicLv, func(message *gmqtt.Message) bool {
-		rs = append(rs, message.Copy())
+	var rs []*topicNode
+	t.matchTopic(topicLv, func(node *topicNode) bool {
+		rs = append(rs, node)
 		return true
 	})
 	return rs
@@ -103,8 +112,8 @@ func isSystemTopic(topicName string) bool {
 	return len(topicName) >= 1 && topicName[0] == '$'
 }
 
-// addRetainMsg add a retain message
-func (t *topicTrie) addRetainMsg(topicName string, message *gmqtt.Message) {
+// addRetainMsg add a retain message and returns the node of the message.
+func (t *topicTrie) addRetainMsg(topicName string, message *gmqtt.Message) *topicNode {
 	topicSlice := strings.Split(topicName, "/")
 	var pNode = t
 	for _, lv := range topicSlice {
@@ -115,36 +124,53 @@ func (t *topicTrie) addRetainMsg(topicName string, message *gmqtt.Message) {
 	}
 	pNode.msg = message
 	pNode.topicName = topicName
+	return pNode
 }
 
-func (t *topicTrie) remove(topicName string) {
+// remove removes the retain message of the topic name and returns the node of the removed message.
+// return nil if not found.
+// The branch which has no message left is pruned, so that the wildcard matching does not walk through it.
+func (t *topicTrie) remove(topicName string) *topicNode {
 	topicSlice := strings.Split(topicName, "/")
-	l := len(topicSlice)
 	var pNode = t
 	for _, lv := range topicSlice {
 		if _, ok := pNode.children[lv]; ok {
 			pNode = pNode.children[lv]
 		} else {
-			return
+			return nil
 		}
 	}
-	pNode.msg = nil
-	if len(pNode.children) == 0 {
-		delete(pNode.parent.children, topicSlice[l-1])
+	node := pNode
+	msg := node.msg
+	node.msg = nil
+	for i := len(topicSlice) - 1; i >= 0 && pNode.msg == nil && len(pNode.children) == 0; i-- {
+		delete(pNode.parent.children, topicSlice[i])
+		pNode = pNode.parent
+	}
+	if msg == nil {
+		return nil
 	}
+	return node
 }
 
 func (t *topicTrie) preOrderTraverse(fn retained.IterateFn) bool {
+	return t.preOrderTraverseNode(func(node *topicNode) bool {
+		return fn(node.msg)
+	})
+}
+
+// preOrderTraverseNode calls the fn callback for each node which has a retained message.
+func (t *topicTrie) preOrderTraverseNode(fn func(node *topicNode) bool) bool {
 	if t == nil {
 		return false
 	}
 	if t.msg != nil {
-		if !fn(t.msg) {
+		if !fn(t) {
 			return false
 		}
 	}
 	for _, c := range t.children {
-		if !c.preOrderTraverse(fn) {
+		if !c.preOrderTraverseNode(fn) {
 			return false
 		}
 	}
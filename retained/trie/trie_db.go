@@ -1,17 +1,40 @@
 package trie
 
 import (
+	"container/list"
 	"sync"
+	"time"
 
 	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/retained"
 )
 
+var (
+	_ retained.Store          = (*trieDB)(nil)
+	_ retained.StatsReader    = (*trieDB)(nil)
+	_ retained.BytesLimiter   = (*trieDB)(nil)
+	_ retained.Limiter        = (*trieDB)(nil)
+	_ retained.StoredAtReader = (*trieDB)(nil)
+)
+
 // trieDB implement the retain.Store, it use trie tree  to store retain messages .
 type trieDB struct {
 	sync.RWMutex
 	userTrie   *topicTrie
 	systemTrie *topicTrie
+
+	// lruMu guards lru, it is required because the nodes are moved to front in GetMatchedMessages, which only holds the read lock.
+	lruMu sync.Mutex
+	// lru orders the nodes from the most recently published or matched to the least.
+	lru      *list.List
+	maxBytes uint64
+	bytes    uint64
+	evicted  uint64
+	limits   retained.Limits
+	rejected uint64
+	// onEvicted is called with the topic name of each evicted message, nil if not set.
+	onEvicted func(topicName string)
 }
 
 func (t *trieDB) Iterate(fn retained.IterateFn) {
@@ -48,32 +71,174 @@ func (t *trieDB) ClearAll() {
 	defer t.Unlock()
 	t.systemTrie = newTopicTrie()
 	t.userTrie = newTopicTrie()
+	t.lruMu.Lock()
+	t.lru.Init()
+	t.bytes = 0
+	t.lruMu.Unlock()
 }
 
 // AddOrReplace add or replace a retain message.
+// The message is dropped if it exceeds the limits, see TryAddOrReplace.
 func (t *trieDB) AddOrReplace(message *gmqtt.Message) {
+	_ = t.TryAddOrReplace(message)
+}
+
+// TryAddOrReplace implements retained.Limiter.
+func (t *trieDB) TryAddOrReplace(message *gmqtt.Message) error {
+	t.Lock()
+	defer t.Unlock()
+	t.lruMu.Lock()
+	defer t.lruMu.Unlock()
+	if l := t.limits.MaxMessageBytes; l > 0 && len(message.Payload) > l {
+		t.rejected++
+		return retained.ErrExceedsMaxMessageBytes
+	}
+	trie := t.getTrie(message.Topic)
+	if t.limits.MaxMessages > 0 && trie.find(message.Topic) == nil && t.lru.Len() >= t.limits.MaxMessages {
+		if t.limits.RejectNew {
+			t.rejected++
+			return retained.ErrExceedsMaxMessages
+		}
+		t.evictCountLocked(t.limits.MaxMessages - 1)
+	}
+	node := trie.addRetainMsg(message.Topic, message)
+	node.storedAt = time.Now()
+	t.bytes -= node.size
+	node.size = uint64(message.TotalBytes(packets.Version5))
+	t.bytes += node.size
+	if node.elem == nil {
+		node.elem = t.lru.PushFront(node)
+	} else {
+		t.lru.MoveToFront(node.elem)
+	}
+	t.evictLocked()
+	return nil
+}
+
+// evictCountLocked removes the least recently used messages until there are at most n messages.
+func (t *trieDB) evictCountLocked(n int) {
+	for t.lru.Len() > n {
+		node := t.lru.Back().Value.(*topicNode)
+		t.removeLocked(node.topicName)
+		t.evictedLocked(node.topicName)
+	}
+}
+
+// evictLocked removes the least recently used messages until the total size is within the budget.
+func (t *trieDB) evictLocked() {
+	if t.maxBytes == 0 {
+		return
+	}
+	for t.bytes > t.maxBytes && t.lru.Len() != 0 {
+		node := t.lru.Back().Value.(*topicNode)
+		t.removeLocked(node.topicName)
+		t.evictedLocked(node.topicName)
+	}
+}
+
+func (t *trieDB) evictedLocked(topicName string) {
+	t.evicted++
+	if t.onEvicted != nil {
+		t.onEvicted(topicName)
+	}
+}
+
+// SetOnEvicted sets the function called with the topic name of each message evicted due to the limits or the byte budget,
+// e.g: to remove the evicted message from a persistent copy. It is called with the store locked, so it must not call the store.
+func (t *trieDB) SetOnEvicted(fn func(topicName string)) {
 	t.Lock()
 	defer t.Unlock()
-	t.getTrie(message.Topic).addRetainMsg(message.Topic, message)
+	t.onEvicted = fn
+}
+
+// removeLocked removes the message of the topic name, both t.Lock() and t.lruMu are required.
+func (t *trieDB) removeLocked(topicName string) {
+	node := t.getTrie(topicName).remove(topicName)
+	if node == nil {
+		return
+	}
+	t.bytes -= node.size
+	node.size = 0
+	t.lru.Remove(node.elem)
+	node.elem = nil
 }
 
 // remove remove the retain message of the topic name.
 func (t *trieDB) Remove(topicName string) {
 	t.Lock()
 	defer t.Unlock()
-	t.getTrie(topicName).remove(topicName)
+	t.lruMu.Lock()
+	defer t.lruMu.Unlock()
+	t.removeLocked(topicName)
 }
 
 // GetMatchedMessages returns all messages that match the topic filter.
 func (t *trieDB) GetMatchedMessages(topicFilter string) []*gmqtt.Message {
 	t.RLock()
 	defer t.RUnlock()
-	return t.getTrie(topicFilter).getMatchedMessages(topicFilter)
+	nodes := t.getTrie(topicFilter).getMatchedNodes(topicFilter)
+	if len(nodes) == 0 {
+		return nil
+	}
+	rs := make([]*gmqtt.Message, 0, len(nodes))
+	t.lruMu.Lock()
+	defer t.lruMu.Unlock()
+	for _, v := range nodes {
+		rs = append(rs, v.msg.Copy())
+		t.lru.MoveToFront(v.elem)
+	}
+	return rs
+}
+
+// StoredAt implements retained.StoredAtReader.
+func (t *trieDB) StoredAt(topicName string) (time.Time, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	node := t.getTrie(topicName).find(topicName)
+	if node == nil {
+		return time.Time{}, false
+	}
+	return node.storedAt, true
+}
+
+// SetMaxBytes implements retained.BytesLimiter.
+func (t *trieDB) SetMaxBytes(maxBytes uint64) {
+	t.Lock()
+	defer t.Unlock()
+	t.lruMu.Lock()
+	defer t.lruMu.Unlock()
+	t.maxBytes = maxBytes
+	t.evictLocked()
+}
+
+// SetLimits implements retained.Limiter.
+func (t *trieDB) SetLimits(limits retained.Limits) {
+	t.Lock()
+	defer t.Unlock()
+	t.lruMu.Lock()
+	defer t.lruMu.Unlock()
+	t.limits = limits
+	if limits.MaxMessages > 0 {
+		t.evictCountLocked(limits.MaxMessages)
+	}
+}
+
+// GetStats implements retained.StatsReader.
+func (t *trieDB) GetStats() retained.Stats {
+	t.lruMu.Lock()
+	defer t.lruMu.Unlock()
+	return retained.Stats{
+		RetainedMessages: uint64(t.lru.Len()),
+		RetainedBytes:    t.bytes,
+		EvictedTotal:     t.evicted,
+		RejectedTotal:    t.rejected,
+	}
 }
 
 func NewStore() *trieDB {
 	return &trieDB{
 		userTrie:   newTopicTrie(),
 		systemTrie: newTopicTrie(),
+		lru:        list.New(),
 	}
 }
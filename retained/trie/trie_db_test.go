@@ -1,11 +1,15 @@
 package trie
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/retained"
 )
 
 func TestTrieDB_ClearAll(t *testing.T) {
@@ -51,6 +55,28 @@ func TestTrieDB_GetRetainedMessage(t *testing.T) {
 	a.Nil(s.GetRetainedMessage("a/b"))
 }
 
+func TestTrieDB_properties(t *testing.T) {
+	a := assert.New(t)
+	s := NewStore()
+	msg := &gmqtt.Message{
+		Topic:           "req/a",
+		Payload:         []byte{1},
+		ResponseTopic:   "resp/a",
+		CorrelationData: []byte("correlation"),
+		UserProperties:  []packets.UserProperty{{K: []byte("k"), V: []byte("v")}},
+	}
+	s.AddOrReplace(msg.Copy())
+	rs := s.GetRetainedMessage("req/a")
+	a.Equal(msg, rs)
+	// the returned message is a copy, mutating it must not affect the stored one.
+	rs.CorrelationData[0] = 'x'
+	rs.UserProperties[0].V[0] = 'x'
+	matched := s.GetMatchedMessages("req/+")
+	if a.Len(matched, 1) {
+		a.Equal(msg, matched[0])
+	}
+}
+
 func TestTrieDB_GetMatchedMessages(t *testing.T) {
 	a := assert.New(t)
 	s := NewStore()
@@ -272,3 +298,204 @@ func TestTrieDB_Iterate_Cancel(t *testing.T) {
 	a.Len(rs, 2)
 
 }
+
+func TestTrieDB_MaxBytes(t *testing.T) {
+	a := assert.New(t)
+	s := NewStore()
+	msg := func(topic string) *gmqtt.Message {
+		return &gmqtt.Message{
+			Topic:   topic,
+			Payload: []byte{1, 2, 3},
+		}
+	}
+	size := uint64(msg("a").TotalBytes(packets.Version5))
+	s.SetMaxBytes(3 * size)
+
+	s.AddOrReplace(msg("a"))
+	s.AddOrReplace(msg("b"))
+	s.AddOrReplace(msg("c"))
+	a.Equal(retained.Stats{RetainedMessages: 3, RetainedBytes: 3 * size}, s.GetStats())
+
+	// exceeding the budget evicts the oldest.
+	s.AddOrReplace(msg("d"))
+	a.Nil(s.GetRetainedMessage("a"))
+	a.NotNil(s.GetRetainedMessage("b"))
+	a.Equal(retained.Stats{RetainedMessages: 3, RetainedBytes: 3 * size, EvictedTotal: 1}, s.GetStats())
+
+	// matching makes "b" the most recently used, so "c" is evicted.
+	a.Len(s.GetMatchedMessages("b"), 1)
+	s.AddOrReplace(msg("e"))
+	a.Nil(s.GetRetainedMessage("c"))
+	a.NotNil(s.GetRetainedMessage("b"))
+	a.Equal(retained.Stats{RetainedMessages: 3, RetainedBytes: 3 * size, EvictedTotal: 2}, s.GetStats())
+
+	s.Remove("b")
+	a.Equal(retained.Stats{RetainedMessages: 2, RetainedBytes: 2 * size, EvictedTotal: 2}, s.GetStats())
+
+	// shrinking the budget evicts immediately.
+	s.SetMaxBytes(size)
+	a.Nil(s.GetRetainedMessage("d"))
+	a.NotNil(s.GetRetainedMessage("e"))
+	a.Equal(retained.Stats{RetainedMessages: 1, RetainedBytes: size, EvictedTotal: 3}, s.GetStats())
+
+	s.ClearAll()
+	a.Equal(retained.Stats{EvictedTotal: 3}, s.GetStats())
+}
+
+func TestTrieDB_Limits(t *testing.T) {
+	a := assert.New(t)
+	s := NewStore()
+	msg := func(topic string, payload string) *gmqtt.Message {
+		return &gmqtt.Message{
+			Topic:   topic,
+			Payload: []byte(payload),
+		}
+	}
+	var evicted []string
+	s.SetOnEvicted(func(topicName string) {
+		evicted = append(evicted, topicName)
+	})
+	s.AddOrReplace(msg("a", "1"))
+	s.AddOrReplace(msg("b", "1"))
+	s.AddOrReplace(msg("c", "1"))
+	// lowering the limit evicts immediately.
+	s.SetLimits(retained.Limits{MaxMessages: 2, MaxMessageBytes: 3})
+	a.Nil(s.GetRetainedMessage("a"))
+	a.Equal([]string{"a"}, evicted)
+	a.EqualValues(2, s.GetStats().RetainedMessages)
+	a.EqualValues(1, s.GetStats().EvictedTotal)
+
+	// exceeding the count evicts the least recently used.
+	a.Len(s.GetMatchedMessages("b"), 1)
+	a.Nil(s.TryAddOrReplace(msg("d", "1")))
+	a.Nil(s.GetRetainedMessage("c"))
+	a.NotNil(s.GetRetainedMessage("b"))
+	a.EqualValues(2, s.GetStats().EvictedTotal)
+	a.Equal([]string{"a", "c"}, evicted)
+
+	// replacing an existing topic is not limited.
+	a.Nil(s.TryAddOrReplace(msg("b", "2")))
+	a.Equal([]byte("2"), s.GetRetainedMessage("b").Payload)
+	a.EqualValues(2, s.GetStats().EvictedTotal)
+
+	a.Equal(retained.ErrExceedsMaxMessageBytes, s.TryAddOrReplace(msg("b", "1234")))
+	a.Equal([]byte("2"), s.GetRetainedMessage("b").Payload)
+
+	s.SetLimits(retained.Limits{MaxMessages: 2, RejectNew: true})
+	a.Equal(retained.ErrExceedsMaxMessages, s.TryAddOrReplace(msg("e", "1")))
+	a.Nil(s.GetRetainedMessage("e"))
+	a.Nil(s.TryAddOrReplace(msg("d", "2")))
+	a.Equal(retained.Stats{
+		RetainedMessages: 2,
+		RetainedBytes:    s.GetStats().RetainedBytes,
+		EvictedTotal:     2,
+		RejectedTotal:    2,
+	}, s.GetStats())
+
+	// removing is not limited, then the new topic can be stored.
+	s.Remove("b")
+	a.Nil(s.GetRetainedMessage("b"))
+	a.Nil(s.TryAddOrReplace(msg("e", "1")))
+	a.NotNil(s.GetRetainedMessage("e"))
+}
+
+func TestTrieDB_StoredAt(t *testing.T) {
+	a := assert.New(t)
+	s := NewStore()
+	before := time.Now()
+	s.AddOrReplace(&gmqtt.Message{Topic: "a/b"})
+	s.AddOrReplace(&gmqtt.Message{Topic: "$SYS/a"})
+	for _, v := range []string{"a/b", "$SYS/a"} {
+		storedAt, ok := s.StoredAt(v)
+		a.True(ok)
+		a.False(storedAt.Before(before))
+	}
+	_, ok := s.StoredAt("a")
+	a.False(ok)
+
+	s.Remove("a/b")
+	_, ok = s.StoredAt("a/b")
+	a.False(ok)
+}
+
+func TestTrieDB_Remove_prune(t *testing.T) {
+	a := assert.New(t)
+	s := NewStore()
+	s.AddOrReplace(&gmqtt.Message{Topic: "a/b/c/d"})
+	s.AddOrReplace(&gmqtt.Message{Topic: "a/x"})
+	s.AddOrReplace(&gmqtt.Message{Topic: "a"})
+
+	s.Remove("a/b/c/d")
+	a.Nil(s.userTrie.children["a"].children["b"])
+	a.NotNil(s.userTrie.children["a"].children["x"])
+
+	s.Remove("a/x")
+	a.Empty(s.userTrie.children["a"].children)
+	a.NotNil(s.GetRetainedMessage("a"))
+
+	s.Remove("a")
+	a.Empty(s.userTrie.children)
+	a.Empty(s.GetMatchedMessages("#"))
+}
+
+// TestTrieDB_GetMatchedMessages_scan verifies that the trie returns the same messages as scanning all retained messages.
+func TestTrieDB_GetMatchedMessages_scan(t *testing.T) {
+	a := assert.New(t)
+	s := NewStore()
+	topics := []string{"a", "a/b", "a/b/c", "a/c", "b/b", "b/b/b", "/a", "a/", "/", "$SYS/a", "$SYS/a/b"}
+	for _, v := range topics {
+		s.AddOrReplace(&gmqtt.Message{Topic: v})
+	}
+	s.Remove("a/b")
+	for _, filter := range []string{"#", "+", "+/#", "+/+", "+/+/#", "a/#", "a/+", "+/b", "+/b/#", "/+", "+/", "/#", "$SYS/#", "$SYS/+/b", "c/#"} {
+		var expected []string
+		s.Iterate(func(msg *gmqtt.Message) bool {
+			if packets.TopicMatch([]byte(msg.Topic), []byte(filter)) {
+				expected = append(expected, msg.Topic)
+			}
+			return true
+		})
+		var actual []string
+		for _, v := range s.GetMatchedMessages(filter) {
+			actual = append(actual, v.Topic)
+		}
+		a.ElementsMatch(expected, actual, filter)
+	}
+}
+
+// BenchmarkTrieDB_GetMatchedMessages subscribes to "+/+/#" against 100k retained topics.
+// scan is the matching by iterating all retained messages, which is the cost of a flat map.
+func BenchmarkTrieDB_GetMatchedMessages(b *testing.B) {
+	const retainedTopics = 100000
+	s := NewStore()
+	for i := 0; i < retainedTopics; i++ {
+		var topic string
+		switch i % 4 {
+		case 0:
+			// does not match "+/+/#"
+			topic = "device" + strconv.Itoa(i)
+		default:
+			topic = "fleet" + strconv.Itoa(i%100) + "/device" + strconv.Itoa(i) + "/state"
+		}
+		s.AddOrReplace(&gmqtt.Message{Topic: topic, Payload: []byte("payload")})
+	}
+	filter := "+/+/#"
+	b.Run("trie", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.GetMatchedMessages(filter)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var rs []*gmqtt.Message
+			s.Iterate(func(msg *gmqtt.Message) bool {
+				if packets.TopicMatch([]byte(msg.Topic), []byte(filter)) {
+					rs = append(rs, msg.Copy())
+				}
+				return true
+			})
+		}
+	})
+}
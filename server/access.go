@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// AccessAction is the action to be checked by CheckAccess.
+type AccessAction byte
+
+const (
+	// AccessConnect checks whether the client is allowed to connect, it runs the OnBasicAuth hook.
+	AccessConnect AccessAction = iota
+	// AccessSubscribe checks whether the client is allowed to subscribe the topic filter, it runs the OnAuthorize and OnSubscribe hooks.
+	AccessSubscribe
+	// AccessPublish checks whether the client is allowed to publish to the topic, it runs the OnAuthorize and OnMsgArrived hooks.
+	AccessPublish
+)
+
+func (a AccessAction) String() string {
+	switch a {
+	case AccessConnect:
+		return "connect"
+	case AccessSubscribe:
+		return "subscribe"
+	case AccessPublish:
+		return "publish"
+	}
+	return "unknown"
+}
+
+// ErrInvalidAccessAction will be returned by CheckAccess if the action is unknown.
+var ErrInvalidAccessAction = errors.New("invalid access action")
+
+// AccessRequest is the input param for CheckAccess.
+type AccessRequest struct {
+	ClientID string
+	// Username and Password are the credentials to be checked.
+	// If the client is connected, the username of the live client will be used for subscribe and publish actions.
+	Username string
+	Password string
+	// Version is the protocol version of the simulated client, default to packets.Version5.
+	// If the client is connected, the version of the live client will be used.
+	Version packets.Version
+	// Action is the action to be checked.
+	Action AccessAction
+	// Topic is the topic filter for AccessSubscribe and the topic name for AccessPublish.
+	Topic string
+	// QoS is the qos of the subscription or the message.
+	QoS packets.QoS
+}
+
+// AccessDecision is the result of CheckAccess.
+type AccessDecision struct {
+	// Allowed indicates whether the action is allowed.
+	Allowed bool
+	// Code is the reason code returned by the hooks, 0 if allowed.
+	Code codes.Code
+	// Reason is the reason string returned by the hooks.
+	Reason string
+	// Rule is the rule which made the decision, it is only available if the hooks report it by SetMatchedRule.
+	Rule string
+	// Connected indicates whether the client is connected when checking.
+	Connected bool
+}
+
+type dryRunKey struct{}
+
+type dryRun struct {
+	rule string
+}
+
+// IsDryRun reports whether the hook is called by CheckAccess.
+// Hooks must not make any side effect (e.g: forward messages, record states) in dry-run mode.
+func IsDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(dryRunKey{}).(*dryRun)
+	return ok
+}
+
+type willAuthPendingKey struct{}
+
+// IsWillAuthPending reports whether the will message passed to the OnWillPublish hook will be authorized afterwards,
+// by the OnAuthorize and OnMsgArrived hooks, see config.MQTT.WillMessageAuth.
+// The will message may be discarded by the authorization, so the hooks which forward the messages to other brokers
+// should not forward it in OnWillPublish, the OnMsgArrived hook will receive it once it is authorized.
+func IsWillAuthPending(ctx context.Context) bool {
+	return ctx.Value(willAuthPendingKey{}) != nil
+}
+
+// SetMatchedRule records the rule which made the decision in dry-run mode.
+// It is a no-op if the hook is not called by CheckAccess.
+func SetMatchedRule(ctx context.Context, rule string) {
+	if d, ok := ctx.Value(dryRunKey{}).(*dryRun); ok {
+		d.rule = rule
+	}
+}
+
+// detachedClient is a Client which is not bound to any live connection.
+// It is passed to hooks in dry-run mode and when authorizing will messages.
+// It never affects the live connection, Close and Disconnect are no-op and Connection returns nil.
+type detachedClient struct {
+	opts        *ClientOptions
+	session     *gmqtt.Session
+	version     packets.Version
+	connectedAt time.Time
+	// system indicates whether it is the system client, see IsSystemClient.
+	system bool
+}
+
+func (d *detachedClient) ClientOptions() *ClientOptions {
+	return d.opts
+}
+
+func (d *detachedClient) SessionInfo() *gmqtt.Session {
+	return d.session
+}
+
+func (d *detachedClient) Version() packets.Version {
+	return d.version
+}
+
+func (d *detachedClient) ConnectedAt() time.Time {
+	return d.connectedAt
+}
+
+func (d *detachedClient) Connection() net.Conn {
+	return nil
+}
+
+func (d *detachedClient) Close() {}
+
+func (d *detachedClient) Disconnect(disconnect *packets.Disconnect) {}
+
+func (d *detachedClient) ConnID() string {
+	return ""
+}
+
+// newDetachedClient returns the detachedClient which copies the options of the given client.
+func newDetachedClient(c Client) *detachedClient {
+	opts := *c.ClientOptions()
+	return &detachedClient{
+		opts:        &opts,
+		session:     c.SessionInfo(),
+		version:     c.Version(),
+		connectedAt: c.ConnectedAt(),
+	}
+}
+
+// newDryRunClient returns the detachedClient for the request.
+// If the client is connected, the options of the live client will be copied, otherwise the supplied credentials will be used.
+func (srv *server) newDryRunClient(req *AccessRequest) (c *detachedClient, connected bool) {
+	srv.mu.Lock()
+	live, ok := srv.clients[req.ClientID]
+	srv.mu.Unlock()
+	if ok {
+		return newDetachedClient(live), true
+	}
+	version := req.Version
+	if version == 0 {
+		version = packets.Version5
+	}
+	return &detachedClient{
+		opts: &ClientOptions{
+			ClientID: req.ClientID,
+			Username: req.Username,
+		},
+		version:     version,
+		connectedAt: time.Now(),
+	}, false
+}
+
+// CheckAccess runs the auth hooks for the request without affecting any live connection.
+// The hooks can use IsDryRun to skip side effects and use SetMatchedRule to report the rule.
+// Notice that the enhanced authentication is not supported, the AccessConnect action only runs the OnBasicAuth hook.
+func (srv *server) CheckAccess(ctx context.Context, req *AccessRequest) (*AccessDecision, error) {
+	d := &dryRun{}
+	ctx = context.WithValue(ctx, dryRunKey{}, d)
+	client, connected := srv.newDryRunClient(req)
+	var err error
+	allowed := true
+	switch req.Action {
+	case AccessConnect:
+		// always use the supplied credentials for connect action.
+		client.opts.Username = req.Username
+		err = srv.dryRunConnect(ctx, client, req)
+	case AccessSubscribe:
+		err = srv.dryRunSubscribe(ctx, client, req)
+	case AccessPublish:
+		allowed, err = srv.dryRunPublish(ctx, client, req)
+	default:
+		return nil, ErrInvalidAccessAction
+	}
+	decision := &AccessDecision{
+		Allowed:   allowed && err == nil,
+		Rule:      d.rule,
+		Connected: connected,
+	}
+	if ce := converError(err); ce != nil {
+		decision.Code = ce.Code
+		decision.Reason = string(ce.ReasonString)
+	}
+	return decision, nil
+}
+
+func (srv *server) dryRunConnect(ctx context.Context, client *detachedClient, req *AccessRequest) error {
+	if srv.hooks.OnBasicAuth == nil {
+		return nil
+	}
+	conn := &packets.Connect{
+		Version:      client.version,
+		ClientID:     []byte(req.ClientID),
+		Username:     []byte(req.Username),
+		Password:     []byte(req.Password),
+		UsernameFlag: req.Username != "",
+		PasswordFlag: req.Password != "",
+		CleanStart:   true,
+	}
+	if client.version == packets.Version5 {
+		conn.Properties = &packets.Properties{}
+	}
+	return srv.hooks.OnBasicAuth(ctx, client, &ConnectRequest{
+		Connect: conn,
+		Options: newAuthOptions(srv.GetConfig(), client.version, conn),
+	})
+}
+
+// dryRunAuthorize calls the OnAuthorize hook without the cache.
+func (srv *server) dryRunAuthorize(ctx context.Context, client *detachedClient, action AccessAction, topic string) bool {
+	if srv.hooks.OnAuthorize == nil {
+		return true
+	}
+	return srv.hooks.OnAuthorize(ctx, client, &AuthorizeRequest{
+		Action: action,
+		Topic:  topic,
+	})
+}
+
+func (srv *server) dryRunSubscribe(ctx context.Context, client *detachedClient, req *AccessRequest) error {
+	if !srv.dryRunAuthorize(ctx, client, AccessSubscribe, req.Topic) {
+		return codes.NewError(codes.NotAuthorized)
+	}
+	if srv.hooks.OnSubscribe == nil {
+		return nil
+	}
+	topic := packets.Topic{
+		SubOptions: packets.SubOptions{
+			Qos: req.QoS,
+		},
+		Name: req.Topic,
+	}
+	subReq := &SubscribeRequest{
+		Subscribe: &packets.Subscribe{
+			Version:    client.version,
+			Topics:     []packets.Topic{topic},
+			Properties: &packets.Properties{},
+		},
+		Subscriptions: map[string]*struct {
+			Sub   *gmqtt.Subscription
+			Error error
+		}{
+			req.Topic: {Sub: subscription.FromTopic(topic, 0)},
+		},
+	}
+	if err := srv.hooks.OnSubscribe(ctx, client, subReq); err != nil {
+		return err
+	}
+	return subReq.Subscriptions[req.Topic].Error
+}
+
+func (srv *server) dryRunPublish(ctx context.Context, client *detachedClient, req *AccessRequest) (allowed bool, err error) {
+	if !srv.dryRunAuthorize(ctx, client, AccessPublish, req.Topic) {
+		return false, codes.NewError(codes.NotAuthorized)
+	}
+	if srv.hooks.OnMsgArrived == nil {
+		return true, nil
+	}
+	pub := &packets.Publish{
+		Version:    client.version,
+		Qos:        req.QoS,
+		TopicName:  []byte(req.Topic),
+		Properties: &packets.Properties{},
+	}
+	msgReq := &MsgArrivedRequest{
+		Publish:          pub,
+		Message:          gmqtt.MessageFromPublish(pub),
+		IterationOptions: defaultIterateOptions(req.Topic),
+	}
+	err = srv.hooks.OnMsgArrived(ctx, client, msgReq)
+	// the message has been dropped by the hooks.
+	return msgReq.Message != nil, err
+}
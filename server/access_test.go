@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestServer_CheckAccess(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.hooks.OnBasicAuth = func(ctx context.Context, client Client, req *ConnectRequest) (err error) {
+		a.True(IsDryRun(ctx))
+		if string(req.Connect.Password) != "pwd" {
+			SetMatchedRule(ctx, "password")
+			return &codes.Error{Code: codes.NotAuthorized}
+		}
+		return nil
+	}
+	srv.hooks.OnSubscribe = func(ctx context.Context, client Client, req *SubscribeRequest) error {
+		if client.ClientOptions().Username != "admin" {
+			req.Reject("a/#", &codes.Error{Code: codes.NotAuthorized})
+			SetMatchedRule(ctx, "deny a/#")
+		}
+		return nil
+	}
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		if req.Message.Topic == "drop" {
+			req.Drop()
+		}
+		if req.Message != nil && req.Message.QoS == packets.Qos2 {
+			return &codes.Error{Code: codes.QoSNotSupported}
+		}
+		return nil
+	}
+
+	var tt = []struct {
+		name     string
+		req      *AccessRequest
+		decision *AccessDecision
+	}{
+		{
+			name:     "connect_allowed",
+			req:      &AccessRequest{ClientID: "cid", Username: "user", Password: "pwd", Action: AccessConnect},
+			decision: &AccessDecision{Allowed: true},
+		},
+		{
+			name:     "connect_denied",
+			req:      &AccessRequest{ClientID: "cid", Username: "user", Password: "wrong", Action: AccessConnect},
+			decision: &AccessDecision{Code: codes.NotAuthorized, Rule: "password"},
+		},
+		{
+			name:     "subscribe_allowed",
+			req:      &AccessRequest{ClientID: "cid", Username: "admin", Topic: "a/#", Action: AccessSubscribe},
+			decision: &AccessDecision{Allowed: true},
+		},
+		{
+			name:     "subscribe_denied",
+			req:      &AccessRequest{ClientID: "cid", Username: "user", Topic: "a/#", Action: AccessSubscribe},
+			decision: &AccessDecision{Code: codes.NotAuthorized, Rule: "deny a/#"},
+		},
+		{
+			name:     "publish_allowed",
+			req:      &AccessRequest{ClientID: "cid", Topic: "a/b", Action: AccessPublish},
+			decision: &AccessDecision{Allowed: true},
+		},
+		{
+			name:     "publish_dropped",
+			req:      &AccessRequest{ClientID: "cid", Topic: "drop", Action: AccessPublish},
+			decision: &AccessDecision{},
+		},
+		{
+			name:     "publish_denied",
+			req:      &AccessRequest{ClientID: "cid", Topic: "a/b", QoS: packets.Qos2, Action: AccessPublish},
+			decision: &AccessDecision{Code: codes.QoSNotSupported},
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			d, err := srv.CheckAccess(context.Background(), v.req)
+			a.Nil(err)
+			a.Equal(v.decision, d)
+		})
+	}
+
+	_, err := srv.CheckAccess(context.Background(), &AccessRequest{Action: 10})
+	a.Equal(ErrInvalidAccessAction, err)
+}
+
+func TestServer_CheckAccess_connected(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.opts.Username = "admin"
+	c.version = packets.Version311
+	srv.clients["cid"] = c
+
+	srv.hooks.OnSubscribe = func(ctx context.Context, client Client, req *SubscribeRequest) error {
+		a.Equal("admin", client.ClientOptions().Username)
+		a.Equal(packets.Version311, client.Version())
+		// must not affect the live client
+		client.Close()
+		return nil
+	}
+	d, err := srv.CheckAccess(context.Background(), &AccessRequest{
+		ClientID: "cid",
+		Username: "user",
+		Topic:    "a/b",
+		Action:   AccessSubscribe,
+	})
+	a.Nil(err)
+	a.Equal(&AccessDecision{Allowed: true, Connected: true}, d)
+	select {
+	case <-c.close:
+		t.Fatal("the live client should not be closed")
+	default:
+	}
+}
+
+func TestServer_CheckAccess_authorize(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.hooks.OnAuthorize = func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+		a.True(IsDryRun(ctx))
+		SetMatchedRule(ctx, "deny "+req.Action.String())
+		return false
+	}
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		a.FailNow("OnMsgArrived must not be called")
+		return nil
+	}
+	for _, action := range []AccessAction{AccessSubscribe, AccessPublish} {
+		d, err := srv.CheckAccess(context.Background(), &AccessRequest{
+			ClientID: "cid",
+			Topic:    "a",
+			Action:   action,
+		})
+		a.Nil(err)
+		a.Equal(&AccessDecision{Code: codes.NotAuthorized, Rule: "deny " + action.String()}, d)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/DrmagicE/gmqtt/config"
+)
+
+type aclCacheKey struct {
+	action AccessAction
+	topic  string
+}
+
+type aclCacheEntry struct {
+	key     aclCacheKey
+	allowed bool
+	expiry  time.Time
+}
+
+// aclCache is the LRU cache of the OnAuthorize decisions of a client, see config.ACLCache.
+type aclCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	l       *list.List
+	entries map[aclCacheKey]*list.Element
+	// gen is increased on every invalidation,
+	// so that the decision made before the invalidation will not be cached.
+	gen uint64
+}
+
+// newACLCache returns nil if the cache is disabled.
+func newACLCache(c config.ACLCache) *aclCache {
+	if !c.Enabled() {
+		return nil
+	}
+	return &aclCache{
+		ttl:     c.TTL,
+		max:     c.MaxEntries,
+		l:       list.New(),
+		entries: make(map[aclCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached decision and the current generation.
+func (a *aclCache) get(key aclCacheKey, now time.Time) (allowed, ok bool, gen uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if elem, exist := a.entries[key]; exist {
+		e := elem.Value.(*aclCacheEntry)
+		if now.Before(e.expiry) {
+			a.l.MoveToFront(elem)
+			return e.allowed, true, a.gen
+		}
+		a.l.Remove(elem)
+		delete(a.entries, key)
+	}
+	return false, false, a.gen
+}
+
+// set caches the decision made at the given generation, it is a no-op if the cache has been invalidated since then.
+func (a *aclCache) set(key aclCacheKey, allowed bool, now time.Time, gen uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if gen != a.gen {
+		return
+	}
+	if elem, exist := a.entries[key]; exist {
+		a.l.Remove(elem)
+		delete(a.entries, key)
+	}
+	if a.l.Len() >= a.max {
+		back := a.l.Back()
+		a.l.Remove(back)
+		delete(a.entries, back.Value.(*aclCacheEntry).key)
+	}
+	a.entries[key] = a.l.PushFront(&aclCacheEntry{
+		key:     key,
+		allowed: allowed,
+		expiry:  now.Add(a.ttl),
+	})
+}
+
+// invalidate removes all cached decisions.
+func (a *aclCache) invalidate() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gen++
+	a.l.Init()
+	a.entries = make(map[aclCacheKey]*list.Element)
+}
+
+func (a *aclCache) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.l.Len()
+}
+
+// authorize calls the OnAuthorize hook, the decision is cached if config.ACLCache is enabled.
+func (client *client) authorize(action AccessAction, topic string) bool {
+	hook := client.server.hooks.OnAuthorize
+	if hook == nil {
+		return true
+	}
+	req := &AuthorizeRequest{
+		Action: action,
+		Topic:  topic,
+	}
+	if client.aclCache == nil {
+		return hook(context.Background(), client, req)
+	}
+	key := aclCacheKey{action: action, topic: topic}
+	now := client.server.clock.Now()
+	allowed, ok, gen := client.aclCache.get(key, now)
+	if ok {
+		return allowed
+	}
+	allowed = hook(context.Background(), client, req)
+	client.aclCache.set(key, allowed, now, gen)
+	return allowed
+}
+
+// InvalidateACL implements ClientService.
+func (c *clientService) InvalidateACL(clientID string) {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+	if clientID != "" {
+		if client, ok := c.srv.clients[clientID]; ok {
+			client.aclCache.invalidate()
+		}
+		return
+	}
+	for _, client := range c.srv.clients {
+		client.aclCache.invalidate()
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/retained"
+)
+
+func TestACLCache(t *testing.T) {
+	a := assert.New(t)
+	a.Nil(newACLCache(config.ACLCache{MaxEntries: 10}))
+
+	c := newACLCache(config.ACLCache{TTL: time.Minute, MaxEntries: 2})
+	now := time.Now()
+	keyA := aclCacheKey{action: AccessPublish, topic: "a"}
+	keyB := aclCacheKey{action: AccessPublish, topic: "b"}
+	keyC := aclCacheKey{action: AccessPublish, topic: "c"}
+
+	_, ok, gen := c.get(keyA, now)
+	a.False(ok)
+	c.set(keyA, true, now, gen)
+	c.set(keyB, false, now, gen)
+	allowed, ok, _ := c.get(keyA, now)
+	a.True(ok)
+	a.True(allowed)
+	allowed, ok, _ = c.get(keyB, now)
+	a.True(ok)
+	a.False(allowed)
+	// the same topic of different actions are cached separately.
+	_, ok, _ = c.get(aclCacheKey{action: AccessSubscribe, topic: "a"}, now)
+	a.False(ok)
+
+	// the least recently used "a" is evicted.
+	_, _, _ = c.get(keyB, now)
+	c.set(keyC, true, now, gen)
+	a.Equal(2, c.len())
+	_, ok, _ = c.get(keyA, now)
+	a.False(ok)
+
+	// expired
+	_, ok, _ = c.get(keyB, now.Add(time.Minute))
+	a.False(ok)
+	a.Equal(1, c.len())
+
+	// the decision made before the invalidation is not cached.
+	_, _, gen = c.get(keyA, now)
+	c.invalidate()
+	a.Equal(0, c.len())
+	c.set(keyA, true, now, gen)
+	a.Equal(0, c.len())
+
+	var nc *aclCache
+	nc.invalidate()
+}
+
+func newAuthorizeServer(ctrl *gomock.Controller, cfg config.ACLCache, fn OnAuthorize) *server {
+	retainedDB := retained.NewMockStore(ctrl)
+	retainedDB.EXPECT().GetMatchedMessages(gomock.Any()).Return(nil).AnyTimes()
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.retainedDB = retainedDB
+	srv.config().ACLCache = cfg
+	srv.hooks.OnAuthorize = fn
+	return srv
+}
+
+func TestClient_authorize(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	calls := make(map[AuthorizeRequest]int)
+	srv := newAuthorizeServer(ctrl, config.ACLCache{TTL: time.Minute, MaxEntries: 10}, func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+		calls[*req]++
+		return req.Topic != "denied"
+	})
+	clk := newTestClock()
+	srv.clock = clk
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	srv.clients["cid"] = c
+
+	for i := 0; i < 3; i++ {
+		a.True(c.authorize(AccessPublish, "a"))
+		a.False(c.authorize(AccessPublish, "denied"))
+	}
+	a.Equal(1, calls[AuthorizeRequest{Action: AccessPublish, Topic: "a"}])
+	a.Equal(1, calls[AuthorizeRequest{Action: AccessPublish, Topic: "denied"}])
+
+	cs := &clientService{srv: srv}
+	cs.InvalidateACL("unknown")
+	a.True(c.authorize(AccessPublish, "a"))
+	a.Equal(1, calls[AuthorizeRequest{Action: AccessPublish, Topic: "a"}])
+	cs.InvalidateACL("cid")
+	a.True(c.authorize(AccessPublish, "a"))
+	a.Equal(2, calls[AuthorizeRequest{Action: AccessPublish, Topic: "a"}])
+	cs.InvalidateACL("")
+	a.True(c.authorize(AccessPublish, "a"))
+	a.Equal(3, calls[AuthorizeRequest{Action: AccessPublish, Topic: "a"}])
+	// the decision expires by the server clock.
+	clk.Advance(time.Minute)
+	a.True(c.authorize(AccessPublish, "a"))
+	a.Equal(4, calls[AuthorizeRequest{Action: AccessPublish, Topic: "a"}])
+
+	// the hook is called every time if the cache is disabled.
+	srv.config().ACLCache = config.DefaultACLCache
+	c, err = srv.newClient(noopConn{})
+	a.Nil(err)
+	for i := 0; i < 3; i++ {
+		a.True(c.authorize(AccessSubscribe, "a"))
+	}
+	a.Equal(3, calls[AuthorizeRequest{Action: AccessSubscribe, Topic: "a"}])
+}
+
+func TestClient_subscribeHandler_authorize(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		srv := newAuthorizeServer(ctrl, config.DefaultACLCache, func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+			a.Equal(AccessSubscribe, req.Action)
+			return req.Topic != "denied"
+		})
+		srv.hooks.OnSubscribe = func(ctx context.Context, client Client, req *SubscribeRequest) error {
+			a.NotNil(req.Subscriptions["denied"].Error)
+			return nil
+		}
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.opts.ClientID = "cid"
+		c.version = version
+		a.Nil(c.subscribeHandler(&packets.Subscribe{
+			Version:  version,
+			PacketID: 1,
+			Topics: []packets.Topic{
+				{SubOptions: packets.SubOptions{Qos: 1}, Name: "a"},
+				{SubOptions: packets.SubOptions{Qos: 1}, Name: "denied"},
+			},
+			Properties: &packets.Properties{},
+		}))
+		failure := codes.NotAuthorized
+		if packets.IsVersion3X(version) {
+			failure = packets.SubscribeFailure
+		}
+		suback := (<-c.out).(*packets.Suback)
+		a.Equal([]codes.Code{codes.GrantedQoS1, failure}, suback.Payload)
+	}
+}
+
+func TestClient_publishHandler_authorize(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := newAuthorizeServer(ctrl, config.DefaultACLCache, func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+		a.Equal(AccessPublish, req.Action)
+		return req.Topic != "denied"
+	})
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		a.NotEqual("denied", req.Message.Topic)
+		return nil
+	}
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	var delivered []string
+	c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+		delivered = append(delivered, msg.Topic)
+		return true, false
+	}
+	for _, topic := range []string{"a", "denied"} {
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:    packets.Version5,
+			Qos:        packets.Qos1,
+			PacketID:   1,
+			TopicName:  []byte(topic),
+			Payload:    []byte("payload"),
+			Properties: &packets.Properties{},
+		}))
+	}
+	a.Equal([]string{"a"}, delivered)
+	a.Equal(codes.Success, (<-c.out).(*packets.Puback).Code)
+	a.Equal(codes.NotAuthorized, (<-c.out).(*packets.Puback).Code)
+}
@@ -48,13 +48,13 @@ func (a *apiRegistrar) RegisterHTTPHandler(fn HTTPHandler) error {
 	for _, v := range a.httpServers {
 		schema, addr := splitEndpoint(v.gRPCEndpoint)
 		if schema == "unix" {
-			err = fn(context.Background(), v.mux, v.gRPCEndpoint, []grpc.DialOption{grpc.WithInsecure()})
+			err = fn(v.ctx, v.mux, v.gRPCEndpoint, []grpc.DialOption{grpc.WithInsecure()})
 			if err != nil {
 				return err
 			}
 			continue
 		}
-		err = fn(context.Background(), v.mux, addr, []grpc.DialOption{grpc.WithInsecure()})
+		err = fn(v.ctx, v.mux, addr, []grpc.DialOption{grpc.WithInsecure()})
 		if err != nil {
 			return err
 		}
@@ -76,6 +76,8 @@ type httpServer struct {
 	tlsCfg       *tls.Config
 	serve        func(errChan chan error) error
 	shutdown     func()
+	// ctx is done after the server is shut down, the gRPC connections dialed by the handlers are closed then.
+	ctx context.Context
 }
 
 // HTTPHandler is the http handler defined by gRPC-gateway.
@@ -174,8 +176,10 @@ func buildHTTPServer(endpoint *config.Endpoint) (*httpServer, error) {
 	server := &http.Server{
 		Handler: mux,
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	shutdown := func() {
 		server.Shutdown(context.Background())
+		cancel()
 	}
 	serve := func(errChan chan error) error {
 		schema, addr := splitEndpoint(endpoint.Address)
@@ -201,6 +205,7 @@ func buildHTTPServer(endpoint *config.Endpoint) (*httpServer, error) {
 		serve:        serve,
 		shutdown:     shutdown,
 		endpoint:     endpoint.Address,
+		ctx:          ctx,
 	}, nil
 }
 
@@ -209,6 +214,7 @@ func (srv *server) exit() {
 	case <-srv.exitChan:
 	default:
 		close(srv.exitChan)
+		srv.connLimiter.close()
 	}
 }
 
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+const (
+	// tlsHandshakeRecord is the first byte of a TLS handshake.
+	tlsHandshakeRecord = 0x16
+	// connectFixedHeader is the first byte of a CONNECT packet.
+	connectFixedHeader = packets.CONNECT << 4
+)
+
+// ErrUnknownProtocol will be returned by the connection accepted by the auto-detect listener
+// if the first byte is neither a TLS handshake nor a MQTT CONNECT packet.
+var ErrUnknownProtocol = errors.New("unknown protocol, neither TLS nor MQTT")
+
+// autoDetectListener accepts both TLS and plaintext connections on one port.
+type autoDetectListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+}
+
+// NewAutoDetectListener returns a net.Listener which accepts both TLS and plaintext MQTT connections from l.
+// The protocol is detected by peeking the first byte of the connection:
+// the TLS handshake starts with 0x16 and the plaintext MQTT connection must start with a CONNECT packet (0x10).
+// The connection that starts with other bytes will be dropped.
+//
+// The detection is performed on the first Read or Write of the connection,
+// so that a slow or silent client will not block the Accept.
+func NewAutoDetectListener(l net.Listener, tlsConfig *tls.Config) net.Listener {
+	return &autoDetectListener{
+		Listener:  l,
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (l *autoDetectListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &autoDetectConn{
+		Conn:      c,
+		tlsConfig: l.tlsConfig,
+	}, nil
+}
+
+// peekedConn is a net.Conn that reads from the buffered reader which contains the peeked bytes.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+type autoDetectConn struct {
+	// Conn is the raw connection.
+	net.Conn
+	tlsConfig *tls.Config
+	once      sync.Once
+	// conn is the detected connection, it is a *tls.Conn for TLS connection.
+	conn net.Conn
+	err  error
+}
+
+func (a *autoDetectConn) detect() {
+	a.once.Do(func() {
+		r := bufio.NewReaderSize(a.Conn, 1)
+		b, err := r.Peek(1)
+		if err != nil {
+			a.err = err
+			return
+		}
+		peeked := &peekedConn{Conn: a.Conn, r: r}
+		switch b[0] {
+		case tlsHandshakeRecord:
+			a.conn = tls.Server(peeked, a.tlsConfig)
+		case connectFixedHeader:
+			a.conn = peeked
+		default:
+			a.err = ErrUnknownProtocol
+			_ = a.Conn.Close()
+		}
+	})
+}
+
+func (a *autoDetectConn) Read(b []byte) (int, error) {
+	a.detect()
+	if a.err != nil {
+		return 0, a.err
+	}
+	return a.conn.Read(b)
+}
+
+func (a *autoDetectConn) Write(b []byte) (int, error) {
+	a.detect()
+	if a.err != nil {
+		return 0, a.err
+	}
+	return a.conn.Write(b)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestAutoDetectListener(t *testing.T) {
+	a := assert.New(t)
+	cert, err := tls.LoadX509KeyPair("./testdata/server-cert.pem", "./testdata/server-key.pem")
+	a.Nil(err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	ln := NewAutoDetectListener(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	defer ln.Close()
+
+	connect := &packets.Connect{
+		Version:       packets.Version311,
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: byte(packets.Version311),
+		CleanStart:    true,
+		KeepAlive:     60,
+		ClientID:      []byte("cid"),
+	}
+	dial := func(useTLS bool) net.Conn {
+		var c net.Conn
+		var err error
+		if useTLS {
+			c, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		} else {
+			c, err = net.Dial("tcp", l.Addr().String())
+		}
+		a.Nil(err)
+		return c
+	}
+	for _, useTLS := range []bool{true, false} {
+		var cli net.Conn
+		go func() {
+			cli = dial(useTLS)
+			w := packets.NewWriter(cli)
+			a.Nil(w.WriteAndFlush(connect))
+		}()
+		c, err := ln.Accept()
+		a.Nil(err)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		p, err := packets.NewReader(c).ReadPacket()
+		if a.Nil(err) {
+			conn, ok := p.(*packets.Connect)
+			if a.True(ok) {
+				a.Equal([]byte("cid"), conn.ClientID)
+			}
+		}
+		_, isTLS := c.(*autoDetectConn).conn.(*tls.Conn)
+		a.Equal(useTLS, isTLS)
+		_ = c.Close()
+	}
+
+	// garbage
+	go func() {
+		cli := dial(false)
+		_, _ = cli.Write([]byte{0xff, 0xff})
+	}()
+	c, err := ln.Accept()
+	a.Nil(err)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = packets.NewReader(c).ReadPacket()
+	a.Equal(ErrUnknownProtocol, err)
+}
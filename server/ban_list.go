@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+)
+
+// ErrInvalidBan is returned by ClientService.Ban if the type or the value of the ban is invalid.
+var ErrInvalidBan = errors.New("invalid ban")
+
+type banKey struct {
+	typ   ban.Type
+	value string
+}
+
+// banList is the temporary ban list, see config.BanList.
+type banList struct {
+	mu   sync.Mutex
+	max  int
+	bans map[banKey]time.Time
+	// store is nil if the bans are not persisted.
+	store ban.Store
+}
+
+func newBanList(max int) *banList {
+	return &banList{
+		max:  max,
+		bans: make(map[banKey]time.Time),
+	}
+}
+
+func (b *banList) setMaxEntries(max int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.max = max
+}
+
+// load loads the bans from the store and persists the subsequent changes into the store.
+// The expired bans are removed from the store.
+func (b *banList) load(store ban.Store, now time.Time) error {
+	var bans, expired []*ban.Ban
+	err := store.Iterate(func(v *ban.Ban) bool {
+		if v.ExpiresAt.After(now) {
+			bans = append(bans, v)
+		} else {
+			expired = append(expired, v)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, v := range expired {
+		if err := store.Remove(v.Type, v.Value); err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store = store
+	for _, v := range bans {
+		b.bans[banKey{typ: v.Type, value: v.Value}] = v.ExpiresAt
+	}
+	return nil
+}
+
+// removeLocked removes the ban from the list and the store, the store error is logged only,
+// because the removed ban will expire in the store anyway.
+func (b *banList) removeLocked(key banKey) {
+	delete(b.bans, key)
+	if b.store != nil {
+		if err := b.store.Remove(key.typ, key.value); err != nil {
+			zaplog.Error("failed to remove the ban from the store", zap.String("type", string(key.typ)), zap.String("value", key.value), zap.Error(err))
+		}
+	}
+}
+
+// evictLocked removes the expired bans, and then removes the ban which expires the earliest if the list is still full.
+func (b *banList) evictLocked(now time.Time) {
+	var earliest banKey
+	var earliestAt time.Time
+	for k, v := range b.bans {
+		if !v.After(now) {
+			b.removeLocked(k)
+			continue
+		}
+		if earliestAt.IsZero() || v.Before(earliestAt) {
+			earliest, earliestAt = k, v
+		}
+	}
+	if len(b.bans) >= b.max && !earliestAt.IsZero() {
+		b.removeLocked(earliest)
+	}
+}
+
+func (b *banList) add(v *ban.Ban, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := banKey{typ: v.Type, value: v.Value}
+	if _, ok := b.bans[key]; !ok && len(b.bans) >= b.max {
+		b.evictLocked(now)
+	}
+	if b.store != nil {
+		if err := b.store.Add(v); err != nil {
+			return err
+		}
+	}
+	b.bans[key] = v.ExpiresAt
+	return nil
+}
+
+// bannedLocked reports whether the key is banned, the expired ban is removed lazily.
+func (b *banList) bannedLocked(key banKey, now time.Time) bool {
+	expiresAt, ok := b.bans[key]
+	if !ok {
+		return false
+	}
+	if expiresAt.After(now) {
+		return true
+	}
+	b.removeLocked(key)
+	return false
+}
+
+// banned reports whether the client id or the IP is banned, nil ip means the IP is unknown.
+func (b *banList) banned(clientID string, ip net.IP, now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.bans) == 0 {
+		return false
+	}
+	if b.bannedLocked(banKey{typ: ban.TypeClientID, value: clientID}, now) {
+		return true
+	}
+	return ip != nil && b.bannedLocked(banKey{typ: ban.TypeIP, value: ip.String()}, now)
+}
+
+// list returns the unexpired bans sorted by the type and the value.
+func (b *banList) list(now time.Time) []*ban.Ban {
+	b.mu.Lock()
+	rs := make([]*ban.Ban, 0, len(b.bans))
+	for k := range b.bans {
+		if b.bannedLocked(k, now) {
+			rs = append(rs, &ban.Ban{Type: k.typ, Value: k.value, ExpiresAt: b.bans[k]})
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Type != rs[j].Type {
+			return rs[i].Type < rs[j].Type
+		}
+		return rs[i].Value < rs[j].Value
+	})
+	return rs
+}
+
+// clear removes the ban of the type and the value, empty type removes all bans.
+func (b *banList) clear(typ ban.Type, value string) (cleared int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if typ == "" {
+		cleared = len(b.bans)
+		for k := range b.bans {
+			b.removeLocked(k)
+		}
+		return cleared
+	}
+	key := banKey{typ: typ, value: value}
+	if _, ok := b.bans[key]; ok {
+		b.removeLocked(key)
+		return 1
+	}
+	return 0
+}
+
+// normalizeBan validates the ban and formats the IP in the canonical form.
+func normalizeBan(v *ban.Ban) (*ban.Ban, error) {
+	rs := *v
+	switch v.Type {
+	case ban.TypeClientID:
+	case ban.TypeIP:
+		ip := net.ParseIP(v.Value)
+		if ip == nil {
+			return nil, ErrInvalidBan
+		}
+		rs.Value = ip.String()
+	default:
+		return nil, ErrInvalidBan
+	}
+	return &rs, nil
+}
+
+// Ban implements ClientService.
+func (c *clientService) Ban(b *ban.Ban) error {
+	nb, err := normalizeBan(b)
+	if err != nil {
+		return err
+	}
+	return c.srv.banList.add(nb, c.srv.clock.Now())
+}
+
+// ListBans implements ClientService.
+func (c *clientService) ListBans() []*ban.Ban {
+	return c.srv.banList.list(c.srv.clock.Now())
+}
+
+// ClearBans implements ClientService.
+func (c *clientService) ClearBans(typ ban.Type, value string) (cleared int) {
+	if typ == ban.TypeIP {
+		if ip := net.ParseIP(value); ip != nil {
+			value = ip.String()
+		}
+	}
+	return c.srv.banList.clear(typ, value)
+}
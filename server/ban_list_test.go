@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+	mem_ban "github.com/DrmagicE/gmqtt/persistence/ban/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func storedBans(a *assert.Assertions, store ban.Store) map[string]time.Time {
+	rs := make(map[string]time.Time)
+	a.Nil(store.Iterate(func(b *ban.Ban) bool {
+		rs[string(b.Type)+":"+b.Value] = b.ExpiresAt
+		return true
+	}))
+	return rs
+}
+
+func TestBanList(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	store := mem_ban.New()
+	// the expired ban is removed on load.
+	a.Nil(store.Add(&ban.Ban{Type: ban.TypeClientID, Value: "expired", ExpiresAt: now.Add(-time.Second)}))
+	a.Nil(store.Add(&ban.Ban{Type: ban.TypeClientID, Value: "a", ExpiresAt: now.Add(time.Hour)}))
+
+	b := newBanList(2)
+	a.Nil(b.load(store, now))
+	a.Len(storedBans(a, store), 1)
+	a.True(b.banned("a", nil, now))
+	a.False(b.banned("expired", nil, now))
+
+	ip := net.ParseIP("10.0.0.1")
+	a.Nil(b.add(&ban.Ban{Type: ban.TypeIP, Value: ip.String(), ExpiresAt: now.Add(2 * time.Hour)}, now))
+	a.True(b.banned("other", ip, now))
+	a.False(b.banned("other", nil, now))
+	a.False(b.banned("other", net.ParseIP("10.0.0.2"), now))
+
+	// the list is full, the ban which expires the earliest is evicted.
+	a.Nil(b.add(&ban.Ban{Type: ban.TypeClientID, Value: "c", ExpiresAt: now.Add(3 * time.Hour)}, now))
+	a.False(b.banned("a", nil, now))
+	a.True(b.banned("c", nil, now))
+	a.Len(storedBans(a, store), 2)
+	// replacing does not evict.
+	a.Nil(b.add(&ban.Ban{Type: ban.TypeClientID, Value: "c", ExpiresAt: now.Add(time.Minute)}, now))
+	a.Len(b.list(now), 2)
+
+	// the expired ban is removed lazily.
+	later := now.Add(90 * time.Minute)
+	a.False(b.banned("c", nil, later))
+	a.Len(b.bans, 1)
+	a.Len(storedBans(a, store), 1)
+
+	// the expired bans are removed before evicting the unexpired ones.
+	a.Nil(b.add(&ban.Ban{Type: ban.TypeClientID, Value: "d", ExpiresAt: later.Add(2 * time.Hour)}, later))
+	later = later.Add(time.Hour)
+	a.Nil(b.add(&ban.Ban{Type: ban.TypeClientID, Value: "e", ExpiresAt: later.Add(time.Hour)}, later))
+	a.Equal([]*ban.Ban{
+		{Type: ban.TypeClientID, Value: "d", ExpiresAt: later.Add(time.Hour)},
+		{Type: ban.TypeClientID, Value: "e", ExpiresAt: later.Add(time.Hour)},
+	}, b.list(later))
+
+	a.Equal(0, b.clear(ban.TypeClientID, "not_exist"))
+	a.Equal(1, b.clear(ban.TypeClientID, "e"))
+	a.Nil(b.add(&ban.Ban{Type: ban.TypeClientID, Value: "f", ExpiresAt: later.Add(time.Hour)}, later))
+	a.Equal(2, b.clear("", ""))
+	a.Empty(b.list(later))
+	a.Empty(storedBans(a, store))
+
+	var nb *banList
+	a.False(nb.banned("a", nil, now))
+}
+
+func TestClientService_Ban(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	cs := &clientService{srv: srv}
+	expiresAt := time.Now().Add(time.Hour)
+
+	a.Equal(ErrInvalidBan, cs.Ban(&ban.Ban{Type: "unknown", Value: "a", ExpiresAt: expiresAt}))
+	a.Equal(ErrInvalidBan, cs.Ban(&ban.Ban{Type: ban.TypeIP, Value: "invalid", ExpiresAt: expiresAt}))
+	a.Nil(cs.Ban(&ban.Ban{Type: ban.TypeIP, Value: "::ffff:10.0.0.1", ExpiresAt: expiresAt}))
+	a.Nil(cs.Ban(&ban.Ban{Type: ban.TypeClientID, Value: "cid", ExpiresAt: expiresAt}))
+	bans := cs.ListBans()
+	if a.Len(bans, 2) {
+		a.Equal("cid", bans[0].Value)
+		// the IP is stored in the canonical form.
+		a.Equal("10.0.0.1", bans[1].Value)
+	}
+	a.Equal(1, cs.ClearBans(ban.TypeIP, "::ffff:10.0.0.1"))
+	a.Equal(1, cs.ClearBans("", ""))
+}
+
+func TestClient_connectHandler_banned(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	cs := &clientService{srv: srv}
+	expiresAt := time.Now().Add(time.Hour)
+	a.Nil(cs.Ban(&ban.Ban{Type: ban.TypeClientID, Value: "banned", ExpiresAt: expiresAt}))
+	a.Nil(cs.Ban(&ban.Ban{Type: ban.TypeIP, Value: "10.0.0.1", ExpiresAt: expiresAt}))
+
+	var tt = []struct {
+		clientID string
+		addr     string
+		version  packets.Version
+		code     codes.Code
+	}{
+		{clientID: "banned", addr: "10.0.0.2:1883", version: packets.Version5, code: codes.NotAuthorized},
+		{clientID: "banned", addr: "10.0.0.2:1883", version: packets.Version311, code: codes.V3NotAuthorized},
+		{clientID: "cid", addr: "10.0.0.1:1883", version: packets.Version5, code: codes.NotAuthorized},
+		{clientID: "cid", addr: "10.0.0.2:1883", version: packets.Version5, code: codes.Success},
+	}
+	for _, v := range tt {
+		c, err := srv.newClient(remoteConn{addr: v.addr})
+		a.Nil(err)
+		_, _, err = c.connectHandler(&packets.Connect{
+			Version:    v.version,
+			ClientID:   []byte(v.clientID),
+			Properties: &packets.Properties{},
+		})
+		if v.code == codes.Success {
+			if err != nil {
+				a.NotEqual(codes.NotAuthorized, converError(err).Code)
+			}
+			continue
+		}
+		a.Equal(v.code, converError(err).Code)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+const (
+	// BatchUserProperty is the user property key of the SUBSCRIBE packet to opt in the message batching.
+	// Setting the value to "true" enables the batching for all subscriptions in the packet.
+	BatchUserProperty = "gmqtt-batch"
+	// BatchCountUserProperty is the user property key of the batched PUBLISH packet,
+	// the value is the number of messages in the batch.
+	BatchCountUserProperty = "gmqtt-batch-count"
+)
+
+// batchKey identifies a batch of one client.
+// Messages are batched per subscription and per topic name, since a PUBLISH packet only has one topic name.
+type batchKey struct {
+	topicFilter string
+	topic       string
+}
+
+type batch struct {
+	msgs   []*gmqtt.Message
+	bytes  int
+	expiry time.Time
+	timer  *time.Timer
+}
+
+// batcher aggregates the messages for the subscriptions which opt in batching.
+// It must be accessed under srv.mu.
+type batcher struct {
+	config config.MessageBatching
+	// clientID => batchKey => batch
+	batches map[string]map[batchKey]*batch
+}
+
+func newBatcher(config config.MessageBatching) *batcher {
+	return &batcher{
+		config:  config,
+		batches: make(map[string]map[batchKey]*batch),
+	}
+}
+
+// isBatchSubscribe reports whether the SUBSCRIBE packet opts in the message batching.
+func isBatchSubscribe(sub *packets.Subscribe) bool {
+	if sub.Version != packets.Version5 || sub.Properties == nil {
+		return false
+	}
+	for _, v := range sub.Properties.User {
+		if string(v.K) == BatchUserProperty {
+			return string(v.V) == "true"
+		}
+	}
+	return false
+}
+
+// encodeBatch encodes the messages into a single message.
+// The payload of the message is the concatenation of the payloads,
+// each of them is prefixed with its length as a 4 bytes big-endian unsigned integer.
+// The QoS of the message is the maximum QoS of the messages,
+// and the other properties (e.g: subscription identifiers) are taken from the first message.
+func encodeBatch(b *batch) *gmqtt.Message {
+	first := b.msgs[0]
+	msg := &gmqtt.Message{
+		QoS:                    first.QoS,
+		Topic:                  first.Topic,
+		SubscriptionIdentifier: first.SubscriptionIdentifier,
+		UserProperties: []packets.UserProperty{
+			{
+				K: []byte(BatchCountUserProperty),
+				V: []byte(strconv.Itoa(len(b.msgs))),
+			},
+		},
+	}
+	payload := make([]byte, b.bytes+4*len(b.msgs))
+	n := 0
+	for _, v := range b.msgs {
+		if v.QoS > msg.QoS {
+			msg.QoS = v.QoS
+		}
+		binary.BigEndian.PutUint32(payload[n:], uint32(len(v.Payload)))
+		n += 4
+		n += copy(payload[n:], v.Payload)
+	}
+	msg.Payload = payload
+	return msg
+}
+
+// addBatchLocked adds the message into the batch of the client and flushes the batch if it is full.
+func (srv *server) addBatchLocked(clientID string, sub *gmqtt.Subscription, msg *gmqtt.Message, expiry time.Time) {
+	bt := srv.batcher
+	key := batchKey{topicFilter: sub.GetFullTopicName(), topic: msg.Topic}
+	if bt.batches[clientID] == nil {
+		bt.batches[clientID] = make(map[batchKey]*batch)
+	}
+	b := bt.batches[clientID][key]
+	if b == nil {
+		b = &batch{}
+		b.timer = time.AfterFunc(bt.config.MaxDelay, func() {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			// the batch may have been flushed by count or bytes.
+			if srv.batcher.batches[clientID][key] == b {
+				srv.flushBatchLocked(clientID, key)
+			}
+		})
+		bt.batches[clientID][key] = b
+	}
+	b.msgs = append(b.msgs, msg)
+	b.bytes += len(msg.Payload)
+	if !expiry.IsZero() && (b.expiry.IsZero() || expiry.Before(b.expiry)) {
+		b.expiry = expiry
+	}
+	if len(b.msgs) >= bt.config.MaxCount || b.bytes >= bt.config.MaxBytes {
+		srv.flushBatchLocked(clientID, key)
+	}
+}
+
+// flushBatchLocked adds the batched message into the queue of the client.
+func (srv *server) flushBatchLocked(clientID string, key batchKey) {
+	b := srv.batcher.batches[clientID][key]
+	if b == nil {
+		return
+	}
+	b.timer.Stop()
+	delete(srv.batcher.batches[clientID], key)
+	if len(srv.batcher.batches[clientID]) == 0 {
+		delete(srv.batcher.batches, clientID)
+	}
+	q := srv.queueStore[clientID]
+	if q == nil {
+		return
+	}
+	msg := encodeBatch(b)
+	if !srv.config().MQTT.QueueQos0Msg {
+		if c := srv.clients[clientID]; c == nil && msg.QoS == packets.Qos0 {
+			return
+		}
+	}
+	srv.enqueueLocked(srv.clock.Now(), clientID, msg, b.expiry, q)
+}
+
+// flushBatchesLocked adds all pending batches into the queues, e.g: before the persistence is closed.
+func (srv *server) flushBatchesLocked() {
+	if srv.batcher == nil {
+		return
+	}
+	for clientID, batches := range srv.batcher.batches {
+		for key := range batches {
+			srv.flushBatchLocked(clientID, key)
+		}
+	}
+}
+
+// removeBatchesLocked discards all batches of the client.
+func (srv *server) removeBatchesLocked(clientID string) {
+	if srv.batcher == nil {
+		return
+	}
+	for _, b := range srv.batcher.batches[clientID] {
+		b.timer.Stop()
+	}
+	delete(srv.batcher.batches, clientID)
+}
+
+// enqueueLocked adds the message to the queue of the client.
+// It returns true if the message is rejected by the queue according to config.MQTT.QueueOverflowStrategy.
+func (srv *server) enqueueLocked(now time.Time, clientID string, msg *gmqtt.Message, expiry time.Time, q queue.Store) (rejected bool) {
+	elem := &queue.Elem{
+		At:     now,
+		Expiry: expiry,
+		MessageWithID: &queue.Publish{
+			Message: msg,
+		},
+	}
+	err := queue.EncodePayload(srv.payloadCodec, elem)
+	if err == nil {
+		err = q.Add(elem)
+	}
+	if err == queue.ErrDropQueueFull {
+		srv.queueNotifierLocked(clientID).notifyDropped(msg, err)
+		return true
+	}
+	if err != nil {
+		srv.queueNotifierLocked(clientID).notifyDropped(msg, &queue.InternalError{Err: err})
+		return false
+	}
+	srv.tracer.record(srv.tracer.traceID(msg), msg, TraceEvent{Stage: TraceEnqueued, ClientID: clientID})
+	if max := srv.config().MQTT.MaxOfflineQos0Msg; max > 0 && msg.QoS == packets.Qos0 && srv.clients[clientID] == nil {
+		if t, ok := q.(queue.Qos0Trimmer); ok {
+			if err := t.TrimQos0(max); err != nil {
+				zaplog.Error("failed to trim the offline qos0 messages", zap.String("client_id", clientID), zap.Error(err))
+			}
+		}
+	}
+	return false
+}
+
+// queueNotifierLocked returns the queue notifier of the client.
+// The sessions restored from the persistence have no client until the clients reconnect.
+func (srv *server) queueNotifierLocked(clientID string) *queueNotifier {
+	if c := srv.clients[clientID]; c != nil {
+		return c.queueNotifier
+	}
+	return srv.defaultNotifier(clientID)
+}
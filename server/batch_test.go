@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func decodeBatch(a *assert.Assertions, payload []byte) (rs [][]byte) {
+	for len(payload) != 0 {
+		if !a.True(len(payload) >= 4) {
+			return
+		}
+		l := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		rs = append(rs, payload[:l])
+		payload = payload[l:]
+	}
+	return
+}
+
+func TestIsBatchSubscribe(t *testing.T) {
+	a := assert.New(t)
+	a.False(isBatchSubscribe(&packets.Subscribe{Version: packets.Version311}))
+	a.False(isBatchSubscribe(&packets.Subscribe{Version: packets.Version5, Properties: &packets.Properties{}}))
+	a.True(isBatchSubscribe(&packets.Subscribe{Version: packets.Version5, Properties: &packets.Properties{
+		User: []packets.UserProperty{{K: []byte(BatchUserProperty), V: []byte("true")}},
+	}}))
+	a.False(isBatchSubscribe(&packets.Subscribe{Version: packets.Version5, Properties: &packets.Properties{
+		User: []packets.UserProperty{{K: []byte(BatchUserProperty), V: []byte("false")}},
+	}}))
+}
+
+func TestServer_batch(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	srv := defaultServer()
+	srv.batcher = newBatcher(config.MessageBatching{
+		Enable:   true,
+		MaxCount: 3,
+		MaxBytes: 10,
+		MaxDelay: 50 * time.Millisecond,
+	})
+	cid := "cid"
+	q := queue.NewMockStore(ctrl)
+	srv.queueStore[cid] = q
+	sub := &gmqtt.Subscription{
+		TopicFilter: "a/#",
+		QoS:         packets.Qos2,
+		ID:          1,
+		Batch:       true,
+	}
+	added := make(chan *gmqtt.Message, 10)
+	q.EXPECT().Add(gomock.Any()).DoAndReturn(func(elem *queue.Elem) error {
+		added <- elem.MessageWithID.(*queue.Publish).Message
+		return nil
+	}).AnyTimes()
+	add := func(topic string, qos packets.QoS, payload string) {
+		srv.mu.Lock()
+		srv.addMsgToQueueLocked(time.Now(), cid, &gmqtt.Message{
+			QoS:     qos,
+			Topic:   topic,
+			Payload: []byte(payload),
+		}, sub, []uint32{sub.ID}, q)
+		srv.mu.Unlock()
+	}
+	assertFlushed := func(topic string, qos packets.QoS, payloads ...string) {
+		select {
+		case msg := <-added:
+			a.Equal(topic, msg.Topic)
+			a.Equal(qos, msg.QoS)
+			a.Equal([]uint32{1}, msg.SubscriptionIdentifier)
+			a.Equal([]packets.UserProperty{{
+				K: []byte(BatchCountUserProperty),
+				V: []byte(strconv.Itoa(len(payloads))),
+			}}, msg.UserProperties)
+			var expected [][]byte
+			for _, v := range payloads {
+				expected = append(expected, []byte(v))
+			}
+			a.Equal(expected, decodeBatch(a, msg.Payload))
+		case <-time.After(time.Second):
+			a.FailNow("batch not flushed")
+		}
+	}
+	assertNotFlushed := func() {
+		select {
+		case msg := <-added:
+			a.FailNow("unexpected flush", msg)
+		default:
+		}
+	}
+
+	// flush by count
+	add("a/1", packets.Qos0, "1")
+	add("a/1", packets.Qos1, "2")
+	assertNotFlushed()
+	add("a/1", packets.Qos0, "3")
+	assertFlushed("a/1", packets.Qos1, "1", "2", "3")
+
+	// flush by bytes
+	add("a/2", packets.Qos1, "12345")
+	assertNotFlushed()
+	add("a/2", packets.Qos1, "67890")
+	assertFlushed("a/2", packets.Qos1, "12345", "67890")
+
+	// flush by time, batched per topic name
+	add("a/3", packets.Qos1, "x")
+	add("a/4", packets.Qos2, "y")
+	assertNotFlushed()
+	flushed := map[string]*gmqtt.Message{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-added:
+			flushed[msg.Topic] = msg
+		case <-time.After(time.Second):
+			a.FailNow("batch not flushed")
+		}
+	}
+	a.Equal([][]byte{[]byte("x")}, decodeBatch(a, flushed["a/3"].Payload))
+	a.Equal([][]byte{[]byte("y")}, decodeBatch(a, flushed["a/4"].Payload))
+	a.EqualValues(packets.Qos2, flushed["a/4"].QoS)
+
+	srv.mu.Lock()
+	a.Len(srv.batcher.batches, 0)
+	srv.mu.Unlock()
+
+	// the batches are discarded when the session is removed
+	add("a/5", packets.Qos1, "z")
+	srv.mu.Lock()
+	srv.removeBatchesLocked(cid)
+	srv.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	assertNotFlushed()
+}
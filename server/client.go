@@ -26,7 +26,6 @@ import (
 	"github.com/DrmagicE/gmqtt/persistence/queue"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	"github.com/DrmagicE/gmqtt/persistence/unack"
-	"github.com/DrmagicE/gmqtt/pkg/bitmap"
 	"github.com/DrmagicE/gmqtt/pkg/codes"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 )
@@ -34,6 +33,15 @@ import (
 // Error
 var (
 	ErrConnectTimeOut = errors.New("connect time out")
+	// ErrKeepAliveTimeout is the error passed to OnClosed hook
+	// if no packet has been received from the client within 1.5 times the keep alive time.
+	ErrKeepAliveTimeout = errors.New("keep alive timeout")
+	// ErrFirstPacketTimeout is the error passed to OnClosed hook
+	// if no packet has been received from the client within config.MQTT.FirstPacketTimeout after the CONNACK packet.
+	ErrFirstPacketTimeout = errors.New("first packet timeout")
+	// ErrWriteBufferFull is the error passed to OnClosed hook
+	// if the client is disconnected because its write buffer is full, see config.MQTT.WriteBufferPolicy.
+	ErrWriteBufferFull = errors.New("write buffer full")
 )
 
 // Client status
@@ -134,12 +142,24 @@ type ClientOptions struct {
 	// RequestProblemInfo is the value to indicate whether the Reason String or User Properties should be sent in the case of failures.
 	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901053
 	RequestProblemInfo bool
+	// DeliveryRateLimit is the maximum number of messages per second delivered to the client, 0 means no limit.
+	// The inflight messages redelivered on session resumption are not limited.
+	DeliveryRateLimit int
+	// Listener is the name of the listener which accepted the connection, see NewNamedListener and WsServer.Name.
+	// It is empty if the listener is not named.
+	Listener string
+	// CertUsername is the username mapped from the verified client certificate, see ConnectRequest.CertUsername.
+	CertUsername string
 	// UserProperties is the user properties provided by the client.
 	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901090
 	UserProperties []*packets.UserProperty
 	// WildcardSubAvailable indicates whether the client is permitted to send retained messages.
 	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901091
 	RetainAvailable bool
+	// MaximumQoS is the highest QoS level permitted for the PUBLISH packets sent by the client,
+	// and the highest QoS level granted to the subscriptions.
+	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901084
+	MaximumQoS uint8
 	// WildcardSubAvailable indicates whether the client is permitted to subscribe Wildcard Subscriptions.
 	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901091
 	WildcardSubAvailable bool
@@ -173,11 +193,15 @@ type Client interface {
 	Close()
 	// Disconnect sends a disconnect packet to client, it is use to close v5 client.
 	Disconnect(disconnect *packets.Disconnect)
+	// ConnID returns the correlation id assigned to the connection when it is accepted.
+	// It is attached to the log lines of the connection as "conn_id".
+	ConnID() string
 }
 
 // client represents a MQTT client and implements the Client interface
 type client struct {
 	connectedAt  int64
+	connID       string
 	server       *server
 	wg           sync.WaitGroup
 	rwc          net.Conn //raw tcp connection
@@ -203,6 +227,8 @@ type client struct {
 	cleanWillFlag bool // whether to remove will Msg
 
 	disconnect *packets.Disconnect
+	// reAuthing indicates the server is waiting for the client to continue the re-authentication.
+	reAuthing bool
 
 	topicAliasManager TopicAliasManager
 	version           packets.Version
@@ -218,12 +244,44 @@ type client struct {
 	unackStore    unack.Store
 	pl            *packetIDLimiter
 	queueNotifier *queueNotifier
+	// publishLimiter is nil if config.PublishRateLimit is disabled.
+	publishLimiter PublishLimiter
+	// reloadedRateLimit is the reloaded config.PublishRateLimit waiting to be applied, nil if none. Guarded by rateLimitMu.
+	rateLimitMu       sync.Mutex
+	reloadedRateLimit *config.PublishRateLimit
+	// rateLimitReloaded is 1 if reloadedRateLimit is set, it is used to skip the lock on every PUBLISH packet.
+	rateLimitReloaded int32
+	// readCPU and writeCPU are nil if config.CPUAccounting is disabled.
+	readCPU  *cpuAccounter
+	writeCPU *cpuAccounter
+	// clientIDFilter restricts the client id of the CONNECT packet, nil means all client ids are allowed.
+	clientIDFilter ClientIDFilter
+	// connectACL is the static allow/deny list of the server when the client is created, nil means disabled.
+	connectACL *connectACL
+	// ipQuotaExceeded indicates the connections of the remote IP exceed config.MQTT.MaxConnectionsPerIP.
+	ipQuotaExceeded bool
+	// serverReference is the Server Reference property of the error CONNACK if the client is redirected.
+	serverReference string
+	// connectRejectReason is the reason of the rejected CONNECT, empty means the reason is derived from the error.
+	// See ConnectRejection.Reason.
+	connectRejectReason string
+	// aclCache caches the decisions of the OnAuthorize hook, nil if config.ACLCache is disabled.
+	aclCache *aclCache
+	// pending is the pending list of the write buffer, nil unless config.MQTT.WriteBufferPolicy is "drop_oldest".
+	pending *pendingWrites
+	// requireClientCert indicates whether the CONNECT packet without a verified client certificate is rejected.
+	requireClientCert bool
+	// topicAliasMax overrides config.MQTT.TopicAliasMax in the default AuthOptions, nil means no override.
+	topicAliasMax *uint16
+	// policy is the policy of the listener which accepted the connection, nil means no policy.
+	policy *ListenerPolicy
 	// register requests the broker to add the client into the "active client list"  before sending a positive CONNACK to the client.
 	register func(connect *packets.Connect, client *client) (sessionResume bool, err error)
 	// unregister requests the broker to remove the client from the "active client list" when the client is disconnected.
 	unregister func(client *client)
 	// deliverMessage
-	deliverMessage func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched bool)
+	// rejected reports whether the message is rejected by any subscriber queue, see config.MQTT.QueueOverflowStrategy.
+	deliverMessage func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool)
 }
 
 func (client *client) SessionInfo() *gmqtt.Session {
@@ -234,6 +292,10 @@ func (client *client) Version() packets.Version {
 	return client.version
 }
 
+func (client *client) ConnID() string {
+	return client.connID
+}
+
 func (client *client) Disconnect(disconnect *packets.Disconnect) {
 	client.write(disconnect)
 }
@@ -270,10 +332,18 @@ func (client *client) IsConnected() bool {
 func (client *client) setError(err error) {
 	client.errOnce.Do(func() {
 		if err != nil && err != io.EOF {
-			zaplog.Warn("connection lost",
-				zap.String("client_id", client.opts.ClientID),
-				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
-				zap.Error(err))
+			if ok, suppressed := client.server.logLimiter.allow(client.logKey(), err, time.Now()); ok {
+				fields := []zap.Field{
+					zap.String("client_id", client.opts.ClientID),
+					zap.String("conn_id", client.connID),
+					zap.String("remote_addr", client.rwc.RemoteAddr().String()),
+					zap.Error(err),
+				}
+				if suppressed != 0 {
+					fields = append(fields, zap.Int("suppressed", suppressed))
+				}
+				zaplog.Warn("connection lost", fields...)
+			}
 			client.err = err
 			if client.version == packets.Version5 {
 				if code, ok := err.(*codes.Error); ok {
@@ -309,8 +379,26 @@ func (client *client) writeLoop() {
 		case <-client.close:
 			return
 		case packet := <-client.out:
+			start := client.writeCPU.start()
 			switch p := packet.(type) {
 			case *packets.Publish:
+				// map the rewritten topic back to the topic that the client expects.
+				if srv.hooks.OnTopicRewrite != nil && len(p.TopicName) != 0 {
+					if topic, err := client.rewriteTopic(string(p.TopicName), TopicRewriteDeliver); err == nil {
+						p.TopicName = []byte(topic)
+					}
+					if p.Properties != nil && len(p.Properties.ResponseTopic) != 0 {
+						if topic, err := client.rewriteTopic(string(p.Properties.ResponseTopic), TopicRewriteDeliver); err == nil {
+							p.Properties.ResponseTopic = []byte(topic)
+						}
+					}
+				}
+				// The message passed to the OnDelivered hook is taken before the topic alias substitution,
+				// and it is deep copied so that the hook can not clobber the queued message which may be retransmitted.
+				var delivered *gmqtt.Message
+				if srv.hooks.OnDelivered != nil {
+					delivered = gmqtt.MessageFromPublish(p).Copy()
+				}
 				if client.version == packets.Version5 {
 					if client.opts.ClientTopicAliasMax > 0 {
 						// use alias if exist
@@ -326,8 +414,8 @@ func (client *client) writeLoop() {
 					}
 				}
 				// OnDelivered hook
-				if srv.hooks.OnDelivered != nil {
-					srv.hooks.OnDelivered(context.Background(), client, gmqtt.MessageFromPublish(p))
+				if delivered != nil {
+					srv.hooks.OnDelivered(context.Background(), client, delivered)
 				}
 				srv.statsManager.messageSent(p.Qos, client.opts.ClientID)
 			case *packets.Puback, *packets.Pubcomp:
@@ -340,6 +428,7 @@ func (client *client) writeLoop() {
 				}
 			}
 			err = client.writePacket(packet)
+			client.accountCPU(false, start)
 			if err != nil {
 				return
 			}
@@ -353,12 +442,13 @@ func (client *client) writeLoop() {
 }
 
 func (client *client) writePacket(packet packets.Packet) error {
-	if client.server.config.Log.DumpPacket {
+	if client.server.config().Log.DumpPacket {
 		if ce := zaplog.Check(zapcore.DebugLevel, "sending packet"); ce != nil {
 			ce.Write(
 				zap.String("packet", packet.String()),
 				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 				zap.String("client_id", client.opts.ClientID),
+				zap.String("conn_id", client.connID),
 			)
 		}
 	}
@@ -394,17 +484,36 @@ func (client *client) readLoop() {
 		client.setError(err)
 		close(client.in)
 	}()
+	// received is the number of the packets received after the client has connected,
+	// the CONNECT and AUTH packets of the authentication exchange are not counted.
+	var received int
 	for {
 		var packet packets.Packet
-		if client.IsConnected() {
-			if keepAlive := client.opts.KeepAlive; keepAlive != 0 { //KeepAlive
-				_ = client.rwc.SetReadDeadline(time.Now().Add(time.Duration(keepAlive/2+keepAlive) * time.Second))
-			}
+		// timeoutErr is the error to report if the read deadline is exceeded.
+		// Before the client has connected, the read deadline is set by connectWithTimeOut.
+		timeoutErr := ErrConnectTimeOut
+		connected := client.IsConnected()
+		if connected {
+			var deadline time.Time
+			deadline, timeoutErr = client.readDeadline(time.Now(), received == 0)
+			_ = client.rwc.SetReadDeadline(deadline)
 		}
 		packet, err = client.packetReader.ReadPacket()
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && timeoutErr != nil {
+				err = timeoutErr
+			}
 			if err != io.EOF && packet != nil {
-				zaplog.Error("read error", zap.String("packet_type", reflect.TypeOf(packet).String()))
+				if ok, suppressed := srv.logLimiter.allow(client.logKey(), err, time.Now()); ok {
+					fields := []zap.Field{
+						zap.String("conn_id", client.connID),
+						zap.String("packet_type", reflect.TypeOf(packet).String()),
+					}
+					if suppressed != 0 {
+						fields = append(fields, zap.Int("suppressed", suppressed))
+					}
+					zaplog.Error("read error", fields...)
+				}
 			}
 			return
 		}
@@ -418,21 +527,41 @@ func (client *client) readLoop() {
 				}
 			}
 		}
+		if connected {
+			received++
+		}
 		client.in <- packet
 		<-client.connected
 		srv.statsManager.packetReceived(packet, client.opts.ClientID)
-		if client.server.config.Log.DumpPacket {
+		if client.server.config().Log.DumpPacket {
 			if ce := zaplog.Check(zapcore.DebugLevel, "received packet"); ce != nil {
 				ce.Write(
 					zap.String("packet", packet.String()),
 					zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 					zap.String("client_id", client.opts.ClientID),
+					zap.String("conn_id", client.connID),
 				)
 			}
 		}
 	}
 }
 
+// readDeadline returns the read deadline of the next packet after the client has connected,
+// and the error to report if it is exceeded. Zero deadline means no limit.
+// The first packet after CONNACK is limited by config.MQTT.FirstPacketTimeout as well as the keep alive.
+func (client *client) readDeadline(now time.Time, first bool) (deadline time.Time, err error) {
+	if keepAlive := client.opts.KeepAlive; keepAlive != 0 {
+		deadline = now.Add(time.Duration(keepAlive) * 1500 * time.Millisecond)
+		err = ErrKeepAliveTimeout
+	}
+	if timeout := client.config.MQTT.FirstPacketTimeout; first && timeout > 0 {
+		if d := now.Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			return d, ErrFirstPacketTimeout
+		}
+	}
+	return deadline, err
+}
+
 // Close closes the client connection. The returned channel will be closed after unregisterClient process has been done
 func (client *client) Close() {
 	if client.rwc != nil {
@@ -479,6 +608,22 @@ func getRandomUUID() string {
 	return fmt.Sprintf(`%x`, string(b[:]))
 }
 
+var connCounter uint32
+
+// newConnID returns the short correlation id of the connection, it is the random part followed by the increment,
+// so that the ids are unique within the process and unlikely to collide across restarts.
+func newConnID() string {
+	var b [6]byte
+	if _, err := io.ReadFull(rand.Reader, b[:3]); err != nil {
+		binary.BigEndian.PutUint16(b[:], uint16(pid))
+	}
+	i := atomic.AddUint32(&connCounter, 1)
+	b[3] = byte(i >> 16)
+	b[4] = byte(i >> 8)
+	b[5] = byte(i)
+	return fmt.Sprintf(`%x`, string(b[:]))
+}
+
 func bool2Byte(bo bool) *byte {
 	var b byte
 	if bo {
@@ -503,17 +648,26 @@ func convertUint32(u *uint32, defaultValue uint32) uint32 {
 	return *u
 }
 
-func sendErrConnack(cli *client, err error) {
+// sendErrConnack sends the CONNACK of the error, and returns the reason code of the CONNACK.
+func sendErrConnack(cli *client, err error) codes.Code {
 	codeErr := converError(err)
 	// Override the error code if it is invalid for V3 client.
 	if packets.IsVersion3X(cli.version) && codeErr.Code > codes.V3NotAuthorized {
 		codeErr.Code = codes.NotAuthorized
 	}
+	ppt := getErrorProperties(cli, &codeErr.ErrorDetails)
+	if cli.serverReference != "" && packets.IsVersion5(cli.version) {
+		if ppt == nil {
+			ppt = &packets.Properties{}
+		}
+		ppt.ServerReference = []byte(cli.serverReference)
+	}
 	cli.out <- &packets.Connack{
 		Version:    cli.version,
 		Code:       codeErr.Code,
-		Properties: getErrorProperties(cli, &codeErr.ErrorDetails),
+		Properties: ppt,
 	}
+	return codeErr.Code
 }
 
 func (client *client) connectWithTimeOut() (ok bool) {
@@ -528,7 +682,10 @@ func (client *client) connectWithTimeOut() (ok bool) {
 		}
 		close(client.connected)
 	}()
-	timeout := time.NewTimer(5 * time.Second)
+	connectTimeout := client.config.MQTT.ConnectTimeout
+	// the deadline unblocks the read of the partial CONNECT packet, the timer limits the authentication exchange.
+	_ = client.rwc.SetReadDeadline(time.Now().Add(connectTimeout))
+	timeout := time.NewTimer(connectTimeout)
 	defer timeout.Stop()
 	var conn *packets.Connect
 	var authOpts *AuthOptions
@@ -555,9 +712,11 @@ func (client *client) connectWithTimeOut() (ok bool) {
 				if err != nil {
 					break
 				}
+				if resp != nil {
+					authData = resp.AuthData
+				}
 				if resp != nil && resp.Continue {
 					code = codes.ContinueAuthentication
-					authData = resp.AuthData
 					onAuth = resp.OnAuth
 				} else {
 					code = codes.Success
@@ -572,19 +731,26 @@ func (client *client) connectWithTimeOut() (ok bool) {
 					break
 				}
 				au := p.(*packets.Auth)
+				// The Client responds to an AUTH packet from the Server by sending a further AUTH packet.
+				// This packet MUST contain a Reason Code of 0x18 (Continue authentication) [MQTT-4.12.0-3]
 				if au.Code != codes.ContinueAuthentication {
 					err = codes.ErrProtocol
 					break
 				}
+				// It is a Protocol Error for the Client to use a different Authentication Method than in the CONNECT packet.
+				if au.Properties == nil || !bytes.Equal(conn.Properties.AuthMethod, au.Properties.AuthMethod) {
+					err = codes.ErrProtocol
+					break
+				}
 
 				var authResp *AuthResponse
 				authResp, err = client.authHandler(au, authOpts, onAuth)
 				if err != nil {
 					break
 				}
+				authData = authResp.AuthData
 				if authResp.Continue {
 					code = codes.ContinueAuthentication
-					authData = authResp.AuthData
 				} else {
 					code = codes.Success
 				}
@@ -596,7 +762,12 @@ func (client *client) connectWithTimeOut() (ok bool) {
 			}
 			// authentication fail
 			if err != nil {
-				sendErrConnack(client, err)
+				// there is no suitable return code for the MQTT v3.x clients while draining, they are closed without CONNACK.
+				code := converError(err).Code
+				if !(packets.IsVersion3X(client.version) && code == codes.ServerUnavailable) {
+					code = sendErrConnack(client, err)
+				}
+				client.connectRejected(conn, code, err)
 				return
 			}
 			// continue authentication (ContinueAuthentication is introduced in V5)
@@ -613,6 +784,7 @@ func (client *client) connectWithTimeOut() (ok bool) {
 
 			// authentication success
 			client.opts.RetainAvailable = authOpts.RetainAvailable
+			client.opts.MaximumQoS = authOpts.MaximumQoS
 			client.opts.WildcardSubAvailable = authOpts.WildcardSubAvailable
 			client.opts.SubIDAvailable = authOpts.SubIDAvailable
 			client.opts.SharedSubAvailable = authOpts.SharedSubAvailable
@@ -621,8 +793,14 @@ func (client *client) connectWithTimeOut() (ok bool) {
 			client.opts.ReceiveMax = authOpts.ReceiveMax
 			client.opts.ClientMaxPacketSize = math.MaxUint32 // unlimited
 			client.opts.ServerMaxPacketSize = authOpts.MaxPacketSize
+			// the hooks may have changed the limit.
+			client.packetReader.SetMaxPacketSize(authOpts.MaxPacketSize)
 			client.opts.ServerTopicAliasMax = authOpts.TopicAliasMax
+			client.opts.DeliveryRateLimit = authOpts.DeliveryRateLimit
 			client.opts.Username = string(conn.Username)
+			if authOpts.Username != "" {
+				client.opts.Username = authOpts.Username
+			}
 
 			if len(conn.ClientID) == 0 {
 				if len(authOpts.AssignedClientID) != 0 {
@@ -637,25 +815,27 @@ func (client *client) connectWithTimeOut() (ok bool) {
 
 			var connackPpt *packets.Properties
 			if client.version == packets.Version5 {
-				client.opts.MaxInflight = convertUint16(conn.Properties.ReceiveMaximum, client.opts.MaxInflight)
+				// The client can only lower the inflight window, the server never sends more than it is configured to.
+				if rm := conn.Properties.ReceiveMaximum; rm != nil && *rm < client.opts.MaxInflight {
+					client.opts.MaxInflight = *rm
+				}
 				client.opts.ClientMaxPacketSize = convertUint32(conn.Properties.MaximumPacketSize, client.opts.ClientMaxPacketSize)
 				client.opts.ClientTopicAliasMax = convertUint16(conn.Properties.TopicAliasMaximum, client.opts.ClientTopicAliasMax)
 				client.opts.AuthMethod = conn.Properties.AuthMethod
 				client.serverReceiveMaximumQuota = client.opts.ReceiveMax
-				client.aliasMapper = make([][]byte, client.opts.ReceiveMax+1)
+				client.aliasMapper = make([][]byte, int(client.opts.ServerTopicAliasMax)+1)
 				client.opts.KeepAlive = authOpts.KeepAlive
 
-				var maxQoS byte
-				if authOpts.MaximumQoS >= 2 {
-					maxQoS = byte(1)
-				} else {
-					maxQoS = byte(0)
+				// The absent Maximum QoS means QoS 2 is supported, the property can only be 0 or 1.
+				var maxQoS *byte
+				if authOpts.MaximumQoS < packets.Qos2 {
+					maxQoS = &authOpts.MaximumQoS
 				}
 
 				connackPpt = &packets.Properties{
 					SessionExpiryInterval: &authOpts.SessionExpiry,
 					ReceiveMaximum:        &authOpts.ReceiveMax,
-					MaximumQoS:            &maxQoS,
+					MaximumQoS:            maxQoS,
 					RetainAvailable:       bool2Byte(authOpts.RetainAvailable),
 					TopicAliasMaximum:     &authOpts.TopicAliasMax,
 					WildcardSubAvailable:  bool2Byte(authOpts.WildcardSubAvailable),
@@ -665,20 +845,30 @@ func (client *client) connectWithTimeOut() (ok bool) {
 					ServerKeepAlive:       &authOpts.KeepAlive,
 					AssignedClientID:      authOpts.AssignedClientID,
 					ResponseInfo:          authOpts.ResponseInfo,
+					// the CONNACK of the enhanced authentication contains the same method and the final auth data, if any.
+					AuthMethod: conn.Properties.AuthMethod,
+					AuthData:   authData,
 				}
 			} else {
-				client.opts.KeepAlive = conn.KeepAlive
+				// v3.x client can not be informed, but the server enforces the read deadline of the clamped keepalive.
+				client.opts.KeepAlive = authOpts.KeepAlive
 			}
 
 			if keepAlive := client.opts.KeepAlive; keepAlive != 0 { //KeepAlive
-				_ = client.rwc.SetReadDeadline(time.Now().Add(time.Duration(keepAlive/2+keepAlive) * time.Second))
+				_ = client.rwc.SetReadDeadline(time.Now().Add(time.Duration(keepAlive) * 1500 * time.Millisecond))
 			}
 			client.newPacketIDLimiter(client.opts.MaxInflight)
+			client.newPublishLimiter()
 
+			// the will is rewritten once the client id is resolved, because the OnTopicRewrite hook is called with it.
+			if err = client.rewriteWill(conn); err != nil {
+				client.connectRejected(conn, sendErrConnack(client, err), err)
+				return
+			}
 			var sessionResume bool
 			sessionResume, err = client.register(conn, client)
 			if err != nil {
-				sendErrConnack(client, err)
+				client.connectRejected(conn, sendErrConnack(client, err), err)
 				return
 			}
 			connack := conn.NewConnackPacket(codes.Success, sessionResume)
@@ -694,28 +884,22 @@ func (client *client) connectWithTimeOut() (ok bool) {
 	}
 }
 
-func (client *client) basicAuth(conn *packets.Connect, authOpts *AuthOptions) (err error) {
+func (client *client) basicAuth(req *ConnectRequest) (err error) {
 	srv := client.server
 	if srv.hooks.OnBasicAuth != nil {
-		err = srv.hooks.OnBasicAuth(context.Background(), client, &ConnectRequest{
-			Connect: conn,
-			Options: authOpts,
-		})
+		err = srv.hooks.OnBasicAuth(context.Background(), client, req)
 
 	}
 	return err
 }
 
-func (client *client) enhancedAuth(conn *packets.Connect, authOpts *AuthOptions) (resp *EnhancedAuthResponse, err error) {
+func (client *client) enhancedAuth(req *ConnectRequest) (resp *EnhancedAuthResponse, err error) {
 	srv := client.server
 	if srv.hooks.OnEnhancedAuth == nil {
 		return nil, errors.New("OnEnhancedAuth hook is nil")
 	}
 
-	resp, err = srv.hooks.OnEnhancedAuth(context.Background(), client, &ConnectRequest{
-		Connect: conn,
-		Options: authOpts,
-	})
+	resp, err = srv.hooks.OnEnhancedAuth(context.Background(), client, req)
 	if err == nil && resp == nil {
 		err = errors.New("return nil response from OnEnhancedAuth hook")
 	}
@@ -723,21 +907,91 @@ func (client *client) enhancedAuth(conn *packets.Connect, authOpts *AuthOptions)
 }
 
 func (client *client) connectHandler(conn *packets.Connect) (authOpts *AuthOptions, enhancedResp *EnhancedAuthResponse, err error) {
+	client.version = conn.Version
+	if err = client.checkListenerPolicy(conn); err != nil {
+		return
+	}
+	if !client.connectACL.allowed(string(conn.ClientID), client.rwc.RemoteAddr()) {
+		code := codes.NotAuthorized
+		if packets.IsVersion3X(client.version) {
+			code = codes.V3NotAuthorized
+		}
+		err = client.rejectConnect(code, "denied by the connect ACL")
+		return
+	}
+	if client.server != nil && client.server.banList.banned(string(conn.ClientID), addrIP(client.rwc.RemoteAddr()), client.server.clock.Now()) {
+		code := codes.NotAuthorized
+		if packets.IsVersion3X(client.version) {
+			code = codes.V3NotAuthorized
+		}
+		err = client.rejectConnect(code, "banned")
+		return
+	}
+	if client.ipQuotaExceeded {
+		code := codes.QuotaExceeded
+		if packets.IsVersion3X(client.version) {
+			code = codes.V3ServerUnavaliable
+		}
+		err = client.rejectConnect(code, "too many connections from the IP")
+		return
+	}
 	if !client.config.MQTT.AllowZeroLenClientID && len(conn.ClientID) == 0 {
-		err = &codes.Error{
-			Code: codes.ClientIdentifierNotValid,
+		err = client.rejectConnect(codes.ClientIdentifierNotValid, "zero-length client id not allowed")
+		return
+	}
+	if client.server != nil && client.server.LifecycleState() == StateDraining {
+		err = client.rejectConnect(codes.ServerUnavailable, "the server is draining")
+		return
+	}
+	if err = client.redirect(conn); err != nil {
+		return
+	}
+	reserved := client.config.MQTT.SystemClientID != "" && string(conn.ClientID) == client.config.MQTT.SystemClientID
+	if reserved || (client.clientIDFilter != nil && !client.clientIDFilter(string(conn.ClientID))) {
+		reason := "client id rejected by the client id filter"
+		if reserved {
+			reason = "client id reserved for the system client"
 		}
+		err = client.rejectConnect(clientIDNotValidCode(client.version), reason)
+		return
+	}
+	assignedID, err := client.checkClientID(conn)
+	if err != nil {
+		return
+	}
+	if conn.WillFlag && client.exceedsMaxTopicLength(conn.WillTopic, conn.WillProperties) {
+		err = client.rejectConnect(codes.TopicNameInvalid, "will topic too long")
+		return
+	}
+	if codeErr := client.checkUserProperties(conn.Properties); codeErr != nil {
+		err = codeErr
+		return
+	}
+	if codeErr := client.checkUserProperties(conn.WillProperties); codeErr != nil {
+		err = codeErr
 		return
 	}
-	client.version = conn.Version
 	// default auth options
 	authOpts = client.defaultAuthOptions(conn)
+	if len(conn.ClientID) == 0 && assignedID != "" {
+		authOpts.AssignedClientID = []byte(assignedID)
+	}
+	req := &ConnectRequest{
+		Connect: conn,
+		Options: authOpts,
+	}
+	if err = client.clientCertAuth(req); err != nil {
+		return
+	}
+	client.opts.CertUsername = req.CertUsername
 
 	if packets.IsVersion3X(client.version) || (packets.IsVersion5(client.version) && conn.Properties.AuthMethod == nil) {
-		err = client.basicAuth(conn, authOpts)
+		if !client.anonymous(conn) {
+			err = client.basicAuth(req)
+		}
 	}
 	if client.version == packets.Version5 && conn.Properties.AuthMethod != nil {
-		enhancedResp, err = client.enhancedAuth(conn, authOpts)
+		enhancedResp, err = client.enhancedAuth(req)
 	}
 
 	return
@@ -765,23 +1019,44 @@ func getErrorProperties(client *client, errDetails *codes.ErrorDetails) *packets
 }
 
 func (client *client) defaultAuthOptions(connect *packets.Connect) *AuthOptions {
-	opts := &AuthOptions{
-		SessionExpiry:        uint32(client.config.MQTT.SessionExpiry.Seconds()),
-		ReceiveMax:           client.config.MQTT.ReceiveMax,
-		MaximumQoS:           client.config.MQTT.MaximumQoS,
-		MaxPacketSize:        client.config.MQTT.MaxPacketSize,
-		TopicAliasMax:        client.config.MQTT.TopicAliasMax,
-		RetainAvailable:      client.config.MQTT.RetainAvailable,
-		WildcardSubAvailable: client.config.MQTT.WildcardAvailable,
-		SubIDAvailable:       client.config.MQTT.SubscriptionIDAvailable,
-		SharedSubAvailable:   client.config.MQTT.SharedSubAvailable,
-		KeepAlive:            client.config.MQTT.MaxKeepAlive,
-		MaxInflight:          client.config.MQTT.MaxInflight,
-	}
-	if connect.KeepAlive < opts.KeepAlive {
-		opts.KeepAlive = connect.KeepAlive
+	opts := newAuthOptions(client.config, client.version, connect)
+	if client.topicAliasMax != nil {
+		opts.TopicAliasMax = *client.topicAliasMax
 	}
-	if client.version == packets.Version5 {
+	if client.policy != nil && client.policy.MaxPacketSize != 0 {
+		opts.MaxPacketSize = client.policy.MaxPacketSize
+	}
+	return opts
+}
+
+// clampKeepAlive returns the keepalive requested by the client clamped to [min, max], 0 means no limit.
+// The requested 0 disables the keep alive mechanism, it is only raised by min.
+func clampKeepAlive(keepAlive, min, max uint16) uint16 {
+	if keepAlive < min {
+		return min
+	}
+	if max != 0 && keepAlive > max {
+		return max
+	}
+	return keepAlive
+}
+
+func newAuthOptions(config config.Config, version packets.Version, connect *packets.Connect) *AuthOptions {
+	opts := &AuthOptions{
+		SessionExpiry:        uint32(config.MQTT.SessionExpiry.Seconds()),
+		ReceiveMax:           config.MQTT.ReceiveMax,
+		MaximumQoS:           config.MQTT.MaximumQoS,
+		MaxPacketSize:        config.MQTT.MaxPacketSize,
+		TopicAliasMax:        config.MQTT.TopicAliasMax,
+		RetainAvailable:      config.MQTT.RetainAvailable,
+		WildcardSubAvailable: config.MQTT.WildcardAvailable,
+		SubIDAvailable:       config.MQTT.SubscriptionIDAvailable,
+		SharedSubAvailable:   config.MQTT.SharedSubAvailable,
+		KeepAlive:            clampKeepAlive(connect.KeepAlive, config.MQTT.MinKeepAlive, config.MQTT.MaxKeepAlive),
+		MaxInflight:          config.MQTT.MaxInflight,
+		DeliveryRateLimit:    config.MQTT.DeliveryRateLimit,
+	}
+	if version == packets.Version5 {
 		if i := connect.Properties.SessionExpiryInterval; i == nil {
 			opts.SessionExpiry = 0
 		} else if *i < opts.SessionExpiry {
@@ -794,6 +1069,10 @@ func (client *client) defaultAuthOptions(connect *packets.Connect) *AuthOptions
 
 func (client *client) internalClose() {
 	if client.IsConnected() {
+		// OnKeepAliveTimeout hooks
+		if client.err == ErrKeepAliveTimeout && client.server.hooks.OnKeepAliveTimeout != nil {
+			client.server.hooks.OnKeepAliveTimeout(context.Background(), client.opts.ClientID)
+		}
 		// OnClosed hooks
 		if client.server.hooks.OnClosed != nil {
 			client.server.hooks.OnClosed(context.Background(), client, client.err)
@@ -823,6 +1102,21 @@ func (client *client) write(packets packets.Packet) {
 	}
 }
 
+// hasSubscription returns whether the client has subscribed the topic filter, topicName is the full topic name.
+func (client *client) hasSubscription(topicName string) bool {
+	var ok bool
+	client.server.subscriptionsDB.Iterate(func(clientID string, s *gmqtt.Subscription) bool {
+		ok = true
+		return false
+	}, subscription.IterationOptions{
+		Type:      subscription.TypeAll,
+		ClientID:  client.opts.ClientID,
+		TopicName: topicName,
+		MatchType: subscription.MatchName,
+	})
+	return ok
+}
+
 func (client *client) subscribeHandler(sub *packets.Subscribe) *codes.Error {
 	srv := client.server
 	suback := &packets.Suback{
@@ -832,7 +1126,10 @@ func (client *client) subscribeHandler(sub *packets.Subscribe) *codes.Error {
 		Payload:    make([]codes.Code, len(sub.Topics)),
 	}
 	var subID uint32
-	now := time.Now()
+	now := srv.clock.Now()
+	if codeErr := client.checkUserProperties(sub.Properties); codeErr != nil {
+		return codeErr
+	}
 	if client.version == packets.Version5 {
 		if client.opts.SubIDAvailable && len(sub.Properties.SubscriptionIdentifier) != 0 {
 			subID = sub.Properties.SubscriptionIdentifier[0]
@@ -852,11 +1149,26 @@ func (client *client) subscribeHandler(sub *packets.Subscribe) *codes.Error {
 		ID: subID,
 	}
 
-	for _, v := range sub.Topics {
+	// If a SUBSCRIBE packet contains the same topic filter more than once, the last one wins.
+	// lastIndex stores the index of the last occurrence for each topic filter.
+	lastIndex := make(map[string]int, len(sub.Topics))
+	batch := isBatchSubscribe(sub)
+	for k, v := range sub.Topics {
+		s := subscription.FromTopic(v, subID)
+		s.Batch = batch
+		// the share name is kept, only the topic filter is rewritten.
+		var err error
+		s.TopicFilter, err = client.rewriteTopic(s.TopicFilter, TopicRewriteSubscribe)
 		subReq.Subscriptions[v.Name] = &struct {
 			Sub   *gmqtt.Subscription
 			Error error
-		}{Sub: subscription.FromTopic(v, subID), Error: nil}
+		}{Sub: s, Error: err}
+		lastIndex[v.Name] = k
+	}
+	for _, v := range subReq.Subscriptions {
+		if v.Error == nil && !client.authorize(AccessSubscribe, v.Sub.GetFullTopicName()) {
+			v.Error = codes.NewError(codes.NotAuthorized)
+		}
 	}
 
 	if srv.hooks.OnSubscribe != nil {
@@ -874,9 +1186,42 @@ func (client *client) subscribeHandler(sub *packets.Subscribe) *codes.Error {
 			return nil
 		}
 	}
+	// subCount is the current subscription number of the client, only used if MaxSubscriptionsPerClient is set.
+	var subCount uint64
+	maxSubs := client.config.MQTT.MaxSubscriptionsPerClient
+	if maxSubs != 0 {
+		// ErrClientNotExists means the client has no subscription.
+		stats, _ := srv.subscriptionsDB.GetClientStats(client.opts.ClientID)
+		subCount = stats.SubscriptionsCurrent
+	}
+	// totalCount is the current subscription number of all clients, only used if MaxTotalSubscriptions is set.
+	var totalCount, totalRejected uint64
+	maxTotal := client.config.MQTT.MaxTotalSubscriptions
+	if maxTotal != 0 {
+		srv.subscribeMu.Lock()
+		totalCount = srv.subscriptionsDB.GetStats().SubscriptionsCurrent
+	}
+	// accepted is the subscriptions which pass the checks, they are added to the store in one batch.
+	type acceptedSub struct {
+		index    int
+		sub      *gmqtt.Subscription
+		isShared bool
+	}
+	var accepted []acceptedSub
 	for k, v := range sub.Topics {
+		if lastIndex[v.Name] != k {
+			// the reason code will be filled after the last occurrence has been handled.
+			continue
+		}
 		sub := subReq.Subscriptions[v.Name].Sub
 		subErr := converError(subReq.Subscriptions[v.Name].Error)
+		// The server might grant a lower QoS than the requested one, the hooks can not grant more than the configured maximum.
+		if maxQoS := client.config.MQTT.MaxSubscriptionQoS; sub.QoS > maxQoS {
+			sub.QoS = maxQoS
+		}
+		if sub.QoS > client.opts.MaximumQoS {
+			sub.QoS = client.opts.MaximumQoS
+		}
 		var isShared bool
 		code := sub.QoS
 		if client.version == packets.Version5 {
@@ -899,104 +1244,217 @@ func (client *client) subscribeHandler(sub *packets.Subscribe) *codes.Error {
 			}
 		}
 
-		var subRs subscription.SubscribeResult
-		var err error
 		if subErr != nil {
 			code = subErr.Code
 			if packets.IsVersion3X(client.version) {
 				code = packets.SubscribeFailure
 			}
 		}
-		if code < packets.SubscribeFailure {
-			subRs, err = srv.subscriptionsDB.Subscribe(client.opts.ClientID, sub)
-			if err != nil {
-				zaplog.Error("failed to subscribe topic",
-					zap.String("topic", v.Name),
-					zap.Uint8("qos", v.Qos),
-					zap.String("client_id", client.opts.ClientID),
-					zap.String("remote_addr", client.rwc.RemoteAddr().String()),
-					zap.Error(err))
+		if code < packets.SubscribeFailure && (maxSubs != 0 || maxTotal != 0) && !client.hasSubscription(sub.GetFullTopicName()) {
+			if maxSubs != 0 && subCount >= uint64(maxSubs) {
+				code = codes.QuotaExceeded
+			} else if maxTotal != 0 && totalCount >= uint64(maxTotal) {
+				code = codes.QuotaExceeded
+				totalRejected++
+			} else {
+				subCount++
+				totalCount++
+			}
+			if code == codes.QuotaExceeded && packets.IsVersion3X(client.version) {
 				code = packets.SubscribeFailure
 			}
 		}
 		suback.Payload[k] = code
 		if code < packets.SubscribeFailure {
-			if srv.hooks.OnSubscribed != nil {
-				srv.hooks.OnSubscribed(context.Background(), client, sub)
-			}
-			zaplog.Info("subscribe succeeded",
+			accepted = append(accepted, acceptedSub{index: k, sub: sub, isShared: isShared})
+		} else {
+			zaplog.Info("subscribe failed",
 				zap.String("topic", sub.TopicFilter),
-				zap.Uint8("qos", sub.QoS),
-				zap.Uint8("retain_handling", sub.RetainHandling),
-				zap.Bool("retain_as_published", sub.RetainAsPublished),
-				zap.Bool("no_local", sub.NoLocal),
-				zap.Uint32("id", sub.ID),
+				zap.Uint8("qos", suback.Payload[k]),
 				zap.String("client_id", client.opts.ClientID),
+				zap.String("conn_id", client.connID),
 				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 			)
-			// The spec does not specify whether the retain message should follow the 'no-local' option rule.
-			// Gmqtt follows the mosquitto implementation which will send retain messages to no-local subscriptions.
-			// For details: https://github.com/eclipse/mosquitto/issues/1796
-			if !isShared && ((!subRs[0].AlreadyExisted && v.RetainHandling != 2) || v.RetainHandling == 0) {
-				msgs := srv.retainedDB.GetMatchedMessages(sub.TopicFilter)
-				for _, v := range msgs {
-					if v.QoS > subRs[0].Subscription.QoS {
-						v.QoS = subRs[0].Subscription.QoS
-					}
-					v.Dup = false
-					if !sub.RetainAsPublished {
-						v.Retained = false
-					}
-					var expiry time.Time
-					if v.MessageExpiry != 0 {
-						expiry = now.Add(time.Second * time.Duration(v.MessageExpiry))
+		}
+	}
+	// The accepted subscriptions are added atomically, so that the session never ends up with a part of them
+	// if the broker crashes in the middle. The SUBACK is sent after they have been committed.
+	var subRs subscription.SubscribeResult
+	if len(accepted) != 0 {
+		subs := make([]*gmqtt.Subscription, len(accepted))
+		for i, v := range accepted {
+			subs[i] = v.sub
+		}
+		var err error
+		subRs, err = srv.subscriptionsDB.Subscribe(client.opts.ClientID, subs...)
+		if err != nil {
+			zaplog.Error("failed to subscribe topics",
+				zap.Int("topics", len(subs)),
+				zap.String("client_id", client.opts.ClientID),
+				zap.String("conn_id", client.connID),
+				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
+				zap.Error(err))
+			// nothing has been added.
+			for _, v := range accepted {
+				suback.Payload[v.index] = packets.SubscribeFailure
+			}
+			accepted = nil
+		}
+	}
+	if maxTotal != 0 {
+		srv.subscribeMu.Unlock()
+		if totalRejected != 0 {
+			srv.statsManager.subscriptionsRejected(totalRejected)
+		}
+	}
+	for i, v := range accepted {
+		sub := v.sub
+		rs := subRs[i]
+		if srv.hooks.OnSubscribed != nil {
+			srv.hooks.OnSubscribed(context.Background(), client, sub)
+		}
+		zaplog.Info("subscribe succeeded",
+			zap.String("topic", sub.TopicFilter),
+			zap.Uint8("qos", sub.QoS),
+			zap.Uint8("retain_handling", sub.RetainHandling),
+			zap.Bool("retain_as_published", sub.RetainAsPublished),
+			zap.Bool("no_local", sub.NoLocal),
+			zap.Uint32("id", sub.ID),
+			zap.String("client_id", client.opts.ClientID),
+			zap.String("conn_id", client.connID),
+			zap.String("remote_addr", client.rwc.RemoteAddr().String()),
+		)
+		// The spec does not specify whether the retain message should follow the 'no-local' option rule.
+		// Gmqtt follows the mosquitto implementation which will send retain messages to no-local subscriptions.
+		// For details: https://github.com/eclipse/mosquitto/issues/1796
+		if sendRetainedOnSubscribe(sub, v.isShared, rs.AlreadyExisted) {
+			msgs := srv.retainedDB.GetMatchedMessages(sub.TopicFilter)
+			for _, v := range msgs {
+				if v.QoS > rs.Subscription.QoS {
+					v.QoS = rs.Subscription.QoS
+				}
+				v.Dup = false
+				if !sub.RetainAsPublished {
+					v.Retained = false
+				}
+				var expiry time.Time
+				if v.MessageExpiry != 0 {
+					expiry = now.Add(time.Second * time.Duration(v.MessageExpiry))
+				}
+				elem := &queue.Elem{
+					At:     now,
+					Expiry: expiry,
+					MessageWithID: &queue.Publish{
+						Message: v,
+					},
+				}
+				err := queue.EncodePayload(srv.payloadCodec, elem)
+				if err == nil {
+					err = client.queueStore.Add(elem)
+				}
+				if err != nil {
+					client.queueNotifier.notifyDropped(v, &queue.InternalError{Err: err})
+					if codesErr, ok := err.(*codes.Error); ok {
+						return codesErr
 					}
-					err := client.queueStore.Add(&queue.Elem{
-						At:     now,
-						Expiry: expiry,
-						MessageWithID: &queue.Publish{
-							Message: v,
-						},
-					})
-					if err != nil {
-						client.queueNotifier.notifyDropped(v, &queue.InternalError{Err: err})
-						if codesErr, ok := err.(*codes.Error); ok {
-							return codesErr
-						}
-						return &codes.Error{
-							Code: codes.UnspecifiedError,
-						}
+					return &codes.Error{
+						Code: codes.UnspecifiedError,
 					}
 				}
 			}
-		} else {
-			zaplog.Info("subscribe failed",
-				zap.String("topic", sub.TopicFilter),
-				zap.Uint8("qos", suback.Payload[k]),
-				zap.String("client_id", client.opts.ClientID),
-				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
-			)
 		}
 	}
+	// keep the reason codes positionally aligned with the topic filters in the SUBSCRIBE packet.
+	for k, v := range sub.Topics {
+		suback.Payload[k] = suback.Payload[lastIndex[v.Name]]
+	}
 	client.write(suback)
 	return nil
 }
 
+// exceedsMaxTopicLength reports whether the topic name or the response topic in properties exceeds config.MQTT.MaxTopicLength.
+func (client *client) exceedsMaxTopicLength(topicName []byte, ppt *packets.Properties) bool {
+	max := client.config.MQTT.MaxTopicLength
+	if max == 0 {
+		return false
+	}
+	return len(topicName) > max || (ppt != nil && len(ppt.ResponseTopic) > max)
+}
+
+// checkUserProperties checks the user properties against config.MQTT.MaxUserProperties and config.MQTT.MaxUserPropertiesBytes.
+func (client *client) checkUserProperties(ppt *packets.Properties) *codes.Error {
+	if ppt == nil {
+		return nil
+	}
+	if max := client.config.MQTT.MaxUserProperties; max != 0 && len(ppt.User) > max {
+		return &codes.Error{
+			Code: codes.ProtocolError,
+		}
+	}
+	if max := client.config.MQTT.MaxUserPropertiesBytes; max != 0 {
+		var n int
+		for _, v := range ppt.User {
+			n += len(v.K) + len(v.V)
+		}
+		if n > max {
+			return &codes.Error{
+				Code: codes.PacketTooLarge,
+			}
+		}
+	}
+	return nil
+}
+
 func (client *client) publishHandler(pub *packets.Publish) *codes.Error {
 	srv := client.server
 	var dup bool
 
-	// check retain available
-	if !client.opts.RetainAvailable && pub.Retain {
+	if client.exceedsMaxTopicLength(pub.TopicName, pub.Properties) {
+		return &codes.Error{
+			Code: codes.TopicNameInvalid,
+		}
+	}
+	if codeErr := client.checkUserProperties(pub.Properties); codeErr != nil {
+		return codeErr
+	}
+
+	// check retain available and maximum QoS
+	downgrade := packets.IsVersion3X(client.version) && client.config.MQTT.V3UnsupportedPolicy == config.V3UnsupportedDowngrade
+	downgradeRetain := !client.opts.RetainAvailable && pub.Retain
+	if downgradeRetain && !downgrade {
 		return &codes.Error{
 			Code: codes.RetainNotSupported,
 		}
 	}
+	downgradeQoS := pub.Qos > client.opts.MaximumQoS
+	if downgradeQoS && !downgrade {
+		return &codes.Error{
+			Code: codes.QoSNotSupported,
+		}
+	}
+	// The retransmitted QoS 2 message may have been accepted, so it is not limited.
+	// The limited message is handled after the topic alias is processed, so that the alias mapping is not lost.
+	client.applyReloadedRateLimit()
+	limited := client.publishLimiter != nil && !(pub.Qos == packets.Qos2 && pub.Dup) && !client.allowPublish(pub)
+	var turn *publishTurn
+	if srv.publishSequencer != nil {
+		turn = srv.publishSequencer.ticket()
+		// pass the turn on the early returns.
+		defer turn.done()
+	}
 	var msg *gmqtt.Message
 	msg = gmqtt.MessageFromPublish(pub)
+	// The downgraded message is still acknowledged with the QoS of the PUBLISH packet.
+	if downgradeRetain {
+		msg.Retained = false
+	}
+	if downgradeQoS {
+		msg.QoS = client.opts.MaximumQoS
+	}
 
 	if client.version == packets.Version5 && pub.Properties.TopicAlias != nil {
-		if *pub.Properties.TopicAlias >= client.opts.ServerTopicAliasMax {
+		// the valid topic alias is from 1 to the Topic Alias Maximum advertised in CONNACK.
+		if a := *pub.Properties.TopicAlias; a == 0 || a > client.opts.ServerTopicAliasMax {
 			return &codes.Error{
 				Code: codes.TopicAliasInvalid,
 			}
@@ -1015,6 +1473,22 @@ func (client *client) publishHandler(pub *packets.Publish) *codes.Error {
 		}
 
 	}
+	// The topic is rewritten after the topic alias is resolved, the alias always maps to the topic sent by the client.
+	// The rejected message is neither retained nor routed, it is acknowledged with the reason code of err.
+	var err error
+	msg.Topic, err = client.rewriteTopic(msg.Topic, TopicRewritePublish)
+	if err == nil && msg.ResponseTopic != "" {
+		msg.ResponseTopic, err = client.rewriteTopic(msg.ResponseTopic, TopicRewritePublish)
+	}
+	if err == nil {
+		srv.statsManager.topicPublished(msg.Topic, len(msg.Payload))
+	}
+	traceID := srv.tracer.start(client.opts.ClientID, msg)
+	traced := msg
+	if limited && pub.Qos == packets.Qos0 {
+		srv.tracer.record(traceID, traced, TraceEvent{Stage: TraceRejected, ClientID: client.opts.ClientID, Reason: publishRejectReason(limited, false, false, false, false, false, nil)})
+		return nil
+	}
 
 	if pub.Qos == packets.Qos2 {
 		exist, err := client.unackStore.Set(pub.PacketID)
@@ -1025,32 +1499,81 @@ func (client *client) publishHandler(pub *packets.Publish) *codes.Error {
 			dup = true
 		}
 	}
-
-	if pub.Retain {
-		if len(pub.Payload) == 0 {
-			srv.retainedDB.Remove(string(pub.TopicName))
-		} else {
-			srv.retainedDB.AddOrReplace(msg.Copy())
+	// The duplicated QoS 1 message is acknowledged with success as if it was routed again.
+	var dedupKey string
+	var deduplicated bool
+	if srv.publishDedup != nil && !limited {
+		dedupKey = srv.publishDedup.key(pub)
+		if dedupKey != "" && srv.publishDedup.seen(client.opts.ClientID, dedupKey, srv.clock.Now()) {
+			deduplicated = true
+			if ce := zaplog.Check(zapcore.DebugLevel, "duplicated message dropped"); ce != nil {
+				ce.Write(zap.String("client_id", client.opts.ClientID), zap.String("conn_id", client.connID), zap.String("idempotency_key", dedupKey))
+			}
+			dedupKey = ""
 		}
 	}
 
-	var err error
-	var topicMatched bool
-	if !dup {
+	var topicMatched, rejected, retainedNacked bool
+	// the retained one is not affected, because it is used to remove the retained message.
+	dropEmpty := client.config.MQTT.DropEmptyPayload && !msg.Retained && len(pub.Payload) == 0
+	if dropEmpty {
+		if ce := zaplog.Check(zapcore.DebugLevel, "empty payload message dropped"); ce != nil {
+			ce.Write(zap.String("client_id", client.opts.ClientID), zap.String("conn_id", client.connID), zap.ByteString("topic", pub.TopicName))
+		}
+	}
+	if !dup && !deduplicated && !dropEmpty && !limited && err == nil {
 		opts := defaultIterateOptions(msg.Topic)
-		if srv.hooks.OnMsgArrived != nil {
+		if !client.authorize(AccessPublish, msg.Topic) {
+			err = codes.NewError(codes.NotAuthorized)
+		} else {
+			err = client.checkTopicPolicy(msg)
+		}
+		if err == nil && srv.hooks.OnMsgArrived != nil {
+			// the hook operates on a copy, so that modifying the message in place does not affect the PUBLISH packet.
 			req := &MsgArrivedRequest{
 				Publish:          pub,
-				Message:          msg,
+				Message:          msg.Copy(),
 				IterationOptions: opts,
 			}
 			err = srv.hooks.OnMsgArrived(context.Background(), client, req)
 			msg = req.Message
 			opts = req.IterationOptions
 		}
-		if msg != nil && err == nil {
-			topicMatched = client.deliverMessage(client.opts.ClientID, msg, opts)
+		// The message returned by the hook is retained and routed, so that the retained store and all subscribers see the same message.
+		if msg != nil && err == nil && msg.Retained {
+			retainedNacked = client.storeRetained(pub, msg)
 		}
+		if msg != nil && err == nil && !retainedNacked {
+			srv.tracer.record(traceID, msg, TraceEvent{Stage: TraceAuthorized, ClientID: client.opts.ClientID})
+			if turn != nil {
+				turn.wait()
+			}
+			topicMatched, rejected = client.deliverMessage(client.opts.ClientID, msg, opts)
+			if !topicMatched && !msg.Retained {
+				srv.noSubscriber.dispatch(client.opts.ClientID, msg)
+				srv.dropDispatcher.dispatch(client.opts.ClientID, msg, DropNoSubscriber)
+			}
+		}
+	}
+	if turn != nil {
+		turn.done()
+	}
+	if traceID != "" {
+		if reason := publishRejectReason(limited, dup, deduplicated, dropEmpty, retainedNacked, msg == nil, err); reason != "" {
+			srv.tracer.record(traceID, traced, TraceEvent{Stage: TraceRejected, ClientID: client.opts.ClientID, Reason: reason})
+		}
+	}
+	// Only the routed message is remembered, so that the message rejected for any reason can be resent.
+	if dedupKey != "" && err == nil && !rejected && !retainedNacked {
+		srv.publishDedup.remember(client.opts.ClientID, dedupKey, srv.clock.Now())
+	}
+	// Withhold the acknowledgement of the rejected message, so that the publisher resends it.
+	if rejected && pub.Qos > packets.Qos0 {
+		if pub.Qos == packets.Qos2 {
+			// remove the packet id, otherwise the resent message will be treated as duplicated and never delivered.
+			return converError(client.unackStore.Remove(pub.PacketID))
+		}
+		return nil
 	}
 
 	var ack packets.Packet
@@ -1058,7 +1581,9 @@ func (client *client) publishHandler(pub *packets.Publish) *codes.Error {
 	var ppt *packets.Properties
 	code := codes.Success
 	if client.version == packets.Version5 {
-		if !topicMatched && err == nil {
+		if limited || retainedNacked {
+			code = codes.QuotaExceeded
+		} else if !topicMatched && err == nil && !dropEmpty && !deduplicated {
 			code = codes.NotMatchingSubscribers
 		}
 		if codeErr := converError(err); codeErr != nil {
@@ -1086,6 +1611,65 @@ func (client *client) publishHandler(pub *packets.Publish) *codes.Error {
 
 }
 
+// storeRetained stores the retained message, it returns true if the message should be nacked.
+// A retained message with zero-length payload removes the existing retained message of the topic (no-op if not exist),
+// and it is never stored itself. However, it is still delivered to the current subscribers as a normal message.
+// The message which is not stored due to the retained limits is nacked for the MQTT v5 clients if config.MQTT.RetainedLimitNack is set.
+func (client *client) storeRetained(pub *packets.Publish, msg *gmqtt.Message) (nacked bool) {
+	if err := client.server.storeRetained(msg); err != nil {
+		if ce := zaplog.Check(zapcore.DebugLevel, "retained message not stored"); ce != nil {
+			ce.Write(zap.String("client_id", client.opts.ClientID), zap.String("conn_id", client.connID), zap.String("topic", msg.Topic), zap.Error(err))
+		}
+		return client.version == packets.Version5 && pub.Qos > packets.Qos0 && client.config.MQTT.RetainedLimitNack
+	}
+	return false
+}
+
+// rewriteTopic rewrites the topic name or topic filter with the OnTopicRewrite hook.
+// The topics sent by the client are normalized before the hook if config.MQTT.NormalizeTopics is set.
+// It returns the given topic unchanged if the hook is not set or returns an error.
+func (client *client) rewriteTopic(topic string, action TopicRewriteAction) (string, error) {
+	if action != TopicRewriteDeliver && client.config.MQTT.NormalizeTopics {
+		topic = packets.NormalizeTopic(topic)
+	}
+	hook := client.server.hooks.OnTopicRewrite
+	if hook == nil {
+		return topic, nil
+	}
+	rewritten, err := hook(context.Background(), client.opts.ClientID, topic, action)
+	if err != nil {
+		return topic, err
+	}
+	if action == TopicRewriteSubscribe {
+		if !packets.ValidTopicFilter(true, []byte(rewritten)) {
+			return topic, codes.NewError(codes.TopicFilterInvalid)
+		}
+	} else if len(rewritten) == 0 || !packets.ValidTopicName(true, []byte(rewritten)) {
+		return topic, codes.NewError(codes.TopicNameInvalid)
+	}
+	return rewritten, nil
+}
+
+// rewriteWill rewrites the will topic and the will response topic the same way as the topics of the PUBLISH packet.
+func (client *client) rewriteWill(conn *packets.Connect) error {
+	if !conn.WillFlag {
+		return nil
+	}
+	topic, err := client.rewriteTopic(string(conn.WillTopic), TopicRewritePublish)
+	if err != nil {
+		return err
+	}
+	conn.WillTopic = []byte(topic)
+	if ppt := conn.WillProperties; ppt != nil && len(ppt.ResponseTopic) != 0 {
+		topic, err = client.rewriteTopic(string(ppt.ResponseTopic), TopicRewritePublish)
+		if err != nil {
+			return err
+		}
+		ppt.ResponseTopic = []byte(topic)
+	}
+	return nil
+}
+
 func converError(err error) *codes.Error {
 	if err == nil {
 		return nil
@@ -1107,19 +1691,36 @@ func (client *client) pubackHandler(puback *packets.Puback) *codes.Error {
 		return converError(err)
 	}
 	client.pl.release(puback.PacketID)
+	client.server.tracer.acked(client.opts.ClientID, puback.PacketID, ackRejectReason(client.version, puback.Code))
 	if ce := zaplog.Check(zapcore.DebugLevel, "unset inflight"); ce != nil {
 		ce.Write(zap.String("clientID", client.opts.ClientID),
+			zap.String("conn_id", client.connID),
 			zap.Uint16("pid", puback.PacketID),
 		)
 	}
 	return nil
 }
 func (client *client) pubrelHandler(pubrel *packets.Pubrel) *codes.Error {
+	pubcomp := pubrel.NewPubcomp()
+	pubcomp.Version = client.version
+	if checker, ok := client.unackStore.(unack.Checker); ok {
+		exist, err := checker.Exist(pubrel.PacketID)
+		if err != nil {
+			return converError(err)
+		}
+		if !exist {
+			if client.config.MQTT.UnknownPubrelPolicy == config.UnknownPubrelDisconnect {
+				return codes.NewError(codes.ProtocolError)
+			}
+			pubcomp.Code = codes.PacketIDNotFound
+			client.write(pubcomp)
+			return nil
+		}
+	}
 	err := client.unackStore.Remove(pubrel.PacketID)
 	if err != nil {
 		return converError(err)
 	}
-	pubcomp := pubrel.NewPubcomp()
 	client.write(pubcomp)
 	return nil
 }
@@ -1127,25 +1728,30 @@ func (client *client) pubrecHandler(pubrec *packets.Pubrec) {
 	if client.version == packets.Version5 && pubrec.Code >= codes.UnspecifiedError {
 		err := client.queueStore.Remove(pubrec.PacketID)
 		client.pl.release(pubrec.PacketID)
+		client.server.tracer.acked(client.opts.ClientID, pubrec.PacketID, ackRejectReason(client.version, pubrec.Code))
 		if err != nil {
 			client.setError(err)
 		}
 		return
 	}
 	pubrel := pubrec.NewPubrel()
-	_, err := client.queueStore.Replace(&queue.Elem{
-		At: time.Now(),
+	replaced, err := client.queueStore.Replace(&queue.Elem{
+		At: client.server.clock.Now(),
 		MessageWithID: &queue.Pubrel{
 			PacketID: pubrel.PacketID,
 		}})
 	if err != nil {
 		client.setError(err)
 	}
+	if !replaced && client.version == packets.Version5 {
+		pubrel.Code = codes.PacketIDNotFound
+	}
 	client.write(pubrel)
 }
 func (client *client) pubcompHandler(pubcomp *packets.Pubcomp) {
 	err := client.queueStore.Remove(pubcomp.PacketID)
 	client.pl.release(pubcomp.PacketID)
+	client.server.tracer.acked(client.opts.ClientID, pubcomp.PacketID, "")
 	if err != nil {
 		client.setError(err)
 	}
@@ -1178,10 +1784,13 @@ func (client *client) unsubscribeHandler(unSub *packets.Unsubscribe) {
 	}
 
 	for _, v := range unSub.Topics {
+		shareName, topicFilter := subscription.SplitTopic(v)
+		topicFilter, err := client.rewriteTopic(topicFilter, TopicRewriteSubscribe)
+		s := &gmqtt.Subscription{ShareName: shareName, TopicFilter: topicFilter}
 		req.Unsubs[v] = &struct {
 			TopicName string
 			Error     error
-		}{TopicName: v}
+		}{TopicName: s.GetFullTopicName(), Error: err}
 	}
 	if srv.hooks.OnUnsubscribe != nil {
 		err := srv.hooks.OnUnsubscribe(context.Background(), client, req)
@@ -1200,25 +1809,37 @@ func (client *client) unsubscribeHandler(unSub *packets.Unsubscribe) {
 		if ce != nil {
 			code = ce.Code
 		}
+		// The topic filter which has not been subscribed, including the repeated one in the same packet,
+		// is acknowledged without calling OnUnsubscribed, v3.x client can not tell it from a success.
+		if code == codes.Success && !client.hasSubscription(topicName) {
+			code = codes.NoSubscriptionExisted
+		}
 		if code == codes.Success {
 			err := srv.subscriptionsDB.Unsubscribe(client.opts.ClientID, topicName)
 			if ce := converError(err); ce != nil {
 				code = ce.Code
 			}
 		}
-		if code == codes.Success {
+		if code == codes.NoSubscriptionExisted {
+			if ce := zaplog.Check(zapcore.DebugLevel, "no subscription existed"); ce != nil {
+				ce.Write(zap.String("topic", topicName), zap.String("client_id", client.opts.ClientID), zap.String("conn_id", client.connID))
+			}
+		} else if code == codes.Success {
+			srv.removeSharedCursor(topicName)
 			if srv.hooks.OnUnsubscribed != nil {
 				srv.hooks.OnUnsubscribed(context.Background(), client, topicName)
 			}
 			zaplog.Info("unsubscribed succeed",
 				zap.String("topic", topicName),
 				zap.String("client_id", client.opts.ClientID),
+				zap.String("conn_id", client.connID),
 				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 			)
 		} else {
 			zaplog.Info("unsubscribed failed",
 				zap.String("topic", topicName),
 				zap.String("client_id", client.opts.ClientID),
+				zap.String("conn_id", client.connID),
 				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 				zap.Uint8("code", code))
 		}
@@ -1227,8 +1848,23 @@ func (client *client) unsubscribeHandler(unSub *packets.Unsubscribe) {
 	}
 }
 
+// reAuthHandler handles the re-authentication, the OnReAuth hook is called for every AUTH packet of the exchange.
 func (client *client) reAuthHandler(auth *packets.Auth) *codes.Error {
 	srv := client.server
+	// If the Client did not use the enhanced authentication in CONNECT, it MUST NOT send AUTH packet [MQTT-4.12.1-1],
+	// and the re-authentication MUST use the same Authentication Method as in the CONNECT packet.
+	if client.opts.AuthMethod == nil || auth.Properties == nil || !bytes.Equal(client.opts.AuthMethod, auth.Properties.AuthMethod) {
+		return codes.ErrProtocol
+	}
+	// The re-authentication starts with the Reason Code 0x19 (Re-authenticate),
+	// and the client continues it by 0x18 (Continue authentication) as the server asks for more auth data.
+	expected := codes.ReAuthenticate
+	if client.reAuthing {
+		expected = codes.ContinueAuthentication
+	}
+	if auth.Code != expected {
+		return codes.ErrProtocol
+	}
 	// default code
 	code := codes.Success
 	var resp *AuthResponse
@@ -1242,6 +1878,15 @@ func (client *client) reAuthHandler(auth *packets.Auth) *codes.Error {
 	} else {
 		return codes.ErrProtocol
 	}
+	if resp == nil {
+		return &codes.Error{
+			Code: codes.UnspecifiedError,
+			ErrorDetails: codes.ErrorDetails{
+				ReasonString: []byte("return nil response from OnReAuth hook"),
+			},
+		}
+	}
+	client.reAuthing = resp.Continue
 	if resp.Continue {
 		code = codes.ContinueAuthentication
 	}
@@ -1277,13 +1922,14 @@ func (client *client) disconnectHandler(dis *packets.Disconnect) *codes.Error {
 			if err != nil {
 				zaplog.Error("fail to set session expiry",
 					zap.String("client_id", client.opts.ClientID),
+					zap.String("conn_id", client.connID),
 					zap.Error(err))
 			}
 		}
 	}
 	client.disconnect = dis
-	// 不发送will message
-	client.cleanWillFlag = true
+	// The will message is only kept if the v5 client disconnects with the Disconnect with Will Message reason code.
+	client.cleanWillFlag = client.version != packets.Version5 || dis.Code != codes.DisconnectWithWillMessage
 	return nil
 }
 
@@ -1297,13 +1943,8 @@ func (client *client) readHandle() {
 		client.setError(err)
 	}()
 	for packet := range client.in {
-		if client.version == packets.Version5 {
-			if client.opts.ServerMaxPacketSize != 0 && packets.TotalBytes(packet) > client.opts.ServerMaxPacketSize {
-				err = codes.NewError(codes.PacketTooLarge)
-				return
-			}
-		}
 		var codeErr *codes.Error
+		start := client.readCPU.start()
 		switch packet.(type) {
 		case *packets.Subscribe:
 			codeErr = client.subscribeHandler(packet.(*packets.Subscribe))
@@ -1330,15 +1971,12 @@ func (client *client) readHandle() {
 				err = codes.ErrProtocol
 				return
 			}
-			if !bytes.Equal(client.opts.AuthMethod, auth.Properties.AuthData) {
-				codeErr = codes.ErrProtocol
-				return
-			}
 			codeErr = client.reAuthHandler(auth)
 
 		default:
 			err = codes.ErrProtocol
 		}
+		client.accountCPU(true, start)
 		if codeErr != nil {
 			err = codeErr
 			return
@@ -1348,14 +1986,11 @@ func (client *client) readHandle() {
 }
 
 func (client *client) newPacketIDLimiter(limit uint16) {
-	client.pl = &packetIDLimiter{
-		cond:      sync.NewCond(&sync.Mutex{}),
-		used:      0,
-		limit:     limit,
-		exit:      false,
-		freePid:   1,
-		lockedPid: bitmap.New(packets.MaxPacketID),
+	newAllocator := NewSequentialAllocator
+	if client.server != nil && client.server.newPacketIDAllocator != nil {
+		newAllocator = client.server.newPacketIDAllocator
 	}
+	client.pl = newPacketIDLimiterWithAllocator(limit, newAllocator(client.opts.ClientID))
 }
 
 func (client *client) pollInflights() (cont bool, err error) {
@@ -1364,20 +1999,52 @@ func (client *client) pollInflights() (cont bool, err error) {
 	if err != nil || len(elems) == 0 {
 		return false, err
 	}
-	client.pl.lock()
-	defer client.pl.unlock()
+	// The inflight set may exceed the inflight window if the client reconnects with a smaller Receive Maximum,
+	// the excess messages are handled according to config.MQTT.InflightTrimPolicy.
+	drop := client.config.MQTT.InflightTrimPolicy == config.InflightDrop
 	for _, v := range elems {
 		id := v.MessageWithID.ID()
+		if !client.pl.tryMarkUsed(id) {
+			if m, ok := v.MessageWithID.(*queue.Publish); ok && drop {
+				err = client.queueStore.Remove(id)
+				if err != nil {
+					return false, err
+				}
+				msg, derr := queue.DecodePayload(client.queueNotifier.codec, v)
+				if derr != nil {
+					msg = m.Message
+				}
+				client.queueNotifier.notifyDropped(msg, queue.ErrDropInflightTrimmed)
+				continue
+			}
+			// wait for the window
+			if !client.pl.waitAndMarkUsed(id) {
+				return false, nil
+			}
+		}
 		switch m := v.MessageWithID.(type) {
 		case *queue.Publish:
 			m.Dup = true
 			// https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Subscription_Options
 			// The Server need not use the same set of Subscription Identifiers in the retransmitted PUBLISH packet.
 			m.SubscriptionIdentifier = nil
-			client.pl.markUsedLocked(id)
-			client.write(gmqtt.MessageToPublish(m.Message, client.version))
+			msg, ok, err := client.decodePublish(v, m)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				client.pl.release(id)
+				continue
+			}
+			err = client.writeDelivery(gmqtt.MessageToPublish(withRemainingExpiry(msg, v.At, client.server.clock.Now()), client.version))
+			if err != nil {
+				return false, err
+			}
+			client.server.tracer.delivered(client.opts.ClientID, msg, id, true)
 		case *queue.Pubrel:
-			client.write(&packets.Pubrel{PacketID: id})
+			if err = client.writeDelivery(&packets.Pubrel{PacketID: id}); err != nil {
+				return false, err
+			}
 		}
 	}
 
@@ -1385,7 +2052,7 @@ func (client *client) pollInflights() (cont bool, err error) {
 }
 
 func (client *client) pollNewMessages(ids []packets.PacketID) (unused []packets.PacketID, err error) {
-	now := time.Now()
+	now := client.server.clock.Now()
 	var elems []*queue.Elem
 	elems, err = client.queueStore.Read(ids)
 	if err != nil {
@@ -1397,16 +2064,96 @@ func (client *client) pollNewMessages(ids []packets.PacketID) (unused []packets.
 			if m.QoS != packets.Qos0 {
 				ids = ids[1:]
 			}
-			if client.version == packets.Version5 && m.Message.MessageExpiry != 0 {
-				d := uint32(now.Sub(v.At).Seconds())
-				m.Message.MessageExpiry = d
+			msg, ok, err := client.decodePublish(v, m)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				if m.QoS != packets.Qos0 {
+					client.pl.release(m.ID())
+				}
+				continue
+			}
+			err = client.writeDelivery(gmqtt.MessageToPublish(withRemainingExpiry(msg, v.At, now), client.version))
+			if err != nil {
+				return nil, err
+			}
+			client.server.tracer.delivered(client.opts.ClientID, msg, m.ID(), false)
+			if !v.At.IsZero() {
+				client.server.statsManager.messageDelivered(now.Sub(v.At))
 			}
-			client.write(gmqtt.MessageToPublish(m.Message, client.version))
 		case *queue.Pubrel:
 		}
 	}
 	return ids, err
 }
+
+// sendRetainedOnSubscribe returns whether to send the retained messages matching the subscription at subscribe time.
+// alreadyExisted indicates whether the client had subscribed the same topic filter before the SUBSCRIBE packet,
+// the subscription replaced by the new one with the identical filter is not a new subscription, even if the options are changed.
+// The retained messages are never sent to the shared subscriptions.
+func sendRetainedOnSubscribe(sub *gmqtt.Subscription, isShared bool, alreadyExisted bool) bool {
+	if isShared {
+		return false
+	}
+	switch sub.RetainHandling {
+	case 0:
+		// If Retain Handling is set to 0 the Server MUST send the retained messages matching the Topic Filter of the subscription to the Client [MQTT-3.3.1-9].
+		return true
+	case 1:
+		// If Retain Handling is set to 1 then if the subscription did not already exist, the Server MUST send all retained message matching the Topic Filter of the subscription to the Client,
+		// and if the subscription did exist the Server MUST NOT send the retained messages. [MQTT-3.3.1-10].
+		return !alreadyExisted
+	default:
+		// If Retain Handling is set to 2, the Server MUST NOT send the retained messages [MQTT-3.3.1-11].
+		return false
+	}
+}
+
+// decodePublish returns the message of the publish elem with the original payload, see queue.PayloadCodec.
+// The elem is not modified, so that the retransmission is decoded from the stored payload as well.
+// If the payload can not be decoded or the decoded message exceeds the maximum packet size of the client,
+// the elem is removed from the queue and reported as dropped, and ok is false.
+func (client *client) decodePublish(elem *queue.Elem, pub *queue.Publish) (msg *gmqtt.Message, ok bool, err error) {
+	if elem.Codec == 0 {
+		return pub.Message, true, nil
+	}
+	msg, derr := queue.DecodePayload(client.queueNotifier.codec, elem)
+	if derr == nil && client.checkMaxPacketSize(msg) {
+		return msg, true, nil
+	}
+	if id := pub.ID(); id != 0 {
+		if err = client.queueStore.Remove(id); err != nil {
+			return nil, false, err
+		}
+	}
+	switch derr {
+	case nil:
+		client.queueNotifier.notifyDropped(msg, queue.ErrDropExceedsMaxPacketSize)
+	case queue.ErrDropCodecMismatch:
+		client.queueNotifier.notifyDropped(pub.Message, derr)
+	default:
+		client.queueNotifier.notifyDropped(pub.Message, &queue.InternalError{Err: derr})
+	}
+	return nil, false, nil
+}
+
+// withRemainingExpiry returns the message whose Message Expiry Interval is reduced by the time it has been waiting in the queue since at.
+// The queued message is not modified, so that the retransmission is calculated from the original interval.
+func withRemainingExpiry(msg *gmqtt.Message, at, now time.Time) *gmqtt.Message {
+	if msg.MessageExpiry == 0 {
+		return msg
+	}
+	waited := uint32(now.Sub(at) / time.Second)
+	m := *msg
+	if waited >= msg.MessageExpiry {
+		// The delivery of the inflight message has started, it is not expired, see queue.Store.Read.
+		m.MessageExpiry = 1
+	} else {
+		m.MessageExpiry = msg.MessageExpiry - waited
+	}
+	return &m
+}
 func (client *client) pollMessageHandler() {
 	var err error
 	defer func() {
@@ -1424,11 +2171,19 @@ func (client *client) pollMessageHandler() {
 		}
 	}
 	var ids []packets.PacketID
+	pacer := newDeliveryPacer(client.opts.DeliveryRateLimit)
 	for {
 		max := uint16(100)
 		if client.opts.MaxInflight < max {
 			max = client.opts.MaxInflight
 		}
+		if pacer != nil {
+			if !pacer.wait(time.Now(), client.close) {
+				return
+			}
+			// read one message at a time, so that the rest are buffered in the queue.
+			max = 1
+		}
 		ids = client.pl.pollPacketIDs(max)
 		if ids == nil {
 			return
@@ -1468,14 +2223,20 @@ func (client *client) serve() {
 			client.readHandle()
 			client.wg.Done()
 		}()
-
+		if client.pending != nil {
+			client.wg.Add(1)
+			go func() {
+				client.forwardPending()
+				client.wg.Done()
+			}()
+		}
 	}
 	readWg.Wait()
 
 	if client.queueStore != nil {
 		qerr := client.queueStore.Close()
 		if qerr != nil {
-			zaplog.Error("fail to close message queue", zap.String("client_id", client.opts.ClientID), zap.Error(qerr))
+			zaplog.Error("fail to close message queue", zap.String("client_id", client.opts.ClientID), zap.String("conn_id", client.connID), zap.Error(qerr))
 		}
 	}
 	if client.pl != nil {
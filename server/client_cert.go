@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+// CertUsernameFunc maps the verified client certificate to the username, see ConnectRequest.CertUsername.
+type CertUsernameFunc func(cert *x509.Certificate) (username string)
+
+// CommonNameUsername is the default CertUsernameFunc, which returns the common name of the certificate subject.
+func CommonNameUsername(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// clientCertListener is a net.Listener which requires the accepted connections to present a verified client certificate.
+type clientCertListener struct {
+	net.Listener
+}
+
+// NewClientCertListener returns a net.Listener which requires the clients to present a verified certificate.
+// The listener must be a TLS listener which verifies the client certificates if given,
+// e.g: tls.Listen with tls.VerifyClientCertIfGiven,
+// so that the CONNECT packet without a verified certificate can be rejected with "Not authorized".
+func NewClientCertListener(l net.Listener) net.Listener {
+	return &clientCertListener{
+		Listener: l,
+	}
+}
+
+// peerCertificates returns the verified certificate chain of the connection, the leaf certificate comes first.
+// It returns nil if the connection is not a TLS connection or no certificate is verified.
+func peerCertificates(c net.Conn) []*x509.Certificate {
+	for {
+		switch v := c.(type) {
+		case *tls.Conn:
+			chains := v.ConnectionState().VerifiedChains
+			if len(chains) == 0 {
+				return nil
+			}
+			return chains[0]
+		case *autoDetectConn:
+			c = v.conn
+		case *wsConn:
+			c = v.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// clientCertAuth checks the client certificate of the CONNECT packet and fills the certificate fields of the request.
+func (client *client) clientCertAuth(req *ConnectRequest) error {
+	req.PeerCertificates = peerCertificates(client.rwc)
+	if len(req.PeerCertificates) == 0 {
+		if client.requireClientCert {
+			return &codes.Error{
+				Code: codes.NotAuthorized,
+			}
+		}
+		return nil
+	}
+	fn := CommonNameUsername
+	if client.server != nil && client.server.certUsernameFunc != nil {
+		fn = client.server.certUsernameFunc
+	}
+	req.CertUsername = fn(req.PeerCertificates[0])
+	return nil
+}
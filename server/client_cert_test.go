@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// newTestCert returns a certificate signed by the parent, it is self-signed if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn + ".example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// tlsPipe returns the server side connection after the handshake, the client presents the given certificates.
+func tlsPipe(t *testing.T, ca tls.Certificate, clientCerts []tls.Certificate) *tls.Conn {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := newTestCert(t, "broker", &ca)
+	sc, cc := net.Pipe()
+	s := tls.Server(sc, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	c := tls.Client(cc, &tls.Config{
+		Certificates: clientCerts,
+		RootCAs:      pool,
+		ServerName:   "broker.example.com",
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Handshake()
+	}()
+	if err := s.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	// close the pipe directly, closing the tls connections blocks on sending close_notify.
+	t.Cleanup(func() {
+		cc.Close()
+		sc.Close()
+	})
+	return s
+}
+
+func TestClient_clientCertAuth(t *testing.T) {
+	a := assert.New(t)
+	ca := newTestCert(t, "ca", nil)
+	device := newTestCert(t, "device-1", &ca)
+
+	srv := defaultServer()
+	c, err := srv.newClient(tlsPipe(t, ca, []tls.Certificate{device}))
+	a.Nil(err)
+	c.requireClientCert = true
+	req := &ConnectRequest{}
+	a.Nil(c.clientCertAuth(req))
+	a.Equal("device-1", req.CertUsername)
+	if a.Len(req.PeerCertificates, 2) {
+		a.Equal([]string{"device-1.example.com"}, req.PeerCertificates[0].DNSNames)
+	}
+
+	// custom mapping
+	WithCertUsernameFunc(func(cert *x509.Certificate) string {
+		return cert.DNSNames[0]
+	})(srv)
+	req = &ConnectRequest{}
+	a.Nil(c.clientCertAuth(req))
+	a.Equal("device-1.example.com", req.CertUsername)
+
+	// no certificate
+	c, err = srv.newClient(tlsPipe(t, ca, nil))
+	a.Nil(err)
+	req = &ConnectRequest{}
+	a.Nil(c.clientCertAuth(req))
+	a.Nil(req.PeerCertificates)
+	a.Empty(req.CertUsername)
+	c.requireClientCert = true
+	a.Equal(codes.NotAuthorized, converError(c.clientCertAuth(req)).Code)
+
+	// not a tls connection
+	c, err = srv.newClient(noopConn{})
+	a.Nil(err)
+	c.requireClientCert = true
+	a.Equal(codes.NotAuthorized, converError(c.clientCertAuth(&ConnectRequest{})).Code)
+}
+
+func TestClient_connectHandler_certUsername(t *testing.T) {
+	a := assert.New(t)
+	ca := newTestCert(t, "ca", nil)
+	device := newTestCert(t, "device-1", &ca)
+
+	srv := defaultServer()
+	srv.hooks.OnBasicAuth = func(ctx context.Context, client Client, req *ConnectRequest) error {
+		if req.CertUsername != "device-1" {
+			return codes.NewError(codes.NotAuthorized)
+		}
+		req.Options.Username = req.CertUsername
+		return nil
+	}
+	c, err := srv.newClient(tlsPipe(t, ca, []tls.Certificate{device}))
+	a.Nil(err)
+	_, _, err = c.connectHandler(&packets.Connect{
+		Version:    packets.Version5,
+		ClientID:   []byte("cid"),
+		Properties: &packets.Properties{},
+	})
+	a.Nil(err)
+	a.Equal("device-1", c.opts.CertUsername)
+
+	c, err = srv.newClient(tlsPipe(t, ca, nil))
+	a.Nil(err)
+	_, _, err = c.connectHandler(&packets.Connect{
+		Version:    packets.Version5,
+		ClientID:   []byte("cid"),
+		Properties: &packets.Properties{},
+	})
+	a.Equal(codes.NotAuthorized, converError(err).Code)
+}
+
+func TestNewClientCertListener(t *testing.T) {
+	a := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer l.Close()
+	s := newTCPListenerState(NewNamedListener(NewClientCertListener(tls.NewListener(l, &tls.Config{})), "mtls"))
+	a.True(s.requireClientCert)
+	a.True(s.tls)
+	a.Equal("mtls", s.name)
+
+	c, err := defaultServer().newClient(noopConn{})
+	a.Nil(err)
+	s.bind(c)
+	a.True(c.requireClientCert)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"regexp"
+)
+
+// ClientIDFilter reports whether the client id is allowed to connect through the listener.
+type ClientIDFilter func(clientID string) bool
+
+// NewClientIDFilter returns a ClientIDFilter which allows the client ids in the list or matching the pattern.
+// It returns nil if both ids and pattern are empty, which means all client ids are allowed.
+func NewClientIDFilter(ids []string, pattern string) (ClientIDFilter, error) {
+	if len(ids) == 0 && pattern == "" {
+		return nil, nil
+	}
+	allowed := make(map[string]struct{}, len(ids))
+	for _, v := range ids {
+		allowed[v] = struct{}{}
+	}
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(clientID string) bool {
+		if _, ok := allowed[clientID]; ok {
+			return true
+		}
+		return re != nil && re.MatchString(clientID)
+	}, nil
+}
+
+// clientIDFilterListener is a net.Listener which restricts the client ids of the accepted connections.
+type clientIDFilterListener struct {
+	net.Listener
+	filter ClientIDFilter
+}
+
+// NewClientIDFilterListener returns a net.Listener which only allows the client ids accepted by the filter.
+// The CONNECT packet with disallowed client id will be rejected with "Client Identifier not valid",
+// or "Identifier rejected" for V3 clients.
+// It returns l if the filter is nil.
+func NewClientIDFilterListener(l net.Listener, filter ClientIDFilter) net.Listener {
+	if filter == nil {
+		return l
+	}
+	return &clientIDFilterListener{
+		Listener: l,
+		filter:   filter,
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestNewClientIDFilter(t *testing.T) {
+	a := assert.New(t)
+	f, err := NewClientIDFilter(nil, "")
+	a.Nil(err)
+	a.Nil(f)
+
+	f, err = NewClientIDFilter([]string{"backend-a"}, "^backend-[0-9]+$")
+	a.Nil(err)
+	a.True(f("backend-a"))
+	a.True(f("backend-1"))
+	a.False(f("backend-b"))
+	a.False(f("device-1"))
+	a.False(f(""))
+
+	_, err = NewClientIDFilter(nil, "[")
+	a.NotNil(err)
+}
+
+func TestNewClientIDFilterListener(t *testing.T) {
+	a := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer l.Close()
+	a.Equal(l, NewClientIDFilterListener(l, nil))
+
+	filter := func(clientID string) bool { return true }
+	s := newTCPListenerState(NewClientIDFilterListener(l, filter))
+	a.NotNil(s.clientIDFilter)
+	a.Equal(ListenerTypeTCP, s.typ)
+
+	s = newTCPListenerState(NewClientIDFilterListener(tls.NewListener(l, &tls.Config{}), filter))
+	a.Equal(ListenerTypeTLS, s.typ)
+	a.True(s.tls)
+}
+
+func TestClient_connectHandler_clientIDFilter(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.clientIDFilter, err = NewClientIDFilter([]string{"backend"}, "")
+	a.Nil(err)
+
+	var tt = []struct {
+		version  packets.Version
+		clientID string
+		code     codes.Code
+	}{
+		{version: packets.Version5, clientID: "backend", code: codes.Success},
+		{version: packets.Version5, clientID: "device", code: codes.ClientIdentifierNotValid},
+		{version: packets.Version311, clientID: "backend", code: codes.Success},
+		{version: packets.Version311, clientID: "device", code: codes.V3IdentifierRejected},
+	}
+	for _, v := range tt {
+		conn := &packets.Connect{
+			Version:  v.version,
+			ClientID: []byte(v.clientID),
+		}
+		if v.version == packets.Version5 {
+			conn.Properties = &packets.Properties{}
+		}
+		_, _, err = c.connectHandler(conn)
+		if v.code == codes.Success {
+			a.Nil(err)
+			continue
+		}
+		a.Equal(v.code, converError(err).Code)
+	}
+}
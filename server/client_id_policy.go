@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// clientIDRule is the compiled config.ClientIDPolicy.
+type clientIDRule struct {
+	// pattern is nil if all client ids are allowed.
+	pattern        *regexp.Regexp
+	assignedFormat string
+}
+
+func newClientIDRule(c config.ClientIDPolicy) (*clientIDRule, error) {
+	r := &clientIDRule{
+		assignedFormat: c.AssignedFormat,
+	}
+	if c.Pattern != "" {
+		var err error
+		// the client id must match the pattern entirely.
+		r.pattern, err = regexp.Compile("^(?:" + c.Pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// clientIDPolicy is the default client id policy, see config.ClientIDPolicy.
+func (srv *server) clientIDPolicy(ctx context.Context, client Client, connect *packets.Connect) (assignedID string, err error) {
+	srv.configMu.RLock()
+	r := srv.clientIDRule
+	srv.configMu.RUnlock()
+	if r == nil {
+		return "", nil
+	}
+	if len(connect.ClientID) != 0 {
+		if r.pattern != nil && !r.pattern.Match(connect.ClientID) {
+			return "", &codes.Error{
+				Code: clientIDNotValidCode(client.Version()),
+				ErrorDetails: codes.ErrorDetails{
+					ReasonString: []byte("client id does not match the client id policy"),
+				},
+			}
+		}
+		return "", nil
+	}
+	if r.assignedFormat == "" {
+		return "", nil
+	}
+	return strings.NewReplacer(
+		"{uuid}", getRandomUUID(),
+		"{username}", string(connect.Username),
+		"{listener}", client.ClientOptions().Listener,
+	).Replace(r.assignedFormat), nil
+}
+
+func clientIDNotValidCode(version packets.Version) codes.Code {
+	if packets.IsVersion3X(version) {
+		return codes.V3IdentifierRejected
+	}
+	return codes.ClientIdentifierNotValid
+}
+
+// checkClientID runs the OnClientID hook, or the default policy if the hook is not set.
+// It returns the client id to assign if the client id of the CONNECT packet is empty.
+func (client *client) checkClientID(conn *packets.Connect) (assignedID string, err error) {
+	srv := client.server
+	if srv == nil {
+		return "", nil
+	}
+	hook := srv.hooks.OnClientID
+	if hook == nil {
+		hook = srv.clientIDPolicy
+	}
+	assignedID, err = hook(context.Background(), client, conn)
+	if err != nil {
+		if codeErr, ok := err.(*codes.Error); ok {
+			return "", codeErr
+		}
+		return "", client.rejectConnect(clientIDNotValidCode(client.version), err.Error())
+	}
+	return assignedID, nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestClient_connectWithTimeOut_clientIDPolicy(t *testing.T) {
+	uuid := "[0-9a-v]{20,}"
+	var tt = []struct {
+		name     string
+		version  packets.Version
+		clientID string
+		hook     OnClientID
+		code     codes.Code
+		// expected is the pattern of the client id.
+		expected string
+		// assigned indicates whether the Assigned Client Identifier property is expected.
+		assigned bool
+	}{
+		{name: "v5_assigned", version: packets.Version5, code: codes.Success, expected: "alice-" + uuid, assigned: true},
+		{name: "v5_matched", version: packets.Version5, clientID: "tenant-a-1", code: codes.Success, expected: "tenant-a-1"},
+		{name: "v5_malformed", version: packets.Version5, clientID: "tenant-A-1", code: codes.ClientIdentifierNotValid},
+		{name: "v3_malformed", version: packets.Version311, clientID: "device", code: codes.V3IdentifierRejected},
+		// the v3.1.1 client can connect with empty client id if clean session is set, but it is not informed of the assigned one.
+		{name: "v3_assigned", version: packets.Version311, code: codes.Success, expected: "alice-" + uuid},
+		{
+			name:     "hook",
+			version:  packets.Version5,
+			clientID: "tenant-a-1",
+			hook: func(ctx context.Context, client Client, connect *packets.Connect) (assignedID string, err error) {
+				return "", errors.New("unknown tenant")
+			},
+			code: codes.ClientIdentifierNotValid,
+		},
+		{
+			name:    "hook_assigned",
+			version: packets.Version5,
+			hook: func(ctx context.Context, client Client, connect *packets.Connect) (assignedID string, err error) {
+				return "assigned", nil
+			},
+			code:     codes.Success,
+			expected: "assigned",
+			assigned: true,
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			var err error
+			srv.clientIDRule, err = newClientIDRule(config.ClientIDPolicy{
+				Pattern:        "tenant-[a-z]+-[0-9]+",
+				AssignedFormat: "{username}-{uuid}",
+			})
+			a.Nil(err)
+			srv.hooks.OnClientID = v.hook
+			c, _ := srv.newClient(noopConn{})
+			connect := &packets.Connect{
+				Version:    v.version,
+				CleanStart: true,
+				ClientID:   []byte(v.clientID),
+				Username:   []byte("alice"),
+			}
+			if v.version == packets.Version5 {
+				connect.Properties = &packets.Properties{}
+			}
+			c.in <- connect
+			c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				return false, nil
+			}
+			c.server.hooks.OnBasicAuth = func(ctx context.Context, client Client, req *ConnectRequest) (err error) {
+				return nil
+			}
+			a.Equal(v.code == codes.Success, c.connectWithTimeOut())
+			connack := (<-c.out).(*packets.Connack)
+			a.Equal(v.code, connack.Code)
+			if v.code != codes.Success {
+				return
+			}
+			a.Regexp(regexp.MustCompile("^"+v.expected+"$"), c.ClientOptions().ClientID)
+			if v.assigned {
+				a.Equal(c.ClientOptions().ClientID, string(connack.Properties.AssignedClientID))
+			} else if connack.Properties != nil {
+				a.Nil(connack.Properties.AssignedClientID)
+			}
+		})
+	}
+}
+
+func TestNewClientIDRule(t *testing.T) {
+	a := assert.New(t)
+	_, err := newClientIDRule(config.ClientIDPolicy{Pattern: "a("})
+	a.Error(err)
+
+	r, err := newClientIDRule(config.ClientIDPolicy{Pattern: "a|b"})
+	a.Nil(err)
+	// the pattern must match the client id entirely.
+	a.True(r.pattern.MatchString("a"))
+	a.True(r.pattern.MatchString("b"))
+	a.False(r.pattern.MatchString("ab"))
+}
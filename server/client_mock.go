@@ -129,3 +129,17 @@ func (mr *MockClientMockRecorder) Disconnect(disconnect interface{}) *gomock.Cal
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Disconnect", reflect.TypeOf((*MockClient)(nil).Disconnect), disconnect)
 }
+
+// ConnID mocks base method
+func (m *MockClient) ConnID() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConnID")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// ConnID indicates an expected call of ConnID
+func (mr *MockClientMockRecorder) ConnID() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConnID", reflect.TypeOf((*MockClient)(nil).ConnID))
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -23,6 +24,7 @@ import (
 	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
 	"github.com/DrmagicE/gmqtt/persistence/unack"
 	unack_mem "github.com/DrmagicE/gmqtt/persistence/unack/mem"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
 	"github.com/DrmagicE/gmqtt/pkg/codes"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/retained"
@@ -221,15 +223,19 @@ func TestClient_subscribeHandler_common(t *testing.T) {
 			retainedDB := retained.NewMockStore(ctrl)
 
 			srv := &server{
-				config:          config.DefaultConfig(),
 				subscriptionsDB: subDB,
 				retainedDB:      retainedDB,
+				clock:           clock.New(),
 			}
+			srv.storeConfig(config.DefaultConfig())
 			c, er := srv.newClient(noopConn{})
 			a.Nil(er)
 			c.opts.ClientID = v.clientID
 			c.opts.SubIDAvailable = true
 			c.version = v.version
+			// all the topic filters are subscribed in one batch.
+			var subs []interface{}
+			var subRs subscription.SubscribeResult
 			for _, topic := range v.in.Topics {
 
 				sub := &gmqtt.Subscription{
@@ -242,15 +248,15 @@ func TestClient_subscribeHandler_common(t *testing.T) {
 				if v.in.Properties != nil && len(v.in.Properties.SubscriptionIdentifier) != 0 {
 					sub.ID = v.in.Properties.SubscriptionIdentifier[0]
 				}
-				subDB.EXPECT().Subscribe(v.clientID, sub).Return(subscription.SubscribeResult{
-					{
-						Subscription:   sub,
-						AlreadyExisted: false,
-					},
-				}, nil)
+				subs = append(subs, sub)
+				subRs = append(subRs, struct {
+					Subscription   *gmqtt.Subscription
+					AlreadyExisted bool
+				}{Subscription: sub})
 				// We are not going to test retained logic in this test case.
 				retainedDB.EXPECT().GetMatchedMessages(sub.TopicFilter).Return(nil)
 			}
+			subDB.EXPECT().Subscribe(v.clientID, subs...).Return(subRs, nil)
 
 			err := c.subscribeHandler(v.in)
 			a.Equal(v.err, err)
@@ -270,6 +276,311 @@ func TestClient_subscribeHandler_common(t *testing.T) {
 
 }
 
+func TestClient_subscribeHandler_duplicatedFilter(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	subDB := subscription.NewMockStore(ctrl)
+	retainedDB := retained.NewMockStore(ctrl)
+	srv := &server{
+		subscriptionsDB: subDB,
+		retainedDB:      retainedDB,
+		clock:           clock.New(),
+	}
+	srv.storeConfig(config.DefaultConfig())
+	c, er := srv.newClient(noopConn{})
+	a.Nil(er)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+
+	in := &packets.Subscribe{
+		Version:  packets.Version5,
+		PacketID: 1,
+		Topics: []packets.Topic{
+			{
+				SubOptions: packets.SubOptions{
+					Qos: 2,
+				},
+				Name: "/topic/A",
+			}, {
+				SubOptions: packets.SubOptions{
+					Qos: 1,
+				},
+				Name: "/topic/B",
+			}, {
+				SubOptions: packets.SubOptions{
+					Qos:     1,
+					NoLocal: true,
+				},
+				Name: "/topic/A",
+			},
+		},
+		Properties: &packets.Properties{},
+	}
+	// the last occurrence wins, and subscribe only once for each topic filter.
+	subB := &gmqtt.Subscription{
+		TopicFilter: "/topic/B",
+		QoS:         1,
+	}
+	subA := &gmqtt.Subscription{
+		TopicFilter: "/topic/A",
+		QoS:         1,
+		NoLocal:     true,
+	}
+	subDB.EXPECT().Subscribe("cid", subB, subA).Return(subscription.SubscribeResult{
+		{Subscription: subB},
+		{Subscription: subA},
+	}, nil)
+	retainedDB.EXPECT().GetMatchedMessages(subB.TopicFilter).Return(nil)
+	retainedDB.EXPECT().GetMatchedMessages(subA.TopicFilter).Return(nil)
+
+	a.Nil(c.subscribeHandler(in))
+	select {
+	case p := <-c.out:
+		suback := p.(*packets.Suback)
+		a.Equal(in.PacketID, suback.PacketID)
+		a.Equal([]codes.Code{codes.GrantedQoS1, codes.GrantedQoS1, codes.GrantedQoS1}, suback.Payload)
+	default:
+		t.Fatal("missing output")
+	}
+}
+
+func TestClient_subscribeHandler_duplicatedFilter_onSubscribed(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		retainedDB := retained.NewMockStore(ctrl)
+		retainedDB.EXPECT().GetMatchedMessages(gomock.Any()).Return(nil).AnyTimes()
+		srv := &server{
+			subscriptionsDB: mem.NewStore(),
+			retainedDB:      retainedDB,
+			clock:           clock.New(),
+		}
+		srv.storeConfig(config.DefaultConfig())
+		var subscribed []*gmqtt.Subscription
+		srv.hooks.OnSubscribed = func(ctx context.Context, client Client, subscription *gmqtt.Subscription) {
+			subscribed = append(subscribed, subscription)
+		}
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = "cid"
+		c.version = version
+		a.Nil(c.subscribeHandler(&packets.Subscribe{
+			Version:  version,
+			PacketID: 1,
+			Topics: []packets.Topic{
+				{SubOptions: packets.SubOptions{Qos: 0}, Name: "a"},
+				{SubOptions: packets.SubOptions{Qos: 1}, Name: "b"},
+				{SubOptions: packets.SubOptions{Qos: 2}, Name: "a"},
+			},
+			Properties: &packets.Properties{},
+		}))
+		suback := (<-c.out).(*packets.Suback)
+		a.Equal([]codes.Code{codes.GrantedQoS2, codes.GrantedQoS1, codes.GrantedQoS2}, suback.Payload)
+		// OnSubscribed is called once for each topic filter, so that the admin store has no duplicated rows.
+		if a.Len(subscribed, 2) {
+			a.Equal("b", subscribed[0].TopicFilter)
+			a.Equal("a", subscribed[1].TopicFilter)
+			a.EqualValues(packets.Qos2, subscribed[1].QoS)
+		}
+		stats, err := srv.subscriptionsDB.GetClientStats("cid")
+		a.Nil(err)
+		a.EqualValues(2, stats.SubscriptionsCurrent)
+	}
+}
+
+func TestClient_subscribeHandler_maxSubscriptions(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		subDB := mem.NewStore()
+		retainedDB := retained.NewMockStore(ctrl)
+		retainedDB.EXPECT().GetMatchedMessages(gomock.Any()).Return(nil).AnyTimes()
+		srv := &server{
+			subscriptionsDB: subDB,
+			retainedDB:      retainedDB,
+			clock:           clock.New(),
+		}
+		srv.storeConfig(config.DefaultConfig())
+		srv.config().MQTT.MaxSubscriptionsPerClient = 3
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = "cid"
+		c.version = version
+		_, err := subDB.Subscribe("cid", &gmqtt.Subscription{TopicFilter: "a"}, &gmqtt.Subscription{TopicFilter: "b"})
+		a.Nil(err)
+
+		var topics []packets.Topic
+		for _, v := range []string{"b", "c", "d", "e"} {
+			topics = append(topics, packets.Topic{SubOptions: packets.SubOptions{Qos: 1}, Name: v})
+		}
+		a.Nil(c.subscribeHandler(&packets.Subscribe{
+			Version:    version,
+			PacketID:   1,
+			Topics:     topics,
+			Properties: &packets.Properties{},
+		}))
+		failure := codes.QuotaExceeded
+		if packets.IsVersion3X(version) {
+			failure = packets.SubscribeFailure
+		}
+		// replacing "b" is not limited, "c" reaches the limit, "d" and "e" exceed it.
+		suback := (<-c.out).(*packets.Suback)
+		a.Equal([]codes.Code{codes.GrantedQoS1, codes.GrantedQoS1, failure, failure}, suback.Payload)
+		stats, err := subDB.GetClientStats("cid")
+		a.Nil(err)
+		a.EqualValues(3, stats.SubscriptionsCurrent)
+
+		// the existing subscription can still be updated after the limit is reached.
+		a.Nil(c.subscribeHandler(&packets.Subscribe{
+			Version:    version,
+			PacketID:   2,
+			Topics:     []packets.Topic{{SubOptions: packets.SubOptions{Qos: 2}, Name: "a"}, {Name: "f"}},
+			Properties: &packets.Properties{},
+		}))
+		suback = (<-c.out).(*packets.Suback)
+		a.Equal([]codes.Code{codes.GrantedQoS2, failure}, suback.Payload)
+	}
+}
+
+func TestClient_subscribeHandler_maxTotalSubscriptions(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	subDB := mem.NewStore()
+	retainedDB := retained.NewMockStore(ctrl)
+	retainedDB.EXPECT().GetMatchedMessages(gomock.Any()).Return(nil).AnyTimes()
+	srv := &server{
+		subscriptionsDB: subDB,
+		retainedDB:      retainedDB,
+		statsManager:    newStatsManager(subDB),
+		clock:           clock.New(),
+	}
+	srv.storeConfig(config.DefaultConfig())
+	srv.config().MQTT.MaxTotalSubscriptions = 3
+	_, err := subDB.Subscribe("other", &gmqtt.Subscription{TopicFilter: "a"})
+	a.Nil(err)
+	newClient := func(clientID string, version packets.Version) *client {
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = clientID
+		c.version = version
+		return c
+	}
+	subscribe := func(c *client, qos uint8, topics ...string) []codes.Code {
+		var ts []packets.Topic
+		for _, v := range topics {
+			ts = append(ts, packets.Topic{SubOptions: packets.SubOptions{Qos: qos}, Name: v})
+		}
+		a.Nil(c.subscribeHandler(&packets.Subscribe{
+			Version:    c.version,
+			PacketID:   1,
+			Topics:     ts,
+			Properties: &packets.Properties{},
+		}))
+		return (<-c.out).(*packets.Suback).Payload
+	}
+	c1 := newClient("c1", packets.Version5)
+	c2 := newClient("c2", packets.Version311)
+	// the limit is shared by all clients.
+	a.Equal([]codes.Code{codes.GrantedQoS1}, subscribe(c1, 1, "b"))
+	a.Equal([]codes.Code{codes.GrantedQoS1, packets.SubscribeFailure}, subscribe(c2, 1, "c", "d"))
+	a.Equal([]codes.Code{codes.QuotaExceeded}, subscribe(c1, 1, "d"))
+	a.EqualValues(3, subDB.GetStats().SubscriptionsCurrent)
+	a.EqualValues(2, srv.statsManager.GetGlobalStats().ConnectionStats.SubscriptionsRejectedTotal)
+
+	// the existing subscription can still be updated after the limit is reached.
+	a.Equal([]codes.Code{codes.GrantedQoS2}, subscribe(c1, 2, "b"))
+
+	// there is room again after unsubscribing.
+	a.Nil(subDB.Unsubscribe("other", "a"))
+	a.Equal([]codes.Code{codes.GrantedQoS1, codes.QuotaExceeded}, subscribe(c1, 1, "d", "e"))
+	a.EqualValues(3, srv.statsManager.GetGlobalStats().ConnectionStats.SubscriptionsRejectedTotal)
+}
+
+func TestClient_subscribeHandler_maxSubscriptionQoS(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		subDB := mem.NewStore()
+		retainedDB := retained.NewMockStore(ctrl)
+		retainedDB.EXPECT().GetMatchedMessages(gomock.Any()).Return(nil).AnyTimes()
+		srv := &server{
+			subscriptionsDB: subDB,
+			retainedDB:      retainedDB,
+			clock:           clock.New(),
+		}
+		srv.storeConfig(config.DefaultConfig())
+		srv.config().MQTT.MaxSubscriptionQoS = packets.Qos1
+		subscribed := make(map[string]uint8)
+		srv.hooks.OnSubscribe = func(ctx context.Context, client Client, req *SubscribeRequest) error {
+			// the hooks can not grant more than the configured maximum.
+			req.GrantQoS("b", packets.Qos2)
+			return nil
+		}
+		srv.hooks.OnSubscribed = func(ctx context.Context, client Client, subscription *gmqtt.Subscription) {
+			subscribed[subscription.TopicFilter] = subscription.QoS
+		}
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = "cid"
+		c.version = version
+
+		a.Nil(c.subscribeHandler(&packets.Subscribe{
+			Version:  version,
+			PacketID: 1,
+			Topics: []packets.Topic{
+				{SubOptions: packets.SubOptions{Qos: packets.Qos2}, Name: "a"},
+				{SubOptions: packets.SubOptions{Qos: packets.Qos0}, Name: "b"},
+				{SubOptions: packets.SubOptions{Qos: packets.Qos0}, Name: "c"},
+			},
+			Properties: &packets.Properties{},
+		}))
+		suback := (<-c.out).(*packets.Suback)
+		a.Equal([]codes.Code{codes.GrantedQoS1, codes.GrantedQoS1, codes.GrantedQoS0}, suback.Payload)
+		a.Equal(map[string]uint8{"a": packets.Qos1, "b": packets.Qos1, "c": packets.Qos0}, subscribed)
+		// the granted QoS is stored.
+		stored := make(map[string]uint8)
+		subDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+			stored[sub.TopicFilter] = sub.QoS
+			return true
+		}, subscription.IterationOptions{Type: subscription.TypeAll, ClientID: "cid"})
+		a.Equal(subscribed, stored)
+	}
+}
+
+func TestClient_subscribeHandler_maximumQoS(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.opts.MaximumQoS = packets.Qos0
+	c.version = packets.Version5
+	// the SUBSCRIBE requesting a higher QoS is still accepted with the maximum QoS.
+	a.Nil(c.subscribeHandler(&packets.Subscribe{
+		Version:  packets.Version5,
+		PacketID: 1,
+		Topics: []packets.Topic{
+			{SubOptions: packets.SubOptions{Qos: packets.Qos2}, Name: "a"},
+			{SubOptions: packets.SubOptions{Qos: packets.Qos1}, Name: "b"},
+		},
+		Properties: &packets.Properties{},
+	}))
+	suback := (<-c.out).(*packets.Suback)
+	a.Equal([]codes.Code{codes.GrantedQoS0, codes.GrantedQoS0}, suback.Payload)
+}
+
 func TestClient_subscribeHandler_shareSubscription(t *testing.T) {
 	var tt = []struct {
 		name               string
@@ -366,15 +677,18 @@ func TestClient_subscribeHandler_shareSubscription(t *testing.T) {
 			subDB := subscription.NewMockStore(ctrl)
 			retainedDB := retained.NewMockStore(ctrl)
 			srv := &server{
-				config:          config.DefaultConfig(),
 				subscriptionsDB: subDB,
 				retainedDB:      retainedDB,
+				clock:           clock.New(),
 			}
+			srv.storeConfig(config.DefaultConfig())
 			c, er := srv.newClient(noopConn{})
 			a.Nil(er)
 			c.opts.ClientID = v.clientID
 			c.opts.SharedSubAvailable = v.sharedSubAvailable
 			c.version = v.version
+			var subs []interface{}
+			var subRs subscription.SubscribeResult
 			for _, topic := range v.in.Topics {
 				var shareName, topicFilter string
 
@@ -394,14 +708,14 @@ func TestClient_subscribeHandler_shareSubscription(t *testing.T) {
 					sub.ID = v.in.Properties.SubscriptionIdentifier[0]
 				}
 
-				if v.sharedSubAvailable {
-					subDB.EXPECT().Subscribe(v.clientID, sub).Return(subscription.SubscribeResult{
-						{
-							Subscription:   sub,
-							AlreadyExisted: false,
-						},
-					}, nil)
-				}
+				subs = append(subs, sub)
+				subRs = append(subRs, struct {
+					Subscription   *gmqtt.Subscription
+					AlreadyExisted bool
+				}{Subscription: sub})
+			}
+			if v.sharedSubAvailable {
+				subDB.EXPECT().Subscribe(v.clientID, subs...).Return(subRs, nil)
 			}
 
 			err := c.subscribeHandler(v.in)
@@ -514,6 +828,47 @@ func TestClient_subscribeHandler_retainedMessage(t *testing.T) {
 			},
 			alreadyExisted: true,
 		},
+		{
+			name:     "retain_handling_1_new",
+			clientID: "cid",
+			version:  packets.Version5,
+			in: &packets.Subscribe{
+				Version:  packets.Version5,
+				PacketID: 1,
+				Topics: []packets.Topic{
+					{
+						SubOptions: packets.SubOptions{
+							Qos:               1,
+							RetainHandling:    1,
+							NoLocal:           false,
+							RetainAsPublished: false,
+						},
+						Name: "/topic/A",
+					},
+				},
+				Properties: &packets.Properties{},
+			},
+			err: nil,
+			out: &packets.Suback{
+				PacketID: 1,
+				Version:  packets.Version5,
+				Payload: []codes.Code{
+					codes.GrantedQoS1,
+				},
+			},
+			retainedMsg: &gmqtt.Message{
+				Retained: true,
+				QoS:      1,
+				Topic:    "/topic/a",
+				Payload:  []byte("b"),
+			},
+			expected: struct {
+				qos      uint8
+				retained bool
+			}{qos: 1, retained: false},
+			alreadyExisted:     false,
+			shouldSendRetained: true,
+		},
 		{
 			// If Retain Handling is set to 2, the Server MUST NOT send the retained messages [MQTT-3.3.1-11].
 			name:     "retain_handling_2",
@@ -715,10 +1070,11 @@ func TestClient_subscribeHandler_retainedMessage(t *testing.T) {
 			retainedDB := retained.NewMockStore(ctrl)
 			qs := queue.NewMockStore(ctrl)
 			srv := &server{
-				config:          config.DefaultConfig(),
 				subscriptionsDB: subDB,
 				retainedDB:      retainedDB,
+				clock:           clock.New(),
 			}
+			srv.storeConfig(config.DefaultConfig())
 			c, er := srv.newClient(noopConn{})
 			a.Nil(er)
 			c.opts.ClientID = v.clientID
@@ -848,20 +1204,21 @@ func TestClient_publishHandler_common(t *testing.T) {
 			retainedDB := retained.NewMockStore(ctrl)
 			subscriptionDB := subscription.NewMockStore(ctrl)
 			srv := &server{
-				config:          config.DefaultConfig(),
 				retainedDB:      retainedDB,
 				subscriptionsDB: subscriptionDB,
+				clock:           clock.New(),
 			}
+			srv.storeConfig(config.DefaultConfig())
 
 			var deliverMessageCalled bool
 
 			c, er := srv.newClient(noopConn{})
 			a.NoError(er)
-			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched bool) {
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
 				a.Equal(v.clientID, srcClientID)
 				a.Equal(gmqtt.MessageFromPublish(v.in), msg)
 				deliverMessageCalled = true
-				return v.topicMatched
+				return v.topicMatched, false
 			}
 
 			c.unackStore = unack_mem.New(unack_mem.Options{
@@ -973,16 +1330,17 @@ func TestClient_publishHandler_retainedMessage(t *testing.T) {
 
 			retainedDB := retained.NewMockStore(ctrl)
 			srv := &server{
-				config:     config.DefaultConfig(),
 				retainedDB: retainedDB,
+				clock:      clock.New(),
 			}
+			srv.storeConfig(config.DefaultConfig())
 
 			c, er := srv.newClient(noopConn{})
 			a.NoError(er)
-			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched bool) {
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
 				a.Equal(v.clientID, srcClientID)
 				a.Equal(gmqtt.MessageFromPublish(v.in), msg)
-				return v.topicMatched
+				return v.topicMatched, false
 			}
 
 			c.unackStore = unack_mem.New(unack_mem.Options{
@@ -1026,6 +1384,93 @@ func TestClient_publishHandler_retainedMessage(t *testing.T) {
 
 }
 
+func TestClient_publishHandler_unsupported(t *testing.T) {
+	var tt = []struct {
+		name     string
+		version  packets.Version
+		policy   string
+		qos      uint8
+		retain   bool
+		err      *codes.Error
+		expected *gmqtt.Message
+	}{
+		{name: "v5_qos", version: packets.Version5, qos: packets.Qos2, err: codes.NewError(codes.QoSNotSupported)},
+		{name: "v5_retain", version: packets.Version5, qos: packets.Qos1, retain: true, err: codes.NewError(codes.RetainNotSupported)},
+		// the v5 clients are not affected by the policy.
+		{name: "v5_downgrade", version: packets.Version5, policy: config.V3UnsupportedDowngrade, qos: packets.Qos2, err: codes.NewError(codes.QoSNotSupported)},
+		{name: "v3_qos", version: packets.Version311, policy: config.V3UnsupportedDisconnect, qos: packets.Qos2, err: codes.NewError(codes.QoSNotSupported)},
+		{name: "v3_retain", version: packets.Version311, retain: true, err: codes.NewError(codes.RetainNotSupported)},
+		{
+			name:     "v3_downgrade_qos",
+			version:  packets.Version311,
+			policy:   config.V3UnsupportedDowngrade,
+			qos:      packets.Qos2,
+			expected: &gmqtt.Message{QoS: packets.Qos1, Topic: "topic", Payload: []byte("payload")},
+		},
+		{
+			name:     "v3_downgrade_retain",
+			version:  packets.Version311,
+			policy:   config.V3UnsupportedDowngrade,
+			qos:      packets.Qos1,
+			retain:   true,
+			expected: &gmqtt.Message{QoS: packets.Qos1, Topic: "topic", Payload: []byte("payload")},
+		},
+		{
+			name:     "supported",
+			version:  packets.Version5,
+			qos:      packets.Qos1,
+			expected: &gmqtt.Message{QoS: packets.Qos1, Topic: "topic", Payload: []byte("payload")},
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.V3UnsupportedPolicy = v.policy
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			c.opts.MaximumQoS = packets.Qos1
+			c.opts.RetainAvailable = false
+			c.version = v.version
+			c.unackStore = unack_mem.New(unack_mem.Options{
+				ClientID: "cid",
+			})
+			var delivered *gmqtt.Message
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				delivered = msg
+				return true, false
+			}
+			pub := &packets.Publish{
+				Version:   v.version,
+				Qos:       v.qos,
+				Retain:    v.retain,
+				PacketID:  1,
+				TopicName: []byte("topic"),
+				Payload:   []byte("payload"),
+			}
+			if v.version == packets.Version5 {
+				pub.Properties = &packets.Properties{}
+			}
+			a.Equal(v.err, c.publishHandler(pub))
+			if v.err != nil {
+				a.Nil(delivered)
+				return
+			}
+			a.Equal(v.expected, delivered)
+			// the downgraded message is acknowledged with the QoS of the PUBLISH packet.
+			switch ack := (<-c.out).(type) {
+			case *packets.Puback:
+				a.Equal(packets.Qos1, v.qos)
+				a.Equal(codes.Success, ack.Code)
+			case *packets.Pubrec:
+				a.Equal(packets.Qos2, v.qos)
+				a.Equal(codes.Success, ack.Code)
+			}
+		})
+	}
+}
+
 func TestClient_publishHandler_topicAlias(t *testing.T) {
 	var tt = []struct {
 		name          string
@@ -1074,6 +1519,53 @@ func TestClient_publishHandler_topicAlias(t *testing.T) {
 			topicAliasMax: 2,
 			err:           codes.NewError(codes.TopicAliasInvalid),
 		},
+		{
+			name:     "invalidZero",
+			clientID: "cid",
+			version:  packets.Version5,
+			in: &packets.Publish{
+				Version:   packets.Version5,
+				Qos:       0,
+				TopicName: []byte("/topic/A"),
+				Payload:   []byte("b"),
+				Properties: &packets.Properties{
+					TopicAlias: uint16P(0),
+				},
+			},
+			topicAliasMax: 2,
+			err:           codes.NewError(codes.TopicAliasInvalid),
+		},
+		{
+			name:     "invalidDisabled",
+			clientID: "cid",
+			version:  packets.Version5,
+			in: &packets.Publish{
+				Version:   packets.Version5,
+				Qos:       0,
+				TopicName: []byte("/topic/A"),
+				Payload:   []byte("b"),
+				Properties: &packets.Properties{
+					TopicAlias: uint16P(1),
+				},
+			},
+			topicAliasMax: 0,
+			err:           codes.NewError(codes.TopicAliasInvalid),
+		},
+		{
+			name:     "max",
+			clientID: "cid",
+			version:  packets.Version5,
+			in: &packets.Publish{
+				Version:   packets.Version5,
+				Qos:       0,
+				TopicName: []byte("/topic/A"),
+				Payload:   []byte("b"),
+				Properties: &packets.Properties{
+					TopicAlias: uint16P(2),
+				},
+			},
+			topicAliasMax: 2,
+		},
 	}
 	for _, v := range tt {
 		t.Run(v.name, func(t *testing.T) {
@@ -1082,23 +1574,29 @@ func TestClient_publishHandler_topicAlias(t *testing.T) {
 			defer ctrl.Finish()
 
 			srv := &server{
-				config: config.DefaultConfig(),
+				clock: clock.New(),
 			}
+			srv.storeConfig(config.DefaultConfig())
 
 			c, er := srv.newClient(noopConn{})
 			a.NoError(er)
-			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched bool) {
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
 				a.Equal(v.clientID, srcClientID)
 				a.Equal(gmqtt.MessageFromPublish(v.in), msg)
-				return true
+				return true, false
 			}
 
 			c.opts.ClientID = v.clientID
 			c.version = v.version
 			c.opts.ServerTopicAliasMax = v.topicAliasMax
+			c.aliasMapper = make([][]byte, v.topicAliasMax+1)
 
 			err := c.publishHandler(v.in)
-			a.Equal(v.err, err)
+			if v.err == nil {
+				a.Nil(err)
+			} else {
+				a.Equal(v.err, err)
+			}
 
 			select {
 			case p := <-c.out:
@@ -1145,17 +1643,18 @@ func TestClient_publishHandler_matchTopicAlias(t *testing.T) {
 	defer ctrl.Finish()
 
 	srv := &server{
-		config: config.DefaultConfig(),
+		clock: clock.New(),
 	}
+	srv.storeConfig(config.DefaultConfig())
 	var deliveredMsg []*gmqtt.Message
 
 	serverTopicAliasMax := uint16(5)
 	c, er := srv.newClient(noopConn{})
 	a.NoError(er)
-	c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched bool) {
+	c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
 		a.Equal("cid", srcClientID)
 		deliveredMsg = append(deliveredMsg, msg)
-		return true
+		return true, false
 	}
 	c.aliasMapper = make([][]byte, serverTopicAliasMax+1)
 	c.opts.ClientID = "cid"
@@ -1296,52 +1795,234 @@ func TestClient_pubcompHandler(t *testing.T) {
 	c.pubcompHandler(pubcomp)
 }
 
-func TestClient_pingreqHandler(t *testing.T) {
+func TestClient_pubrelHandler_unknownPacketID(t *testing.T) {
 	a := assert.New(t)
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
-	srv := defaultServer()
-	c, er := srv.newClient(noopConn{})
-	a.Nil(er)
-	c.opts.ClientID = "cid"
-	c.version = packets.Version5
-	pingreq := &packets.Pingreq{}
-	c.pingreqHandler(pingreq)
-	select {
-	case p := <-c.out:
-		a.IsType(&packets.Pingresp{}, p)
-	default:
-		t.Fatal("missing output")
+	for _, v := range []struct {
+		version packets.Version
+		policy  string
+	}{
+		{version: packets.Version311, policy: ""},
+		{version: packets.Version311, policy: config.UnknownPubrelComplete},
+		{version: packets.Version311, policy: config.UnknownPubrelDisconnect},
+		{version: packets.Version5, policy: ""},
+		{version: packets.Version5, policy: config.UnknownPubrelComplete},
+		{version: packets.Version5, policy: config.UnknownPubrelDisconnect},
+	} {
+		srv := defaultServer()
+		srv.config().MQTT.UnknownPubrelPolicy = v.policy
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = "cid"
+		c.version = v.version
+		c.unackStore = unack_mem.New(unack_mem.Options{ClientID: c.opts.ClientID})
+
+		// known packet id
+		_, err := c.unackStore.Set(1)
+		a.Nil(err)
+		a.Nil(c.pubrelHandler(&packets.Pubrel{PacketID: 1}))
+		p := (<-c.out).(*packets.Pubcomp)
+		a.EqualValues(1, p.PacketID)
+		a.Equal(codes.Success, p.Code)
+
+		// the QoS 2 state has been released, the id is unknown now.
+		codeErr := c.pubrelHandler(&packets.Pubrel{PacketID: 1})
+		if v.policy == config.UnknownPubrelDisconnect {
+			a.NotNil(codeErr)
+			a.Equal(codes.ProtocolError, codeErr.Code)
+			a.Len(c.out, 0)
+			continue
+		}
+		a.Nil(codeErr)
+		p = (<-c.out).(*packets.Pubcomp)
+		a.EqualValues(1, p.PacketID)
+		b := &bytes.Buffer{}
+		a.Nil(p.Pack(b))
+		if v.version == packets.Version5 {
+			a.Equal(codes.PacketIDNotFound, p.Code)
+			a.Equal([]byte{0x70, 0x04, 0x00, 0x01, codes.PacketIDNotFound, 0x00}, b.Bytes())
+		} else {
+			a.Equal([]byte{0x70, 0x02, 0x00, 0x01}, b.Bytes())
+		}
 	}
 }
 
-func TestClient_unsubscribeHandler(t *testing.T) {
+func TestClient_ackHandler_unknownPacketID(t *testing.T) {
 	a := assert.New(t)
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
+	for _, version := range []packets.Version{packets.Version31, packets.Version311, packets.Version5} {
+		srv := defaultServer()
+		srv.statsManager = newStatsManager(mem.NewStore())
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = "cid"
+		c.version = version
+		c.opts.MaxInflight = 10
+		c.newPacketIDLimiter(c.opts.MaxInflight)
+		qs := queue.NewMockStore(ctrl)
+		c.queueStore = qs
 
-	subDB := subscription.NewMockStore(ctrl)
-	srv := defaultServer()
-	srv.subscriptionsDB = subDB
-	c, er := srv.newClient(noopConn{})
-	a.Nil(er)
-	c.opts.ClientID = "cid"
-	c.version = packets.Version5
+		qs.EXPECT().Remove(packets.PacketID(1)).Return(nil)
+		a.Nil(c.pubackHandler(&packets.Puback{Version: version, PacketID: 1}))
 
-	unsub := &packets.Unsubscribe{
-		Version:    packets.Version5,
-		PacketID:   1,
-		Topics:     []string{"/topic/A", "/topic/B"},
-		Properties: nil,
+		qs.EXPECT().Remove(packets.PacketID(2)).Return(nil)
+		c.pubcompHandler(&packets.Pubcomp{Version: version, PacketID: 2})
+		a.Len(c.out, 0)
+
+		qs.EXPECT().Replace(gomock.Any()).Return(false, nil)
+		c.pubrecHandler(&packets.Pubrec{Version: version, PacketID: 3})
+		p := (<-c.out).(*packets.Pubrel)
+		a.EqualValues(3, p.PacketID)
+		if version == packets.Version5 {
+			a.Equal(codes.PacketIDNotFound, p.Code)
+		} else {
+			a.Equal(codes.Success, p.Code)
+		}
+
+		// the unknown packet ids must not affect the inflight window.
+		a.Equal(uint16(0), c.pl.used)
+		a.Nil(c.err)
 	}
+}
 
-	for _, topic := range unsub.Topics {
-		subDB.EXPECT().Unsubscribe(c.opts.ClientID, topic)
+// windowQueue is a pacedQueue which assigns the packet ids to the read messages, as the queue implementations do.
+type windowQueue struct {
+	*pacedQueue
+}
+
+func (q *windowQueue) Read(pids []packets.PacketID) ([]*queue.Elem, error) {
+	elems, err := q.pacedQueue.Read(pids)
+	for i, v := range elems {
+		v.MessageWithID.SetID(pids[i])
 	}
+	return elems, err
+}
 
-	c.unsubscribeHandler(unsub)
-	select {
-	case p := <-c.out:
+func TestClient_pollMessageHandler_inflightWindow(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	const n = 5
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	// the negotiated Receive Maximum of the client.
+	c.opts.MaxInflight = 2
+	c.newPacketIDLimiter(c.opts.MaxInflight)
+	qs := queue.NewMockStore(ctrl)
+	q := &windowQueue{pacedQueue: &pacedQueue{Store: qs, close: c.close}}
+	for i := 0; i < n; i++ {
+		q.elems = append(q.elems, &queue.Elem{
+			At: time.Now(),
+			MessageWithID: &queue.Publish{Message: &gmqtt.Message{
+				Topic:   "topic",
+				QoS:     packets.Qos1,
+				Payload: []byte(strconv.Itoa(i)),
+			}},
+		})
+	}
+	c.queueStore = q
+
+	done := make(chan struct{})
+	go func() {
+		c.pollMessageHandler()
+		close(done)
+	}()
+	receive := func() *packets.Publish {
+		select {
+		case p := <-c.out:
+			return p.(*packets.Publish)
+		case <-time.After(time.Second):
+			t.Fatal("message not delivered")
+		}
+		return nil
+	}
+	assertPaused := func() {
+		select {
+		case p := <-c.out:
+			t.Fatalf("unexpected send when the inflight window is full: %v", p)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	var inflight []packets.PacketID
+	for i := 0; i < 2; i++ {
+		pub := receive()
+		a.Equal(strconv.Itoa(i), string(pub.Payload))
+		inflight = append(inflight, pub.PacketID)
+	}
+	assertPaused()
+	a.Equal(n-2, q.len())
+
+	for i := 2; i < n; i++ {
+		qs.EXPECT().Remove(inflight[0]).Return(nil)
+		a.Nil(c.pubackHandler(&packets.Puback{Version: c.version, PacketID: inflight[0]}))
+		inflight = inflight[1:]
+		pub := receive()
+		a.Equal(strconv.Itoa(i), string(pub.Payload))
+		inflight = append(inflight, pub.PacketID)
+		assertPaused()
+	}
+	a.Equal(0, q.len())
+	// the handler is blocked by the full inflight window.
+	c.setError(nil)
+	c.pl.close()
+	<-done
+}
+
+func TestClient_pingreqHandler(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	c, er := srv.newClient(noopConn{})
+	a.Nil(er)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	pingreq := &packets.Pingreq{}
+	c.pingreqHandler(pingreq)
+	select {
+	case p := <-c.out:
+		a.IsType(&packets.Pingresp{}, p)
+	default:
+		t.Fatal("missing output")
+	}
+}
+
+func TestClient_unsubscribeHandler(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	subDB := subscription.NewMockStore(ctrl)
+	srv := defaultServer()
+	srv.subscriptionsDB = subDB
+	c, er := srv.newClient(noopConn{})
+	a.Nil(er)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+
+	unsub := &packets.Unsubscribe{
+		Version:    packets.Version5,
+		PacketID:   1,
+		Topics:     []string{"/topic/A", "/topic/B"},
+		Properties: nil,
+	}
+
+	for _, topic := range unsub.Topics {
+		topicName := topic
+		subDB.EXPECT().Iterate(gomock.Any(), gomock.Any()).Do(func(fn subscription.IterateFn, opts subscription.IterationOptions) {
+			a.Equal(topicName, opts.TopicName)
+			fn(c.opts.ClientID, &gmqtt.Subscription{TopicFilter: topicName})
+		})
+		subDB.EXPECT().Unsubscribe(c.opts.ClientID, topic)
+	}
+
+	c.unsubscribeHandler(unsub)
+	select {
+	case p := <-c.out:
 		unSuback := p.(*packets.Unsuback)
 		a.EqualValues(0, unSuback.Payload[0])
 		a.EqualValues(0, unSuback.Payload[1])
@@ -1351,6 +2032,42 @@ func TestClient_unsubscribeHandler(t *testing.T) {
 	}
 }
 
+func TestClient_unsubscribeHandler_noSubscriptionExisted(t *testing.T) {
+	a := assert.New(t)
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		srv := defaultServer()
+		srv.subscriptionsDB = mem.NewStore()
+		var unsubscribed []string
+		srv.hooks.OnUnsubscribed = func(ctx context.Context, client Client, topicName string) {
+			unsubscribed = append(unsubscribed, topicName)
+		}
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = "cid"
+		c.version = version
+		_, err := srv.subscriptionsDB.Subscribe("cid", &gmqtt.Subscription{TopicFilter: "a"})
+		a.Nil(err)
+
+		c.unsubscribeHandler(&packets.Unsubscribe{
+			Version:  version,
+			PacketID: 1,
+			// "b" has never been subscribed, and "a" is repeated.
+			Topics: []string{"b", "a", "a"},
+		})
+		unSuback := (<-c.out).(*packets.Unsuback)
+		a.EqualValues(1, unSuback.PacketID)
+		if version == packets.Version5 {
+			a.Equal([]codes.Code{codes.NoSubscriptionExisted, codes.Success, codes.NoSubscriptionExisted}, unSuback.Payload)
+		} else {
+			a.Nil(unSuback.Payload)
+		}
+		// OnUnsubscribed is only called for the removed subscription, so that the admin store is not touched by the others.
+		a.Equal([]string{"a"}, unsubscribed)
+		stats, _ := srv.subscriptionsDB.GetClientStats("cid")
+		a.EqualValues(0, stats.SubscriptionsCurrent)
+	}
+}
+
 func TestMsg_TotalBytes(t *testing.T) {
 	var tt = []struct {
 		name string
@@ -1489,6 +2206,23 @@ func TestClient_defaultAuthOptions(t *testing.T) {
 
 }
 
+func TestClampKeepAlive(t *testing.T) {
+	a := assert.New(t)
+	var tt = []struct {
+		keepAlive, min, max, expected uint16
+	}{
+		{keepAlive: 30, min: 10, max: 60, expected: 30},
+		{keepAlive: 5, min: 10, max: 60, expected: 10},
+		{keepAlive: 0, min: 10, max: 60, expected: 10},
+		{keepAlive: 100, min: 10, max: 60, expected: 60},
+		{keepAlive: 0, min: 0, max: 60, expected: 0},
+		{keepAlive: 1000, min: 10, max: 0, expected: 1000},
+	}
+	for _, v := range tt {
+		a.Equal(v.expected, clampKeepAlive(v.keepAlive, v.min, v.max))
+	}
+}
+
 func TestClient_connectWithTimeOut_BasicAuth(t *testing.T) {
 	var tt = []struct {
 		name           string
@@ -1643,6 +2377,69 @@ func TestClient_connectWithTimeOut_BasicAuth(t *testing.T) {
 				a.Equal("cid", string(ack.Properties.AssignedClientID))
 			},
 		},
+		{
+			name: "receive_maximum_lower",
+			connect: &packets.Connect{
+				Version:    packets.Version5,
+				ClientID:   []byte("cid"),
+				Properties: &packets.Properties{ReceiveMaximum: uint16P(10)},
+			},
+			register: func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				return false, nil
+			},
+			basicAuth: func(ctx context.Context, client Client, req *ConnectRequest) (err error) {
+				return nil
+			},
+			ok: true,
+			assertConnack: func(a *assert.Assertions, ack *packets.Connack) {
+				a.Equal(codes.Success, ack.Code)
+			},
+			finalAssertion: func(a *assert.Assertions, cli *client) {
+				a.EqualValues(10, cli.opts.MaxInflight)
+			},
+		},
+		{
+			name: "receive_maximum_higher",
+			connect: &packets.Connect{
+				Version:    packets.Version5,
+				ClientID:   []byte("cid"),
+				Properties: &packets.Properties{ReceiveMaximum: uint16P(500)},
+			},
+			register: func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				return false, nil
+			},
+			basicAuth: func(ctx context.Context, client Client, req *ConnectRequest) (err error) {
+				return nil
+			},
+			ok: true,
+			assertConnack: func(a *assert.Assertions, ack *packets.Connack) {
+				a.Equal(codes.Success, ack.Code)
+			},
+			finalAssertion: func(a *assert.Assertions, cli *client) {
+				a.EqualValues(config.DefaultConfig().MQTT.MaxInflight, cli.opts.MaxInflight)
+			},
+		},
+		{
+			name: "receive_maximum_absent",
+			connect: &packets.Connect{
+				Version:    packets.Version5,
+				ClientID:   []byte("cid"),
+				Properties: &packets.Properties{},
+			},
+			register: func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				return false, nil
+			},
+			basicAuth: func(ctx context.Context, client Client, req *ConnectRequest) (err error) {
+				return nil
+			},
+			ok: true,
+			assertConnack: func(a *assert.Assertions, ack *packets.Connack) {
+				a.Equal(codes.Success, ack.Code)
+			},
+			finalAssertion: func(a *assert.Assertions, cli *client) {
+				a.EqualValues(config.DefaultConfig().MQTT.MaxInflight, cli.opts.MaxInflight)
+			},
+		},
 	}
 	for _, v := range tt {
 		t.Run(v.name, func(t *testing.T) {
@@ -1673,12 +2470,109 @@ func TestClient_connectWithTimeOut_BasicAuth(t *testing.T) {
 
 }
 
+func TestClient_connectWithTimeOut_KeepAlive(t *testing.T) {
+	var tt = []struct {
+		name      string
+		version   packets.Version
+		keepAlive uint16
+		expected  uint16
+	}{
+		{name: "v5_below_min", version: packets.Version5, keepAlive: 5, expected: 10},
+		{name: "v5_disabled", version: packets.Version5, keepAlive: 0, expected: 10},
+		{name: "v5_above_max", version: packets.Version5, keepAlive: 100, expected: 60},
+		{name: "v5_in_range", version: packets.Version5, keepAlive: 30, expected: 30},
+		{name: "v3_below_min", version: packets.Version311, keepAlive: 5, expected: 10},
+		{name: "v3_above_max", version: packets.Version311, keepAlive: 100, expected: 60},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.MinKeepAlive = 10
+			srv.config().MQTT.MaxKeepAlive = 60
+			c, _ := srv.newClient(noopConn{})
+			connect := &packets.Connect{
+				Version:   v.version,
+				KeepAlive: v.keepAlive,
+				ClientID:  []byte("cid"),
+			}
+			if v.version == packets.Version5 {
+				connect.Properties = &packets.Properties{}
+			}
+			c.in <- connect
+			c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				return false, nil
+			}
+			c.server.hooks.OnBasicAuth = func(ctx context.Context, client Client, req *ConnectRequest) (err error) {
+				return nil
+			}
+			a.True(c.connectWithTimeOut())
+			connack := (<-c.out).(*packets.Connack)
+			a.Equal(codes.Success, connack.Code)
+			if v.version == packets.Version5 {
+				a.EqualValues(v.expected, *connack.Properties.ServerKeepAlive)
+			} else {
+				a.Nil(connack.Properties)
+			}
+			a.EqualValues(v.expected, c.ClientOptions().KeepAlive)
+		})
+	}
+}
+
+func TestClient_connectWithTimeOut_MaximumQoS(t *testing.T) {
+	var tt = []struct {
+		name            string
+		maximumQoS      uint8
+		retainAvailable bool
+	}{
+		{name: "qos0", maximumQoS: packets.Qos0, retainAvailable: true},
+		{name: "qos1", maximumQoS: packets.Qos1, retainAvailable: false},
+		{name: "qos2", maximumQoS: packets.Qos2, retainAvailable: true},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.MaximumQoS = v.maximumQoS
+			srv.config().MQTT.RetainAvailable = v.retainAvailable
+			c, _ := srv.newClient(noopConn{})
+			c.in <- &packets.Connect{
+				Version:    packets.Version5,
+				ClientID:   []byte("cid"),
+				Properties: &packets.Properties{},
+			}
+			c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				return false, nil
+			}
+			c.server.hooks.OnBasicAuth = func(ctx context.Context, client Client, req *ConnectRequest) (err error) {
+				return nil
+			}
+			a.True(c.connectWithTimeOut())
+			connack := (<-c.out).(*packets.Connack)
+			a.Equal(codes.Success, connack.Code)
+			// the absent Maximum QoS means QoS 2.
+			if v.maximumQoS == packets.Qos2 {
+				a.Nil(connack.Properties.MaximumQoS)
+			} else if a.NotNil(connack.Properties.MaximumQoS) {
+				a.Equal(v.maximumQoS, *connack.Properties.MaximumQoS)
+			}
+			a.Equal(bool2Byte(v.retainAvailable), connack.Properties.RetainAvailable)
+			a.Equal(v.maximumQoS, c.ClientOptions().MaximumQoS)
+			a.Equal(v.retainAvailable, c.ClientOptions().RetainAvailable)
+
+			// the CONNACK can be encoded.
+			a.Nil(connack.Pack(&bytes.Buffer{}))
+		})
+	}
+}
+
 func TestClient_connectWithTimeOut_Timeout(t *testing.T) {
 	a := assert.New(t)
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	srv := defaultServer()
+	srv.config().MQTT.ConnectTimeout = 100 * time.Millisecond
 	c, _ := srv.newClient(noopConn{})
 
 	ok := c.connectWithTimeOut()
@@ -1691,6 +2585,144 @@ func TestClient_connectWithTimeOut_Timeout(t *testing.T) {
 	a.Equal(ErrConnectTimeOut, c.err)
 }
 
+// newPipeClient returns the client which reads from a pipe, the packets are sent from the other end of the pipe.
+func newPipeClient(t *testing.T, srv *server) (*client, net.Conn, chan struct{}) {
+	srv.statsManager = newStatsManager(mem.NewStore())
+	conn, cli := net.Pipe()
+	c, err := srv.newClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+		client.setConnected(time.Now())
+		return false, nil
+	}
+	readDone := make(chan struct{})
+	go func() {
+		c.readLoop()
+		close(readDone)
+	}()
+	return c, cli, readDone
+}
+
+func TestClient_readLoop_handshakeTimeout(t *testing.T) {
+	a := assert.New(t)
+	var connect bytes.Buffer
+	a.Nil(packets.NewWriter(&connect).WriteAndFlush(&packets.Connect{
+		Version:       packets.Version311,
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: byte(packets.Version311),
+		CleanStart:    true,
+		ClientID:      []byte("cid"),
+	}))
+	var tt = []struct {
+		name      string
+		send      []byte
+		connected bool
+		err       error
+	}{
+		{
+			name: "nothing",
+			err:  ErrConnectTimeOut,
+		},
+		{
+			name: "partial_connect",
+			send: connect.Bytes()[:3],
+			err:  ErrConnectTimeOut,
+		},
+		{
+			name:      "no_packet_after_connect",
+			send:      connect.Bytes(),
+			connected: true,
+			err:       ErrFirstPacketTimeout,
+		},
+	}
+	for _, v := range tt {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.ConnectTimeout = 100 * time.Millisecond
+			srv.config().MQTT.FirstPacketTimeout = 100 * time.Millisecond
+			c, cli, readDone := newPipeClient(t, srv)
+			defer cli.Close()
+			go func() {
+				if len(v.send) != 0 {
+					_, _ = cli.Write(v.send)
+				}
+			}()
+			a.Equal(v.connected, c.connectWithTimeOut())
+			select {
+			case <-readDone:
+			case <-time.After(time.Second):
+				t.Fatal("the connection is not dropped")
+			}
+			a.Equal(v.err, c.err)
+		})
+	}
+}
+
+func TestClient_readLoop_firstPacketInTime(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.config().MQTT.ConnectTimeout = 100 * time.Millisecond
+	srv.config().MQTT.FirstPacketTimeout = 100 * time.Millisecond
+	c, cli, readDone := newPipeClient(t, srv)
+	defer cli.Close()
+	w := packets.NewWriter(cli)
+	go func() {
+		_ = w.WriteAndFlush(&packets.Connect{
+			Version:       packets.Version311,
+			ProtocolName:  []byte("MQTT"),
+			ProtocolLevel: byte(packets.Version311),
+			CleanStart:    true,
+			ClientID:      []byte("cid"),
+		})
+		_ = w.WriteAndFlush(&packets.Pingreq{})
+	}()
+	a.True(c.connectWithTimeOut())
+	a.IsType(&packets.Pingreq{}, <-c.in)
+	// neither the connect timeout nor the first packet timeout applies afterwards, the client does not use keep alive.
+	select {
+	case <-readDone:
+		t.Fatalf("unexpected disconnect: %v", c.err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	_ = cli.Close()
+	<-readDone
+	a.Nil(c.err)
+}
+
+func TestClient_readDeadline(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	now := time.Now()
+
+	deadline, err := c.readDeadline(now, true)
+	a.True(deadline.IsZero())
+	a.Nil(err)
+
+	c.opts.KeepAlive = 10
+	deadline, err = c.readDeadline(now, true)
+	a.Equal(now.Add(15*time.Second), deadline)
+	a.Equal(ErrKeepAliveTimeout, err)
+
+	c.config.MQTT.FirstPacketTimeout = 5 * time.Second
+	deadline, err = c.readDeadline(now, true)
+	a.Equal(now.Add(5*time.Second), deadline)
+	a.Equal(ErrFirstPacketTimeout, err)
+	deadline, err = c.readDeadline(now, false)
+	a.Equal(now.Add(15*time.Second), deadline)
+	a.Equal(ErrKeepAliveTimeout, err)
+
+	c.config.MQTT.FirstPacketTimeout = 20 * time.Second
+	deadline, err = c.readDeadline(now, true)
+	a.Equal(now.Add(15*time.Second), deadline)
+	a.Equal(ErrKeepAliveTimeout, err)
+}
+
 func TestClient_connectWithTimeOut_EnhancedAuth(t *testing.T) {
 	authMethod := []byte("authMethod")
 	authData := []byte("authData")
@@ -1749,7 +2781,7 @@ func TestClient_connectWithTimeOut_EnhancedAuth(t *testing.T) {
 						if authIndex == 1 {
 							return &AuthResponse{
 								Continue: false,
-								AuthData: nil,
+								AuthData: []byte("data3"),
 							}, nil
 						}
 
@@ -1776,6 +2808,8 @@ func TestClient_connectWithTimeOut_EnhancedAuth(t *testing.T) {
 						if i == 2 {
 							connack := p.(*packets.Connack)
 							a.Equal(codes.Success, connack.Code)
+							a.Equal(authMethod, connack.Properties.AuthMethod)
+							a.Equal([]byte("data3"), connack.Properties.AuthData)
 						}
 						i++
 					}
@@ -1812,28 +2846,75 @@ func TestClient_connectWithTimeOut_EnhancedAuth(t *testing.T) {
 				a.Equal(codes.ErrProtocol, client.err)
 			},
 		},
-	}
-	for _, v := range tt {
-		t.Run(v.name, func(t *testing.T) {
-			authIndex = 0
-			connect := &packets.Connect{
-				Version:    packets.Version5,
-				CleanStart: false,
-				KeepAlive:  0,
-				ClientID:   []byte("cid"),
-				Properties: &packets.Properties{
-					AuthMethod: authMethod,
-					AuthData:   authData,
+		{
+			// It is a Protocol Error for the Client to use a different Authentication Method than in the CONNECT packet.
+			name: "different_auth_method",
+			auth: []*packets.Auth{
+				{
+					Code: codes.ContinueAuthentication,
+					Properties: &packets.Properties{
+						AuthData:   []byte("1"),
+						AuthMethod: []byte("other"),
+					},
 				},
-			}
-			a := assert.New(t)
-			ctrl := gomock.NewController(t)
-			defer ctrl.Finish()
-
-			srv := defaultServer()
-			c, _ := srv.newClient(noopConn{})
-			c.in <- connect
-			for _, v := range v.auth {
+			},
+			enhancedAuth: func(ctx context.Context, client Client, req *ConnectRequest) (resp *EnhancedAuthResponse, err error) {
+				return &EnhancedAuthResponse{
+					Continue: true,
+					OnAuth: func(ctx context.Context, client Client, req *AuthRequest) (resp *AuthResponse, e error) {
+						panic("unexpected OnAuth call")
+					},
+					AuthData: []byte("data1"),
+				}, nil
+			},
+			ok: false,
+			finalAssertion: func(a *assert.Assertions, client *client) {
+				a.Equal(codes.ErrProtocol, client.err)
+			},
+		},
+		{
+			name: "no_properties",
+			auth: []*packets.Auth{
+				{
+					Code: codes.ContinueAuthentication,
+				},
+			},
+			enhancedAuth: func(ctx context.Context, client Client, req *ConnectRequest) (resp *EnhancedAuthResponse, err error) {
+				return &EnhancedAuthResponse{
+					Continue: true,
+					OnAuth: func(ctx context.Context, client Client, req *AuthRequest) (resp *AuthResponse, e error) {
+						panic("unexpected OnAuth call")
+					},
+					AuthData: []byte("data1"),
+				}, nil
+			},
+			ok: false,
+			finalAssertion: func(a *assert.Assertions, client *client) {
+				a.Equal(codes.ErrProtocol, client.err)
+			},
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			authIndex = 0
+			connect := &packets.Connect{
+				Version:    packets.Version5,
+				CleanStart: false,
+				KeepAlive:  0,
+				ClientID:   []byte("cid"),
+				Properties: &packets.Properties{
+					AuthMethod: authMethod,
+					AuthData:   authData,
+				},
+			}
+			a := assert.New(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			srv := defaultServer()
+			c, _ := srv.newClient(noopConn{})
+			c.in <- connect
+			for _, v := range v.auth {
 				c.in <- v
 			}
 			c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
@@ -1856,3 +2937,1427 @@ func TestClient_connectWithTimeOut_EnhancedAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_reAuthHandler(t *testing.T) {
+	a := assert.New(t)
+	authMethod := []byte("authMethod")
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version5
+	c.opts.AuthMethod = authMethod
+	var received [][]byte
+	srv.hooks.OnReAuth = func(ctx context.Context, client Client, auth *packets.Auth) (*AuthResponse, error) {
+		received = append(received, auth.Properties.AuthData)
+		if auth.Code == codes.ReAuthenticate {
+			return &AuthResponse{Continue: true, AuthData: []byte("challenge")}, nil
+		}
+		return &AuthResponse{AuthData: []byte("final")}, nil
+	}
+	newAuth := func(code codes.Code, data string) *packets.Auth {
+		return &packets.Auth{
+			Code: code,
+			Properties: &packets.Properties{
+				AuthMethod: authMethod,
+				AuthData:   []byte(data),
+			},
+		}
+	}
+	assertAuth := func(code codes.Code, data string) {
+		auth := (<-c.out).(*packets.Auth)
+		a.Equal(code, auth.Code)
+		a.Equal(authMethod, auth.Properties.AuthMethod)
+		a.Equal([]byte(data), auth.Properties.AuthData)
+	}
+	// the re-authentication must start with Re-authenticate.
+	a.Equal(codes.ErrProtocol, c.reAuthHandler(newAuth(codes.ContinueAuthentication, "1")))
+	// the same auth method is required.
+	a.Equal(codes.ErrProtocol, c.reAuthHandler(&packets.Auth{Code: codes.ReAuthenticate}))
+	a.Equal(codes.ErrProtocol, c.reAuthHandler(&packets.Auth{
+		Code:       codes.ReAuthenticate,
+		Properties: &packets.Properties{AuthMethod: []byte("other")},
+	}))
+
+	a.Nil(c.reAuthHandler(newAuth(codes.ReAuthenticate, "1")))
+	assertAuth(codes.ContinueAuthentication, "challenge")
+	// the client must continue the exchange.
+	a.Equal(codes.ErrProtocol, c.reAuthHandler(newAuth(codes.ReAuthenticate, "2")))
+	a.Nil(c.reAuthHandler(newAuth(codes.ContinueAuthentication, "2")))
+	assertAuth(codes.Success, "final")
+	a.Equal([][]byte{[]byte("1"), []byte("2")}, received)
+
+	// a new re-authentication.
+	a.Nil(c.reAuthHandler(newAuth(codes.ReAuthenticate, "3")))
+	assertAuth(codes.ContinueAuthentication, "challenge")
+
+	srv.hooks.OnReAuth = func(ctx context.Context, client Client, auth *packets.Auth) (*AuthResponse, error) {
+		return nil, &codes.Error{Code: codes.NotAuthorized}
+	}
+	a.Equal(codes.NotAuthorized, c.reAuthHandler(newAuth(codes.ContinueAuthentication, "4")).Code)
+}
+
+func newInflightPublish(id packets.PacketID) *queue.Elem {
+	return &queue.Elem{
+		At: time.Now(),
+		MessageWithID: &queue.Publish{
+			Message: &gmqtt.Message{
+				QoS:      packets.Qos1,
+				Topic:    "topic",
+				Payload:  []byte("payload"),
+				PacketID: id,
+			},
+		},
+	}
+}
+
+func TestWithRemainingExpiry(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	msg := &gmqtt.Message{Topic: "a", MessageExpiry: 10}
+	m := withRemainingExpiry(msg, now.Add(-3*time.Second), now)
+	a.EqualValues(7, m.MessageExpiry)
+	a.EqualValues(10, msg.MessageExpiry, "the queued message must not be modified")
+	// the inflight message which has waited longer than the interval.
+	a.EqualValues(1, withRemainingExpiry(msg, now.Add(-time.Minute), now).MessageExpiry)
+	noExpiry := &gmqtt.Message{Topic: "a"}
+	a.Equal(noExpiry, withRemainingExpiry(noExpiry, now.Add(-time.Minute), now))
+}
+
+func TestClient_pollInflights_exceedsWindow(t *testing.T) {
+	var tt = []struct {
+		name   string
+		policy string
+	}{
+		{name: "redeliver", policy: config.InflightRedeliver},
+		{name: "drop", policy: config.InflightDrop},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			srv := defaultServer()
+			srv.statsManager = newStatsManager(mem.NewStore())
+			srv.config().MQTT.InflightTrimPolicy = v.policy
+			c, er := srv.newClient(noopConn{})
+			a.Nil(er)
+			c.opts.ClientID = "cid"
+			c.version = packets.Version5
+			// the client reconnects with a smaller receive maximum than its inflight count.
+			c.opts.MaxInflight = 2
+			c.newPacketIDLimiter(c.opts.MaxInflight)
+			qs := queue.NewMockStore(ctrl)
+			c.queueStore = qs
+
+			var dropped []packets.PacketID
+			c.queueNotifier.dropHook = func(ctx context.Context, clientID string, msg *gmqtt.Message, err error) {
+				a.Equal(queue.ErrDropInflightTrimmed, err)
+				dropped = append(dropped, msg.PacketID)
+			}
+			qs.EXPECT().ReadInflight(uint(2)).Return([]*queue.Elem{
+				newInflightPublish(1),
+				newInflightPublish(2),
+				newInflightPublish(3),
+				{At: time.Now(), MessageWithID: &queue.Pubrel{PacketID: 4}},
+			}, nil)
+			if v.policy == config.InflightDrop {
+				qs.EXPECT().Remove(packets.PacketID(3)).Return(nil)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				cont, err := c.pollInflights()
+				a.True(cont)
+				a.Nil(err)
+			}()
+
+			readPacket := func() packets.Packet {
+				select {
+				case p := <-c.out:
+					return p
+				case <-time.After(time.Second):
+					t.Fatal("missing output")
+				}
+				return nil
+			}
+			assertPublish := func(p packets.Packet, id packets.PacketID) {
+				pub, ok := p.(*packets.Publish)
+				if a.True(ok) {
+					a.Equal(id, pub.PacketID)
+					a.True(pub.Dup)
+				}
+			}
+			// the inflight messages within the window are redelivered in order.
+			assertPublish(readPacket(), 1)
+			assertPublish(readPacket(), 2)
+			select {
+			case p := <-c.out:
+				t.Fatalf("unexpected output: %v", p)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			c.pl.release(1)
+			if v.policy == config.InflightRedeliver {
+				assertPublish(readPacket(), 3)
+				a.Nil(dropped)
+				c.pl.release(2)
+			} else {
+				a.Equal([]packets.PacketID{3}, dropped)
+			}
+			p := readPacket()
+			a.Equal(&packets.Pubrel{PacketID: 4}, p)
+			<-done
+		})
+	}
+}
+
+func TestClient_pollInflights_qos2Resume(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	qs := queue.NewMockStore(ctrl)
+	newClient := func() *client {
+		c, er := srv.newClient(noopConn{})
+		a.Nil(er)
+		c.opts.ClientID = "cid"
+		c.version = packets.Version5
+		c.opts.MaxInflight = 2
+		c.newPacketIDLimiter(c.opts.MaxInflight)
+		c.queueStore = qs
+		return c
+	}
+	readPacket := func(c *client) packets.Packet {
+		select {
+		case p := <-c.out:
+			return p
+		default:
+			t.Fatal("missing output")
+		}
+		return nil
+	}
+	assertPubrel := func(p packets.Packet, id packets.PacketID) {
+		pubrel, ok := p.(*packets.Pubrel)
+		if a.True(ok) {
+			a.Equal(id, pubrel.PacketID)
+			a.Equal(codes.Success, pubrel.Code)
+		}
+	}
+
+	// the QoS 2 messages 1 and 2 are delivered, and the client disconnects after sending PUBREC for 1.
+	c := newClient()
+	a.Equal([]packets.PacketID{1, 2}, c.pl.pollPacketIDs(2))
+	var inflight []*queue.Elem
+	qs.EXPECT().Replace(gomock.Any()).DoAndReturn(func(elem *queue.Elem) (bool, error) {
+		inflight = append(inflight, elem)
+		return true, nil
+	})
+	c.pubrecHandler(&packets.Pubrec{PacketID: 1})
+	assertPubrel(readPacket(c), 1)
+	c.pl.close()
+
+	pub := newInflightPublish(2)
+	pub.MessageWithID.(*queue.Publish).QoS = packets.Qos2
+	inflight = append(inflight, pub)
+
+	// the session is resumed.
+	c = newClient()
+	gomock.InOrder(
+		qs.EXPECT().ReadInflight(uint(2)).Return(inflight, nil),
+		qs.EXPECT().ReadInflight(uint(2)).Return(nil, nil),
+	)
+	cont := true
+	for cont {
+		var err error
+		cont, err = c.pollInflights()
+		a.Nil(err)
+	}
+	// PUBREL is retransmitted for the acknowledged message, and PUBLISH with DUP for the other one.
+	assertPubrel(readPacket(c), 1)
+	p := readPacket(c).(*packets.Publish)
+	a.EqualValues(2, p.PacketID)
+	a.Equal(packets.Qos2, p.Qos)
+	a.True(p.Dup)
+	a.EqualValues(2, c.pl.used)
+
+	qs.EXPECT().Replace(gomock.Any()).Return(true, nil)
+	c.pubrecHandler(&packets.Pubrec{PacketID: 2})
+	assertPubrel(readPacket(c), 2)
+
+	qs.EXPECT().Remove(packets.PacketID(1)).Return(nil)
+	qs.EXPECT().Remove(packets.PacketID(2)).Return(nil)
+	c.pubcompHandler(&packets.Pubcomp{PacketID: 1})
+	c.pubcompHandler(&packets.Pubcomp{PacketID: 2})
+	// all packet ids are released.
+	a.EqualValues(0, c.pl.used)
+	a.Equal([]packets.PacketID{1, 2}, c.pl.pollPacketIDs(2))
+}
+
+func TestClient_publishHandler_emptyPayload(t *testing.T) {
+	var tt = []struct {
+		name         string
+		dropEmpty    bool
+		retain       bool
+		payload      []byte
+		delivered    bool
+		retainRemove bool
+	}{
+		{
+			name:      "drop_normal_empty",
+			dropEmpty: true,
+			payload:   []byte{},
+			delivered: false,
+		},
+		{
+			name:      "route_normal_empty",
+			dropEmpty: false,
+			payload:   []byte{},
+			delivered: true,
+		},
+		{
+			name:      "route_non_empty",
+			dropEmpty: true,
+			payload:   []byte("b"),
+			delivered: true,
+		},
+		{
+			name:         "retained_clear",
+			dropEmpty:    true,
+			retain:       true,
+			payload:      []byte{},
+			delivered:    true,
+			retainRemove: true,
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			retainedDB := retained.NewMockStore(ctrl)
+			cfg := config.DefaultConfig()
+			cfg.MQTT.DropEmptyPayload = v.dropEmpty
+			srv := &server{
+				retainedDB: retainedDB,
+				clock:      clock.New(),
+			}
+			srv.storeConfig(cfg)
+			var arrived bool
+			srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+				arrived = true
+				return nil
+			}
+			c, er := srv.newClient(noopConn{})
+			a.NoError(er)
+			var delivered bool
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				delivered = true
+				return false, false
+			}
+			c.opts.ClientID = "cid"
+			c.version = packets.Version5
+			c.opts.RetainAvailable = true
+			in := &packets.Publish{
+				Version:    packets.Version5,
+				Qos:        packets.Qos1,
+				Retain:     v.retain,
+				TopicName:  []byte("/topic/A"),
+				PacketID:   1,
+				Payload:    v.payload,
+				Properties: &packets.Properties{},
+			}
+			if v.retainRemove {
+				retainedDB.EXPECT().Remove("/topic/A")
+			}
+			a.Nil(c.publishHandler(in))
+			a.Equal(v.delivered, delivered)
+			a.Equal(v.delivered, arrived)
+			select {
+			case p := <-c.out:
+				if v.delivered {
+					a.Equal(in.NewPuback(codes.NotMatchingSubscribers, nil), p)
+				} else {
+					// the publisher still receives a positive acknowledgement.
+					a.Equal(in.NewPuback(codes.Success, nil), p)
+				}
+			default:
+				t.Fatal("missing output")
+			}
+		})
+	}
+}
+
+func TestClient_readLoop_keepAliveTimeout(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c, _ := srv.newClient(conn)
+	c.opts.ClientID = "cid"
+	c.opts.KeepAlive = 1
+	c.setConnected(time.Now())
+	close(c.connected)
+
+	// the client sends a PINGREQ and then vanishes without FIN.
+	go func() {
+		_ = packets.NewWriter(peer).WriteAndFlush(&packets.Pingreq{})
+	}()
+	go c.readLoop()
+	a.IsType(&packets.Pingreq{}, <-c.in)
+	pinged := time.Now()
+	select {
+	case _, ok := <-c.in:
+		a.False(ok)
+	case <-time.After(5 * time.Second):
+		a.FailNow("readLoop not returned")
+	}
+	a.Equal(ErrKeepAliveTimeout, c.err)
+	// the client is reaped 1.5 times the keep alive time after the last packet.
+	elapsed := time.Since(pinged)
+	a.True(elapsed >= 1400*time.Millisecond && elapsed < 2500*time.Millisecond, elapsed)
+}
+
+func TestClient_readLoop_malformedUTF8Topic(t *testing.T) {
+	a := assert.New(t)
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		srv := defaultServer()
+		conn, peer := net.Pipe()
+		c, _ := srv.newClient(conn)
+		c.opts.ClientID = "cid"
+		c.version = version
+		c.packetReader.SetVersion(version)
+		c.setConnected(time.Now())
+
+		// PUBLISH with the overlong encoding of '/' in the topic name.
+		topic := []byte("a\xc0\xafb")
+		b := []byte{0x30, byte(2 + len(topic) + 1), 0, byte(len(topic))}
+		b = append(b, topic...)
+		if version == packets.Version5 {
+			b = append(b, 0)
+			b[1]++
+		}
+		b = append(b, 'p')
+		go func() {
+			_, _ = peer.Write(b)
+		}()
+		go c.readLoop()
+		select {
+		case _, ok := <-c.in:
+			// the packet must not be passed to the handlers.
+			a.False(ok)
+		case <-time.After(5 * time.Second):
+			a.FailNow("readLoop not returned")
+		}
+		a.Equal(codes.ErrMalformed, c.err)
+		if version == packets.Version5 {
+			a.Equal(&packets.Disconnect{
+				Version: packets.Version5,
+				Code:    codes.MalformedPacket,
+				Properties: &packets.Properties{
+					User: kvsToProperties(nil),
+				},
+			}, <-c.out)
+		} else {
+			a.Len(c.out, 0)
+		}
+		peer.Close()
+	}
+}
+
+func TestClient_readLoop_packetTooLarge(t *testing.T) {
+	a := assert.New(t)
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		srv := defaultServer()
+		srv.config().MQTT.MaxPacketSize = 1024
+		conn, peer := net.Pipe()
+		c, _ := srv.newClient(conn)
+		c.opts.ClientID = "cid"
+		c.version = version
+		c.packetReader.SetVersion(version)
+		c.setConnected(time.Now())
+
+		// the remaining length claims 1MB, but the payload is never sent.
+		go func() {
+			_, _ = peer.Write([]byte{0x30, 0x80, 0x80, 0x40})
+		}()
+		go c.readLoop()
+		select {
+		case _, ok := <-c.in:
+			a.False(ok)
+		case <-time.After(5 * time.Second):
+			a.FailNow("readLoop not returned")
+		}
+		a.Equal(codes.ErrPacketTooLarge, c.err)
+		if version == packets.Version5 {
+			a.Equal(&packets.Disconnect{
+				Version: packets.Version5,
+				Code:    codes.PacketTooLarge,
+				Properties: &packets.Properties{
+					User: kvsToProperties(nil),
+				},
+			}, <-c.out)
+		} else {
+			a.Len(c.out, 0)
+		}
+		peer.Close()
+	}
+}
+
+func TestClient_publishHandler_retainedClear(t *testing.T) {
+	topic := "/topic/A"
+	existing := &gmqtt.Message{
+		QoS:      packets.Qos1,
+		Retained: true,
+		Topic:    topic,
+		Payload:  []byte("retained"),
+	}
+	var tt = []struct {
+		name     string
+		existing bool
+		alias    bool
+		// limits indicates whether the retained limits are reached, which must not affect the clearing.
+		limits bool
+	}{
+		{name: "clearWithExisting", existing: true},
+		{name: "clearWithoutExisting", existing: false},
+		{name: "clearWithTopicAlias", existing: true, alias: true},
+		{name: "clearWithLimits", existing: true, limits: true},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			if v.existing {
+				srv.retainedDB.AddOrReplace(existing.Copy())
+			}
+			if v.limits {
+				srv.config().MQTT.MaxRetainedMessages = 1
+				srv.config().MQTT.MaxRetainedMessageBytes = 1
+				srv.config().MQTT.RetainedLimitPolicy = config.RetainedLimitReject
+				srv.config().MQTT.RetainedLimitNack = true
+				srv.applyRetainedLimits(srv.config().MQTT)
+			}
+			c, er := srv.newClient(noopConn{})
+			a.NoError(er)
+			c.opts.ClientID = "cid"
+			c.version = packets.Version5
+			c.opts.RetainAvailable = true
+			c.opts.ServerTopicAliasMax = 5
+			c.aliasMapper = make([][]byte, 6)
+			c.unackStore = unack_mem.New(unack_mem.Options{
+				ClientID: "cid",
+			})
+			var delivered []*gmqtt.Message
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				delivered = append(delivered, msg)
+				return true, false
+			}
+			clear := &packets.Publish{
+				Version:    packets.Version5,
+				Qos:        packets.Qos1,
+				Retain:     true,
+				TopicName:  []byte(topic),
+				PacketID:   1,
+				Payload:    []byte{},
+				Properties: &packets.Properties{},
+			}
+			if v.alias {
+				// set the alias first, and then clear by the alias with empty topic name.
+				a.Nil(c.publishHandler(&packets.Publish{
+					Version:    packets.Version5,
+					Qos:        packets.Qos0,
+					TopicName:  []byte(topic),
+					Payload:    []byte("live"),
+					Properties: &packets.Properties{TopicAlias: uint16P(1)},
+				}))
+				delivered = nil
+				clear.TopicName = []byte{}
+				clear.Properties.TopicAlias = uint16P(1)
+			}
+			a.Nil(c.publishHandler(clear))
+
+			// the retained message is removed and the empty one is not stored.
+			a.Nil(srv.retainedDB.GetRetainedMessage(topic))
+			a.Len(srv.retainedDB.GetMatchedMessages("#"), 0)
+			// delivered to the current subscribers with empty payload.
+			if a.Len(delivered, 1) {
+				a.Equal(topic, delivered[0].Topic)
+				a.Len(delivered[0].Payload, 0)
+				a.True(delivered[0].Retained)
+			}
+			select {
+			case p := <-c.out:
+				a.Equal(clear.NewPuback(codes.Success, nil), p)
+			default:
+				a.Fail("missing puback")
+			}
+		})
+	}
+}
+
+func TestClient_publishHandler_retainedLimits(t *testing.T) {
+	var tt = []struct {
+		name    string
+		version packets.Version
+		qos     uint8
+		nack    bool
+		payload string
+		code    codes.Code
+		stored  bool
+	}{
+		{name: "stored", version: packets.Version5, qos: packets.Qos1, nack: true, payload: "1", code: codes.Success, stored: true},
+		{name: "v5_qos1_nack", version: packets.Version5, qos: packets.Qos1, nack: true, payload: "123", code: codes.QuotaExceeded},
+		{name: "v5_qos2_nack", version: packets.Version5, qos: packets.Qos2, nack: true, payload: "123", code: codes.QuotaExceeded},
+		{name: "v5_qos1_no_nack", version: packets.Version5, qos: packets.Qos1, payload: "123", code: codes.Success},
+		{name: "v3_qos1_nack", version: packets.Version311, qos: packets.Qos1, nack: true, payload: "123", code: codes.Success},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.MaxRetainedMessageBytes = 2
+			srv.config().MQTT.RetainedLimitNack = v.nack
+			srv.applyRetainedLimits(srv.config().MQTT)
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			c.version = v.version
+			c.opts.RetainAvailable = true
+			c.unackStore = unack_mem.New(unack_mem.Options{
+				ClientID: "cid",
+			})
+			var delivered bool
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				delivered = true
+				return true, false
+			}
+			a.Nil(c.publishHandler(&packets.Publish{
+				Version:    v.version,
+				Qos:        v.qos,
+				Retain:     true,
+				PacketID:   1,
+				TopicName:  []byte("topic"),
+				Payload:    []byte(v.payload),
+				Properties: &packets.Properties{},
+			}))
+			a.Equal(v.stored, srv.retainedDB.GetRetainedMessage("topic") != nil)
+			a.Equal(v.code == codes.Success, delivered)
+			switch p := (<-c.out).(type) {
+			case *packets.Puback:
+				a.Equal(v.code, p.Code)
+			case *packets.Pubrec:
+				a.Equal(v.code, p.Code)
+				exist, err := c.unackStore.Set(1)
+				a.Nil(err)
+				a.False(exist)
+			}
+		})
+	}
+}
+
+func TestClient_publishHandler_maxRetainedMessages(t *testing.T) {
+	var tt = []struct {
+		policy string
+		code   codes.Code
+	}{
+		{policy: config.RetainedLimitEvict, code: codes.Success},
+		{policy: config.RetainedLimitReject, code: codes.QuotaExceeded},
+	}
+	for _, v := range tt {
+		t.Run(v.policy, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.MaxRetainedMessages = 1
+			srv.config().MQTT.RetainedLimitPolicy = v.policy
+			srv.config().MQTT.RetainedLimitNack = true
+			srv.applyRetainedLimits(srv.config().MQTT)
+			publish := func(clientID string, topic string) codes.Code {
+				c, err := srv.newClient(noopConn{})
+				a.Nil(err)
+				c.opts.ClientID = clientID
+				c.version = packets.Version5
+				c.opts.RetainAvailable = true
+				c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+					return true, false
+				}
+				a.Nil(c.publishHandler(&packets.Publish{
+					Version:    packets.Version5,
+					Qos:        packets.Qos1,
+					Retain:     true,
+					PacketID:   1,
+					TopicName:  []byte(topic),
+					Payload:    []byte("payload"),
+					Properties: &packets.Properties{},
+				}))
+				return (<-c.out).(*packets.Puback).Code
+			}
+			// the limit applies to the retained messages of all clients.
+			a.Equal(codes.Success, publish("c1", "a"))
+			a.Equal(v.code, publish("c2", "b"))
+			// replacing the retained message of an existing topic is not limited.
+			if v.policy == config.RetainedLimitEvict {
+				a.Nil(srv.retainedDB.GetRetainedMessage("a"))
+				a.NotNil(srv.retainedDB.GetRetainedMessage("b"))
+				a.Equal(codes.Success, publish("c1", "b"))
+			} else {
+				a.NotNil(srv.retainedDB.GetRetainedMessage("a"))
+				a.Nil(srv.retainedDB.GetRetainedMessage("b"))
+				a.Equal(codes.Success, publish("c2", "a"))
+			}
+			sts := srv.retainedDB.(retained.StatsReader).GetStats()
+			a.EqualValues(1, sts.RetainedMessages)
+			if v.policy == config.RetainedLimitEvict {
+				a.EqualValues(1, sts.EvictedTotal)
+			} else {
+				a.EqualValues(1, sts.RejectedTotal)
+			}
+		})
+	}
+}
+
+func TestClient_connectWithTimeOut_maxTopicLength(t *testing.T) {
+	var tt = []struct {
+		name    string
+		connect *packets.Connect
+		code    codes.Code
+	}{
+		{
+			name: "will_topic_too_long",
+			connect: &packets.Connect{
+				Version:        packets.Version5,
+				ClientID:       []byte("cid"),
+				Properties:     &packets.Properties{},
+				WillFlag:       true,
+				WillTopic:      []byte("abcdefghi"),
+				WillProperties: &packets.Properties{},
+			},
+			code: codes.TopicNameInvalid,
+		},
+		{
+			name: "will_response_topic_too_long",
+			connect: &packets.Connect{
+				Version:    packets.Version5,
+				ClientID:   []byte("cid"),
+				Properties: &packets.Properties{},
+				WillFlag:   true,
+				WillTopic:  []byte("will"),
+				WillProperties: &packets.Properties{
+					ResponseTopic: []byte("abcdefghi"),
+				},
+			},
+			code: codes.TopicNameInvalid,
+		},
+		{
+			name: "will_topic_too_long_v3",
+			connect: &packets.Connect{
+				Version:   packets.Version311,
+				ClientID:  []byte("cid"),
+				WillFlag:  true,
+				WillTopic: []byte("abcdefghi"),
+			},
+			code: codes.NotAuthorized,
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.MaxTopicLength = 8
+			c, _ := srv.newClient(noopConn{})
+			c.in <- v.connect
+			c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				panic("should not call register if the will topic is too long")
+			}
+			a.False(c.connectWithTimeOut())
+			select {
+			case p := <-c.out:
+				a.Equal(v.code, p.(*packets.Connack).Code)
+			default:
+				a.FailNow("missing connack")
+			}
+		})
+	}
+}
+
+func TestClient_publishHandler_rejected(t *testing.T) {
+	for name, qos := range map[string]uint8{"qos0": packets.Qos0, "qos1": packets.Qos1, "qos2": packets.Qos2} {
+		qos := qos
+		t.Run(name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := &server{
+				clock: clock.New(),
+			}
+			srv.storeConfig(config.DefaultConfig())
+			c, err := srv.newClient(noopConn{})
+			a.NoError(err)
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				return true, true
+			}
+			c.opts.ClientID = "cid"
+			c.version = packets.Version5
+			c.unackStore = unack_mem.New(unack_mem.Options{
+				ClientID: "cid",
+			})
+			a.Nil(c.publishHandler(&packets.Publish{
+				Version:    packets.Version5,
+				Qos:        qos,
+				PacketID:   1,
+				TopicName:  []byte("topic"),
+				Payload:    []byte("payload"),
+				Properties: &packets.Properties{},
+			}))
+			// the acknowledgement is withheld.
+			a.Len(c.out, 0)
+			if qos == packets.Qos2 {
+				// the resent message is not treated as duplicated.
+				exist, err := c.unackStore.Set(1)
+				a.Nil(err)
+				a.False(exist)
+			}
+		})
+	}
+}
+
+func TestClient_publishHandler_maxTopicLength(t *testing.T) {
+	var tt = []struct {
+		name          string
+		topicName     string
+		responseTopic string
+		code          codes.Code
+	}{
+		{
+			name:      "topic_name_too_long",
+			topicName: "abcdefghi",
+			code:      codes.TopicNameInvalid,
+		},
+		{
+			name:          "response_topic_too_long",
+			topicName:     "abc",
+			responseTopic: "abcdefghi",
+			code:          codes.TopicNameInvalid,
+		},
+		{
+			name:          "within_limit",
+			topicName:     "abcdefgh",
+			responseTopic: "abcdefgh",
+			code:          codes.Success,
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			cfg := config.DefaultConfig()
+			cfg.MQTT.MaxTopicLength = 8
+			srv := &server{
+				clock: clock.New(),
+			}
+			srv.storeConfig(cfg)
+			c, er := srv.newClient(noopConn{})
+			a.NoError(er)
+			var delivered bool
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				delivered = true
+				return true, false
+			}
+			c.opts.ClientID = "cid"
+			c.version = packets.Version5
+			in := &packets.Publish{
+				Version:   packets.Version5,
+				Qos:       packets.Qos0,
+				TopicName: []byte(v.topicName),
+				Payload:   []byte("payload"),
+				Properties: &packets.Properties{
+					ResponseTopic: []byte(v.responseTopic),
+				},
+			}
+			codeErr := c.publishHandler(in)
+			if v.code == codes.Success {
+				a.Nil(codeErr)
+				a.True(delivered)
+				return
+			}
+			a.Equal(v.code, codeErr.Code)
+			a.False(delivered)
+		})
+	}
+}
+
+func newUserProperties(n, size int) []packets.UserProperty {
+	ppt := make([]packets.UserProperty, n)
+	for i := range ppt {
+		ppt[i] = packets.UserProperty{K: []byte("k"), V: bytes.Repeat([]byte("v"), size-1)}
+	}
+	return ppt
+}
+
+func TestClient_userPropertiesLimit(t *testing.T) {
+	var tt = []struct {
+		name string
+		user []packets.UserProperty
+		code codes.Code
+	}{
+		{
+			name: "within_limit",
+			user: newUserProperties(4, 8),
+			code: codes.Success,
+		},
+		{
+			name: "exceed_count",
+			user: newUserProperties(5, 1),
+			code: codes.ProtocolError,
+		},
+		{
+			name: "exceed_bytes",
+			user: newUserProperties(3, 11),
+			code: codes.PacketTooLarge,
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.MaxUserProperties = 4
+			srv.config().MQTT.MaxUserPropertiesBytes = 32
+			srv.subscriptionsDB = mem.NewStore()
+			srv.statsManager = newStatsManager(srv.subscriptionsDB)
+
+			// CONNECT properties and will properties
+			for _, connect := range []*packets.Connect{
+				{
+					Version:    packets.Version5,
+					ClientID:   []byte("cid"),
+					Properties: &packets.Properties{User: v.user},
+				},
+				{
+					Version:        packets.Version5,
+					ClientID:       []byte("cid"),
+					Properties:     &packets.Properties{},
+					WillFlag:       true,
+					WillTopic:      []byte("will"),
+					WillProperties: &packets.Properties{User: v.user},
+				},
+			} {
+				c, err := srv.newClient(noopConn{})
+				a.Nil(err)
+				c.in <- connect
+				c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+					return false, nil
+				}
+				a.Equal(v.code == codes.Success, c.connectWithTimeOut())
+				a.Equal(v.code, (<-c.out).(*packets.Connack).Code)
+			}
+
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			c.version = packets.Version5
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				return true, false
+			}
+			codeErr := c.publishHandler(&packets.Publish{
+				Version:    packets.Version5,
+				TopicName:  []byte("topic"),
+				Payload:    []byte("payload"),
+				Properties: &packets.Properties{User: v.user},
+			})
+			codeErr2 := c.subscribeHandler(&packets.Subscribe{
+				Version:    packets.Version5,
+				PacketID:   1,
+				Topics:     []packets.Topic{{Name: "topic"}},
+				Properties: &packets.Properties{User: v.user},
+			})
+			if v.code == codes.Success {
+				a.Nil(codeErr)
+				a.Nil(codeErr2)
+				return
+			}
+			a.Equal(v.code, codeErr.Code)
+			a.Equal(v.code, codeErr2.Code)
+		})
+	}
+}
+
+func TestNewConnID(t *testing.T) {
+	a := assert.New(t)
+	ids := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		id := newConnID()
+		a.Len(id, 12)
+		ids[id] = struct{}{}
+	}
+	a.Len(ids, 100)
+
+	srv := defaultServer()
+	c1, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c2, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	a.NotEqual(c1.ConnID(), c2.ConnID())
+}
+
+// tenantRewrite prefixes the topics of each client with "tenant/{client_id}/".
+func tenantRewrite(ctx context.Context, clientID string, topic string, action TopicRewriteAction) (string, error) {
+	prefix := "tenant/" + clientID + "/"
+	switch {
+	case action == TopicRewriteDeliver:
+		return strings.TrimPrefix(topic, prefix), nil
+	case topic == "forbidden":
+		return "", &codes.Error{Code: codes.NotAuthorized}
+	case topic == "bad":
+		return prefix + "#/bad", nil
+	}
+	return prefix + topic, nil
+}
+
+func TestClient_subscribeHandler_topicRewrite(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		srv := defaultServer()
+		srv.subscriptionsDB = mem.NewStore()
+		srv.hooks.OnTopicRewrite = tenantRewrite
+		var authorized []string
+		srv.hooks.OnAuthorize = func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+			authorized = append(authorized, req.Topic)
+			return true
+		}
+		srv.retainedDB.AddOrReplace(&gmqtt.Message{Topic: "tenant/cid/a/b", Payload: []byte("mine"), Retained: true})
+		srv.retainedDB.AddOrReplace(&gmqtt.Message{Topic: "a/b", Payload: []byte("others"), Retained: true})
+		qs := queue.NewMockStore(ctrl)
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.opts.ClientID = "cid"
+		c.opts.SharedSubAvailable = true
+		c.opts.WildcardSubAvailable = true
+		c.version = version
+		c.queueStore = qs
+		// only the retained message in the namespace of the client is matched.
+		qs.EXPECT().Add(gomock.Any()).DoAndReturn(func(elem *queue.Elem) error {
+			a.Equal("tenant/cid/a/b", elem.MessageWithID.(*queue.Publish).Topic)
+			return nil
+		})
+
+		a.Nil(c.subscribeHandler(&packets.Subscribe{
+			Version:  version,
+			PacketID: 1,
+			Topics: []packets.Topic{
+				{SubOptions: packets.SubOptions{Qos: 1}, Name: "a/+"},
+				{SubOptions: packets.SubOptions{Qos: 1}, Name: "$share/g/b/#"},
+				{SubOptions: packets.SubOptions{Qos: 1}, Name: "forbidden"},
+				{SubOptions: packets.SubOptions{Qos: 1}, Name: "bad"},
+			},
+			Properties: &packets.Properties{},
+		}))
+		suback := (<-c.out).(*packets.Suback)
+		if packets.IsVersion3X(version) {
+			a.Equal([]codes.Code{codes.GrantedQoS1, codes.GrantedQoS1, packets.SubscribeFailure, packets.SubscribeFailure}, suback.Payload)
+		} else {
+			a.Equal([]codes.Code{codes.GrantedQoS1, codes.GrantedQoS1, codes.NotAuthorized, codes.TopicFilterInvalid}, suback.Payload)
+		}
+		// the rejected ones are not authorized.
+		a.ElementsMatch([]string{"tenant/cid/a/+", "$share/g/tenant/cid/b/#"}, authorized)
+		var subs []string
+		srv.subscriptionsDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+			subs = append(subs, sub.GetFullTopicName())
+			return true
+		}, subscription.IterationOptions{Type: subscription.TypeAll})
+		a.ElementsMatch([]string{"tenant/cid/a/+", "$share/g/tenant/cid/b/#"}, subs)
+
+		// unsubscribe maps the topic filters in the same way.
+		c.unsubscribeHandler(&packets.Unsubscribe{
+			Version:  version,
+			PacketID: 2,
+			Topics:   []string{"a/+", "$share/g/b/#"},
+		})
+		<-c.out
+		stats, _ := srv.subscriptionsDB.GetClientStats("cid")
+		a.EqualValues(0, stats.SubscriptionsCurrent)
+	}
+}
+
+func TestClient_publishHandler_topicRewrite(t *testing.T) {
+	var tt = []struct {
+		topic    string
+		expected string
+		code     codes.Code
+	}{
+		{topic: "a/b", expected: "tenant/cid/a/b", code: codes.Success},
+		{topic: "forbidden", code: codes.NotAuthorized},
+		{topic: "bad", code: codes.TopicNameInvalid},
+	}
+	for _, v := range tt {
+		t.Run(v.topic, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.hooks.OnTopicRewrite = tenantRewrite
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			c.opts.RetainAvailable = true
+			c.version = packets.Version5
+			var routed []string
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				routed = append(routed, msg.Topic)
+				return true, false
+			}
+			a.Nil(c.publishHandler(&packets.Publish{
+				Version:    packets.Version5,
+				Qos:        packets.Qos1,
+				PacketID:   1,
+				Retain:     true,
+				TopicName:  []byte(v.topic),
+				Payload:    []byte("payload"),
+				Properties: &packets.Properties{},
+			}))
+			puback := (<-c.out).(*packets.Puback)
+			a.Equal(v.code, puback.Code)
+			if v.code != codes.Success {
+				a.Empty(routed)
+				a.Empty(srv.retainedDB.GetMatchedMessages("#"))
+				return
+			}
+			a.Equal([]string{v.expected}, routed)
+			a.Nil(srv.retainedDB.GetRetainedMessage(v.topic))
+			a.NotNil(srv.retainedDB.GetRetainedMessage(v.expected))
+		})
+	}
+}
+
+func TestClient_publishHandler_responseTopicRewrite(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.hooks.OnTopicRewrite = tenantRewrite
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	var routed []*gmqtt.Message
+	c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+		routed = append(routed, msg)
+		return true, false
+	}
+	for i, v := range []struct {
+		responseTopic string
+		code          codes.Code
+	}{
+		{responseTopic: "a/resp", code: codes.Success},
+		{responseTopic: "bad", code: codes.TopicNameInvalid},
+	} {
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:   packets.Version5,
+			Qos:       packets.Qos1,
+			PacketID:  packets.PacketID(i + 1),
+			TopicName: []byte("a/b"),
+			Payload:   []byte("payload"),
+			Properties: &packets.Properties{
+				ResponseTopic: []byte(v.responseTopic),
+			},
+		}))
+		a.Equal(v.code, (<-c.out).(*packets.Puback).Code)
+	}
+	if a.Len(routed, 1) {
+		a.Equal("tenant/cid/a/b", routed[0].Topic)
+		a.Equal("tenant/cid/a/resp", routed[0].ResponseTopic)
+	}
+}
+
+func TestClient_rewriteWill(t *testing.T) {
+	var tt = []struct {
+		name          string
+		topic         string
+		responseTopic string
+		expected      string
+		expectedResp  string
+		err           bool
+	}{
+		{name: "rewritten", topic: "/a//b", responseTopic: "resp//x", expected: "tenant/cid/a/b", expectedResp: "tenant/cid/resp/x"},
+		{name: "no_response_topic", topic: "a/b", expected: "tenant/cid/a/b"},
+		{name: "invalid_topic", topic: "bad", err: true},
+		{name: "invalid_response_topic", topic: "a/b", responseTopic: "forbidden", err: true},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().MQTT.NormalizeTopics = true
+			srv.hooks.OnTopicRewrite = tenantRewrite
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			conn := &packets.Connect{
+				Version:   packets.Version5,
+				WillFlag:  true,
+				WillTopic: []byte(v.topic),
+				WillProperties: &packets.Properties{
+					ResponseTopic: []byte(v.responseTopic),
+				},
+			}
+			err = c.rewriteWill(conn)
+			if v.err {
+				a.NotNil(err)
+				return
+			}
+			a.Nil(err)
+			a.Equal(v.expected, string(conn.WillTopic))
+			a.Equal(v.expectedResp, string(conn.WillProperties.ResponseTopic))
+		})
+	}
+}
+
+func TestClient_publishHandler_msgArrivedModify(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	received := make(map[string][]string)
+	for _, v := range []string{"sub1", "sub2"} {
+		subscriber := v
+		_, err := srv.subscriptionsDB.Subscribe(subscriber, &gmqtt.Subscription{TopicFilter: "a/+", QoS: packets.Qos1})
+		a.Nil(err)
+		mockQueue := queue.NewMockStore(ctrl)
+		mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+			received[subscriber] = append(received[subscriber], string(elem.MessageWithID.(*queue.Publish).Payload))
+		}).AnyTimes()
+		srv.queueStore[subscriber] = mockQueue
+	}
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		if req.Message.Topic == "a/drop" {
+			req.Drop()
+			return nil
+		}
+		// modify in place, the PUBLISH packet must not be affected.
+		copy(req.Message.Payload, bytes.ToUpper(req.Message.Payload))
+		return nil
+	}
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.opts.RetainAvailable = true
+	c.version = packets.Version5
+
+	pub := &packets.Publish{
+		Version:    packets.Version5,
+		Qos:        packets.Qos1,
+		PacketID:   1,
+		Retain:     true,
+		TopicName:  []byte("a/b"),
+		Payload:    []byte("payload"),
+		Properties: &packets.Properties{},
+	}
+	a.Nil(c.publishHandler(pub))
+	a.Equal(codes.Success, (<-c.out).(*packets.Puback).Code)
+	a.Equal([]byte("payload"), pub.Payload)
+	a.Equal(map[string][]string{
+		"sub1": {"PAYLOAD"},
+		"sub2": {"PAYLOAD"},
+	}, received)
+	retained := srv.retainedDB.GetRetainedMessage("a/b")
+	if a.NotNil(retained) {
+		a.Equal([]byte("PAYLOAD"), retained.Payload)
+	}
+
+	// the dropped message is neither retained nor delivered.
+	a.Nil(c.publishHandler(&packets.Publish{
+		Version:    packets.Version5,
+		Qos:        packets.Qos1,
+		PacketID:   2,
+		Retain:     true,
+		TopicName:  []byte("a/drop"),
+		Payload:    []byte("payload"),
+		Properties: &packets.Properties{},
+	}))
+	a.Equal(codes.NotMatchingSubscribers, (<-c.out).(*packets.Puback).Code)
+	a.Len(received["sub1"], 1)
+	a.Nil(srv.retainedDB.GetRetainedMessage("a/drop"))
+}
+
+func TestClient_writeLoop_topicRewrite(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	srv.hooks.OnTopicRewrite = tenantRewrite
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	c, err := srv.newClient(sc)
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	go c.writeLoop()
+	defer c.setError(nil)
+
+	r := packets.NewReader(cc)
+	r.SetVersion(packets.Version5)
+	for _, v := range []struct{ in, out string }{
+		{in: "tenant/cid/a/b", out: "a/b"},
+		{in: "a/b", out: "a/b"},
+	} {
+		c.out <- &packets.Publish{
+			Version:   packets.Version5,
+			TopicName: []byte(v.in),
+			Payload:   []byte("payload"),
+			Properties: &packets.Properties{
+				ResponseTopic: []byte(v.in + "/resp"),
+			},
+		}
+		p, err := r.ReadPacket()
+		a.Nil(err)
+		a.Equal(v.out, string(p.(*packets.Publish).TopicName))
+		a.Equal(v.out+"/resp", string(p.(*packets.Publish).Properties.ResponseTopic))
+	}
+}
+
+func TestClient_subscribeHandler_retainHandlingResubscribe(t *testing.T) {
+	var tt = []struct {
+		retainHandling byte
+		// the number of the retained messages sent for the first subscribe, the resubscribe,
+		// the resubscribe with different options and the subscribe after unsubscribe.
+		sent []int
+	}{
+		{retainHandling: 0, sent: []int{1, 1, 1, 1}},
+		{retainHandling: 1, sent: []int{1, 0, 0, 1}},
+		{retainHandling: 2, sent: []int{0, 0, 0, 0}},
+	}
+	for _, v := range tt {
+		t.Run("retain_handling_"+strconv.Itoa(int(v.retainHandling)), func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.subscriptionsDB = mem.NewStore()
+			srv.retainedDB.AddOrReplace(&gmqtt.Message{Topic: "a/b", QoS: packets.Qos1, Payload: []byte("retained"), Retained: true})
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			c.opts.WildcardSubAvailable = true
+			c.version = packets.Version5
+			q := &elemQueue{}
+			c.queueStore = q
+
+			var pid packets.PacketID
+			subscribe := func(qos uint8) int {
+				pid++
+				n := len(q.elems)
+				a.Nil(c.subscribeHandler(&packets.Subscribe{
+					Version:  packets.Version5,
+					PacketID: pid,
+					Topics: []packets.Topic{
+						{SubOptions: packets.SubOptions{Qos: qos, RetainHandling: v.retainHandling}, Name: "a/+"},
+					},
+					Properties: &packets.Properties{},
+				}))
+				<-c.out
+				return len(q.elems) - n
+			}
+			var sent []int
+			sent = append(sent, subscribe(packets.Qos1))
+			// replaces the existing subscription with the identical filter.
+			sent = append(sent, subscribe(packets.Qos1))
+			sent = append(sent, subscribe(packets.Qos2))
+			c.unsubscribeHandler(&packets.Unsubscribe{
+				Version:  packets.Version5,
+				PacketID: pid + 1,
+				Topics:   []string{"a/+"},
+			})
+			<-c.out
+			pid++
+			sent = append(sent, subscribe(packets.Qos1))
+			a.Equal(v.sent, sent)
+		})
+	}
+}
+
+func TestClient_normalizeTopics(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.config().MQTT.NormalizeTopics = true
+	srv.subscriptionsDB = mem.NewStore()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.opts.SharedSubAvailable = true
+	c.opts.WildcardSubAvailable = true
+	c.version = packets.Version5
+
+	a.Nil(c.subscribeHandler(&packets.Subscribe{
+		Version:  packets.Version5,
+		PacketID: 1,
+		Topics: []packets.Topic{
+			{SubOptions: packets.SubOptions{Qos: 1}, Name: "/a//+/"},
+			{SubOptions: packets.SubOptions{Qos: 1}, Name: "$share/g//b/#"},
+		},
+		Properties: &packets.Properties{},
+	}))
+	suback := (<-c.out).(*packets.Suback)
+	a.Equal([]codes.Code{codes.GrantedQoS1, codes.GrantedQoS1}, suback.Payload)
+	var subs []string
+	srv.subscriptionsDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+		subs = append(subs, sub.GetFullTopicName())
+		return true
+	}, subscription.IterationOptions{Type: subscription.TypeAll})
+	a.ElementsMatch([]string{"a/+", "$share/g/b/#"}, subs)
+
+	var routed []string
+	c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+		routed = append(routed, msg.Topic)
+		return true, false
+	}
+	a.Nil(c.publishHandler(&packets.Publish{
+		Version:    packets.Version5,
+		Qos:        packets.Qos1,
+		PacketID:   2,
+		TopicName:  []byte("/a//b/"),
+		Payload:    []byte("payload"),
+		Properties: &packets.Properties{},
+	}))
+	<-c.out
+	a.Equal([]string{"a/b"}, routed)
+
+	c.unsubscribeHandler(&packets.Unsubscribe{
+		Version:  packets.Version5,
+		PacketID: 3,
+		Topics:   []string{"a//+", "$share/g//b/#"},
+	})
+	<-c.out
+	stats, _ := srv.subscriptionsDB.GetClientStats("cid")
+	a.EqualValues(0, stats.SubscriptionsCurrent)
+}
+
+func TestClient_subscribeHandler_batchFailure(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	subDB := subscription.NewMockStore(ctrl)
+	srv := &server{
+		subscriptionsDB: subDB,
+		clock:           clock.New(),
+	}
+	srv.storeConfig(config.DefaultConfig())
+	var subscribed int
+	srv.hooks.OnSubscribed = func(ctx context.Context, client Client, subscription *gmqtt.Subscription) {
+		subscribed++
+	}
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	// the accepted topic filters are added in one batch, nothing is added if the store fails.
+	subDB.EXPECT().Subscribe("cid", &gmqtt.Subscription{TopicFilter: "a", QoS: 1}, &gmqtt.Subscription{TopicFilter: "b", QoS: 2}).
+		Return(nil, errors.New("persistence error"))
+	a.Nil(c.subscribeHandler(&packets.Subscribe{
+		Version:  packets.Version5,
+		PacketID: 1,
+		Topics: []packets.Topic{
+			{SubOptions: packets.SubOptions{Qos: 1}, Name: "a"},
+			{SubOptions: packets.SubOptions{Qos: 1}, Name: "c/#"},
+			{SubOptions: packets.SubOptions{Qos: 2}, Name: "b"},
+		},
+		Properties: &packets.Properties{},
+	}))
+	suback := (<-c.out).(*packets.Suback)
+	a.Equal([]codes.Code{codes.UnspecifiedError, codes.WildcardSubNotSupported, codes.UnspecifiedError}, suback.Payload)
+	a.Zero(subscribed)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/DrmagicE/gmqtt/config"
+)
+
+// ErrConfigLoaderNotSet is returned by Server.ReloadConfig if the ConfigLoader is not set, see WithConfigLoader.
+var ErrConfigLoaderNotSet = errors.New("config loader not set")
+
+// ConfigLoader loads the config to reload, e.g: re-reads the config file.
+type ConfigLoader func() (config.Config, error)
+
+// ReloadResult is the result of Server.ReloadConfig.
+// The fields are represented by the yaml path, e.g: "mqtt.max_inflight" or "publish_rate_limit".
+type ReloadResult struct {
+	// Applied is the changed fields which are applied to the running server.
+	Applied []string
+	// RequireRestart is the changed fields which only take effect after restart, the running server keeps the old values.
+	RequireRestart []string
+}
+
+// reloadableFields is the fields which can be applied to the running server by ReloadConfig.
+// Most of them take effect on the new connections only, because the clients keep the config when they are created.
+// The exceptions are publish_rate_limit, which is also applied to the connected clients,
+// and the fields which are read by the server on use, e.g: connect_acl and topic_policy.
+var reloadableFields = map[string]bool{
+	"log.level":                              true,
+	"log.dump_packet":                        true,
+	"mqtt.session_expiry":                    true,
+	"mqtt.max_packet_size":                   true,
+	"mqtt.server_receive_maximum":            true,
+	"mqtt.max_keepalive":                     true,
+	"mqtt.min_keepalive":                     true,
+	"mqtt.topic_alias_maximum":               true,
+	"mqtt.subscription_identifier_available": true,
+	"mqtt.shared_subscription_available":     true,
+	"mqtt.wildcard_subscription_available":   true,
+	"mqtt.retain_available":                  true,
+	"mqtt.max_retained_bytes":                true,
+	"mqtt.max_retained_messages":             true,
+	"mqtt.max_retained_message_bytes":        true,
+	"mqtt.retained_limit_policy":             true,
+	"mqtt.retained_limit_nack":               true,
+	"mqtt.max_inflight":                      true,
+	"mqtt.maximum_qos":                       true,
+	"mqtt.max_subscription_qos":              true,
+	"mqtt.normalize_topics":                  true,
+	"mqtt.allow_zero_length_clientid":        true,
+	"mqtt.unknown_pubrel_policy":             true,
+	"mqtt.v3_unsupported_policy":             true,
+	"mqtt.drop_empty_payload":                true,
+	"mqtt.max_topic_length":                  true,
+	"mqtt.delivery_rate_limit":               true,
+	"mqtt.max_sessions_per_username":         true,
+	"mqtt.session_limit_policy":              true,
+	"mqtt.max_connections":                   true,
+	"mqtt.max_connections_per_ip":            true,
+	"mqtt.connect_timeout":                   true,
+	"mqtt.first_packet_timeout":              true,
+	"mqtt.max_subscriptions_per_client":      true,
+	"mqtt.max_total_subscriptions":           true,
+	"mqtt.max_user_properties":               true,
+	"mqtt.max_user_properties_bytes":         true,
+	"publish_rate_limit":                     true,
+	"acl_cache":                              true,
+	"publish_dedup":                          true,
+	"cpu_accounting":                         true,
+	"connect_acl":                            true,
+	"topic_policy":                           true,
+	"redirect":                               true,
+	"client_id_policy":                       true,
+	"ban_list.max_entries":                   true,
+}
+
+// ReloadConfig implements Server.ReloadConfig.
+func (srv *server) ReloadConfig() (*ReloadResult, error) {
+	if srv.configLoader == nil {
+		return nil, ErrConfigLoaderNotSet
+	}
+	c, err := srv.configLoader()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+	merged := srv.GetConfig()
+	rs := &ReloadResult{}
+	mergeReloadable(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(c), "", func(path string) bool {
+		if path == "log.level" && srv.logLevel == nil {
+			return false
+		}
+		return reloadableFields[path]
+	}, rs)
+	if len(rs.Applied) != 0 {
+		srv.ApplyConfig(merged)
+	}
+	return rs, nil
+}
+
+// mergeReloadable copies the changed reloadable fields of src to dst and records the changed fields in rs.
+// The struct fields are compared as a whole unless some of their fields are reloadable, e.g: mqtt.
+func mergeReloadable(dst, src reflect.Value, prefix string, reloadable func(path string) bool, rs *ReloadResult) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if f.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		d, s := dst.Field(i), src.Field(i)
+		if f.Type.Kind() == reflect.Struct && hasReloadableField(path) {
+			mergeReloadable(d, s, path+".", reloadable, rs)
+			continue
+		}
+		if reflect.DeepEqual(d.Interface(), s.Interface()) {
+			continue
+		}
+		if reloadable(path) {
+			d.Set(s)
+			rs.Applied = append(rs.Applied, path)
+		} else {
+			rs.RequireRestart = append(rs.RequireRestart, path)
+		}
+	}
+}
+
+func hasReloadableField(path string) bool {
+	for k := range reloadableFields {
+		if strings.HasPrefix(k, path+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	unack_mem "github.com/DrmagicE/gmqtt/persistence/unack/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestServer_ReloadConfig(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.storeConfig(config.DefaultConfig())
+	_, err := srv.ReloadConfig()
+	a.Equal(ErrConfigLoaderNotSet, err)
+
+	loadErr := errors.New("error")
+	var loaded config.Config
+	WithConfigLoader(func() (config.Config, error) {
+		return loaded, loadErr
+	})(srv)
+	_, err = srv.ReloadConfig()
+	a.Equal(loadErr, err)
+
+	loadErr = nil
+	loaded = config.DefaultConfig()
+	loaded.MQTT.MaxInflight = 0
+	_, err = srv.ReloadConfig()
+	a.NotNil(err)
+
+	// nothing changed
+	loaded = config.DefaultConfig()
+	rs, err := srv.ReloadConfig()
+	a.Nil(err)
+	a.Empty(rs.Applied)
+	a.Empty(rs.RequireRestart)
+
+	loaded = config.DefaultConfig()
+	loaded.MQTT.MaxInflight = 10
+	loaded.MQTT.FanoutWorkers = 8
+	loaded.Listeners = []*config.ListenerConfig{{Address: ":1884"}}
+	loaded.ACLCache.TTL = time.Minute
+	loaded.Log.Level = "debug"
+	rs, err = srv.ReloadConfig()
+	a.Nil(err)
+	a.ElementsMatch([]string{"mqtt.max_inflight", "acl_cache"}, rs.Applied)
+	// the log level is not reloadable without WithLogLevel.
+	a.ElementsMatch([]string{"listeners", "mqtt.fanout_workers", "log.level"}, rs.RequireRestart)
+	cfg := srv.GetConfig()
+	a.EqualValues(10, cfg.MQTT.MaxInflight)
+	a.Equal(time.Minute, cfg.ACLCache.TTL)
+	a.Equal(config.DefaultConfig().MQTT.FanoutWorkers, cfg.MQTT.FanoutWorkers)
+	a.Equal(config.DefaultConfig().Listeners, cfg.Listeners)
+	a.Equal(config.DefaultConfig().Log.Level, cfg.Log.Level)
+
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	WithLogLevel(level)(srv)
+	rs, err = srv.ReloadConfig()
+	a.Nil(err)
+	a.Equal([]string{"log.level"}, rs.Applied)
+	a.ElementsMatch([]string{"listeners", "mqtt.fanout_workers"}, rs.RequireRestart)
+	a.Equal(zapcore.DebugLevel, level.Level())
+}
+
+func TestServer_ReloadConfig_publishRateLimit(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.storeConfig(config.DefaultConfig())
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	loaded := config.DefaultConfig()
+	WithConfigLoader(func() (config.Config, error) {
+		return loaded, nil
+	})(srv)
+
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	c.unackStore = unack_mem.New(unack_mem.Options{
+		ClientID: "cid",
+	})
+	c.newPublishLimiter()
+	a.Nil(c.publishLimiter)
+	c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+		return true, false
+	}
+	srv.clients["cid"] = c
+	publish := func(pid packets.PacketID) codes.Code {
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:    packets.Version5,
+			Qos:        packets.Qos1,
+			PacketID:   pid,
+			TopicName:  []byte("topic"),
+			Payload:    []byte("payload"),
+			Properties: &packets.Properties{},
+		}))
+		return (<-c.out).(*packets.Puback).Code
+	}
+	a.Equal(codes.Success, publish(1))
+	a.Equal(codes.Success, publish(2))
+
+	loaded.PublishRateLimit = config.PublishRateLimit{MessagesPerSecond: 1, Policy: config.PublishRateLimitReject}
+	rs, err := srv.ReloadConfig()
+	a.Nil(err)
+	a.Equal([]string{"publish_rate_limit"}, rs.Applied)
+
+	// the new limit applies to the connected client.
+	a.Equal(codes.Success, publish(3))
+	a.Equal(codes.QuotaExceeded, publish(4))
+	a.NotNil(c.publishLimiter)
+	a.Equal(c, srv.clients["cid"])
+	select {
+	case <-c.close:
+		t.Fatal("the client should not be closed")
+	default:
+	}
+}
+
+// TestServer_ReloadConfig_connected reloads the config while a connected client is writing packets,
+// it is meant to be run with -race.
+func TestServer_ReloadConfig_connected(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	loaded := config.DefaultConfig()
+	WithConfigLoader(func() (config.Config, error) {
+		return loaded, nil
+	})(srv)
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	srv.mu.Lock()
+	srv.clients["cid"] = c
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = c.writePacket(&packets.Pingresp{})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		loaded = config.DefaultConfig()
+		loaded.MQTT.MaxInflight = uint16(i + 1)
+		_, err := srv.ReloadConfig()
+		a.Nil(err)
+	}
+	<-done
+	a.EqualValues(100, srv.GetConfig().MQTT.MaxInflight)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// connLimiter counts the network connections of the server and applies config.MQTT.MaxConnections and config.MQTT.MaxConnectionsPerIP.
+// A connection reserves a slot before it is accepted, binds the slot to its remote IP after accepted,
+// and releases the slot once it is closed.
+type connLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	max      int
+	maxPerIP int
+	// total is the number of the reserved slots, including the pending ones.
+	total int
+	// pending is the number of the slots which are reserved but not bound, e.g: the accept loop is waiting for the next connection.
+	pending int
+	// perIP is the number of the connections of each remote IP, the IP without connection is removed.
+	perIP  map[string]int
+	closed bool
+}
+
+func newConnLimiter() *connLimiter {
+	l := &connLimiter{
+		perIP: make(map[string]int),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// setLimits updates the limits, 0 means no limit.
+// The connections which have been accepted are not affected.
+func (l *connLimiter) setLimits(max, maxPerIP int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.maxPerIP = maxPerIP
+	l.cond.Broadcast()
+}
+
+func (l *connLimiter) fullLocked() bool {
+	return l.max > 0 && l.total >= l.max
+}
+
+// reserve blocks until a slot is available and reserves it.
+// It returns false if the limiter has been closed.
+func (l *connLimiter) reserve() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for !l.closed && l.fullLocked() {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return false
+	}
+	l.total++
+	l.pending++
+	return true
+}
+
+// tryReserve reserves a slot without blocking, it returns false if no slot is available.
+func (l *connLimiter) tryReserve() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.fullLocked() {
+		return false
+	}
+	l.total++
+	l.pending++
+	return true
+}
+
+// cancel releases the reserved slot which is not bound, e.g: the accept fails.
+func (l *connLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	l.pending--
+	l.cond.Signal()
+}
+
+// bind binds the reserved slot to the accepted connection of the remote IP,
+// and returns whether the number of the connections of the IP exceeds the limit.
+// The connection without a valid IP is not limited by IP.
+func (l *connLimiter) bind(ip net.IP) (exceeded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+	if ip == nil {
+		return false
+	}
+	key := ip.String()
+	l.perIP[key]++
+	return l.maxPerIP > 0 && l.perIP[key] > l.maxPerIP
+}
+
+// release releases the slot of the closed connection, the ip must be the one passed to bind.
+func (l *connLimiter) release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if ip != nil {
+		key := ip.String()
+		if l.perIP[key]--; l.perIP[key] <= 0 {
+			delete(l.perIP, key)
+		}
+	}
+	l.cond.Signal()
+}
+
+// close wakes up all waiting reserve calls.
+func (l *connLimiter) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// connections returns the number of the bound slots, i.e: the number of the network connections.
+func (l *connLimiter) connections() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(l.total - l.pending)
+}
+
+// requestIP returns the remote IP of the websocket handshake.
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestConnLimiter(t *testing.T) {
+	a := assert.New(t)
+	l := newConnLimiter()
+	l.setLimits(1, 1)
+	ip := net.ParseIP("10.0.0.1")
+	a.True(l.reserve())
+	a.False(l.bind(ip))
+	a.False(l.tryReserve())
+
+	reserved := make(chan bool, 1)
+	go func() {
+		reserved <- l.reserve()
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("reserve must block if the limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.release(ip)
+	a.True(<-reserved)
+	a.Empty(l.perIP)
+
+	// the connections of the same IP exceed the limit.
+	a.False(l.bind(ip))
+	l.setLimits(0, 1)
+	a.True(l.tryReserve())
+	a.True(l.bind(ip))
+	a.EqualValues(2, l.connections())
+	l.release(ip)
+	l.release(ip)
+	a.Empty(l.perIP)
+	a.Zero(l.connections())
+
+	// the connection without IP is not limited by IP.
+	a.True(l.reserve())
+	a.Zero(l.connections())
+	a.False(l.bind(nil))
+	a.EqualValues(1, l.connections())
+	l.release(nil)
+	a.True(l.reserve())
+	l.cancel()
+	a.Zero(l.total)
+
+	// raising the limit wakes up the waiting reserve.
+	l.setLimits(1, 0)
+	a.True(l.reserve())
+	go func() {
+		reserved <- l.reserve()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.setLimits(2, 0)
+	a.True(<-reserved)
+
+	go func() {
+		reserved <- l.reserve()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.close()
+	a.False(<-reserved)
+	a.False(l.tryReserve())
+
+	var nl *connLimiter
+	nl.setLimits(1, 1)
+	nl.close()
+}
+
+func TestServer_serveTCP_maxConnections(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.connLimiter.setLimits(1, 1)
+	accepted := make(chan string, 2)
+	srv.hooks.OnAccept = func(ctx context.Context, conn net.Conn) bool {
+		accepted <- conn.RemoteAddr().String()
+		return true
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	state := newTCPListenerState(l)
+	done := make(chan struct{})
+	go func() {
+		srv.serveTCP(l, state)
+		close(done)
+	}()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	a.Nil(err)
+	a.Equal(c1.LocalAddr().String(), <-accepted)
+	// the new connection waits in the backlog.
+	c2, err := net.Dial("tcp", l.Addr().String())
+	a.Nil(err)
+	select {
+	case <-accepted:
+		t.Fatal("the listener must stop accepting if max_connections is reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.EqualValues(1, srv.connLimiter.connections())
+
+	_ = c1.Close()
+	select {
+	case addr := <-accepted:
+		a.Equal(c2.LocalAddr().String(), addr)
+	case <-time.After(time.Second):
+		t.Fatal("the listener must accept once a slot is available")
+	}
+	_ = c2.Close()
+	a.Eventually(func() bool {
+		return srv.connLimiter.connections() == 0
+	}, time.Second, 10*time.Millisecond)
+	srv.connLimiter.mu.Lock()
+	a.Empty(srv.connLimiter.perIP)
+	srv.connLimiter.mu.Unlock()
+
+	srv.exit()
+	_ = l.Close()
+	<-done
+}
+
+func TestClient_connectHandler_ipQuotaExceeded(t *testing.T) {
+	a := assert.New(t)
+	for version, code := range map[packets.Version]codes.Code{
+		packets.Version5:   codes.QuotaExceeded,
+		packets.Version311: codes.V3ServerUnavaliable,
+	} {
+		srv := defaultServer()
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.ipQuotaExceeded = true
+		_, _, err = c.connectHandler(&packets.Connect{
+			Version:    version,
+			ClientID:   []byte("cid"),
+			Properties: &packets.Properties{},
+		})
+		a.Equal(code, converError(err).Code)
+	}
+}
+
+func TestServer_wsHandler_maxConnections(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.connLimiter.setLimits(1, 0)
+	a.True(srv.connLimiter.reserve())
+	ws := &WsServer{Server: &http.Server{}, Path: "/"}
+	rec := httptest.NewRecorder()
+	srv.wsHandler(ws, newWebsocketState(ws))(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	a.Equal(http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"path"
+
+	"github.com/DrmagicE/gmqtt/config"
+)
+
+// connectACL is the compiled config.ConnectACL.
+type connectACL struct {
+	denyClientIDs  []string
+	allowClientIDs []string
+	denyNets       []*net.IPNet
+	allowNets      []*net.IPNet
+}
+
+// newConnectACL compiles the config.ConnectACL, it returns nil if the acl is not enabled.
+func newConnectACL(c config.ConnectACL) (*connectACL, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	acl := &connectACL{
+		denyClientIDs:  c.DenyClientIDs,
+		allowClientIDs: c.AllowClientIDs,
+	}
+	for _, v := range c.DenyCIDRs {
+		_, ipNet, _ := net.ParseCIDR(v)
+		acl.denyNets = append(acl.denyNets, ipNet)
+	}
+	for _, v := range c.AllowCIDRs {
+		_, ipNet, _ := net.ParseCIDR(v)
+		acl.allowNets = append(acl.allowNets, ipNet)
+	}
+	return acl, nil
+}
+
+func matchClientID(patterns []string, clientID string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, clientID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the client id from the remote address is allowed to connect, see config.ConnectACL for the precedence rules.
+// The connection without an IP address, e.g: net.Pipe, never matches the CIDRs.
+func (a *connectACL) allowed(clientID string, addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	if matchClientID(a.denyClientIDs, clientID) || containsIP(a.denyNets, ip) {
+		return false
+	}
+	if len(a.allowClientIDs) != 0 && !matchClientID(a.allowClientIDs, clientID) {
+		return false
+	}
+	if len(a.allowNets) != 0 && !containsIP(a.allowNets, ip) {
+		return false
+	}
+	return true
+}
+
+// addrIP returns the IP of the address, nil if the address has no IP.
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestConnectACL_allowed(t *testing.T) {
+	var tt = []struct {
+		name     string
+		acl      config.ConnectACL
+		clientID string
+		remote   string
+		allowed  bool
+	}{
+		{name: "disabled", clientID: "c", remote: "10.0.0.1:1", allowed: true},
+		{
+			name:     "deny_client_id",
+			acl:      config.ConnectACL{DenyClientIDs: []string{"test-*"}},
+			clientID: "test-1", remote: "10.0.0.1:1",
+		},
+		{
+			name:     "not_denied",
+			acl:      config.ConnectACL{DenyClientIDs: []string{"test-*"}},
+			clientID: "prod-1", remote: "10.0.0.1:1", allowed: true,
+		},
+		{
+			name:     "deny_wins_over_allow",
+			acl:      config.ConnectACL{DenyClientIDs: []string{"test-*"}, AllowClientIDs: []string{"*"}},
+			clientID: "test-1", remote: "10.0.0.1:1",
+		},
+		{
+			name:     "allow_is_default_deny",
+			acl:      config.ConnectACL{AllowClientIDs: []string{"prod-*"}},
+			clientID: "dev-1", remote: "10.0.0.1:1",
+		},
+		{
+			name:     "allow_client_id",
+			acl:      config.ConnectACL{AllowClientIDs: []string{"prod-*"}},
+			clientID: "prod-1", remote: "10.0.0.1:1", allowed: true,
+		},
+		{
+			name:     "deny_cidr",
+			acl:      config.ConnectACL{DenyCIDRs: []string{"10.0.0.0/8"}},
+			clientID: "c", remote: "10.1.2.3:1",
+		},
+		{
+			name:     "deny_cidr_wins_over_allow_client_id",
+			acl:      config.ConnectACL{DenyCIDRs: []string{"10.0.0.0/8"}, AllowClientIDs: []string{"c"}},
+			clientID: "c", remote: "10.1.2.3:1",
+		},
+		{
+			name:     "deny_cidr_wins_over_allow_cidr",
+			acl:      config.ConnectACL{DenyCIDRs: []string{"10.0.0.1/32"}, AllowCIDRs: []string{"10.0.0.0/8"}},
+			clientID: "c", remote: "10.0.0.1:1",
+		},
+		{
+			name:     "allow_cidr",
+			acl:      config.ConnectACL{AllowCIDRs: []string{"10.0.0.0/8"}},
+			clientID: "c", remote: "10.0.0.1:1", allowed: true,
+		},
+		{
+			name:     "not_in_allow_cidr",
+			acl:      config.ConnectACL{AllowCIDRs: []string{"10.0.0.0/8"}},
+			clientID: "c", remote: "192.168.0.1:1",
+		},
+		{
+			name:     "both_allow_lists_must_match",
+			acl:      config.ConnectACL{AllowClientIDs: []string{"prod-*"}, AllowCIDRs: []string{"10.0.0.0/8"}},
+			clientID: "prod-1", remote: "192.168.0.1:1",
+		},
+		{
+			name:     "deny_ipv6",
+			acl:      config.ConnectACL{DenyCIDRs: []string{"fd00::/8"}},
+			clientID: "c", remote: "[fd12::1]:1",
+		},
+		{
+			name:     "allow_ipv6",
+			acl:      config.ConnectACL{AllowCIDRs: []string{"2001:db8::/32"}},
+			clientID: "c", remote: "[2001:db8::1]:1", allowed: true,
+		},
+		{
+			name:     "ipv4_not_in_ipv6_cidr",
+			acl:      config.ConnectACL{AllowCIDRs: []string{"2001:db8::/32"}},
+			clientID: "c", remote: "10.0.0.1:1",
+		},
+		{
+			name:     "ipv4_mapped_ipv6",
+			acl:      config.ConnectACL{DenyCIDRs: []string{"10.0.0.0/8"}},
+			clientID: "c", remote: "[::ffff:10.0.0.1]:1",
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			acl, err := newConnectACL(v.acl)
+			a.Nil(err)
+			a.Equal(v.allowed, acl.allowed(v.clientID, remoteConn{addr: v.remote}.RemoteAddr()))
+		})
+	}
+}
+
+func TestConnectACL_noIP(t *testing.T) {
+	a := assert.New(t)
+	acl, err := newConnectACL(config.ConnectACL{AllowCIDRs: []string{"0.0.0.0/0"}})
+	a.Nil(err)
+	a.False(acl.allowed("c", noopConn{}.RemoteAddr()))
+	acl, err = newConnectACL(config.ConnectACL{DenyCIDRs: []string{"0.0.0.0/0"}})
+	a.Nil(err)
+	a.True(acl.allowed("c", noopConn{}.RemoteAddr()))
+
+	_, err = newConnectACL(config.ConnectACL{DenyCIDRs: []string{"10.0.0.1"}})
+	a.Error(err)
+}
+
+func TestClient_connectHandler_connectACL(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.hooks.OnBasicAuth = func(ctx context.Context, client Client, req *ConnectRequest) error {
+		a.FailNow("the auth hook must not be called")
+		return nil
+	}
+	cfg := config.DefaultConfig()
+	cfg.ConnectACL = config.ConnectACL{DenyClientIDs: []string{"test-*"}}
+	srv.ApplyConfig(cfg)
+
+	var tt = []struct {
+		version packets.Version
+		code    codes.Code
+	}{
+		{version: packets.Version5, code: codes.NotAuthorized},
+		{version: packets.Version311, code: codes.V3NotAuthorized},
+	}
+	for _, v := range tt {
+		c, err := srv.newClient(remoteConn{addr: "10.0.0.1:1000"})
+		a.Nil(err)
+		conn := &packets.Connect{
+			Version:  v.version,
+			ClientID: []byte("test-1"),
+		}
+		if v.version == packets.Version5 {
+			conn.Properties = &packets.Properties{}
+		}
+		_, _, err = c.connectHandler(conn)
+		a.Equal(v.code, converError(err).Code)
+	}
+}
+
+func TestServer_ApplyConfig_connectACL(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	conn := &packets.Connect{
+		Version:    packets.Version5,
+		ClientID:   []byte("c"),
+		Properties: &packets.Properties{},
+	}
+	c, err := srv.newClient(remoteConn{addr: "10.0.0.1:1000"})
+	a.Nil(err)
+	_, _, err = c.connectHandler(conn)
+	a.Nil(err)
+
+	// the client reconnects after the IP is denied.
+	cfg := config.DefaultConfig()
+	cfg.ConnectACL = config.ConnectACL{DenyCIDRs: []string{"10.0.0.0/24"}}
+	srv.ApplyConfig(cfg)
+	c, err = srv.newClient(remoteConn{addr: "10.0.0.1:1001"})
+	a.Nil(err)
+	_, _, err = c.connectHandler(conn)
+	a.Equal(codes.NotAuthorized, converError(err).Code)
+
+	// the invalid acl is ignored.
+	cfg.ConnectACL = config.ConnectACL{DenyCIDRs: []string{"invalid"}}
+	srv.ApplyConfig(cfg)
+	c, err = srv.newClient(remoteConn{addr: "10.0.0.1:1002"})
+	a.Nil(err)
+	_, _, err = c.connectHandler(conn)
+	a.Equal(codes.NotAuthorized, converError(err).Code)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// ConnectRejection is a CONNECT rejected by the server, see ClientService.RecentConnectRejections.
+type ConnectRejection struct {
+	// ClientID is the client id in the CONNECT packet, empty if the client did not send one,
+	// or the connection was rejected before the CONNECT packet.
+	ClientID string
+	// Username is the username in the CONNECT packet.
+	Username string
+	// RemoteAddr is the source address of the connection.
+	RemoteAddr string
+	// Version is the protocol version of the CONNECT packet, 0 if the CONNECT packet was not received.
+	Version packets.Version
+	// Code is the reason code of the CONNACK. The MQTT v3.x clients which are rejected while draining
+	// are closed without CONNACK, the code is codes.ServerUnavailable in that case.
+	Code codes.Code
+	// Reason describes why the CONNECT is rejected, e.g: "banned" or "bad user name or password".
+	Reason string
+	// RejectedAt is the time when the CONNECT was rejected.
+	RejectedAt time.Time
+}
+
+// connectRejections is the bounded ring buffer of the recently rejected CONNECTs, see config.MQTT.ConnectRejectionBufferSize.
+// nil means the rejections are not recorded.
+type connectRejections struct {
+	mu  sync.Mutex
+	buf []ConnectRejection
+	// next is the index to write the next rejection.
+	next int
+	// n is the number of the recorded rejections, at most len(buf).
+	n int
+}
+
+func newConnectRejections(size int) *connectRejections {
+	if size <= 0 {
+		return nil
+	}
+	return &connectRejections{
+		buf: make([]ConnectRejection, size),
+	}
+}
+
+// add records the rejection, the oldest one is overwritten if the buffer is full.
+func (r *connectRejections) add(rejection ConnectRejection) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = rejection
+	r.next = (r.next + 1) % len(r.buf)
+	if r.n < len(r.buf) {
+		r.n++
+	}
+}
+
+// recent returns the recorded rejections, the most recent one first.
+func (r *connectRejections) recent() []ConnectRejection {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rs := make([]ConnectRejection, 0, r.n)
+	for i := 1; i <= r.n; i++ {
+		rs = append(rs, r.buf[(r.next-i+len(r.buf))%len(r.buf)])
+	}
+	return rs
+}
+
+// RecentConnectRejections implements ClientService.
+func (c *clientService) RecentConnectRejections() []ConnectRejection {
+	return c.srv.connectRejections.recent()
+}
+
+// connackReasons describes the failure reason codes of the CONNACK.
+var connackReasons = map[codes.Code]string{
+	codes.UnspecifiedError:            "unspecified error",
+	codes.MalformedPacket:             "malformed packet",
+	codes.ProtocolError:               "protocol error",
+	codes.ImplementationSpecificError: "implementation specific error",
+	codes.UnsupportedProtocolVersion:  "unsupported protocol version",
+	codes.ClientIdentifierNotValid:    "client identifier not valid",
+	codes.BadUserNameOrPassword:       "bad user name or password",
+	codes.NotAuthorized:               "not authorized",
+	codes.ServerUnavailable:           "server unavailable",
+	codes.ServerBusy:                  "server busy",
+	codes.Banned:                      "banned",
+	codes.BadAuthMethod:               "bad authentication method",
+	codes.TopicNameInvalid:            "topic name invalid",
+	codes.PacketTooLarge:              "packet too large",
+	codes.QuotaExceeded:               "quota exceeded",
+	codes.PayloadFormatInvalid:        "payload format invalid",
+	codes.RetainNotSupported:          "retain not supported",
+	codes.QoSNotSupported:             "QoS not supported",
+	codes.UseAnotherServer:            "use another server",
+	codes.ServerMoved:                 "server moved",
+	codes.ConnectionRateExceeded:      "connection rate exceeded",
+}
+
+// v3ConnackReasons describes the failure return codes of the MQTT v3.x CONNACK.
+var v3ConnackReasons = map[codes.Code]string{
+	codes.V3UnacceptableProtocolVersion: "unacceptable protocol version",
+	codes.V3IdentifierRejected:          "identifier rejected",
+	codes.V3ServerUnavaliable:           "server unavailable",
+	codes.V3BadUsernameorPassword:       "bad user name or password",
+	codes.V3NotAuthorized:               "not authorized",
+}
+
+// rejectConnect sets the reason of the rejected CONNECT which is more specific than the reason code,
+// e.g: "banned" for the "Not authorized" CONNACK. It returns the error of the code.
+func (client *client) rejectConnect(code codes.Code, reason string) error {
+	client.connectRejectReason = reason
+	return &codes.Error{
+		Code: code,
+	}
+}
+
+// connectRejected records the rejected CONNECT and calls the OnConnectRejected hook.
+// code is the reason code of the CONNACK, conn is nil if the CONNECT packet was not received.
+func (client *client) connectRejected(conn *packets.Connect, code codes.Code, err error) {
+	srv := client.server
+	if srv == nil || (srv.connectRejections == nil && srv.hooks.OnConnectRejected == nil) {
+		return
+	}
+	r := &ConnectRejection{
+		RemoteAddr: client.rwc.RemoteAddr().String(),
+		Version:    client.version,
+		Code:       code,
+		Reason:     client.connectRejectReason,
+		RejectedAt: srv.clock.Now(),
+	}
+	if conn != nil {
+		r.ClientID = string(conn.ClientID)
+		r.Username = string(conn.Username)
+	}
+	if r.Reason == "" {
+		if ce := converError(err); len(ce.ReasonString) != 0 {
+			r.Reason = string(ce.ReasonString)
+		} else if packets.IsVersion3X(r.Version) && code < codes.UnspecifiedError {
+			r.Reason = v3ConnackReasons[code]
+		} else {
+			r.Reason = connackReasons[code]
+		}
+		if r.Reason == "" {
+			r.Reason = fmt.Sprintf("reason code 0x%02X", code)
+		}
+	}
+	srv.connectRejections.add(*r)
+	if srv.hooks.OnConnectRejected != nil {
+		srv.hooks.OnConnectRejected(context.Background(), r)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestConnectRejections(t *testing.T) {
+	a := assert.New(t)
+	a.Nil(newConnectRejections(0))
+	var r *connectRejections
+	r.add(ConnectRejection{ClientID: "a"})
+	a.Nil(r.recent())
+
+	r = newConnectRejections(3)
+	a.Empty(r.recent())
+	for i := 0; i < 2; i++ {
+		r.add(ConnectRejection{ClientID: strconv.Itoa(i)})
+	}
+	ids := func() (rs []string) {
+		for _, v := range r.recent() {
+			rs = append(rs, v.ClientID)
+		}
+		return rs
+	}
+	a.Equal([]string{"1", "0"}, ids())
+	for i := 2; i < 5; i++ {
+		r.add(ConnectRejection{ClientID: strconv.Itoa(i)})
+	}
+	// the oldest ones are overwritten.
+	a.Equal([]string{"4", "3", "2"}, ids())
+}
+
+func TestClient_connectRejected(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.connectRejections = newConnectRejections(10)
+	var hooked []*ConnectRejection
+	srv.hooks.OnConnectRejected = func(ctx context.Context, rejection *ConnectRejection) {
+		hooked = append(hooked, rejection)
+	}
+	cs := &clientService{srv: srv}
+	a.Nil(cs.Ban(&ban.Ban{Type: ban.TypeClientID, Value: "banned", ExpiresAt: time.Now().Add(time.Hour)}))
+
+	var tt = []struct {
+		connect *packets.Connect
+		auth    OnBasicAuth
+		code    codes.Code
+		reason  string
+	}{
+		{
+			connect: &packets.Connect{Version: packets.Version5, ClientID: []byte("banned"), Properties: &packets.Properties{}},
+			code:    codes.NotAuthorized,
+			reason:  "banned",
+		},
+		{
+			connect: &packets.Connect{Version: packets.Version311, ClientID: []byte("cid"), Username: []byte("user")},
+			auth: func(ctx context.Context, client Client, req *ConnectRequest) error {
+				return &codes.Error{Code: codes.V3BadUsernameorPassword}
+			},
+			code:   codes.V3BadUsernameorPassword,
+			reason: "bad user name or password",
+		},
+		{
+			connect: &packets.Connect{Version: packets.Version5, ClientID: []byte("cid"), Properties: &packets.Properties{}},
+			auth: func(ctx context.Context, client Client, req *ConnectRequest) error {
+				return &codes.Error{Code: codes.NotAuthorized, ErrorDetails: codes.ErrorDetails{ReasonString: []byte("expired token")}}
+			},
+			code:   codes.NotAuthorized,
+			reason: "expired token",
+		},
+	}
+	for _, v := range tt {
+		srv.hooks.OnBasicAuth = v.auth
+		c, err := srv.newClient(remoteConn{addr: "10.0.0.1:1883"})
+		a.Nil(err)
+		c.in <- v.connect
+		a.False(c.connectWithTimeOut())
+		a.Equal(v.code, (<-c.out).(*packets.Connack).Code)
+	}
+
+	rs := cs.RecentConnectRejections()
+	a.Len(rs, len(tt))
+	a.Len(hooked, len(tt))
+	for i, v := range tt {
+		// the most recent one first.
+		r := rs[len(rs)-1-i]
+		a.Equal(*hooked[i], r)
+		a.Equal(string(v.connect.ClientID), r.ClientID)
+		a.Equal(string(v.connect.Username), r.Username)
+		a.Equal("10.0.0.1:1883", r.RemoteAddr)
+		a.Equal(v.connect.Version, r.Version)
+		a.Equal(v.code, r.Code)
+		a.Equal(v.reason, r.Reason)
+		a.False(r.RejectedAt.IsZero())
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"time"
+)
+
+// cpuAccounter samples the time spent processing the packets in one direction of a client.
+// It is not concurrency-safe, the read and write goroutine of the client own one each.
+// See config.CPUAccounting for details.
+type cpuAccounter struct {
+	sampleRate int
+	count      int
+}
+
+func newCPUAccounter(sampleRate int) *cpuAccounter {
+	return &cpuAccounter{
+		sampleRate: sampleRate,
+	}
+}
+
+// start returns the current time if the packet should be measured, otherwise returns zero time.
+func (c *cpuAccounter) start() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	c.count++
+	if c.count < c.sampleRate {
+		return time.Time{}
+	}
+	c.count = 0
+	return time.Now()
+}
+
+// elapsed returns the estimated time spent since start.
+func (c *cpuAccounter) elapsed(start time.Time) time.Duration {
+	return time.Since(start) * time.Duration(c.sampleRate)
+}
+
+// accountCPU records the estimated time spent since start, the start time is returned by cpuAccounter.start.
+func (client *client) accountCPU(read bool, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	acc := client.writeCPU
+	if read {
+		acc = client.readCPU
+	}
+	client.server.statsManager.cpuTimeSpent(client.opts.ClientID, read, acc.elapsed(start))
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+)
+
+func TestCPUAccounter_start(t *testing.T) {
+	a := assert.New(t)
+	var nilAcc *cpuAccounter
+	a.True(nilAcc.start().IsZero())
+
+	acc := newCPUAccounter(3)
+	var sampled int
+	for i := 0; i < 9; i++ {
+		if !acc.start().IsZero() {
+			sampled++
+		}
+	}
+	a.Equal(3, sampled)
+	a.True(acc.elapsed(time.Now().Add(-time.Second)) >= 3*time.Second)
+}
+
+func TestClient_accountCPU(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	srv.config().CPUAccounting = config.CPUAccounting{
+		Enable:     true,
+		SampleRate: 1,
+	}
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	a.NotNil(c.readCPU)
+	a.NotNil(c.writeCPU)
+
+	c.accountCPU(true, c.readCPU.start().Add(-time.Second))
+	c.accountCPU(false, c.writeCPU.start().Add(-2*time.Second))
+	// not sampled
+	c.accountCPU(true, time.Time{})
+
+	sts, ok := srv.statsManager.GetClientStats("cid")
+	a.True(ok)
+	a.True(sts.CPUStats.ReadNanoseconds >= uint64(time.Second))
+	a.True(sts.CPUStats.ReadNanoseconds < uint64(2*time.Second))
+	a.True(sts.CPUStats.WriteNanoseconds >= uint64(2*time.Second))
+
+	srv.config().CPUAccounting.Enable = false
+	c, err = srv.newClient(noopConn{})
+	a.Nil(err)
+	a.Nil(c.readCPU)
+	a.Nil(c.writeCPU)
+}
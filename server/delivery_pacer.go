@@ -0,0 +1,38 @@
+package server
+
+import "time"
+
+// deliveryPacer paces the delivery of the messages to a client, see config.MQTT.DeliveryRateLimit.
+// It allows one message per interval without bursts.
+type deliveryPacer struct {
+	interval time.Duration
+	// next is the earliest time that the next message is allowed to be delivered.
+	next time.Time
+}
+
+// newDeliveryPacer returns nil if rate is not positive, which means no limit.
+func newDeliveryPacer(rate int) *deliveryPacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &deliveryPacer{
+		interval: time.Second / time.Duration(rate),
+	}
+}
+
+// wait blocks until the next message is allowed to be delivered.
+// It returns false if the close channel is closed while waiting.
+func (p *deliveryPacer) wait(now time.Time, close <-chan struct{}) bool {
+	if p.next.After(now) {
+		t := time.NewTimer(p.next.Sub(now))
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-close:
+			return false
+		}
+		now = p.next
+	}
+	p.next = now.Add(p.interval)
+	return true
+}
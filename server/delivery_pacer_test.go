@@ -0,0 +1,118 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// pacedQueue is a queue.Store which returns at most len(ids) elems in each Read and blocks if it is empty.
+type pacedQueue struct {
+	queue.Store
+	mu    sync.Mutex
+	elems []*queue.Elem
+	close chan struct{}
+}
+
+func (q *pacedQueue) ReadInflight(maxSize uint) ([]*queue.Elem, error) {
+	return nil, nil
+}
+
+func (q *pacedQueue) Read(pids []packets.PacketID) ([]*queue.Elem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.elems) == 0 {
+		q.mu.Unlock()
+		<-q.close
+		q.mu.Lock()
+		return nil, nil
+	}
+	n := len(pids)
+	if n > len(q.elems) {
+		n = len(q.elems)
+	}
+	elems := q.elems[:n]
+	q.elems = q.elems[n:]
+	return elems, nil
+}
+
+func (q *pacedQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.elems)
+}
+
+func TestDeliveryPacer(t *testing.T) {
+	a := assert.New(t)
+	a.Nil(newDeliveryPacer(0))
+
+	p := newDeliveryPacer(10)
+	a.Equal(100*time.Millisecond, p.interval)
+	now := time.Now()
+	a.True(p.wait(now, nil))
+	a.Equal(now.Add(p.interval), p.next)
+
+	// no burst after idle.
+	later := now.Add(time.Hour)
+	a.True(p.wait(later, nil))
+	a.Equal(later.Add(p.interval), p.next)
+
+	closed := make(chan struct{})
+	p.next = time.Now().Add(time.Hour)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(closed)
+	}()
+	a.False(p.wait(time.Now(), closed))
+}
+
+func TestClient_pollMessageHandler_deliveryRateLimit(t *testing.T) {
+	a := assert.New(t)
+	const n = 5
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version311
+	c.opts.MaxInflight = 10
+	c.opts.DeliveryRateLimit = 20
+	c.newPacketIDLimiter(c.opts.MaxInflight)
+	q := &pacedQueue{close: c.close}
+	for i := 0; i < n; i++ {
+		q.elems = append(q.elems, &queue.Elem{
+			At:            time.Now(),
+			MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "topic", QoS: packets.Qos0}},
+		})
+	}
+	c.queueStore = q
+
+	done := make(chan struct{})
+	go func() {
+		c.pollMessageHandler()
+		close(done)
+	}()
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		select {
+		case p := <-c.out:
+			a.IsType(&packets.Publish{}, p)
+		case <-time.After(time.Second):
+			t.Fatal("message not delivered")
+		}
+		if i == 0 {
+			// the rest are buffered in the queue.
+			a.Equal(n-1, q.len())
+		}
+	}
+	a.True(time.Since(start) >= (n-1)*50*time.Millisecond)
+	c.setError(nil)
+	<-done
+}
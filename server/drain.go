@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+// drainCheckInterval is the interval to check whether the connected clients have been drained.
+var drainCheckInterval = 100 * time.Millisecond
+
+// Drain stops accepting new connections and waits for the connected clients to complete
+// the outbound QoS 1/QoS 2 handshakes and flush the queued messages, then closes the remaining clients.
+// The new CONNECT packets received during draining are refused with "Server unavailable" CONNACK,
+// or closed without CONNACK for the MQTT v3.x clients.
+// The inbound QoS 2 messages have been delivered on receipt, Drain does not wait for their PUBREL packets.
+//
+// It returns when all connected clients are drained, or returns the context error when the context is done,
+// the clients are closed in either case. It is safe to call Drain more than once, and Stop is still required
+// to stop the server after draining.
+func (srv *server) Drain(ctx context.Context) error {
+	srv.drainOnce.Do(func() {
+		zaplog.Info("draining gmqtt server")
+		srv.transitLifecycle(StateDraining)
+		srv.closeListeners(ctx)
+	})
+	var err error
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+wait:
+	for !srv.drained() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			zaplog.Warn("drain timeout, closing the remaining clients", zap.Error(err))
+			break wait
+		case <-ticker.C:
+		}
+	}
+	srv.mu.Lock()
+	clients := make([]*client, 0, len(srv.clients))
+	for _, c := range srv.clients {
+		clients = append(clients, c)
+	}
+	srv.mu.Unlock()
+	for _, c := range clients {
+		c.setError(codes.NewError(codes.ServerShuttingDown))
+		c.Close()
+	}
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		select {
+		case <-c.closed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	zaplog.Info("server drained", zap.Int("closed_clients", len(clients)))
+	return nil
+}
+
+// closeListeners closes all TCP listeners and shuts down all websocket servers.
+func (srv *server) closeListeners(ctx context.Context) {
+	for _, l := range srv.tcpListener {
+		l.Close()
+	}
+	for _, ws := range srv.websocketServer {
+		ws.Server.Shutdown(ctx)
+	}
+}
+
+// drained reports whether all connected clients have no inflight and queued messages.
+func (srv *server) drained() bool {
+	srv.mu.Lock()
+	ids := make([]string, 0, len(srv.clients))
+	for id := range srv.clients {
+		ids = append(ids, id)
+	}
+	srv.mu.Unlock()
+	for _, id := range ids {
+		sts, ok := srv.statsManager.copyClientStats(id)
+		if ok && (sts.MessageStats.InflightCurrent != 0 || sts.MessageStats.QueuedCurrent != 0) {
+			return false
+		}
+	}
+	return true
+}
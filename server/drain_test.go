@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestServer_Drain(t *testing.T) {
+	a := assert.New(t)
+	drainCheckInterval = time.Millisecond
+	srv := defaultServer()
+	srv.lifecycleState = int32(StateReady)
+	srv.statsManager = newStatsManager(mem.NewStore())
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	srv.clients["cid"] = c
+	srv.statsManager.addQueueLen("cid", 1)
+
+	// the queued message is not flushed before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	a.Equal(context.DeadlineExceeded, srv.Drain(ctx))
+	a.Equal(StateDraining, srv.LifecycleState())
+	a.Equal(codes.ServerShuttingDown, converError(c.err).Code)
+
+	// drained after the message is flushed and the client is closed.
+	srv.statsManager.decQueueLen("cid", 1)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(c.closed)
+	}()
+	a.Nil(srv.Drain(context.Background()))
+}
+
+func TestClient_connectWithTimeOut_draining(t *testing.T) {
+	var tt = []struct {
+		name    string
+		version packets.Version
+		connack bool
+	}{
+		{name: "v5", version: packets.Version5, connack: true},
+		{name: "v311", version: packets.Version311},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.lifecycleState = int32(StateDraining)
+			c, _ := srv.newClient(noopConn{})
+			c.in <- &packets.Connect{
+				Version:    v.version,
+				ClientID:   []byte("cid"),
+				Properties: &packets.Properties{},
+			}
+			c.register = func(connect *packets.Connect, client *client) (sessionResume bool, err error) {
+				panic("should not call register while draining")
+			}
+			a.False(c.connectWithTimeOut())
+			if v.connack {
+				a.Equal(codes.ServerUnavailable, (<-c.out).(*packets.Connack).Code)
+			} else {
+				a.Len(c.out, 0)
+			}
+		})
+	}
+}
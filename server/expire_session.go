@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrClientConnected will be returned by ExpireSession if the client is connected.
+var ErrClientConnected = errors.New("client is connected")
+
+// ExpireSession implements ClientService.
+func (c *clientService) ExpireSession(clientID string) error {
+	srv := c.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.clients[clientID]; ok {
+		return ErrClientConnected
+	}
+	if _, ok := srv.offlineClients[clientID]; !ok {
+		return ErrSessionNotFound
+	}
+	return srv.expireSessionLocked(clientID)
+}
+
+// SetSessionExpiry implements ClientService.
+func (c *clientService) SetSessionExpiry(clientID string, expiry uint32) error {
+	srv := c.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	_, connected := srv.clients[clientID]
+	expiresAt, disconnected := srv.offlineClients[clientID]
+	if !connected && !disconnected {
+		return ErrSessionNotFound
+	}
+	sess, err := srv.sessionStore.Get(clientID)
+	if err != nil {
+		return err
+	}
+	if sess == nil {
+		return ErrSessionNotFound
+	}
+	// offlineClients records the disconnect time plus the previous interval.
+	disconnectedAt := expiresAt.Add(-time.Duration(sess.ExpiryInterval) * time.Second)
+	err = srv.sessionStore.SetSessionExpiry(clientID, expiry)
+	if err != nil || connected {
+		return err
+	}
+	expiresAt = disconnectedAt.Add(time.Duration(expiry) * time.Second)
+	if !srv.clock.Now().Before(expiresAt) {
+		return srv.expireSessionLocked(clientID)
+	}
+	srv.offlineClients[clientID] = expiresAt
+	srv.rescheduleWillLocked(clientID, expiresAt)
+	return nil
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	session_mem "github.com/DrmagicE/gmqtt/persistence/session/mem"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+)
+
+func TestClientService_ExpireSession(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.sessionStore = session_mem.New()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	var terminated []SessionTerminatedReason
+	srv.hooks.OnSessionTerminated = func(ctx context.Context, clientID string, reason SessionTerminatedReason) {
+		a.Equal("offline", clientID)
+		terminated = append(terminated, reason)
+	}
+	cs := &clientService{srv: srv}
+
+	// the session with a long expiry interval.
+	srv.offlineClients["offline"] = srv.clock.Now().Add(time.Hour)
+	a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+		ClientID:       "offline",
+		ExpiryInterval: 3600,
+	}))
+	_, err := srv.subscriptionsDB.Subscribe("offline", &gmqtt.Subscription{TopicFilter: "a"})
+	a.Nil(err)
+	qs := queue.NewMockStore(ctrl)
+	qs.EXPECT().Clean().Return(nil)
+	srv.queueStore["offline"] = qs
+
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "online"
+	srv.clients["online"] = c
+
+	a.Equal(ErrClientConnected, cs.ExpireSession("online"))
+	a.Equal(ErrSessionNotFound, cs.ExpireSession("unknown"))
+
+	a.Nil(cs.ExpireSession("offline"))
+	a.Equal([]SessionTerminatedReason{ExpiredTermination}, terminated)
+	a.NotContains(srv.offlineClients, "offline")
+	a.NotContains(srv.queueStore, "offline")
+	sess, err := srv.sessionStore.Get("offline")
+	a.Nil(err)
+	a.Nil(sess)
+	srv.subscriptionsDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+		t.Fatalf("unexpected subscription: %s", sub.TopicFilter)
+		return true
+	}, subscription.IterationOptions{Type: subscription.TypeAll, ClientID: "offline"})
+
+	a.Equal(ErrSessionNotFound, cs.ExpireSession("offline"))
+}
+
+func TestServer_sessionExpireCheck(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	clk := newTestClock()
+	srv := defaultServer()
+	srv.clock = clk
+	srv.sessionStore = session_mem.New()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	var terminated []string
+	srv.hooks.OnSessionTerminated = func(ctx context.Context, clientID string, reason SessionTerminatedReason) {
+		a.Equal(ExpiredTermination, reason)
+		terminated = append(terminated, clientID)
+	}
+	disconnect := func(clientID string, expiry uint32) {
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.opts.ClientID = clientID
+		a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+			ClientID:       clientID,
+			ExpiryInterval: expiry,
+		}))
+		qs := queue.NewMockStore(ctrl)
+		srv.queueStore[clientID] = qs
+		srv.clients[clientID] = c
+		srv.unregisterClient(c)
+	}
+	disconnect("short", 10)
+	disconnect("long", 60)
+	srv.queueStore["short"].(*queue.MockStore).EXPECT().Clean().Return(nil)
+
+	clk.Advance(10 * time.Second)
+	srv.sessionExpireCheck()
+	a.Empty(terminated)
+
+	clk.Advance(time.Nanosecond)
+	srv.sessionExpireCheck()
+	a.Equal([]string{"short"}, terminated)
+	a.NotContains(srv.offlineClients, "short")
+	a.Contains(srv.offlineClients, "long")
+
+	srv.queueStore["long"].(*queue.MockStore).EXPECT().Clean().Return(nil)
+	clk.Advance(50 * time.Second)
+	srv.sessionExpireCheck()
+	a.Equal([]string{"short", "long"}, terminated)
+	a.Empty(srv.offlineClients)
+}
+
+func TestClientService_SetSessionExpiry(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	clk := newTestClock()
+	srv := defaultServer()
+	srv.clock = clk
+	srv.sessionStore = session_mem.New()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	var terminated []string
+	srv.hooks.OnSessionTerminated = func(ctx context.Context, clientID string, reason SessionTerminatedReason) {
+		a.Equal(ExpiredTermination, reason)
+		terminated = append(terminated, clientID)
+	}
+	cs := &clientService{srv: srv}
+	connect := func(clientID string, expiry uint32) *client {
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.opts.ClientID = clientID
+		a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+			ClientID:       clientID,
+			ExpiryInterval: expiry,
+		}))
+		srv.queueStore[clientID] = queue.NewMockStore(ctrl)
+		srv.clients[clientID] = c
+		return c
+	}
+	expectClean := func(clientID string) {
+		srv.queueStore[clientID].(*queue.MockStore).EXPECT().Clean().Return(nil)
+	}
+	srv.unregisterClient(connect("extend", 10))
+	srv.unregisterClient(connect("shorten", 60))
+	srv.unregisterClient(connect("zero", 60))
+	online := connect("online", 10)
+
+	a.Equal(ErrSessionNotFound, cs.SetSessionExpiry("unknown", 10))
+
+	clk.Advance(5 * time.Second)
+	a.Nil(cs.SetSessionExpiry("extend", 60))
+	a.Nil(cs.SetSessionExpiry("shorten", 10))
+	a.Nil(cs.SetSessionExpiry("online", 20))
+	sess, err := srv.sessionStore.Get("online")
+	a.Nil(err)
+	a.EqualValues(20, sess.ExpiryInterval)
+
+	// expires immediately.
+	expectClean("zero")
+	a.Nil(cs.SetSessionExpiry("zero", 0))
+	a.Equal([]string{"zero"}, terminated)
+	a.NotContains(srv.offlineClients, "zero")
+
+	// the new interval is counted from the disconnect time.
+	expectClean("shorten")
+	clk.Advance(5*time.Second + time.Nanosecond)
+	srv.sessionExpireCheck()
+	a.Equal([]string{"zero", "shorten"}, terminated)
+	a.Contains(srv.offlineClients, "extend")
+
+	// the connected client applies the new interval after disconnect.
+	srv.unregisterClient(online)
+	a.Equal(clk.Now().Add(20*time.Second), srv.offlineClients["online"])
+
+	// shortening the interval to the elapsed time expires the session immediately.
+	clk.Advance(10 * time.Second)
+	expectClean("online")
+	a.Nil(cs.SetSessionExpiry("online", 5))
+	a.Equal([]string{"zero", "shorten", "online"}, terminated)
+
+	expectClean("extend")
+	clk.Advance(40 * time.Second)
+	srv.sessionExpireCheck()
+	a.Equal([]string{"zero", "shorten", "online", "extend"}, terminated)
+	a.Empty(srv.offlineClients)
+}
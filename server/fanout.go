@@ -0,0 +1,122 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+// minPooledFanout is the minimum number of the matched subscribers to use the fanout pool,
+// the smaller fanout is queued by the publisher directly, which is cheaper than handing it to the workers.
+const minPooledFanout = 64
+
+// fanoutTarget is a matched subscriber of the routed message.
+type fanoutTarget struct {
+	clientID string
+	sub      *gmqtt.Subscription
+	ids      []uint32
+	q        queue.Store
+}
+
+// fanoutPool adds the routed message to the queues of the matched subscribers with a fixed number of workers.
+// The subscribers are partitioned by client id, the messages to the same client are always added by the same worker in order.
+//
+// The caller must hold srv.mu and waits for all partitions to be done,
+// so the workers can read the server states safely without holding the lock.
+// The statsManager updates are still serialized by its own lock, the workers only run the queue writes in parallel.
+// The OnMsgDropped hook is called by the workers concurrently, see OnMsgDropped.
+type fanoutPool struct {
+	workers []chan func()
+	wg      sync.WaitGroup
+}
+
+func newFanoutPool(size int) *fanoutPool {
+	p := &fanoutPool{
+		workers: make([]chan func(), size),
+	}
+	p.wg.Add(size)
+	for i := range p.workers {
+		p.workers[i] = make(chan func())
+		go p.work(p.workers[i])
+	}
+	return p
+}
+
+func (p *fanoutPool) work(ch chan func()) {
+	defer p.wg.Done()
+	for fn := range ch {
+		fn()
+	}
+}
+
+// partition returns the partition of the client, it is the FNV-1a hash of the client id modulo the pool size.
+func (p *fanoutPool) partition(clientID string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(clientID); i++ {
+		h ^= uint32(clientID[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(p.workers)))
+}
+
+// run calls fn with each non-empty partition in the corresponding worker and blocks until all of them return.
+func (p *fanoutPool) run(parts [][]fanoutTarget, fn func(targets []fanoutTarget)) {
+	var wg sync.WaitGroup
+	for i, targets := range parts {
+		if len(targets) == 0 {
+			continue
+		}
+		targets := targets
+		wg.Add(1)
+		p.workers[i] <- func() {
+			defer wg.Done()
+			fn(targets)
+		}
+	}
+	wg.Wait()
+}
+
+// stop stops all workers and waits for them to exit.
+func (p *fanoutPool) stop() {
+	for _, ch := range p.workers {
+		close(ch)
+	}
+	p.wg.Wait()
+}
+
+// fanoutLocked adds the message to the queues of the targets,
+// it returns true if the message is rejected by any of the queues, see addMsgToQueueLocked.
+func (srv *server) fanoutLocked(now time.Time, msg *gmqtt.Message, targets []fanoutTarget) (rejected bool) {
+	if srv.fanout == nil || len(targets) < minPooledFanout {
+		for _, t := range targets {
+			if srv.addMsgToQueueLocked(now, t.clientID, msg.Copy(), t.sub, t.ids, t.q) {
+				rejected = true
+			}
+		}
+		return rejected
+	}
+	parts := make([][]fanoutTarget, len(srv.fanout.workers))
+	for _, t := range targets {
+		// the batches are not safe for concurrent use, so the batched messages are added by the publisher.
+		if t.sub.Batch && srv.batcher != nil {
+			if srv.addMsgToQueueLocked(now, t.clientID, msg.Copy(), t.sub, t.ids, t.q) {
+				rejected = true
+			}
+			continue
+		}
+		i := srv.fanout.partition(t.clientID)
+		parts[i] = append(parts[i], t)
+	}
+	var rejectedFlag int32
+	srv.fanout.run(parts, func(targets []fanoutTarget) {
+		for _, t := range targets {
+			if srv.addMsgToQueueLocked(now, t.clientID, msg.Copy(), t.sub, t.ids, t.q) {
+				atomic.StoreInt32(&rejectedFlag, 1)
+			}
+		}
+	})
+	return rejected || atomic.LoadInt32(&rejectedFlag) == 1
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// recordQueue is a queue.Store which records the payloads of the added messages.
+type recordQueue struct {
+	queue.Store
+	payloads []string
+	full     bool
+}
+
+func (q *recordQueue) Add(elem *queue.Elem) error {
+	if q.full {
+		return queue.ErrDropQueueFull
+	}
+	q.payloads = append(q.payloads, string(elem.MessageWithID.(*queue.Publish).Payload))
+	return nil
+}
+
+// countQueue is a queue.Store which only counts the added elems.
+type countQueue struct {
+	queue.Store
+	added uint64
+}
+
+func (q *countQueue) Add(elem *queue.Elem) error {
+	atomic.AddUint64(&q.added, 1)
+	return nil
+}
+
+// slowQueue is a countQueue which takes the delay to add the elem.
+type slowQueue struct {
+	countQueue
+	delay time.Duration
+}
+
+func (q *slowQueue) Add(elem *queue.Elem) error {
+	time.Sleep(q.delay)
+	return q.countQueue.Add(elem)
+}
+
+func newFanoutServer(workers int) *server {
+	srv := defaultServer()
+	srv.config().MQTT.QueueQos0Msg = true
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	if workers > 1 {
+		srv.fanout = newFanoutPool(workers)
+	}
+	return srv
+}
+
+func TestServer_deliver_fanoutOrder(t *testing.T) {
+	for _, mode := range []string{Overlap, OnlyOnce} {
+		t.Run(mode, func(t *testing.T) {
+			a := assert.New(t)
+			srv := newFanoutServer(4)
+			defer srv.fanout.stop()
+			srv.config().MQTT.DeliveryMode = mode
+			queues := make(map[string]*recordQueue)
+			for i := 0; i < 2*minPooledFanout; i++ {
+				clientID := "sub" + strconv.Itoa(i)
+				// the overlapping subscriptions of the client are queued in order as well.
+				_, err := srv.subscriptionsDB.Subscribe(clientID,
+					&gmqtt.Subscription{TopicFilter: "fanout/#"},
+					&gmqtt.Subscription{TopicFilter: "fanout/+"},
+				)
+				a.Nil(err)
+				queues[clientID] = &recordQueue{}
+				srv.queueStore[clientID] = queues[clientID]
+			}
+			var expected []string
+			for i := 0; i < 20; i++ {
+				payload := strconv.Itoa(i)
+				expected = append(expected, payload)
+				if mode == Overlap {
+					expected = append(expected, payload)
+				}
+				matched, rejected := srv.deliver("pub", &gmqtt.Message{
+					Topic:   "fanout/a",
+					Payload: []byte(payload),
+				}, defaultIterateOptions("fanout/a"))
+				a.True(matched)
+				a.False(rejected)
+			}
+			for clientID, q := range queues {
+				a.Equal(expected, q.payloads, clientID)
+			}
+		})
+	}
+}
+
+func TestServer_deliver_fanoutRejected(t *testing.T) {
+	a := assert.New(t)
+	srv := newFanoutServer(4)
+	defer srv.fanout.stop()
+	for i := 0; i < minPooledFanout; i++ {
+		clientID := "sub" + strconv.Itoa(i)
+		_, err := srv.subscriptionsDB.Subscribe(clientID, &gmqtt.Subscription{TopicFilter: "fanout/#"})
+		a.Nil(err)
+		srv.queueStore[clientID] = &recordQueue{full: i == minPooledFanout-1}
+	}
+	_, rejected := srv.deliver("pub", &gmqtt.Message{Topic: "fanout/a"}, defaultIterateOptions("fanout/a"))
+	a.True(rejected)
+}
+
+func TestFanoutPool_stop(t *testing.T) {
+	a := assert.New(t)
+	n := runtime.NumGoroutine()
+	p := newFanoutPool(8)
+	a.Equal(n+8, runtime.NumGoroutine())
+	p.stop()
+	// the workers may not have exited right after Done is called.
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(n, runtime.NumGoroutine())
+}
+
+// BenchmarkServer_deliver_fanout publishes QoS 0 messages to 50k subscribers,
+// the queue writes of the "slow" queues take 1ms for every 1000 subscribers.
+// fanout_workers_1 is the delivery without the workers.
+func BenchmarkServer_deliver_fanout(b *testing.B) {
+	const subscribers = 50000
+	for _, slow := range []bool{false, true} {
+		for _, workers := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("slow_%t/fanout_workers_%d", slow, workers), func(b *testing.B) {
+				srv := newFanoutServer(workers)
+				if srv.fanout != nil {
+					defer srv.fanout.stop()
+				}
+				for i := 0; i < subscribers; i++ {
+					clientID := "sub" + strconv.Itoa(i)
+					srv.subscriptionsDB.Subscribe(clientID, &gmqtt.Subscription{
+						TopicFilter: "fanout/#",
+					})
+					if slow && i%1000 == 0 {
+						srv.queueStore[clientID] = &slowQueue{delay: time.Millisecond}
+					} else {
+						srv.queueStore[clientID] = &countQueue{}
+					}
+				}
+				msg := &gmqtt.Message{
+					Topic:   "fanout/topic",
+					QoS:     packets.Qos0,
+					Payload: []byte("payload"),
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					srv.mu.Lock()
+					srv.deliver("pub", msg, defaultIterateOptions(msg.Topic))
+					srv.mu.Unlock()
+				}
+			})
+		}
+	}
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"net"
+	"time"
 
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
@@ -29,6 +31,21 @@ type Hooks struct {
 	OnMsgDropped
 	OnWillPublish
 	OnWillPublished
+	OnWillDelayed
+	OnWillDelay
+	OnReconnectStorm
+	OnLifecycleStateChanged
+	OnKeepAliveTimeout
+	OnSessionTakeover
+	OnMessageDropped
+	OnAuthorize
+	OnTopicRewrite
+	OnRedirect
+	OnSlowConsumer
+	OnTopicPolicy
+	OnConnectRejected
+	OnClientID
+	OnNoSubscriber
 }
 
 // WillMsgRequest is the input param for OnWillPublish hook.
@@ -49,6 +66,8 @@ func (w *WillMsgRequest) Drop() {
 
 // OnWillPublish will be called before the client with the given clientID sending the will message.
 // It provides the ability to modify the message before sending.
+// If IsWillAuthPending reports true, the will message has not been authorized yet,
+// the hooks which forward the messages to other brokers should forward it in OnMsgArrived instead.
 type OnWillPublish func(ctx context.Context, clientID string, req *WillMsgRequest)
 
 type OnWillPublishWrapper func(OnWillPublish) OnWillPublish
@@ -59,17 +78,87 @@ type OnWillPublished func(ctx context.Context, clientID string, msg *gmqtt.Messa
 
 type OnWillPublishedWrapper func(OnWillPublished) OnWillPublished
 
+// OnWillDelayed will be called when the will message of a v5 client is delayed by the will delay interval.
+// OnWillPublish will be called when the delay elapses, unless the session is resumed before that, in which case the will message is discarded.
+// The msg param is immutable, DO NOT EDIT.
+type OnWillDelayed func(ctx context.Context, clientID string, msg *gmqtt.Message, delay time.Duration)
+
+type OnWillDelayedWrapper func(OnWillDelayed) OnWillDelayed
+
+// OnWillDelay will be called when a client with the will message disconnects, to decide whether and when the will message is published.
+// disconnectReason is the reason code of the DISCONNECT packet sent by the client (0x00 for v3.x clients),
+// or the reason code of the error which closed the connection, codes.UnspecifiedError if there is no reason code, e.g: the network failure.
+// The innermost hook implements the spec behavior: the will message is discarded unless the connection is closed abnormally
+// or the v5 client disconnects with "Disconnect with Will Message", and it is delayed by the will delay interval. Call the next hook to fall back to it.
+// Return publish=false to discard the will message, or delay=0 to publish it immediately.
+// The delay is capped by the session expiry interval, and ignored if the session is not kept.
+// The will param is a copy of the will message, which can be modified, e.g: to override the retained flag.
+type OnWillDelay func(ctx context.Context, clientID string, disconnectReason byte, will *gmqtt.Message) (delay time.Duration, publish bool)
+
+type OnWillDelayWrapper func(OnWillDelay) OnWillDelay
+
 // OnAccept will be called after a new connection established in TCP server.
 // If returns false, the connection will be close directly.
 type OnAccept func(ctx context.Context, conn net.Conn) bool
 
 type OnAcceptWrapper func(OnAccept) OnAccept
 
+// OnRedirect will be called when a v5 client connects, before the auth hooks, i.e: the client is not authenticated yet.
+// Return a non-nil ServerRedirect to reject the client with the Server Reference, or nil to accept it.
+// The innermost hook is the policy of config.Redirect, call the next hook to fall back to it.
+// It is not called for v3.1.1 clients, since they cannot be redirected.
+type OnRedirect func(ctx context.Context, client Client, connect *packets.Connect) *ServerRedirect
+
+type OnRedirectWrapper func(OnRedirect) OnRedirect
+
+// OnClientID will be called when a client connects, after OnRedirect and before the auth hooks.
+// It validates the client id in the CONNECT packet, and returns the client id to assign if the client id is empty.
+// Return a non-nil error to reject the client, the codes.Error is replied as is,
+// the other errors are replied with "Client Identifier not valid"(0x85), or "Identifier rejected"(0x02) for v3.1.1 clients.
+// The returned assignedID is ignored if the client id is not empty, and the auth hooks can override it by AuthOptions.AssignedClientID.
+// The innermost hook is the policy of config.ClientIDPolicy, call the next hook to fall back to it.
+type OnClientID func(ctx context.Context, client Client, connect *packets.Connect) (assignedID string, err error)
+
+type OnClientIDWrapper func(OnClientID) OnClientID
+
+// OnTopicPolicy will be called for each inbound PUBLISH after the authorization, with the topic name after the topic rewrite.
+// Return the policy of the topic name, or nil if the topic is not restricted.
+// The innermost hook is the policy of config.TopicPolicy, call the next hook to fall back to it.
+type OnTopicPolicy func(ctx context.Context, client Client, topic string) *TopicPolicy
+
+type OnTopicPolicyWrapper func(OnTopicPolicy) OnTopicPolicy
+
 // OnStop will be called on server.Stop()
 type OnStop func(ctx context.Context)
 
 type OnStopWrapper func(OnStop) OnStop
 
+// OnReconnectStorm will be called when the reconnect storm mitigation is activated or relaxed.
+// It is only called if the reconnect storm detector is enabled, see config.ReconnectStorm.
+type OnReconnectStorm func(ctx context.Context, ev *ReconnectStormEvent)
+
+type OnReconnectStormWrapper func(OnReconnectStorm) OnReconnectStorm
+
+// OnSlowConsumer will be called when a connected client is detected as a slow consumer.
+// It is only called if the slow consumer detector is enabled, see config.SlowConsumer.
+// If config.SlowConsumer.Disconnect is set, the client is disconnected after the hook returns.
+type OnSlowConsumer func(ctx context.Context, client Client, ev *SlowConsumerEvent)
+
+type OnSlowConsumerWrapper func(OnSlowConsumer) OnSlowConsumer
+
+// OnConnectRejected will be called when a CONNECT is rejected, after the CONNACK with the failure reason code has been sent.
+// It is called in the goroutine of the connection, which is closed after the hook returns.
+// The rejection param is immutable, DO NOT EDIT.
+type OnConnectRejected func(ctx context.Context, rejection *ConnectRejection)
+
+type OnConnectRejectedWrapper func(OnConnectRejected) OnConnectRejected
+
+// OnLifecycleStateChanged will be called after the lifecycle state of the server has been changed.
+// See LifecycleState for details.
+type OnLifecycleStateChanged func(ctx context.Context, from, to LifecycleState)
+
+type OnLifecycleStateChangedWrapper func(OnLifecycleStateChanged) OnLifecycleStateChanged
+
 // SubscribeRequest represents the subscribe request made by a SUBSCRIBE packet.
 type SubscribeRequest struct {
 	// Subscribe is the SUBSCRIBE packet. It is immutable, do not edit.
@@ -172,7 +261,9 @@ type MsgArrivedRequest struct {
 	// Publish is the origin MQTT PUBLISH packet, it is immutable. DO NOT EDIT.
 	Publish *packets.Publish
 	// Message is the message that is going to be passed to topic match process.
-	// The caller can modify it.
+	// The caller can modify it in place or replace it, e.g: to strip sensitive data or transcode the payload.
+	// It is a copy of the PUBLISH packet, the result is stored into the retained store if Message.Retained is set,
+	// and delivered to all matched subscribers.
 	Message *gmqtt.Message
 	// IterationOptions provides the the ability to change the options of topic matching process.
 	// In most of cases, you don't need to modify it.
@@ -195,11 +286,80 @@ func (m *MsgArrivedRequest) Drop() {
 
 type OnMsgArrivedWrapper func(OnMsgArrived) OnMsgArrived
 
+// AuthorizeRequest is the input param for OnAuthorize hook.
+type AuthorizeRequest struct {
+	// Action is AccessSubscribe or AccessPublish.
+	Action AccessAction
+	// Topic is the topic filter for AccessSubscribe and the topic name for AccessPublish.
+	Topic string
+}
+
+// OnAuthorize will be called before the OnSubscribe hook for each topic filter of the SUBSCRIBE packet,
+// and before the OnMsgArrived hook for each PUBLISH packet, as well as for the will message if config.MQTT.WillMessageAuth is enabled.
+// It reports whether the client is allowed to subscribe or publish the topic,
+// the denied ones are rejected with "Not authorized" without calling the OnSubscribe or OnMsgArrived hook.
+//
+// Unlike OnSubscribe and OnMsgArrived, the decision only depends on the client and the request,
+// so that it can be cached per client if config.ACLCache is enabled. The hook must not make any side effects.
+// The decisions for the will messages are not cached, because the client has gone away.
+type OnAuthorize func(ctx context.Context, client Client, req *AuthorizeRequest) (allowed bool)
+
+type OnAuthorizeWrapper func(OnAuthorize) OnAuthorize
+
+// TopicRewriteAction is the action param of the OnTopicRewrite hook.
+type TopicRewriteAction byte
+
+const (
+	// TopicRewriteSubscribe rewrites the topic filter of the SUBSCRIBE and UNSUBSCRIBE packets.
+	// The share name of a shared subscription is not passed to the hook and is kept as it is.
+	TopicRewriteSubscribe TopicRewriteAction = iota
+	// TopicRewritePublish rewrites the topic name and the response topic of the PUBLISH packet sent by the client,
+	// as well as the will topic and the will response topic of the CONNECT packet.
+	TopicRewritePublish
+	// TopicRewriteDeliver rewrites the topic name and the response topic of the PUBLISH packet sent to the client,
+	// it maps the rewritten topic back to the topic that the client expects.
+	TopicRewriteDeliver
+)
+
+func (a TopicRewriteAction) String() string {
+	switch a {
+	case TopicRewriteSubscribe:
+		return "subscribe"
+	case TopicRewritePublish:
+		return "publish"
+	case TopicRewriteDeliver:
+		return "deliver"
+	default:
+		return "unknown"
+	}
+}
+
+// OnTopicRewrite will be called to rewrite the topic before authorization, routing and retained matching,
+// e.g: it can be used to prefix the topics of each tenant with "tenant/{id}/" transparently.
+// The rewrite is expected to be symmetric: the topic rewritten by TopicRewritePublish or TopicRewriteSubscribe
+// should be mapped back by TopicRewriteDeliver, so that the client never sees the rewritten topic.
+//
+// For TopicRewriteSubscribe and TopicRewritePublish, returning an error rejects the operation.
+// If the error is a *codes.Error, its code is used as the reason code, otherwise "Unspecified error" is used.
+// The rewritten topic filter or topic name must be valid, otherwise the operation is rejected with
+// "Topic Filter invalid" or "Topic Name invalid".
+// For TopicRewriteDeliver, the error is ignored and the topic is sent without rewriting.
+type OnTopicRewrite func(ctx context.Context, clientID string, topic string, action TopicRewriteAction) (string, error)
+
+type OnTopicRewriteWrapper func(OnTopicRewrite) OnTopicRewrite
+
 // OnClosed will be called after the tcp connection of the client has been closed
 type OnClosed func(ctx context.Context, client Client, err error)
 
 type OnClosedWrapper func(OnClosed) OnClosed
 
+// OnKeepAliveTimeout will be called before OnClosed if the client is closed by keep alive timeout,
+// which means no packet has been received from the client within 1.5 times the keep alive time.
+// The err param of the following OnClosed hook is ErrKeepAliveTimeout.
+type OnKeepAliveTimeout func(ctx context.Context, clientID string)
+
+type OnKeepAliveTimeoutWrapper func(OnKeepAliveTimeout) OnKeepAliveTimeout
+
 // AuthOptions provides several options which controls how the server interacts with the client.
 // The default value of these options is defined in the configuration file.
 type AuthOptions struct {
@@ -212,7 +372,9 @@ type AuthOptions struct {
 	// MaximumQoS is the highest QOS level permitted for a Publish.
 	MaximumQoS uint8
 	// MaxPacketSize is the maximum packet size that the server is willing to accept from the client.
-	// If the client version is v5, this value will be set into Receive Maximum property in CONNACK packet.
+	// If the client version is v5, this value will be set into Maximum Packet Size property in CONNACK packet.
+	// The packet whose remaining length exceeds it is rejected before the rest of the packet is read,
+	// with DISCONNECT "Packet too large" for v5 clients, or closing the connection for v3 clients.
 	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901086
 	MaxPacketSize uint32
 	// TopicAliasMax indicates the highest value that the server will accept as a Topic Alias sent by the client.
@@ -233,8 +395,10 @@ type AuthOptions struct {
 	// SharedSubAvailable indicates whether the server supports Shared Subscriptions.
 	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901093
 	SharedSubAvailable bool
-	// KeepAlive is the keep alive time assigned by the server.
-	// This option only affect v5 client.
+	// KeepAlive is the keep alive time assigned by the server, it is the client requested value clamped to
+	// config.MQTT.MinKeepAlive and config.MQTT.MaxKeepAlive by default.
+	// The v5 client is informed by the Server Keep Alive property in CONNACK,
+	// the v3.x client is not informed, but the server closes the connection after 1.5 times the keep alive time.
 	// See: https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901094
 	KeepAlive uint16
 	// UserProperties is be used to provide additional information to the client.
@@ -250,6 +414,12 @@ type AuthOptions struct {
 	ResponseInfo []byte
 	// MaxInflight limits the number of QoS 1 and QoS 2 publications that the client is willing to process concurrently.
 	MaxInflight uint16
+	// DeliveryRateLimit is the maximum number of messages per second delivered to the client, 0 means no limit.
+	// Default to config.MQTT.DeliveryRateLimit.
+	DeliveryRateLimit int
+	// Username overrides the username in the connect packet if not empty,
+	// e.g: the username mapped from the client certificate.
+	Username string
 }
 
 // OnBasicAuth will be called when receive v311 connect packet or v5 connect packet with empty auth method property.
@@ -262,6 +432,12 @@ type ConnectRequest struct {
 	// Options represents the setting which will be applied to the current client if auth success.
 	// Caller can edit this property to change the setting.
 	Options *AuthOptions
+	// PeerCertificates is the verified certificate chain presented by the client, the leaf certificate comes first.
+	// It is nil if the client does not present a verified certificate.
+	PeerCertificates []*x509.Certificate
+	// CertUsername is the username mapped from the leaf certificate by the CertUsernameFunc, see WithCertUsernameFunc.
+	// The hooks can set it into Options.Username to authenticate the client by the certificate.
+	CertUsername string
 }
 
 type OnBasicAuthWrapper func(OnBasicAuth) OnBasicAuth
@@ -270,6 +446,9 @@ type OnBasicAuthWrapper func(OnBasicAuth) OnBasicAuth
 type OnEnhancedAuth func(ctx context.Context, client Client, req *ConnectRequest) (resp *EnhancedAuthResponse, err error)
 
 type EnhancedAuthResponse struct {
+	// Continue indicates that more authentication data is needed,
+	// the AuthData is sent in the AUTH packet and the following AUTH packets of the client are passed to OnAuth.
+	// If it is false, the authentication succeeds and the AuthData, if any, is sent in the CONNACK packet.
 	Continue bool
 	OnAuth   OnAuth
 	AuthData []byte
@@ -281,11 +460,11 @@ type AuthRequest struct {
 	Options *AuthOptions
 }
 
-// ReAuthResponse is the response of the OnAuth hook.
+// AuthResponse is the response of the OnAuth and OnReAuth hooks.
 type AuthResponse struct {
 	// Continue indicate that whether more authentication data is needed.
 	Continue bool
-	// AuthData is the auth data property of the auth packet.
+	// AuthData is the auth data property of the auth packet, or the CONNACK packet if the authentication succeeds in OnAuth.
 	AuthData []byte
 }
 
@@ -293,6 +472,9 @@ type OnAuth func(ctx context.Context, client Client, req *AuthRequest) (*AuthRes
 
 type OnReAuthWrapper func(OnReAuth) OnReAuth
 
+// OnReAuth will be called for every AUTH packet of the re-authentication,
+// the exchange starts with the Reason Code 0x19 (Re-authenticate) and continues with 0x18 (Continue authentication).
+// Returning an error fails the re-authentication and the client is disconnected with the code of the error, see codes.Error.
 type OnReAuth func(ctx context.Context, client Client, auth *packets.Auth) (*AuthResponse, error)
 
 type OnAuthWrapper func(OnAuth) OnAuth
@@ -325,6 +507,27 @@ type OnSessionTerminated func(ctx context.Context, clientID string, reason Sessi
 
 type OnSessionTerminatedWrapper func(OnSessionTerminated) OnSessionTerminated
 
+// TakeoverDecision is the decision of the OnSessionTakeover hook.
+type TakeoverDecision byte
+
+const (
+	// SessionTakeover disconnects the existing client with "Session taken over", which is the default behavior.
+	SessionTakeover TakeoverDecision = iota
+	// SessionRejectNew rejects the new connection with "Unspecified error" CONNACK, the existing client keeps connected.
+	SessionRejectNew
+	// SessionRejectIfRemoteDiffers rejects the new connection with "Not authorized" CONNACK
+	// if its remote IP address differs from the existing client, otherwise it is the same as SessionTakeover.
+	SessionRejectIfRemoteDiffers
+)
+
+// OnSessionTakeover will be called when a client connects with the client id of a connected client,
+// before the existing client is disconnected.
+// It can be used to prevent a cloned device from kicking the legitimate one.
+// The existing and incoming params are immutable, DO NOT EDIT.
+type OnSessionTakeover func(ctx context.Context, clientID string, existing, incoming *ClientOptions) TakeoverDecision
+
+type OnSessionTakeoverWrapper func(OnSessionTakeover) OnSessionTakeover
+
 // OnDelivered will be called when publishing a message to a client.
 type OnDelivered func(ctx context.Context, client Client, msg *gmqtt.Message)
 
@@ -333,6 +536,73 @@ type OnDeliveredWrapper func(OnDelivered) OnDelivered
 // OnMsgDropped will be called after the Msg dropped.
 // The err indicates the reason of dropping.
 // See: persistence/queue/error.go
+// It is called synchronously by the goroutine which drops the message, e.g: the client goroutines and the fanout workers
+// (see config.MQTT.FanoutWorkers), so it may be called concurrently and must be safe for concurrent use.
+// Use OnMessageDropped if the hook needs the calls to be serialized.
 type OnMsgDropped func(ctx context.Context, clientID string, msg *gmqtt.Message, err error)
 
 type OnMsgDroppedWrapper func(OnMsgDropped) OnMsgDropped
+
+// DropReason is the reason of the OnMessageDropped hook.
+type DropReason byte
+
+const (
+	// DropQueueFull means the message is dropped because the message queue of the client is full.
+	DropQueueFull DropReason = iota
+	// DropExpired means the message or the inflight message is expired before it is delivered or acknowledged.
+	DropExpired
+	// DropClientGone means the message is still in the queue when the session is removed,
+	// e.g: the session is expired, or discarded by a clean start connection.
+	DropClientGone
+	// DropQuotaExceeded means the message exceeds the maximum packet size or the inflight window of the client.
+	DropQuotaExceeded
+	// DropInternal means the message is dropped by an internal error, e.g: a persistence error.
+	DropInternal
+	// DropWriteBufferFull means the message is dropped because the write buffer of the connected client is full,
+	// see config.MQTT.WriteBufferPolicy. The message has left the queue, so it is not counted by DropQueueFull.
+	DropWriteBufferFull
+	// DropNoSubscriber means the non-retained message published by the client matches no subscription,
+	// the clientID of the hook is the publisher.
+	DropNoSubscriber
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropQueueFull:
+		return "queue_full"
+	case DropExpired:
+		return "expired"
+	case DropClientGone:
+		return "client_gone"
+	case DropQuotaExceeded:
+		return "quota_exceeded"
+	case DropWriteBufferFull:
+		return "write_buffer_full"
+	case DropNoSubscriber:
+		return "no_subscriber"
+	default:
+		return "internal"
+	}
+}
+
+// OnMessageDropped will be called after a message to the client is dropped, it can be used to forward the dropped messages
+// to a dead-letter topic or an external log.
+// Unlike OnMsgDropped, it is called in a separate goroutine in order, so a slow hook does not block the delivery.
+// The messages of the same client are reported in the order they are dropped,
+// the order between the clients is not defined if they are dropped by different fanout workers.
+// If the hook falls behind more than the buffered messages, the following dropped messages are discarded without calling the hook.
+// The msg param is immutable, DO NOT EDIT.
+type OnMessageDropped func(ctx context.Context, clientID string, msg *gmqtt.Message, reason DropReason)
+
+type OnMessageDroppedWrapper func(OnMessageDropped) OnMessageDropped
+
+// OnNoSubscriber will be called after a message published by the client matches no subscription,
+// which usually indicates a misconfigured publisher sending to the topics nobody listens on.
+// The retained messages are not reported, neither are the messages which are rejected before routing, e.g: by OnMsgArrived.
+// Like OnMessageDropped, it is called in a separate goroutine in order, so it does not delay the acknowledgement to the publisher.
+// If the hook falls behind more than the buffered messages, the following unmatched messages are discarded without calling the hook.
+// See config.NoSubscriber to republish the unmatched messages to a dead-letter topic.
+// The msg param is immutable, DO NOT EDIT.
+type OnNoSubscriber func(ctx context.Context, msg *gmqtt.Message)
+
+type OnNoSubscriberWrapper func(OnNoSubscriber) OnNoSubscriber
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+// ErrIterateNotSupported will be returned by IterateQueue if the queue store does not implement queue.Iterator.
+var ErrIterateNotSupported = errors.New("queue store does not support iteration")
+
+// IterateQueue implements ClientService.
+func (c *clientService) IterateQueue(clientID string, fn func(elem *queue.Elem) (bool, error)) error {
+	c.srv.mu.Lock()
+	qs := c.srv.queueStore[clientID]
+	c.srv.mu.Unlock()
+	if qs == nil {
+		return ErrSessionNotFound
+	}
+	it, ok := qs.(queue.Iterator)
+	if !ok {
+		return ErrIterateNotSupported
+	}
+	codec := c.srv.payloadCodec
+	return it.Iterate(func(elem *queue.Elem) (bool, error) {
+		if elem.Codec == 0 {
+			return fn(elem)
+		}
+		// the elem can not be modified, pass the decoded copy instead.
+		// The elem is passed as it is if it can not be decoded.
+		if msg, err := queue.DecodePayload(codec, elem); err == nil {
+			e := *elem
+			e.Codec = 0
+			e.MessageWithID = &queue.Publish{Message: msg}
+			return fn(&e)
+		}
+		return fn(elem)
+	})
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+// iterableQueue is a queue.Store which implements queue.Iterator.
+type iterableQueue struct {
+	sliceQueue
+}
+
+func (q *iterableQueue) Iterate(fn func(elem *queue.Elem) (bool, error)) error {
+	for _, v := range q.elems {
+		if cont, err := fn(v); err != nil || !cont {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestClientService_IterateQueue(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	cs := &clientService{srv: srv}
+	elems := newMigrateElems()
+	srv.queueStore["c"] = &iterableQueue{sliceQueue{elems: elems}}
+	srv.queueStore["not_supported"] = &sliceQueue{}
+
+	var rs []*queue.Elem
+	a.Nil(cs.IterateQueue("c", func(elem *queue.Elem) (bool, error) {
+		rs = append(rs, elem)
+		return len(rs) < 3, nil
+	}))
+	a.Equal(elems[:3], rs)
+
+	a.Equal(ErrSessionNotFound, cs.IterateQueue("unknown", nil))
+	a.Equal(ErrIterateNotSupported, cs.IterateQueue("not_supported", nil))
+}
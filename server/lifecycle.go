@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// LifecycleState represents the lifecycle state of the server.
+// The state can only move forward: Starting -> Restoring -> Ready -> Draining -> Stopped.
+// A state can be skipped, e.g: the server will transit from Ready to Stopped directly if there is no client to drain.
+type LifecycleState int32
+
+const (
+	// StateStarting is the initial state, the server has been created but not initialised yet.
+	StateStarting LifecycleState = iota
+	// StateRestoring means the server is opening the persistence and restoring sessions from it.
+	StateRestoring
+	// StateReady means the server is serving, all listeners have been started.
+	StateReady
+	// StateDraining means the server is stopping, it no longer accepts new connections and is waiting for
+	// the existing connections to be closed.
+	StateDraining
+	// StateStopped means the server has been stopped.
+	StateStopped
+)
+
+func (s LifecycleState) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateRestoring:
+		return "restoring"
+	case StateReady:
+		return "ready"
+	case StateDraining:
+		return "draining"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// LifecycleState returns the current lifecycle state of the server.
+func (srv *server) LifecycleState() LifecycleState {
+	return LifecycleState(atomic.LoadInt32(&srv.lifecycleState))
+}
+
+// transitLifecycle moves the lifecycle state to the given state and fires the OnLifecycleStateChanged hook.
+// It returns false if the transition is invalid, which means the current state is not prior to the given state.
+func (srv *server) transitLifecycle(to LifecycleState) bool {
+	var from LifecycleState
+	for {
+		from = srv.LifecycleState()
+		if from >= to {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&srv.lifecycleState, int32(from), int32(to)) {
+			break
+		}
+	}
+	zaplog.Info("lifecycle state changed", zap.Stringer("from", from), zap.Stringer("to", to))
+	if srv.hooks.OnLifecycleStateChanged != nil {
+		srv.hooks.OnLifecycleStateChanged(context.Background(), from, to)
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestServer_transitLifecycle(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	type transition struct {
+		from, to LifecycleState
+	}
+	var fired []transition
+	srv.hooks.OnLifecycleStateChanged = func(ctx context.Context, from, to LifecycleState) {
+		fired = append(fired, transition{from: from, to: to})
+	}
+	a.Equal(StateStarting, srv.LifecycleState())
+
+	a.True(srv.transitLifecycle(StateRestoring))
+	a.True(srv.transitLifecycle(StateReady))
+	// can not move backward
+	a.False(srv.transitLifecycle(StateRestoring))
+	a.False(srv.transitLifecycle(StateReady))
+	a.Equal(StateReady, srv.LifecycleState())
+	// skip draining
+	a.True(srv.transitLifecycle(StateStopped))
+	a.False(srv.transitLifecycle(StateDraining))
+	a.Equal(StateStopped, srv.LifecycleState())
+
+	a.Equal([]transition{
+		{from: StateStarting, to: StateRestoring},
+		{from: StateRestoring, to: StateReady},
+		{from: StateReady, to: StateStopped},
+	}, fired)
+}
+
+func TestServer_Stop_lifecycle(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	var states []LifecycleState
+	srv.hooks.OnLifecycleStateChanged = func(ctx context.Context, from, to LifecycleState) {
+		states = append(states, to)
+	}
+	srv.transitLifecycle(StateReady)
+	a.Nil(srv.Stop(context.Background()))
+	a.Equal([]LifecycleState{StateReady, StateDraining, StateStopped}, states)
+}
+
+func TestServer_Stop_order(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.batcher = newBatcher(config.MessageBatching{
+		Enable:   true,
+		MaxCount: 10,
+		MaxBytes: 1024,
+		MaxDelay: time.Hour,
+	})
+	q := queue.NewMockStore(ctrl)
+	srv.queueStore["cid"] = q
+	pe := NewMockPersistence(ctrl)
+	srv.persistence = pe
+	plg := NewMockPlugin(ctrl)
+	plg.EXPECT().Name().Return("plugin").AnyTimes()
+	srv.plugins = []Plugin{plg}
+	srv.mu.Lock()
+	srv.addMsgToQueueLocked(time.Now(), "cid", &gmqtt.Message{
+		QoS:     packets.Qos1,
+		Topic:   "a",
+		Payload: []byte("1"),
+	}, &gmqtt.Subscription{TopicFilter: "a", QoS: packets.Qos1, Batch: true}, nil, q)
+	srv.mu.Unlock()
+
+	// the pending batch is flushed before the persistence is closed, and the plugins are unloaded at last.
+	gomock.InOrder(
+		q.EXPECT().Add(gomock.Any()).Return(nil),
+		pe.EXPECT().Close().Return(nil),
+		plg.EXPECT().Unload().Return(nil),
+	)
+	a.Nil(srv.Stop(context.Background()))
+	a.Equal(StateStopped, srv.LifecycleState())
+}
+
+func TestServer_Stop_timeout(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	pe := NewMockPersistence(ctrl)
+	srv.persistence = pe
+	// the background goroutine is still running.
+	srv.wg.Add(1)
+	defer srv.wg.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// the persistence is not closed.
+	a.Equal(context.DeadlineExceeded, srv.Stop(ctx))
+	a.Equal(StateStopped, srv.LifecycleState())
+}
@@ -7,14 +7,63 @@ import (
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 )
 
+// PacketIDAllocator decides which unused packet id will be used for the outgoing QoS 1 and QoS 2 messages of a client.
+// The number of inflight messages is still limited by the server, the allocator only picks the id.
+// Notice: the packet ids are allocated before the messages are read from the queue,
+// so the QoS level of the message is unknown to the allocator.
+type PacketIDAllocator interface {
+	// Allocate returns an unused packet id. The inUse function reports whether the given id is in use.
+	// It is guaranteed that there are at least one unused id when Allocate is called.
+	// If the allocator only allocates id in a sub range, the size of the range must be greater than or equal to the
+	// maximum inflight of the client.
+	// Allocate is called with the lock held, so the implementation is not required to be concurrency-safe.
+	Allocate(inUse func(id packets.PacketID) bool) packets.PacketID
+}
+
+// NewPacketIDAllocator is the constructor of PacketIDAllocator. It will be called for every client on connecting.
+type NewPacketIDAllocator func(clientID string) PacketIDAllocator
+
+// NewSequentialAllocator returns the default PacketIDAllocator,
+// which allocates the next unused id in ascending order and wraps around at packets.MaxPacketID.
+func NewSequentialAllocator(clientID string) PacketIDAllocator {
+	return &sequentialAllocator{
+		freePid: packets.MinPacketID,
+	}
+}
+
+type sequentialAllocator struct {
+	freePid packets.PacketID // next available id
+}
+
+func (s *sequentialAllocator) next() {
+	if s.freePid == packets.MaxPacketID {
+		s.freePid = packets.MinPacketID
+	} else {
+		s.freePid++
+	}
+}
+
+func (s *sequentialAllocator) Allocate(inUse func(id packets.PacketID) bool) packets.PacketID {
+	for inUse(s.freePid) {
+		s.next()
+	}
+	id := s.freePid
+	s.next()
+	return id
+}
+
 func newPacketIDLimiter(limit uint16) *packetIDLimiter {
+	return newPacketIDLimiterWithAllocator(limit, NewSequentialAllocator(""))
+}
+
+func newPacketIDLimiterWithAllocator(limit uint16, allocator PacketIDAllocator) *packetIDLimiter {
 	return &packetIDLimiter{
 		cond:      sync.NewCond(&sync.Mutex{}),
 		used:      0,
 		limit:     limit,
 		exit:      false,
-		freePid:   1,
 		lockedPid: bitmap.New(packets.MaxPacketID),
+		allocator: allocator,
 	}
 }
 
@@ -25,8 +74,12 @@ type packetIDLimiter struct {
 	used      uint16
 	limit     uint16
 	exit      bool
-	lockedPid *bitmap.Bitmap   // packet id in-use
-	freePid   packets.PacketID // next available id
+	lockedPid *bitmap.Bitmap // packet id in-use
+	allocator PacketIDAllocator
+}
+
+func (p *packetIDLimiter) inUseLocked(id packets.PacketID) bool {
+	return p.lockedPid.Get(id) == 1
 }
 
 func (p *packetIDLimiter) close() {
@@ -54,21 +107,10 @@ func (p *packetIDLimiter) pollPacketIDs(max uint16) (id []packets.PacketID) {
 		n = remain
 	}
 	for j := uint16(0); j < n; j++ {
-		for p.lockedPid.Get(p.freePid) == 1 {
-			if p.freePid == packets.MaxPacketID {
-				p.freePid = packets.MinPacketID
-			} else {
-				p.freePid++
-			}
-		}
-		id = append(id, p.freePid)
+		pid := p.allocator.Allocate(p.inUseLocked)
+		id = append(id, pid)
 		p.used++
-		p.lockedPid.Set(p.freePid, 1)
-		if p.freePid == packets.MaxPacketID {
-			p.freePid = packets.MinPacketID
-		} else {
-			p.freePid++
-		}
+		p.lockedPid.Set(pid, 1)
 	}
 	return id
 }
@@ -104,6 +146,32 @@ func (p *packetIDLimiter) markUsedLocked(id packets.PacketID) {
 	p.lockedPid.Set(id, 1)
 }
 
+// tryMarkUsed marks the given id as used if the limit has not been reached, and reports whether the id has been marked.
+func (p *packetIDLimiter) tryMarkUsed(id packets.PacketID) bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	if p.used >= p.limit {
+		return false
+	}
+	p.markUsedLocked(id)
+	return true
+}
+
+// waitAndMarkUsed blocks until the number of used ids is below the limit, and then marks the given id as used.
+// It returns false if the limiter has been closed.
+func (p *packetIDLimiter) waitAndMarkUsed(id packets.PacketID) bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	for p.used >= p.limit && !p.exit {
+		p.cond.Wait()
+	}
+	if p.exit {
+		return false
+	}
+	p.markUsedLocked(id)
+	return true
+}
+
 func (p *packetIDLimiter) lock() {
 	p.cond.L.Lock()
 }
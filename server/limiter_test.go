@@ -46,3 +46,46 @@ func Test_packetIDLimiterMax(t *testing.T) {
 	a.Equal([]packets.PacketID{65535}, p.pollPacketIDs(3))
 
 }
+
+// evenAllocator allocates even packet ids only.
+type evenAllocator struct {
+	next packets.PacketID
+}
+
+func (e *evenAllocator) Allocate(inUse func(id packets.PacketID) bool) packets.PacketID {
+	for {
+		if e.next >= packets.MaxPacketID-1 {
+			e.next = 0
+		}
+		e.next += 2
+		if !inUse(e.next) {
+			return e.next
+		}
+	}
+}
+
+func Test_packetIDLimiter_customAllocator(t *testing.T) {
+	a := assert.New(t)
+	p := newPacketIDLimiterWithAllocator(5, &evenAllocator{})
+	a.Equal([]packets.PacketID{2, 4, 6, 8, 10}, p.pollPacketIDs(10))
+
+	p.batchRelease([]packets.PacketID{4, 8})
+	a.Equal([]packets.PacketID{12, 14}, p.pollPacketIDs(10))
+	p.close()
+}
+
+func TestWithPacketIDAllocator(t *testing.T) {
+	a := assert.New(t)
+	var cid string
+	srv := New(WithPacketIDAllocator(func(clientID string) PacketIDAllocator {
+		cid = clientID
+		return &evenAllocator{}
+	}))
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.newPacketIDLimiter(10)
+	a.Equal("cid", cid)
+	a.Equal([]packets.PacketID{2, 4, 6}, c.pl.pollPacketIDs(3))
+	c.pl.close()
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// ListenerPolicy is the connection policy of a listener, e.g: the internal listener on localhost
+// may accept anonymous clients while the public listener requires authentication.
+type ListenerPolicy struct {
+	// ProtocolVersions is the list of the MQTT versions allowed to connect through the listener, empty means all versions.
+	// The CONNECT packet of other versions is rejected with "Unsupported Protocol Version",
+	// or "Unacceptable protocol version" for V3 clients.
+	ProtocolVersions []packets.Version
+	// MaxPacketSize overrides config.MQTT.MaxPacketSize for the connections accepted by the listener, 0 means no override.
+	// The OnBasicAuth and OnEnhancedAuth hooks can still override it by AuthOptions.MaxPacketSize.
+	MaxPacketSize uint32
+	// AllowAnonymous indicates whether the CONNECT packet without username and password is accepted
+	// without calling the OnBasicAuth hook. The enhanced authentication is not affected.
+	AllowAnonymous bool
+}
+
+// versionAllowed reports whether the MQTT version is allowed by the policy.
+func (p *ListenerPolicy) versionAllowed(v packets.Version) bool {
+	if len(p.ProtocolVersions) == 0 {
+		return true
+	}
+	for _, allowed := range p.ProtocolVersions {
+		if v == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// policyListener is a net.Listener which applies the ListenerPolicy to the accepted connections.
+type policyListener struct {
+	net.Listener
+	policy ListenerPolicy
+}
+
+// NewPolicyListener returns a net.Listener which applies the policy to the connections accepted by it.
+func NewPolicyListener(l net.Listener, policy ListenerPolicy) net.Listener {
+	return &policyListener{
+		Listener: l,
+		policy:   policy,
+	}
+}
+
+// checkListenerPolicy checks the CONNECT packet against the policy of the listener which accepted the connection.
+func (client *client) checkListenerPolicy(conn *packets.Connect) error {
+	if client.policy == nil || client.policy.versionAllowed(conn.Version) {
+		return nil
+	}
+	code := codes.UnsupportedProtocolVersion
+	if packets.IsVersion3X(conn.Version) {
+		code = codes.V3UnacceptableProtocolVersion
+	}
+	return client.rejectConnect(code, "protocol version not allowed by the listener")
+}
+
+// anonymous reports whether the CONNECT packet is accepted without the basic authentication, see ListenerPolicy.AllowAnonymous.
+func (client *client) anonymous(conn *packets.Connect) bool {
+	return client.policy != nil && client.policy.AllowAnonymous && len(conn.Username) == 0 && len(conn.Password) == 0
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestNewPolicyListener(t *testing.T) {
+	a := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer l.Close()
+	s := newTCPListenerState(NewNamedListener(NewPolicyListener(l, ListenerPolicy{
+		ProtocolVersions: []packets.Version{packets.Version5},
+		MaxPacketSize:    1024,
+	}), "public"))
+	a.Equal("public", s.name)
+	if a.NotNil(s.policy) {
+		a.EqualValues(1024, s.policy.MaxPacketSize)
+	}
+	conn := &packets.Connect{
+		Version:    packets.Version5,
+		ClientID:   []byte("cid"),
+		Properties: &packets.Properties{},
+	}
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version5
+	s.bind(c)
+	a.EqualValues(1024, c.defaultAuthOptions(conn).MaxPacketSize)
+
+	_, _, err = c.connectHandler(conn)
+	a.Nil(err)
+	_, _, err = c.connectHandler(&packets.Connect{Version: packets.Version311, ClientID: []byte("cid")})
+	a.EqualValues(codes.V3UnacceptableProtocolVersion, converError(err).Code)
+
+	// no policy
+	c, err = srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version5
+	newWebsocketState(&WsServer{Server: &http.Server{}}).bind(c)
+	a.Equal(srv.config().MQTT.MaxPacketSize, c.defaultAuthOptions(conn).MaxPacketSize)
+	_, _, err = c.connectHandler(&packets.Connect{Version: packets.Version311, ClientID: []byte("cid")})
+	a.Nil(err)
+
+	newWebsocketState(&WsServer{Server: &http.Server{}, Policy: &ListenerPolicy{
+		ProtocolVersions: []packets.Version{packets.Version311},
+	}}).bind(c)
+	_, _, err = c.connectHandler(conn)
+	a.Equal(codes.UnsupportedProtocolVersion, converError(err).Code)
+}
+
+func TestListenerPolicy_allowAnonymous(t *testing.T) {
+	srv := defaultServer()
+	srv.hooks.OnBasicAuth = func(ctx context.Context, client Client, req *ConnectRequest) error {
+		if string(req.Connect.Username) == "user" && string(req.Connect.Password) == "pass" {
+			return nil
+		}
+		return &codes.Error{Code: codes.NotAuthorized}
+	}
+	internal := &listenerState{policy: &ListenerPolicy{AllowAnonymous: true}}
+	public := &listenerState{}
+
+	var tt = []struct {
+		name     string
+		listener *listenerState
+		username string
+		password string
+		ok       bool
+	}{
+		{name: "internal_anonymous", listener: internal, ok: true},
+		{name: "internal_valid_credentials", listener: internal, username: "user", password: "pass", ok: true},
+		// the clients which provide the credentials are still authenticated.
+		{name: "internal_invalid_credentials", listener: internal, username: "user", password: "invalid"},
+		{name: "public_anonymous", listener: public},
+		{name: "public_valid_credentials", listener: public, username: "user", password: "pass", ok: true},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			v.listener.bind(c)
+			_, _, err = c.connectHandler(&packets.Connect{
+				Version:      packets.Version5,
+				ClientID:     []byte("cid"),
+				UsernameFlag: v.username != "",
+				Username:     []byte(v.username),
+				PasswordFlag: v.password != "",
+				Password:     []byte(v.password),
+				Properties:   &packets.Properties{},
+			})
+			if v.ok {
+				a.Nil(err)
+				return
+			}
+			a.Equal(codes.NotAuthorized, converError(err).Code)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"sync/atomic"
+)
+
+// Listener types
+const (
+	ListenerTypeTCP          = "tcp"
+	ListenerTypeTLS          = "tls"
+	ListenerTypeWebsocket    = "ws"
+	ListenerTypeWebsocketTLS = "wss"
+	ListenerTypeUnix         = "unix"
+)
+
+// ListenerStats is the statistics of a listener.
+type ListenerStats struct {
+	// Address is the listening address.
+	Address string
+	// Type is the listener type, possible values: tcp | tls | ws | wss | unix
+	Type string
+	// TLS indicates whether the listener accepts TLS connections.
+	TLS bool
+	// ConnectionsCurrent is the number of the current connections accepted by the listener.
+	ConnectionsCurrent uint64
+	// AcceptErrorsTotal is the number of the errors occurred while accepting connections,
+	// e.g: accept errors of tcp listeners, upgrade errors of websocket servers.
+	AcceptErrorsTotal uint64
+}
+
+// listenerState records the statistics of a listener, it is updated by the accept loop.
+type listenerState struct {
+	address            string
+	typ                string
+	tls                bool
+	connectionsCurrent int64
+	acceptErrorsTotal  uint64
+	// name is the name of the listener, see NewNamedListener.
+	name string
+	// clientIDFilter restricts the client ids of the connections accepted by the listener.
+	clientIDFilter ClientIDFilter
+	// requireClientCert indicates whether the connections must present a verified client certificate.
+	requireClientCert bool
+	// topicAliasMax overrides config.MQTT.TopicAliasMax for the connections, nil means no override.
+	topicAliasMax *uint16
+	// policy is the ListenerPolicy of the connections, nil means no policy.
+	policy *ListenerPolicy
+}
+
+var tlsListenerType = reflect.TypeOf(tls.NewListener(nil, nil))
+
+func newTCPListenerState(l net.Listener) *listenerState {
+	s := &listenerState{}
+	l = s.unwrap(l)
+	s.address = l.Addr().String()
+	s.typ = ListenerTypeTCP
+	if l.Addr().Network() == "unix" {
+		s.typ = ListenerTypeUnix
+	}
+	// the listener created by tls.Listen or tls.NewListener.
+	if _, ok := l.(*autoDetectListener); ok || reflect.TypeOf(l) == tlsListenerType {
+		s.typ = ListenerTypeTLS
+		s.tls = true
+	}
+	return s
+}
+
+func newWebsocketState(ws *WsServer) *listenerState {
+	s := &listenerState{
+		address:           ws.Server.Addr,
+		typ:               ListenerTypeWebsocket,
+		name:              ws.Name,
+		clientIDFilter:    ws.ClientIDFilter,
+		requireClientCert: ws.RequireClientCert,
+		topicAliasMax:     ws.TopicAliasMax,
+		policy:            ws.Policy,
+	}
+	if ws.CertFile != "" && ws.KeyFile != "" {
+		s.typ = ListenerTypeWebsocketTLS
+		s.tls = true
+	}
+	return s
+}
+
+// unwrap records the settings of the wrapped listener and returns the underlying listener.
+// The wrappers (NewNamedListener, NewClientIDFilterListener, NewClientCertListener, NewTopicAliasMaxListener
+// and NewPolicyListener) can be nested in any order.
+func (l *listenerState) unwrap(ln net.Listener) net.Listener {
+	for {
+		switch v := ln.(type) {
+		case *namedListener:
+			l.name = v.name
+			ln = v.Listener
+		case *clientIDFilterListener:
+			l.clientIDFilter = v.filter
+			ln = v.Listener
+		case *clientCertListener:
+			l.requireClientCert = true
+			ln = v.Listener
+		case *topicAliasMaxListener:
+			max := v.max
+			l.topicAliasMax = &max
+			ln = v.Listener
+		case *policyListener:
+			policy := v.policy
+			l.policy = &policy
+			ln = v.Listener
+		default:
+			return ln
+		}
+	}
+}
+
+// bind applies the listener settings to the client accepted by the listener.
+func (l *listenerState) bind(client *client) {
+	client.clientIDFilter = l.clientIDFilter
+	client.requireClientCert = l.requireClientCert
+	client.topicAliasMax = l.topicAliasMax
+	client.policy = l.policy
+	client.opts.Listener = l.name
+	// the CONNECT packet is also limited by the max packet size of the listener.
+	if l.policy != nil && l.policy.MaxPacketSize != 0 && client.packetReader != nil {
+		client.packetReader.SetMaxPacketSize(l.policy.MaxPacketSize)
+	}
+}
+
+func (l *listenerState) connected() {
+	atomic.AddInt64(&l.connectionsCurrent, 1)
+}
+
+func (l *listenerState) disconnected() {
+	atomic.AddInt64(&l.connectionsCurrent, -1)
+}
+
+func (l *listenerState) acceptError() {
+	atomic.AddUint64(&l.acceptErrorsTotal, 1)
+}
+
+func (l *listenerState) stats() ListenerStats {
+	return ListenerStats{
+		Address:            l.address,
+		Type:               l.typ,
+		TLS:                l.tls,
+		ConnectionsCurrent: uint64(atomic.LoadInt64(&l.connectionsCurrent)),
+		AcceptErrorsTotal:  atomic.LoadUint64(&l.acceptErrorsTotal),
+	}
+}
+
+// ListListeners returns the statistics of all listeners.
+// It returns nil if the server is not running.
+func (srv *server) ListListeners() []ListenerStats {
+	srv.listenersMu.RLock()
+	defer srv.listenersMu.RUnlock()
+	var rs []ListenerStats
+	for _, v := range srv.listeners {
+		rs = append(rs, v.stats())
+	}
+	return rs
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewListenerState(t *testing.T) {
+	a := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer l.Close()
+
+	s := newTCPListenerState(l).stats()
+	a.Equal(l.Addr().String(), s.Address)
+	a.Equal(ListenerTypeTCP, s.Type)
+	a.False(s.TLS)
+
+	s = newTCPListenerState(tls.NewListener(l, &tls.Config{})).stats()
+	a.Equal(ListenerTypeTLS, s.Type)
+	a.True(s.TLS)
+
+	s = newTCPListenerState(NewAutoDetectListener(l, &tls.Config{})).stats()
+	a.Equal(ListenerTypeTLS, s.Type)
+	a.True(s.TLS)
+
+	s = newWebsocketState(&WsServer{Server: &http.Server{Addr: ":8883"}}).stats()
+	a.Equal(":8883", s.Address)
+	a.Equal(ListenerTypeWebsocket, s.Type)
+	a.False(s.TLS)
+
+	s = newWebsocketState(&WsServer{Server: &http.Server{Addr: ":8883"}, CertFile: "cert", KeyFile: "key"}).stats()
+	a.Equal(ListenerTypeWebsocketTLS, s.Type)
+	a.True(s.TLS)
+}
+
+func TestServer_serveTCP_listenerStats(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	state := newTCPListenerState(l)
+	srv.listeners = []*listenerState{state}
+	done := make(chan struct{})
+	go func() {
+		srv.serveTCP(l, state)
+		close(done)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	a.Nil(err)
+	a.Eventually(func() bool {
+		return srv.ListListeners()[0].ConnectionsCurrent == 1
+	}, time.Second, 10*time.Millisecond)
+
+	_ = c.Close()
+	a.Eventually(func() bool {
+		return srv.ListListeners()[0].ConnectionsCurrent == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the listener is closed unexpectedly.
+	_ = l.Close()
+	<-done
+	a.EqualValues(1, srv.ListListeners()[0].AcceptErrorsTotal)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+// logLimiterSweepInterval is the interval to remove the idle entries of the logLimiter.
+const logLimiterSweepInterval = time.Minute
+
+type logLimiterKey struct {
+	clientID string
+	errType  string
+}
+
+type logLimiterEntry struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// logLimiter limits the number of per-client error logs for each client and error type in every second.
+// The suppressed logs are collapsed into a count, which is reported by the next log of the same client and error type.
+// A nil logLimiter allows all logs.
+type logLimiter struct {
+	mu        sync.Mutex
+	rate      int
+	entries   map[logLimiterKey]*logLimiterEntry
+	lastSweep time.Time
+	// onSuppressed will be called every time a log is suppressed.
+	onSuppressed func()
+}
+
+func newLogLimiter(rate int, onSuppressed func()) *logLimiter {
+	return &logLimiter{
+		rate:         rate,
+		entries:      make(map[logLimiterKey]*logLimiterEntry),
+		lastSweep:    time.Now(),
+		onSuppressed: onSuppressed,
+	}
+}
+
+// allow reports whether the log for the client and the error is allowed,
+// and returns the number of logs have been suppressed since the last allowed one.
+func (l *logLimiter) allow(clientID string, err error, now time.Time) (ok bool, suppressed int) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= logLimiterSweepInterval {
+		for k, v := range l.entries {
+			if v.suppressed == 0 && now.Sub(v.windowStart) >= time.Second {
+				delete(l.entries, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	key := logLimiterKey{clientID: clientID, errType: errorType(err)}
+	e := l.entries[key]
+	if e == nil {
+		e = &logLimiterEntry{windowStart: now}
+		l.entries[key] = e
+	}
+	if now.Sub(e.windowStart) >= time.Second {
+		e.windowStart = now
+		e.count = 0
+	}
+	if e.count < l.rate {
+		e.count++
+		suppressed = e.suppressed
+		e.suppressed = 0
+		return true, suppressed
+	}
+	e.suppressed++
+	if l.onSuppressed != nil {
+		l.onSuppressed()
+	}
+	return false, 0
+}
+
+// errorType returns the type of the error used to deduplicate the logs.
+func errorType(err error) string {
+	switch e := err.(type) {
+	case *codes.Error:
+		return fmt.Sprintf("%T:%d", e, e.Code)
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+// logKey returns the key to limit the error logs of the client.
+// The host of the remote address is used if the client id is not available, e.g: malformed CONNECT packet.
+func (client *client) logKey() string {
+	if client.opts.ClientID != "" {
+		return client.opts.ClientID
+	}
+	if host, _, err := net.SplitHostPort(client.rwc.RemoteAddr().String()); err == nil {
+		return host
+	}
+	return client.rwc.RemoteAddr().String()
+}
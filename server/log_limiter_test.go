@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+func TestLogLimiter(t *testing.T) {
+	a := assert.New(t)
+	var suppressedTotal int
+	l := newLogLimiter(2, func() {
+		suppressedTotal++
+	})
+	now := time.Now()
+	errA := errors.New("a")
+	errB := codes.NewError(codes.MalformedPacket)
+
+	for i := 0; i < 2; i++ {
+		ok, suppressed := l.allow("cid", errA, now)
+		a.True(ok)
+		a.Zero(suppressed)
+	}
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("cid", errA, now)
+		a.False(ok)
+	}
+	// different error type and different client are not affected.
+	ok, _ := l.allow("cid", errB, now)
+	a.True(ok)
+	ok, _ = l.allow("cid2", errA, now)
+	a.True(ok)
+	a.Equal(3, suppressedTotal)
+
+	// the suppressed count is reported in the next window.
+	ok, suppressed := l.allow("cid", errA, now.Add(time.Second))
+	a.True(ok)
+	a.Equal(3, suppressed)
+	ok, suppressed = l.allow("cid", errA, now.Add(time.Second))
+	a.True(ok)
+	a.Zero(suppressed)
+
+	// idle entries are removed.
+	l.allow("cid", errA, now.Add(time.Second+logLimiterSweepInterval))
+	a.Len(l.entries, 1)
+
+	var nilLimiter *logLimiter
+	ok, _ = nilLimiter.allow("cid", errA, now)
+	a.True(ok)
+}
+
+func TestErrorType(t *testing.T) {
+	a := assert.New(t)
+	a.Equal("*codes.Error:129", errorType(codes.NewError(codes.MalformedPacket)))
+	a.NotEqual(errorType(codes.NewError(codes.MalformedPacket)), errorType(codes.NewError(codes.ProtocolError)))
+	a.Equal(errorType(errors.New("a")), errorType(errors.New("b")))
+}
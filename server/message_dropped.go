@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+// droppedBufferSize is the number of the dropped messages buffered for the OnMessageDropped hook.
+var droppedBufferSize = 1024
+
+type droppedMessage struct {
+	clientID string
+	msg      *gmqtt.Message
+	reason   DropReason
+	// queued is the elems remaining in the queue of the removed session, see dispatchQueue.
+	queued []*queue.Elem
+	codec  queue.PayloadCodec
+}
+
+// dropDispatcher calls the OnMessageDropped hook in a separate goroutine,
+// so that a slow hook can not stall the delivery path.
+type dropDispatcher struct {
+	hook OnMessageDropped
+	ch   chan droppedMessage
+	// discarded is the number of the dropped messages which are discarded because the buffer is full.
+	discarded uint64
+}
+
+func newDropDispatcher(hook OnMessageDropped, size int) *dropDispatcher {
+	return &dropDispatcher{
+		hook: hook,
+		ch:   make(chan droppedMessage, size),
+	}
+}
+
+// run calls the hook for the buffered messages until exit is closed.
+func (d *dropDispatcher) run(exit <-chan struct{}) {
+	for {
+		select {
+		case <-exit:
+			return
+		case m := <-d.ch:
+			if m.queued == nil {
+				d.hook(context.Background(), m.clientID, m.msg, m.reason)
+				continue
+			}
+			for _, elem := range m.queued {
+				pub, ok := elem.MessageWithID.(*queue.Publish)
+				if !ok {
+					continue
+				}
+				msg, err := queue.DecodePayload(m.codec, elem)
+				if err != nil {
+					msg = pub.Message
+				}
+				d.hook(context.Background(), m.clientID, msg, DropClientGone)
+			}
+		}
+	}
+}
+
+// dispatch buffers the dropped message without blocking, the message is discarded if the buffer is full.
+// It is a no-op if d is nil.
+func (d *dropDispatcher) dispatch(clientID string, msg *gmqtt.Message, reason DropReason) {
+	if d == nil {
+		return
+	}
+	d.send(droppedMessage{clientID: clientID, msg: msg, reason: reason}, 1)
+}
+
+// send buffers m which carries n dropped messages, they are discarded if the buffer is full.
+func (d *dropDispatcher) send(m droppedMessage, n int) {
+	select {
+	case d.ch <- m:
+	default:
+		total := atomic.AddUint64(&d.discarded, uint64(n))
+		// log once every cap(d.ch)+1 discarded messages.
+		k, prev := uint64(cap(d.ch)+1), total-uint64(n)
+		if prev == 0 || (total-1)/k != (prev-1)/k {
+			zaplog.Warn("the OnMessageDropped hook falls behind, dropped messages discarded",
+				zap.String("client_id", m.clientID),
+				zap.Uint64("discarded_total", total))
+		}
+	}
+}
+
+// dispatchQueue reports the publish messages remaining in the queue with DropClientGone before the queue is cleaned.
+// It is called with the server lock held, so only the elems are collected here,
+// the payloads are decoded and the hook is called by the dispatcher goroutine.
+// The queue store must implement queue.Iterator, otherwise the remaining messages are not reported.
+// The payloads are decoded with the codec if they have been encoded, see queue.PayloadCodec.
+func (d *dropDispatcher) dispatchQueue(clientID string, qs queue.Store, codec queue.PayloadCodec) {
+	if d == nil {
+		return
+	}
+	it, ok := qs.(queue.Iterator)
+	if !ok {
+		return
+	}
+	var elems []*queue.Elem
+	err := it.Iterate(func(elem *queue.Elem) (bool, error) {
+		elems = append(elems, elem)
+		return true, nil
+	})
+	if err != nil {
+		zaplog.Warn("fail to iterate the dropped messages", zap.String("client_id", clientID), zap.Error(err))
+	}
+	if len(elems) == 0 {
+		return
+	}
+	d.send(droppedMessage{clientID: clientID, queued: elems, codec: codec}, len(elems))
+}
+
+// dropReason converts the drop error of queue.Notifier to DropReason.
+func dropReason(err error) DropReason {
+	switch err {
+	case queue.ErrDropQueueFull:
+		return DropQueueFull
+	case queue.ErrDropExpired, queue.ErrDropExpiredInflight:
+		return DropExpired
+	case queue.ErrDropExceedsMaxPacketSize, queue.ErrDropInflightTrimmed:
+		return DropQuotaExceeded
+	case queue.ErrDropWriteBufferFull:
+		return DropWriteBufferFull
+	default:
+		return DropInternal
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	session_mem "github.com/DrmagicE/gmqtt/persistence/session/mem"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+)
+
+func TestDropReason(t *testing.T) {
+	a := assert.New(t)
+	for err, reason := range map[error]DropReason{
+		queue.ErrDropQueueFull:                    DropQueueFull,
+		queue.ErrDropExpired:                      DropExpired,
+		queue.ErrDropExpiredInflight:              DropExpired,
+		queue.ErrDropExceedsMaxPacketSize:         DropQuotaExceeded,
+		queue.ErrDropInflightTrimmed:              DropQuotaExceeded,
+		queue.ErrDropWriteBufferFull:              DropWriteBufferFull,
+		&queue.InternalError{Err: errors.New("")}: DropInternal,
+	} {
+		a.Equal(reason, dropReason(err), err.Error())
+	}
+}
+
+type droppedCall struct {
+	clientID string
+	topic    string
+	reason   DropReason
+}
+
+func TestDropDispatcher(t *testing.T) {
+	a := assert.New(t)
+	unblock := make(chan struct{})
+	called := make(chan droppedCall, 10)
+	d := newDropDispatcher(func(ctx context.Context, clientID string, msg *gmqtt.Message, reason DropReason) {
+		<-unblock
+		called <- droppedCall{clientID: clientID, topic: msg.Topic, reason: reason}
+	}, 1)
+	exit := make(chan struct{})
+	defer close(exit)
+	go d.run(exit)
+
+	d.dispatch("cid", &gmqtt.Message{Topic: "a"}, DropQueueFull)
+	// wait for the hook goroutine to receive the first message.
+	for len(d.ch) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// a slow hook does not block the drop sites.
+	done := make(chan struct{})
+	go func() {
+		for _, topic := range []string{"b", "c", "d"} {
+			d.dispatch("cid", &gmqtt.Message{Topic: topic}, DropQueueFull)
+		}
+		// the elems of a queue are discarded together.
+		d.dispatchQueue("cid", &iterableQueue{sliceQueue{elems: []*queue.Elem{
+			{MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "e"}}},
+			{MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "f"}}},
+		}}}, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		a.FailNow("dispatch blocked by the slow hook")
+	}
+	close(unblock)
+	// "a" is being handled and "b" is buffered, the others are discarded.
+	a.Equal(droppedCall{clientID: "cid", topic: "a", reason: DropQueueFull}, <-called)
+	a.Equal(droppedCall{clientID: "cid", topic: "b", reason: DropQueueFull}, <-called)
+	a.EqualValues(4, d.discarded)
+
+	// nil dispatcher is a no-op.
+	var nd *dropDispatcher
+	nd.dispatch("cid", &gmqtt.Message{}, DropExpired)
+	nd.dispatchQueue("cid", nil, nil)
+}
+
+// cleanableQueue is an iterableQueue which can be cleaned.
+type cleanableQueue struct {
+	iterableQueue
+}
+
+func (q *cleanableQueue) Clean() error {
+	q.elems = nil
+	return nil
+}
+
+func TestServer_onMessageDropped(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	srv.sessionStore = session_mem.New()
+	called := make(chan droppedCall, 10)
+	srv.dropDispatcher = newDropDispatcher(func(ctx context.Context, clientID string, msg *gmqtt.Message, reason DropReason) {
+		called <- droppedCall{clientID: clientID, topic: msg.Topic, reason: reason}
+	}, 10)
+	go srv.dropDispatcher.run(srv.exitChan)
+	defer close(srv.exitChan)
+
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.queueNotifier.notifyDropped(&gmqtt.Message{Topic: "expired"}, queue.ErrDropExpired)
+	a.Equal(droppedCall{clientID: "cid", topic: "expired", reason: DropExpired}, <-called)
+
+	// the queued messages are reported when the session is removed.
+	q := &cleanableQueue{iterableQueue{sliceQueue{elems: []*queue.Elem{
+		{MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "inflight"}}},
+		{MessageWithID: &queue.Pubrel{PacketID: 1}},
+		{MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "queued"}}},
+	}}}}
+	srv.queueStore["cid"] = q
+	srv.mu.Lock()
+	a.Nil(srv.removeSessionLocked("cid"))
+	srv.mu.Unlock()
+	a.Equal(droppedCall{clientID: "cid", topic: "inflight", reason: DropClientGone}, <-called)
+	a.Equal(droppedCall{clientID: "cid", topic: "queued", reason: DropClientGone}, <-called)
+}
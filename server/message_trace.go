@@ -0,0 +1,364 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// TraceStage is the stage of a traced message, see config.MessageTrace.
+type TraceStage byte
+
+const (
+	// TraceReceived means the message is received from the publisher.
+	TraceReceived TraceStage = iota
+	// TraceAuthorized means the message passes the authorization, the topic policy and the OnMsgArrived hook.
+	TraceAuthorized
+	// TraceRejected means the message is not routed, e.g: the publisher is not authorized.
+	TraceRejected
+	// TraceMatched means the message matches a subscriber, or no subscriber if the client id of the event is empty.
+	TraceMatched
+	// TraceEnqueued means the message is added to the queue of the subscriber.
+	TraceEnqueued
+	// TraceDelivered means the message is sent to the subscriber.
+	TraceDelivered
+	// TraceAcked means the QoS 1 or QoS 2 message is acknowledged by the subscriber.
+	TraceAcked
+	// TraceDropped means the message is dropped for the subscriber.
+	TraceDropped
+)
+
+func (s TraceStage) String() string {
+	switch s {
+	case TraceReceived:
+		return "received"
+	case TraceAuthorized:
+		return "authorized"
+	case TraceRejected:
+		return "rejected"
+	case TraceMatched:
+		return "matched"
+	case TraceEnqueued:
+		return "enqueued"
+	case TraceDelivered:
+		return "delivered"
+	case TraceAcked:
+		return "acked"
+	case TraceDropped:
+		return "dropped"
+	default:
+		return "unknown"
+	}
+}
+
+// TraceEvent is a recorded stage of a traced message.
+type TraceEvent struct {
+	Stage TraceStage
+	At    time.Time
+	// ClientID is the publisher for TraceReceived, TraceAuthorized and TraceRejected, and the subscriber for the others.
+	ClientID string
+	// Reason is the reason of TraceRejected and TraceDropped, and the details of the other stages if any.
+	Reason string
+}
+
+// MessageTrace is the recorded events of a traced message.
+type MessageTrace struct {
+	// ID is the trace id carried by the user property, see config.MessageTrace.
+	ID    string
+	Topic string
+	// StartedAt is the time of the first event.
+	StartedAt time.Time
+	// Events are the recorded events in the order of recording.
+	Events []TraceEvent
+	// DiscardedEvents is the number of the events which exceed config.MessageTrace.MaxEvents.
+	DiscardedEvents int
+}
+
+// MessageTracer provides the recent traces of the traced messages, see config.MessageTrace.
+type MessageTracer interface {
+	// Recent returns the copy of the recent traces, the most recently started one first.
+	Recent() []MessageTrace
+}
+
+// tracedPacket is the packet id of a delivered QoS 1 or QoS 2 traced message.
+type tracedPacket struct {
+	clientID string
+	pid      packets.PacketID
+}
+
+// messageTracer implements MessageTracer.
+// All methods are no-ops if the tracer is nil, so that the tracing costs nothing if it is disabled.
+type messageTracer struct {
+	config config.MessageTrace
+	clock  clock.Clock
+	mu     sync.Mutex
+	traces map[string]*MessageTrace
+	// ring is the ids of the buffered traces in the order of starting, next is the index of the next trace.
+	ring []string
+	next int
+	// pending maps the delivered packets which are waiting for the acknowledgement to the trace id.
+	pending map[tracedPacket]string
+	// npending is the size of pending, it is used to skip the lock when there is no pending packet.
+	npending int64
+}
+
+func newMessageTracer(c config.MessageTrace, clk clock.Clock) *messageTracer {
+	return &messageTracer{
+		config:  c,
+		clock:   clk,
+		traces:  make(map[string]*MessageTrace),
+		ring:    make([]string, c.BufferSize),
+		pending: make(map[tracedPacket]string),
+	}
+}
+
+// traceID returns the trace id carried by the message, empty if the message is not traced.
+func (t *messageTracer) traceID(msg *gmqtt.Message) string {
+	if t == nil {
+		return ""
+	}
+	for _, v := range msg.UserProperties {
+		if string(v.K) == t.config.UserProperty {
+			return string(v.V)
+		}
+	}
+	return ""
+}
+
+// start records TraceReceived if the message is traced and returns the trace id.
+// The generated trace id is attached to the message if it carries an empty one or only matches the topic filters.
+func (t *messageTracer) start(clientID string, msg *gmqtt.Message) string {
+	if t == nil {
+		return ""
+	}
+	index := -1
+	for i, v := range msg.UserProperties {
+		if string(v.K) == t.config.UserProperty {
+			index = i
+			break
+		}
+	}
+	if index == -1 && !t.match(msg.Topic) {
+		return ""
+	}
+	var id string
+	if index != -1 {
+		id = string(msg.UserProperties[index].V)
+	}
+	if id == "" {
+		id = getRandomUUID()
+		// do not modify the user properties shared with the PUBLISH packet.
+		ppt := make([]packets.UserProperty, 0, len(msg.UserProperties)+1)
+		ppt = append(ppt, msg.UserProperties...)
+		if index == -1 {
+			ppt = append(ppt, packets.UserProperty{K: []byte(t.config.UserProperty)})
+			index = len(ppt) - 1
+		}
+		ppt[index].V = []byte(id)
+		msg.UserProperties = ppt
+	}
+	t.record(id, msg, TraceEvent{Stage: TraceReceived, ClientID: clientID})
+	return id
+}
+
+func (t *messageTracer) match(topic string) bool {
+	for _, v := range t.config.TopicFilters {
+		if packets.TopicMatch([]byte(topic), []byte(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// record records the event of the traced message, it is a no-op if id is empty.
+func (t *messageTracer) record(id string, msg *gmqtt.Message, e TraceEvent) {
+	if t == nil || id == "" {
+		return
+	}
+	e.At = t.clock.Now()
+	if t.config.Log {
+		zaplog.Info("message trace",
+			zap.String("trace_id", id),
+			zap.String("topic", msg.Topic),
+			zap.Stringer("stage", e.Stage),
+			zap.String("client_id", e.ClientID),
+			zap.String("reason", e.Reason))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr := t.traces[id]
+	if tr == nil {
+		// the trace may have been evicted, or the traced message is published by the server.
+		tr = &MessageTrace{
+			ID:        id,
+			Topic:     msg.Topic,
+			StartedAt: e.At,
+		}
+		t.addLocked(tr)
+	}
+	if len(tr.Events) >= t.config.MaxEvents {
+		tr.DiscardedEvents++
+		return
+	}
+	tr.Events = append(tr.Events, e)
+}
+
+// addLocked adds the trace to the buffer, the oldest trace is evicted if the buffer is full.
+func (t *messageTracer) addLocked(tr *MessageTrace) {
+	if old := t.ring[t.next]; old != "" {
+		delete(t.traces, old)
+		for k, v := range t.pending {
+			if v == old {
+				t.removePendingLocked(k)
+			}
+		}
+	}
+	t.traces[tr.ID] = tr
+	t.ring[t.next] = tr.ID
+	t.next = (t.next + 1) % len(t.ring)
+}
+
+func (t *messageTracer) removePendingLocked(k tracedPacket) (id string, ok bool) {
+	if id, ok = t.pending[k]; ok {
+		delete(t.pending, k)
+		atomic.AddInt64(&t.npending, -1)
+	}
+	return id, ok
+}
+
+// matched records TraceMatched for each subscriber which the message is added to,
+// or a single TraceMatched without client id if there is no such subscriber.
+func (t *messageTracer) matched(id string, msg *gmqtt.Message, targets []fanoutTarget) {
+	if len(targets) == 0 {
+		t.record(id, msg, TraceEvent{Stage: TraceMatched, Reason: "no matching subscribers"})
+		return
+	}
+	for _, v := range targets {
+		t.record(id, msg, TraceEvent{Stage: TraceMatched, ClientID: v.clientID, Reason: v.sub.GetFullTopicName()})
+	}
+}
+
+// delivered records TraceDelivered if the message is traced, and remembers the packet id to record the acknowledgement.
+// The packet id of the untraced message replaces the remembered one, because the packet id has been reused.
+func (t *messageTracer) delivered(clientID string, msg *gmqtt.Message, pid packets.PacketID, retransmitted bool) {
+	if t == nil {
+		return
+	}
+	id := t.traceID(msg)
+	if id == "" {
+		if pid != 0 && atomic.LoadInt64(&t.npending) > 0 {
+			t.mu.Lock()
+			t.removePendingLocked(tracedPacket{clientID: clientID, pid: pid})
+			t.mu.Unlock()
+		}
+		return
+	}
+	e := TraceEvent{Stage: TraceDelivered, ClientID: clientID}
+	if retransmitted {
+		e.Reason = "retransmitted"
+	}
+	t.record(id, msg, e)
+	if pid == 0 {
+		return
+	}
+	k := tracedPacket{clientID: clientID, pid: pid}
+	t.mu.Lock()
+	if _, ok := t.pending[k]; !ok {
+		atomic.AddInt64(&t.npending, 1)
+	}
+	t.pending[k] = id
+	t.mu.Unlock()
+}
+
+// acked records the acknowledgement of the delivered packet if it is traced.
+// The message is recorded as TraceDropped if the reason is not empty, e.g: the subscriber responds with an error reason code.
+func (t *messageTracer) acked(clientID string, pid packets.PacketID, reason string) {
+	if t == nil || atomic.LoadInt64(&t.npending) == 0 {
+		return
+	}
+	t.mu.Lock()
+	id, ok := t.removePendingLocked(tracedPacket{clientID: clientID, pid: pid})
+	var topic string
+	if tr := t.traces[id]; ok && tr != nil {
+		topic = tr.Topic
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	e := TraceEvent{Stage: TraceAcked, ClientID: clientID}
+	if reason != "" {
+		e.Stage = TraceDropped
+		e.Reason = reason
+	}
+	t.record(id, &gmqtt.Message{Topic: topic}, e)
+}
+
+// forget removes the packet ids of the client waiting for the acknowledgement, it is called when the session is removed.
+func (t *messageTracer) forget(clientID string) {
+	if t == nil || atomic.LoadInt64(&t.npending) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k := range t.pending {
+		if k.clientID == clientID {
+			t.removePendingLocked(k)
+		}
+	}
+}
+
+// Recent implements MessageTracer.
+func (t *messageTracer) Recent() []MessageTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rs := make([]MessageTrace, 0, len(t.traces))
+	for i := 1; i <= len(t.ring); i++ {
+		id := t.ring[(t.next-i+len(t.ring))%len(t.ring)]
+		if id == "" {
+			break
+		}
+		tr := *t.traces[id]
+		tr.Events = append([]TraceEvent(nil), tr.Events...)
+		rs = append(rs, tr)
+	}
+	return rs
+}
+
+// publishRejectReason returns the reason why the message received by publishHandler is not routed, empty if it is routed.
+func publishRejectReason(limited, dup, deduplicated, dropEmpty, retainedNacked, hookDropped bool, err error) string {
+	switch {
+	case limited:
+		return "publish rate limit exceeded"
+	case dup:
+		return "duplicated QoS 2 message"
+	case deduplicated:
+		return "duplicated idempotency key"
+	case dropEmpty:
+		return "empty payload"
+	case err != nil:
+		return err.Error()
+	case hookDropped:
+		return "dropped by the OnMsgArrived hook"
+	case retainedNacked:
+		return "retained message limit exceeded"
+	}
+	return ""
+}
+
+// ackRejectReason returns the reason of the PUBACK or PUBREC with an error reason code, empty if the message is accepted.
+func ackRejectReason(version packets.Version, code codes.Code) string {
+	if version != packets.Version5 || code < codes.UnspecifiedError {
+		return ""
+	}
+	return fmt.Sprintf("rejected by the subscriber with reason code 0x%02X", code)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func stages(events []TraceEvent, clientID string) (rs []TraceStage) {
+	for _, v := range events {
+		if v.ClientID == clientID {
+			rs = append(rs, v.Stage)
+		}
+	}
+	return rs
+}
+
+func TestMessageTracer(t *testing.T) {
+	a := assert.New(t)
+	var tr *messageTracer
+	// nil tracer is a no-op.
+	a.Equal("", tr.start("cid", &gmqtt.Message{Topic: "a"}))
+	tr.delivered("cid", &gmqtt.Message{}, 1, false)
+	tr.acked("cid", 1, "")
+
+	clk := newTestClock()
+	tr = newMessageTracer(config.MessageTrace{
+		Enable:       true,
+		UserProperty: "trace",
+		TopicFilters: []string{"debug/#"},
+		BufferSize:   2,
+		MaxEvents:    4,
+	}, clk)
+
+	// untagged
+	a.Equal("", tr.start("cid", &gmqtt.Message{Topic: "a"}))
+	a.Empty(tr.Recent())
+
+	// tagged
+	msg := &gmqtt.Message{Topic: "a", UserProperties: []packets.UserProperty{{K: []byte("trace"), V: []byte("id1")}}}
+	a.Equal("id1", tr.start("cid", msg))
+
+	// matched the topic filter, the generated trace id is attached.
+	ppt := make([]packets.UserProperty, 1, 2)
+	ppt[0] = packets.UserProperty{K: []byte("k"), V: []byte("v")}
+	msg2 := &gmqtt.Message{Topic: "debug/a", UserProperties: ppt}
+	id2 := tr.start("cid", msg2)
+	a.NotEmpty(id2)
+	a.Equal(id2, tr.traceID(msg2))
+	a.Len(msg2.UserProperties, 2)
+	// the original user properties are not modified.
+	a.Equal(packets.UserProperty{K: []byte("k"), V: []byte("v")}, ppt[:2][0])
+	a.Nil(ppt[:2][1].K)
+
+	clk.Advance(time.Second)
+	tr.delivered("sub", msg, 1, false)
+	tr.delivered("sub", msg, 1, true)
+	tr.acked("sub", 1, "")
+	// not pending
+	tr.acked("sub", 1, "")
+	rs := tr.Recent()
+	a.Len(rs, 2)
+	a.Equal(id2, rs[0].ID)
+	a.Equal("id1", rs[1].ID)
+	a.Equal([]TraceStage{TraceDelivered, TraceDelivered, TraceAcked}, stages(rs[1].Events, "sub"))
+	a.Equal("retransmitted", rs[1].Events[2].Reason)
+	a.Equal(clk.Now(), rs[1].Events[1].At)
+	// exceeds MaxEvents
+	tr.delivered("sub", msg, 4, false)
+	a.Equal(1, tr.Recent()[1].DiscardedEvents)
+
+	// the packet id is reused by the untraced message.
+	tr.delivered("sub", msg2, 2, false)
+	tr.delivered("sub", &gmqtt.Message{Topic: "a"}, 2, false)
+	tr.acked("sub", 2, "")
+	a.Equal([]TraceStage{TraceDelivered}, stages(tr.Recent()[0].Events, "sub"))
+
+	tr.delivered("sub", msg2, 3, false)
+	tr.acked("sub", 3, ackRejectReason(packets.Version5, codes.UnspecifiedError))
+	events := tr.Recent()[0].Events
+	a.Equal(TraceDropped, events[len(events)-1].Stage)
+	a.Equal("rejected by the subscriber with reason code 0x80", events[len(events)-1].Reason)
+
+	// the oldest trace is evicted with its pending packets.
+	a.EqualValues(1, tr.npending)
+	a.Equal("id3", tr.start("cid", &gmqtt.Message{Topic: "a", UserProperties: []packets.UserProperty{{K: []byte("trace"), V: []byte("id3")}}}))
+	rs = tr.Recent()
+	a.Len(rs, 2)
+	a.Equal("id3", rs[0].ID)
+	a.Equal(id2, rs[1].ID)
+	a.EqualValues(0, tr.npending)
+
+	tr.delivered("sub", msg2, 5, false)
+	tr.forget("sub")
+	a.EqualValues(0, tr.npending)
+}
+
+func TestClient_publishHandler_trace(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.config().MQTT.DeliveryMode = Overlap
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	srv.tracer = newMessageTracer(config.MessageTrace{
+		Enable:       true,
+		UserProperty: "trace",
+		BufferSize:   10,
+		MaxEvents:    100,
+	}, srv.clock)
+	srv.hooks.OnAuthorize = func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+		return req.Topic != "denied"
+	}
+
+	q1 := queue.NewMockStore(ctrl)
+	q2 := queue.NewMockStore(ctrl)
+	srv.queueStore["sub1"] = q1
+	srv.queueStore["sub2"] = q2
+	_, err := srv.subscriptionsDB.Subscribe("sub1", &gmqtt.Subscription{TopicFilter: "a", QoS: packets.Qos1})
+	a.Nil(err)
+	_, err = srv.subscriptionsDB.Subscribe("sub2", &gmqtt.Subscription{TopicFilter: "#", QoS: packets.Qos1})
+	a.Nil(err)
+
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "pub"
+	c.version = packets.Version5
+	publish := func(topic string, ppt []packets.UserProperty) {
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:    packets.Version5,
+			Qos:        packets.Qos1,
+			PacketID:   1,
+			TopicName:  []byte(topic),
+			Payload:    []byte("payload"),
+			Properties: &packets.Properties{User: ppt},
+		}))
+	}
+
+	// untagged
+	q1.EXPECT().Add(gomock.Any()).Return(nil)
+	q2.EXPECT().Add(gomock.Any()).Return(nil)
+	publish("a", nil)
+	a.Empty(srv.tracer.Recent())
+
+	q1.EXPECT().Add(gomock.Any()).DoAndReturn(func(elem *queue.Elem) error {
+		// the trace id is carried to the subscriber.
+		a.Equal("id1", srv.tracer.traceID(elem.MessageWithID.(*queue.Publish).Message))
+		return nil
+	})
+	q2.EXPECT().Add(gomock.Any()).Return(queue.ErrDropQueueFull)
+	publish("a", []packets.UserProperty{{K: []byte("trace"), V: []byte("id1")}})
+
+	publish("denied", []packets.UserProperty{{K: []byte("trace"), V: []byte("id2")}})
+
+	rs := srv.tracer.Recent()
+	a.Len(rs, 2)
+	a.Equal("id2", rs[0].ID)
+	a.Equal([]TraceStage{TraceReceived, TraceRejected}, stages(rs[0].Events, "pub"))
+
+	a.Equal("id1", rs[1].ID)
+	a.Equal("a", rs[1].Topic)
+	a.Equal([]TraceStage{TraceReceived, TraceAuthorized}, stages(rs[1].Events, "pub"))
+	a.Equal([]TraceStage{TraceMatched, TraceEnqueued}, stages(rs[1].Events, "sub1"))
+	a.Equal([]TraceStage{TraceMatched, TraceDropped}, stages(rs[1].Events, "sub2"))
+	last := rs[1].Events[len(rs[1].Events)-1]
+	if last.ClientID != "sub2" {
+		last = rs[1].Events[len(rs[1].Events)-2]
+	}
+	a.Equal(queue.ErrDropQueueFull.Error(), last.Reason)
+
+	// delivered and acknowledged by sub1.
+	sub1, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	sub1.opts.ClientID = "sub1"
+	sub1.newPacketIDLimiter(10)
+	sub1.queueStore = q1
+	srv.tracer.delivered("sub1", &gmqtt.Message{Topic: "a", UserProperties: []packets.UserProperty{{K: []byte("trace"), V: []byte("id1")}}}, 1, false)
+	q1.EXPECT().Remove(packets.PacketID(1)).Return(nil)
+	a.Nil(sub1.pubackHandler(&packets.Puback{PacketID: 1}))
+	a.Equal([]TraceStage{TraceMatched, TraceEnqueued, TraceDelivered, TraceAcked}, stages(srv.tracer.Recent()[1].Events, "sub1"))
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The metric names recorded into the MetricSink.
+const (
+	// MetricConnected is the counter of the connected clients.
+	MetricConnected = "connections.connected"
+	// MetricDisconnected is the counter of the disconnected clients.
+	MetricDisconnected = "connections.disconnected"
+	// MetricSessionsActive is the gauge of the sessions which are connected.
+	MetricSessionsActive = "sessions.active"
+	// MetricMessagesReceived is the counter of the PUBLISH packets received from the clients, tagged with "qos".
+	MetricMessagesReceived = "messages.received"
+	// MetricMessagesSent is the counter of the PUBLISH packets sent to the clients, tagged with "qos".
+	MetricMessagesSent = "messages.sent"
+	// MetricMessagesDropped is the counter of the dropped messages, tagged with "qos" and "reason", see DropReason.
+	MetricMessagesDropped = "messages.dropped"
+	// MetricDeliveryLatency is the timing between the message is queued and it is sent to the client.
+	MetricDeliveryLatency = "messages.delivery_latency"
+)
+
+// MetricSink is the interface to push the metrics to an external system, e.g: StatsD or OpenTelemetry.
+// The counters of StatsReader remain the source of truth, the sink is an additional push channel.
+// The methods are called in a single goroutine, and the tags must not be modified.
+// See WithMetricSink.
+type MetricSink interface {
+	// RecordCounter adds delta to the counter.
+	RecordCounter(name string, delta int64, tags map[string]string)
+	// RecordGauge sets the gauge to value.
+	RecordGauge(name string, value float64, tags map[string]string)
+	// RecordTiming records a sample of the duration.
+	RecordTiming(name string, d time.Duration, tags map[string]string)
+}
+
+// NopMetricSink is the MetricSink which discards all metrics.
+type NopMetricSink struct{}
+
+func (NopMetricSink) RecordCounter(name string, delta int64, tags map[string]string)    {}
+func (NopMetricSink) RecordGauge(name string, value float64, tags map[string]string)    {}
+func (NopMetricSink) RecordTiming(name string, d time.Duration, tags map[string]string) {}
+
+// metricBufferSize is the number of the metrics buffered for the MetricSink.
+var metricBufferSize = 4096
+
+// qosTags is the tags of each QoS level, which are shared to avoid the allocation on the hot path.
+var qosTags = [3]map[string]string{{"qos": "0"}, {"qos": "1"}, {"qos": "2"}}
+
+func metricQoSTags(qos uint8) map[string]string {
+	if int(qos) < len(qosTags) {
+		return qosTags[qos]
+	}
+	return map[string]string{"qos": strconv.Itoa(int(qos))}
+}
+
+type metricKind byte
+
+const (
+	metricCounter metricKind = iota
+	metricGauge
+	metricTiming
+)
+
+type metric struct {
+	kind  metricKind
+	name  string
+	delta int64
+	value float64
+	d     time.Duration
+	tags  map[string]string
+}
+
+// metricDispatcher calls the MetricSink in a separate goroutine,
+// so that a stalled sink can not slow down the message handling.
+type metricDispatcher struct {
+	sink MetricSink
+	ch   chan metric
+	// discarded is the number of the metrics which are discarded because the buffer is full.
+	discarded uint64
+}
+
+func newMetricDispatcher(sink MetricSink, size int) *metricDispatcher {
+	return &metricDispatcher{
+		sink: sink,
+		ch:   make(chan metric, size),
+	}
+}
+
+// run calls the sink for the buffered metrics until exit is closed.
+func (d *metricDispatcher) run(exit <-chan struct{}) {
+	for {
+		select {
+		case <-exit:
+			return
+		case m := <-d.ch:
+			switch m.kind {
+			case metricCounter:
+				d.sink.RecordCounter(m.name, m.delta, m.tags)
+			case metricGauge:
+				d.sink.RecordGauge(m.name, m.value, m.tags)
+			case metricTiming:
+				d.sink.RecordTiming(m.name, m.d, m.tags)
+			}
+		}
+	}
+}
+
+// record buffers the metric without blocking, the metric is discarded if the buffer is full.
+// It is a no-op if d is nil.
+func (d *metricDispatcher) record(m metric) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.ch <- m:
+	default:
+		if atomic.AddUint64(&d.discarded, 1)%uint64(cap(d.ch)+1) == 1 {
+			zaplog.Warn("the metric sink falls behind, metrics discarded",
+				zap.Uint64("discarded_total", atomic.LoadUint64(&d.discarded)))
+		}
+	}
+}
+
+func (d *metricDispatcher) counter(name string, delta int64, tags map[string]string) {
+	d.record(metric{kind: metricCounter, name: name, delta: delta, tags: tags})
+}
+
+func (d *metricDispatcher) gauge(name string, value float64, tags map[string]string) {
+	d.record(metric{kind: metricGauge, name: name, value: value, tags: tags})
+}
+
+func (d *metricDispatcher) timing(name string, duration time.Duration, tags map[string]string) {
+	d.record(metric{kind: metricTiming, name: name, d: duration, tags: tags})
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// fakeMetricSink records the calls in the format of "type name value tags".
+type fakeMetricSink struct {
+	mu    sync.Mutex
+	calls []string
+	// block blocks the calls until it is closed, nil means not blocking.
+	block chan struct{}
+}
+
+func (f *fakeMetricSink) record(call string) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeMetricSink) RecordCounter(name string, delta int64, tags map[string]string) {
+	f.record(fmt.Sprintf("counter %s %d %v", name, delta, tags))
+}
+
+func (f *fakeMetricSink) RecordGauge(name string, value float64, tags map[string]string) {
+	f.record(fmt.Sprintf("gauge %s %v %v", name, value, tags))
+}
+
+func (f *fakeMetricSink) RecordTiming(name string, d time.Duration, tags map[string]string) {
+	f.record(fmt.Sprintf("timing %s %s %v", name, d, tags))
+}
+
+// waitCalls waits for n calls and returns them.
+func (f *fakeMetricSink) waitCalls(t *testing.T, n int) []string {
+	for i := 0; i < 100; i++ {
+		f.mu.Lock()
+		calls := append([]string{}, f.calls...)
+		f.mu.Unlock()
+		if len(calls) >= n {
+			return calls
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d metric calls", n)
+	return nil
+}
+
+func TestServer_metricSink(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	clk := newTestClock()
+	srv.clock = clk
+	srv.statsManager = newStatsManager(mem.NewStore())
+	sink := &fakeMetricSink{}
+	srv.statsManager.sink = newMetricDispatcher(sink, 100)
+	go srv.statsManager.sink.run(srv.exitChan)
+	defer close(srv.exitChan)
+
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	c.opts.MaxInflight = 10
+	c.newPacketIDLimiter(c.opts.MaxInflight)
+	qs := queue.NewMockStore(ctrl)
+	c.queueStore = qs
+
+	srv.statsManager.clientConnected("cid")
+	srv.statsManager.sessionActive(true)
+	// the message is published and queued a second ago.
+	srv.statsManager.messageReceived(packets.Qos1, "publisher")
+	ids := c.pl.pollPacketIDs(1)
+	qs.EXPECT().Read(ids).Return([]*queue.Elem{{
+		At: clk.Now().Add(-time.Second),
+		MessageWithID: &queue.Publish{
+			Message: &gmqtt.Message{QoS: packets.Qos1, Topic: "topic", PacketID: ids[0]},
+		},
+	}}, nil)
+	_, err = c.pollNewMessages(ids)
+	a.Nil(err)
+	// the next one is dropped.
+	c.queueNotifier.notifyDropped(&gmqtt.Message{QoS: packets.Qos1, Topic: "topic"}, queue.ErrDropQueueFull)
+
+	a.Equal([]string{
+		"counter connections.connected 1 map[]",
+		"gauge sessions.active 1 map[]",
+		"counter messages.received 1 map[qos:1]",
+		"timing messages.delivery_latency 1s map[]",
+		"counter messages.dropped 1 map[qos:1 reason:queue_full]",
+	}, sink.waitCalls(t, 5))
+	// the StatsReader counters are still updated.
+	a.EqualValues(1, srv.statsManager.GetGlobalStats().MessageStats.Qos1.ReceivedTotal)
+	a.EqualValues(1, srv.statsManager.GetGlobalStats().MessageStats.Qos1.DroppedTotal.QueueFull)
+}
+
+func TestMetricDispatcher(t *testing.T) {
+	a := assert.New(t)
+	sink := &fakeMetricSink{block: make(chan struct{})}
+	d := newMetricDispatcher(sink, 1)
+	exit := make(chan struct{})
+	defer close(exit)
+	go d.run(exit)
+
+	d.counter("a", 1, nil)
+	// wait for the sink goroutine to receive the first metric.
+	for len(d.ch) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// a stalled sink does not block the callers.
+	done := make(chan struct{})
+	go func() {
+		for _, name := range []string{"b", "c", "d"} {
+			d.counter(name, 1, nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		a.FailNow("record blocked by the stalled sink")
+	}
+	close(sink.block)
+	// "a" is being recorded and "b" is buffered, the others are discarded.
+	a.Equal([]string{"counter a 1 map[]", "counter b 1 map[]"}, sink.waitCalls(t, 2))
+	a.EqualValues(2, d.discarded)
+
+	// nil dispatcher is a no-op.
+	var md *metricDispatcher
+	md.counter("a", 1, nil)
+	md.gauge("a", 1, nil)
+	md.timing("a", time.Second, nil)
+}
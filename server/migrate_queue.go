@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+var (
+	// ErrSessionNotFound will be returned by MigrateQueue if the source or the destination session does not exist.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionConnected will be returned by MigrateQueue if the source client is connected.
+	ErrSessionConnected = errors.New("source client is connected")
+	// ErrQueueNotEmpty will be returned by MigrateQueue if the destination queue is not empty and MigrateQueueOptions.Append is false.
+	ErrQueueNotEmpty = errors.New("destination queue is not empty")
+	// ErrMigrateNotSupported will be returned by MigrateQueue if the queue store does not implement queue.Drainer.
+	ErrMigrateNotSupported = errors.New("queue store does not support migration")
+)
+
+// MigrateQueueOptions is the options for ClientService.MigrateQueue.
+type MigrateQueueOptions struct {
+	// IncludeInflight indicates whether to migrate the inflight PUBLISH messages,
+	// they will be delivered to the destination as new messages.
+	// If false, the inflight messages are dropped.
+	// The inflight PUBREL packets are always dropped, because the packet ids only make sense in the source session.
+	IncludeInflight bool
+	// Append indicates whether to append the messages to the destination queue if it is not empty.
+	// If false, ErrQueueNotEmpty will be returned for the non-empty destination queue.
+	Append bool
+}
+
+// MigrateQueue implements ClientService.
+// The source session must be disconnected, and the destination session must exist, it can be either connected or not.
+// The source queue will be empty after migration.
+func (c *clientService) MigrateQueue(fromClientID, toClientID string, opts MigrateQueueOptions) (migrated int, err error) {
+	if fromClientID == toClientID {
+		return 0, errors.New("the source and destination client id must be different")
+	}
+	srv := c.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.clients[fromClientID]; ok {
+		return 0, ErrSessionConnected
+	}
+	from, to := srv.queueStore[fromClientID], srv.queueStore[toClientID]
+	if from == nil || to == nil {
+		return 0, ErrSessionNotFound
+	}
+	fromDrainer, ok := from.(queue.Drainer)
+	if !ok {
+		return 0, ErrMigrateNotSupported
+	}
+	if !opts.Append {
+		toDrainer, ok := to.(queue.Drainer)
+		if !ok {
+			return 0, ErrMigrateNotSupported
+		}
+		l, err := toDrainer.Len()
+		if err != nil {
+			return 0, err
+		}
+		if l != 0 {
+			return 0, ErrQueueNotEmpty
+		}
+	}
+	migrated, _, err = srv.migrateQueueLocked(fromClientID, toClientID, fromDrainer, opts)
+	return migrated, err
+}
+
+// migrateQueueLocked drains the source queue into the destination queue, the caller must hold srv.mu.
+// It returns the number of the messages added to the destination queue and the number of the dropped elements.
+func (srv *server) migrateQueueLocked(fromClientID, toClientID string, fromDrainer queue.Drainer, opts MigrateQueueOptions) (migrated, dropped int, err error) {
+	to := srv.queueStore[toClientID]
+	elems, err := fromDrainer.Drain()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, v := range elems {
+		pub, ok := v.MessageWithID.(*queue.Publish)
+		if !ok || (pub.ID() != 0 && !opts.IncludeInflight) {
+			dropped++
+			continue
+		}
+		msg := pub.Message.Copy()
+		msg.PacketID = 0
+		msg.Dup = false
+		err = to.Add(&queue.Elem{
+			At:     v.At,
+			Expiry: v.Expiry,
+			// the payload is kept encoded
+			Codec: v.Codec,
+			MessageWithID: &queue.Publish{
+				Message: msg,
+			},
+		})
+		if err != nil {
+			zaplog.Error("fail to migrate queued message",
+				zap.String("from_client_id", fromClientID),
+				zap.String("to_client_id", toClientID),
+				zap.Error(err))
+			dropped++
+			continue
+		}
+		migrated++
+	}
+	zaplog.Info("queue migrated",
+		zap.String("from_client_id", fromClientID),
+		zap.String("to_client_id", toClientID),
+		zap.Int("migrated", migrated),
+		zap.Int("dropped", dropped))
+	return migrated, dropped, nil
+}
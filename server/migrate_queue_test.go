@@ -0,0 +1,111 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// sliceQueue is a queue.Store which implements queue.Drainer.
+type sliceQueue struct {
+	queue.Store
+	elems []*queue.Elem
+}
+
+func (q *sliceQueue) Add(elem *queue.Elem) error {
+	q.elems = append(q.elems, elem)
+	return nil
+}
+
+func (q *sliceQueue) Len() (int, error) {
+	return len(q.elems), nil
+}
+
+func (q *sliceQueue) Clean() error {
+	q.elems = nil
+	return nil
+}
+
+func (q *sliceQueue) Drain() ([]*queue.Elem, error) {
+	elems := q.elems
+	q.elems = nil
+	return elems, nil
+}
+
+func newMigrateElems() []*queue.Elem {
+	return []*queue.Elem{
+		// inflight
+		{MessageWithID: &queue.Pubrel{PacketID: 1}},
+		{MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "inflight", QoS: packets.Qos1, PacketID: 2, Dup: true}}},
+		// new messages
+		{MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "a", QoS: packets.Qos1}}},
+		{MessageWithID: &queue.Publish{Message: &gmqtt.Message{Topic: "b", QoS: packets.Qos0}}},
+	}
+}
+
+func topicsOf(elems []*queue.Elem) (topics []string) {
+	for _, v := range elems {
+		topics = append(topics, v.MessageWithID.(*queue.Publish).Topic)
+	}
+	return topics
+}
+
+func TestClientService_MigrateQueue(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	cs := &clientService{srv: srv}
+
+	from := &sliceQueue{elems: newMigrateElems()}
+	to := &sliceQueue{}
+	srv.queueStore["old"] = from
+	srv.queueStore["new"] = to
+
+	n, err := cs.MigrateQueue("old", "new", MigrateQueueOptions{})
+	a.NoError(err)
+	a.Equal(2, n)
+	a.Empty(from.elems)
+	a.Equal([]string{"a", "b"}, topicsOf(to.elems))
+
+	// reject the non-empty destination queue.
+	from.elems = newMigrateElems()
+	_, err = cs.MigrateQueue("old", "new", MigrateQueueOptions{IncludeInflight: true})
+	a.Equal(ErrQueueNotEmpty, err)
+	a.Len(from.elems, 4)
+
+	n, err = cs.MigrateQueue("old", "new", MigrateQueueOptions{IncludeInflight: true, Append: true})
+	a.NoError(err)
+	a.Equal(3, n)
+	a.Equal([]string{"a", "b", "inflight", "a", "b"}, topicsOf(to.elems))
+	// the inflight message is migrated as a new message.
+	inflight := to.elems[2].MessageWithID.(*queue.Publish)
+	a.EqualValues(0, inflight.PacketID)
+	a.False(inflight.Dup)
+}
+
+func TestClientService_MigrateQueue_error(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	cs := &clientService{srv: srv}
+	srv.queueStore["old"] = &sliceQueue{elems: newMigrateElems()}
+	srv.queueStore["new"] = &sliceQueue{}
+
+	_, err := cs.MigrateQueue("old", "notexist", MigrateQueueOptions{})
+	a.Equal(ErrSessionNotFound, err)
+	_, err = cs.MigrateQueue("notexist", "new", MigrateQueueOptions{})
+	a.Equal(ErrSessionNotFound, err)
+	_, err = cs.MigrateQueue("old", "old", MigrateQueueOptions{})
+	a.Error(err)
+
+	srv.queueStore["unsupported"] = &countQueue{}
+	_, err = cs.MigrateQueue("unsupported", "new", MigrateQueueOptions{})
+	a.Equal(ErrMigrateNotSupported, err)
+
+	srv.clients["old"] = &client{}
+	_, err = cs.MigrateQueue("old", "new", MigrateQueueOptions{})
+	a.Equal(ErrSessionConnected, err)
+	a.Len(srv.queueStore["old"].(*sliceQueue).elems, 4)
+}
@@ -0,0 +1,23 @@
+package server
+
+import "net"
+
+// namedListener is a net.Listener which tags the accepted connections with the name.
+type namedListener struct {
+	net.Listener
+	name string
+}
+
+// NewNamedListener returns a net.Listener which tags the connections accepted by it with the name.
+// The name is available in ClientOptions.Listener,
+// so that the hooks can treat the messages differently according to the ingress listener.
+// It returns l if the name is empty.
+func NewNamedListener(l net.Listener, name string) net.Listener {
+	if name == "" {
+		return l
+	}
+	return &namedListener{
+		Listener: l,
+		name:     name,
+	}
+}
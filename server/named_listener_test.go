@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestNewNamedListener(t *testing.T) {
+	a := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer l.Close()
+	a.Equal(l, NewNamedListener(l, ""))
+
+	filter := func(clientID string) bool { return true }
+	s := newTCPListenerState(NewNamedListener(NewClientIDFilterListener(l, filter), "public"))
+	a.Equal("public", s.name)
+	a.NotNil(s.clientIDFilter)
+	a.Equal(l.Addr().String(), s.address)
+
+	s = newTCPListenerState(NewClientIDFilterListener(NewNamedListener(l, "internal"), filter))
+	a.Equal("internal", s.name)
+	a.NotNil(s.clientIDFilter)
+	a.Equal(l.Addr().String(), s.address)
+}
+
+func TestServer_routeByListener(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+
+	arrived := make(map[string]string)
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		// force the messages from the public listener into the public/ namespace.
+		if client.ClientOptions().Listener == "public" {
+			req.Message.Topic = "public/" + req.Message.Topic
+		}
+		arrived[client.ClientOptions().ClientID] = req.Message.Topic
+		return nil
+	}
+
+	for _, v := range []struct {
+		clientID string
+		state    *listenerState
+	}{
+		{clientID: "a", state: newWebsocketState(&WsServer{Server: &http.Server{}, Name: "public"})},
+		{clientID: "b", state: newWebsocketState(&WsServer{Server: &http.Server{}, Name: "internal"})},
+	} {
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		v.state.bind(c)
+		c.opts.ClientID = v.clientID
+		c.version = packets.Version311
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:   packets.Version311,
+			TopicName: []byte("sensor"),
+			Payload:   []byte("payload"),
+		}))
+	}
+	a.Equal("public/sensor", arrived["a"])
+	a.Equal("sensor", arrived["b"])
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+)
+
+// unmatchedBufferSize is the number of the unmatched messages buffered for the OnNoSubscriber hook and the dead letters.
+var unmatchedBufferSize = 1024
+
+// noSubscriberDispatcher calls the OnNoSubscriber hook and republishes the dead letters in a separate goroutine,
+// so that the acknowledgement to the publisher is not delayed. See config.NoSubscriber.
+type noSubscriberDispatcher struct {
+	hook OnNoSubscriber
+	// deadLetterPrefix is the topic prefix of the dead letters, empty means the dead letter is disabled.
+	deadLetterPrefix string
+	// publish routes the dead letter.
+	publish func(msg *gmqtt.Message)
+	ch      chan *gmqtt.Message
+	// discarded is the number of the unmatched messages which are discarded because the buffer is full.
+	discarded uint64
+}
+
+func newNoSubscriberDispatcher(hook OnNoSubscriber, deadLetterPrefix string, publish func(msg *gmqtt.Message), size int) *noSubscriberDispatcher {
+	return &noSubscriberDispatcher{
+		hook:             hook,
+		deadLetterPrefix: deadLetterPrefix,
+		publish:          publish,
+		ch:               make(chan *gmqtt.Message, size),
+	}
+}
+
+// run handles the buffered messages until exit is closed.
+func (d *noSubscriberDispatcher) run(exit <-chan struct{}) {
+	for {
+		select {
+		case <-exit:
+			return
+		case msg := <-d.ch:
+			if d.hook != nil {
+				d.hook(context.Background(), msg)
+			}
+			if dl := d.deadLetter(msg); dl != nil {
+				d.publish(dl)
+			}
+		}
+	}
+}
+
+// deadLetter returns the dead letter of the unmatched message, nil if the dead letter is disabled.
+// The message which is published to the dead-letter topics is not republished again.
+func (d *noSubscriberDispatcher) deadLetter(msg *gmqtt.Message) *gmqtt.Message {
+	if d.deadLetterPrefix == "" || msg.Topic == d.deadLetterPrefix || strings.HasPrefix(msg.Topic, d.deadLetterPrefix+"/") {
+		return nil
+	}
+	dl := msg.Copy()
+	dl.Topic = d.deadLetterPrefix + "/" + msg.Topic
+	return dl
+}
+
+// publishDeadLetter routes the dead letter as the message published by the broker.
+// The no-subscriber check only applies to the messages published by the clients, so the unmatched dead letter is not dispatched again.
+func (srv *server) publishDeadLetter(msg *gmqtt.Message) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.deliverMessage("", msg, defaultIterateOptions(msg.Topic))
+}
+
+// dispatch buffers the unmatched message published by the client without blocking,
+// the message is discarded if the buffer is full. It is a no-op if d is nil.
+func (d *noSubscriberDispatcher) dispatch(clientID string, msg *gmqtt.Message) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.ch <- msg:
+	default:
+		if atomic.AddUint64(&d.discarded, 1)%uint64(cap(d.ch)+1) == 1 {
+			zaplog.Warn("the OnNoSubscriber hook or the dead letter falls behind, unmatched messages discarded",
+				zap.String("client_id", clientID),
+				zap.Uint64("discarded_total", atomic.LoadUint64(&d.discarded)))
+		}
+	}
+}
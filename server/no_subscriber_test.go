@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestNoSubscriberDispatcher_deadLetter(t *testing.T) {
+	a := assert.New(t)
+	d := newNoSubscriberDispatcher(nil, "", nil, 1)
+	a.Nil(d.deadLetter(&gmqtt.Message{Topic: "a"}))
+
+	d = newNoSubscriberDispatcher(nil, "$unmatched", nil, 1)
+	msg := &gmqtt.Message{Topic: "a/b", QoS: packets.Qos1, Payload: []byte("payload")}
+	dl := d.deadLetter(msg)
+	a.Equal("$unmatched/a/b", dl.Topic)
+	a.Equal(packets.Qos1, dl.QoS)
+	a.Equal([]byte("payload"), dl.Payload)
+	// the original message is not modified.
+	a.Equal("a/b", msg.Topic)
+
+	// no recursion
+	a.Nil(d.deadLetter(&gmqtt.Message{Topic: "$unmatched/a"}))
+	a.Nil(d.deadLetter(&gmqtt.Message{Topic: "$unmatched"}))
+	a.NotNil(d.deadLetter(&gmqtt.Message{Topic: "$unmatchedx"}))
+
+	// nil dispatcher is a no-op.
+	var nd *noSubscriberDispatcher
+	nd.dispatch("cid", &gmqtt.Message{})
+}
+
+func TestClient_publishHandler_noSubscriber(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+
+	hooked := make(chan string, 10)
+	hook := func(ctx context.Context, msg *gmqtt.Message) {
+		hooked <- msg.Topic
+	}
+	srv.noSubscriber = newNoSubscriberDispatcher(hook, "$unmatched", srv.publishDeadLetter, 10)
+	exit := make(chan struct{})
+	defer close(exit)
+	go srv.noSubscriber.run(exit)
+	dropped := make(chan droppedCall, 10)
+	srv.dropDispatcher = newDropDispatcher(func(ctx context.Context, clientID string, msg *gmqtt.Message, reason DropReason) {
+		dropped <- droppedCall{clientID: clientID, topic: msg.Topic, reason: reason}
+	}, 10)
+	go srv.dropDispatcher.run(exit)
+
+	dl := queue.NewMockStore(ctrl)
+	srv.queueStore["dl"] = dl
+	_, err := srv.subscriptionsDB.Subscribe("dl", &gmqtt.Subscription{TopicFilter: "$unmatched/#", QoS: packets.Qos1})
+	a.Nil(err)
+	sub := queue.NewMockStore(ctrl)
+	srv.queueStore["sub"] = sub
+	_, err = srv.subscriptionsDB.Subscribe("sub", &gmqtt.Subscription{TopicFilter: "matched", QoS: packets.Qos1})
+	a.Nil(err)
+
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "pub"
+	c.opts.RetainAvailable = true
+	c.version = packets.Version5
+	publish := func(topic string, retain bool) {
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:    packets.Version5,
+			Qos:        packets.Qos1,
+			Retain:     retain,
+			PacketID:   1,
+			TopicName:  []byte(topic),
+			Payload:    []byte("payload"),
+			Properties: &packets.Properties{},
+		}))
+		ack := (<-c.out).(*packets.Puback)
+		a.EqualValues(1, ack.PacketID)
+	}
+
+	deadLetter := make(chan string, 10)
+	dl.EXPECT().Add(gomock.Any()).DoAndReturn(func(elem *queue.Elem) error {
+		deadLetter <- elem.MessageWithID.(*queue.Publish).Topic
+		return nil
+	})
+	publish("a/b", false)
+	select {
+	case v := <-hooked:
+		a.Equal("a/b", v)
+	case <-time.After(time.Second):
+		a.FailNow("OnNoSubscriber not called")
+	}
+	select {
+	case v := <-deadLetter:
+		a.Equal("$unmatched/a/b", v)
+	case <-time.After(time.Second):
+		a.FailNow("dead letter not received")
+	}
+	a.Equal(droppedCall{clientID: "pub", topic: "a/b", reason: DropNoSubscriber}, <-dropped)
+
+	// matched
+	sub.EXPECT().Add(gomock.Any()).Return(nil)
+	publish("matched", false)
+	// retained
+	publish("retained", true)
+	// the dead letter is matched by "dl", it is neither reported nor republished.
+	dl.EXPECT().Add(gomock.Any()).Return(nil)
+	publish("$unmatched/x", false)
+
+	// the unmatched dead letter is not dispatched again.
+	a.Nil(srv.subscriptionsDB.Unsubscribe("dl", "$unmatched/#"))
+	publish("c", false)
+	a.Equal("c", <-hooked)
+	a.Equal(droppedCall{clientID: "pub", topic: "c", reason: DropNoSubscriber}, <-dropped)
+	time.Sleep(10 * time.Millisecond)
+	a.Empty(hooked)
+	a.Empty(dropped)
+	a.Empty(srv.noSubscriber.ch)
+}
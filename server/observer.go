@@ -0,0 +1,238 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// DefaultObserverBufferSize is the buffer size used by ObserverService.Register if Observer.BufferSize is 0.
+const DefaultObserverBufferSize = 1000
+
+var (
+	// ErrObserverExists will be returned by ObserverService.Register if the name has been registered.
+	ErrObserverExists = errors.New("observer already exists")
+	// ErrObserverNotFound will be returned by ObserverService.Unregister if the name has not been registered.
+	ErrObserverNotFound = errors.New("observer not found")
+	// ErrInvalidObserver will be returned by ObserverService.Register if the observer is invalid.
+	ErrInvalidObserver = errors.New("invalid observer")
+)
+
+// Observer is a read-only receiver of the published messages, e.g: for auditing.
+//
+// An observer receives a copy of every message which matches its topic filters after the message is routed,
+// no matter whether the message has subscribers or not.
+// It is not a subscription, thus it is never selected as a shared subscription member,
+// and it does not count as a subscriber, e.g: the PUBACK of the v5 publisher is still "No matching subscribers"
+// if the message is only observed.
+// The messages are dropped rather than delaying the routing if the observer is too slow or exceeds the rate limit.
+type Observer struct {
+	// Name is the unique name of the observer.
+	Name string
+	// TopicFilters are the topic filters of the observed messages, empty means all messages.
+	TopicFilters []string
+	// MessagesPerSecond limits the number of the observed messages per second, 0 means no limit.
+	// The messages exceed the limit are dropped.
+	MessagesPerSecond int
+	// BufferSize is the number of the messages waiting for Handle, DefaultObserverBufferSize is used if it is 0.
+	// The messages are dropped if the buffer is full.
+	BufferSize int
+	// Handle is called for every observed message in the order of routing, in a dedicated goroutine of the observer.
+	// The srcClientID is the client id of the publisher, empty if the message is published by the server.
+	Handle func(srcClientID string, msg *gmqtt.Message)
+}
+
+// ObserverInfo is the information of a registered observer.
+type ObserverInfo struct {
+	Name         string
+	TopicFilters []string
+	// ObservedTotal is the number of the messages passed to Handle.
+	ObservedTotal uint64
+	// DroppedTotal is the number of the matched messages dropped because of the rate limit or the full buffer.
+	DroppedTotal uint64
+}
+
+// ObserverService provides the ability to register the observers, see Observer for details.
+type ObserverService interface {
+	// Register registers the observer.
+	// It returns ErrObserverExists if the name has been registered and ErrInvalidObserver if the observer is invalid.
+	Register(observer Observer) error
+	// Unregister stops the observer, the buffered messages are discarded.
+	// It returns ErrObserverNotFound if the name has not been registered.
+	Unregister(name string) error
+	// List returns the registered observers sorted by the name.
+	List() []ObserverInfo
+}
+
+type observer struct {
+	Observer
+	mu sync.Mutex
+	// limiter is nil if MessagesPerSecond is 0.
+	limiter  *tokenBucket
+	msgs     chan observedMessage
+	done     chan struct{}
+	observed uint64
+	dropped  uint64
+}
+
+type observedMessage struct {
+	srcClientID string
+	msg         *gmqtt.Message
+}
+
+func (o *observer) match(topic string) bool {
+	if len(o.TopicFilters) == 0 {
+		return true
+	}
+	for _, v := range o.TopicFilters {
+		if packets.TopicMatch([]byte(topic), []byte(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe enqueues the copy of the message without blocking.
+func (o *observer) observe(srcClientID string, msg *gmqtt.Message, now time.Time) {
+	o.mu.Lock()
+	allowed := true
+	if o.limiter != nil {
+		o.limiter.refill(now)
+		if o.limiter.tokens < 1 {
+			allowed = false
+		} else {
+			o.limiter.tokens--
+		}
+	}
+	o.mu.Unlock()
+	if !allowed {
+		atomic.AddUint64(&o.dropped, 1)
+		return
+	}
+	select {
+	case o.msgs <- observedMessage{srcClientID: srcClientID, msg: msg.Copy()}:
+	default:
+		atomic.AddUint64(&o.dropped, 1)
+	}
+}
+
+func (o *observer) run() {
+	for {
+		select {
+		case <-o.done:
+			return
+		case m := <-o.msgs:
+			o.Handle(m.srcClientID, m.msg)
+			atomic.AddUint64(&o.observed, 1)
+		}
+	}
+}
+
+// observerRegistry implements ObserverService.
+type observerRegistry struct {
+	mu        sync.RWMutex
+	observers map[string]*observer
+}
+
+func newObserverRegistry() *observerRegistry {
+	return &observerRegistry{
+		observers: make(map[string]*observer),
+	}
+}
+
+// Register implements ObserverService.
+func (r *observerRegistry) Register(o Observer) error {
+	if o.Name == "" || o.Handle == nil || o.MessagesPerSecond < 0 || o.BufferSize < 0 {
+		return ErrInvalidObserver
+	}
+	for _, v := range o.TopicFilters {
+		if !packets.ValidTopicFilter(true, []byte(v)) {
+			return ErrInvalidObserver
+		}
+	}
+	if o.BufferSize == 0 {
+		o.BufferSize = DefaultObserverBufferSize
+	}
+	o.TopicFilters = append([]string(nil), o.TopicFilters...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.observers[o.Name]; ok {
+		return ErrObserverExists
+	}
+	ob := &observer{
+		Observer: o,
+		limiter:  newTokenBucket(o.MessagesPerSecond),
+		msgs:     make(chan observedMessage, o.BufferSize),
+		done:     make(chan struct{}),
+	}
+	r.observers[o.Name] = ob
+	go ob.run()
+	return nil
+}
+
+// Unregister implements ObserverService.
+func (r *observerRegistry) Unregister(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o, ok := r.observers[name]
+	if !ok {
+		return ErrObserverNotFound
+	}
+	close(o.done)
+	delete(r.observers, name)
+	return nil
+}
+
+// List implements ObserverService.
+func (r *observerRegistry) List() []ObserverInfo {
+	r.mu.RLock()
+	rs := make([]ObserverInfo, 0, len(r.observers))
+	for _, o := range r.observers {
+		rs = append(rs, ObserverInfo{
+			Name:          o.Name,
+			TopicFilters:  append([]string(nil), o.TopicFilters...),
+			ObservedTotal: atomic.LoadUint64(&o.observed),
+			DroppedTotal:  atomic.LoadUint64(&o.dropped),
+		})
+	}
+	r.mu.RUnlock()
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].Name < rs[j].Name
+	})
+	return rs
+}
+
+// observe passes the routed message to the matched observers.
+func (r *observerRegistry) observe(srcClientID string, msg *gmqtt.Message) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.observers) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, o := range r.observers {
+		if o.match(msg.Topic) {
+			o.observe(srcClientID, msg, now)
+		}
+	}
+}
+
+// close stops all observers.
+func (r *observerRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, o := range r.observers {
+		close(o.done)
+		delete(r.observers, name)
+	}
+}
+
+// ObserverService returns the ObserverService of the server.
+func (srv *server) ObserverService() ObserverService {
+	return srv.observers
+}
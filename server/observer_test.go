@@ -0,0 +1,117 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+type observed struct {
+	srcClientID string
+	topic       string
+}
+
+func TestServer_observer_sharedSubscription(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	members := []string{"c1", "c2"}
+	ts := newTestDeliverMsg(ctrl, members[0])
+	srv := ts.srv
+	srv.observers = newObserverRegistry()
+	received := make(map[string]int)
+	for _, v := range members {
+		mockQueue := queue.NewMockStore(ctrl)
+		clientID := v
+		mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+			received[clientID]++
+		}).AnyTimes()
+		srv.queueStore[v] = mockQueue
+		_, err := srv.subscriptionsDB.Subscribe(v, &gmqtt.Subscription{
+			ShareName:   "g",
+			TopicFilter: "/abc",
+			QoS:         1,
+		})
+		a.Nil(err)
+	}
+	ch := make(chan observed, 10)
+	a.Nil(srv.ObserverService().Register(Observer{
+		Name: "audit",
+		Handle: func(srcClientID string, msg *gmqtt.Message) {
+			ch <- observed{srcClientID: srcClientID, topic: msg.Topic}
+		},
+	}))
+	defer srv.observers.close()
+
+	msg := &gmqtt.Message{Topic: "/abc", QoS: 1}
+	a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+	a.Equal(1, received["c1"]+received["c2"])
+	select {
+	case o := <-ch:
+		a.Equal(observed{srcClientID: "srcCli", topic: "/abc"}, o)
+	case <-time.After(time.Second):
+		a.FailNow("observer timeout")
+	}
+
+	// the observer is not a subscriber.
+	msg = &gmqtt.Message{Topic: "/no_subscriber", QoS: 1}
+	a.False(srv.deliverMessage("", msg, defaultIterateOptions(msg.Topic)))
+	select {
+	case o := <-ch:
+		a.Equal(observed{topic: "/no_subscriber"}, o)
+	case <-time.After(time.Second):
+		a.FailNow("observer timeout")
+	}
+}
+
+func TestObserverRegistry(t *testing.T) {
+	a := assert.New(t)
+	r := newObserverRegistry()
+	defer r.close()
+	handle := func(srcClientID string, msg *gmqtt.Message) {}
+
+	a.Equal(ErrInvalidObserver, r.Register(Observer{Handle: handle}))
+	a.Equal(ErrInvalidObserver, r.Register(Observer{Name: "a"}))
+	a.Equal(ErrInvalidObserver, r.Register(Observer{Name: "a", Handle: handle, TopicFilters: []string{"a/#/b"}}))
+
+	// the blocked handler fills up the buffer.
+	block := make(chan struct{})
+	defer close(block)
+	a.Nil(r.Register(Observer{
+		Name:         "slow",
+		TopicFilters: []string{"a/+"},
+		BufferSize:   1,
+		Handle: func(srcClientID string, msg *gmqtt.Message) {
+			<-block
+		},
+	}))
+	a.Nil(r.Register(Observer{
+		Name:              "limited",
+		MessagesPerSecond: 2,
+		Handle:            handle,
+	}))
+	a.Equal(ErrObserverExists, r.Register(Observer{Name: "slow", Handle: handle}))
+
+	for i := 0; i < 5; i++ {
+		r.observe("cid", &gmqtt.Message{Topic: "a/b"})
+	}
+	r.observe("cid", &gmqtt.Message{Topic: "b"})
+	rs := r.List()
+	a.Len(rs, 2)
+	a.Equal("limited", rs[0].Name)
+	// the rate limit allows 2 messages.
+	a.EqualValues(4, rs[0].DroppedTotal)
+	a.Equal("slow", rs[1].Name)
+	a.Equal([]string{"a/+"}, rs[1].TopicFilters)
+	// one message is being handled and one is buffered at most.
+	a.True(rs[1].DroppedTotal >= 3)
+
+	a.Nil(r.Unregister("slow"))
+	a.Equal(ErrObserverNotFound, r.Unregister("slow"))
+	a.Len(r.List(), 1)
+}
@@ -4,6 +4,8 @@ import (
 	"net"
 
 	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
 	"github.com/DrmagicE/gmqtt/retained"
 	"go.uber.org/zap"
 )
@@ -13,7 +15,7 @@ type Options func(srv *server)
 // WithConfig set the config of the server
 func WithConfig(config config.Config) Options {
 	return func(srv *server) {
-		srv.config = config
+		srv.storeConfig(config)
 	}
 }
 
@@ -51,9 +53,85 @@ func WithLogger(logger *zap.Logger) Options {
 	}
 }
 
+// WithLogLevel set the level of the logger, so that the log level can be changed by ApplyConfig and ReloadConfig.
+// It should be the level of the logger set by WithLogger, see config.Config.GetLoggerWithLevel.
+func WithLogLevel(level zap.AtomicLevel) Options {
+	return func(srv *server) {
+		srv.logLevel = &level
+	}
+}
+
+// WithConfigLoader set the ConfigLoader which is used by ReloadConfig to load the config.
+// ReloadConfig returns ErrConfigLoaderNotSet if it is not set.
+func WithConfigLoader(loader ConfigLoader) Options {
+	return func(srv *server) {
+		srv.configLoader = loader
+	}
+}
+
+// WithPacketIDAllocator set the constructor of the packet id allocator of the server.
+// Default to NewSequentialAllocator.
+func WithPacketIDAllocator(new NewPacketIDAllocator) Options {
+	return func(srv *server) {
+		srv.newPacketIDAllocator = new
+	}
+}
+
+// WithPublishLimiter set the constructor of the inbound publish rate limiter of the server.
+// Default to NewTokenBucketLimiter. It only takes effect if config.PublishRateLimit is enabled.
+func WithPublishLimiter(new NewPublishLimiter) Options {
+	return func(srv *server) {
+		srv.newPublishLimiter = new
+	}
+}
+
+// WithCertUsernameFunc set the function which maps the verified client certificate to ConnectRequest.CertUsername.
+// Default to CommonNameUsername.
+func WithCertUsernameFunc(fn CertUsernameFunc) Options {
+	return func(srv *server) {
+		srv.certUsernameFunc = fn
+	}
+}
+
+// WithSubscriptionStore set the constructor of the subscription store of the server.
+// If set, the subscription store will be created by the constructor instead of Persistence.NewSubscriptionStore,
+// the other stores are still provided by the Persistence.
+func WithSubscriptionStore(new NewSubscriptionStore) Options {
+	return func(srv *server) {
+		srv.newSubscriptionStore = new
+	}
+}
+
+// WithPayloadCodec set the codec to transform the payloads of the queued messages at rest, e.g: compression or encryption.
+// See queue.PayloadCodec for details.
+func WithPayloadCodec(codec queue.PayloadCodec) Options {
+	return func(srv *server) {
+		srv.payloadCodec = codec
+	}
+}
+
+// WithMetricSink set the sink to push the metrics to an external system, e.g: StatsD, see MetricSink.
+// The metrics are buffered and the sink is called in a separate goroutine,
+// the metrics are discarded if the buffer is full, so that a stalled sink can not slow down the message handling.
+func WithMetricSink(sink MetricSink) Options {
+	return func(srv *server) {
+		srv.metricSink = sink
+	}
+}
+
 // WithRetainedStore set retained db of the server. Notice: WithRetainedStore(s) will overwrite retainedDB.
 func WithRetainedStore(store retained.Store) Options {
 	return func(srv *server) {
 		srv.retainedDB = store
+		srv.customRetainedDB = true
+	}
+}
+
+// WithClock set the time source of the time-based features, e.g: session expiry, message expiry,
+// delayed will messages, scheduled messages and bans. Default to clock.New(), the wall clock.
+// It is useful to test these features with a fake clock.
+func WithClock(c clock.Clock) Options {
+	return func(srv *server) {
+		srv.clock = c
 	}
 }
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// upperCodec is a queue.PayloadCodec which stores the payload in upper case with a "#" prefix.
+type upperCodec struct {
+	version uint8
+}
+
+func (u *upperCodec) Version() uint8 {
+	return u.version
+}
+
+func (u *upperCodec) Encode(payload []byte) ([]byte, error) {
+	return append([]byte("#"), bytes.ToUpper(payload)...), nil
+}
+
+func (u *upperCodec) Decode(payload []byte) ([]byte, error) {
+	return bytes.ToLower(payload[1:]), nil
+}
+
+// elemQueue is a queue.Store which records the added elems.
+type elemQueue struct {
+	queue.Store
+	elems []*queue.Elem
+}
+
+func (q *elemQueue) Add(elem *queue.Elem) error {
+	q.elems = append(q.elems, elem)
+	return nil
+}
+
+func TestServer_enqueueLocked_payloadCodec(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.payloadCodec = &upperCodec{version: 1}
+	q := &elemQueue{}
+	for _, qos := range []uint8{packets.Qos0, packets.Qos1, packets.Qos2} {
+		msg := &gmqtt.Message{
+			QoS:           qos,
+			Topic:         "a",
+			Payload:       []byte("payload"),
+			PayloadFormat: packets.PayloadFormatString,
+		}
+		a.False(srv.enqueueLocked(time.Now(), "cid", msg, time.Time{}, q))
+		// the routed message is not modified
+		a.Equal([]byte("payload"), msg.Payload)
+	}
+	// QoS 0 messages bypass the codec
+	a.EqualValues(0, q.elems[0].Codec)
+	a.Equal([]byte("payload"), q.elems[0].MessageWithID.(*queue.Publish).Payload)
+	for _, v := range q.elems[1:] {
+		a.EqualValues(1, v.Codec)
+		pub := v.MessageWithID.(*queue.Publish)
+		a.Equal([]byte("#PAYLOAD"), pub.Payload)
+		a.Equal(packets.PayloadFormatString, pub.PayloadFormat)
+	}
+}
+
+func TestClient_pollNewMessages_payloadCodec(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	srv.payloadCodec = &upperCodec{version: 2}
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	c.opts.MaxInflight = 10
+	c.newPacketIDLimiter(c.opts.MaxInflight)
+	qs := queue.NewMockStore(ctrl)
+	c.queueStore = qs
+
+	var dropped []error
+	c.queueNotifier.dropHook = func(ctx context.Context, clientID string, msg *gmqtt.Message, err error) {
+		dropped = append(dropped, err)
+	}
+	newElem := func(codec uint8, id packets.PacketID, payload string) *queue.Elem {
+		return &queue.Elem{
+			At:    time.Now(),
+			Codec: codec,
+			MessageWithID: &queue.Publish{
+				Message: &gmqtt.Message{
+					QoS:           packets.Qos1,
+					Topic:         "topic",
+					Payload:       []byte(payload),
+					PacketID:      id,
+					PayloadFormat: packets.PayloadFormatString,
+				},
+			},
+		}
+	}
+	ids := c.pl.pollPacketIDs(3)
+	a.Len(ids, 3)
+	encoded := newElem(2, ids[0], "#PAYLOAD")
+	qs.EXPECT().Read(ids).Return([]*queue.Elem{
+		encoded,
+		// encoded by the previous codec before restart
+		newElem(1, ids[1], "#PAYLOAD"),
+		// stored before the codec is enabled
+		newElem(0, ids[2], "raw"),
+	}, nil)
+	qs.EXPECT().Remove(ids[1]).Return(nil)
+	unused, err := c.pollNewMessages(ids)
+	a.Nil(err)
+	a.Len(unused, 0)
+
+	pub := (<-c.out).(*packets.Publish)
+	a.Equal([]byte("payload"), pub.Payload)
+	a.Equal(ids[0], pub.PacketID)
+	a.Equal(packets.PayloadFormatString, *pub.Properties.PayloadFormat)
+	// the stored elem is kept encoded for retransmission
+	a.Equal([]byte("#PAYLOAD"), encoded.MessageWithID.(*queue.Publish).Payload)
+	pub = (<-c.out).(*packets.Publish)
+	a.Equal([]byte("raw"), pub.Payload)
+	a.Equal([]error{queue.ErrDropCodecMismatch}, dropped)
+	// the packet id of the dropped message is released
+	a.False(c.pl.inUseLocked(ids[1]))
+}
@@ -1,15 +1,26 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"io"
+
 	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/ban"
 	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
 	"github.com/DrmagicE/gmqtt/persistence/session"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	"github.com/DrmagicE/gmqtt/persistence/unack"
+	"github.com/DrmagicE/gmqtt/retained"
 )
 
 type NewPersistence func(config config.Config) (Persistence, error)
 
+// NewSubscriptionStore is the constructor of the subscription store.
+// It can be set by WithSubscriptionStore to use a custom subscription store instead of the one provided by Persistence.
+type NewSubscriptionStore func(config config.Config) (subscription.Store, error)
+
 type Persistence interface {
 	Open() error
 	NewQueueStore(config config.Config, defaultNotifier queue.Notifier, clientID string) (queue.Store, error)
@@ -18,3 +29,45 @@ type Persistence interface {
 	NewUnackStore(config config.Config, clientID string) (unack.Store, error)
 	Close() error
 }
+
+// ErrPersistenceOpened is returned by BackupablePersistence.Restore if the persistence is in use.
+var ErrPersistenceOpened = errors.New("cannot restore into an opened persistence, the broker must be stopped")
+
+// BackupablePersistence is an optional interface for Persistence to snapshot the persisted state,
+// e.g: for migration or disaster recovery.
+// The retained messages are included if the Persistence implements RetainedPersistence, which both built-in ones do.
+// The retained messages of the store set by WithRetainedStore are not included.
+type BackupablePersistence interface {
+	// Backup writes the sessions, subscriptions, queued messages and retained messages into w in a versioned stream.
+	Backup(w io.Writer) error
+	// Restore reads the stream written by Backup.
+	// The state of the clients in the stream replaces the existing one, the other clients are kept.
+	// It returns ErrPersistenceOpened if the persistence has been opened, i.e: the broker is running.
+	Restore(r io.Reader) error
+}
+
+// SchedulablePersistence is an optional interface for Persistence to persist the messages scheduled by ScheduleService.
+// If the Persistence does not implement it, the scheduled messages are kept in memory and lost after the broker restarts.
+type SchedulablePersistence interface {
+	NewScheduledStore(config config.Config) (scheduled.Store, error)
+}
+
+// RetainedPersistence is an optional interface for Persistence to provide the retained store,
+// e.g: to persist the retained messages. It is not used if the retained store is set by WithRetainedStore.
+// If the Persistence does not implement it, the retained messages are kept in memory and lost after the broker restarts.
+type RetainedPersistence interface {
+	NewRetainedStore(config config.Config) (retained.Store, error)
+}
+
+// BanPersistence is an optional interface for Persistence to persist the ban list, see config.BanList.
+type BanPersistence interface {
+	NewBanStore(config config.Config) (ban.Store, error)
+}
+
+// HealthCheckPersistence is an optional interface for Persistence to report whether the backend is reachable,
+// see config.PersistenceHealthCheck. If the Persistence does not implement it, the backend is always considered healthy.
+type HealthCheckPersistence interface {
+	// Ping checks the reachability of the backend, e.g: round-trips a PING to redis.
+	// It should return before the context is done.
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// PersistenceHealth is the health state of the persistence backend, see config.PersistenceHealthCheck.
+type PersistenceHealth struct {
+	// Enabled indicates whether the health check is enabled.
+	// It is false if the interval is 0 or the persistence does not implement HealthCheckPersistence.
+	Enabled bool
+	// Healthy is false once FailureThreshold consecutive probes have failed, until a probe succeeds.
+	// It is always true if the health check is disabled.
+	Healthy bool
+	// ConsecutiveFailures is the number of the consecutive failed probes.
+	ConsecutiveFailures int
+	// LastCheck is the time of the last probe, zero if the backend has not been probed yet.
+	LastCheck time.Time
+	// LastError is the error of the last failed probe, empty if no probe has failed.
+	LastError string
+	// LastErrorTime is the time of the last failed probe.
+	LastErrorTime time.Time
+}
+
+// persistenceHealth probes the persistence backend periodically.
+type persistenceHealth struct {
+	mu     sync.Mutex
+	pinger HealthCheckPersistence
+	config config.PersistenceHealthCheck
+	state  PersistenceHealth
+}
+
+func newPersistenceHealth(pinger HealthCheckPersistence, config config.PersistenceHealthCheck) *persistenceHealth {
+	return &persistenceHealth{
+		pinger: pinger,
+		config: config,
+		state: PersistenceHealth{
+			Enabled: true,
+			Healthy: true,
+		},
+	}
+}
+
+// probe pings the backend and updates the state.
+// It returns the new state and whether the health has been changed.
+func (h *persistenceHealth) probe(now time.Time) (state PersistenceHealth, changed bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	err := h.pinger.Ping(ctx)
+	cancel()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev := h.state.Healthy
+	h.state.LastCheck = now
+	if err != nil {
+		h.state.ConsecutiveFailures++
+		h.state.LastError = err.Error()
+		h.state.LastErrorTime = now
+		if h.state.ConsecutiveFailures >= h.config.FailureThreshold {
+			h.state.Healthy = false
+		}
+	} else {
+		h.state.ConsecutiveFailures = 0
+		h.state.Healthy = true
+	}
+	return h.state, prev != h.state.Healthy
+}
+
+func (h *persistenceHealth) get() PersistenceHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// PersistenceHealth returns the health state of the persistence backend.
+func (srv *server) PersistenceHealth() PersistenceHealth {
+	if srv.persistenceHealth == nil {
+		return PersistenceHealth{
+			Healthy: true,
+		}
+	}
+	return srv.persistenceHealth.get()
+}
+
+// persistenceHealthLoop probes the persistence backend until the server is stopped.
+// The probe runs in its own goroutine, so that a blocked backend does not stall the event loop.
+func (srv *server) persistenceHealthLoop() {
+	defer srv.wg.Done()
+	ticker := time.NewTicker(srv.persistenceHealth.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.exitChan:
+			return
+		case <-ticker.C:
+			srv.checkPersistenceHealth()
+		}
+	}
+}
+
+func (srv *server) checkPersistenceHealth() {
+	state, changed := srv.persistenceHealth.probe(time.Now())
+	if !changed {
+		return
+	}
+	srv.statsManager.persistenceUnhealthy(!state.Healthy)
+	if !state.Healthy {
+		zaplog.Error("persistence backend is unhealthy",
+			zap.Int("consecutive_failures", state.ConsecutiveFailures),
+			zap.String("last_error", state.LastError))
+	} else {
+		zaplog.Info("persistence backend is healthy again")
+	}
+}
+
+// checkPersistentSession returns the error of CONNACK if the client requires a persistent session while the persistence backend is unhealthy,
+// see config.PersistenceHealthCheck.RejectPersistentSessions.
+func (srv *server) checkPersistentSession(connect *packets.Connect, client *client) error {
+	if srv.persistenceHealth == nil {
+		return nil
+	}
+	reject := srv.config().Persistence.HealthCheck.RejectPersistentSessions
+	if !reject {
+		return nil
+	}
+	if packets.IsVersion3X(client.version) && connect.CleanStart {
+		return nil
+	}
+	if packets.IsVersion5(client.version) && client.opts.SessionExpiry == 0 {
+		return nil
+	}
+	if srv.persistenceHealth.get().Healthy {
+		return nil
+	}
+	srv.statsManager.persistenceRejected()
+	code := codes.ServerUnavailable
+	if packets.IsVersion3X(client.version) {
+		code = codes.V3ServerUnavaliable
+	}
+	return &codes.Error{
+		Code: code,
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+type testPinger struct {
+	err error
+}
+
+func (p *testPinger) Ping(ctx context.Context) error {
+	return p.err
+}
+
+func TestPersistenceHealth_probe(t *testing.T) {
+	a := assert.New(t)
+	p := &testPinger{}
+	h := newPersistenceHealth(p, config.PersistenceHealthCheck{
+		Interval:         time.Second,
+		Timeout:          time.Second,
+		FailureThreshold: 2,
+	})
+	now := time.Now()
+	state, changed := h.probe(now)
+	a.False(changed)
+	a.True(state.Enabled)
+	a.True(state.Healthy)
+	a.Equal(now, state.LastCheck)
+
+	p.err = errors.New("connection refused")
+	state, changed = h.probe(now.Add(time.Second))
+	a.False(changed)
+	a.True(state.Healthy)
+	a.Equal(1, state.ConsecutiveFailures)
+
+	state, changed = h.probe(now.Add(2 * time.Second))
+	a.True(changed)
+	a.False(state.Healthy)
+	a.Equal(2, state.ConsecutiveFailures)
+	a.Equal("connection refused", state.LastError)
+	a.Equal(now.Add(2*time.Second), state.LastErrorTime)
+
+	p.err = nil
+	state, changed = h.probe(now.Add(3 * time.Second))
+	a.True(changed)
+	a.True(state.Healthy)
+	a.Equal(0, state.ConsecutiveFailures)
+	// the last error is kept for troubleshooting
+	a.Equal("connection refused", state.LastError)
+	a.Equal(state, h.get())
+}
+
+func TestServer_checkPersistentSession(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	// the health check is disabled
+	a.Equal(PersistenceHealth{Healthy: true}, srv.PersistenceHealth())
+
+	cfg := config.DefaultConfig()
+	cfg.Persistence.HealthCheck.RejectPersistentSessions = true
+	srv.ApplyConfig(cfg)
+	p := &testPinger{err: errors.New("connection refused")}
+	srv.persistenceHealth = newPersistenceHealth(p, cfg.Persistence.HealthCheck)
+	for i := 0; i < cfg.Persistence.HealthCheck.FailureThreshold; i++ {
+		srv.checkPersistenceHealth()
+	}
+	a.False(srv.PersistenceHealth().Healthy)
+	a.EqualValues(1, srv.statsManager.GetGlobalStats().ConnectionStats.PersistenceUnhealthy)
+
+	var tt = []struct {
+		name       string
+		version    packets.Version
+		cleanStart bool
+		expiry     uint32
+		code       codes.Code
+	}{
+		{name: "v3_clean_session", version: packets.Version311, cleanStart: true},
+		{name: "v3_persistent", version: packets.Version311, code: codes.V3ServerUnavaliable},
+		{name: "v5_no_expiry", version: packets.Version5, cleanStart: true},
+		{name: "v5_persistent", version: packets.Version5, expiry: 60, code: codes.ServerUnavailable},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.version = v.version
+			c.opts.SessionExpiry = v.expiry
+			err = srv.checkPersistentSession(&packets.Connect{CleanStart: v.cleanStart}, c)
+			if v.code == 0 {
+				a.Nil(err)
+			} else {
+				a.Equal(v.code, converError(err).Code)
+			}
+		})
+	}
+	a.EqualValues(2, srv.statsManager.GetGlobalStats().ConnectionStats.PersistenceRejectedTotal)
+
+	p.err = nil
+	srv.checkPersistenceHealth()
+	a.True(srv.PersistenceHealth().Healthy)
+	a.EqualValues(0, srv.statsManager.GetGlobalStats().ConnectionStats.PersistenceUnhealthy)
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version311
+	a.Nil(srv.checkPersistentSession(&packets.Connect{}, c))
+}
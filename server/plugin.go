@@ -6,25 +6,40 @@ import (
 
 // HookWrapper groups all hook wrappers function
 type HookWrapper struct {
-	OnBasicAuthWrapper         OnBasicAuthWrapper
-	OnEnhancedAuthWrapper      OnEnhancedAuthWrapper
-	OnConnectedWrapper         OnConnectedWrapper
-	OnReAuthWrapper            OnReAuthWrapper
-	OnSessionCreatedWrapper    OnSessionCreatedWrapper
-	OnSessionResumedWrapper    OnSessionResumedWrapper
-	OnSessionTerminatedWrapper OnSessionTerminatedWrapper
-	OnSubscribeWrapper         OnSubscribeWrapper
-	OnSubscribedWrapper        OnSubscribedWrapper
-	OnUnsubscribeWrapper       OnUnsubscribeWrapper
-	OnUnsubscribedWrapper      OnUnsubscribedWrapper
-	OnMsgArrivedWrapper        OnMsgArrivedWrapper
-	OnMsgDroppedWrapper        OnMsgDroppedWrapper
-	OnDeliveredWrapper         OnDeliveredWrapper
-	OnClosedWrapper            OnClosedWrapper
-	OnAcceptWrapper            OnAcceptWrapper
-	OnStopWrapper              OnStopWrapper
-	OnWillPublishWrapper       OnWillPublishWrapper
-	OnWillPublishedWrapper     OnWillPublishedWrapper
+	OnBasicAuthWrapper             OnBasicAuthWrapper
+	OnEnhancedAuthWrapper          OnEnhancedAuthWrapper
+	OnConnectedWrapper             OnConnectedWrapper
+	OnReAuthWrapper                OnReAuthWrapper
+	OnSessionCreatedWrapper        OnSessionCreatedWrapper
+	OnSessionResumedWrapper        OnSessionResumedWrapper
+	OnSessionTerminatedWrapper     OnSessionTerminatedWrapper
+	OnSubscribeWrapper             OnSubscribeWrapper
+	OnSubscribedWrapper            OnSubscribedWrapper
+	OnUnsubscribeWrapper           OnUnsubscribeWrapper
+	OnUnsubscribedWrapper          OnUnsubscribedWrapper
+	OnMsgArrivedWrapper            OnMsgArrivedWrapper
+	OnMsgDroppedWrapper            OnMsgDroppedWrapper
+	OnDeliveredWrapper             OnDeliveredWrapper
+	OnClosedWrapper                OnClosedWrapper
+	OnAcceptWrapper                OnAcceptWrapper
+	OnStopWrapper                  OnStopWrapper
+	OnWillPublishWrapper           OnWillPublishWrapper
+	OnWillPublishedWrapper         OnWillPublishedWrapper
+	OnWillDelayedWrapper           OnWillDelayedWrapper
+	OnWillDelayWrapper             OnWillDelayWrapper
+	OnReconnectStormWrapper        OnReconnectStormWrapper
+	OnLifecycleStateChangedWrapper OnLifecycleStateChangedWrapper
+	OnKeepAliveTimeoutWrapper      OnKeepAliveTimeoutWrapper
+	OnSessionTakeoverWrapper       OnSessionTakeoverWrapper
+	OnMessageDroppedWrapper        OnMessageDroppedWrapper
+	OnAuthorizeWrapper             OnAuthorizeWrapper
+	OnTopicRewriteWrapper          OnTopicRewriteWrapper
+	OnRedirectWrapper              OnRedirectWrapper
+	OnSlowConsumerWrapper          OnSlowConsumerWrapper
+	OnTopicPolicyWrapper           OnTopicPolicyWrapper
+	OnConnectRejectedWrapper       OnConnectRejectedWrapper
+	OnClientIDWrapper              OnClientIDWrapper
+	OnNoSubscriberWrapper          OnNoSubscriberWrapper
 }
 
 // NewPlugin is the constructor of a plugin.
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PluginDependencies can be implemented by the plugin which depends on other plugins.
+// The dependencies must be enabled as well, and they are loaded before the plugin.
+type PluginDependencies interface {
+	// Dependencies returns the names of the plugins which must be loaded before the plugin.
+	Dependencies() []string
+}
+
+// PluginPriority can be implemented by the plugin which needs to be loaded earlier or later than others.
+// Plugins with the smaller priority are loaded first, and their hooks are invoked first.
+// The plugin which does not implement PluginPriority has the priority 0.
+// The priority never breaks the dependencies, see PluginDependencies.
+type PluginPriority interface {
+	// Priority returns the priority of the plugin.
+	Priority() int
+}
+
+func pluginPriority(p Plugin) int {
+	if pp, ok := p.(PluginPriority); ok {
+		return pp.Priority()
+	}
+	return 0
+}
+
+func pluginDependencies(p Plugin) []string {
+	if pd, ok := p.(PluginDependencies); ok {
+		return pd.Dependencies()
+	}
+	return nil
+}
+
+// sortPlugins returns the plugins in the loading order.
+// The plugins are sorted by priority first, the plugins with the same priority keep the given order.
+// Then the plugins are topologically sorted by the dependencies,
+// the first plugin whose dependencies have been loaded is always picked, so the result is deterministic.
+// It returns error if the plugin names are duplicated, a dependency is not enabled or the dependencies have a cycle.
+func sortPlugins(plgs []Plugin) ([]Plugin, error) {
+	enabled := make(map[string]struct{}, len(plgs))
+	for _, p := range plgs {
+		if _, ok := enabled[p.Name()]; ok {
+			return nil, fmt.Errorf("duplicated plugin: %s", p.Name())
+		}
+		enabled[p.Name()] = struct{}{}
+	}
+	for _, p := range plgs {
+		for _, dep := range pluginDependencies(p) {
+			if _, ok := enabled[dep]; !ok {
+				return nil, fmt.Errorf("plugin %s requires plugin %s, which is not enabled", p.Name(), dep)
+			}
+		}
+	}
+	pending := make([]Plugin, len(plgs))
+	copy(pending, plgs)
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pluginPriority(pending[i]) < pluginPriority(pending[j])
+	})
+	loaded := make(map[string]struct{}, len(plgs))
+	sorted := make([]Plugin, 0, len(plgs))
+	for len(pending) != 0 {
+		next := -1
+		for i, p := range pending {
+			if depsLoaded(p, loaded) {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			names := make([]string, len(pending))
+			for i, p := range pending {
+				names[i] = p.Name()
+			}
+			return nil, fmt.Errorf("plugin dependency cycle among: %s", strings.Join(names, ", "))
+		}
+		p := pending[next]
+		loaded[p.Name()] = struct{}{}
+		sorted = append(sorted, p)
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+	return sorted, nil
+}
+
+func depsLoaded(p Plugin, loaded map[string]struct{}) bool {
+	for _, dep := range pluginDependencies(p) {
+		if _, ok := loaded[dep]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type orderedPlugin struct {
+	name     string
+	deps     []string
+	priority int
+	calls    *[]string
+}
+
+func (p *orderedPlugin) Load(service Server) error {
+	return nil
+}
+
+func (p *orderedPlugin) Unload() error {
+	return nil
+}
+
+func (p *orderedPlugin) HookWrapper() HookWrapper {
+	return HookWrapper{
+		OnBasicAuthWrapper: func(pre OnBasicAuth) OnBasicAuth {
+			return func(ctx context.Context, client Client, req *ConnectRequest) error {
+				*p.calls = append(*p.calls, p.name)
+				return pre(ctx, client, req)
+			}
+		},
+	}
+}
+
+func (p *orderedPlugin) Name() string {
+	return p.name
+}
+
+func (p *orderedPlugin) Dependencies() []string {
+	return p.deps
+}
+
+func (p *orderedPlugin) Priority() int {
+	return p.priority
+}
+
+func pluginNames(plgs []Plugin) []string {
+	var names []string
+	for _, v := range plgs {
+		names = append(names, v.Name())
+	}
+	return names
+}
+
+func TestSortPlugins(t *testing.T) {
+	var tt = []struct {
+		name     string
+		plugins  []*orderedPlugin
+		expected []string
+		err      string
+	}{
+		{
+			name: "keep_order",
+			plugins: []*orderedPlugin{
+				{name: "prometheus"}, {name: "admin"}, {name: "auth"},
+			},
+			expected: []string{"prometheus", "admin", "auth"},
+		},
+		{
+			name: "dependencies",
+			plugins: []*orderedPlugin{
+				{name: "admin", deps: []string{"auth"}}, {name: "prometheus"}, {name: "auth"},
+			},
+			expected: []string{"prometheus", "auth", "admin"},
+		},
+		{
+			name: "priority",
+			plugins: []*orderedPlugin{
+				{name: "prometheus", priority: 10}, {name: "admin"}, {name: "acl", priority: -10},
+			},
+			expected: []string{"acl", "admin", "prometheus"},
+		},
+		{
+			name: "dependencies_over_priority",
+			plugins: []*orderedPlugin{
+				{name: "admin", priority: -10, deps: []string{"auth"}}, {name: "auth", priority: 10}, {name: "prometheus"},
+			},
+			expected: []string{"prometheus", "auth", "admin"},
+		},
+		{
+			name: "missing_dependency",
+			plugins: []*orderedPlugin{
+				{name: "admin", deps: []string{"auth"}}, {name: "prometheus"},
+			},
+			err: "plugin admin requires plugin auth, which is not enabled",
+		},
+		{
+			name: "cycle",
+			plugins: []*orderedPlugin{
+				{name: "prometheus"}, {name: "a", deps: []string{"b"}}, {name: "b", deps: []string{"a"}},
+			},
+			err: "plugin dependency cycle among: a, b",
+		},
+		{
+			name: "duplicated",
+			plugins: []*orderedPlugin{
+				{name: "admin"}, {name: "admin"},
+			},
+			err: "duplicated plugin: admin",
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			var plgs []Plugin
+			for _, p := range v.plugins {
+				plgs = append(plgs, p)
+			}
+			sorted, err := sortPlugins(plgs)
+			if v.err != "" {
+				a.EqualError(err, v.err)
+				return
+			}
+			a.Nil(err)
+			a.Equal(v.expected, pluginNames(sorted))
+		})
+	}
+}
+
+func TestServer_initPluginHooks_order(t *testing.T) {
+	a := assert.New(t)
+	var calls []string
+	srv := defaultServer()
+	srv.plugins = []Plugin{
+		&orderedPlugin{name: "metrics", calls: &calls},
+		&orderedPlugin{name: "admin", deps: []string{"acl"}, calls: &calls},
+		&orderedPlugin{name: "acl", priority: -1, calls: &calls},
+	}
+	a.Nil(srv.initPluginHooks())
+	a.Equal([]string{"acl", "metrics", "admin"}, pluginNames(srv.plugins))
+	a.Nil(srv.hooks.OnBasicAuth(context.Background(), nil, nil))
+	a.Equal([]string{"acl", "metrics", "admin"}, calls)
+
+	srv = defaultServer()
+	srv.config().PluginOrder = []string{"not_registered"}
+	a.EqualError(srv.initPluginHooks(), "plugin not_registered is not registered")
+}
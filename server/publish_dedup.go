@@ -0,0 +1,131 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+type publishDedupEntry struct {
+	clientID string
+	key      string
+	expiry   time.Time
+	// lru is the element in the LRU list of the client, expiring is the element in publishDedup.expiring.
+	lru      *list.Element
+	expiring *list.Element
+}
+
+// clientDedup is the idempotency keys of a client, the most recently seen key is at the front of lru.
+type clientDedup struct {
+	lru     *list.List
+	entries map[string]*publishDedupEntry
+}
+
+// publishDedup is the cache of the idempotency keys of the messages published by the clients, see config.PublishDedup.
+// The keys are kept by the client id, so that they survive the reconnections until they expire.
+type publishDedup struct {
+	mu           sync.Mutex
+	ttl          time.Duration
+	max          int
+	userProperty string
+	// expiring is all entries in the order of the expiry time,
+	// which is also the order they are remembered because the TTL is fixed.
+	expiring *list.List
+	clients  map[string]*clientDedup
+}
+
+// newPublishDedup returns nil if the deduplication is disabled.
+func newPublishDedup(c config.PublishDedup) *publishDedup {
+	if !c.Enabled() {
+		return nil
+	}
+	return &publishDedup{
+		ttl:          c.TTL,
+		max:          c.MaxEntries,
+		userProperty: c.UserProperty,
+		expiring:     list.New(),
+		clients:      make(map[string]*clientDedup),
+	}
+}
+
+// key returns the idempotency key of the PUBLISH packet, empty if the packet has no key.
+func (p *publishDedup) key(pub *packets.Publish) string {
+	if pub.Qos != packets.Qos1 || pub.Properties == nil {
+		return ""
+	}
+	for _, v := range pub.Properties.User {
+		if string(v.K) == p.userProperty {
+			return string(v.V)
+		}
+	}
+	return ""
+}
+
+// seen reports whether the key of the client has been remembered and not expired.
+func (p *publishDedup) seen(clientID string, key string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expireLocked(now)
+	c := p.clients[clientID]
+	if c == nil {
+		return false
+	}
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e.lru)
+	}
+	return ok
+}
+
+// remember adds the key of the message routed for the client.
+func (p *publishDedup) remember(clientID string, key string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expireLocked(now)
+	c := p.clients[clientID]
+	if c == nil {
+		c = &clientDedup{
+			lru:     list.New(),
+			entries: make(map[string]*publishDedupEntry),
+		}
+	}
+	if e, ok := c.entries[key]; ok {
+		p.removeLocked(c, e)
+	}
+	if c.lru.Len() >= p.max {
+		p.removeLocked(c, c.lru.Back().Value.(*publishDedupEntry))
+	}
+	e := &publishDedupEntry{
+		clientID: clientID,
+		key:      key,
+		expiry:   now.Add(p.ttl),
+	}
+	e.lru = c.lru.PushFront(e)
+	e.expiring = p.expiring.PushBack(e)
+	c.entries[key] = e
+	// removing the existing entries may have removed c from the clients.
+	p.clients[clientID] = c
+}
+
+// expireLocked removes the expired keys of all clients.
+func (p *publishDedup) expireLocked(now time.Time) {
+	for front := p.expiring.Front(); front != nil; front = p.expiring.Front() {
+		e := front.Value.(*publishDedupEntry)
+		if now.Before(e.expiry) {
+			return
+		}
+		p.removeLocked(p.clients[e.clientID], e)
+	}
+}
+
+func (p *publishDedup) removeLocked(c *clientDedup, e *publishDedupEntry) {
+	c.lru.Remove(e.lru)
+	p.expiring.Remove(e.expiring)
+	delete(c.entries, e.key)
+	if len(c.entries) == 0 {
+		delete(p.clients, e.clientID)
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestPublishDedup(t *testing.T) {
+	a := assert.New(t)
+	a.Nil(newPublishDedup(config.DefaultPublishDedup))
+
+	p := newPublishDedup(config.PublishDedup{TTL: time.Minute, MaxEntries: 2, UserProperty: "key"})
+	now := time.Now()
+	a.False(p.seen("c1", "a", now))
+	p.remember("c1", "a", now)
+	p.remember("c1", "b", now)
+	a.True(p.seen("c1", "a", now))
+	// the keys are kept by the client id.
+	a.False(p.seen("c2", "a", now))
+	p.remember("c2", "a", now.Add(time.Second))
+	// b is the least recently seen one.
+	p.remember("c1", "c", now.Add(time.Second))
+	a.False(p.seen("c1", "b", now))
+	a.True(p.seen("c1", "a", now))
+	a.True(p.seen("c1", "c", now))
+	// expired, the clients without keys are removed.
+	a.False(p.seen("c1", "a", now.Add(time.Minute)))
+	a.True(p.seen("c1", "c", now.Add(time.Minute)))
+	a.False(p.seen("c1", "c", now.Add(time.Minute+time.Second)))
+	a.False(p.seen("c2", "a", now.Add(time.Minute+time.Second)))
+	a.Empty(p.clients)
+	a.Equal(0, p.expiring.Len())
+
+	pub := &packets.Publish{
+		Qos: packets.Qos1,
+		Properties: &packets.Properties{
+			User: []packets.UserProperty{{K: []byte("other"), V: []byte("1")}, {K: []byte("key"), V: []byte("2")}},
+		},
+	}
+	a.Equal("2", p.key(pub))
+	pub.Qos = packets.Qos2
+	a.Equal("", p.key(pub))
+	pub.Qos = packets.Qos1
+	pub.Properties.User = nil
+	a.Equal("", p.key(pub))
+}
+
+func TestClient_publishHandler_dedup(t *testing.T) {
+	var tt = []struct {
+		name     string
+		cfg      config.PublishDedup
+		keys     []string
+		rejected []bool
+		// reconnect publishes each message by a new connection of the client.
+		reconnect bool
+		// advance is the time elapsed between the messages.
+		advance   time.Duration
+		delivered int
+	}{
+		{
+			name:      "duplicated",
+			cfg:       config.PublishDedup{TTL: time.Minute, MaxEntries: 10, UserProperty: "idempotency-key"},
+			keys:      []string{"1", "1"},
+			delivered: 1,
+		},
+		{
+			name:      "different_keys",
+			cfg:       config.PublishDedup{TTL: time.Minute, MaxEntries: 10, UserProperty: "idempotency-key"},
+			keys:      []string{"1", "2"},
+			delivered: 2,
+		},
+		{
+			name:      "no_key",
+			cfg:       config.PublishDedup{TTL: time.Minute, MaxEntries: 10, UserProperty: "idempotency-key"},
+			keys:      []string{"", ""},
+			delivered: 2,
+		},
+		{
+			name:      "rejected_not_remembered",
+			cfg:       config.PublishDedup{TTL: time.Minute, MaxEntries: 10, UserProperty: "idempotency-key"},
+			keys:      []string{"1", "1", "1"},
+			rejected:  []bool{true, false, false},
+			delivered: 2,
+		},
+		{
+			name:      "reconnected",
+			cfg:       config.PublishDedup{TTL: time.Minute, MaxEntries: 10, UserProperty: "idempotency-key"},
+			keys:      []string{"1", "1"},
+			reconnect: true,
+			delivered: 1,
+		},
+		{
+			name:      "expired",
+			cfg:       config.PublishDedup{TTL: time.Minute, MaxEntries: 10, UserProperty: "idempotency-key"},
+			keys:      []string{"1", "1"},
+			advance:   time.Minute,
+			delivered: 2,
+		},
+		{
+			name:      "disabled",
+			cfg:       config.DefaultPublishDedup,
+			keys:      []string{"1", "1"},
+			delivered: 2,
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			clk := newTestClock()
+			srv.clock = clk
+			srv.config().PublishDedup = v.cfg
+			srv.publishDedup = newPublishDedup(v.cfg)
+			var delivered int
+			newClient := func() *client {
+				c, err := srv.newClient(noopConn{})
+				a.Nil(err)
+				c.opts.ClientID = "cid"
+				c.version = packets.Version5
+				c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+					delivered++
+					if len(v.rejected) >= delivered {
+						return true, v.rejected[delivered-1]
+					}
+					return true, false
+				}
+				return c
+			}
+			c := newClient()
+			for i, key := range v.keys {
+				if i != 0 {
+					clk.Advance(v.advance)
+					if v.reconnect {
+						c = newClient()
+					}
+				}
+				ppt := &packets.Properties{}
+				if key != "" {
+					ppt.User = []packets.UserProperty{{K: []byte("idempotency-key"), V: []byte(key)}}
+				}
+				a.Nil(c.publishHandler(&packets.Publish{
+					Version:    packets.Version5,
+					Qos:        packets.Qos1,
+					PacketID:   packets.PacketID(i + 1),
+					TopicName:  []byte("a"),
+					Payload:    []byte("payload"),
+					Properties: ppt,
+				}))
+				// the rejected message is not acknowledged.
+				select {
+				case p := <-c.out:
+					a.Equal(codes.Success, p.(*packets.Puback).Code)
+				default:
+				}
+			}
+			a.Equal(v.delivered, delivered)
+		})
+	}
+}
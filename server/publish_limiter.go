@@ -0,0 +1,174 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// PublishLimiter limits the inbound PUBLISH packets of a client, see config.PublishRateLimit.
+// It is only called by the goroutine which handles the packets of the client,
+// so the implementation is not required to be concurrency-safe.
+type PublishLimiter interface {
+	// Allow reports whether a PUBLISH packet with the given payload size is allowed at now.
+	// The packet is only counted if it is allowed.
+	// If not allowed, wait is the estimated duration before the packet can be allowed.
+	Allow(now time.Time, size int) (ok bool, wait time.Duration)
+}
+
+// NewPublishLimiter is the constructor of PublishLimiter.
+// It will be called for every client on connecting if config.PublishRateLimit is enabled.
+type NewPublishLimiter func(clientID string, config config.PublishRateLimit) PublishLimiter
+
+// minPublishWait is the minimum duration to wait in the throttle policy, in case the limiter returns a non-positive wait.
+const minPublishWait = time.Millisecond
+
+// NewTokenBucketLimiter returns the default PublishLimiter,
+// which is a token bucket for each limit with the capacity of one second.
+// The byte tokens are allowed to be negative, so that a message larger than the capacity is not starved.
+func NewTokenBucketLimiter(clientID string, config config.PublishRateLimit) PublishLimiter {
+	return &tokenBucketLimiter{
+		messages: newTokenBucket(config.MessagesPerSecond),
+		bytes:    newTokenBucket(config.BytesPerSecond),
+	}
+}
+
+type tokenBucketLimiter struct {
+	// messages and bytes are nil if unlimited.
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func (t *tokenBucketLimiter) Allow(now time.Time, size int) (ok bool, wait time.Duration) {
+	if t.messages != nil {
+		t.messages.refill(now)
+		if t.messages.tokens < 1 {
+			wait = t.messages.waitFor(1)
+		}
+	}
+	if t.bytes != nil {
+		t.bytes.refill(now)
+		if t.bytes.tokens <= 0 {
+			if w := t.bytes.waitFor(0); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	if t.messages != nil {
+		t.messages.tokens--
+	}
+	if t.bytes != nil {
+		t.bytes.tokens -= float64(size)
+	}
+	return true, 0
+}
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil if rate is not positive, which means no limit.
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.last.IsZero() {
+		b.last = now
+		return
+	}
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+}
+
+// waitFor returns the duration before the tokens exceed n.
+func (b *tokenBucket) waitFor(n float64) time.Duration {
+	wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if wait < minPublishWait {
+		wait = minPublishWait
+	}
+	return wait
+}
+
+func (client *client) newPublishLimiter() {
+	rl := client.config.PublishRateLimit
+	if !rl.Enabled() {
+		client.publishLimiter = nil
+		return
+	}
+	newLimiter := NewTokenBucketLimiter
+	if client.server != nil && client.server.newPublishLimiter != nil {
+		newLimiter = client.server.newPublishLimiter
+	}
+	client.publishLimiter = newLimiter(client.opts.ClientID, rl)
+}
+
+// reloadPublishRateLimit replaces the config.PublishRateLimit of the connected client.
+// The PublishLimiter is not concurrency-safe, so the new limit is applied by the goroutine which handles the packets
+// before the next PUBLISH packet, see applyReloadedRateLimit.
+func (client *client) reloadPublishRateLimit(rl config.PublishRateLimit) {
+	client.rateLimitMu.Lock()
+	client.reloadedRateLimit = &rl
+	atomic.StoreInt32(&client.rateLimitReloaded, 1)
+	client.rateLimitMu.Unlock()
+}
+
+// applyReloadedRateLimit recreates the PublishLimiter if the config.PublishRateLimit has been reloaded.
+func (client *client) applyReloadedRateLimit() {
+	if atomic.LoadInt32(&client.rateLimitReloaded) == 0 {
+		return
+	}
+	client.rateLimitMu.Lock()
+	rl := client.reloadedRateLimit
+	client.reloadedRateLimit = nil
+	atomic.StoreInt32(&client.rateLimitReloaded, 0)
+	client.rateLimitMu.Unlock()
+	if rl == nil {
+		return
+	}
+	client.config.PublishRateLimit = *rl
+	client.newPublishLimiter()
+}
+
+// allowPublish applies the publish rate limit to the PUBLISH packet, it returns false if the packet exceeds the limit.
+// The QoS 1 and QoS 2 packets are waited until allowed in the throttle policy.
+func (client *client) allowPublish(pub *packets.Publish) bool {
+	for {
+		ok, wait := client.publishLimiter.Allow(time.Now(), len(pub.Payload))
+		if ok {
+			return true
+		}
+		if pub.Qos == packets.Qos0 || client.config.PublishRateLimit.Policy != config.PublishRateLimitThrottle {
+			client.server.statsManager.publishLimited(client.opts.ClientID)
+			return false
+		}
+		if wait < minPublishWait {
+			wait = minPublishWait
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-client.close:
+			t.Stop()
+			return false
+		}
+	}
+}
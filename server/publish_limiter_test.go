@@ -0,0 +1,149 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	unack_mem "github.com/DrmagicE/gmqtt/persistence/unack/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	a := assert.New(t)
+	l := NewTokenBucketLimiter("cid", config.PublishRateLimit{MessagesPerSecond: 2, BytesPerSecond: 100})
+	now := time.Unix(100, 0)
+	ok, _ := l.Allow(now, 10)
+	a.True(ok)
+	ok, _ = l.Allow(now, 10)
+	a.True(ok)
+	ok, wait := l.Allow(now, 10)
+	a.False(ok)
+	a.Equal(500*time.Millisecond, wait)
+
+	ok, _ = l.Allow(now.Add(500*time.Millisecond), 10)
+	a.True(ok)
+
+	// a message larger than the bucket is allowed, the following messages wait for the bytes.
+	now = now.Add(time.Hour)
+	ok, _ = l.Allow(now, 300)
+	a.True(ok)
+	ok, wait = l.Allow(now, 10)
+	a.False(ok)
+	a.Equal(2*time.Second, wait)
+	ok, _ = l.Allow(now.Add(2*time.Second+time.Millisecond), 10)
+	a.True(ok)
+}
+
+func TestTokenBucketLimiter_unlimited(t *testing.T) {
+	a := assert.New(t)
+	l := NewTokenBucketLimiter("cid", config.PublishRateLimit{MessagesPerSecond: 1})
+	now := time.Unix(100, 0)
+	ok, _ := l.Allow(now, 1<<20)
+	a.True(ok)
+	ok, _ = l.Allow(now, 0)
+	a.False(ok)
+}
+
+type countLimiter struct {
+	allowed int32
+}
+
+func (c *countLimiter) Allow(now time.Time, size int) (ok bool, wait time.Duration) {
+	if atomic.LoadInt32(&c.allowed) == 0 {
+		return false, time.Millisecond
+	}
+	atomic.AddInt32(&c.allowed, -1)
+	return true, 0
+}
+
+func TestClient_publishHandler_rateLimit(t *testing.T) {
+	var tt = []struct {
+		name    string
+		version packets.Version
+		policy  string
+		qos     uint8
+		// code is the code of the ack, -1 means no ack.
+		code      int
+		delivered bool
+	}{
+		{name: "v5_qos0", version: packets.Version5, policy: config.PublishRateLimitReject, qos: packets.Qos0, code: -1},
+		{name: "v5_qos1_reject", version: packets.Version5, policy: config.PublishRateLimitReject, qos: packets.Qos1, code: int(codes.QuotaExceeded)},
+		{name: "v5_qos2_reject", version: packets.Version5, policy: config.PublishRateLimitReject, qos: packets.Qos2, code: int(codes.QuotaExceeded)},
+		{name: "v3_qos1_reject", version: packets.Version311, policy: config.PublishRateLimitReject, qos: packets.Qos1, code: int(codes.Success)},
+		{name: "v5_qos0_throttle", version: packets.Version5, policy: config.PublishRateLimitThrottle, qos: packets.Qos0, code: -1},
+		{name: "v5_qos1_throttle", version: packets.Version5, policy: config.PublishRateLimitThrottle, qos: packets.Qos1, code: int(codes.Success), delivered: true},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.config().PublishRateLimit = config.PublishRateLimit{MessagesPerSecond: 1, Policy: v.policy}
+			srv.subscriptionsDB = mem.NewStore()
+			srv.statsManager = newStatsManager(srv.subscriptionsDB)
+			limiter := &countLimiter{}
+			WithPublishLimiter(func(clientID string, config config.PublishRateLimit) PublishLimiter {
+				return limiter
+			})(srv)
+
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			c.version = v.version
+			c.unackStore = unack_mem.New(unack_mem.Options{
+				ClientID: "cid",
+			})
+			c.newPublishLimiter()
+			a.Equal(limiter, c.publishLimiter)
+			var delivered bool
+			c.deliverMessage = func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+				delivered = true
+				return true, false
+			}
+			if v.policy == config.PublishRateLimitThrottle {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					atomic.StoreInt32(&limiter.allowed, 1)
+				}()
+			}
+			a.Nil(c.publishHandler(&packets.Publish{
+				Version:    v.version,
+				Qos:        v.qos,
+				PacketID:   1,
+				TopicName:  []byte("topic"),
+				Payload:    []byte("payload"),
+				Properties: &packets.Properties{},
+			}))
+			a.Equal(v.delivered, delivered)
+
+			if v.code == -1 {
+				a.Len(c.out, 0)
+			} else {
+				ack := <-c.out
+				switch p := ack.(type) {
+				case *packets.Puback:
+					a.EqualValues(v.code, p.Code)
+				case *packets.Pubrec:
+					a.EqualValues(v.code, p.Code)
+					// the rejected message is removed from the unack store.
+					exist, err := c.unackStore.Set(1)
+					a.Nil(err)
+					a.False(exist)
+				}
+			}
+			sts, _ := srv.statsManager.GetClientStats("cid")
+			if v.delivered {
+				a.EqualValues(0, sts.PublishRateStats.LimitedTotal)
+			} else {
+				a.EqualValues(1, sts.PublishRateStats.LimitedTotal)
+			}
+		})
+	}
+}
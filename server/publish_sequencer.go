@@ -0,0 +1,74 @@
+package server
+
+import "sync"
+
+// publishSequencer routes the incoming PUBLISH messages in the order of arrival across all clients,
+// see config.MQTT.StrictPublishOrder.
+// Each message takes a ticket on arrival and waits for its turn before routing,
+// so that the messages are added into the queues in the arrival order even if the hooks of the publishers run concurrently.
+type publishSequencer struct {
+	mu sync.Mutex
+	// next is the next ticket to be issued.
+	next uint64
+	// serving is the ticket whose turn it is.
+	serving uint64
+	// waiters signals the ticket which is waiting for its turn.
+	waiters map[uint64]chan struct{}
+}
+
+func newPublishSequencer() *publishSequencer {
+	return &publishSequencer{
+		waiters: make(map[uint64]chan struct{}),
+	}
+}
+
+// ticket issues a turn for the arrived message, the turn must be done even if the message is not routed.
+func (s *publishSequencer) ticket() *publishTurn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &publishTurn{s: s, ticket: s.next}
+	s.next++
+	return t
+}
+
+type publishTurn struct {
+	s      *publishSequencer
+	ticket uint64
+	waited bool
+	passed bool
+}
+
+// wait blocks until the messages arrived earlier are routed or dropped.
+func (t *publishTurn) wait() {
+	if t.waited {
+		return
+	}
+	t.waited = true
+	s := t.s
+	s.mu.Lock()
+	if s.serving == t.ticket {
+		s.mu.Unlock()
+		return
+	}
+	c := make(chan struct{})
+	s.waiters[t.ticket] = c
+	s.mu.Unlock()
+	<-c
+}
+
+// done passes the turn to the next message, it is no-op if the turn has been passed.
+func (t *publishTurn) done() {
+	if t.passed {
+		return
+	}
+	t.wait()
+	t.passed = true
+	s := t.s
+	s.mu.Lock()
+	s.serving++
+	if c, ok := s.waiters[s.serving]; ok {
+		delete(s.waiters, s.serving)
+		close(c)
+	}
+	s.mu.Unlock()
+}
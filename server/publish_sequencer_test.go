@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestPublishSequencer(t *testing.T) {
+	a := assert.New(t)
+	s := newPublishSequencer()
+	t0, t1, t2 := s.ticket(), s.ticket(), s.ticket()
+
+	var mu sync.Mutex
+	var order []uint64
+	var wg sync.WaitGroup
+	for _, v := range []*publishTurn{t2, t1} {
+		wg.Add(1)
+		go func(turn *publishTurn) {
+			defer wg.Done()
+			turn.wait()
+			mu.Lock()
+			order = append(order, turn.ticket)
+			mu.Unlock()
+			turn.done()
+		}(v)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	a.Empty(order)
+	mu.Unlock()
+
+	// t0 is dropped without waiting explicitly.
+	t0.done()
+	t0.done()
+	wg.Wait()
+	a.Equal([]uint64{1, 2}, order)
+	a.EqualValues(3, s.serving)
+	a.Empty(s.waiters)
+}
+
+func TestClient_publishHandler_strictPublishOrder(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	srv.publishSequencer = newPublishSequencer()
+	// the offline subscriber
+	_, err := srv.subscriptionsDB.Subscribe("sub", &gmqtt.Subscription{
+		TopicFilter: "#",
+		QoS:         packets.Qos1,
+	})
+	a.Nil(err)
+	q := &sliceQueue{}
+	srv.queueStore["sub"] = q
+
+	// the hook of the slow publisher takes longer, the messages of it would be routed later without the sequencer.
+	arrived := make(chan struct{})
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		if client.ClientOptions().ClientID == "slow" {
+			arrived <- struct{}{}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil
+	}
+	publishers := make(map[string]*client)
+	for _, id := range []string{"slow", "fast"} {
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.opts.ClientID = id
+		c.version = packets.Version311
+		publishers[id] = c
+	}
+	publish := func(c *client, topic string) {
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:   packets.Version311,
+			Qos:       packets.Qos1,
+			PacketID:  1,
+			TopicName: []byte(topic),
+			Payload:   []byte("payload"),
+		}))
+		<-c.out
+	}
+
+	var want []string
+	for i := 0; i < 3; i++ {
+		slowTopic, fastTopic := fmt.Sprintf("slow/%d", i), fmt.Sprintf("fast/%d", i)
+		done := make(chan struct{})
+		go func() {
+			publish(publishers["slow"], slowTopic)
+			close(done)
+		}()
+		<-arrived
+		publish(publishers["fast"], fastTopic)
+		<-done
+		want = append(want, slowTopic, fastTopic)
+	}
+	a.Equal(want, topicsOf(q.elems))
+}
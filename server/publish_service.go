@@ -1,13 +1,69 @@
 package server
 
-import "github.com/DrmagicE/gmqtt"
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+)
 
 type publishService struct {
 	server *server
 }
 
 func (p *publishService) Publish(message *gmqtt.Message) {
-	p.server.mu.Lock()
-	p.server.deliverMessage("", message, defaultIterateOptions(message.Topic))
-	p.server.mu.Unlock()
+	_ = p.publish(message, false)
+}
+
+func (p *publishService) PublishRetained(message *gmqtt.Message) error {
+	return p.publish(message, true)
+}
+
+// publish delivers the message on behalf of the system client, if any.
+// If retain is set, the message is checked against the topic policy and the retained message is stored after the hook,
+// in the same way as client.publishHandler does.
+func (p *publishService) publish(message *gmqtt.Message, retain bool) error {
+	srv := p.server
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	// avoid the typed nil in the Client interface passed to the hooks.
+	var hookClient Client
+	var clientID string
+	if c := srv.systemClient; c != nil {
+		hookClient = c
+		clientID = c.opts.ClientID
+	}
+	if retain {
+		if err := srv.checkTopicPolicy(hookClient, message); err != nil {
+			return err
+		}
+	}
+	opts := defaultIterateOptions(message.Topic)
+	if client := srv.systemClient; client != nil && srv.hooks.OnMsgArrived != nil {
+		req := &MsgArrivedRequest{
+			Publish:          gmqtt.MessageToPublish(message, client.version),
+			Message:          message,
+			IterationOptions: opts,
+		}
+		err := srv.hooks.OnMsgArrived(context.Background(), client, req)
+		if err != nil || req.Message == nil {
+			zaplog.Debug("system message discarded by OnMsgArrived hook",
+				zap.String("topic", message.Topic),
+				zap.Error(err))
+			return err
+		}
+		message = req.Message
+		opts = req.IterationOptions
+	}
+	if retain && message.Retained {
+		if err := srv.storeRetained(message); err != nil {
+			zaplog.Debug("retained message not stored", zap.String("topic", message.Topic), zap.Error(err))
+			if srv.config().MQTT.RetainedLimitNack {
+				return err
+			}
+		}
+	}
+	srv.deliverMessage(clientID, message, opts)
+	return nil
 }
@@ -12,17 +12,26 @@ import (
 // queueNotifier implements queue.Notifier interface.
 type queueNotifier struct {
 	dropHook OnMsgDropped
-	sts      *statsManager
-	cli      *client
+	// dispatcher is nil if the OnMessageDropped hook is not set.
+	dispatcher *dropDispatcher
+	sts        *statsManager
+	cli        *client
+	// codec decodes the payloads of the dropped messages before reporting them, see queue.PayloadCodec.
+	codec queue.PayloadCodec
+	// tracer is nil if config.MessageTrace is disabled.
+	tracer *messageTracer
 }
 
 // defaultNotifier is used to init the notifier when using a persistent session store (e.g redis) which can load session data
 // while bootstrapping.
-func defaultNotifier(dropHook OnMsgDropped, sts *statsManager, clientID string) *queueNotifier {
+func (srv *server) defaultNotifier(clientID string) *queueNotifier {
 	return &queueNotifier{
-		dropHook: dropHook,
-		sts:      sts,
-		cli:      &client{opts: &ClientOptions{ClientID: clientID}, status: Connected + 1},
+		dropHook:   srv.hooks.OnMsgDropped,
+		dispatcher: srv.dropDispatcher,
+		sts:        srv.statsManager,
+		cli:        &client{opts: &ClientOptions{ClientID: clientID}, status: Connected + 1},
+		codec:      srv.payloadCodec,
+		tracer:     srv.tracer,
 	}
 }
 
@@ -33,6 +42,10 @@ func (q *queueNotifier) notifyDropped(msg *gmqtt.Message, err error) {
 	if q.dropHook != nil {
 		q.dropHook(context.Background(), cid, msg, err)
 	}
+	q.dispatcher.dispatch(cid, msg, dropReason(err))
+	if id := q.tracer.traceID(msg); id != "" {
+		q.tracer.record(id, msg, TraceEvent{Stage: TraceDropped, ClientID: cid, Reason: err.Error()})
+	}
 }
 
 func (q *queueNotifier) NotifyDropped(elem *queue.Elem, err error) {
@@ -41,7 +54,12 @@ func (q *queueNotifier) NotifyDropped(elem *queue.Elem, err error) {
 		q.cli.pl.release(elem.ID())
 	}
 	if pub, ok := elem.MessageWithID.(*queue.Publish); ok {
-		q.notifyDropped(pub.Message, err)
+		msg, derr := queue.DecodePayload(q.codec, elem)
+		if derr != nil {
+			// report the encoded message rather than nothing.
+			msg = pub.Message
+		}
+		q.notifyDropped(msg, err)
 	} else {
 		zaplog.Warn("message dropped", zap.String("client_id", cid), zap.Error(err))
 	}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/config"
+)
+
+// ReconnectStormEvent is the input param for OnReconnectStorm hook.
+type ReconnectStormEvent struct {
+	// Mitigating indicates whether the mitigation has been activated (true) or relaxed (false).
+	Mitigating bool
+	// Rate is the number of new connections in the last second.
+	Rate int
+}
+
+// stormDetector measures the new connection rate in one second windows,
+// and decides whether the accept rate should be tightened.
+// See config.ReconnectStorm for details.
+type stormDetector struct {
+	mu     sync.Mutex
+	config config.ReconnectStorm
+	// windowStart is the start time of the current measuring window.
+	windowStart time.Time
+	// count is the number of new connections in the current window.
+	count int
+	// accepted is the number of connections that have been accepted in the current window.
+	accepted int
+	// lastRate is the number of new connections in the last completed window.
+	lastRate int
+	// exceedSince is the time when the rate started to exceed the threshold, zero if the rate is below the threshold.
+	exceedSince time.Time
+	// calmSince is the time when the rate fell below the threshold, zero if the rate is above the threshold.
+	calmSince  time.Time
+	mitigating bool
+}
+
+func newStormDetector(config config.ReconnectStorm, now time.Time) *stormDetector {
+	return &stormDetector{
+		config:      config,
+		windowStart: now,
+	}
+}
+
+// evaluateLocked updates the mitigation state with the rate measured in [start, end).
+func (s *stormDetector) evaluateLocked(rate int, start, end time.Time) {
+	s.lastRate = rate
+	if rate > s.config.Threshold {
+		s.calmSince = time.Time{}
+		if s.exceedSince.IsZero() {
+			s.exceedSince = start
+		}
+		if !s.mitigating && end.Sub(s.exceedSince) >= s.config.SustainedPeriod {
+			s.mitigating = true
+		}
+		return
+	}
+	s.exceedSince = time.Time{}
+	if s.calmSince.IsZero() {
+		s.calmSince = start
+	}
+	if s.mitigating && end.Sub(s.calmSince) >= s.config.CoolDownPeriod {
+		s.mitigating = false
+	}
+}
+
+// rotateLocked closes the current window if it is expired.
+// It returns a non-nil event if the mitigation state has been changed.
+func (s *stormDetector) rotateLocked(now time.Time) *ReconnectStormEvent {
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < time.Second {
+		return nil
+	}
+	prev := s.mitigating
+	end := s.windowStart.Add(time.Second)
+	s.evaluateLocked(s.count, s.windowStart, end)
+	next := s.windowStart.Add(elapsed / time.Second * time.Second)
+	if next.After(end) {
+		// there is no new connection between end and next.
+		s.evaluateLocked(0, end, next)
+	}
+	s.windowStart = next
+	s.count = 0
+	s.accepted = 0
+	if prev == s.mitigating {
+		return nil
+	}
+	return &ReconnectStormEvent{
+		Mitigating: s.mitigating,
+		Rate:       s.lastRate,
+	}
+}
+
+// accept records a new connection and reports whether the connection is allowed.
+func (s *stormDetector) accept(now time.Time) (ok bool, ev *ReconnectStormEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev = s.rotateLocked(now)
+	s.count++
+	if s.mitigating && s.accepted >= s.config.MitigatedRate {
+		return false, ev
+	}
+	s.accepted++
+	return true, ev
+}
+
+// tick closes the expired window even if there is no new connection.
+func (s *stormDetector) tick(now time.Time) *ReconnectStormEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotateLocked(now)
+}
+
+// allowConnection reports whether the new connection can be accepted by the reconnect storm detector.
+func (srv *server) allowConnection() bool {
+	if srv.stormDetector == nil {
+		return true
+	}
+	ok, ev := srv.stormDetector.accept(time.Now())
+	if ev != nil {
+		srv.reconnectStormChanged(ev)
+	}
+	if !ok {
+		srv.statsManager.connectionRejected()
+	}
+	return ok
+}
+
+func (srv *server) checkReconnectStorm() {
+	if ev := srv.stormDetector.tick(time.Now()); ev != nil {
+		srv.reconnectStormChanged(ev)
+	}
+}
+
+func (srv *server) reconnectStormChanged(ev *ReconnectStormEvent) {
+	srv.statsManager.reconnectStormMitigating(ev.Mitigating)
+	if ev.Mitigating {
+		zaplog.Warn("reconnect storm detected, tightening the accept rate",
+			zap.Int("rate", ev.Rate),
+			zap.Int("mitigated_rate", srv.stormDetector.config.MitigatedRate))
+	} else {
+		zaplog.Info("reconnect storm subsided, relaxing the accept rate", zap.Int("rate", ev.Rate))
+	}
+	if srv.hooks.OnReconnectStorm != nil {
+		srv.hooks.OnReconnectStorm(context.Background(), ev)
+	}
+}
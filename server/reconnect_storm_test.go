@@ -0,0 +1,59 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+)
+
+func TestStormDetector(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(0, 0)
+	s := newStormDetector(config.ReconnectStorm{
+		Enable:          true,
+		Threshold:       10,
+		SustainedPeriod: 2 * time.Second,
+		MitigatedRate:   5,
+		CoolDownPeriod:  3 * time.Second,
+	}, now)
+
+	burst := func(n int) (rejected int) {
+		for i := 0; i < n; i++ {
+			ok, ev := s.accept(now)
+			a.Nil(ev)
+			if !ok {
+				rejected++
+			}
+		}
+		return
+	}
+	// exceeds the threshold for 2 seconds
+	a.Zero(burst(20))
+	now = now.Add(time.Second)
+	a.Nil(s.tick(now))
+	a.Zero(burst(20))
+	now = now.Add(time.Second)
+
+	ev := s.tick(now)
+	a.Equal(&ReconnectStormEvent{
+		Mitigating: true,
+		Rate:       20,
+	}, ev)
+	a.Equal(15, burst(20))
+
+	now = now.Add(time.Second)
+	a.Nil(s.tick(now))
+	// the storm subsides, no connections for 3 seconds.
+	now = now.Add(time.Second)
+	a.Nil(s.tick(now))
+	now = now.Add(2 * time.Second)
+	ev = s.tick(now)
+	a.Equal(&ReconnectStormEvent{
+		Mitigating: false,
+		Rate:       0,
+	}, ev)
+	a.Zero(burst(20))
+}
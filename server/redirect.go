@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// ServerRedirect is the decision of the OnRedirect hook.
+type ServerRedirect struct {
+	// ServerReference is the Server Reference property of the CONNACK, e.g: "broker2.example.com:1883".
+	ServerReference string
+	// Moved indicates whether the client should use the other server permanently.
+	// If true, the reason code is "Server moved"(0x9D), otherwise "Use another server"(0x9C).
+	Moved bool
+}
+
+// redirectPolicy is the default redirect policy, see config.Redirect.
+func (srv *server) redirectPolicy(ctx context.Context, client Client, connect *packets.Connect) *ServerRedirect {
+	c := srv.config().Redirect
+	if !c.Enable {
+		return nil
+	}
+	srv.mu.Lock()
+	n := len(srv.clients)
+	srv.mu.Unlock()
+	if n < c.Threshold {
+		return nil
+	}
+	if c.Ratio < 1 && rand.Float64() >= c.Ratio {
+		return nil
+	}
+	i := atomic.AddUint32(&srv.redirectCursor, 1) - 1
+	return &ServerRedirect{
+		ServerReference: c.Servers[int(i%uint32(len(c.Servers)))],
+		Moved:           c.ServerMoved,
+	}
+}
+
+// redirect returns the error of CONNACK if the client is redirected to another server.
+// The MQTT v3.1.1 clients cannot be redirected.
+func (client *client) redirect(conn *packets.Connect) error {
+	srv := client.server
+	if srv == nil || !packets.IsVersion5(client.version) {
+		return nil
+	}
+	hook := srv.hooks.OnRedirect
+	if hook == nil {
+		hook = srv.redirectPolicy
+	}
+	r := hook(context.Background(), client, conn)
+	if r == nil || r.ServerReference == "" {
+		return nil
+	}
+	client.serverReference = r.ServerReference
+	code := codes.UseAnotherServer
+	if r.Moved {
+		code = codes.ServerMoved
+	}
+	return client.rejectConnect(code, "redirected to "+r.ServerReference)
+}
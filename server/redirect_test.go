@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func newRedirectServer(r config.Redirect) *server {
+	srv := defaultServer()
+	cfg := config.DefaultConfig()
+	cfg.Redirect = r
+	srv.ApplyConfig(cfg)
+	return srv
+}
+
+func TestClient_connectHandler_redirect(t *testing.T) {
+	a := assert.New(t)
+	srv := newRedirectServer(config.Redirect{
+		Enable:    true,
+		Threshold: 1,
+		Ratio:     1,
+		Servers:   []string{"b1:1883", "b2:1883"},
+	})
+	connect := func(version packets.Version) (*client, error) {
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		conn := &packets.Connect{
+			Version:  version,
+			ClientID: []byte("cid"),
+		}
+		if version == packets.Version5 {
+			conn.Properties = &packets.Properties{}
+		}
+		_, _, err = c.connectHandler(conn)
+		return c, err
+	}
+	// below the threshold
+	_, err := connect(packets.Version5)
+	a.Nil(err)
+
+	srv.clients["existing"] = &client{}
+	for _, ref := range []string{"b1:1883", "b2:1883", "b1:1883"} {
+		c, err := connect(packets.Version5)
+		a.Equal(codes.UseAnotherServer, converError(err).Code)
+		a.Equal(ref, c.serverReference)
+	}
+	// v3.1.1 clients cannot be redirected
+	_, err = connect(packets.Version311)
+	a.Nil(err)
+
+	cfg := config.DefaultConfig()
+	cfg.Redirect = config.Redirect{
+		Enable:      true,
+		Ratio:       1,
+		Servers:     []string{"b3:1883"},
+		ServerMoved: true,
+	}
+	srv.ApplyConfig(cfg)
+	c, err := connect(packets.Version5)
+	a.Equal(codes.ServerMoved, converError(err).Code)
+	a.Equal("b3:1883", c.serverReference)
+}
+
+func TestClient_connectHandler_redirectHook(t *testing.T) {
+	srv := newRedirectServer(config.Redirect{
+		Enable:  true,
+		Ratio:   1,
+		Servers: []string{"default:1883"},
+	})
+	srv.hooks.OnRedirect = func(ctx context.Context, client Client, connect *packets.Connect) *ServerRedirect {
+		switch string(connect.ClientID) {
+		case "accept":
+			return nil
+		case "custom":
+			return &ServerRedirect{ServerReference: "custom:1883", Moved: true}
+		}
+		return srv.redirectPolicy(ctx, client, connect)
+	}
+	var tt = []struct {
+		clientID string
+		code     codes.Code
+		ref      string
+	}{
+		{clientID: "accept", code: codes.Success},
+		{clientID: "custom", code: codes.ServerMoved, ref: "custom:1883"},
+		{clientID: "other", code: codes.UseAnotherServer, ref: "default:1883"},
+	}
+	for _, v := range tt {
+		t.Run(v.clientID, func(t *testing.T) {
+			a := assert.New(t)
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			_, _, err = c.connectHandler(&packets.Connect{
+				Version:    packets.Version5,
+				ClientID:   []byte(v.clientID),
+				Properties: &packets.Properties{},
+			})
+			if v.code == codes.Success {
+				a.Nil(err)
+			} else {
+				a.Equal(v.code, converError(err).Code)
+			}
+			a.Equal(v.ref, c.serverReference)
+		})
+	}
+}
+
+func TestServer_redirectPolicy_ratio(t *testing.T) {
+	a := assert.New(t)
+	srv := newRedirectServer(config.Redirect{
+		Enable:  true,
+		Ratio:   0.5,
+		Servers: []string{"b1:1883"},
+	})
+	var redirected int
+	for i := 0; i < 1000; i++ {
+		if srv.redirectPolicy(context.Background(), nil, nil) != nil {
+			redirected++
+		}
+	}
+	a.InDelta(500, redirected, 150)
+}
+
+func TestSendErrConnack_serverReference(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version5
+	c.serverReference = "b1:1883"
+	sendErrConnack(c, &codes.Error{Code: codes.UseAnotherServer})
+	connack := (<-c.out).(*packets.Connack)
+	a.Equal(codes.UseAnotherServer, connack.Code)
+	a.Equal([]byte("b1:1883"), connack.Properties.ServerReference)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// ResolveRequest is the input param for ResolveSubscribers.
+type ResolveRequest struct {
+	// TopicName is the topic name of the simulated message.
+	TopicName string
+	// QoS is the qos of the simulated message.
+	QoS packets.QoS
+	// PublisherID is the client id of the simulated publisher,
+	// the subscriptions of the publisher with the No Local option are suppressed. Empty means the message is published by the broker.
+	PublisherID string
+}
+
+// ResolvedSubscriber is a subscription which matches the topic name, see ResolveSubscribers.
+type ResolvedSubscriber struct {
+	ClientID string
+	// TopicFilter is the topic filter of the matched subscription, with the "$share/{ShareName}/" prefix for shared subscriptions.
+	// In onlyonce delivery mode, it is the subscription with the maximum qos if the client has multiple matched subscriptions.
+	TopicFilter string
+	// ShareName is the share name of the shared subscription, empty for the non-shared subscriptions.
+	ShareName string
+	// QoS is the qos of the message delivered to the client, which is the minimum of the message qos and the subscription qos.
+	QoS packets.QoS
+	// SubscriptionIDs is the subscription identifiers attached to the message.
+	SubscriptionIDs []uint32
+	// Receives indicates whether the client would receive the message.
+	Receives bool
+	// NoLocal indicates that the message is suppressed because the subscription is made by the publisher with the No Local option.
+	NoLocal bool
+}
+
+// ResolveSubscribers returns the subscriptions which match the topic name and whether they would receive the message,
+// without delivering the message or changing the routing state.
+// The shared subscription members which are not selected are returned with Receives set to false.
+// In round_robin strategy, the selected member is the one which would receive the next message,
+// in random strategy, the member is picked at random for each message, thus none of the members is selected.
+// The subscriptions of the clients without session are not returned, because they never receive messages.
+// Notice that the hooks are not called, and the queue level decisions, e.g: the queue overflow, are not taken into account.
+func (srv *server) ResolveSubscribers(req *ResolveRequest) []ResolvedSubscriber {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	cfg := srv.config().MQTT
+	var rs []ResolvedSubscriber
+	subs := newMatchedSubscriptions()
+	resolved := func(clientID string, sub *gmqtt.Subscription) ResolvedSubscriber {
+		r := ResolvedSubscriber{
+			ClientID:    clientID,
+			TopicFilter: sub.GetFullTopicName(),
+			ShareName:   sub.ShareName,
+			QoS:         req.QoS,
+			Receives:    true,
+		}
+		if r.QoS > sub.QoS {
+			r.QoS = sub.QoS
+		}
+		if sub.ID != 0 {
+			r.SubscriptionIDs = []uint32{sub.ID}
+		}
+		return r
+	}
+	srv.subscriptionsDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+		if _, ok := srv.queueStore[clientID]; !ok {
+			return true
+		}
+		if sub.NoLocal && clientID == req.PublisherID {
+			r := resolved(clientID, sub)
+			r.Receives = false
+			r.NoLocal = true
+			rs = append(rs, r)
+			return true
+		}
+		if !subs.add(cfg.DeliveryMode, clientID, sub) {
+			rs = append(rs, resolved(clientID, sub))
+		}
+		return true
+	}, defaultIterateOptions(req.TopicName))
+
+	for clientID, v := range subs.mq {
+		r := resolved(clientID, v.sub)
+		r.SubscriptionIDs = v.subIDs
+		sort.Slice(r.SubscriptionIDs, func(i, j int) bool {
+			return r.SubscriptionIDs[i] < r.SubscriptionIDs[j]
+		})
+		rs = append(rs, r)
+	}
+	for fullTopic, members := range subs.sl {
+		selected := srv.selectSharedSubscriberLocked(fullTopic, members, true)
+		for i, m := range members {
+			r := resolved(m.clientID, m.sub)
+			r.Receives = i == selected
+			rs = append(rs, r)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].ClientID != rs[j].ClientID {
+			return rs[i].ClientID < rs[j].ClientID
+		}
+		return rs[i].TopicFilter < rs[j].TopicFilter
+	})
+	return rs
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+func TestServer_ResolveSubscribers(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ts := newTestDeliverMsg(ctrl, "c1")
+	srv := ts.srv
+	for _, v := range []string{"c2", "c3", "pub"} {
+		srv.queueStore[v] = queue.NewMockStore(ctrl)
+	}
+	subscribe := func(clientID string, subs ...*gmqtt.Subscription) {
+		_, err := srv.subscriptionsDB.Subscribe(clientID, subs...)
+		a.Nil(err)
+	}
+	subscribe("c1", &gmqtt.Subscription{TopicFilter: "a/b", QoS: 1, ID: 1}, &gmqtt.Subscription{TopicFilter: "a/+", QoS: 2, ID: 2})
+	subscribe("c2", &gmqtt.Subscription{ShareName: "g", TopicFilter: "a/#", QoS: 2})
+	subscribe("c3", &gmqtt.Subscription{ShareName: "g", TopicFilter: "a/#", QoS: 1})
+	subscribe("pub", &gmqtt.Subscription{TopicFilter: "a/b", QoS: 1, NoLocal: true})
+	// no session
+	subscribe("gone", &gmqtt.Subscription{TopicFilter: "a/b", QoS: 1})
+	req := &ResolveRequest{TopicName: "a/b", QoS: 2, PublisherID: "pub"}
+
+	// onlyonce mode, random strategy
+	a.Equal([]ResolvedSubscriber{
+		{ClientID: "c1", TopicFilter: "a/+", QoS: 2, SubscriptionIDs: []uint32{1, 2}, Receives: true},
+		{ClientID: "c2", TopicFilter: "$share/g/a/#", ShareName: "g", QoS: 2},
+		{ClientID: "c3", TopicFilter: "$share/g/a/#", ShareName: "g", QoS: 1},
+		{ClientID: "pub", TopicFilter: "a/b", QoS: 1, NoLocal: true},
+	}, srv.ResolveSubscribers(req))
+
+	// overlap mode, round_robin strategy
+	srv.config().MQTT.DeliveryMode = Overlap
+	srv.config().MQTT.SharedSubscriptionStrategy = config.SharedSubscriptionRoundRobin
+	srv.sharedCursors = map[string]string{"$share/g/a/#": "c2"}
+	req.PublisherID = ""
+	rs := srv.ResolveSubscribers(req)
+	a.Equal([]ResolvedSubscriber{
+		{ClientID: "c1", TopicFilter: "a/+", QoS: 2, SubscriptionIDs: []uint32{2}, Receives: true},
+		{ClientID: "c1", TopicFilter: "a/b", QoS: 1, SubscriptionIDs: []uint32{1}, Receives: true},
+		{ClientID: "c2", TopicFilter: "$share/g/a/#", ShareName: "g", QoS: 2},
+		{ClientID: "c3", TopicFilter: "$share/g/a/#", ShareName: "g", QoS: 1, Receives: true},
+		{ClientID: "pub", TopicFilter: "a/b", QoS: 1, Receives: true},
+	}, rs)
+	// the round robin cursor is not changed.
+	a.Equal(rs, srv.ResolveSubscribers(req))
+	a.Equal(map[string]string{"$share/g/a/#": "c2"}, srv.sharedCursors)
+
+	a.Empty(srv.ResolveSubscribers(&ResolveRequest{TopicName: "b"}))
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
+)
+
+// ErrScheduledNotFound is returned by ScheduleService.Cancel if the scheduled message does not exist or has been delivered.
+var ErrScheduledNotFound = errors.New("scheduled message not found")
+
+// scheduler implements ScheduleService.
+type scheduler struct {
+	mu      sync.Mutex
+	store   scheduled.Store
+	pending map[string]*scheduled.Message
+	// wakeup notifies the run loop that the pending messages have been changed.
+	wakeup  chan struct{}
+	publish func(msg *gmqtt.Message)
+	clock   clock.Clock
+}
+
+// newScheduler loads the pending messages from the store.
+func newScheduler(store scheduled.Store, clk clock.Clock, publish func(msg *gmqtt.Message)) (*scheduler, error) {
+	s := &scheduler{
+		store:   store,
+		pending: make(map[string]*scheduled.Message),
+		wakeup:  make(chan struct{}, 1),
+		publish: publish,
+		clock:   clk,
+	}
+	err := store.Iterate(func(msg *scheduled.Message) bool {
+		s.pending[msg.ID] = msg
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule implements ScheduleService.
+func (s *scheduler) Schedule(message *gmqtt.Message, deliverAt time.Time) (id string, err error) {
+	msg := &scheduled.Message{
+		ID:        getRandomUUID(),
+		DeliverAt: deliverAt,
+		Message:   message.Copy(),
+	}
+	s.mu.Lock()
+	err = s.store.Add(msg)
+	if err == nil {
+		s.pending[msg.ID] = msg
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	s.notify()
+	return msg.ID, nil
+}
+
+// Cancel implements ScheduleService.
+func (s *scheduler) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[id]; !ok {
+		return ErrScheduledNotFound
+	}
+	if err := s.store.Remove(id); err != nil {
+		return err
+	}
+	delete(s.pending, id)
+	s.notify()
+	return nil
+}
+
+// List implements ScheduleService.
+func (s *scheduler) List() []*scheduled.Message {
+	s.mu.Lock()
+	rs := make([]*scheduled.Message, 0, len(s.pending))
+	for _, v := range s.pending {
+		rs = append(rs, v)
+	}
+	s.mu.Unlock()
+	sortScheduled(rs)
+	return rs
+}
+
+func sortScheduled(msgs []*scheduled.Message) {
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].DeliverAt.Equal(msgs[j].DeliverAt) {
+			return msgs[i].ID < msgs[j].ID
+		}
+		return msgs[i].DeliverAt.Before(msgs[j].DeliverAt)
+	})
+}
+
+// deliverDue publishes the messages which are due at now,
+// and returns the delivery time of the next pending message, zero means no message is pending.
+// The message is removed from the store after it is published,
+// it may be published again after the restart if the broker crashes in between.
+func (s *scheduler) deliverDue(now time.Time) (next time.Time) {
+	var due []*scheduled.Message
+	s.mu.Lock()
+	for id, v := range s.pending {
+		if !v.DeliverAt.After(now) {
+			due = append(due, v)
+			delete(s.pending, id)
+			continue
+		}
+		if next.IsZero() || v.DeliverAt.Before(next) {
+			next = v.DeliverAt
+		}
+	}
+	s.mu.Unlock()
+	sortScheduled(due)
+	for _, v := range due {
+		s.publish(v.Message)
+		if err := s.store.Remove(v.ID); err != nil {
+			zaplog.Error("failed to remove the delivered scheduled message", zap.String("id", v.ID), zap.Error(err))
+		}
+	}
+	return next
+}
+
+func (s *scheduler) run(exit <-chan struct{}) {
+	for {
+		var timeout <-chan time.Time
+		var timer clock.Timer
+		now := s.clock.Now()
+		if next := s.deliverDue(now); !next.IsZero() {
+			timer = s.clock.NewTimer(next.Sub(now))
+			timeout = timer.C()
+		}
+		select {
+		case <-exit:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-s.wakeup:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// publishScheduled publishes the scheduled message, the retained message is stored by Publisher.PublishRetained.
+func (srv *server) publishScheduled(msg *gmqtt.Message) {
+	if err := srv.publishService.PublishRetained(msg); err != nil {
+		zaplog.Warn("scheduled message rejected", zap.String("topic", msg.Topic), zap.Error(err))
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+	mem_scheduled "github.com/DrmagicE/gmqtt/persistence/scheduled/mem"
+)
+
+func TestScheduler(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	store := mem_scheduled.New()
+	// the pending messages before the restart.
+	a.Nil(store.Add(&scheduled.Message{ID: "past", DeliverAt: now.Add(-time.Hour), Message: &gmqtt.Message{Topic: "past"}}))
+	a.Nil(store.Add(&scheduled.Message{ID: "future", DeliverAt: now.Add(time.Hour), Message: &gmqtt.Message{Topic: "future"}}))
+
+	var published []string
+	s, err := newScheduler(store, newTestClock(), func(msg *gmqtt.Message) {
+		published = append(published, msg.Topic)
+	})
+	a.Nil(err)
+	a.Len(s.List(), 2)
+
+	a.True(now.Add(time.Hour).Equal(s.deliverDue(now)))
+	a.Equal([]string{"past"}, published)
+
+	id, err := s.Schedule(&gmqtt.Message{Topic: "b"}, now.Add(2*time.Minute))
+	a.Nil(err)
+	_, err = s.Schedule(&gmqtt.Message{Topic: "a"}, now.Add(time.Minute))
+	a.Nil(err)
+	var topics []string
+	for _, v := range s.List() {
+		topics = append(topics, v.Message.Topic)
+	}
+	a.Equal([]string{"a", "b", "future"}, topics)
+
+	a.Nil(s.Cancel(id))
+	a.Equal(ErrScheduledNotFound, s.Cancel(id))
+	a.Equal(ErrScheduledNotFound, s.Cancel("past"))
+
+	a.True(s.deliverDue(now.Add(2 * time.Hour)).IsZero())
+	a.Equal([]string{"past", "a", "future"}, published)
+	a.Empty(s.List())
+	var stored int
+	a.Nil(store.Iterate(func(msg *scheduled.Message) bool {
+		stored++
+		return true
+	}))
+	a.Zero(stored)
+}
+
+func TestScheduler_run(t *testing.T) {
+	a := assert.New(t)
+	published := make(chan *gmqtt.Message, 2)
+	clk := newTestClock()
+	s, err := newScheduler(mem_scheduled.New(), clk, func(msg *gmqtt.Message) {
+		published <- msg
+	})
+	a.Nil(err)
+	exit := make(chan struct{})
+	defer close(exit)
+	go s.run(exit)
+
+	_, err = s.Schedule(&gmqtt.Message{Topic: "later"}, clk.Now().Add(time.Minute))
+	a.Nil(err)
+	// the message in the past is published immediately.
+	_, err = s.Schedule(&gmqtt.Message{Topic: "now"}, clk.Now().Add(-time.Second))
+	a.Nil(err)
+	receive := func(topic string) {
+		select {
+		case msg := <-published:
+			a.Equal(topic, msg.Topic)
+		case <-time.After(time.Second):
+			t.Fatal("scheduled message timeout")
+		}
+	}
+	receive("now")
+	// wait for the run loop to wait for the next message.
+	a.Eventually(func() bool {
+		return clk.Timers() == 1
+	}, time.Second, time.Millisecond)
+	clk.Advance(time.Minute - time.Millisecond)
+	select {
+	case msg := <-published:
+		t.Fatalf("unexpected message: %s", msg.Topic)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clk.Advance(time.Millisecond)
+	receive("later")
+}
+
+func TestServer_publishScheduled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	pub := NewMockPublisher(ctrl)
+	srv.publishService = pub
+
+	msg := &gmqtt.Message{Topic: "a", Payload: []byte("a"), Retained: true}
+	pub.EXPECT().PublishRetained(msg).Return(nil)
+	srv.publishScheduled(msg)
+
+	msg = &gmqtt.Message{Topic: "a", Retained: true}
+	pub.EXPECT().PublishRetained(msg).Return(errors.New("rejected"))
+	srv.publishScheduled(msg)
+}
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"compress/flate"
 	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
+	"path"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,8 +22,11 @@ import (
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
 	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
+	mem_scheduled "github.com/DrmagicE/gmqtt/persistence/scheduled/mem"
 	"github.com/DrmagicE/gmqtt/persistence/session"
 	"github.com/DrmagicE/gmqtt/persistence/unack"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
 	"github.com/DrmagicE/gmqtt/pkg/codes"
 	retained_trie "github.com/DrmagicE/gmqtt/retained/trie"
 
@@ -94,17 +101,43 @@ type Server interface {
 	StatsManager() StatsReader
 	// Stop stop the server gracefully
 	Stop(ctx context.Context) error
+	// Drain stops accepting new connections, waits for the connected clients to finish the inflight and queued messages
+	// until the context is done, and then closes the remaining clients. See the server implementation for details.
+	Drain(ctx context.Context) error
 	// ApplyConfig will replace the config of the server
 	ApplyConfig(config config.Config)
+	// ReloadConfig loads the config by the ConfigLoader and applies the reloadable fields to the running server,
+	// the other changed fields are reported to require restart. See WithConfigLoader.
+	ReloadConfig() (*ReloadResult, error)
 
 	ClientService() ClientService
 
 	SubscriptionService() SubscriptionService
 
 	RetainedService() RetainedService
+	// ScheduleService returns the ScheduleService to publish messages at a scheduled time.
+	ScheduleService() ScheduleService
 	// Plugins returns all enabled plugins
 	Plugins() []Plugin
 	APIRegistrar() APIRegistrar
+	// LifecycleState returns the current lifecycle state of the server.
+	LifecycleState() LifecycleState
+	// CheckAccess runs the auth hooks in dry-run mode and returns the decision. See AccessRequest for details.
+	CheckAccess(ctx context.Context, req *AccessRequest) (*AccessDecision, error)
+	// ResolveSubscribers returns the subscriptions which match the topic name in dry-run mode, see ResolveRequest for details.
+	ResolveSubscribers(req *ResolveRequest) []ResolvedSubscriber
+	// ListListeners returns the statistics of all listeners.
+	ListListeners() []ListenerStats
+	// PersistenceHealth returns the health state of the persistence backend.
+	PersistenceHealth() PersistenceHealth
+	// SessionIterator returns the SessionIterator to list the sessions and the subscriptions.
+	SessionIterator() SessionIterator
+	// ObserverService returns the ObserverService to register the observers of the published messages.
+	ObserverService() ObserverService
+	// Clock returns the time source of the server, see WithClock.
+	Clock() clock.Clock
+	// MessageTracer returns the MessageTracer to read the recent traces, nil if config.MessageTrace is disabled.
+	MessageTracer() MessageTracer
 }
 
 type clientService struct {
@@ -141,13 +174,24 @@ func (c *clientService) GetSession(clientID string) (*gmqtt.Session, error) {
 }
 
 func (c *clientService) TerminateSession(clientID string) {
+	c.TerminateSessionWithDisconnect(clientID, nil)
+}
+
+func (c *clientService) TerminateSessionWithDisconnect(clientID string, disconnect *packets.Disconnect) {
 	c.srv.mu.Lock()
-	defer c.srv.mu.Unlock()
 	if cli, ok := c.srv.clients[clientID]; ok {
 		atomic.StoreInt32(&cli.forceRemoveSession, 1)
-		cli.Close()
+		c.srv.mu.Unlock()
+		if disconnect != nil && cli.version == packets.Version5 {
+			// the connection is closed after the DISCONNECT packet is written.
+			// Write outside the lock, because it blocks until the packet is accepted by the write loop.
+			cli.Disconnect(disconnect)
+		} else {
+			cli.Close()
+		}
 		return
 	}
+	defer c.srv.mu.Unlock()
 	if _, ok := c.srv.offlineClients[clientID]; ok {
 		err := c.srv.sessionTerminatedLocked(clientID, NormalTermination)
 		if err != nil {
@@ -161,11 +205,27 @@ func (c *clientService) TerminateSession(clientID string) {
 // server represents a mqtt server instance.
 // Create a server by using New()
 type server struct {
-	wg       sync.WaitGroup
+	// wg waits for the background goroutines, e.g: the event loop and the API servers.
+	wg sync.WaitGroup
+	// willWg waits for the goroutines of the delayed will messages.
+	willWg   sync.WaitGroup
 	initOnce sync.Once
 	stopOnce sync.Once
 	mu       sync.RWMutex //gard clients & offlineClients map
 	status   int32        //server status
+	// lifecycleState is the LifecycleState of the server, use atomic to access.
+	lifecycleState int32
+	// drainOnce guards the listeners closing of Drain.
+	drainOnce sync.Once
+	// dropDispatcher calls the OnMessageDropped hook, nil if the hook is not set.
+	dropDispatcher *dropDispatcher
+	// metricSink is set by WithMetricSink, nil if not set.
+	metricSink MetricSink
+	// publishDedup remembers the idempotency keys of the published QoS 1 messages, nil if config.PublishDedup is disabled.
+	publishDedup *publishDedup
+	// noSubscriber calls the OnNoSubscriber hook and republishes the dead letters,
+	// nil if neither the hook nor config.NoSubscriber.DeadLetter is set.
+	noSubscriber *noSubscriberDispatcher
 	// clients stores the  online clients
 	clients map[string]*client
 	// offlineClients store the expired time of all disconnected clients
@@ -181,23 +241,87 @@ type server struct {
 
 	retainedDB      retained.Store
 	subscriptionsDB subscription.Store //store subscriptions
+	// customRetainedDB indicates whether the retained store is set by WithRetainedStore.
+	customRetainedDB bool
+	// subscribeMu serializes the check and the add of the subscriptions if config.MQTT.MaxTotalSubscriptions is set,
+	// so that the concurrent SUBSCRIBEs can not exceed the limit together.
+	subscribeMu sync.Mutex
 
 	persistence  Persistence
 	queueStore   map[string]queue.Store
 	unackStore   map[string]unack.Store
 	sessionStore session.Store
+	// payloadCodec is nil if the payloads of the queued messages are stored as they are.
+	payloadCodec queue.PayloadCodec
 
-	// guards config
-	configMu             sync.RWMutex
-	config               config.Config
+	// configMu serializes ApplyConfig and guards the states compiled from the config.
+	configMu sync.RWMutex
+	// cfg is the *config.Config which is replaced as a whole by ApplyConfig, see config.
+	cfg                  atomic.Value
 	hooks                Hooks
 	plugins              []Plugin
 	statsManager         *statsManager
 	publishService       Publisher
 	newTopicAliasManager NewTopicAliasManager
+	newPacketIDAllocator NewPacketIDAllocator
+	newPublishLimiter    NewPublishLimiter
+	certUsernameFunc     CertUsernameFunc
+	newSubscriptionStore NewSubscriptionStore
+	// connectACL is compiled from config.ConnectACL and guarded by configMu, nil means disabled.
+	connectACL *connectACL
+	// clientIDRule is compiled from config.ClientIDPolicy and guarded by configMu.
+	clientIDRule *clientIDRule
+	// configLoader is nil if ReloadConfig is not supported, see WithConfigLoader.
+	configLoader ConfigLoader
+	// reloadMu serializes ReloadConfig.
+	reloadMu sync.Mutex
+	// logLevel is the level of the logger which is changed by ApplyConfig, nil if not set, see WithLogLevel.
+	logLevel *zap.AtomicLevel
 
 	clientService *clientService
 	apiRegistrar  *apiRegistrar
+	// stormDetector is nil if the reconnect storm detector is disabled.
+	stormDetector *stormDetector
+	// persistenceHealth is nil if the persistence health check is disabled, see config.PersistenceHealthCheck.
+	persistenceHealth *persistenceHealth
+	// batcher is nil if the message batching is disabled.
+	batcher *batcher
+	// fanout is nil if the fanout workers are disabled or the server has been stopped, see config.MQTT.FanoutWorkers.
+	fanout *fanoutPool
+	// systemClient is nil if SystemClientID is empty.
+	systemClient *detachedClient
+	// publishSequencer is nil if StrictPublishOrder is false.
+	publishSequencer *publishSequencer
+	// topicAliasHints stores the hot topics of the offline sessions, see config.TopicAliasManager.PrimeOnResume.
+	topicAliasHints map[string][]string
+	// sharedCursors records the client id which received the last message of each shared subscription, key by the full topic name.
+	// Only used in round_robin shared subscription strategy. The entry is removed when the last member unsubscribes.
+	sharedCursors map[string]string
+	// scheduler delivers the messages scheduled by ScheduleService.
+	scheduler *scheduler
+	// observers receive a copy of the routed messages, see Observer.
+	observers *observerRegistry
+	// tracer records the stages of the traced messages, nil if config.MessageTrace is disabled.
+	tracer *messageTracer
+	// clock is the time source of the time-based features, see WithClock.
+	clock clock.Clock
+	// redirectCursor is the index of the next config.Redirect.Servers to redirect to.
+	redirectCursor uint32
+	// connLimiter counts the network connections, see config.MQTT.MaxConnections.
+	connLimiter *connLimiter
+	// banList is the temporary ban list checked at CONNECT, see config.BanList.
+	banList *banList
+	// connectRejections records the recently rejected CONNECTs, see config.MQTT.ConnectRejectionBufferSize.
+	connectRejections *connectRejections
+	// usernameSessions tracks the sessions of each username, see config.MQTT.MaxSessionsPerUsername.
+	usernameSessions *usernameSessions
+
+	// logLimiter limits the per-client error logs, nil means no limit.
+	logLimiter *logLimiter
+
+	listenersMu sync.RWMutex
+	// listeners records the statistics of the tcp listeners and websocket servers.
+	listeners []*listenerState
 }
 
 func (srv *server) APIRegistrar() APIRegistrar {
@@ -221,11 +345,87 @@ func (srv *server) ClientService() ClientService {
 	return srv.clientService
 }
 
+func (srv *server) ScheduleService() ScheduleService {
+	return srv.scheduler
+}
+
+func (srv *server) MessageTracer() MessageTracer {
+	if srv.tracer == nil {
+		return nil
+	}
+	return srv.tracer
+}
+
+func (srv *server) Clock() clock.Clock {
+	return srv.clock
+}
+
 func (srv *server) ApplyConfig(config config.Config) {
 	srv.configMu.Lock()
-	defer srv.configMu.Unlock()
-	srv.config = config
+	acl, err := newConnectACL(config.ConnectACL)
+	if err != nil {
+		zaplog.Error("invalid connect acl, keep the previous one", zap.Error(err))
+	} else {
+		srv.connectACL = acl
+	}
+	rule, err := newClientIDRule(config.ClientIDPolicy)
+	if err != nil {
+		zaplog.Error("invalid client id policy, keep the previous one", zap.Error(err))
+	} else {
+		srv.clientIDRule = rule
+	}
+	rateLimitChanged := srv.config().PublishRateLimit != config.PublishRateLimit
+	srv.storeConfig(config)
+	srv.applyRetainedLimits(config.MQTT)
+	srv.connLimiter.setLimits(config.MQTT.MaxConnections, config.MQTT.MaxConnectionsPerIP)
+	srv.banList.setMaxEntries(config.BanList.MaxEntries)
+	if srv.logLevel != nil {
+		if err := srv.logLevel.UnmarshalText([]byte(config.Log.Level)); err != nil {
+			zaplog.Error("invalid log level, keep the previous one", zap.Error(err))
+		}
+	}
+	srv.configMu.Unlock()
+	if rateLimitChanged {
+		srv.mu.Lock()
+		for _, c := range srv.clients {
+			c.reloadPublishRateLimit(config.PublishRateLimit)
+		}
+		srv.mu.Unlock()
+	}
+}
+
+// applyRetainedLimits applies the limits of the retained messages to the retained store if supported.
+func (srv *server) applyRetainedLimits(c config.MQTT) {
+	if l, ok := srv.retainedDB.(retained.BytesLimiter); ok {
+		l.SetMaxBytes(c.MaxRetainedBytes)
+	}
+	if l, ok := srv.retainedDB.(retained.Limiter); ok {
+		l.SetLimits(retained.Limits{
+			MaxMessages:     c.MaxRetainedMessages,
+			MaxMessageBytes: c.MaxRetainedMessageBytes,
+			RejectNew:       c.RetainedLimitPolicy == config.RetainedLimitReject,
+		})
+	}
+}
 
+// addRetained adds or replaces the retained message,
+// it returns the error of retained.Limiter.TryAddOrReplace if the message is not stored due to the limits.
+func (srv *server) addRetained(msg *gmqtt.Message) error {
+	if l, ok := srv.retainedDB.(retained.Limiter); ok {
+		return l.TryAddOrReplace(msg)
+	}
+	srv.retainedDB.AddOrReplace(msg)
+	return nil
+}
+
+// storeRetained stores the retained message, or removes the existing retained message of the topic if the payload is empty.
+// It returns the error of retained.Limiter.TryAddOrReplace if the message is not stored due to the limits.
+func (srv *server) storeRetained(msg *gmqtt.Message) error {
+	if len(msg.Payload) == 0 {
+		srv.retainedDB.Remove(msg.Topic)
+		return nil
+	}
+	return srv.addRetained(msg.Copy())
 }
 
 func (srv *server) SubscriptionService() SubscriptionService {
@@ -255,9 +455,18 @@ const (
 
 // GetConfig returns the config of the server
 func (srv *server) GetConfig() config.Config {
-	srv.configMu.Lock()
-	defer srv.configMu.Unlock()
-	return srv.config
+	return *srv.config()
+}
+
+// config returns the current config, which must not be modified.
+// The config is replaced by ApplyConfig at any time, the readers which read several fields should load it once,
+// so that they see a consistent config.
+func (srv *server) config() *config.Config {
+	return srv.cfg.Load().(*config.Config)
+}
+
+func (srv *server) storeConfig(c config.Config) {
+	srv.cfg.Store(&c)
 }
 
 // StatsManager returns StatsReader
@@ -272,6 +481,10 @@ func (srv *server) Status() int32 {
 
 func (srv *server) sessionTerminatedLocked(clientID string, reason SessionTerminatedReason) (err error) {
 	err = srv.removeSessionLocked(clientID)
+	// The delayed will message is published when the session ends, if the will delay interval has not elapsed.
+	if w, ok := srv.willMessage[clientID]; ok {
+		w.signal(true)
+	}
 	if srv.hooks.OnSessionTerminated != nil {
 		srv.hooks.OnSessionTerminated(context.Background(), clientID, reason)
 	}
@@ -312,7 +525,8 @@ func (srv *server) lockDuplicatedID(c *client) (oldSession *gmqtt.Session, err e
 			srv.mu.Unlock()
 			zaplog.Error("fail to get session",
 				zap.String("remote_addr", c.rwc.RemoteAddr().String()),
-				zap.String("client_id", c.opts.ClientID))
+				zap.String("client_id", c.opts.ClientID),
+				zap.String("conn_id", c.connID))
 			return
 		}
 		if oldSession != nil {
@@ -323,10 +537,15 @@ func (srv *server) lockDuplicatedID(c *client) (oldSession *gmqtt.Session, err e
 				srv.mu.Lock()
 				break
 			}
+			if err = srv.checkTakeover(oldClient, c); err != nil {
+				return
+			}
 			// if there is a duplicated online client, close if first.
 			zaplog.Info("logging with duplicate ClientID",
 				zap.String("remote", c.rwc.RemoteAddr().String()),
 				zap.String("client_id", oldSession.ClientID),
+				zap.String("conn_id", c.connID),
+				zap.String("existing_conn_id", oldClient.connID),
 			)
 			oldClient.setError(codes.NewError(codes.SessionTakenOver))
 			oldClient.Close()
@@ -338,17 +557,60 @@ func (srv *server) lockDuplicatedID(c *client) (oldSession *gmqtt.Session, err e
 	return
 }
 
+// checkTakeover calls the OnSessionTakeover hook, it returns the error of CONNACK if the new client is rejected.
+func (srv *server) checkTakeover(oldClient, c *client) error {
+	if srv.hooks.OnSessionTakeover == nil {
+		return nil
+	}
+	var code codes.Code
+	switch srv.hooks.OnSessionTakeover(context.Background(), c.opts.ClientID, oldClient.opts, c.opts) {
+	case SessionRejectNew:
+		code = codes.UnspecifiedError
+	case SessionRejectIfRemoteDiffers:
+		if remoteHost(oldClient.rwc) == remoteHost(c.rwc) {
+			return nil
+		}
+		code = codes.NotAuthorized
+	default:
+		return nil
+	}
+	zaplog.Info("session takeover rejected",
+		zap.String("remote", c.rwc.RemoteAddr().String()),
+		zap.String("existing_remote", oldClient.rwc.RemoteAddr().String()),
+		zap.String("client_id", c.opts.ClientID),
+		zap.String("conn_id", c.connID),
+	)
+	return codes.NewError(code)
+}
+
+// remoteHost returns the host of the remote address without the port.
+func remoteHost(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 // 已经判断是成功了，注册
 func (srv *server) registerClient(connect *packets.Connect, client *client) (sessionResume bool, err error) {
 	var qs queue.Store
 	var ua unack.Store
 	var sess *gmqtt.Session
 	var oldSession *gmqtt.Session
-	now := time.Now()
+	now := srv.clock.Now()
+	if err = srv.checkPersistentSession(connect, client); err != nil {
+		return
+	}
 	oldSession, err = srv.lockDuplicatedID(client)
 	if err != nil {
 		return
 	}
+	err = srv.checkSessionLimitLocked(client)
+	if err != nil {
+		srv.mu.Unlock()
+		return
+	}
 	defer func() {
 		if err == nil {
 			var willMsg *gmqtt.Message
@@ -363,7 +625,7 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 			}
 			// use default expiry if the client version is version3.1.1
 			if packets.IsVersion3X(client.version) && !connect.CleanStart {
-				expiryInterval = uint32(srv.config.MQTT.SessionExpiry.Seconds())
+				expiryInterval = uint32(srv.config().MQTT.SessionExpiry.Seconds())
 			} else if connect.Properties != nil {
 				willDelayInterval = convertUint32(connect.WillProperties.WillDelayInterval, 0)
 				expiryInterval = client.opts.SessionExpiry
@@ -397,13 +659,25 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 				srv.statsManager.sessionActive(true)
 			}
 			srv.clients[client.opts.ClientID] = client
+			srv.usernameSessions.add(client.opts.Username, client.opts.ClientID, sess.ConnectedAt)
 			srv.unackStore[client.opts.ClientID] = ua
 			srv.queueStore[client.opts.ClientID] = qs
+			srv.statsManager.setQueueStore(client.opts.ClientID, qs)
 			client.queueStore = qs
 			client.unackStore = ua
 			if client.version == packets.Version5 {
-				client.topicAliasManager = srv.newTopicAliasManager(client.config, client.opts.ClientTopicAliasMax, client.opts.ClientID)
+				maxAlias := client.opts.ClientTopicAliasMax
+				if m := client.config.TopicAliasManager.Max; m != 0 && m < maxAlias {
+					maxAlias = m
+				}
+				client.topicAliasManager = srv.newTopicAliasManager(client.config, maxAlias, client.opts.ClientID)
+				if p, ok := client.topicAliasManager.(TopicAliasPrimer); ok && sessionResume && client.config.TopicAliasManager.PrimeOnResume {
+					if topics := srv.topicAliasHints[client.opts.ClientID]; len(topics) != 0 {
+						p.Prime(topics)
+					}
+				}
 			}
+			delete(srv.topicAliasHints, client.opts.ClientID)
 		}
 		srv.mu.Unlock()
 	}()
@@ -420,15 +694,12 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 		}
 		// clean old session
 		if !sessionResume {
+			// the delayed will message is sent because the previous session is ended.
 			err = srv.sessionTerminatedLocked(oldSession.ClientID, TakenOverTermination)
 			if err != nil {
 				err = fmt.Errorf("session terminated fail: %w", err)
 				zaplog.Error("session terminated fail", zap.Error(err))
 			}
-			// Send will message because the previous session is ended.
-			if w, ok := srv.willMessage[client.opts.ClientID]; ok {
-				w.signal(true)
-			}
 		} else {
 			qs = srv.queueStore[client.opts.ClientID]
 			if qs != nil {
@@ -437,6 +708,7 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 					Version:        client.version,
 					ReadBytesLimit: client.opts.ClientMaxPacketSize,
 					Notifier:       client.queueNotifier,
+					Clock:          srv.clock,
 				})
 				if err != nil {
 					return
@@ -455,11 +727,13 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 				sessionResume = false
 				zaplog.Error("detect inconsistent session state",
 					zap.String("remote_addr", client.rwc.RemoteAddr().String()),
-					zap.String("client_id", client.opts.ClientID))
+					zap.String("client_id", client.opts.ClientID),
+					zap.String("conn_id", client.connID))
 			} else {
 				zaplog.Info("logged in with session reuse",
 					zap.String("remote_addr", client.rwc.RemoteAddr().String()),
-					zap.String("client_id", client.opts.ClientID))
+					zap.String("client_id", client.opts.ClientID),
+					zap.String("conn_id", client.connID))
 			}
 
 		}
@@ -467,7 +741,7 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 	if !sessionResume {
 		// create new session
 		// It is ok to pass nil to defaultNotifier, because we will call Init to override it.
-		qs, err = srv.persistence.NewQueueStore(srv.config, nil, client.opts.ClientID)
+		qs, err = srv.persistence.NewQueueStore(*srv.config(), nil, client.opts.ClientID)
 		if err != nil {
 			return
 		}
@@ -476,12 +750,13 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 			Version:        client.version,
 			ReadBytesLimit: client.opts.ClientMaxPacketSize,
 			Notifier:       client.queueNotifier,
+			Clock:          srv.clock,
 		})
 		if err != nil {
 			return
 		}
 
-		ua, err = srv.persistence.NewUnackStore(srv.config, client.opts.ClientID)
+		ua, err = srv.persistence.NewUnackStore(*srv.config(), client.opts.ClientID)
 		if err != nil {
 			return
 		}
@@ -492,6 +767,7 @@ func (srv *server) registerClient(connect *packets.Connect, client *client) (ses
 		zaplog.Info("logged in with new session",
 			zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 			zap.String("client_id", client.opts.ClientID),
+			zap.String("conn_id", client.connID),
 		)
 	}
 	delete(srv.offlineClients, client.opts.ClientID)
@@ -503,6 +779,10 @@ type willMsg struct {
 	// If true, send the msg.
 	// If false, discard the msg.
 	send chan bool
+	// timer fires at the earlier of willAt and the session expiry.
+	timer clock.Timer
+	// willAt is the time when the will delay interval elapses.
+	willAt time.Time
 }
 
 func (w *willMsg) signal(send bool) {
@@ -512,28 +792,81 @@ func (w *willMsg) signal(send bool) {
 	}
 }
 
+// rescheduleWillLocked recomputes the fire time of the delayed will message after the session expiry of the disconnected client is changed.
+func (srv *server) rescheduleWillLocked(clientID string, expiresAt time.Time) {
+	wm, ok := srv.willMessage[clientID]
+	if !ok {
+		return
+	}
+	// the timer has fired if Stop returns false, the will message is being sent.
+	if wm.timer.Stop() {
+		wm.timer.Reset(earlierTime(wm.willAt, expiresAt).Sub(srv.clock.Now()))
+	}
+}
+
+// earlierTime returns the earlier one of a and b.
+func earlierTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
 // sendWillLocked sends the will message for the client, this function must be guard by srv.Lock.
-func (srv *server) sendWillLocked(msg *gmqtt.Message, clientID string) {
+func (srv *server) sendWillLocked(msg *gmqtt.Message, client *detachedClient) {
+	clientID := client.opts.ClientID
 	req := &WillMsgRequest{
-		Message: msg,
+		Message:          msg,
+		IterationOptions: defaultIterateOptions(msg.Topic),
 	}
+	willAuth := srv.config().MQTT.WillMessageAuth
 	if srv.hooks.OnWillPublish != nil {
-		srv.hooks.OnWillPublish(context.Background(), clientID, req)
+		ctx := context.Background()
+		if willAuth && srv.hooks.OnMsgArrived != nil {
+			ctx = context.WithValue(ctx, willAuthPendingKey{}, true)
+		}
+		srv.hooks.OnWillPublish(ctx, clientID, req)
 	}
 	// the will message is dropped
 	if req.Message == nil {
 		return
 	}
-	srv.deliverMessage(clientID, msg, defaultIterateOptions(msg.Topic))
+	msg = req.Message
+	opts := req.IterationOptions
+	if willAuth && srv.hooks.OnAuthorize != nil &&
+		!srv.hooks.OnAuthorize(context.Background(), client, &AuthorizeRequest{Action: AccessPublish, Topic: msg.Topic}) {
+		zaplog.Info("will message discarded by OnAuthorize hook",
+			zap.String("client_id", clientID),
+			zap.String("topic", msg.Topic))
+		return
+	}
+	if willAuth && srv.hooks.OnMsgArrived != nil {
+		arrived := &MsgArrivedRequest{
+			Publish:          gmqtt.MessageToPublish(msg, client.version),
+			Message:          msg,
+			IterationOptions: opts,
+		}
+		err := srv.hooks.OnMsgArrived(context.Background(), client, arrived)
+		if err != nil || arrived.Message == nil {
+			zaplog.Info("will message discarded by OnMsgArrived hook",
+				zap.String("client_id", clientID),
+				zap.String("topic", msg.Topic),
+				zap.Error(err))
+			return
+		}
+		msg = arrived.Message
+		opts = arrived.IterationOptions
+	}
+	srv.deliverMessage(clientID, msg, opts)
 	if srv.hooks.OnWillPublished != nil {
-		srv.hooks.OnWillPublished(context.Background(), clientID, req.Message)
+		srv.hooks.OnWillPublished(context.Background(), clientID, msg)
 	}
 }
 
 func (srv *server) unregisterClient(client *client) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	now := time.Now()
+	now := srv.clock.Now()
 	var storeSession bool
 	if sess, err := srv.sessionStore.Get(client.opts.ClientID); sess != nil {
 		forceRemove := atomic.LoadInt32(&client.forceRemoveSession)
@@ -545,47 +878,68 @@ func (srv *server) unregisterClient(client *client) {
 				storeSession = true
 			}
 		}
+		var msg *gmqtt.Message
+		var willAt, fireAt time.Time
+		var publish bool
+		if sess.Will != nil {
+			msg = sess.Will.Copy()
+			var delay time.Duration
+			delay, publish = srv.willDelay(client, msg, time.Duration(sess.WillDelayInterval)*time.Second, !client.cleanWillFlag)
+			// The will message is published at the earlier of the will delay and the session expiry.
+			willAt = now.Add(delay)
+			fireAt = earlierTime(willAt, now.Add(time.Duration(sess.ExpiryInterval)*time.Second))
+		}
 		// need to send will message
-		if !client.cleanWillFlag && sess.Will != nil {
-			willDelayInterval := sess.WillDelayInterval
-			if sess.ExpiryInterval <= sess.WillDelayInterval {
-				willDelayInterval = sess.ExpiryInterval
-			}
-			msg := sess.Will.Copy()
-			if willDelayInterval != 0 && storeSession {
+		if publish {
+			willClient := newDetachedClient(client)
+			if delay := fireAt.Sub(now); delay > 0 && storeSession {
+				t := srv.clock.NewTimer(delay)
 				wm := &willMsg{
-					msg:  msg,
-					send: make(chan bool, 1),
+					msg:    msg,
+					send:   make(chan bool, 1),
+					timer:  t,
+					willAt: willAt,
 				}
 				srv.willMessage[client.opts.ClientID] = wm
-				t := time.NewTimer(time.Duration(willDelayInterval) * time.Second)
+				srv.willWg.Add(1)
 				go func(clientID string) {
+					defer srv.willWg.Done()
 					var send bool
 					select {
 					case send = <-wm.send:
 						t.Stop()
-					case <-t.C:
+					case <-t.C():
 						send = true
 					}
 					srv.mu.Lock()
 					defer srv.mu.Unlock()
-					delete(srv.willMessage, clientID)
+					// the client may have reconnected and disconnected again, which delays a new will message.
+					if srv.willMessage[clientID] == wm {
+						delete(srv.willMessage, clientID)
+					}
 					if !send {
 						return
 					}
-					srv.sendWillLocked(msg, clientID)
+					srv.sendWillLocked(msg, willClient)
 				}(client.opts.ClientID)
+				if srv.hooks.OnWillDelayed != nil {
+					srv.hooks.OnWillDelayed(context.Background(), client.opts.ClientID, msg, delay)
+				}
 			} else {
-				srv.sendWillLocked(msg, client.opts.ClientID)
+				srv.sendWillLocked(msg, willClient)
 			}
 		}
 		if storeSession {
 			expiredTime := now.Add(time.Duration(sess.ExpiryInterval) * time.Second)
 			srv.offlineClients[client.opts.ClientID] = expiredTime
+			if p, ok := client.topicAliasManager.(TopicAliasPrimer); ok && client.config.TopicAliasManager.PrimeOnResume {
+				srv.topicAliasHints[client.opts.ClientID] = p.HotTopics()
+			}
 			delete(srv.clients, client.opts.ClientID)
 			zaplog.Info("logged out and storing session",
 				zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 				zap.String("client_id", client.opts.ClientID),
+				zap.String("conn_id", client.connID),
 				zap.Time("expired_at", expiredTime),
 			)
 			return
@@ -594,28 +948,36 @@ func (srv *server) unregisterClient(client *client) {
 		zaplog.Error("fail to get session",
 			zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 			zap.String("client_id", client.opts.ClientID),
+			zap.String("conn_id", client.connID),
 			zap.Error(err))
 	}
 	zaplog.Info("logged out and cleaning session",
 		zap.String("remote_addr", client.rwc.RemoteAddr().String()),
 		zap.String("client_id", client.opts.ClientID),
+		zap.String("conn_id", client.connID),
 	)
 	_ = srv.sessionTerminatedLocked(client.opts.ClientID, NormalTermination)
 }
 
-func (srv *server) addMsgToQueueLocked(now time.Time, clientID string, msg *gmqtt.Message, sub *gmqtt.Subscription, ids []uint32, q queue.Store) {
-	mqttCfg := srv.config.MQTT
+// addMsgToQueueLocked adds the message to the queue of the subscriber,
+// it returns true if the message is rejected by the queue, see enqueueLocked.
+func (srv *server) addMsgToQueueLocked(now time.Time, clientID string, msg *gmqtt.Message, sub *gmqtt.Subscription, ids []uint32, q queue.Store) (rejected bool) {
+	mqttCfg := srv.config().MQTT
 	if !mqttCfg.QueueQos0Msg {
 		// If the client with the clientID is not connected, skip qos0 messages.
 		if c := srv.clients[clientID]; c == nil && msg.QoS == packets.Qos0 {
-			return
+			srv.tracer.record(srv.tracer.traceID(msg), msg, TraceEvent{Stage: TraceDropped, ClientID: clientID, Reason: "the QoS 0 message is not queued for the offline client"})
+			return false
 		}
 	}
 	if msg.QoS > sub.QoS {
 		msg.QoS = sub.QoS
 	}
+	// The identifiers of all matched subscriptions are attached to the message, the identifiers of the incoming message are never forwarded.
+	// https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901117 [MQTT-3.3.4-3], [MQTT-3.3.4-4]
+	msg.SubscriptionIdentifier = nil
 	for _, id := range ids {
-		if id != 0 {
+		if id != 0 && !containsUint32(msg.SubscriptionIdentifier, id) {
 			msg.SubscriptionIdentifier = append(msg.SubscriptionIdentifier, id)
 		}
 	}
@@ -625,25 +987,33 @@ func (srv *server) addMsgToQueueLocked(now time.Time, clientID string, msg *gmqt
 	}
 	var expiry time.Time
 	if mqttCfg.MessageExpiry != 0 {
-		if msg.MessageExpiry != 0 && int(msg.MessageExpiry) <= int(mqttCfg.MessageExpiry) {
+		if msg.MessageExpiry != 0 && time.Duration(msg.MessageExpiry)*time.Second <= mqttCfg.MessageExpiry {
 			expiry = now.Add(time.Duration(msg.MessageExpiry) * time.Second)
 		} else {
 			expiry = now.Add(mqttCfg.MessageExpiry)
+			// forward the capped expiry interval to the subscriber.
+			if msg.MessageExpiry != 0 {
+				msg.MessageExpiry = uint32(mqttCfg.MessageExpiry / time.Second)
+			}
 		}
 	} else if msg.MessageExpiry != 0 {
 		expiry = now.Add(time.Duration(msg.MessageExpiry) * time.Second)
 	}
-	err := q.Add(&queue.Elem{
-		At:     now,
-		Expiry: expiry,
-		MessageWithID: &queue.Publish{
-			Message: msg,
-		},
-	})
-	if err != nil {
-		srv.clients[clientID].queueNotifier.notifyDropped(msg, &queue.InternalError{Err: err})
-		return
+	if sub.Batch && srv.batcher != nil {
+		srv.tracer.record(srv.tracer.traceID(msg), msg, TraceEvent{Stage: TraceEnqueued, ClientID: clientID, Reason: "batched"})
+		srv.addBatchLocked(clientID, sub, msg, expiry)
+		return false
+	}
+	return srv.enqueueLocked(now, clientID, msg, expiry, q)
+}
+
+func containsUint32(s []uint32, v uint32) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
 	}
+	return false
 }
 
 // sharedList is the subscriber (client id) list of shared subscriptions. (key by topic name).
@@ -658,106 +1028,231 @@ type maxQos map[string]*struct {
 	subIDs []uint32
 }
 
+// matchedSubscriptions groups the matched subscriptions of a message.
+// It is used by both the delivery and ResolveSubscribers, so that they select the same subscribers.
+type matchedSubscriptions struct {
+	sl sharedList
+	mq maxQos
+}
+
+func newMatchedSubscriptions() matchedSubscriptions {
+	return matchedSubscriptions{
+		sl: make(sharedList),
+		mq: make(maxQos),
+	}
+}
+
+// add adds the shared subscription to sl, and the non-shared subscription to mq if the delivery mode is onlyonce.
+// It returns false if the subscription is not added, which is the non-shared subscription in overlap mode.
+func (m matchedSubscriptions) add(mode string, clientID string, sub *gmqtt.Subscription) bool {
+	if sub.ShareName != "" {
+		fullTopic := sub.GetFullTopicName()
+		m.sl[fullTopic] = append(m.sl[fullTopic], struct {
+			clientID string
+			sub      *gmqtt.Subscription
+		}{clientID: clientID, sub: sub})
+		return true
+	}
+	if mode == Overlap {
+		return false
+	}
+	// If the delivery mode is onlyOnce, set the message qos to the maximum qos in matched subscriptions.
+	if m.mq[clientID] == nil {
+		m.mq[clientID] = &struct {
+			sub    *gmqtt.Subscription
+			subIDs []uint32
+		}{sub: sub}
+	} else if m.mq[clientID].sub.QoS < sub.QoS {
+		m.mq[clientID].sub = sub
+	}
+	if sub.ID != 0 && !containsUint32(m.mq[clientID].subIDs, sub.ID) {
+		m.mq[clientID].subIDs = append(m.mq[clientID].subIDs, sub.ID)
+	}
+	return true
+}
+
 // deliverHandler controllers the delivery behaviors according to the DeliveryMode config. (overlap or onlyonce)
 type deliverHandler struct {
 	fn      subscription.IterateFn
-	sl      sharedList
-	mq      maxQos
+	subs    matchedSubscriptions
+	targets []fanoutTarget
 	matched bool
-	now     time.Time
-	msg     *gmqtt.Message
-	srv     *server
+	// rejected indicates whether the message is rejected by any of the subscriber queues.
+	rejected bool
+	now      time.Time
+	msg      *gmqtt.Message
+	srv      *server
 }
 
 func newDeliverHandler(mode string, srcClientID string, msg *gmqtt.Message, now time.Time, srv *server) *deliverHandler {
 	d := &deliverHandler{
-		sl:  make(sharedList),
-		mq:  make(maxQos),
-		msg: msg,
-		srv: srv,
-		now: now,
+		subs: newMatchedSubscriptions(),
+		msg:  msg,
+		srv:  srv,
+		now:  now,
 	}
-	var iterateFn subscription.IterateFn
 	d.fn = func(clientID string, sub *gmqtt.Subscription) bool {
 		if sub.NoLocal && clientID == srcClientID {
 			return true
 		}
 		d.matched = true
-		if sub.ShareName != "" {
-			fullTopic := sub.GetFullTopicName()
-			d.sl[fullTopic] = append(d.sl[fullTopic], struct {
-				clientID string
-				sub      *gmqtt.Subscription
-			}{clientID: clientID, sub: sub})
+		if d.subs.add(mode, clientID, sub) {
 			return true
 		}
-		return iterateFn(clientID, sub)
-	}
-	if mode == Overlap {
-		iterateFn = func(clientID string, sub *gmqtt.Subscription) bool {
-			if qs := srv.queueStore[clientID]; qs != nil {
-				srv.addMsgToQueueLocked(now, clientID, msg.Copy(), sub, []uint32{sub.ID}, qs)
-			}
-			return true
-		}
-	} else {
-		iterateFn = func(clientID string, sub *gmqtt.Subscription) bool {
-			// If the delivery mode is onlyOnce, set the message qos to the maximum qos in matched subscriptions.
-			if d.mq[clientID] == nil {
-				d.mq[clientID] = &struct {
-					sub    *gmqtt.Subscription
-					subIDs []uint32
-				}{sub: sub, subIDs: []uint32{sub.ID}}
-				return true
-			}
-			if d.mq[clientID].sub.QoS < sub.QoS {
-				d.mq[clientID].sub = sub
-			}
-			d.mq[clientID].subIDs = append(d.mq[clientID].subIDs, sub.ID)
-			return true
+		if qs := srv.queueStore[clientID]; qs != nil {
+			d.targets = append(d.targets, fanoutTarget{clientID: clientID, sub: sub, ids: []uint32{sub.ID}, q: qs})
 		}
+		return true
 	}
 	return d
 }
 
 func (d *deliverHandler) flush() {
 	// shared subscription
-	// TODO enable customize balance strategy of shared subscription
-	for _, v := range d.sl {
-		var rs struct {
-			clientID string
-			sub      *gmqtt.Subscription
+	for fullTopic, v := range d.subs.sl {
+		i := d.srv.selectSharedSubscriberLocked(fullTopic, v, false)
+		if i == -1 {
+			continue
 		}
-		// random
-		rs = v[rand.Intn(len(v))]
+		rs := v[i]
 		if c, ok := d.srv.queueStore[rs.clientID]; ok {
-			d.srv.addMsgToQueueLocked(d.now, rs.clientID, d.msg.Copy(), rs.sub, []uint32{rs.sub.ID}, c)
+			d.targets = append(d.targets, fanoutTarget{clientID: rs.clientID, sub: rs.sub, ids: []uint32{rs.sub.ID}, q: c})
 		}
 	}
 	// For onlyonce mode, send the non-shared messages.
-	for clientID, v := range d.mq {
+	for clientID, v := range d.subs.mq {
 		if qs := d.srv.queueStore[clientID]; qs != nil {
-			d.srv.addMsgToQueueLocked(d.now, clientID, d.msg.Copy(), v.sub, v.subIDs, qs)
+			d.targets = append(d.targets, fanoutTarget{clientID: clientID, sub: v.sub, ids: v.subIDs, q: qs})
 		}
 	}
+	if id := d.srv.tracer.traceID(d.msg); id != "" {
+		d.srv.tracer.matched(id, d.msg, d.targets)
+	}
+	d.rejected = d.srv.fanoutLocked(d.now, d.msg, d.targets)
+}
+
+// selectSharedSubscriberLocked returns the index of the member which receives the message of the shared subscription,
+// according to the SharedSubscriptionStrategy config. Returns -1 if no member is selected.
+// If peek is true, the last receiver of round_robin strategy is not changed,
+// and no member is selected in random strategy, because the member is picked at random for each message.
+func (srv *server) selectSharedSubscriberLocked(fullTopic string, members []struct {
+	clientID string
+	sub      *gmqtt.Subscription
+}, peek bool) int {
+	if srv.config().MQTT.SharedSubscriptionStrategy == config.SharedSubscriptionRoundRobin {
+		if peek {
+			return srv.peekSharedSubscriberLocked(fullTopic, members)
+		}
+		return srv.nextSharedSubscriberLocked(fullTopic, members)
+	}
+	if peek {
+		return -1
+	}
+	// random
+	return rand.Intn(len(members))
+}
+
+// nextSharedSubscriberLocked returns the index of the member which follows the last receiver of the shared subscription in client id order,
+// and records the member as the last receiver.
+// The members whose session has gone away are skipped. Returns -1 if there is no available member.
+func (srv *server) nextSharedSubscriberLocked(fullTopic string, members []struct {
+	clientID string
+	sub      *gmqtt.Subscription
+}) int {
+	i := srv.peekSharedSubscriberLocked(fullTopic, members)
+	if i == -1 {
+		return -1
+	}
+	if srv.sharedCursors == nil {
+		srv.sharedCursors = make(map[string]string)
+	}
+	srv.sharedCursors[fullTopic] = members[i].clientID
+	return i
+}
+
+// peekSharedSubscriberLocked is the same as nextSharedSubscriberLocked, except that the last receiver is not changed.
+// The members are sorted by client id.
+func (srv *server) peekSharedSubscriberLocked(fullTopic string, members []struct {
+	clientID string
+	sub      *gmqtt.Subscription
+}) int {
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].clientID < members[j].clientID
+	})
+	last := srv.sharedCursors[fullTopic]
+	start := sort.Search(len(members), func(i int) bool {
+		return members[i].clientID > last
+	})
+	for k := 0; k < len(members); k++ {
+		i := (start + k) % len(members)
+		if _, ok := srv.queueStore[members[i].clientID]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeSharedCursorLocked removes the last receiver of the shared subscription if the shared subscription has no member left.
+func (srv *server) removeSharedCursorLocked(fullTopic string) {
+	if _, ok := srv.sharedCursors[fullTopic]; !ok {
+		return
+	}
+	var found bool
+	srv.subscriptionsDB.Iterate(func(string, *gmqtt.Subscription) bool {
+		found = true
+		return false
+	}, subscription.IterationOptions{
+		Type:      subscription.TypeShared,
+		TopicName: fullTopic,
+		MatchType: subscription.MatchName,
+	})
+	if !found {
+		delete(srv.sharedCursors, fullTopic)
+	}
+}
+
+// removeSharedCursor is the same as removeSharedCursorLocked, except that it acquires srv.mu.
+// The non-shared topic filters are ignored.
+func (srv *server) removeSharedCursor(topicName string) {
+	if !strings.HasPrefix(topicName, "$share/") {
+		return
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.removeSharedCursorLocked(topicName)
 }
 
 // deliverMessage send msg to matched client, must call under srv.mu.Lock
 func (srv *server) deliverMessage(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched bool) {
-	now := time.Now()
-	d := newDeliverHandler(srv.config.MQTT.DeliveryMode, srcClientID, msg, now, srv)
+	matched, _ = srv.deliver(srcClientID, msg, options)
+	return matched
+}
+
+// deliver is the same as deliverMessage, besides it also reports whether the message is rejected by any subscriber queue,
+// see config.MQTT.QueueOverflowStrategy.
+func (srv *server) deliver(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
+	now := srv.clock.Now()
+	d := newDeliverHandler(srv.config().MQTT.DeliveryMode, srcClientID, msg, now, srv)
 	srv.subscriptionsDB.Iterate(d.fn, options)
 	d.flush()
-	return d.matched
+	if srv.observers != nil {
+		srv.observers.observe(srcClientID, msg)
+	}
+	return d.matched, d.rejected
 }
 
 func (srv *server) removeSessionLocked(clientID string) (err error) {
 	delete(srv.clients, clientID)
 	delete(srv.offlineClients, clientID)
+	delete(srv.topicAliasHints, clientID)
+	srv.usernameSessions.remove(clientID)
+	srv.tracer.forget(clientID)
+	srv.removeBatchesLocked(clientID)
 
 	var errs []string
 	var queueErr, sessionErr, subErr error
 	if qs := srv.queueStore[clientID]; qs != nil {
+		srv.dropDispatcher.dispatchQueue(clientID, qs, srv.payloadCodec)
 		queueErr = qs.Clean()
 		if queueErr != nil {
 			zaplog.Error("fail to clean message queue",
@@ -766,6 +1261,7 @@ func (srv *server) removeSessionLocked(clientID string) (err error) {
 			errs = append(errs, "fail to clean message queue: "+queueErr.Error())
 		}
 		delete(srv.queueStore, clientID)
+		srv.statsManager.removeQueueStore(clientID)
 	}
 	sessionErr = srv.sessionStore.Remove(clientID)
 	if sessionErr != nil {
@@ -775,6 +1271,17 @@ func (srv *server) removeSessionLocked(clientID string) (err error) {
 
 		errs = append(errs, "fail to remove session: "+sessionErr.Error())
 	}
+	// the shared subscriptions of the client, whose last receiver is removed if the client is the last member.
+	var shared []string
+	if len(srv.sharedCursors) != 0 {
+		srv.subscriptionsDB.Iterate(func(_ string, sub *gmqtt.Subscription) bool {
+			shared = append(shared, sub.GetFullTopicName())
+			return true
+		}, subscription.IterationOptions{
+			Type:     subscription.TypeShared,
+			ClientID: clientID,
+		})
+	}
 	subErr = srv.subscriptionsDB.UnsubscribeAll(clientID)
 	if subErr != nil {
 		zaplog.Error("fail to remove subscription",
@@ -783,6 +1290,9 @@ func (srv *server) removeSessionLocked(clientID string) (err error) {
 
 		errs = append(errs, "fail to remove subscription: "+subErr.Error())
 	}
+	for _, v := range shared {
+		srv.removeSharedCursorLocked(v)
+	}
 
 	if errs != nil {
 		return errors.New(strings.Join(errs, ";"))
@@ -793,21 +1303,37 @@ func (srv *server) removeSessionLocked(clientID string) (err error) {
 // sessionExpireCheck 判断是否超时
 // sessionExpireCheck check and terminate expired sessions
 func (srv *server) sessionExpireCheck() {
-	now := time.Now()
+	now := srv.clock.Now()
 	srv.mu.Lock()
 	for cid, expiredTime := range srv.offlineClients {
 		if now.After(expiredTime) {
-			zaplog.Info("session expired", zap.String("client_id", cid))
-			_ = srv.sessionTerminatedLocked(cid, ExpiredTermination)
-
+			_ = srv.expireSessionLocked(cid)
 		}
 	}
 	srv.mu.Unlock()
 }
 
+// expireSessionLocked terminates the session of the disconnected client as it expires.
+func (srv *server) expireSessionLocked(clientID string) error {
+	zaplog.Info("session expired", zap.String("client_id", clientID))
+	return srv.sessionTerminatedLocked(clientID, ExpiredTermination)
+}
+
 // server event loop
 func (srv *server) eventLoop() {
 	sessionExpireTimer := time.NewTicker(time.Second * 20)
+	var stormCheck <-chan time.Time
+	if srv.stormDetector != nil {
+		stormTimer := time.NewTicker(time.Second)
+		defer stormTimer.Stop()
+		stormCheck = stormTimer.C
+	}
+	var slowConsumerCheck <-chan time.Time
+	if srv.config().SlowConsumer.Enable {
+		slowConsumerTimer := time.NewTicker(time.Second)
+		defer slowConsumerTimer.Stop()
+		slowConsumerCheck = slowConsumerTimer.C
+	}
 	defer func() {
 		sessionExpireTimer.Stop()
 		srv.wg.Done()
@@ -818,6 +1344,10 @@ func (srv *server) eventLoop() {
 			return
 		case <-sessionExpireTimer.C:
 			srv.sessionExpireCheck()
+		case <-stormCheck:
+			srv.checkReconnectStorm()
+		case now := <-slowConsumerCheck:
+			srv.checkSlowConsumers(now)
 		}
 
 	}
@@ -829,21 +1359,58 @@ type WsServer struct {
 	Path     string // Url path
 	CertFile string //TLS configration
 	KeyFile  string //TLS configration
+	// ClientIDFilter restricts the client ids of the connections accepted by the websocket server.
+	// If nil, all client ids are allowed.
+	ClientIDFilter ClientIDFilter
+	// Name tags the connections accepted by the websocket server, see NewNamedListener.
+	Name string
+	// Compression indicates whether to negotiate the permessage-deflate extension (RFC 7692) with the clients.
+	// The extension is always negotiated with server_no_context_takeover and client_no_context_takeover,
+	// context takeover is not supported.
+	Compression bool
+	// CompressionLevel is the flate compression level from 1 (best speed) to 9 (best compression).
+	// 0 means flate.DefaultCompression.
+	CompressionLevel int
+	// RequireClientCert indicates whether the CONNECT packet without a verified client certificate is rejected with "Not authorized".
+	// Server.TLSConfig must be set to verify the client certificates, e.g: tls.VerifyClientCertIfGiven.
+	RequireClientCert bool
+	// Subprotocols is the list of the supported websocket subprotocols, default to ["mqtt"].
+	// The handshake which does not request any of them is rejected with 400.
+	Subprotocols []string
+	// AllowedOrigins is the allowlist of the Origin header, empty means all origins are allowed.
+	// The patterns are matched by path.Match case-insensitively, and "*" alone matches all origins.
+	// The handshake from a disallowed origin is rejected with 403. The handshake without the Origin header is always allowed.
+	AllowedOrigins []string
+	// TopicAliasMax overrides config.MQTT.TopicAliasMax for the connections accepted by the websocket server,
+	// nil means no override. See NewTopicAliasMaxListener.
+	TopicAliasMax *uint16
+	// Policy is the connection policy of the websocket server, nil means no policy. See NewPolicyListener.
+	Policy *ListenerPolicy
+	// SocketOptions is the socket options of the websocket server and the connections accepted by it,
+	// nil means the defaults of the net package.
+	SocketOptions *SocketOptions
 }
 
 func defaultServer() *server {
 	srv := &server{
-		status:         serverStatusInit,
-		exitChan:       make(chan struct{}),
-		exitedChan:     make(chan struct{}),
-		clients:        make(map[string]*client),
-		offlineClients: make(map[string]time.Time),
-		willMessage:    make(map[string]*willMsg),
-		retainedDB:     retained_trie.NewStore(),
-		config:         config.DefaultConfig(),
-		queueStore:     make(map[string]queue.Store),
-		unackStore:     make(map[string]unack.Store),
-	}
+		status:           serverStatusInit,
+		exitChan:         make(chan struct{}),
+		exitedChan:       make(chan struct{}),
+		clients:          make(map[string]*client),
+		offlineClients:   make(map[string]time.Time),
+		willMessage:      make(map[string]*willMsg),
+		topicAliasHints:  make(map[string][]string),
+		sharedCursors:    make(map[string]string),
+		usernameSessions: newUsernameSessions(),
+		connLimiter:      newConnLimiter(),
+		banList:          newBanList(config.DefaultBanList.MaxEntries),
+		retainedDB:       retained_trie.NewStore(),
+		queueStore:       make(map[string]queue.Store),
+		unackStore:       make(map[string]unack.Store),
+		observers:        newObserverRegistry(),
+		clock:            clock.New(),
+	}
+	srv.storeConfig(config.DefaultConfig())
 	srv.publishService = &publishService{server: srv}
 	return srv
 }
@@ -865,10 +1432,39 @@ func (srv *server) init(opts ...Options) (err error) {
 	if err != nil {
 		return err
 	}
+	srv.connectACL, err = newConnectACL(srv.config().ConnectACL)
+	if err != nil {
+		return err
+	}
+	srv.clientIDRule, err = newClientIDRule(srv.config().ClientIDPolicy)
+	if err != nil {
+		return err
+	}
+	if srv.hooks.OnMessageDropped != nil {
+		srv.dropDispatcher = newDropDispatcher(srv.hooks.OnMessageDropped, droppedBufferSize)
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.dropDispatcher.run(srv.exitChan)
+		}()
+	}
+	if srv.hooks.OnNoSubscriber != nil || srv.config().NoSubscriber.DeadLetter {
+		var prefix string
+		if srv.config().NoSubscriber.DeadLetter {
+			prefix = srv.config().NoSubscriber.DeadLetterPrefix
+		}
+		srv.noSubscriber = newNoSubscriberDispatcher(srv.hooks.OnNoSubscriber, prefix, srv.publishDeadLetter, unmatchedBufferSize)
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.noSubscriber.run(srv.exitChan)
+		}()
+	}
+	srv.transitLifecycle(StateRestoring)
 	var pe Persistence
-	peType := srv.config.Persistence.Type
+	peType := srv.config().Persistence.Type
 	if newFn := persistenceFactories[peType]; newFn != nil {
-		pe, err = newFn(srv.config)
+		pe, err = newFn(*srv.config())
 		if err != nil {
 			return err
 		}
@@ -881,12 +1477,25 @@ func (srv *server) init(opts ...Options) (err error) {
 	}
 	zaplog.Info("open persistence succeeded", zap.String("type", peType))
 	srv.persistence = pe
+	if hc, ok := pe.(HealthCheckPersistence); ok && srv.config().Persistence.HealthCheck.Interval > 0 {
+		srv.persistenceHealth = newPersistenceHealth(hc, srv.config().Persistence.HealthCheck)
+	}
 
-	srv.subscriptionsDB, err = srv.persistence.NewSubscriptionStore(srv.config)
+	if srv.newSubscriptionStore != nil {
+		srv.subscriptionsDB, err = srv.newSubscriptionStore(*srv.config())
+	} else {
+		srv.subscriptionsDB, err = srv.persistence.NewSubscriptionStore(*srv.config())
+	}
 	if err != nil {
 		return err
 	}
-	st, err := srv.persistence.NewSessionStore(srv.config)
+	if rp, ok := srv.persistence.(RetainedPersistence); ok && !srv.customRetainedDB {
+		srv.retainedDB, err = rp.NewRetainedStore(*srv.config())
+		if err != nil {
+			return err
+		}
+	}
+	st, err := srv.persistence.NewSessionStore(*srv.config())
 	if err != nil {
 		return err
 	}
@@ -904,7 +1513,85 @@ func (srv *server) init(opts ...Options) (err error) {
 	}
 	zaplog.Info("init session store succeeded", zap.String("type", peType), zap.Int("session_total", len(cids)))
 
+	var scheduledStore scheduled.Store
+	if sp, ok := srv.persistence.(SchedulablePersistence); ok {
+		scheduledStore, err = sp.NewScheduledStore(*srv.config())
+		if err != nil {
+			return err
+		}
+	} else {
+		scheduledStore = mem_scheduled.New()
+	}
+	srv.scheduler, err = newScheduler(scheduledStore, srv.clock, srv.publishScheduled)
+	if err != nil {
+		return err
+	}
+	zaplog.Info("init scheduled store succeeded", zap.String("type", peType), zap.Int("scheduled_total", len(srv.scheduler.pending)))
+
+	srv.connectRejections = newConnectRejections(srv.config().MQTT.ConnectRejectionBufferSize)
+	srv.banList = newBanList(srv.config().BanList.MaxEntries)
+	if srv.config().BanList.Persistent {
+		if bp, ok := srv.persistence.(BanPersistence); ok {
+			banStore, err := bp.NewBanStore(*srv.config())
+			if err != nil {
+				return err
+			}
+			if err = srv.banList.load(banStore, srv.clock.Now()); err != nil {
+				return err
+			}
+			zaplog.Info("init ban store succeeded", zap.String("type", peType), zap.Int("ban_total", len(srv.banList.bans)))
+		} else {
+			zaplog.Warn("the persistence does not support persisting the ban list, the bans are kept in memory", zap.String("type", peType))
+		}
+	}
+
 	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	if srv.metricSink != nil {
+		srv.statsManager.sink = newMetricDispatcher(srv.metricSink, metricBufferSize)
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.statsManager.sink.run(srv.exitChan)
+		}()
+	}
+	if r, ok := srv.retainedDB.(retained.StatsReader); ok {
+		srv.statsManager.retainedStatsReader = r
+	}
+	srv.applyRetainedLimits(srv.config().MQTT)
+	srv.connLimiter.setLimits(srv.config().MQTT.MaxConnections, srv.config().MQTT.MaxConnectionsPerIP)
+	srv.statsManager.connectionsReader = srv.connLimiter.connections
+	if srv.config().ReconnectStorm.Enable {
+		srv.stormDetector = newStormDetector(srv.config().ReconnectStorm, time.Now())
+	}
+	if srv.config().TopicStats.Enable {
+		srv.statsManager.topicTracker = newTopicTracker(srv.config().TopicStats.Capacity)
+	}
+	if srv.config().SlowConsumer.Enable {
+		srv.statsManager.queueHighWaterMark = uint64(srv.config().SlowConsumer.HighWaterMark)
+	}
+	if srv.config().MessageBatching.Enable {
+		srv.batcher = newBatcher(srv.config().MessageBatching)
+	}
+	srv.publishDedup = newPublishDedup(srv.config().PublishDedup)
+	workers := srv.config().MQTT.FanoutWorkers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > 1 {
+		srv.fanout = newFanoutPool(workers)
+	}
+	if id := srv.config().MQTT.SystemClientID; id != "" {
+		srv.systemClient = newSystemClient(id)
+	}
+	if srv.config().MQTT.StrictPublishOrder {
+		srv.publishSequencer = newPublishSequencer()
+	}
+	if srv.config().MessageTrace.Enable {
+		srv.tracer = newMessageTracer(srv.config().MessageTrace, srv.clock)
+	}
+	if rate := srv.config().Log.ClientErrorRateLimit; rate > 0 {
+		srv.logLimiter = newLogLimiter(rate, srv.statsManager.errorLogSuppressed)
+	}
 	srv.clientService = &clientService{
 		srv:          srv,
 		sessionStore: srv.sessionStore,
@@ -912,14 +1599,15 @@ func (srv *server) init(opts ...Options) (err error) {
 
 	// init queue store & unack store from persistence
 	for _, v := range sts {
-		q, err := srv.persistence.NewQueueStore(srv.config, defaultNotifier(srv.hooks.OnMsgDropped, srv.statsManager, v.ClientID), v.ClientID)
+		q, err := srv.persistence.NewQueueStore(*srv.config(), srv.defaultNotifier(v.ClientID), v.ClientID)
 		if err != nil {
 			return err
 		}
 		srv.queueStore[v.ClientID] = q
-		srv.offlineClients[v.ClientID] = time.Now().Add(time.Duration(v.ExpiryInterval) * time.Second)
+		srv.statsManager.setQueueStore(v.ClientID, q)
+		srv.offlineClients[v.ClientID] = srv.clock.Now().Add(time.Duration(v.ExpiryInterval) * time.Second)
 
-		ua, err := srv.persistence.NewUnackStore(srv.config, v.ClientID)
+		ua, err := srv.persistence.NewUnackStore(*srv.config(), v.ClientID)
 		if err != nil {
 			return err
 		}
@@ -932,11 +1620,11 @@ func (srv *server) init(opts ...Options) (err error) {
 		return err
 	}
 
-	topicAliasMgrFactory := topicAliasMgrFactory[srv.config.TopicAliasManager.Type]
+	topicAliasMgrFactory := topicAliasMgrFactory[srv.config().TopicAliasManager.Type]
 	if topicAliasMgrFactory != nil {
 		srv.newTopicAliasManager = topicAliasMgrFactory
 	} else {
-		return fmt.Errorf("topic alias manager : %s not found", srv.config.TopicAliasManager.Type)
+		return fmt.Errorf("topic alias manager : %s not found", srv.config().TopicAliasManager.Type)
 	}
 	err = srv.initAPIRegistrar()
 	if err != nil {
@@ -947,7 +1635,7 @@ func (srv *server) init(opts ...Options) (err error) {
 
 func (srv *server) initAPIRegistrar() error {
 	registrar := &apiRegistrar{}
-	for _, v := range srv.config.API.HTTP {
+	for _, v := range srv.config().API.HTTP {
 		server, err := buildHTTPServer(v)
 		if err != nil {
 			return err
@@ -955,7 +1643,7 @@ func (srv *server) initAPIRegistrar() error {
 		registrar.httpServers = append(registrar.httpServers, server)
 
 	}
-	for _, v := range srv.config.API.GRPC {
+	for _, v := range srv.config().API.GRPC {
 		server, err := buildGRPCServer(v)
 		if err != nil {
 			return err
@@ -981,15 +1669,21 @@ func (srv *server) Client(clientID string) Client {
 	return srv.clients[clientID]
 }
 
-func (srv *server) serveTCP(l net.Listener) {
+func (srv *server) serveTCP(l net.Listener, state *listenerState) {
 	defer func() {
 		l.Close()
 	}()
 	var tempDelay time.Duration
 	for {
+		// stop accepting until a slot is available if config.MQTT.MaxConnections is reached.
+		if !srv.connLimiter.reserve() {
+			return
+		}
 		rw, e := l.Accept()
 		if e != nil {
+			srv.connLimiter.cancel()
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				state.acceptError()
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
 				} else {
@@ -1001,20 +1695,45 @@ func (srv *server) serveTCP(l net.Listener) {
 				time.Sleep(tempDelay)
 				continue
 			}
+			select {
+			case <-srv.exitChan:
+				// the listener is closed by Stop.
+			default:
+				// the listener is closed by Drain.
+				if srv.LifecycleState() != StateDraining {
+					state.acceptError()
+				}
+			}
 			return
 		}
+		ip := addrIP(rw.RemoteAddr())
+		ipQuotaExceeded := srv.connLimiter.bind(ip)
+		if !srv.allowConnection() {
+			rw.Close()
+			srv.connLimiter.release(ip)
+			continue
+		}
 		if srv.hooks.OnAccept != nil {
 			if !srv.hooks.OnAccept(context.Background(), rw) {
 				rw.Close()
+				srv.connLimiter.release(ip)
 				continue
 			}
 		}
 		client, err := srv.newClient(rw)
 		if err != nil {
+			srv.connLimiter.release(ip)
 			zaplog.Error("new client fail", zap.Error(err))
 			return
 		}
-		go client.serve()
+		client.ipQuotaExceeded = ipQuotaExceeded
+		state.bind(client)
+		state.connected()
+		go func() {
+			client.serve()
+			srv.connLimiter.release(ip)
+			state.disconnected()
+		}()
 	}
 }
 
@@ -1027,6 +1746,87 @@ var defaultUpgrader = &websocket.Upgrader{
 	Subprotocols: []string{"mqtt"},
 }
 
+// newUpgrader returns the function which upgrades the HTTP connections to the websocket protocol for the given websocket server.
+func newUpgrader(ws *WsServer) func(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	u := *defaultUpgrader
+	if len(ws.Subprotocols) != 0 {
+		u.Subprotocols = ws.Subprotocols
+	}
+	if len(ws.AllowedOrigins) != 0 {
+		u.CheckOrigin = newOriginChecker(ws.AllowedOrigins)
+	}
+	u.EnableCompression = ws.Compression
+	level := ws.CompressionLevel
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return func(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+		// check the origin before the subprotocol, so that a disallowed origin always gets 403.
+		if !u.CheckOrigin(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return nil, errOriginNotAllowed
+		}
+		if !requestsSubprotocol(r, u.Subprotocols) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return nil, errSubprotocolNotSupported
+		}
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !u.EnableCompression {
+			return c, nil
+		}
+		// no-op if the client does not negotiate the extension.
+		if err = c.SetCompressionLevel(level); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+var (
+	errOriginNotAllowed        = errors.New("websocket: request origin not allowed")
+	errSubprotocolNotSupported = errors.New("websocket: none of the requested subprotocols is supported")
+)
+
+// newOriginChecker returns the origin checker of the given allowlist, see WsServer.AllowedOrigins.
+func newOriginChecker(allowed []string) func(r *http.Request) bool {
+	patterns := make([]string, 0, len(allowed))
+	for _, v := range allowed {
+		patterns = append(patterns, strings.ToLower(v))
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		origin = strings.ToLower(origin)
+		for _, p := range patterns {
+			if p == "*" {
+				return true
+			}
+			if ok, _ := path.Match(p, origin); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// requestsSubprotocol reports whether the handshake requests any of the supported subprotocols.
+func requestsSubprotocol(r *http.Request, supported []string) bool {
+	for _, v := range websocket.Subprotocols(r) {
+		for _, s := range supported {
+			if v == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // 实现io.ReadWriter接口
 // wsConn implements the io.readWriter
 type wsConn struct {
@@ -1071,7 +1871,25 @@ func (ws *wsConn) Write(p []byte) (n int, err error) {
 
 func (srv *server) serveWebSocket(ws *WsServer) {
 	var err error
-	if ws.CertFile != "" && ws.KeyFile != "" {
+	useTLS := ws.CertFile != "" && ws.KeyFile != ""
+	if ws.SocketOptions != nil {
+		addr := ws.Server.Addr
+		if addr == "" {
+			addr = ":http"
+			if useTLS {
+				addr = ":https"
+			}
+		}
+		var ln net.Listener
+		ln, err = ws.SocketOptions.Listen(addr, 0)
+		if err == nil {
+			if useTLS {
+				err = ws.Server.ServeTLS(ln, ws.CertFile, ws.KeyFile)
+			} else {
+				err = ws.Server.Serve(ln)
+			}
+		}
+	} else if useTLS {
 		err = ws.Server.ListenAndServeTLS(ws.CertFile, ws.KeyFile)
 	} else {
 		err = ws.Server.ListenAndServe()
@@ -1082,10 +1900,12 @@ func (srv *server) serveWebSocket(ws *WsServer) {
 }
 
 func (srv *server) newClient(c net.Conn) (*client, error) {
+	cfg := *srv.config()
 	srv.configMu.Lock()
-	cfg := srv.config
+	acl := srv.connectACL
 	srv.configMu.Unlock()
 	client := &client{
+		connID:        newConnID(),
 		server:        srv,
 		rwc:           c,
 		bufr:          newBufioReaderSize(c, readBufferSize),
@@ -1095,25 +1915,40 @@ func (srv *server) newClient(c net.Conn) (*client, error) {
 		connected:     make(chan struct{}),
 		error:         make(chan error, 1),
 		in:            make(chan packets.Packet, 8),
-		out:           make(chan packets.Packet, 8),
+		out:           make(chan packets.Packet, writeBufferCap(cfg.MQTT.WriteBufferSize)),
 		status:        Connecting,
-		opts:          &ClientOptions{},
+		opts:          &ClientOptions{MaximumQoS: packets.Qos2},
 		cleanWillFlag: false,
 		config:        cfg,
+		connectACL:    acl,
+		aclCache:      newACLCache(cfg.ACLCache),
 		register:      srv.registerClient,
 		unregister:    srv.unregisterClient,
-		deliverMessage: func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched bool) {
+		deliverMessage: func(srcClientID string, msg *gmqtt.Message, options subscription.IterationOptions) (matched, rejected bool) {
 			srv.mu.Lock()
 			defer srv.mu.Unlock()
-			return srv.deliverMessage(srcClientID, msg, options)
+			return srv.deliver(srcClientID, msg, options)
 		},
 	}
+	if cfg.MQTT.WriteBufferPolicy == config.WriteBufferDropOldest {
+		client.pending = newPendingWrites(writeBufferCap(cfg.MQTT.WriteBufferSize))
+	}
 	client.packetReader = packets.NewReader(client.bufr)
+	client.packetReader.SetLenient(cfg.MQTT.ProtocolCompliance == config.ProtocolComplianceLenient)
+	// the limit applies to the CONNECT packet as well, it is updated by the AuthOptions after the connection is authenticated.
+	client.packetReader.SetMaxPacketSize(cfg.MQTT.MaxPacketSize)
 	client.packetWriter = packets.NewWriter(client.bufw)
 	client.queueNotifier = &queueNotifier{
-		dropHook: srv.hooks.OnMsgDropped,
-		sts:      srv.statsManager,
-		cli:      client,
+		dropHook:   srv.hooks.OnMsgDropped,
+		dispatcher: srv.dropDispatcher,
+		sts:        srv.statsManager,
+		cli:        client,
+		codec:      srv.payloadCodec,
+		tracer:     srv.tracer,
+	}
+	if cfg.CPUAccounting.Enable {
+		client.readCPU = newCPUAccounter(cfg.CPUAccounting.SampleRate)
+		client.writeCPU = newCPUAccounter(cfg.CPUAccounting.SampleRate)
 	}
 	client.setConnecting()
 
@@ -1142,14 +1977,43 @@ func (srv *server) initPluginHooks() error {
 		onMsgDroppedWrappers       []OnMsgDroppedWrapper
 		onWillPublishWrappers      []OnWillPublishWrapper
 		onWillPublishedWrappers    []OnWillPublishedWrapper
+		onWillDelayedWrappers      []OnWillDelayedWrapper
+		onWillDelayWrappers        []OnWillDelayWrapper
+		onReconnectStormWrappers   []OnReconnectStormWrapper
+		onLifecycleWrappers        []OnLifecycleStateChangedWrapper
+		onKeepAliveTimeoutWrappers []OnKeepAliveTimeoutWrapper
+		onSessionTakeoverWrappers  []OnSessionTakeoverWrapper
+		onMessageDroppedWrappers   []OnMessageDroppedWrapper
+		onAuthorizeWrappers        []OnAuthorizeWrapper
+		onTopicRewriteWrappers     []OnTopicRewriteWrapper
+		onRedirectWrappers         []OnRedirectWrapper
+		onSlowConsumerWrappers     []OnSlowConsumerWrapper
+		onTopicPolicyWrappers      []OnTopicPolicyWrapper
+		onConnectRejectedWrappers  []OnConnectRejectedWrapper
+		onClientIDWrappers         []OnClientIDWrapper
+		onNoSubscriberWrappers     []OnNoSubscriberWrapper
 	)
-	for _, v := range srv.config.PluginOrder {
-		plg, err := plugins[v](srv.config)
+	for _, v := range srv.config().PluginOrder {
+		newPlugin, ok := plugins[v]
+		if !ok {
+			return fmt.Errorf("plugin %s is not registered", v)
+		}
+		plg, err := newPlugin(*srv.config())
 		if err != nil {
 			return err
 		}
 		srv.plugins = append(srv.plugins, plg)
 	}
+	sorted, err := sortPlugins(srv.plugins)
+	if err != nil {
+		return err
+	}
+	srv.plugins = sorted
+	names := make([]string, len(srv.plugins))
+	for i, p := range srv.plugins {
+		names[i] = p.Name()
+	}
+	zaplog.Info("plugin loading order", zap.Strings("plugins", names))
 
 	for _, p := range srv.plugins {
 		hooks := p.HookWrapper()
@@ -1211,6 +2075,51 @@ func (srv *server) initPluginHooks() error {
 		if hooks.OnWillPublishedWrapper != nil {
 			onWillPublishedWrappers = append(onWillPublishedWrappers, hooks.OnWillPublishedWrapper)
 		}
+		if hooks.OnWillDelayedWrapper != nil {
+			onWillDelayedWrappers = append(onWillDelayedWrappers, hooks.OnWillDelayedWrapper)
+		}
+		if hooks.OnWillDelayWrapper != nil {
+			onWillDelayWrappers = append(onWillDelayWrappers, hooks.OnWillDelayWrapper)
+		}
+		if hooks.OnReconnectStormWrapper != nil {
+			onReconnectStormWrappers = append(onReconnectStormWrappers, hooks.OnReconnectStormWrapper)
+		}
+		if hooks.OnLifecycleStateChangedWrapper != nil {
+			onLifecycleWrappers = append(onLifecycleWrappers, hooks.OnLifecycleStateChangedWrapper)
+		}
+		if hooks.OnKeepAliveTimeoutWrapper != nil {
+			onKeepAliveTimeoutWrappers = append(onKeepAliveTimeoutWrappers, hooks.OnKeepAliveTimeoutWrapper)
+		}
+		if hooks.OnSessionTakeoverWrapper != nil {
+			onSessionTakeoverWrappers = append(onSessionTakeoverWrappers, hooks.OnSessionTakeoverWrapper)
+		}
+		if hooks.OnMessageDroppedWrapper != nil {
+			onMessageDroppedWrappers = append(onMessageDroppedWrappers, hooks.OnMessageDroppedWrapper)
+		}
+		if hooks.OnAuthorizeWrapper != nil {
+			onAuthorizeWrappers = append(onAuthorizeWrappers, hooks.OnAuthorizeWrapper)
+		}
+		if hooks.OnTopicRewriteWrapper != nil {
+			onTopicRewriteWrappers = append(onTopicRewriteWrappers, hooks.OnTopicRewriteWrapper)
+		}
+		if hooks.OnRedirectWrapper != nil {
+			onRedirectWrappers = append(onRedirectWrappers, hooks.OnRedirectWrapper)
+		}
+		if hooks.OnSlowConsumerWrapper != nil {
+			onSlowConsumerWrappers = append(onSlowConsumerWrappers, hooks.OnSlowConsumerWrapper)
+		}
+		if hooks.OnTopicPolicyWrapper != nil {
+			onTopicPolicyWrappers = append(onTopicPolicyWrappers, hooks.OnTopicPolicyWrapper)
+		}
+		if hooks.OnConnectRejectedWrapper != nil {
+			onConnectRejectedWrappers = append(onConnectRejectedWrappers, hooks.OnConnectRejectedWrapper)
+		}
+		if hooks.OnClientIDWrapper != nil {
+			onClientIDWrappers = append(onClientIDWrappers, hooks.OnClientIDWrapper)
+		}
+		if hooks.OnNoSubscriberWrapper != nil {
+			onNoSubscriberWrappers = append(onNoSubscriberWrappers, hooks.OnNoSubscriberWrapper)
+		}
 	}
 	if onAcceptWrappers != nil {
 		onAccept := func(ctx context.Context, conn net.Conn) bool {
@@ -1353,6 +2262,121 @@ func (srv *server) initPluginHooks() error {
 		}
 		srv.hooks.OnWillPublished = onWillPublished
 	}
+	if onWillDelayedWrappers != nil {
+		onWillDelayed := func(ctx context.Context, clientID string, msg *gmqtt.Message, delay time.Duration) {}
+		for i := len(onWillDelayedWrappers); i > 0; i-- {
+			onWillDelayed = onWillDelayedWrappers[i-1](onWillDelayed)
+		}
+		srv.hooks.OnWillDelayed = onWillDelayed
+	}
+	if onWillDelayWrappers != nil {
+		// the wrappers fall back to the spec behavior.
+		onWillDelay := OnWillDelay(specWillDelay)
+		for i := len(onWillDelayWrappers); i > 0; i-- {
+			onWillDelay = onWillDelayWrappers[i-1](onWillDelay)
+		}
+		srv.hooks.OnWillDelay = onWillDelay
+	}
+	if onReconnectStormWrappers != nil {
+		onReconnectStorm := func(ctx context.Context, ev *ReconnectStormEvent) {}
+		for i := len(onReconnectStormWrappers); i > 0; i-- {
+			onReconnectStorm = onReconnectStormWrappers[i-1](onReconnectStorm)
+		}
+		srv.hooks.OnReconnectStorm = onReconnectStorm
+	}
+	if onLifecycleWrappers != nil {
+		onLifecycleStateChanged := func(ctx context.Context, from, to LifecycleState) {}
+		for i := len(onLifecycleWrappers); i > 0; i-- {
+			onLifecycleStateChanged = onLifecycleWrappers[i-1](onLifecycleStateChanged)
+		}
+		srv.hooks.OnLifecycleStateChanged = onLifecycleStateChanged
+	}
+	if onKeepAliveTimeoutWrappers != nil {
+		onKeepAliveTimeout := func(ctx context.Context, clientID string) {}
+		for i := len(onKeepAliveTimeoutWrappers); i > 0; i-- {
+			onKeepAliveTimeout = onKeepAliveTimeoutWrappers[i-1](onKeepAliveTimeout)
+		}
+		srv.hooks.OnKeepAliveTimeout = onKeepAliveTimeout
+	}
+	if onSessionTakeoverWrappers != nil {
+		onSessionTakeover := func(ctx context.Context, clientID string, existing, incoming *ClientOptions) TakeoverDecision {
+			return SessionTakeover
+		}
+		for i := len(onSessionTakeoverWrappers); i > 0; i-- {
+			onSessionTakeover = onSessionTakeoverWrappers[i-1](onSessionTakeover)
+		}
+		srv.hooks.OnSessionTakeover = onSessionTakeover
+	}
+	if onMessageDroppedWrappers != nil {
+		onMessageDropped := func(ctx context.Context, clientID string, msg *gmqtt.Message, reason DropReason) {}
+		for i := len(onMessageDroppedWrappers); i > 0; i-- {
+			onMessageDropped = onMessageDroppedWrappers[i-1](onMessageDropped)
+		}
+		srv.hooks.OnMessageDropped = onMessageDropped
+	}
+	if onAuthorizeWrappers != nil {
+		onAuthorize := func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+			return true
+		}
+		for i := len(onAuthorizeWrappers); i > 0; i-- {
+			onAuthorize = onAuthorizeWrappers[i-1](onAuthorize)
+		}
+		srv.hooks.OnAuthorize = onAuthorize
+	}
+	if onTopicRewriteWrappers != nil {
+		onTopicRewrite := func(ctx context.Context, clientID string, topic string, action TopicRewriteAction) (string, error) {
+			return topic, nil
+		}
+		for i := len(onTopicRewriteWrappers); i > 0; i-- {
+			onTopicRewrite = onTopicRewriteWrappers[i-1](onTopicRewrite)
+		}
+		srv.hooks.OnTopicRewrite = onTopicRewrite
+	}
+	if onRedirectWrappers != nil {
+		// the wrappers fall back to the policy of config.Redirect.
+		onRedirect := OnRedirect(srv.redirectPolicy)
+		for i := len(onRedirectWrappers); i > 0; i-- {
+			onRedirect = onRedirectWrappers[i-1](onRedirect)
+		}
+		srv.hooks.OnRedirect = onRedirect
+	}
+	if onSlowConsumerWrappers != nil {
+		onSlowConsumer := func(ctx context.Context, client Client, ev *SlowConsumerEvent) {}
+		for i := len(onSlowConsumerWrappers); i > 0; i-- {
+			onSlowConsumer = onSlowConsumerWrappers[i-1](onSlowConsumer)
+		}
+		srv.hooks.OnSlowConsumer = onSlowConsumer
+	}
+	if onTopicPolicyWrappers != nil {
+		// the wrappers fall back to the policy of config.TopicPolicy.
+		onTopicPolicy := OnTopicPolicy(srv.topicPolicy)
+		for i := len(onTopicPolicyWrappers); i > 0; i-- {
+			onTopicPolicy = onTopicPolicyWrappers[i-1](onTopicPolicy)
+		}
+		srv.hooks.OnTopicPolicy = onTopicPolicy
+	}
+	if onConnectRejectedWrappers != nil {
+		onConnectRejected := func(ctx context.Context, rejection *ConnectRejection) {}
+		for i := len(onConnectRejectedWrappers); i > 0; i-- {
+			onConnectRejected = onConnectRejectedWrappers[i-1](onConnectRejected)
+		}
+		srv.hooks.OnConnectRejected = onConnectRejected
+	}
+	if onClientIDWrappers != nil {
+		// the wrappers fall back to the policy of config.ClientIDPolicy.
+		onClientID := OnClientID(srv.clientIDPolicy)
+		for i := len(onClientIDWrappers); i > 0; i-- {
+			onClientID = onClientIDWrappers[i-1](onClientID)
+		}
+		srv.hooks.OnClientID = onClientID
+	}
+	if onNoSubscriberWrappers != nil {
+		onNoSubscriber := func(ctx context.Context, msg *gmqtt.Message) {}
+		for i := len(onNoSubscriberWrappers); i > 0; i-- {
+			onNoSubscriber = onNoSubscriberWrappers[i-1](onNoSubscriber)
+		}
+		srv.hooks.OnNoSubscriber = onNoSubscriber
+	}
 	return nil
 }
 
@@ -1367,10 +2391,23 @@ func (srv *server) loadPlugins() error {
 	return nil
 }
 
-func (srv *server) wsHandler() http.HandlerFunc {
+func (srv *server) wsHandler(ws *WsServer, state *listenerState) http.HandlerFunc {
+	upgrade := newUpgrader(ws)
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := defaultUpgrader.Upgrade(w, r, nil)
+		if !srv.allowConnection() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if !srv.connLimiter.tryReserve() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		ip := requestIP(r)
+		ipQuotaExceeded := srv.connLimiter.bind(ip)
+		defer srv.connLimiter.release(ip)
+		c, err := upgrade(w, r)
 		if err != nil {
+			state.acceptError()
 			zaplog.Error("websocket upgrade error", zap.String("Msg", err.Error()))
 			return
 		}
@@ -1381,6 +2418,10 @@ func (srv *server) wsHandler() http.HandlerFunc {
 			zaplog.Error("new client fail", zap.Error(err))
 			return
 		}
+		client.ipQuotaExceeded = ipQuotaExceeded
+		state.bind(client)
+		state.connected()
+		defer state.disconnected()
 		client.serve()
 	}
 }
@@ -1409,15 +2450,37 @@ func (srv *server) Run() (err error) {
 	zaplog.Info("gmqtt server started", zap.Strings("tcp server listen on", tcps), zap.Strings("websocket server listen on", ws))
 
 	srv.status = serverStatusStarted
+	srv.transitLifecycle(StateReady)
+	tcpStates := make([]*listenerState, len(srv.tcpListener))
+	for k, v := range srv.tcpListener {
+		tcpStates[k] = newTCPListenerState(v)
+	}
+	wsStates := make([]*listenerState, len(srv.websocketServer))
+	for k, v := range srv.websocketServer {
+		wsStates[k] = newWebsocketState(v)
+	}
+	srv.listenersMu.Lock()
+	srv.listeners = append(tcpStates, wsStates...)
+	srv.listenersMu.Unlock()
+
 	srv.wg.Add(2)
 	go srv.eventLoop()
 	go srv.serveAPIServer()
-	for _, ln := range srv.tcpListener {
-		go srv.serveTCP(ln)
+	if srv.persistenceHealth != nil {
+		srv.wg.Add(1)
+		go srv.persistenceHealthLoop()
+	}
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		srv.scheduler.run(srv.exitChan)
+	}()
+	for k, ln := range srv.tcpListener {
+		go srv.serveTCP(ln, tcpStates[k])
 	}
-	for _, server := range srv.websocketServer {
+	for k, server := range srv.websocketServer {
 		mux := http.NewServeMux()
-		mux.Handle(server.Path, srv.wsHandler())
+		mux.Handle(server.Path, srv.wsHandler(server, wsStates[k]))
 		server.Server.Handler = mux
 		go srv.serveWebSocket(server)
 	}
@@ -1427,26 +2490,37 @@ func (srv *server) Run() (err error) {
 }
 
 // Stop gracefully stops the mqtt server by the following steps:
-//  1. Closing all opening TCP listeners and shutting down all opening websocket servers
-//  2. Closing all idle connections
-//  3. Waiting for all connections have been closed
-//  4. Triggering OnStop()
+//  1. Closing all opening TCP listeners and shutting down all opening websocket servers and API servers
+//  2. Closing all connections and waiting for all connections have been closed
+//  3. Publishing the pending delayed will messages, since they are not persisted
+//  4. Waiting for the background goroutines, so that no more messages are delivered
+//  5. Flushing the pending message batches into the queues and closing the persistence
+//  6. Unloading the plugins in the reverse loading order and triggering OnStop()
+//
+// It blocks until all steps are completed, or returns the context error when the context is done,
+// the persistence is not closed in the latter case, since the deliveries may still be in flight.
 func (srv *server) Stop(ctx context.Context) error {
 	var err error
 	srv.stopOnce.Do(func() {
 		zaplog.Info("stopping gmqtt server")
+		srv.transitLifecycle(StateDraining)
 		defer func() {
 			defer close(srv.exitedChan)
+			// the later messages are queued by the publishers directly.
+			srv.mu.Lock()
+			if srv.fanout != nil {
+				srv.fanout.stop()
+				srv.fanout = nil
+			}
+			srv.mu.Unlock()
+			if srv.observers != nil {
+				srv.observers.close()
+			}
+			srv.transitLifecycle(StateStopped)
 			zaplog.Info("server stopped")
 		}()
 		srv.exit()
-
-		for _, l := range srv.tcpListener {
-			l.Close()
-		}
-		for _, ws := range srv.websocketServer {
-			ws.Server.Shutdown(ctx)
-		}
+		srv.closeListeners(ctx)
 		// close all idle clients
 		srv.mu.Lock()
 		chs := make([]chan struct{}, len(srv.clients))
@@ -1457,36 +2531,67 @@ func (srv *server) Stop(ctx context.Context) error {
 			c.Close()
 		}
 		srv.mu.Unlock()
-
-		done := make(chan struct{})
-		if len(chs) != 0 {
-			go func() {
-				for _, v := range chs {
-					<-v
-				}
-				close(done)
-			}()
-		} else {
-			close(done)
+		wait := func(fn func()) bool {
+			if err = waitContext(ctx, fn); err != nil {
+				zaplog.Warn("server stop timeout, force exit", zap.String("error", err.Error()))
+				return false
+			}
+			return true
 		}
-
-		select {
-		case <-ctx.Done():
-			zaplog.Warn("server stop timeout, force exit", zap.String("error", ctx.Err().Error()))
-			err = ctx.Err()
+		for _, v := range chs {
+			ch := v
+			if !wait(func() { <-ch }) {
+				return
+			}
+		}
+		srv.mu.Lock()
+		for _, w := range srv.willMessage {
+			w.signal(true)
+		}
+		srv.mu.Unlock()
+		if !wait(srv.willWg.Wait) || !wait(srv.wg.Wait) {
 			return
-		case <-done:
-			for _, v := range srv.plugins {
-				zaplog.Info("unloading plugin", zap.String("name", v.Name()))
-				err := v.Unload()
-				if err != nil {
-					zaplog.Warn("plugin unload error", zap.String("error", err.Error()))
-				}
+		}
+		srv.mu.Lock()
+		if srv.fanout != nil {
+			srv.fanout.stop()
+			srv.fanout = nil
+		}
+		srv.flushBatchesLocked()
+		srv.mu.Unlock()
+		if srv.persistence != nil {
+			if err := srv.persistence.Close(); err != nil {
+				zaplog.Warn("persistence close error", zap.String("error", err.Error()))
 			}
-			if srv.hooks.OnStop != nil {
-				srv.hooks.OnStop(context.Background())
+		}
+		// unload in the reverse loading order, so that the dependencies are unloaded after the plugins depending on them.
+		for i := len(srv.plugins) - 1; i >= 0; i-- {
+			v := srv.plugins[i]
+			zaplog.Info("unloading plugin", zap.String("name", v.Name()))
+			err := v.Unload()
+			if err != nil {
+				zaplog.Warn("plugin unload error", zap.String("error", err.Error()))
 			}
 		}
+		if srv.hooks.OnStop != nil {
+			srv.hooks.OnStop(context.Background())
+		}
 	})
 	return err
 }
+
+// waitContext calls the blocking fn and waits for it to return or the context to be done.
+// fn is left running in the latter case.
+func waitContext(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
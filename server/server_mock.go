@@ -7,6 +7,7 @@ package server
 import (
 	context "context"
 	config "github.com/DrmagicE/gmqtt/config"
+	clock "github.com/DrmagicE/gmqtt/pkg/clock"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 )
@@ -90,6 +91,20 @@ func (mr *MockServerMockRecorder) Stop(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stop", reflect.TypeOf((*MockServer)(nil).Stop), ctx)
 }
 
+// Drain mocks base method
+func (m *MockServer) Drain(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Drain", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Drain indicates an expected call of Drain
+func (mr *MockServerMockRecorder) Drain(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Drain", reflect.TypeOf((*MockServer)(nil).Drain), ctx)
+}
+
 // ApplyConfig mocks base method
 func (m *MockServer) ApplyConfig(config config.Config) {
 	m.ctrl.T.Helper()
@@ -102,6 +117,21 @@ func (mr *MockServerMockRecorder) ApplyConfig(config interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ApplyConfig", reflect.TypeOf((*MockServer)(nil).ApplyConfig), config)
 }
 
+// ReloadConfig mocks base method
+func (m *MockServer) ReloadConfig() (*ReloadResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReloadConfig")
+	ret0, _ := ret[0].(*ReloadResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReloadConfig indicates an expected call of ReloadConfig
+func (mr *MockServerMockRecorder) ReloadConfig() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReloadConfig", reflect.TypeOf((*MockServer)(nil).ReloadConfig))
+}
+
 // ClientService mocks base method
 func (m *MockServer) ClientService() ClientService {
 	m.ctrl.T.Helper()
@@ -144,6 +174,62 @@ func (mr *MockServerMockRecorder) RetainedService() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetainedService", reflect.TypeOf((*MockServer)(nil).RetainedService))
 }
 
+// Clock mocks base method
+func (m *MockServer) Clock() clock.Clock {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Clock")
+	ret0, _ := ret[0].(clock.Clock)
+	return ret0
+}
+
+// Clock indicates an expected call of Clock
+func (mr *MockServerMockRecorder) Clock() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Clock", reflect.TypeOf((*MockServer)(nil).Clock))
+}
+
+// MessageTracer mocks base method
+func (m *MockServer) MessageTracer() MessageTracer {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MessageTracer")
+	ret0, _ := ret[0].(MessageTracer)
+	return ret0
+}
+
+// MessageTracer indicates an expected call of MessageTracer
+func (mr *MockServerMockRecorder) MessageTracer() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MessageTracer", reflect.TypeOf((*MockServer)(nil).MessageTracer))
+}
+
+// ObserverService mocks base method
+func (m *MockServer) ObserverService() ObserverService {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ObserverService")
+	ret0, _ := ret[0].(ObserverService)
+	return ret0
+}
+
+// ObserverService indicates an expected call of ObserverService
+func (mr *MockServerMockRecorder) ObserverService() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ObserverService", reflect.TypeOf((*MockServer)(nil).ObserverService))
+}
+
+// ScheduleService mocks base method
+func (m *MockServer) ScheduleService() ScheduleService {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ScheduleService")
+	ret0, _ := ret[0].(ScheduleService)
+	return ret0
+}
+
+// ScheduleService indicates an expected call of ScheduleService
+func (mr *MockServerMockRecorder) ScheduleService() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ScheduleService", reflect.TypeOf((*MockServer)(nil).ScheduleService))
+}
+
 // Plugins mocks base method
 func (m *MockServer) Plugins() []Plugin {
 	m.ctrl.T.Helper()
@@ -171,3 +257,88 @@ func (mr *MockServerMockRecorder) APIRegistrar() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "APIRegistrar", reflect.TypeOf((*MockServer)(nil).APIRegistrar))
 }
+
+// LifecycleState mocks base method
+func (m *MockServer) LifecycleState() LifecycleState {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LifecycleState")
+	ret0, _ := ret[0].(LifecycleState)
+	return ret0
+}
+
+// LifecycleState indicates an expected call of LifecycleState
+func (mr *MockServerMockRecorder) LifecycleState() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LifecycleState", reflect.TypeOf((*MockServer)(nil).LifecycleState))
+}
+
+// CheckAccess mocks base method
+func (m *MockServer) CheckAccess(ctx context.Context, req *AccessRequest) (*AccessDecision, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CheckAccess", ctx, req)
+	ret0, _ := ret[0].(*AccessDecision)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckAccess indicates an expected call of CheckAccess
+func (mr *MockServerMockRecorder) CheckAccess(ctx, req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckAccess", reflect.TypeOf((*MockServer)(nil).CheckAccess), ctx, req)
+}
+
+// ResolveSubscribers mocks base method
+func (m *MockServer) ResolveSubscribers(req *ResolveRequest) []ResolvedSubscriber {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveSubscribers", req)
+	ret0, _ := ret[0].([]ResolvedSubscriber)
+	return ret0
+}
+
+// ResolveSubscribers indicates an expected call of ResolveSubscribers
+func (mr *MockServerMockRecorder) ResolveSubscribers(req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveSubscribers", reflect.TypeOf((*MockServer)(nil).ResolveSubscribers), req)
+}
+
+// ListListeners mocks base method
+func (m *MockServer) ListListeners() []ListenerStats {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListListeners")
+	ret0, _ := ret[0].([]ListenerStats)
+	return ret0
+}
+
+// ListListeners indicates an expected call of ListListeners
+func (mr *MockServerMockRecorder) ListListeners() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListListeners", reflect.TypeOf((*MockServer)(nil).ListListeners))
+}
+
+// PersistenceHealth mocks base method
+func (m *MockServer) PersistenceHealth() PersistenceHealth {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PersistenceHealth")
+	ret0, _ := ret[0].(PersistenceHealth)
+	return ret0
+}
+
+// PersistenceHealth indicates an expected call of PersistenceHealth
+func (mr *MockServerMockRecorder) PersistenceHealth() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PersistenceHealth", reflect.TypeOf((*MockServer)(nil).PersistenceHealth))
+}
+
+// SessionIterator mocks base method
+func (m *MockServer) SessionIterator() SessionIterator {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SessionIterator")
+	ret0, _ := ret[0].(SessionIterator)
+	return ret0
+}
+
+// SessionIterator indicates an expected call of SessionIterator
+func (mr *MockServerMockRecorder) SessionIterator() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SessionIterator", reflect.TypeOf((*MockServer)(nil).SessionIterator))
+}
@@ -1,7 +1,12 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -9,10 +14,20 @@ import (
 	"github.com/DrmagicE/gmqtt"
 	"github.com/DrmagicE/gmqtt/config"
 	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/session"
+	session_mem "github.com/DrmagicE/gmqtt/persistence/session/mem"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/clock"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
 )
 
+// newTestClock returns the fake clock to control the time of the time-based features in tests.
+func newTestClock() *clock.Fake {
+	return clock.NewFake(time.Unix(1600000000, 0))
+}
+
 type testDeliverMsg struct {
 	srv *server
 }
@@ -22,9 +37,10 @@ func newTestDeliverMsg(ctrl *gomock.Controller, subscriber string) *testDeliverM
 	srv := &server{
 		subscriptionsDB: sub,
 		queueStore:      make(map[string]queue.Store),
-		config:          config.DefaultConfig(),
 		statsManager:    newStatsManager(sub),
+		clock:           clock.New(),
 	}
+	srv.storeConfig(config.DefaultConfig())
 	mockQueue := queue.NewMockStore(ctrl)
 	srv.queueStore[subscriber] = mockQueue
 	return &testDeliverMsg{
@@ -57,7 +73,7 @@ func TestServer_deliverMessage(t *testing.T) {
 
 	mockQueue := srv.queueStore[subscriber].(*queue.MockStore)
 	// test only once
-	srv.config.MQTT.DeliveryMode = OnlyOnce
+	srv.config().MQTT.DeliveryMode = OnlyOnce
 	mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
 		a.EqualValues(elem.MessageWithID.(*queue.Publish).QoS, 2)
 	})
@@ -65,7 +81,7 @@ func TestServer_deliverMessage(t *testing.T) {
 	a.True(srv.deliverMessage(srcCli, msg, defaultIterateOptions(msg.Topic)))
 
 	// test overlap
-	srv.config.MQTT.DeliveryMode = Overlap
+	srv.config().MQTT.DeliveryMode = Overlap
 	qos := map[byte]int{
 		packets.Qos1: 0,
 		packets.Qos2: 0,
@@ -88,6 +104,346 @@ func TestServer_deliverMessage(t *testing.T) {
 
 }
 
+func TestServer_deliverMessage_subscriptionIdentifier(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	subscriber := "subCli"
+	ts := newTestDeliverMsg(ctrl, subscriber)
+	srv := ts.srv
+	srv.config().MQTT.DeliveryMode = OnlyOnce
+	srv.subscriptionsDB.Subscribe(subscriber, &gmqtt.Subscription{
+		TopicFilter: "a/+",
+		ID:          1,
+		QoS:         1,
+	}, &gmqtt.Subscription{
+		TopicFilter: "a/b",
+		ID:          2,
+		QoS:         1,
+	}, &gmqtt.Subscription{
+		TopicFilter: "a/#",
+		QoS:         1,
+	})
+	msg := &gmqtt.Message{
+		Topic: "a/b",
+		QoS:   1,
+		// the identifiers of the incoming message must not be forwarded.
+		SubscriptionIdentifier: []uint32{3},
+	}
+	mockQueue := srv.queueStore[subscriber].(*queue.MockStore)
+	var delivered []*gmqtt.Message
+	mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+		delivered = append(delivered, elem.MessageWithID.(*queue.Publish).Message)
+	})
+	a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+	if a.Len(delivered, 1) {
+		a.ElementsMatch([]uint32{1, 2}, delivered[0].SubscriptionIdentifier)
+		pub := gmqtt.MessageToPublish(delivered[0], packets.Version5)
+		a.ElementsMatch([]uint32{1, 2}, pub.Properties.SubscriptionIdentifier)
+	}
+	a.Equal([]uint32{3}, msg.SubscriptionIdentifier)
+}
+
+func TestServer_deliverMessage_requestResponse(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ts := newTestDeliverMsg(ctrl, "sub1")
+	srv := ts.srv
+	srv.queueStore["sub2"] = queue.NewMockStore(ctrl)
+	srv.subscriptionsDB.Subscribe("sub1", &gmqtt.Subscription{
+		TopicFilter: "req/+",
+		ID:          1,
+		QoS:         1,
+	})
+	srv.subscriptionsDB.Subscribe("sub2", &gmqtt.Subscription{
+		TopicFilter: "req/#",
+		QoS:         1,
+	})
+	msg := &gmqtt.Message{
+		Topic:           "req/a",
+		QoS:             1,
+		ResponseTopic:   "resp/a",
+		CorrelationData: []byte("correlation"),
+		UserProperties:  []packets.UserProperty{{K: []byte("k"), V: []byte("v")}},
+	}
+	delivered := make(map[string]*gmqtt.Message)
+	for _, v := range []string{"sub1", "sub2"} {
+		clientID := v
+		srv.queueStore[clientID].(*queue.MockStore).EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+			delivered[clientID] = elem.MessageWithID.(*queue.Publish).Message
+		})
+	}
+	a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+	a.Len(delivered, 2)
+	// each subscriber receives its own copy, mutating one of them must not affect the others.
+	delivered["sub1"].CorrelationData[0] = 'x'
+	delivered["sub1"].UserProperties[0].V[0] = 'x'
+	for _, m := range []*gmqtt.Message{delivered["sub2"], msg} {
+		a.Equal("resp/a", m.ResponseTopic)
+		a.Equal([]byte("correlation"), m.CorrelationData)
+		a.Equal([]packets.UserProperty{{K: []byte("k"), V: []byte("v")}}, m.UserProperties)
+		a.Empty(m.SubscriptionIdentifier)
+	}
+	a.Equal([]uint32{1}, delivered["sub1"].SubscriptionIdentifier)
+
+	// the properties survive the serialization for each subscriber.
+	for _, m := range delivered {
+		pub := gmqtt.MessageToPublish(m, packets.Version5)
+		a.Equal([]byte("resp/a"), pub.Properties.ResponseTopic)
+		a.Equal(m.CorrelationData, pub.Properties.CorrelationData)
+	}
+}
+
+func TestServer_deliver_rejected(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	subscriber := "subCli"
+	ts := newTestDeliverMsg(ctrl, subscriber)
+	srv := ts.srv
+	srv.subscriptionsDB.Subscribe(subscriber, &gmqtt.Subscription{
+		TopicFilter: "/abc",
+		QoS:         1,
+	})
+	msg := &gmqtt.Message{
+		Topic: "/abc",
+		QoS:   1,
+	}
+	mockQueue := srv.queueStore[subscriber].(*queue.MockStore)
+	mockQueue.EXPECT().Add(gomock.Any()).Return(queue.ErrDropQueueFull)
+	matched, rejected := srv.deliver("srcCli", msg, defaultIterateOptions(msg.Topic))
+	a.True(matched)
+	a.True(rejected)
+	sts, _ := srv.statsManager.GetClientStats(subscriber)
+	a.EqualValues(1, sts.MessageStats.Qos1.DroppedTotal.QueueFull)
+
+	mockQueue.EXPECT().Add(gomock.Any()).Return(nil)
+	matched, rejected = srv.deliver("srcCli", msg, defaultIterateOptions(msg.Topic))
+	a.True(matched)
+	a.False(rejected)
+}
+
+// trimQueue is a queue.Store which implements queue.Qos0Trimmer.
+type trimQueue struct {
+	queue.Store
+	elems []*queue.Elem
+}
+
+func (q *trimQueue) Add(elem *queue.Elem) error {
+	q.elems = append(q.elems, elem)
+	return nil
+}
+
+func (q *trimQueue) TrimQos0(max int) error {
+	var n int
+	for _, v := range q.elems {
+		if v.MessageWithID.(*queue.Publish).QoS == packets.Qos0 {
+			n++
+		}
+	}
+	var elems []*queue.Elem
+	for _, v := range q.elems {
+		if v.MessageWithID.(*queue.Publish).QoS == packets.Qos0 && n > max {
+			n--
+			continue
+		}
+		elems = append(elems, v)
+	}
+	q.elems = elems
+	return nil
+}
+
+func (q *trimQueue) payloads() (rs []string) {
+	for _, v := range q.elems {
+		rs = append(rs, string(v.MessageWithID.(*queue.Publish).Payload))
+	}
+	return rs
+}
+
+func TestServer_deliverMessage_offlineQos0(t *testing.T) {
+	var tt = []struct {
+		name      string
+		queueQos0 bool
+		online    bool
+		expected  []string
+	}{
+		{
+			name:      "offline",
+			queueQos0: true,
+			expected:  []string{"1", "2", "3"},
+		},
+		{
+			name:      "online",
+			queueQos0: true,
+			online:    true,
+			expected:  []string{"0", "1", "2", "3"},
+		},
+		{
+			// the QoS 1 message is queued regardless.
+			name:     "disabled",
+			expected: []string{"1"},
+		},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			subscriber := "subCli"
+			srv := newTestDeliverMsg(ctrl, subscriber).srv
+			srv.config().MQTT.QueueQos0Msg = v.queueQos0
+			srv.config().MQTT.MaxOfflineQos0Msg = 2
+			srv.clients = make(map[string]*client)
+			if v.online {
+				srv.clients[subscriber] = &client{}
+			}
+			q := &trimQueue{}
+			srv.queueStore[subscriber] = q
+			srv.subscriptionsDB.Subscribe(subscriber, &gmqtt.Subscription{
+				TopicFilter: "/abc",
+				QoS:         1,
+			})
+			srv.deliverMessage("srcCli", &gmqtt.Message{Topic: "/abc", QoS: 0, Payload: []byte("0")}, defaultIterateOptions("/abc"))
+			// the QoS 1 message is not counted.
+			srv.deliverMessage("srcCli", &gmqtt.Message{Topic: "/abc", QoS: 1, Payload: []byte("1")}, defaultIterateOptions("/abc"))
+			for _, payload := range []string{"2", "3"} {
+				srv.deliverMessage("srcCli", &gmqtt.Message{Topic: "/abc", QoS: 0, Payload: []byte(payload)}, defaultIterateOptions("/abc"))
+			}
+			a.Equal(v.expected, q.payloads())
+		})
+	}
+}
+
+func TestServer_deliverMessage_messageExpiry(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	subscriber := "subCli"
+	ts := newTestDeliverMsg(ctrl, subscriber)
+	srv := ts.srv
+	srv.config().MQTT.MessageExpiry = time.Minute
+	srv.subscriptionsDB.Subscribe(subscriber, &gmqtt.Subscription{
+		TopicFilter: "/abc",
+		QoS:         1,
+	})
+	mockQueue := srv.queueStore[subscriber].(*queue.MockStore)
+
+	for _, v := range []struct {
+		name          string
+		messageExpiry uint32
+		expiry        time.Duration
+		// forwarded is the Message Expiry Interval forwarded to the subscriber.
+		forwarded uint32
+	}{
+		{name: "within the limit", messageExpiry: 10, expiry: 10 * time.Second, forwarded: 10},
+		{name: "exceeds the limit", messageExpiry: 3600, expiry: time.Minute, forwarded: 60},
+		{name: "no message expiry", messageExpiry: 0, expiry: time.Minute, forwarded: 0},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			now := time.Now()
+			mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+				a.WithinDuration(now.Add(v.expiry), elem.Expiry, time.Second)
+				a.Equal(v.forwarded, elem.MessageWithID.(*queue.Publish).MessageExpiry)
+			})
+			msg := &gmqtt.Message{Topic: "/abc", QoS: 1, MessageExpiry: v.messageExpiry}
+			a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+		})
+	}
+}
+
+func TestServer_deliverMessage_sharedSubscriptionRoundRobin(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	members := []string{"c1", "c2", "c3"}
+	ts := newTestDeliverMsg(ctrl, members[0])
+	srv := ts.srv
+	srv.config().MQTT.SharedSubscriptionStrategy = config.SharedSubscriptionRoundRobin
+	received := make(map[string]int)
+	for _, v := range members {
+		mockQueue := queue.NewMockStore(ctrl)
+		clientID := v
+		mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+			received[clientID]++
+		}).AnyTimes()
+		srv.queueStore[v] = mockQueue
+		_, err := srv.subscriptionsDB.Subscribe(v, &gmqtt.Subscription{
+			ShareName:   "g",
+			TopicFilter: "/abc",
+			QoS:         1,
+		})
+		a.Nil(err)
+	}
+	msg := &gmqtt.Message{
+		Topic: "/abc",
+		QoS:   1,
+	}
+	for i := 0; i < 30; i++ {
+		a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+	}
+	a.Equal(map[string]int{"c1": 10, "c2": 10, "c3": 10}, received)
+
+	// the session of c2 has gone away.
+	delete(srv.queueStore, "c2")
+	received = make(map[string]int)
+	for i := 0; i < 30; i++ {
+		a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+	}
+	a.Equal(map[string]int{"c1": 15, "c3": 15}, received)
+
+	// c3 leaves the group.
+	a.Nil(srv.subscriptionsDB.Unsubscribe("c3", "$share/g//abc"))
+	received = make(map[string]int)
+	for i := 0; i < 10; i++ {
+		a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+	}
+	a.Equal(map[string]int{"c1": 10}, received)
+}
+
+func TestServer_removeSharedCursor(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	srv.sessionStore = session_mem.New()
+	srv.config().MQTT.SharedSubscriptionStrategy = config.SharedSubscriptionRoundRobin
+	for _, v := range []string{"c1", "c2"} {
+		mockQueue := queue.NewMockStore(ctrl)
+		mockQueue.EXPECT().Add(gomock.Any()).AnyTimes()
+		srv.queueStore[v] = mockQueue
+		_, err := srv.subscriptionsDB.Subscribe(v, &gmqtt.Subscription{ShareName: "g", TopicFilter: "/abc", QoS: 1})
+		a.Nil(err)
+	}
+	_, err := srv.subscriptionsDB.Subscribe("c1", &gmqtt.Subscription{ShareName: "h", TopicFilter: "/abc", QoS: 1})
+	a.Nil(err)
+	msg := &gmqtt.Message{Topic: "/abc", QoS: 1}
+	srv.mu.Lock()
+	a.True(srv.deliverMessage("srcCli", msg, defaultIterateOptions(msg.Topic)))
+	srv.mu.Unlock()
+	a.Equal(map[string]string{"$share/g//abc": "c1", "$share/h//abc": "c1"}, srv.sharedCursors)
+
+	// c1 is the last member of h.
+	cs := &clientService{srv: srv}
+	a.Nil(cs.Unsubscribe("c1", "$share/h//abc"))
+	a.Equal(map[string]string{"$share/g//abc": "c1"}, srv.sharedCursors)
+
+	// c2 is still a member of g.
+	delete(srv.queueStore, "c1")
+	srv.mu.Lock()
+	a.Nil(srv.removeSessionLocked("c1"))
+	srv.mu.Unlock()
+	a.Equal(map[string]string{"$share/g//abc": "c1"}, srv.sharedCursors)
+
+	delete(srv.queueStore, "c2")
+	srv.mu.Lock()
+	a.Nil(srv.removeSessionLocked("c2"))
+	srv.mu.Unlock()
+	a.Empty(srv.sharedCursors)
+}
+
 func TestServer_deliverMessage_sharedSubscription(t *testing.T) {
 	a := assert.New(t)
 	ctrl := gomock.NewController(t)
@@ -124,7 +480,7 @@ func TestServer_deliverMessage_sharedSubscription(t *testing.T) {
 		packets.Qos1: 0,
 		packets.Qos2: 0,
 	}
-	srv.config.MQTT.DeliveryMode = OnlyOnce
+	srv.config().MQTT.DeliveryMode = OnlyOnce
 	mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
 		_, ok := qos[elem.MessageWithID.(*queue.Publish).QoS]
 		a.True(ok)
@@ -137,7 +493,7 @@ func TestServer_deliverMessage_sharedSubscription(t *testing.T) {
 	a.Equal(2, qos[packets.Qos2])
 
 	// test overlap
-	srv.config.MQTT.DeliveryMode = Overlap
+	srv.config().MQTT.DeliveryMode = Overlap
 	qos = map[byte]int{
 		packets.Qos1: 0,
 		packets.Qos2: 0,
@@ -152,3 +508,453 @@ func TestServer_deliverMessage_sharedSubscription(t *testing.T) {
 	a.Equal(2, qos[packets.Qos2])
 
 }
+
+// prefixStore is an example custom subscription store which only accepts the topic filters with the given prefix.
+type prefixStore struct {
+	subscription.Store
+	prefix string
+}
+
+func (p *prefixStore) Subscribe(clientID string, subscriptions ...*gmqtt.Subscription) (subscription.SubscribeResult, error) {
+	for _, v := range subscriptions {
+		if !strings.HasPrefix(v.TopicFilter, p.prefix) {
+			return nil, errors.New("topic filter not allowed")
+		}
+	}
+	return p.Store.Subscribe(clientID, subscriptions...)
+}
+
+func TestServer_sendWillLocked_auth(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	subscriber := "subCli"
+	ts := newTestDeliverMsg(ctrl, subscriber)
+	srv := ts.srv
+	srv.subscriptionsDB.Subscribe(subscriber, &gmqtt.Subscription{
+		TopicFilter: "#",
+		QoS:         1,
+	})
+	var arrivedClient Client
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		arrivedClient = client
+		if req.Message.Topic == "denied" {
+			return codes.NewError(codes.NotAuthorized)
+		}
+		if req.Message.Topic == "dropped" {
+			req.Drop()
+		}
+		return nil
+	}
+	var published []string
+	srv.hooks.OnWillPublished = func(ctx context.Context, clientID string, msg *gmqtt.Message) {
+		published = append(published, msg.Topic)
+	}
+	var pending []bool
+	srv.hooks.OnWillPublish = func(ctx context.Context, clientID string, req *WillMsgRequest) {
+		pending = append(pending, IsWillAuthPending(ctx))
+	}
+	srv.hooks.OnAuthorize = func(ctx context.Context, client Client, req *AuthorizeRequest) bool {
+		a.Equal(AccessPublish, req.Action)
+		return req.Topic != "unauthorized"
+	}
+	willClient := &detachedClient{
+		opts:    &ClientOptions{ClientID: "willCli", Username: "user"},
+		version: packets.Version5,
+	}
+	mockQueue := srv.queueStore[subscriber].(*queue.MockStore)
+
+	// the hook is bypassed if the option is disabled.
+	mockQueue.EXPECT().Add(gomock.Any())
+	srv.sendWillLocked(&gmqtt.Message{Topic: "denied", QoS: 1}, willClient)
+	a.Nil(arrivedClient)
+	a.Equal([]string{"denied"}, published)
+	a.Equal([]bool{false}, pending)
+
+	srv.config().MQTT.WillMessageAuth = true
+	published = nil
+	srv.sendWillLocked(&gmqtt.Message{Topic: "denied", QoS: 1}, willClient)
+	a.Equal(willClient, arrivedClient)
+	srv.sendWillLocked(&gmqtt.Message{Topic: "dropped", QoS: 1}, willClient)
+	a.Empty(published)
+	// the will message denied by OnAuthorize is not passed to OnMsgArrived.
+	arrivedClient = nil
+	srv.sendWillLocked(&gmqtt.Message{Topic: "unauthorized", QoS: 1}, willClient)
+	a.Nil(arrivedClient)
+	a.Empty(published)
+
+	mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+		a.Equal("allowed", elem.MessageWithID.(*queue.Publish).Topic)
+	})
+	srv.sendWillLocked(&gmqtt.Message{Topic: "allowed", QoS: 1}, willClient)
+	a.Equal([]string{"allowed"}, published)
+	// the forwarding hooks are told to wait for the authorization.
+	a.Equal([]bool{false, true, true, true, true}, pending)
+}
+
+func TestServer_init_withSubscriptionStore(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pe := NewMockPersistence(ctrl)
+	ss := session.NewMockStore(ctrl)
+	pe.EXPECT().Open().Return(nil)
+	pe.EXPECT().NewSessionStore(gomock.Any()).Return(ss, nil)
+	// the custom subscription store is used instead of the persistence one.
+	pe.EXPECT().NewSubscriptionStore(gomock.Any()).Times(0)
+	ss.EXPECT().Iterate(gomock.Any()).Return(nil)
+
+	persistenceFactories["test_custom_subscription"] = func(config config.Config) (Persistence, error) {
+		return pe, nil
+	}
+	defer delete(persistenceFactories, "test_custom_subscription")
+
+	cfg := config.DefaultConfig()
+	cfg.API = config.API{}
+	cfg.Persistence.Type = "test_custom_subscription"
+	cfg.TopicAliasManager.Type = "test_custom_subscription"
+	topicAliasMgrFactory["test_custom_subscription"] = func(config config.Config, maxAlias uint16, clientID string) TopicAliasManager {
+		return nil
+	}
+	defer delete(topicAliasMgrFactory, "test_custom_subscription")
+
+	srv := New(WithConfig(cfg), WithSubscriptionStore(func(config config.Config) (subscription.Store, error) {
+		return &prefixStore{Store: mem.NewStore(), prefix: "allowed/"}, nil
+	}))
+	a.Nil(srv.init())
+	a.IsType(&prefixStore{}, srv.subscriptionsDB)
+
+	_, err := srv.subscriptionsDB.Subscribe("cid", &gmqtt.Subscription{TopicFilter: "allowed/a"})
+	a.Nil(err)
+	_, err = srv.subscriptionsDB.Subscribe("cid", &gmqtt.Subscription{TopicFilter: "denied/a"})
+	a.NotNil(err)
+}
+
+func TestClientService_TerminateSessionWithDisconnect(t *testing.T) {
+	a := assert.New(t)
+	dis := &packets.Disconnect{
+		Version:    packets.Version5,
+		Code:       codes.AdminAction,
+		Properties: &packets.Properties{},
+	}
+	for _, version := range []packets.Version{packets.Version311, packets.Version5} {
+		srv := defaultServer()
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.opts.ClientID = "cli"
+		c.version = version
+		srv.clients["cli"] = c
+		cs := &clientService{srv: srv}
+		cs.TerminateSessionWithDisconnect("cli", dis)
+		a.EqualValues(1, atomic.LoadInt32(&c.forceRemoveSession))
+		select {
+		case p := <-c.out:
+			a.Equal(packets.Version5, version)
+			a.Equal(dis, p)
+		default:
+			// the v3 client is closed without DISCONNECT packet.
+			a.Equal(packets.Version311, version)
+		}
+	}
+}
+
+func TestServer_unregisterClient_will(t *testing.T) {
+	for _, v := range []struct {
+		name       string
+		version    packets.Version
+		disconnect *packets.Disconnect
+		sent       bool
+	}{
+		{name: "close without disconnect", version: packets.Version5, sent: true},
+		{name: "v3 disconnect", version: packets.Version311, disconnect: &packets.Disconnect{Version: packets.Version311}},
+		{name: "normal disconnect", version: packets.Version5, disconnect: &packets.Disconnect{
+			Version:    packets.Version5,
+			Code:       codes.NormalDisconnection,
+			Properties: &packets.Properties{},
+		}},
+		{name: "disconnect with will message", version: packets.Version5, sent: true, disconnect: &packets.Disconnect{
+			Version:    packets.Version5,
+			Code:       codes.DisconnectWithWillMessage,
+			Properties: &packets.Properties{},
+		}},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.subscriptionsDB = mem.NewStore()
+			srv.sessionStore = session_mem.New()
+			srv.statsManager = newStatsManager(srv.subscriptionsDB)
+			var published []string
+			srv.hooks.OnWillPublished = func(ctx context.Context, clientID string, msg *gmqtt.Message) {
+				published = append(published, msg.Topic)
+			}
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cli"
+			c.version = v.version
+			a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+				ClientID: "cli",
+				Will:     &gmqtt.Message{Topic: "will"},
+			}))
+			srv.clients["cli"] = c
+			if v.disconnect != nil {
+				a.Nil(c.disconnectHandler(v.disconnect))
+			}
+			srv.unregisterClient(c)
+			if v.sent {
+				a.Equal([]string{"will"}, published)
+			} else {
+				a.Empty(published)
+			}
+		})
+	}
+}
+
+func TestServer_unregisterClient_onWillDelay(t *testing.T) {
+	for _, v := range []struct {
+		name       string
+		disconnect *packets.Disconnect
+		err        error
+		reason     byte
+		// delay is the delay of the will message, -1 means the will message is discarded.
+		delay time.Duration
+	}{
+		{name: "normal disconnect", reason: codes.NormalDisconnection, delay: -1, disconnect: &packets.Disconnect{
+			Version:    packets.Version5,
+			Code:       codes.NormalDisconnection,
+			Properties: &packets.Properties{},
+		}},
+		{name: "suppressed", reason: codes.DisconnectWithWillMessage, delay: -1, disconnect: &packets.Disconnect{
+			Version:    packets.Version5,
+			Code:       codes.DisconnectWithWillMessage,
+			Properties: &packets.Properties{},
+		}},
+		{name: "abnormal", reason: codes.UnspecifiedError, delay: 0},
+		{name: "fallback", reason: codes.KeepAliveTimeout, err: codes.NewError(codes.KeepAliveTimeout), delay: 10 * time.Second},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			clk := newTestClock()
+			srv := defaultServer()
+			srv.clock = clk
+			srv.subscriptionsDB = mem.NewStore()
+			srv.sessionStore = session_mem.New()
+			srv.statsManager = newStatsManager(srv.subscriptionsDB)
+			var reasons []byte
+			srv.hooks.OnWillDelay = func(next OnWillDelay) OnWillDelay {
+				return func(ctx context.Context, clientID string, disconnectReason byte, will *gmqtt.Message) (time.Duration, bool) {
+					a.Equal("cli", clientID)
+					reasons = append(reasons, disconnectReason)
+					switch disconnectReason {
+					case codes.NormalDisconnection, codes.DisconnectWithWillMessage:
+						return 0, false
+					case codes.UnspecifiedError:
+						will.Retained = true
+						return 0, true
+					}
+					return next(ctx, clientID, disconnectReason, will)
+				}
+			}(specWillDelay)
+			var delayed []time.Duration
+			srv.hooks.OnWillDelayed = func(ctx context.Context, clientID string, msg *gmqtt.Message, delay time.Duration) {
+				delayed = append(delayed, delay)
+			}
+			var published []*gmqtt.Message
+			srv.hooks.OnWillPublished = func(ctx context.Context, clientID string, msg *gmqtt.Message) {
+				published = append(published, msg)
+			}
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cli"
+			c.version = packets.Version5
+			a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+				ClientID:          "cli",
+				Will:              &gmqtt.Message{Topic: "will"},
+				WillDelayInterval: 20,
+				ExpiryInterval:    10,
+			}))
+			srv.clients["cli"] = c
+			if v.disconnect != nil {
+				a.Nil(c.disconnectHandler(v.disconnect))
+			}
+			c.err = v.err
+			srv.unregisterClient(c)
+			a.Equal([]byte{v.reason}, reasons)
+			switch {
+			case v.delay < 0:
+				a.Empty(delayed)
+				a.Empty(published)
+			case v.delay == 0:
+				a.Empty(delayed)
+				a.Equal(0, clk.Timers())
+				if a.Len(published, 1) {
+					a.True(published[0].Retained)
+				}
+			default:
+				// the will delay interval is capped by the session expiry interval.
+				a.Equal([]time.Duration{v.delay}, delayed)
+				a.Empty(published)
+				a.Equal(1, clk.Timers())
+			}
+		})
+	}
+}
+
+func TestServer_unregisterClient_willDelayed(t *testing.T) {
+	for _, resume := range []bool{false, true} {
+		a := assert.New(t)
+		clk := newTestClock()
+		srv := defaultServer()
+		srv.clock = clk
+		srv.subscriptionsDB = mem.NewStore()
+		srv.sessionStore = session_mem.New()
+		srv.statsManager = newStatsManager(srv.subscriptionsDB)
+		var delays []time.Duration
+		var willPublish, published int32
+		srv.hooks.OnWillDelayed = func(ctx context.Context, clientID string, msg *gmqtt.Message, delay time.Duration) {
+			a.Equal("will", msg.Topic)
+			delays = append(delays, delay)
+		}
+		srv.hooks.OnWillPublish = func(ctx context.Context, clientID string, req *WillMsgRequest) {
+			atomic.AddInt32(&willPublish, 1)
+		}
+		srv.hooks.OnWillPublished = func(ctx context.Context, clientID string, msg *gmqtt.Message) {
+			atomic.AddInt32(&published, 1)
+		}
+		disconnect := func() {
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cli"
+			c.version = packets.Version5
+			a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+				ClientID:          "cli",
+				Will:              &gmqtt.Message{Topic: "will"},
+				WillDelayInterval: 1,
+				ExpiryInterval:    10,
+			}))
+			srv.clients["cli"] = c
+			srv.unregisterClient(c)
+		}
+		disconnect()
+		a.Equal([]time.Duration{time.Second}, delays)
+		// the publish hook is called at delivery time.
+		a.Zero(atomic.LoadInt32(&willPublish))
+		if !resume {
+			clk.Advance(time.Second - time.Millisecond)
+			a.Equal(1, clk.Timers())
+			a.Zero(atomic.LoadInt32(&published))
+			clk.Advance(time.Millisecond)
+			a.Eventually(func() bool {
+				return atomic.LoadInt32(&published) == 1
+			}, time.Second, time.Millisecond)
+			a.EqualValues(1, atomic.LoadInt32(&willPublish))
+			continue
+		}
+		// the session is resumed and then disconnected again before the first delay elapses.
+		srv.mu.Lock()
+		srv.willMessage["cli"].signal(false)
+		srv.mu.Unlock()
+		disconnect()
+		srv.mu.Lock()
+		w := srv.willMessage["cli"]
+		if a.NotNil(w) {
+			w.signal(false)
+		}
+		srv.mu.Unlock()
+		// both timers are stopped as the will messages are cancelled.
+		a.Eventually(func() bool {
+			return clk.Timers() == 0
+		}, time.Second, time.Millisecond)
+		clk.Advance(2 * time.Second)
+		a.Zero(atomic.LoadInt32(&willPublish))
+		a.Zero(atomic.LoadInt32(&published))
+	}
+}
+
+func TestServer_unregisterClient_willSessionExpiry(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		// change is called after the client disconnects.
+		change func(srv *server, cs *clientService) error
+		// fireAt is the elapsed time when the will message is published, -1 means it is not published.
+		fireAt time.Duration
+	}{
+		{name: "session expiry", fireAt: 30 * time.Second},
+		{name: "reconnect", fireAt: -1, change: func(srv *server, cs *clientService) error {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			srv.willMessage["cli"].signal(false)
+			return nil
+		}},
+		{name: "shorten expiry", fireAt: 10 * time.Second, change: func(srv *server, cs *clientService) error {
+			return cs.SetSessionExpiry("cli", 10)
+		}},
+		{name: "extend expiry", fireAt: 60 * time.Second, change: func(srv *server, cs *clientService) error {
+			return cs.SetSessionExpiry("cli", 3600)
+		}},
+		{name: "expire session", fireAt: 0, change: func(srv *server, cs *clientService) error {
+			return cs.ExpireSession("cli")
+		}},
+		{name: "taken over", fireAt: 0, change: func(srv *server, cs *clientService) error {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			return srv.sessionTerminatedLocked("cli", TakenOverTermination)
+		}},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			clk := newTestClock()
+			srv := defaultServer()
+			srv.clock = clk
+			srv.subscriptionsDB = mem.NewStore()
+			srv.sessionStore = session_mem.New()
+			srv.statsManager = newStatsManager(srv.subscriptionsDB)
+			var delays []time.Duration
+			var published int32
+			srv.hooks.OnWillDelayed = func(ctx context.Context, clientID string, msg *gmqtt.Message, delay time.Duration) {
+				delays = append(delays, delay)
+			}
+			srv.hooks.OnWillPublished = func(ctx context.Context, clientID string, msg *gmqtt.Message) {
+				atomic.AddInt32(&published, 1)
+			}
+			cs := &clientService{srv: srv}
+			c, err := srv.newClient(noopConn{})
+			a.Nil(err)
+			c.opts.ClientID = "cli"
+			c.version = packets.Version5
+			a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+				ClientID:          "cli",
+				Will:              &gmqtt.Message{Topic: "will"},
+				WillDelayInterval: 60,
+				ExpiryInterval:    30,
+			}))
+			srv.clients["cli"] = c
+			srv.unregisterClient(c)
+			// the session expires before the will delay interval elapses.
+			a.Equal([]time.Duration{30 * time.Second}, delays)
+
+			if v.change != nil {
+				a.Nil(v.change(srv, cs))
+			}
+			switch {
+			case v.fireAt < 0:
+				a.Eventually(func() bool {
+					return clk.Timers() == 0
+				}, time.Second, time.Millisecond)
+				clk.Advance(time.Hour)
+				srv.willWg.Wait()
+				a.Zero(atomic.LoadInt32(&published))
+			case v.fireAt == 0:
+				srv.willWg.Wait()
+				a.EqualValues(1, atomic.LoadInt32(&published))
+			default:
+				clk.Advance(v.fireAt - time.Millisecond)
+				a.Zero(atomic.LoadInt32(&published))
+				clk.Advance(time.Millisecond)
+				srv.willWg.Wait()
+				a.EqualValues(1, atomic.LoadInt32(&published))
+			}
+		})
+	}
+}
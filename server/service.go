@@ -1,17 +1,31 @@
 package server
 
 import (
+	"time"
+
 	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/ban"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/scheduled"
 	"github.com/DrmagicE/gmqtt/persistence/session"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
 	"github.com/DrmagicE/gmqtt/retained"
 )
 
 // Publisher provides the ability to Publish messages to the broker.
 type Publisher interface {
 	// Publish Publish a message to broker.
-	// Calling this method will not trigger OnMsgArrived hook.
+	// Calling this method will not trigger OnMsgArrived hook unless config.MQTT.SystemClientID is set,
+	// in which case the hook is called on behalf of the system client.
 	Publish(message *gmqtt.Message)
+	// PublishRetained publishes a message to broker in the same way as Publish,
+	// and stores the retained message in the same way as the retained message published by a client:
+	// the message is checked against the topic policy before the OnMsgArrived hook,
+	// and the message returned by the hook is stored or removed subject to the retained limits.
+	// It returns the error if the message is rejected by the topic policy or the hook,
+	// or if the retained message is not stored due to the limits and config.MQTT.RetainedLimitNack is set.
+	PublishRetained(message *gmqtt.Message) error
 }
 
 // ClientIterateFn is the callback function used by ClientService.IterateClient
@@ -25,6 +39,69 @@ type ClientService interface {
 	GetClient(clientID string) Client
 	IterateClient(fn ClientIterateFn)
 	TerminateSession(clientID string)
+	// TerminateSessionWithDisconnect is the same as TerminateSession,
+	// except that the DISCONNECT packet is sent to the connected v5 client before closing the connection.
+	TerminateSessionWithDisconnect(clientID string, disconnect *packets.Disconnect)
+	// MigrateQueue moves the queued messages of the disconnected session fromClientID to the session toClientID,
+	// e.g: when replacing a device.
+	// It returns the number of messages added to the destination queue, see MigrateQueueOptions for details.
+	MigrateQueue(fromClientID, toClientID string, opts MigrateQueueOptions) (migrated int, err error)
+	// TransferSession moves the subscriptions and the queued messages of the session fromClientID to the session toClientID,
+	// e.g: when a device is re-provisioned with a new client id. The target session is created if it does not exist.
+	// The subscriptions are moved before the queued messages, and the source session is removed once both are moved.
+	// If any step fails, the previous steps are rolled back and the source session is left as it was.
+	// The queued messages, including the inflight ones, are appended to the target queue in order,
+	// the inflight ones are delivered as new messages because the packet ids only make sense in the source session.
+	// The inflight PUBREL packets are dropped and counted in TransferSessionResult.Dropped,
+	// the QoS 2 packet ids awaiting PUBREL from the source client are discarded, the messages have been routed on receipt.
+	// It returns ErrClientConnected if either client is connected, ErrSessionNotFound if the source session does not exist,
+	// and ErrMigrateNotSupported if the queue store does not implement queue.Drainer.
+	TransferSession(fromClientID, toClientID string) (TransferSessionResult, error)
+	// IterateQueue walks through the queued messages of the session in delivery order without removing them,
+	// see queue.Iterator for details.
+	// It returns ErrSessionNotFound if the session does not exist,
+	// and ErrIterateNotSupported if the queue store does not implement queue.Iterator.
+	IterateQueue(clientID string, fn func(elem *queue.Elem) (bool, error)) error
+	// VerifyQueue checks the delivery order of the queued messages of the session, see queue.Verifier for details.
+	// It returns ErrSessionNotFound if the session does not exist,
+	// and ErrVerifyNotSupported if the queue store does not implement queue.Verifier.
+	VerifyQueue(clientID string) ([]queue.Anomaly, error)
+	// Unsubscribe removes the subscription of the client on behalf of the client, e.g: to revoke the access after an ACL change.
+	// The topicName is the topic filter, with the "$share/{ShareName}/" prefix for shared subscriptions.
+	// The OnUnsubscribed hook is called in the same way as an UNSUBSCRIBE packet,
+	// however, the client is not notified, because MQTT does not define a server-initiated unsubscribe.
+	// It returns ErrSubscriptionNotFound if the client has not subscribed the topic filter.
+	Unsubscribe(clientID string, topicName string) error
+	// ExpireSession expires the session of the disconnected client immediately, without waiting for the Session Expiry Interval.
+	// The session is cleaned up in the same way as it expires, and OnSessionTerminated is called with ExpiredTermination.
+	// The delayed will message, if any, is published as the session ends.
+	// It returns ErrClientConnected if the client is connected, use TerminateSession instead,
+	// and ErrSessionNotFound if the session does not exist.
+	ExpireSession(clientID string) error
+	// SetSessionExpiry sets the Session Expiry Interval of the session in seconds.
+	// For the disconnected client, the session expires at the disconnect time plus the new interval,
+	// it expires immediately if the time has passed, e.g: the interval is 0.
+	// The delayed will message is rescheduled to the earlier of the will delay and the new session expiry.
+	// For the connected client, the new interval is applied when the client disconnects,
+	// unless the client sets the Session Expiry Interval in the DISCONNECT packet.
+	// It returns ErrSessionNotFound if the session does not exist.
+	SetSessionExpiry(clientID string, expiry uint32) error
+	// InvalidateACL removes the cached OnAuthorize decisions of the client, see config.ACLCache.
+	// Empty clientID means all connected clients.
+	InvalidateACL(clientID string)
+	// Ban adds the client id or the source IP into the ban list until b.ExpiresAt, see config.BanList.
+	// The CONNECT of the banned client id or from the banned IP is refused with "Not authorized",
+	// the connected client is not disconnected by the ban.
+	// It returns ErrInvalidBan if the type is unknown or the IP is invalid.
+	Ban(b *ban.Ban) error
+	// ListBans returns the unexpired bans sorted by the type and the value.
+	ListBans() []*ban.Ban
+	// ClearBans removes the ban of the type and the value, empty typ removes all bans.
+	// It returns the number of the removed bans.
+	ClearBans(typ ban.Type, value string) (cleared int)
+	// RecentConnectRejections returns the recently rejected CONNECTs, the most recent one first.
+	// At most config.MQTT.ConnectRejectionBufferSize rejections are kept, the older ones are dropped.
+	RecentConnectRejections() []ConnectRejection
 }
 
 // SubscriptionService providers the ability to query and add/delete subscriptions.
@@ -52,3 +129,17 @@ type SubscriptionService interface {
 type RetainedService interface {
 	retained.Store
 }
+
+// ScheduleService provides the ability to publish messages at a scheduled time.
+// The pending messages are persisted if the Persistence implements SchedulablePersistence,
+// the messages which are due during the downtime are published right after the broker restarts.
+type ScheduleService interface {
+	// Schedule parks the message until deliverAt and returns the id of the scheduled message.
+	// The message is published as soon as possible if deliverAt is not in the future.
+	// The retained message is stored when it is published, in the same way as it is published by a client.
+	Schedule(message *gmqtt.Message, deliverAt time.Time) (id string, err error)
+	// Cancel cancels the pending scheduled message.
+	Cancel(id string) error
+	// List returns the pending scheduled messages in the order of the delivery time.
+	List() []*scheduled.Message
+}
@@ -6,11 +6,16 @@ package server
 
 import (
 	gmqtt "github.com/DrmagicE/gmqtt"
+	ban "github.com/DrmagicE/gmqtt/persistence/ban"
+	queue "github.com/DrmagicE/gmqtt/persistence/queue"
+	scheduled "github.com/DrmagicE/gmqtt/persistence/scheduled"
 	session "github.com/DrmagicE/gmqtt/persistence/session"
 	subscription "github.com/DrmagicE/gmqtt/persistence/subscription"
+	packets "github.com/DrmagicE/gmqtt/pkg/packets"
 	retained "github.com/DrmagicE/gmqtt/retained"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
+	time "time"
 )
 
 // MockPublisher is a mock of Publisher interface
@@ -48,6 +53,20 @@ func (mr *MockPublisherMockRecorder) Publish(message interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*MockPublisher)(nil).Publish), message)
 }
 
+// PublishRetained mocks base method
+func (m *MockPublisher) PublishRetained(message *gmqtt.Message) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishRetained", message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PublishRetained indicates an expected call of PublishRetained
+func (mr *MockPublisherMockRecorder) PublishRetained(message interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishRetained", reflect.TypeOf((*MockPublisher)(nil).PublishRetained), message)
+}
+
 // MockClientService is a mock of ClientService interface
 type MockClientService struct {
 	ctrl     *gomock.Controller
@@ -138,6 +157,187 @@ func (mr *MockClientServiceMockRecorder) TerminateSession(clientID interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TerminateSession", reflect.TypeOf((*MockClientService)(nil).TerminateSession), clientID)
 }
 
+// TerminateSessionWithDisconnect mocks base method
+func (m *MockClientService) TerminateSessionWithDisconnect(clientID string, disconnect *packets.Disconnect) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "TerminateSessionWithDisconnect", clientID, disconnect)
+}
+
+// TerminateSessionWithDisconnect indicates an expected call of TerminateSessionWithDisconnect
+func (mr *MockClientServiceMockRecorder) TerminateSessionWithDisconnect(clientID, disconnect interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TerminateSessionWithDisconnect", reflect.TypeOf((*MockClientService)(nil).TerminateSessionWithDisconnect), clientID, disconnect)
+}
+
+// MigrateQueue mocks base method
+func (m *MockClientService) MigrateQueue(fromClientID, toClientID string, opts MigrateQueueOptions) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MigrateQueue", fromClientID, toClientID, opts)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MigrateQueue indicates an expected call of MigrateQueue
+func (mr *MockClientServiceMockRecorder) MigrateQueue(fromClientID, toClientID, opts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MigrateQueue", reflect.TypeOf((*MockClientService)(nil).MigrateQueue), fromClientID, toClientID, opts)
+}
+
+// TransferSession mocks base method
+func (m *MockClientService) TransferSession(fromClientID, toClientID string) (TransferSessionResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransferSession", fromClientID, toClientID)
+	ret0, _ := ret[0].(TransferSessionResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TransferSession indicates an expected call of TransferSession
+func (mr *MockClientServiceMockRecorder) TransferSession(fromClientID, toClientID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferSession", reflect.TypeOf((*MockClientService)(nil).TransferSession), fromClientID, toClientID)
+}
+
+// IterateQueue mocks base method
+func (m *MockClientService) IterateQueue(clientID string, fn func(*queue.Elem) (bool, error)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IterateQueue", clientID, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// IterateQueue indicates an expected call of IterateQueue
+func (mr *MockClientServiceMockRecorder) IterateQueue(clientID, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IterateQueue", reflect.TypeOf((*MockClientService)(nil).IterateQueue), clientID, fn)
+}
+
+// VerifyQueue mocks base method
+func (m *MockClientService) VerifyQueue(clientID string) ([]queue.Anomaly, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "VerifyQueue", clientID)
+	ret0, _ := ret[0].([]queue.Anomaly)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// VerifyQueue indicates an expected call of VerifyQueue
+func (mr *MockClientServiceMockRecorder) VerifyQueue(clientID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyQueue", reflect.TypeOf((*MockClientService)(nil).VerifyQueue), clientID)
+}
+
+// Unsubscribe mocks base method
+func (m *MockClientService) Unsubscribe(clientID, topicName string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unsubscribe", clientID, topicName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unsubscribe indicates an expected call of Unsubscribe
+func (mr *MockClientServiceMockRecorder) Unsubscribe(clientID, topicName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unsubscribe", reflect.TypeOf((*MockClientService)(nil).Unsubscribe), clientID, topicName)
+}
+
+// ExpireSession mocks base method
+func (m *MockClientService) ExpireSession(clientID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireSession", clientID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExpireSession indicates an expected call of ExpireSession
+func (mr *MockClientServiceMockRecorder) ExpireSession(clientID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireSession", reflect.TypeOf((*MockClientService)(nil).ExpireSession), clientID)
+}
+
+// SetSessionExpiry mocks base method
+func (m *MockClientService) SetSessionExpiry(clientID string, expiry uint32) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetSessionExpiry", clientID, expiry)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetSessionExpiry indicates an expected call of SetSessionExpiry
+func (mr *MockClientServiceMockRecorder) SetSessionExpiry(clientID, expiry interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSessionExpiry", reflect.TypeOf((*MockClientService)(nil).SetSessionExpiry), clientID, expiry)
+}
+
+// InvalidateACL mocks base method
+func (m *MockClientService) InvalidateACL(clientID string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "InvalidateACL", clientID)
+}
+
+// InvalidateACL indicates an expected call of InvalidateACL
+func (mr *MockClientServiceMockRecorder) InvalidateACL(clientID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InvalidateACL", reflect.TypeOf((*MockClientService)(nil).InvalidateACL), clientID)
+}
+
+// Ban mocks base method
+func (m *MockClientService) Ban(b *ban.Ban) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Ban", b)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Ban indicates an expected call of Ban
+func (mr *MockClientServiceMockRecorder) Ban(b interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ban", reflect.TypeOf((*MockClientService)(nil).Ban), b)
+}
+
+// ListBans mocks base method
+func (m *MockClientService) ListBans() []*ban.Ban {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListBans")
+	ret0, _ := ret[0].([]*ban.Ban)
+	return ret0
+}
+
+// ListBans indicates an expected call of ListBans
+func (mr *MockClientServiceMockRecorder) ListBans() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListBans", reflect.TypeOf((*MockClientService)(nil).ListBans))
+}
+
+// ClearBans mocks base method
+func (m *MockClientService) ClearBans(typ ban.Type, value string) int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClearBans", typ, value)
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// ClearBans indicates an expected call of ClearBans
+func (mr *MockClientServiceMockRecorder) ClearBans(typ, value interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearBans", reflect.TypeOf((*MockClientService)(nil).ClearBans), typ, value)
+}
+
+// RecentConnectRejections mocks base method
+func (m *MockClientService) RecentConnectRejections() []ConnectRejection {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecentConnectRejections")
+	ret0, _ := ret[0].([]ConnectRejection)
+	return ret0
+}
+
+// RecentConnectRejections indicates an expected call of RecentConnectRejections
+func (mr *MockClientServiceMockRecorder) RecentConnectRejections() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecentConnectRejections", reflect.TypeOf((*MockClientService)(nil).RecentConnectRejections))
+}
+
 // MockSubscriptionService is a mock of SubscriptionService interface
 type MockSubscriptionService struct {
 	ctrl     *gomock.Controller
@@ -353,3 +553,69 @@ func (mr *MockRetainedServiceMockRecorder) Iterate(fn interface{}) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Iterate", reflect.TypeOf((*MockRetainedService)(nil).Iterate), fn)
 }
+
+// MockScheduleService is a mock of ScheduleService interface
+type MockScheduleService struct {
+	ctrl     *gomock.Controller
+	recorder *MockScheduleServiceMockRecorder
+}
+
+// MockScheduleServiceMockRecorder is the mock recorder for MockScheduleService
+type MockScheduleServiceMockRecorder struct {
+	mock *MockScheduleService
+}
+
+// NewMockScheduleService creates a new mock instance
+func NewMockScheduleService(ctrl *gomock.Controller) *MockScheduleService {
+	mock := &MockScheduleService{ctrl: ctrl}
+	mock.recorder = &MockScheduleServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockScheduleService) EXPECT() *MockScheduleServiceMockRecorder {
+	return m.recorder
+}
+
+// Schedule mocks base method
+func (m *MockScheduleService) Schedule(message *gmqtt.Message, deliverAt time.Time) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Schedule", message, deliverAt)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Schedule indicates an expected call of Schedule
+func (mr *MockScheduleServiceMockRecorder) Schedule(message, deliverAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Schedule", reflect.TypeOf((*MockScheduleService)(nil).Schedule), message, deliverAt)
+}
+
+// Cancel mocks base method
+func (m *MockScheduleService) Cancel(id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Cancel", id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Cancel indicates an expected call of Cancel
+func (mr *MockScheduleServiceMockRecorder) Cancel(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Cancel", reflect.TypeOf((*MockScheduleService)(nil).Cancel), id)
+}
+
+// List mocks base method
+func (m *MockScheduleService) List() []*scheduled.Message {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List")
+	ret0, _ := ret[0].([]*scheduled.Message)
+	return ret0
+}
+
+// List indicates an expected call of List
+func (mr *MockScheduleServiceMockRecorder) List() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockScheduleService)(nil).List))
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+const (
+	// DefaultPage is the page used by SessionIterator if the page is 0.
+	DefaultPage = 1
+	// DefaultPageSize is the page size used by SessionIterator if the page size is 0.
+	DefaultPageSize = 20
+)
+
+var (
+	// ErrInvalidSortBy will be returned by SessionIterator.ListSessions if the sort key is unknown.
+	ErrInvalidSortBy = errors.New("unknown sort key")
+	// ErrInvalidAfter will be returned by SessionIterator.ListSessions if ListSessionsOptions.After is set
+	// with an order other than the ascending client id.
+	ErrInvalidAfter = errors.New("after can only be used with the ascending client id order")
+)
+
+// SessionIterator provides the ability to list the sessions and the subscriptions page by page,
+// the client list of the admin plugin is served by it.
+// The results are snapshots, the changes after the call are not reflected.
+type SessionIterator interface {
+	// ListSessions returns the sessions which match the options in the given page, and the total number of the matched sessions.
+	ListSessions(opts ListSessionsOptions) (rs []*SessionInfo, total int, err error)
+	// ListSubscriptions returns the subscriptions which match the options in the given page,
+	// and the total number of the matched subscriptions.
+	ListSubscriptions(opts ListSubscriptionsOptions) (rs []*SubscriptionInfo, total int, err error)
+}
+
+// SessionInfo is the information of a session returned by SessionIterator.
+type SessionInfo struct {
+	ClientID string
+	// Connected indicates whether the client is connected.
+	// The following connection fields are only available for the connected clients.
+	Connected  bool
+	Username   string
+	ConnID     string
+	Version    packets.Version
+	KeepAlive  uint16
+	RemoteAddr string
+	LocalAddr  string
+	// ConnectedAt is the time when the client connected, or the time when the session was created for the disconnected clients.
+	ConnectedAt   time.Time
+	SessionExpiry uint32
+	// ExpiresAt is the time when the session of the disconnected client expires, zero for the connected clients.
+	ExpiresAt   time.Time
+	MaxInflight uint16
+	MaxQueue    int
+	// Stats is the statistics of the client, it is zero if the statistics are not available.
+	Stats ClientStats
+}
+
+// lastActiveAt returns the time when the last packet was received, or the connected time if no packet has been received.
+func (s *SessionInfo) lastActiveAt() time.Time {
+	if !s.Stats.LastPacketReceivedAt.IsZero() {
+		return s.Stats.LastPacketReceivedAt
+	}
+	return s.ConnectedAt
+}
+
+// SessionSortBy is the sort key of ListSessions.
+type SessionSortBy byte
+
+const (
+	// SessionSortByClientID sorts the sessions by the client id, it is the default order.
+	SessionSortByClientID SessionSortBy = iota
+	SessionSortByConnectedAt
+	SessionSortBySubscriptionsCurrent
+	SessionSortByQueueLen
+	SessionSortByMessageDropped
+)
+
+// SessionFilter is the predicate of ListSessions, the zero value matches all sessions.
+type SessionFilter struct {
+	// Username matches the username of the connected clients.
+	// The disconnected clients never match a non-empty Username, because the username is not stored in the session.
+	Username string
+	// UsernamePrefix indicates whether Username is matched as a prefix.
+	UsernamePrefix   bool
+	ConnectedOnly    bool
+	DisconnectedOnly bool
+	// ConnectedBefore matches the sessions which connected before the time, the zero value matches all sessions.
+	ConnectedBefore time.Time
+	// IdleBefore matches the connected clients which have not sent any packet since the time, the zero value matches all sessions.
+	IdleBefore time.Time
+}
+
+func (f SessionFilter) match(s *SessionInfo) bool {
+	if f.Username != "" {
+		if f.UsernamePrefix && !strings.HasPrefix(s.Username, f.Username) {
+			return false
+		}
+		if !f.UsernamePrefix && s.Username != f.Username {
+			return false
+		}
+	}
+	if f.ConnectedOnly && !s.Connected {
+		return false
+	}
+	if f.DisconnectedOnly && s.Connected {
+		return false
+	}
+	if !f.ConnectedBefore.IsZero() && !s.ConnectedAt.Before(f.ConnectedBefore) {
+		return false
+	}
+	if !f.IdleBefore.IsZero() && (!s.Connected || !s.lastActiveAt().Before(f.IdleBefore)) {
+		return false
+	}
+	return true
+}
+
+// ListSessionsOptions is the options of ListSessions.
+type ListSessionsOptions struct {
+	// Page starts from 1, DefaultPage is used if it is 0.
+	Page uint
+	// PageSize is the number of the sessions in a page, DefaultPageSize is used if it is 0.
+	PageSize uint
+	Filter   SessionFilter
+	SortBy   SessionSortBy
+	// Descending reverses the order of SortBy.
+	Descending bool
+	// After lists the sessions whose client id is greater than After, it is the client id of the last session in the previous page.
+	// Unlike Page, the pages located by After do not shift when the sessions are added or removed between the calls.
+	// It can only be used with SessionSortByClientID in ascending order, the Page is counted from the first session after it.
+	After string
+	// Fill is called with each session before the filter is applied, nil means no-op.
+	// It can fill the fields which the broker does not keep for the disconnected sessions, e.g: the username of the last connection.
+	Fill func(s *SessionInfo)
+}
+
+// SubscriptionInfo is the subscription returned by SessionIterator.
+type SubscriptionInfo struct {
+	ClientID     string
+	Subscription *gmqtt.Subscription
+}
+
+// ListSubscriptionsOptions is the options of ListSubscriptions.
+// The subscriptions are sorted by the client id and then the full topic name.
+type ListSubscriptionsOptions struct {
+	// Page starts from 1, DefaultPage is used if it is 0.
+	Page uint
+	// PageSize is the number of the subscriptions in a page, DefaultPageSize is used if it is 0.
+	PageSize uint
+	// ClientID matches the subscriptions of the client, empty means all clients.
+	ClientID string
+	// MatchTopic matches the subscriptions whose topic filter matches the topic name, empty means all subscriptions.
+	MatchTopic string
+}
+
+// pageRange returns the range of the page in a slice of length n.
+func pageRange(page, pageSize uint, n int) (start, end int) {
+	if page == 0 {
+		page = DefaultPage
+	}
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+	offset := (page - 1) * pageSize
+	if offset >= uint(n) {
+		return n, n
+	}
+	end = n
+	if offset+pageSize < uint(n) {
+		end = int(offset + pageSize)
+	}
+	return int(offset), end
+}
+
+func sessionLess(sortBy SessionSortBy) func(a, b *SessionInfo) bool {
+	switch sortBy {
+	case SessionSortByClientID:
+		return func(a, b *SessionInfo) bool {
+			return a.ClientID < b.ClientID
+		}
+	case SessionSortByConnectedAt:
+		return func(a, b *SessionInfo) bool {
+			return a.ConnectedAt.Before(b.ConnectedAt)
+		}
+	case SessionSortBySubscriptionsCurrent:
+		return func(a, b *SessionInfo) bool {
+			return a.Stats.SubscriptionStats.SubscriptionsCurrent < b.Stats.SubscriptionStats.SubscriptionsCurrent
+		}
+	case SessionSortByQueueLen:
+		return func(a, b *SessionInfo) bool {
+			return a.Stats.MessageStats.QueuedCurrent < b.Stats.MessageStats.QueuedCurrent
+		}
+	case SessionSortByMessageDropped:
+		return func(a, b *SessionInfo) bool {
+			return a.Stats.MessageStats.GetDroppedTotal() < b.Stats.MessageStats.GetDroppedTotal()
+		}
+	}
+	return nil
+}
+
+type sessionIterator struct {
+	srv *server
+}
+
+// SessionIterator returns the SessionIterator of the server.
+func (srv *server) SessionIterator() SessionIterator {
+	return &sessionIterator{srv: srv}
+}
+
+func newSessionInfo(client *client, maxQueue int) *SessionInfo {
+	opts := client.ClientOptions()
+	rs := &SessionInfo{
+		ClientID:      opts.ClientID,
+		Connected:     client.IsConnected(),
+		Username:      opts.Username,
+		ConnID:        client.ConnID(),
+		Version:       client.Version(),
+		KeepAlive:     opts.KeepAlive,
+		ConnectedAt:   client.ConnectedAt(),
+		SessionExpiry: opts.SessionExpiry,
+		MaxInflight:   opts.MaxInflight,
+		MaxQueue:      maxQueue,
+	}
+	if conn := client.Connection(); conn != nil {
+		rs.RemoteAddr = conn.RemoteAddr().String()
+		rs.LocalAddr = conn.LocalAddr().String()
+	}
+	return rs
+}
+
+// ListSessions implements SessionIterator.
+func (s *sessionIterator) ListSessions(opts ListSessionsOptions) (rs []*SessionInfo, total int, err error) {
+	less := sessionLess(opts.SortBy)
+	if less == nil {
+		return nil, 0, ErrInvalidSortBy
+	}
+	if opts.After != "" && (opts.SortBy != SessionSortByClientID || opts.Descending) {
+		return nil, 0, ErrInvalidAfter
+	}
+	srv := s.srv
+	maxQueue := srv.config().MQTT.MaxQueuedMsg
+
+	srv.mu.RLock()
+	all := make([]*SessionInfo, 0, len(srv.clients)+len(srv.offlineClients))
+	for _, c := range srv.clients {
+		all = append(all, newSessionInfo(c, maxQueue))
+	}
+	offline := make(map[string]time.Time, len(srv.offlineClients))
+	for cid, expiresAt := range srv.offlineClients {
+		offline[cid] = expiresAt
+	}
+	srv.mu.RUnlock()
+
+	// read the session store outside the lock, it may be a remote store.
+	for cid, expiresAt := range offline {
+		info := &SessionInfo{
+			ClientID:  cid,
+			ExpiresAt: expiresAt,
+			MaxQueue:  maxQueue,
+		}
+		if sess, err := srv.sessionStore.Get(cid); err == nil && sess != nil {
+			info.ConnectedAt = sess.ConnectedAt
+			info.SessionExpiry = sess.ExpiryInterval
+		}
+		all = append(all, info)
+	}
+	n := 0
+	for _, v := range all {
+		v.Stats, _ = srv.statsManager.GetClientStats(v.ClientID)
+		if opts.Fill != nil {
+			opts.Fill(v)
+		}
+		if opts.Filter.match(v) {
+			all[n] = v
+			n++
+		}
+	}
+	all = all[:n]
+	// the sessions with the same sort key are ordered by the client id.
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ClientID < all[j].ClientID
+	})
+	sort.SliceStable(all, func(i, j int) bool {
+		if opts.Descending {
+			return less(all[j], all[i])
+		}
+		return less(all[i], all[j])
+	})
+	rest := all
+	if opts.After != "" {
+		rest = all[sort.Search(len(all), func(i int) bool {
+			return all[i].ClientID > opts.After
+		}):]
+	}
+	start, end := pageRange(opts.Page, opts.PageSize, len(rest))
+	return append(make([]*SessionInfo, 0, end-start), rest[start:end]...), len(all), nil
+}
+
+// ListSubscriptions implements SessionIterator.
+func (s *sessionIterator) ListSubscriptions(opts ListSubscriptionsOptions) (rs []*SubscriptionInfo, total int, err error) {
+	var all []*SubscriptionInfo
+	s.srv.subscriptionsDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+		if opts.MatchTopic != "" && !packets.TopicMatch([]byte(opts.MatchTopic), []byte(sub.TopicFilter)) {
+			return true
+		}
+		all = append(all, &SubscriptionInfo{
+			ClientID:     clientID,
+			Subscription: sub.Copy(),
+		})
+		return true
+	}, subscription.IterationOptions{
+		Type:     subscription.TypeAll,
+		ClientID: opts.ClientID,
+	})
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].ClientID != all[j].ClientID {
+			return all[i].ClientID < all[j].ClientID
+		}
+		return all[i].Subscription.GetFullTopicName() < all[j].Subscription.GetFullTopicName()
+	})
+	start, end := pageRange(opts.Page, opts.PageSize, len(all))
+	return append(make([]*SubscriptionInfo, 0, end-start), all[start:end]...), len(all), nil
+}
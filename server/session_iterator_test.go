@@ -0,0 +1,179 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	session_mem "github.com/DrmagicE/gmqtt/persistence/session/mem"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestSessionIterator_ListSessions(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.sessionStore = session_mem.New()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	now := time.Unix(time.Now().Unix(), 0)
+	for i, v := range []struct {
+		clientID string
+		username string
+	}{
+		{clientID: "c", username: "user-1"},
+		{clientID: "a", username: "user-2"},
+		{clientID: "b", username: "admin"},
+	} {
+		c, err := srv.newClient(noopConn{})
+		a.Nil(err)
+		c.opts.ClientID = v.clientID
+		c.opts.Username = v.username
+		c.version = packets.Version5
+		c.setConnected(now.Add(time.Duration(i) * time.Minute))
+		srv.clients[v.clientID] = c
+	}
+	srv.offlineClients["offline"] = now.Add(time.Hour)
+	a.Nil(srv.sessionStore.Set(&gmqtt.Session{
+		ClientID:       "offline",
+		ConnectedAt:    now.Add(-time.Hour),
+		ExpiryInterval: 7200,
+	}))
+	(&queueNotifier{sts: srv.statsManager, cli: srv.clients["c"]}).NotifyMsgQueueAdded(2)
+	(&queueNotifier{sts: srv.statsManager, cli: srv.clients["b"]}).NotifyMsgQueueAdded(1)
+	it := srv.SessionIterator()
+
+	clientIDs := func(rs []*SessionInfo) []string {
+		var ids []string
+		for _, v := range rs {
+			ids = append(ids, v.ClientID)
+		}
+		return ids
+	}
+	rs, total, err := it.ListSessions(ListSessionsOptions{})
+	a.Nil(err)
+	a.Equal(4, total)
+	a.Equal([]string{"a", "b", "c", "offline"}, clientIDs(rs))
+	a.True(rs[0].Connected)
+	a.Equal("user-2", rs[0].Username)
+	a.Equal("dummy", rs[0].RemoteAddr)
+	a.EqualValues(packets.Version5, rs[0].Version)
+	a.False(rs[3].Connected)
+	a.Equal(now.Add(time.Hour), rs[3].ExpiresAt)
+	a.EqualValues(7200, rs[3].SessionExpiry)
+
+	rs, total, err = it.ListSessions(ListSessionsOptions{Page: 2, PageSize: 3})
+	a.Nil(err)
+	a.Equal(4, total)
+	a.Equal([]string{"offline"}, clientIDs(rs))
+
+	rs, total, err = it.ListSessions(ListSessionsOptions{Page: 3, PageSize: 3})
+	a.Nil(err)
+	a.Equal(4, total)
+	a.Empty(rs)
+
+	rs, total, err = it.ListSessions(ListSessionsOptions{
+		Filter: SessionFilter{Username: "user", UsernamePrefix: true},
+	})
+	a.Nil(err)
+	a.Equal(2, total)
+	a.Equal([]string{"a", "c"}, clientIDs(rs))
+
+	rs, _, err = it.ListSessions(ListSessionsOptions{Filter: SessionFilter{DisconnectedOnly: true}})
+	a.Nil(err)
+	a.Equal([]string{"offline"}, clientIDs(rs))
+
+	rs, _, err = it.ListSessions(ListSessionsOptions{Filter: SessionFilter{ConnectedBefore: now.Add(time.Minute)}})
+	a.Nil(err)
+	a.Equal([]string{"c", "offline"}, clientIDs(rs))
+
+	rs, _, err = it.ListSessions(ListSessionsOptions{Filter: SessionFilter{IdleBefore: now.Add(time.Minute)}})
+	a.Nil(err)
+	a.Equal([]string{"c"}, clientIDs(rs))
+
+	rs, _, err = it.ListSessions(ListSessionsOptions{SortBy: SessionSortByQueueLen, Descending: true})
+	a.Nil(err)
+	a.Equal([]string{"c", "b", "a", "offline"}, clientIDs(rs))
+	a.EqualValues(2, rs[0].Stats.MessageStats.QueuedCurrent)
+
+	rs, _, err = it.ListSessions(ListSessionsOptions{SortBy: SessionSortByConnectedAt})
+	a.Nil(err)
+	a.Equal([]string{"offline", "c", "a", "b"}, clientIDs(rs))
+
+	// the total counts the sessions before After as well.
+	rs, total, err = it.ListSessions(ListSessionsOptions{After: "a", PageSize: 2})
+	a.Nil(err)
+	a.Equal(4, total)
+	a.Equal([]string{"b", "c"}, clientIDs(rs))
+	rs, _, err = it.ListSessions(ListSessionsOptions{After: "bb", PageSize: 2})
+	a.Nil(err)
+	a.Equal([]string{"c", "offline"}, clientIDs(rs))
+	rs, _, err = it.ListSessions(ListSessionsOptions{After: "offline"})
+	a.Nil(err)
+	a.Empty(rs)
+
+	// Fill is called before filtering.
+	rs, total, err = it.ListSessions(ListSessionsOptions{
+		Filter: SessionFilter{Username: "last"},
+		Fill: func(s *SessionInfo) {
+			if !s.Connected {
+				s.Username = "last"
+			}
+		},
+	})
+	a.Nil(err)
+	a.Equal(1, total)
+	a.Equal([]string{"offline"}, clientIDs(rs))
+
+	_, _, err = it.ListSessions(ListSessionsOptions{SortBy: 100})
+	a.Equal(ErrInvalidSortBy, err)
+	_, _, err = it.ListSessions(ListSessionsOptions{After: "a", Descending: true})
+	a.Equal(ErrInvalidAfter, err)
+	_, _, err = it.ListSessions(ListSessionsOptions{After: "a", SortBy: SessionSortByQueueLen})
+	a.Equal(ErrInvalidAfter, err)
+}
+
+func TestSessionIterator_ListSubscriptions(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	_, err := srv.subscriptionsDB.Subscribe("b", &gmqtt.Subscription{TopicFilter: "a/+", QoS: 1})
+	a.Nil(err)
+	_, err = srv.subscriptionsDB.Subscribe("a",
+		&gmqtt.Subscription{TopicFilter: "a/b"},
+		&gmqtt.Subscription{ShareName: "g", TopicFilter: "a/#", QoS: 2},
+		&gmqtt.Subscription{TopicFilter: "c"},
+	)
+	a.Nil(err)
+	it := srv.SessionIterator()
+
+	topics := func(rs []*SubscriptionInfo) []string {
+		var ts []string
+		for _, v := range rs {
+			ts = append(ts, v.ClientID+":"+v.Subscription.GetFullTopicName())
+		}
+		return ts
+	}
+	rs, total, err := it.ListSubscriptions(ListSubscriptionsOptions{})
+	a.Nil(err)
+	a.Equal(4, total)
+	a.Equal([]string{"a:$share/g/a/#", "a:a/b", "a:c", "b:a/+"}, topics(rs))
+	a.EqualValues(2, rs[0].Subscription.QoS)
+
+	rs, total, err = it.ListSubscriptions(ListSubscriptionsOptions{Page: 2, PageSize: 3})
+	a.Nil(err)
+	a.Equal(4, total)
+	a.Equal([]string{"b:a/+"}, topics(rs))
+
+	rs, total, err = it.ListSubscriptions(ListSubscriptionsOptions{MatchTopic: "a/b"})
+	a.Nil(err)
+	a.Equal(3, total)
+	a.Equal([]string{"a:$share/g/a/#", "a:a/b", "b:a/+"}, topics(rs))
+
+	rs, total, err = it.ListSubscriptions(ListSubscriptionsOptions{ClientID: "b"})
+	a.Nil(err)
+	a.Equal(1, total)
+	a.Equal([]string{"b:a/+"}, topics(rs))
+}
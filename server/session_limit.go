@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+// usernameSessions tracks the sessions of each username, see config.MQTT.MaxSessionsPerUsername.
+// It is not goroutine safe, guarded by server.mu.
+type usernameSessions struct {
+	// username => client id => connected time of the session
+	sessions map[string]map[string]time.Time
+	// client id => username
+	usernames map[string]string
+}
+
+func newUsernameSessions() *usernameSessions {
+	return &usernameSessions{
+		sessions:  make(map[string]map[string]time.Time),
+		usernames: make(map[string]string),
+	}
+}
+
+// add adds or updates the session of the client, the username can be changed when the client reconnects.
+func (u *usernameSessions) add(username, clientID string, connectedAt time.Time) {
+	u.remove(clientID)
+	if username == "" {
+		return
+	}
+	s, ok := u.sessions[username]
+	if !ok {
+		s = make(map[string]time.Time)
+		u.sessions[username] = s
+	}
+	s[clientID] = connectedAt
+	u.usernames[clientID] = username
+}
+
+func (u *usernameSessions) remove(clientID string) {
+	username, ok := u.usernames[clientID]
+	if !ok {
+		return
+	}
+	delete(u.usernames, clientID)
+	s := u.sessions[username]
+	delete(s, clientID)
+	if len(s) == 0 {
+		delete(u.sessions, username)
+	}
+}
+
+// others returns the client ids of the sessions of the username except the given client id, the oldest session first.
+func (u *usernameSessions) others(username, clientID string) []string {
+	s := u.sessions[username]
+	ids := make([]string, 0, len(s))
+	for id := range s {
+		if id != clientID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if s[ids[i]].Equal(s[ids[j]]) {
+			return ids[i] < ids[j]
+		}
+		return s[ids[i]].Before(s[ids[j]])
+	})
+	return ids
+}
+
+// checkSessionLimitLocked checks whether the client exceeds config.MQTT.MaxSessionsPerUsername.
+// If the policy is config.SessionLimitEvictOldest, the oldest sessions will be terminated to make room for the client.
+func (srv *server) checkSessionLimitLocked(c *client) error {
+	max := c.config.MQTT.MaxSessionsPerUsername
+	username := c.opts.Username
+	if max == 0 || username == "" {
+		return nil
+	}
+	// the session of the same client id will be resumed or replaced, it is not counted.
+	others := srv.usernameSessions.others(username, c.opts.ClientID)
+	if len(others) < max {
+		return nil
+	}
+	if c.config.MQTT.SessionLimitPolicy != config.SessionLimitEvictOldest {
+		return codes.NewError(codes.QuotaExceeded)
+	}
+	for _, clientID := range others[:len(others)-max+1] {
+		zaplog.Info("evicting session due to max sessions per username",
+			zap.String("client_id", clientID),
+			zap.String("username", username),
+		)
+		srv.usernameSessions.remove(clientID)
+		if old, ok := srv.clients[clientID]; ok {
+			// The session will be removed once the client is closed.
+			atomic.StoreInt32(&old.forceRemoveSession, 1)
+			// setError may block on writing the DISCONNECT packet, do not hold the lock.
+			go func() {
+				old.setError(codes.NewError(codes.SessionTakenOver))
+				old.Close()
+			}()
+			continue
+		}
+		if _, ok := srv.offlineClients[clientID]; ok {
+			err := srv.sessionTerminatedLocked(clientID, TakenOverTermination)
+			if err != nil {
+				err = fmt.Errorf("session terminated fail: %w", err)
+				zaplog.Error("session terminated fail", zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	session_mem "github.com/DrmagicE/gmqtt/persistence/session/mem"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+func TestUsernameSessions(t *testing.T) {
+	a := assert.New(t)
+	u := newUsernameSessions()
+	now := time.Now()
+	u.add("user", "b", now.Add(time.Second))
+	u.add("user", "a", now)
+	u.add("user", "c", now.Add(2*time.Second))
+	u.add("", "d", now)
+	a.Equal([]string{"a", "b", "c"}, u.others("user", ""))
+	a.Equal([]string{"a", "c"}, u.others("user", "b"))
+	a.Empty(u.others("", ""))
+
+	// the client reconnects with another username.
+	u.add("other", "a", now.Add(3*time.Second))
+	a.Equal([]string{"b", "c"}, u.others("user", ""))
+	a.Equal([]string{"a"}, u.others("other", ""))
+
+	u.remove("a")
+	u.remove("notexist")
+	a.Empty(u.others("other", ""))
+	a.NotContains(u.sessions, "other")
+}
+
+// newSessionLimitServer returns a server which has an offline session "offline" and a connected session "online" of the username "user",
+// the offline one is older.
+func newSessionLimitServer(t *testing.T, policy string, max int) (srv *server, online *client) {
+	a := assert.New(t)
+	srv = defaultServer()
+	srv.config().MQTT.MaxSessionsPerUsername = max
+	srv.config().MQTT.SessionLimitPolicy = policy
+	srv.subscriptionsDB = mem.NewStore()
+	srv.sessionStore = session_mem.New()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	now := time.Now()
+
+	a.Nil(srv.sessionStore.Set(&gmqtt.Session{ClientID: "offline", ConnectedAt: now.Add(-time.Minute), ExpiryInterval: 3600}))
+	srv.offlineClients["offline"] = now.Add(time.Hour)
+	srv.usernameSessions.add("user", "offline", now.Add(-time.Minute))
+
+	online, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	online.opts.ClientID = "online"
+	online.opts.Username = "user"
+	a.Nil(srv.sessionStore.Set(&gmqtt.Session{ClientID: "online", ConnectedAt: now, ExpiryInterval: 3600}))
+	srv.clients["online"] = online
+	srv.usernameSessions.add("user", "online", now)
+	return srv, online
+}
+
+func newSessionLimitClient(t *testing.T, srv *server, clientID, username string) *client {
+	c, err := srv.newClient(noopConn{})
+	assert.Nil(t, err)
+	c.opts.ClientID = clientID
+	c.opts.Username = username
+	return c
+}
+
+func TestServer_checkSessionLimitLocked_reject(t *testing.T) {
+	a := assert.New(t)
+	srv, _ := newSessionLimitServer(t, config.SessionLimitReject, 2)
+
+	err := srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "new", "user"))
+	a.Equal(codes.QuotaExceeded, err.(*codes.Error).Code)
+
+	// resume the existing session.
+	a.Nil(srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "offline", "user")))
+	// other usernames and the clients without username are not limited.
+	a.Nil(srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "new", "other")))
+	a.Nil(srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "new", "")))
+
+	srv.config().MQTT.SessionLimitPolicy = ""
+	err = srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "new", "user"))
+	a.Equal(codes.QuotaExceeded, err.(*codes.Error).Code)
+
+	srv.config().MQTT.MaxSessionsPerUsername = 0
+	a.Nil(srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "new", "user")))
+}
+
+func TestServer_checkSessionLimitLocked_evictOldest(t *testing.T) {
+	a := assert.New(t)
+	srv, online := newSessionLimitServer(t, config.SessionLimitEvictOldest, 2)
+	terminated := make(map[string]SessionTerminatedReason)
+	srv.hooks.OnSessionTerminated = func(ctx context.Context, clientID string, reason SessionTerminatedReason) {
+		terminated[clientID] = reason
+	}
+
+	// evict the offline session which is the oldest one.
+	a.Nil(srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "new", "user")))
+	a.Equal(map[string]SessionTerminatedReason{"offline": TakenOverTermination}, terminated)
+	a.NotContains(srv.offlineClients, "offline")
+	sess, err := srv.sessionStore.Get("offline")
+	a.Nil(err)
+	a.Nil(sess)
+	a.Equal([]string{"online"}, srv.usernameSessions.others("user", ""))
+	srv.usernameSessions.add("user", "new", time.Now())
+
+	// evict the connected session which is older than "new".
+	a.Nil(srv.checkSessionLimitLocked(newSessionLimitClient(t, srv, "another", "user")))
+	a.Equal([]string{"new"}, srv.usernameSessions.others("user", ""))
+	a.EqualValues(1, online.forceRemoveSession)
+	select {
+	case <-online.close:
+		a.Equal(codes.SessionTakenOver, online.err.(*codes.Error).Code)
+	case <-time.After(time.Second):
+		t.Fatal("the client of the evicted session must be disconnected")
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	session_mem "github.com/DrmagicE/gmqtt/persistence/session/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+// remoteConn is a noopConn with the given remote address.
+type remoteConn struct {
+	noopConn
+	addr string
+}
+
+func (r remoteConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", r.addr)
+	return addr
+}
+
+func TestServer_lockDuplicatedID_takeover(t *testing.T) {
+	var tt = []struct {
+		name     string
+		decision TakeoverDecision
+		remote   string
+		code     codes.Code
+	}{
+		{name: "takeover", decision: SessionTakeover, remote: "10.0.0.2:1000"},
+		{name: "reject_new", decision: SessionRejectNew, remote: "10.0.0.1:2000", code: codes.UnspecifiedError},
+		{name: "reject_if_remote_differs", decision: SessionRejectIfRemoteDiffers, remote: "10.0.0.2:1000", code: codes.NotAuthorized},
+		{name: "same_remote", decision: SessionRejectIfRemoteDiffers, remote: "10.0.0.1:2000"},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			srv := defaultServer()
+			srv.sessionStore = session_mem.New()
+			old, err := srv.newClient(remoteConn{addr: "10.0.0.1:1000"})
+			a.Nil(err)
+			old.opts.ClientID = "cid"
+			old.opts.Username = "old"
+			a.Nil(srv.sessionStore.Set(&gmqtt.Session{ClientID: "cid", ConnectedAt: time.Now()}))
+			srv.clients["cid"] = old
+
+			c, err := srv.newClient(remoteConn{addr: v.remote})
+			a.Nil(err)
+			c.opts.ClientID = "cid"
+			c.opts.Username = "new"
+			srv.hooks.OnSessionTakeover = func(ctx context.Context, clientID string, existing, incoming *ClientOptions) TakeoverDecision {
+				a.Equal("cid", clientID)
+				a.Equal("old", existing.Username)
+				a.Equal("new", incoming.Username)
+				return v.decision
+			}
+			if v.code != 0 {
+				_, err = srv.lockDuplicatedID(c)
+				a.Equal(v.code, err.(*codes.Error).Code)
+				// the lock is released and the existing client is not closed.
+				srv.mu.Lock()
+				srv.mu.Unlock()
+				a.Nil(old.err)
+				return
+			}
+			// the existing client is taken over.
+			go func() {
+				<-old.close
+				srv.mu.Lock()
+				delete(srv.clients, "cid")
+				srv.mu.Unlock()
+				close(old.closed)
+			}()
+			_, err = srv.lockDuplicatedID(c)
+			a.Nil(err)
+			srv.mu.Unlock()
+			a.Equal(codes.SessionTakenOver, old.err.(*codes.Error).Code)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// SlowConsumerEvent is the input param for OnSlowConsumer hook.
+type SlowConsumerEvent struct {
+	// QueueLen is the length of the message queue of the client.
+	QueueLen uint64
+	// Since is the time when the queue length exceeded the high-water mark,
+	// or the time when the client connected if it is later.
+	Since time.Time
+	// Disconnect indicates whether the client will be disconnected, see config.SlowConsumer.
+	Disconnect bool
+}
+
+// aboveHighWater returns the clients whose queue length have stayed above the high-water mark since before the deadline,
+// along with the time when the mark was exceeded.
+func (s *statsManager) aboveHighWater(deadline time.Time) map[string]time.Time {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	var rs map[string]time.Time
+	for cid, sts := range s.clientStats {
+		if since := sts.aboveHighWaterSince; !since.IsZero() && !since.After(deadline) {
+			if rs == nil {
+				rs = make(map[string]time.Time)
+			}
+			rs[cid] = since
+		}
+	}
+	return rs
+}
+
+// restartHighWater restarts the measuring of the client if its queue length is still above the high-water mark.
+func (s *statsManager) restartHighWater(clientID string, now time.Time) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	if sts := s.clientStats[clientID]; sts != nil && !sts.aboveHighWaterSince.IsZero() {
+		sts.aboveHighWaterSince = now
+	}
+}
+
+// checkSlowConsumers reports the connected clients whose queue length has stayed above
+// config.SlowConsumer.HighWaterMark for config.SlowConsumer.Duration, and disconnects them if configured.
+func (srv *server) checkSlowConsumers(now time.Time) {
+	cfg := srv.config().SlowConsumer
+	if !cfg.Enable {
+		return
+	}
+	candidates := srv.statsManager.aboveHighWater(now.Add(-cfg.Duration))
+	for cid, since := range candidates {
+		srv.mu.RLock()
+		cli := srv.clients[cid]
+		srv.mu.RUnlock()
+		// the offline sessions are handled by the session expiry and the queue limit.
+		if cli == nil || !cli.IsConnected() {
+			continue
+		}
+		if connectedAt := cli.ConnectedAt(); connectedAt.After(since) {
+			if now.Sub(connectedAt) < cfg.Duration {
+				continue
+			}
+			since = connectedAt
+		}
+		sts, _ := srv.statsManager.GetClientStats(cid)
+		ev := &SlowConsumerEvent{
+			QueueLen:   sts.MessageStats.QueuedCurrent,
+			Since:      since,
+			Disconnect: cfg.Disconnect,
+		}
+		zaplog.Warn("slow consumer detected",
+			zap.String("client_id", cid),
+			zap.Uint64("queue_len", ev.QueueLen),
+			zap.Time("since", since),
+			zap.Bool("disconnect", cfg.Disconnect))
+		if srv.hooks.OnSlowConsumer != nil {
+			srv.hooks.OnSlowConsumer(context.Background(), cli, ev)
+		}
+		// report it again after another Duration if it is not disconnected.
+		srv.statsManager.restartHighWater(cid, now)
+		if cfg.Disconnect {
+			// Disconnect blocks until the packet is accepted by the write loop, which may be stuck by the slow consumer.
+			go srv.disconnectSlowConsumer(cli, cfg.RemoveSession)
+		}
+	}
+}
+
+func (srv *server) disconnectSlowConsumer(cli *client, removeSession bool) {
+	if removeSession {
+		atomic.StoreInt32(&cli.forceRemoveSession, 1)
+	}
+	if cli.version == packets.Version5 {
+		// the connection is closed after the DISCONNECT packet is written.
+		cli.Disconnect(&packets.Disconnect{
+			Version: packets.Version5,
+			Code:    codes.QuotaExceeded,
+			Properties: &packets.Properties{
+				ReasonString: []byte("slow consumer"),
+			},
+		})
+	} else {
+		cli.Close()
+	}
+}
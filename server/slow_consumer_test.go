@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestServer_checkSlowConsumers(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.config().SlowConsumer = config.SlowConsumer{
+		Enable:        true,
+		HighWaterMark: 2,
+		Duration:      10 * time.Second,
+		Disconnect:    true,
+	}
+	srv.statsManager = newStatsManager(mem.NewStore())
+	srv.statsManager.queueHighWaterMark = 2
+	var events []*SlowConsumerEvent
+	srv.hooks.OnSlowConsumer = func(ctx context.Context, client Client, ev *SlowConsumerEvent) {
+		a.Equal("cid", client.ClientOptions().ClientID)
+		events = append(events, ev)
+	}
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	c.setConnected(time.Now().Add(-time.Minute))
+	srv.clients["cid"] = c
+	notifier := &queueNotifier{sts: srv.statsManager, cli: c}
+	aboveSince := func() time.Time {
+		srv.statsManager.clientMu.Lock()
+		defer srv.statsManager.clientMu.Unlock()
+		return srv.statsManager.clientStats["cid"].aboveHighWaterSince
+	}
+
+	// the queue length is not above the high-water mark.
+	notifier.NotifyMsgQueueAdded(2)
+	a.True(aboveSince().IsZero())
+	srv.checkSlowConsumers(time.Now().Add(time.Hour))
+	a.Empty(events)
+
+	// the client stops reading, and catches up before the duration elapses.
+	notifier.NotifyMsgQueueAdded(1)
+	since := aboveSince()
+	a.False(since.IsZero())
+	srv.checkSlowConsumers(since.Add(9 * time.Second))
+	a.Empty(events)
+	notifier.NotifyMsgQueueAdded(-1)
+	a.True(aboveSince().IsZero())
+	srv.checkSlowConsumers(since.Add(time.Hour))
+	a.Empty(events)
+
+	// the client stops reading again, it is disconnected once the duration elapses.
+	notifier.NotifyMsgQueueAdded(2)
+	since = aboveSince()
+	srv.checkSlowConsumers(since.Add(10*time.Second - time.Millisecond))
+	a.Empty(events)
+	srv.checkSlowConsumers(since.Add(10 * time.Second))
+	a.Equal([]*SlowConsumerEvent{{QueueLen: 4, Since: since, Disconnect: true}}, events)
+	select {
+	case p := <-c.out:
+		a.Equal(codes.QuotaExceeded, p.(*packets.Disconnect).Code)
+	case <-time.After(time.Second):
+		t.Fatal("DISCONNECT not sent")
+	}
+	a.EqualValues(0, atomic.LoadInt32(&c.forceRemoveSession))
+}
+
+func TestServer_checkSlowConsumers_reportOnly(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.config().SlowConsumer = config.SlowConsumer{
+		Enable:        true,
+		HighWaterMark: 1,
+		Duration:      10 * time.Second,
+	}
+	srv.statsManager = newStatsManager(mem.NewStore())
+	srv.statsManager.queueHighWaterMark = 1
+	var events []*SlowConsumerEvent
+	srv.hooks.OnSlowConsumer = func(ctx context.Context, client Client, ev *SlowConsumerEvent) {
+		events = append(events, ev)
+	}
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version5
+	now := time.Now()
+	// the client has just reconnected, the duration is counted since it connected.
+	connectedAt := time.Unix(now.Unix()+5, 0)
+	c.setConnected(connectedAt)
+	srv.clients["cid"] = c
+	notifier := &queueNotifier{sts: srv.statsManager, cli: c}
+	notifier.NotifyMsgQueueAdded(2)
+
+	srv.checkSlowConsumers(now.Add(12 * time.Second))
+	a.Empty(events)
+	srv.checkSlowConsumers(connectedAt.Add(10 * time.Second))
+	a.Equal([]*SlowConsumerEvent{{QueueLen: 2, Since: connectedAt}}, events)
+	a.Len(c.out, 0)
+
+	// it is reported again after another duration.
+	srv.checkSlowConsumers(connectedAt.Add(19 * time.Second))
+	a.Len(events, 1)
+	srv.checkSlowConsumers(connectedAt.Add(20 * time.Second))
+	a.Len(events, 2)
+	a.Equal(connectedAt.Add(10*time.Second), events[1].Since)
+
+	// the client which is not online is not reported.
+	delete(srv.clients, "cid")
+	srv.checkSlowConsumers(connectedAt.Add(time.Hour))
+	a.Len(events, 2)
+}
+
+func TestServer_disconnectSlowConsumer_removeSession(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version311
+	srv.disconnectSlowConsumer(c, true)
+	a.EqualValues(1, atomic.LoadInt32(&c.forceRemoveSession))
+	a.Len(c.out, 0)
+}
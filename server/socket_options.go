@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SocketOptions is the socket options of a tcp listener and the connections accepted by it.
+type SocketOptions struct {
+	// NoDelay sets TCP_NODELAY of the accepted connections, which disables the Nagle's algorithm to reduce the latency.
+	NoDelay bool
+	// ReadBufferSize sets SO_RCVBUF of the accepted connections, 0 means the system default.
+	ReadBufferSize int
+	// WriteBufferSize sets SO_SNDBUF of the accepted connections, 0 means the system default.
+	WriteBufferSize int
+	// ReuseAddr sets SO_REUSEADDR of the listening socket, which allows to restart on the address
+	// whose previous connections are still in TIME_WAIT. It is ignored on windows.
+	ReuseAddr bool
+}
+
+// DefaultSocketOptions is the socket options which match the defaults of the net package.
+var DefaultSocketOptions = SocketOptions{
+	NoDelay:   true,
+	ReuseAddr: true,
+}
+
+// Listen listens on the tcp address with the socket options, the accepted connections send the TCP keep-alive probes
+// with the period, see net.ListenConfig.KeepAlive.
+func (o SocketOptions) Listen(address string, keepAlive time.Duration) (net.Listener, error) {
+	lc := net.ListenConfig{
+		KeepAlive: keepAlive,
+		Control:   reuseAddrControl(o.ReuseAddr),
+	}
+	l, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocketOptionsListener(l, o), nil
+}
+
+// socketConn is the connection whose socket options can be set, e.g: *net.TCPConn.
+type socketConn interface {
+	SetNoDelay(noDelay bool) error
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// apply sets the socket options of the connection, the connection which is not a socketConn is ignored.
+func (o SocketOptions) apply(conn net.Conn) error {
+	sc, ok := conn.(socketConn)
+	if !ok {
+		return nil
+	}
+	if err := sc.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+	if o.ReadBufferSize != 0 {
+		if err := sc.SetReadBuffer(o.ReadBufferSize); err != nil {
+			return err
+		}
+	}
+	if o.WriteBufferSize != 0 {
+		return sc.SetWriteBuffer(o.WriteBufferSize)
+	}
+	return nil
+}
+
+// socketOptionsListener is a net.Listener which sets the socket options of the accepted connections.
+type socketOptionsListener struct {
+	net.Listener
+	opts SocketOptions
+}
+
+// NewSocketOptionsListener returns a net.Listener which sets NoDelay, ReadBufferSize and WriteBufferSize
+// of SocketOptions on the connections accepted by l. It must wrap the tcp listener directly,
+// e.g: before tls.NewListener, otherwise the options are not applied.
+// The connection is still served if the options fail to be set.
+func NewSocketOptionsListener(l net.Listener, opts SocketOptions) net.Listener {
+	return &socketOptionsListener{
+		Listener: l,
+		opts:     opts,
+	}
+}
+
+func (l *socketOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.opts.apply(conn); err != nil {
+		zaplog.Warn("failed to set the socket options", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+	}
+	return conn, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSocketConn struct {
+	net.Conn
+	noDelay    *bool
+	readBuf    int
+	writeBuf   int
+	noDelayErr error
+}
+
+func (c *testSocketConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = &noDelay
+	return c.noDelayErr
+}
+
+func (c *testSocketConn) SetReadBuffer(bytes int) error {
+	c.readBuf = bytes
+	return nil
+}
+
+func (c *testSocketConn) SetWriteBuffer(bytes int) error {
+	c.writeBuf = bytes
+	return nil
+}
+
+type testAcceptListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *testAcceptListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func TestNewSocketOptionsListener(t *testing.T) {
+	a := assert.New(t)
+	ln := &testAcceptListener{conns: make(chan net.Conn, 3)}
+	l := NewSocketOptionsListener(ln, SocketOptions{
+		NoDelay:         false,
+		ReadBufferSize:  1024,
+		WriteBufferSize: 2048,
+	})
+	sc := &testSocketConn{}
+	ln.conns <- sc
+	conn, err := l.Accept()
+	a.Nil(err)
+	a.Equal(sc, conn)
+	if a.NotNil(sc.noDelay) {
+		a.False(*sc.noDelay)
+	}
+	a.Equal(1024, sc.readBuf)
+	a.Equal(2048, sc.writeBuf)
+
+	// the system defaults are kept.
+	l = NewSocketOptionsListener(ln, DefaultSocketOptions)
+	sc = &testSocketConn{}
+	ln.conns <- sc
+	_, err = l.Accept()
+	a.Nil(err)
+	if a.NotNil(sc.noDelay) {
+		a.True(*sc.noDelay)
+	}
+	a.Zero(sc.readBuf)
+	a.Zero(sc.writeBuf)
+
+	// the connection is still accepted on failure.
+	c, _ := net.Pipe()
+	sc = &testSocketConn{Conn: c, noDelayErr: errors.New("error")}
+	ln.conns <- sc
+	conn, err = l.Accept()
+	a.Nil(err)
+	a.Equal(sc, conn)
+
+	// not a socket
+	ln.conns <- c
+	conn, err = l.Accept()
+	a.Nil(err)
+	a.Equal(c, conn)
+}
+
+func TestSocketOptions_Listen(t *testing.T) {
+	a := assert.New(t)
+	for _, reuseAddr := range []bool{true, false} {
+		l, err := SocketOptions{ReadBufferSize: 4096, ReuseAddr: reuseAddr}.Listen("127.0.0.1:0", 0)
+		a.Nil(err)
+		c, err := net.Dial("tcp", l.Addr().String())
+		a.Nil(err)
+		conn, err := l.Accept()
+		a.Nil(err)
+		_, ok := conn.(*net.TCPConn)
+		a.True(ok)
+		conn.Close()
+		c.Close()
+		l.Close()
+	}
+}
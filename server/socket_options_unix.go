@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import "syscall"
+
+// reuseAddrControl returns the net.ListenConfig.Control which sets SO_REUSEADDR of the listening socket.
+func reuseAddrControl(reuseAddr bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		v := 0
+		if reuseAddr {
+			v = 1
+		}
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, v)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
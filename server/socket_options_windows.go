@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package server
+
+import "syscall"
+
+// reuseAddrControl returns nil because SO_REUSEADDR allows to steal the bound port on windows.
+func reuseAddrControl(reuseAddr bool) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -1,12 +1,15 @@
 package server
 
 import (
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/DrmagicE/gmqtt/persistence/queue"
 	"github.com/DrmagicE/gmqtt/persistence/subscription"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/retained"
 )
 
 type statsManager struct {
@@ -14,6 +17,70 @@ type statsManager struct {
 	totalStats     *GlobalStats
 	clientMu       sync.Mutex
 	clientStats    map[string]*ClientStats
+	// retainedStatsReader is nil if the retained store does not implement retained.StatsReader.
+	retainedStatsReader retained.StatsReader
+	// connectionsReader returns the number of the network connections, nil means not available.
+	connectionsReader func() uint64
+	// queueMu guards queueAgeReaders.
+	// Do not call the readers while holding any lock, because the queue store calls the notifier while holding its own lock.
+	queueMu         sync.Mutex
+	queueAgeReaders map[string]queue.AgeReader
+	// queueHighWaterMark is the high-water mark of the slow consumer detector, 0 means disabled.
+	// See config.SlowConsumer.
+	queueHighWaterMark uint64
+	// topicTracker is nil if config.TopicStats is disabled.
+	topicTracker *topicTracker
+	// snapshotMu guards intervalBase and intervalStart, see SnapshotStats.
+	snapshotMu    sync.Mutex
+	intervalBase  GlobalStats
+	intervalStart time.Time
+	// sink pushes the metrics to the MetricSink, nil if the sink is not set.
+	sink *metricDispatcher
+}
+
+// setQueueStore records the queue store of the client to read the queue age.
+// The queue store that does not implement queue.AgeReader is ignored.
+func (s *statsManager) setQueueStore(clientID string, qs queue.Store) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if r, ok := qs.(queue.AgeReader); ok {
+		s.queueAgeReaders[clientID] = r
+	} else {
+		delete(s.queueAgeReaders, clientID)
+	}
+}
+
+func (s *statsManager) removeQueueStore(clientID string) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	delete(s.queueAgeReaders, clientID)
+}
+
+// oldestQueuedAt returns the enqueue time of the oldest message waiting for delivery of the client.
+func (s *statsManager) oldestQueuedAt(clientID string) time.Time {
+	s.queueMu.Lock()
+	r := s.queueAgeReaders[clientID]
+	s.queueMu.Unlock()
+	if r == nil {
+		return time.Time{}
+	}
+	return r.OldestQueuedAt()
+}
+
+// globalOldestQueuedAt returns the enqueue time of the oldest message waiting for delivery among all clients.
+func (s *statsManager) globalOldestQueuedAt() (oldest time.Time) {
+	s.queueMu.Lock()
+	readers := make([]queue.AgeReader, 0, len(s.queueAgeReaders))
+	for _, v := range s.queueAgeReaders {
+		readers = append(readers, v)
+	}
+	s.queueMu.Unlock()
+	for _, r := range readers {
+		if t := r.OldestQueuedAt(); !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	return oldest
 }
 
 func (s *statsManager) getClientStats(clientID string) (stats *ClientStats) {
@@ -31,7 +98,13 @@ func (s *statsManager) packetReceived(packet packets.Packet, clientID string) {
 	s.totalStats.PacketStats.add(packet, true)
 	s.clientMu.Lock()
 	defer s.clientMu.Unlock()
-	s.getClientStats(clientID).PacketStats.add(packet, true)
+	sts := s.getClientStats(clientID)
+	sts.PacketStats.add(packet, true)
+	now := time.Now()
+	sts.LastPacketReceivedAt = now
+	if pub, ok := packet.(*packets.Publish); ok {
+		sts.publishRate.add(now, len(pub.Payload))
+	}
 }
 func (s *statsManager) packetSent(packet packets.Packet, clientID string) {
 	s.totalStats.PacketStats.add(packet, false)
@@ -52,25 +125,78 @@ func (s *statsManager) clientPacketSent(packet packets.Packet, clientID string)
 
 func (s *statsManager) clientConnected(clientID string) {
 	atomic.AddUint64(&s.totalStats.ConnectionStats.ConnectedTotal, 1)
+	s.sink.counter(MetricConnected, 1, nil)
 }
 
 func (s *statsManager) clientDisconnected(clientID string) {
 	atomic.AddUint64(&s.totalStats.ConnectionStats.DisconnectedTotal, 1)
+	s.sink.counter(MetricDisconnected, 1, nil)
 	s.sessionInActive()
 }
 
+func (s *statsManager) reconnectStormMitigating(mitigating bool) {
+	var v uint64
+	if mitigating {
+		v = 1
+	}
+	atomic.StoreUint64(&s.totalStats.ConnectionStats.ReconnectStormMitigating, v)
+}
+
+func (s *statsManager) persistenceUnhealthy(unhealthy bool) {
+	var v uint64
+	if unhealthy {
+		v = 1
+	}
+	atomic.StoreUint64(&s.totalStats.ConnectionStats.PersistenceUnhealthy, v)
+}
+
+func (s *statsManager) persistenceRejected() {
+	atomic.AddUint64(&s.totalStats.ConnectionStats.PersistenceRejectedTotal, 1)
+}
+
+func (s *statsManager) subscriptionsRejected(n uint64) {
+	atomic.AddUint64(&s.totalStats.ConnectionStats.SubscriptionsRejectedTotal, n)
+}
+
+func (s *statsManager) connectionRejected() {
+	atomic.AddUint64(&s.totalStats.ConnectionStats.ReconnectStormRejectedTotal, 1)
+}
+
+func (s *statsManager) errorLogSuppressed() {
+	atomic.AddUint64(&s.totalStats.ConnectionStats.ErrorLogsSuppressedTotal, 1)
+}
+
+func (s *statsManager) cpuTimeSpent(clientID string, read bool, d time.Duration) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	sts := s.getClientStats(clientID)
+	if read {
+		atomic.AddUint64(&sts.CPUStats.ReadNanoseconds, uint64(d))
+	} else {
+		atomic.AddUint64(&sts.CPUStats.WriteNanoseconds, uint64(d))
+	}
+}
+
+func (s *statsManager) publishLimited(clientID string) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	atomic.AddUint64(&s.getClientStats(clientID).PublishRateStats.LimitedTotal, 1)
+}
+
 func (s *statsManager) sessionActive(create bool) {
 	if create {
 		atomic.AddUint64(&s.totalStats.ConnectionStats.SessionCreatedTotal, 1)
 	} else {
 		atomic.AddUint64(&s.totalStats.ConnectionStats.InactiveCurrent, ^uint64(0))
 	}
-	atomic.AddUint64(&s.totalStats.ConnectionStats.ActiveCurrent, 1)
+	active := atomic.AddUint64(&s.totalStats.ConnectionStats.ActiveCurrent, 1)
+	s.sink.gauge(MetricSessionsActive, float64(active), nil)
 }
 
 func (s *statsManager) sessionInActive() {
-	atomic.AddUint64(&s.totalStats.ConnectionStats.ActiveCurrent, ^uint64(0))
+	active := atomic.AddUint64(&s.totalStats.ConnectionStats.ActiveCurrent, ^uint64(0))
 	atomic.AddUint64(&s.totalStats.ConnectionStats.InactiveCurrent, 1)
+	s.sink.gauge(MetricSessionsActive, float64(active), nil)
 }
 
 func (s *statsManager) sessionTerminated(clientID string, reason SessionTerminatedReason) {
@@ -90,7 +216,24 @@ func (s *statsManager) sessionTerminated(clientID string, reason SessionTerminat
 	delete(s.clientStats, clientID)
 }
 
+// sessionTransferred updates the stats as the source session is removed by ClientService.TransferSession,
+// the created target session replaces it as an inactive session.
+func (s *statsManager) sessionTransferred(fromClientID string, created bool) {
+	if !created {
+		atomic.AddUint64(&s.totalStats.ConnectionStats.InactiveCurrent, ^uint64(0))
+	}
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	delete(s.clientStats, fromClientID)
+}
+
 func (s *statsManager) messageDropped(qos uint8, clientID string, err error) {
+	if s.sink != nil {
+		s.sink.counter(MetricMessagesDropped, 1, map[string]string{
+			"qos":    strconv.Itoa(int(qos)),
+			"reason": dropReason(err).String(),
+		})
+	}
 	switch qos {
 	case packets.Qos0:
 		s.totalStats.MessageStats.Qos0.DroppedTotal.messageDropped(err)
@@ -119,12 +262,17 @@ func (d *DroppedTotal) messageDropped(err error) {
 		atomic.AddUint64(&d.Expired, 1)
 	case queue.ErrDropExpiredInflight:
 		atomic.AddUint64(&d.InflightExpired, 1)
+	case queue.ErrDropInflightTrimmed:
+		atomic.AddUint64(&d.InflightTrimmed, 1)
+	case queue.ErrDropWriteBufferFull:
+		atomic.AddUint64(&d.WriteBufferFull, 1)
 	default:
 		atomic.AddUint64(&d.Internal, 1)
 	}
 }
 
 func (s *statsManager) messageReceived(qos uint8, clientID string) {
+	s.sink.counter(MetricMessagesReceived, 1, metricQoSTags(qos))
 	switch qos {
 	case packets.Qos0:
 		atomic.AddUint64(&s.totalStats.MessageStats.Qos0.ReceivedTotal, 1)
@@ -145,6 +293,7 @@ func (s *statsManager) messageReceived(qos uint8, clientID string) {
 }
 
 func (s *statsManager) messageSent(qos uint8, clientID string) {
+	s.sink.counter(MetricMessagesSent, 1, metricQoSTags(qos))
 	switch qos {
 	case packets.Qos0:
 		atomic.AddUint64(&s.totalStats.MessageStats.Qos0.SentTotal, 1)
@@ -164,6 +313,11 @@ func (s *statsManager) messageSent(qos uint8, clientID string) {
 	}
 }
 
+// messageDelivered records the duration between the message is queued and it is sent to the client.
+func (s *statsManager) messageDelivered(latency time.Duration) {
+	s.sink.timing(MetricDeliveryLatency, latency, nil)
+}
+
 // StatsReader interface provides the ability to access the statistics of the server
 type StatsReader interface {
 	// GetGlobalStats returns the server statistics.
@@ -308,6 +462,21 @@ type ConnectionStats struct {
 	ActiveCurrent uint64
 	// InactiveCurrent is the number of used inactive session.
 	InactiveCurrent uint64
+	// ReconnectStormMitigating is 1 if the reconnect storm mitigation is active, otherwise 0.
+	ReconnectStormMitigating uint64
+	// ReconnectStormRejectedTotal is the number of connections rejected by the reconnect storm mitigation.
+	ReconnectStormRejectedTotal uint64
+	// ErrorLogsSuppressedTotal is the number of per-client error logs suppressed by the rate limit.
+	ErrorLogsSuppressedTotal uint64
+	// PersistenceUnhealthy is 1 if the persistence backend is unhealthy, otherwise 0. See config.PersistenceHealthCheck.
+	PersistenceUnhealthy uint64
+	// PersistenceRejectedTotal is the number of the persistent sessions rejected due to the unhealthy persistence backend.
+	PersistenceRejectedTotal uint64
+	// SubscriptionsRejectedTotal is the number of the topic filters rejected due to config.MQTT.MaxTotalSubscriptions.
+	SubscriptionsRejectedTotal uint64
+	// ConnectionsCurrent is the number of the network connections, including the connections which have not sent CONNECT.
+	// It is only available in GetGlobalStats.
+	ConnectionsCurrent uint64
 }
 
 func (c *ConnectionStats) copy() *ConnectionStats {
@@ -324,8 +493,14 @@ func (c *ConnectionStats) copy() *ConnectionStats {
 			Expired:   atomic.LoadUint64(&c.SessionTerminated.Expired),
 			Normal:    atomic.LoadUint64(&c.SessionTerminated.Normal),
 		},
-		ActiveCurrent:   atomic.LoadUint64(&c.ActiveCurrent),
-		InactiveCurrent: atomic.LoadUint64(&c.InactiveCurrent),
+		ActiveCurrent:               atomic.LoadUint64(&c.ActiveCurrent),
+		InactiveCurrent:             atomic.LoadUint64(&c.InactiveCurrent),
+		ReconnectStormMitigating:    atomic.LoadUint64(&c.ReconnectStormMitigating),
+		ReconnectStormRejectedTotal: atomic.LoadUint64(&c.ReconnectStormRejectedTotal),
+		ErrorLogsSuppressedTotal:    atomic.LoadUint64(&c.ErrorLogsSuppressedTotal),
+		PersistenceUnhealthy:        atomic.LoadUint64(&c.PersistenceUnhealthy),
+		PersistenceRejectedTotal:    atomic.LoadUint64(&c.PersistenceRejectedTotal),
+		SubscriptionsRejectedTotal:  atomic.LoadUint64(&c.SubscriptionsRejectedTotal),
 	}
 }
 
@@ -335,6 +510,10 @@ type DroppedTotal struct {
 	QueueFull            uint64
 	Expired              uint64
 	InflightExpired      uint64
+	InflightTrimmed      uint64
+	// WriteBufferFull is the number of the messages dropped by config.MQTT.WriteBufferPolicy,
+	// which are read from the queue but can not be written to the connected client.
+	WriteBufferFull uint64
 }
 
 type MessageQosStats struct {
@@ -344,7 +523,8 @@ type MessageQosStats struct {
 }
 
 func (m *MessageQosStats) GetDroppedTotal() uint64 {
-	return m.DroppedTotal.Internal + m.DroppedTotal.Expired + m.DroppedTotal.ExceedsMaxPacketSize + m.DroppedTotal.QueueFull + m.DroppedTotal.InflightExpired
+	return m.DroppedTotal.Internal + m.DroppedTotal.Expired + m.DroppedTotal.ExceedsMaxPacketSize + m.DroppedTotal.QueueFull + m.DroppedTotal.InflightExpired +
+		m.DroppedTotal.InflightTrimmed + m.DroppedTotal.WriteBufferFull
 }
 
 // MessageStats represents the statistics of PUBLISH in, separated by QOS.
@@ -354,12 +534,25 @@ type MessageStats struct {
 	Qos2            MessageQosStats
 	InflightCurrent uint64
 	QueuedCurrent   uint64
+	// OldestQueuedAt is the time when the oldest message waiting for delivery was added to the queue.
+	// In GlobalStats, it is the oldest among all clients.
+	// It is zero if there is no such message or the queue store does not implement queue.AgeReader.
+	OldestQueuedAt time.Time
 }
 
 func (m *MessageStats) GetDroppedTotal() uint64 {
 	return m.Qos0.GetDroppedTotal() + m.Qos1.GetDroppedTotal() + m.Qos2.GetDroppedTotal()
 }
 
+// OldestQueuedMessageAge returns how long the oldest message waiting for delivery has been queued at now.
+// A growing age means the client is falling behind.
+func (m *MessageStats) OldestQueuedMessageAge(now time.Time) time.Duration {
+	if m.OldestQueuedAt.IsZero() || now.Before(m.OldestQueuedAt) {
+		return 0
+	}
+	return now.Sub(m.OldestQueuedAt)
+}
+
 func (s *statsManager) addInflight(clientID string, delta uint64) {
 	s.clientMu.Lock()
 	defer s.clientMu.Unlock()
@@ -387,6 +580,10 @@ func (s *statsManager) addQueueLen(clientID string, delta uint64) {
 	sts := s.getClientStats(clientID)
 	atomic.AddUint64(&sts.MessageStats.QueuedCurrent, delta)
 	atomic.AddUint64(&s.totalStats.MessageStats.QueuedCurrent, delta)
+	if s.queueHighWaterMark != 0 && sts.aboveHighWaterSince.IsZero() &&
+		atomic.LoadUint64(&sts.MessageStats.QueuedCurrent) > s.queueHighWaterMark {
+		sts.aboveHighWaterSince = time.Now()
+	}
 }
 func (s *statsManager) decQueueLen(clientID string, delta uint64) {
 	s.clientMu.Lock()
@@ -400,6 +597,9 @@ func (s *statsManager) decQueueLen(clientID string, delta uint64) {
 	}
 	atomic.AddUint64(&sts.MessageStats.QueuedCurrent, ^uint64(delta-1))
 	atomic.AddUint64(&s.totalStats.MessageStats.QueuedCurrent, ^uint64(delta-1))
+	if atomic.LoadUint64(&sts.MessageStats.QueuedCurrent) <= s.queueHighWaterMark {
+		sts.aboveHighWaterSince = time.Time{}
+	}
 }
 
 func (m *MessageStats) copy() *MessageStats {
@@ -411,6 +611,8 @@ func (m *MessageStats) copy() *MessageStats {
 				QueueFull:            atomic.LoadUint64(&m.Qos0.DroppedTotal.QueueFull),
 				Expired:              atomic.LoadUint64(&m.Qos0.DroppedTotal.Expired),
 				InflightExpired:      atomic.LoadUint64(&m.Qos0.DroppedTotal.InflightExpired),
+				InflightTrimmed:      atomic.LoadUint64(&m.Qos0.DroppedTotal.InflightTrimmed),
+				WriteBufferFull:      atomic.LoadUint64(&m.Qos0.DroppedTotal.WriteBufferFull),
 			},
 			ReceivedTotal: atomic.LoadUint64(&m.Qos0.ReceivedTotal),
 			SentTotal:     atomic.LoadUint64(&m.Qos0.SentTotal),
@@ -422,6 +624,8 @@ func (m *MessageStats) copy() *MessageStats {
 				QueueFull:            atomic.LoadUint64(&m.Qos1.DroppedTotal.QueueFull),
 				Expired:              atomic.LoadUint64(&m.Qos1.DroppedTotal.Expired),
 				InflightExpired:      atomic.LoadUint64(&m.Qos1.DroppedTotal.InflightExpired),
+				InflightTrimmed:      atomic.LoadUint64(&m.Qos1.DroppedTotal.InflightTrimmed),
+				WriteBufferFull:      atomic.LoadUint64(&m.Qos1.DroppedTotal.WriteBufferFull),
 			},
 			ReceivedTotal: atomic.LoadUint64(&m.Qos1.ReceivedTotal),
 			SentTotal:     atomic.LoadUint64(&m.Qos1.SentTotal),
@@ -433,6 +637,8 @@ func (m *MessageStats) copy() *MessageStats {
 				QueueFull:            atomic.LoadUint64(&m.Qos2.DroppedTotal.QueueFull),
 				Expired:              atomic.LoadUint64(&m.Qos2.DroppedTotal.Expired),
 				InflightExpired:      atomic.LoadUint64(&m.Qos2.DroppedTotal.InflightExpired),
+				InflightTrimmed:      atomic.LoadUint64(&m.Qos2.DroppedTotal.InflightTrimmed),
+				WriteBufferFull:      atomic.LoadUint64(&m.Qos2.DroppedTotal.WriteBufferFull),
 			},
 			ReceivedTotal: atomic.LoadUint64(&m.Qos2.ReceivedTotal),
 			SentTotal:     atomic.LoadUint64(&m.Qos2.SentTotal),
@@ -448,6 +654,7 @@ type GlobalStats struct {
 	PacketStats       PacketStats
 	MessageStats      MessageStats
 	SubscriptionStats subscription.Stats
+	RetainedStats     retained.Stats
 }
 
 // ClientStats is the statistic information of one client.
@@ -455,6 +662,88 @@ type ClientStats struct {
 	PacketStats       PacketStats
 	MessageStats      MessageStats
 	SubscriptionStats subscription.Stats
+	// CPUStats is only available if config.CPUAccounting is enabled.
+	CPUStats         CPUStats
+	PublishRateStats PublishRateStats
+	// LastPacketReceivedAt is the time when the last packet (including PINGREQ) was received from the client.
+	LastPacketReceivedAt time.Time
+	// publishRate measures the inbound publish rate, it is guarded by statsManager.clientMu.
+	publishRate rateMeter
+	// subscriptionsTotalBase is the SubscriptionsTotal of the subscription store at the last reset,
+	// it is guarded by statsManager.clientMu.
+	subscriptionsTotalBase uint64
+	// aboveHighWaterSince is the time when the queue length exceeded the high-water mark of the slow consumer detector,
+	// zero if the queue length is below the mark. It is guarded by statsManager.clientMu.
+	aboveHighWaterSince time.Time
+}
+
+// PublishRateStats represents the inbound PUBLISH rate of the client, see config.PublishRateLimit.
+type PublishRateStats struct {
+	// MessagesPerSecond is the number of the PUBLISH packets received in the last second.
+	MessagesPerSecond uint64
+	// BytesPerSecond is the payload bytes of the PUBLISH packets received in the last second.
+	BytesPerSecond uint64
+	// LimitedTotal is the number of the PUBLISH packets which are dropped or rejected by the rate limit.
+	LimitedTotal uint64
+}
+
+// rateMeter counts the messages in one second windows, the rate is the count of the last complete window.
+type rateMeter struct {
+	// window is the start of the current window in unix seconds.
+	window       int64
+	messages     uint64
+	bytes        uint64
+	lastMessages uint64
+	lastBytes    uint64
+}
+
+func (r *rateMeter) roll(now time.Time) {
+	sec := now.Unix()
+	if sec == r.window {
+		return
+	}
+	if sec == r.window+1 {
+		r.lastMessages, r.lastBytes = r.messages, r.bytes
+	} else {
+		r.lastMessages, r.lastBytes = 0, 0
+	}
+	r.window = sec
+	r.messages, r.bytes = 0, 0
+}
+
+func (r *rateMeter) add(now time.Time, size int) {
+	r.roll(now)
+	r.messages++
+	r.bytes += uint64(size)
+}
+
+func (r *rateMeter) rate(now time.Time) (messages, bytes uint64) {
+	r.roll(now)
+	return r.lastMessages, r.lastBytes
+}
+
+// CPUStats represents the estimated time spent processing the packets of the client.
+type CPUStats struct {
+	// ReadNanoseconds is the time spent handling the packets received from the client.
+	ReadNanoseconds uint64
+	// WriteNanoseconds is the time spent writing the packets to the client.
+	WriteNanoseconds uint64
+}
+
+func (c *CPUStats) copy() *CPUStats {
+	return &CPUStats{
+		ReadNanoseconds:  atomic.LoadUint64(&c.ReadNanoseconds),
+		WriteNanoseconds: atomic.LoadUint64(&c.WriteNanoseconds),
+	}
+}
+
+func (c *ClientStats) copyPublishRateStats(now time.Time) PublishRateStats {
+	messages, bytes := c.publishRate.rate(now)
+	return PublishRateStats{
+		MessagesPerSecond: messages,
+		BytesPerSecond:    bytes,
+		LimitedTotal:      atomic.LoadUint64(&c.PublishRateStats.LimitedTotal),
+	}
 }
 
 func (c ClientStats) GetDroppedTotal() uint64 {
@@ -463,36 +752,71 @@ func (c ClientStats) GetDroppedTotal() uint64 {
 
 // GetGlobalStats returns the GlobalStats
 func (s *statsManager) GetGlobalStats() GlobalStats {
+	var rs retained.Stats
+	if s.retainedStatsReader != nil {
+		rs = s.retainedStatsReader.GetStats()
+	}
+	ms := *s.totalStats.MessageStats.copy()
+	ms.OldestQueuedAt = s.globalOldestQueuedAt()
+	cs := *s.totalStats.ConnectionStats.copy()
+	if s.connectionsReader != nil {
+		cs.ConnectionsCurrent = s.connectionsReader()
+	}
 	return GlobalStats{
 		PacketStats:       *s.totalStats.PacketStats.copy(),
-		ConnectionStats:   *s.totalStats.ConnectionStats.copy(),
-		MessageStats:      *s.totalStats.MessageStats.copy(),
+		ConnectionStats:   cs,
+		MessageStats:      ms,
 		SubscriptionStats: s.subStatsReader.GetStats(),
+		RetainedStats:     rs,
 	}
 }
 
 // GetClientStats returns the client statistic information for given client id.
 func (s *statsManager) GetClientStats(clientID string) (ClientStats, bool) {
+	rs, ok := s.copyClientStats(clientID)
+	// read the queue age without holding clientMu,
+	// because the queue store calls the notifier which acquires clientMu while holding its own lock.
+	if ok {
+		rs.MessageStats.OldestQueuedAt = s.oldestQueuedAt(clientID)
+	}
+	return rs, ok
+}
+
+func (s *statsManager) copyClientStats(clientID string) (ClientStats, bool) {
 	s.clientMu.Lock()
 	defer s.clientMu.Unlock()
+	return s.copyClientStatsLocked(clientID)
+}
+
+func (s *statsManager) copyClientStatsLocked(clientID string) (ClientStats, bool) {
 	if stats := s.clientStats[clientID]; stats == nil {
 		return ClientStats{}, false
 	} else {
 		s, _ := s.subStatsReader.GetClientStats(clientID)
+		// the subscription statistics are maintained by the subscription store, see ResetClientStats.
+		if s.SubscriptionsTotal >= stats.subscriptionsTotalBase {
+			s.SubscriptionsTotal -= stats.subscriptionsTotalBase
+		} else {
+			s.SubscriptionsTotal = 0
+		}
 		return ClientStats{
-			PacketStats:       *stats.PacketStats.copy(),
-			MessageStats:      *stats.MessageStats.copy(),
-			SubscriptionStats: s,
+			PacketStats:          *stats.PacketStats.copy(),
+			MessageStats:         *stats.MessageStats.copy(),
+			SubscriptionStats:    s,
+			CPUStats:             *stats.CPUStats.copy(),
+			PublishRateStats:     stats.copyPublishRateStats(time.Now()),
+			LastPacketReceivedAt: stats.LastPacketReceivedAt,
 		}, true
 	}
-
 }
 
 func newStatsManager(subStatsReader subscription.StatsReader) *statsManager {
 	return &statsManager{
-		subStatsReader: subStatsReader,
-		totalStats:     &GlobalStats{},
-		clientMu:       sync.Mutex{},
-		clientStats:    make(map[string]*ClientStats),
+		subStatsReader:  subStatsReader,
+		totalStats:      &GlobalStats{},
+		clientMu:        sync.Mutex{},
+		clientStats:     make(map[string]*ClientStats),
+		queueAgeReaders: make(map[string]queue.AgeReader),
+		intervalStart:   time.Now(),
 	}
 }
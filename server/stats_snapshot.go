@@ -0,0 +1,177 @@
+package server
+
+import (
+	"time"
+
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/retained"
+)
+
+// StatsSnapshot is the snapshot of the global statistics.
+//
+// The statistics are separated into two kinds:
+// 1. Counters, e.g: ConnectionStats.ConnectedTotal, PacketStats, MessageStats.Qos0.ReceivedTotal.
+// They are monotonic in Lifetime and resettable in Interval.
+// 2. Gauges, the fields with "Current" suffix, ConnectionStats.ReconnectStormMitigating and ConnectionStats.PersistenceUnhealthy.
+// They represent the current state, thus they are the same in Lifetime and Interval and never reset.
+type StatsSnapshot struct {
+	// Lifetime is the statistics since the server started, it is never reset.
+	Lifetime GlobalStats
+	// Interval is the statistics since the last reset, or since the server started if it has never been reset.
+	Interval GlobalStats
+	// IntervalStart is the start time of Interval.
+	IntervalStart time.Time
+}
+
+// StatsResetter is an optional interface for StatsReader to provide the resettable interval statistics.
+type StatsResetter interface {
+	// SnapshotStats returns the snapshot of the global statistics.
+	// If reset is true, the interval counters will be reset atomically after read,
+	// that is, every increment is counted in exactly one interval.
+	SnapshotStats(reset bool) StatsSnapshot
+}
+
+// ClientStatsResetter is an optional interface for StatsReader to reset the client statistics.
+type ClientStatsResetter interface {
+	// ResetClientStats returns the statistics of the client and resets its counters atomically,
+	// that is, every increment is counted either in the returned statistics or after the reset.
+	// The gauges and the publish rates are not reset.
+	// It returns false if the client does not exist.
+	ResetClientStats(clientID string) (sts ClientStats, exist bool)
+}
+
+var _ StatsResetter = (*statsManager)(nil)
+var _ ClientStatsResetter = (*statsManager)(nil)
+
+// SnapshotStats implements StatsResetter.
+func (s *statsManager) SnapshotStats(reset bool) StatsSnapshot {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	now := s.GetGlobalStats()
+	rs := StatsSnapshot{
+		Lifetime:      now,
+		Interval:      now.sub(s.intervalBase),
+		IntervalStart: s.intervalStart,
+	}
+	if reset {
+		s.intervalBase = now
+		s.intervalStart = time.Now()
+	}
+	return rs
+}
+
+// ResetClientStats implements ClientStatsResetter.
+func (s *statsManager) ResetClientStats(clientID string) (ClientStats, bool) {
+	s.clientMu.Lock()
+	rs, ok := s.copyClientStatsLocked(clientID)
+	if ok {
+		// all updates of the client statistics hold clientMu, so no increment is lost.
+		stats := s.clientStats[clientID]
+		stats.PacketStats = PacketStats{}
+		stats.MessageStats.Qos0 = MessageQosStats{}
+		stats.MessageStats.Qos1 = MessageQosStats{}
+		stats.MessageStats.Qos2 = MessageQosStats{}
+		stats.CPUStats = CPUStats{}
+		stats.PublishRateStats.LimitedTotal = 0
+		stats.subscriptionsTotalBase += rs.SubscriptionStats.SubscriptionsTotal
+	}
+	s.clientMu.Unlock()
+	// read the queue age without holding clientMu, see GetClientStats.
+	if ok {
+		rs.MessageStats.OldestQueuedAt = s.oldestQueuedAt(clientID)
+	}
+	return rs, ok
+}
+
+// sub returns the statistics that all counters are subtracted by base, the gauges are kept.
+func (g GlobalStats) sub(base GlobalStats) GlobalStats {
+	return GlobalStats{
+		ConnectionStats:   g.ConnectionStats.sub(base.ConnectionStats),
+		PacketStats:       g.PacketStats.sub(base.PacketStats),
+		MessageStats:      g.MessageStats.sub(base.MessageStats),
+		SubscriptionStats: subSubscriptionStats(g.SubscriptionStats, base.SubscriptionStats),
+		RetainedStats:     subRetainedStats(g.RetainedStats, base.RetainedStats),
+	}
+}
+
+func (c ConnectionStats) sub(base ConnectionStats) ConnectionStats {
+	rs := c
+	rs.ConnectedTotal -= base.ConnectedTotal
+	rs.DisconnectedTotal -= base.DisconnectedTotal
+	rs.SessionCreatedTotal -= base.SessionCreatedTotal
+	rs.SessionTerminated.TakenOver -= base.SessionTerminated.TakenOver
+	rs.SessionTerminated.Expired -= base.SessionTerminated.Expired
+	rs.SessionTerminated.Normal -= base.SessionTerminated.Normal
+	rs.ReconnectStormRejectedTotal -= base.ReconnectStormRejectedTotal
+	rs.ErrorLogsSuppressedTotal -= base.ErrorLogsSuppressedTotal
+	rs.PersistenceRejectedTotal -= base.PersistenceRejectedTotal
+	rs.SubscriptionsRejectedTotal -= base.SubscriptionsRejectedTotal
+	return rs
+}
+
+func (p PacketStats) sub(base PacketStats) PacketStats {
+	return PacketStats{
+		BytesReceived: p.BytesReceived.sub(base.BytesReceived),
+		ReceivedTotal: p.ReceivedTotal.sub(base.ReceivedTotal),
+		BytesSent:     p.BytesSent.sub(base.BytesSent),
+		SentTotal:     p.SentTotal.sub(base.SentTotal),
+	}
+}
+
+func (p PacketBytes) sub(base PacketBytes) PacketBytes {
+	return PacketBytes{
+		Auth:        p.Auth - base.Auth,
+		Connect:     p.Connect - base.Connect,
+		Connack:     p.Connack - base.Connack,
+		Disconnect:  p.Disconnect - base.Disconnect,
+		Pingreq:     p.Pingreq - base.Pingreq,
+		Pingresp:    p.Pingresp - base.Pingresp,
+		Puback:      p.Puback - base.Puback,
+		Pubcomp:     p.Pubcomp - base.Pubcomp,
+		Publish:     p.Publish - base.Publish,
+		Pubrec:      p.Pubrec - base.Pubrec,
+		Pubrel:      p.Pubrel - base.Pubrel,
+		Suback:      p.Suback - base.Suback,
+		Subscribe:   p.Subscribe - base.Subscribe,
+		Unsuback:    p.Unsuback - base.Unsuback,
+		Unsubscribe: p.Unsubscribe - base.Unsubscribe,
+		Total:       p.Total - base.Total,
+	}
+}
+
+func (m MessageStats) sub(base MessageStats) MessageStats {
+	rs := m
+	rs.Qos0 = m.Qos0.sub(base.Qos0)
+	rs.Qos1 = m.Qos1.sub(base.Qos1)
+	rs.Qos2 = m.Qos2.sub(base.Qos2)
+	return rs
+}
+
+func (m MessageQosStats) sub(base MessageQosStats) MessageQosStats {
+	return MessageQosStats{
+		DroppedTotal: DroppedTotal{
+			Internal:             m.DroppedTotal.Internal - base.DroppedTotal.Internal,
+			ExceedsMaxPacketSize: m.DroppedTotal.ExceedsMaxPacketSize - base.DroppedTotal.ExceedsMaxPacketSize,
+			QueueFull:            m.DroppedTotal.QueueFull - base.DroppedTotal.QueueFull,
+			Expired:              m.DroppedTotal.Expired - base.DroppedTotal.Expired,
+			InflightExpired:      m.DroppedTotal.InflightExpired - base.DroppedTotal.InflightExpired,
+			InflightTrimmed:      m.DroppedTotal.InflightTrimmed - base.DroppedTotal.InflightTrimmed,
+			WriteBufferFull:      m.DroppedTotal.WriteBufferFull - base.DroppedTotal.WriteBufferFull,
+		},
+		ReceivedTotal: m.ReceivedTotal - base.ReceivedTotal,
+		SentTotal:     m.SentTotal - base.SentTotal,
+	}
+}
+
+func subSubscriptionStats(s, base subscription.Stats) subscription.Stats {
+	rs := s
+	rs.SubscriptionsTotal -= base.SubscriptionsTotal
+	return rs
+}
+
+func subRetainedStats(s, base retained.Stats) retained.Stats {
+	rs := s
+	rs.EvictedTotal -= base.EvictedTotal
+	rs.RejectedTotal -= base.RejectedTotal
+	return rs
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/retained"
+)
+
+func TestStatsManager_SnapshotStats(t *testing.T) {
+	a := assert.New(t)
+	s := newStatsManager(mem.NewStore())
+	start := s.SnapshotStats(false).IntervalStart
+	a.False(start.IsZero())
+
+	s.clientConnected("cid")
+	s.packetReceived(&packets.Pingreq{}, "cid")
+	s.messageReceived(packets.Qos1, "cid")
+	s.addInflight("cid", 1)
+
+	snapshot := s.SnapshotStats(true)
+	a.Equal(snapshot.Lifetime, snapshot.Interval)
+	a.Equal(start, snapshot.IntervalStart)
+	a.EqualValues(1, snapshot.Interval.ConnectionStats.ConnectedTotal)
+
+	s.clientConnected("cid")
+	s.messageReceived(packets.Qos1, "cid")
+
+	snapshot = s.SnapshotStats(false)
+	a.True(snapshot.IntervalStart.After(start))
+	// monotonic
+	a.EqualValues(2, snapshot.Lifetime.ConnectionStats.ConnectedTotal)
+	a.EqualValues(2, snapshot.Lifetime.MessageStats.Qos1.ReceivedTotal)
+	a.EqualValues(1, snapshot.Lifetime.PacketStats.ReceivedTotal.Total)
+	// resettable
+	a.EqualValues(1, snapshot.Interval.ConnectionStats.ConnectedTotal)
+	a.EqualValues(1, snapshot.Interval.MessageStats.Qos1.ReceivedTotal)
+	a.EqualValues(0, snapshot.Interval.PacketStats.ReceivedTotal.Total)
+	// gauges are never reset
+	a.EqualValues(1, snapshot.Lifetime.MessageStats.InflightCurrent)
+	a.EqualValues(1, snapshot.Interval.MessageStats.InflightCurrent)
+
+	s.SnapshotStats(true)
+	snapshot = s.SnapshotStats(false)
+	a.EqualValues(0, snapshot.Interval.ConnectionStats.ConnectedTotal)
+	a.EqualValues(0, snapshot.Interval.MessageStats.Qos1.ReceivedTotal)
+	a.EqualValues(2, snapshot.Lifetime.ConnectionStats.ConnectedTotal)
+	a.EqualValues(1, snapshot.Interval.MessageStats.InflightCurrent)
+	a.Equal(s.GetGlobalStats(), snapshot.Lifetime)
+}
+
+func TestSubRetainedStats(t *testing.T) {
+	a := assert.New(t)
+	rs := subRetainedStats(retained.Stats{
+		RetainedMessages: 3,
+		RetainedBytes:    30,
+		EvictedTotal:     5,
+		RejectedTotal:    4,
+	}, retained.Stats{
+		RetainedMessages: 1,
+		RetainedBytes:    10,
+		EvictedTotal:     2,
+		RejectedTotal:    1,
+	})
+	// the gauges are kept, the counters are subtracted.
+	a.Equal(retained.Stats{
+		RetainedMessages: 3,
+		RetainedBytes:    30,
+		EvictedTotal:     3,
+		RejectedTotal:    3,
+	}, rs)
+}
+
+func TestStatsManager_ResetClientStats(t *testing.T) {
+	a := assert.New(t)
+	subStore := mem.NewStore()
+	s := newStatsManager(subStore)
+	_, ok := s.ResetClientStats("cid")
+	a.False(ok)
+
+	_, err := subStore.Subscribe("cid", &gmqtt.Subscription{TopicFilter: "a"}, &gmqtt.Subscription{TopicFilter: "b"})
+	a.Nil(err)
+	s.packetReceived(&packets.Pingreq{}, "cid")
+	s.messageDropped(packets.Qos1, "cid", nil)
+	s.cpuTimeSpent("cid", true, 10)
+	s.publishLimited("cid")
+	s.addInflight("cid", 1)
+	s.addQueueLen("cid", 2)
+
+	sts, ok := s.ResetClientStats("cid")
+	a.True(ok)
+	a.EqualValues(1, sts.PacketStats.ReceivedTotal.Total)
+	a.EqualValues(1, sts.MessageStats.GetDroppedTotal())
+	a.EqualValues(10, sts.CPUStats.ReadNanoseconds)
+	a.EqualValues(1, sts.PublishRateStats.LimitedTotal)
+	a.EqualValues(2, sts.SubscriptionStats.SubscriptionsTotal)
+
+	sts, ok = s.GetClientStats("cid")
+	a.True(ok)
+	a.Zero(sts.PacketStats.ReceivedTotal.Total)
+	a.Zero(sts.MessageStats.GetDroppedTotal())
+	a.Zero(sts.CPUStats.ReadNanoseconds)
+	a.Zero(sts.PublishRateStats.LimitedTotal)
+	a.Zero(sts.SubscriptionStats.SubscriptionsTotal)
+	// gauges are never reset
+	a.EqualValues(2, sts.SubscriptionStats.SubscriptionsCurrent)
+	a.EqualValues(1, sts.MessageStats.InflightCurrent)
+	a.EqualValues(2, sts.MessageStats.QueuedCurrent)
+	a.False(sts.LastPacketReceivedAt.IsZero())
+
+	_, err = subStore.Subscribe("cid", &gmqtt.Subscription{TopicFilter: "c"})
+	a.Nil(err)
+	sts, _ = s.GetClientStats("cid")
+	a.EqualValues(1, sts.SubscriptionStats.SubscriptionsTotal)
+	a.EqualValues(3, sts.SubscriptionStats.SubscriptionsCurrent)
+}
+
+func TestStatsManager_ResetClientStats_concurrent(t *testing.T) {
+	a := assert.New(t)
+	s := newStatsManager(mem.NewStore())
+	s.packetReceived(&packets.Pingreq{}, "cid")
+	const workers, n = 4, 1000
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				s.packetReceived(&packets.Pingreq{}, "cid")
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	var total uint64
+	for stop := false; !stop; {
+		select {
+		case <-done:
+			stop = true
+		default:
+		}
+		sts, ok := s.ResetClientStats("cid")
+		a.True(ok)
+		total += sts.PacketStats.ReceivedTotal.Total
+	}
+	// every increment is counted in exactly one reset.
+	a.EqualValues(workers*n+1, total)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// ageQueue is a queue.Store which reports the enqueue time of the head message.
+type ageQueue struct {
+	queue.Store
+	mu     sync.Mutex
+	headAt time.Time
+}
+
+func (q *ageQueue) OldestQueuedAt() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.headAt
+}
+
+func TestStatsManager_oldestQueuedMessageAge(t *testing.T) {
+	a := assert.New(t)
+	sm := newStatsManager(mem.NewStore())
+	sm.addQueueLen("cid", 1)
+	sm.addQueueLen("cid2", 1)
+
+	now := time.Now()
+	q := &ageQueue{headAt: now}
+	sm.setQueueStore("cid", q)
+	sm.setQueueStore("cid2", &ageQueue{headAt: now.Add(-time.Second)})
+
+	sts, ok := sm.GetClientStats("cid")
+	a.True(ok)
+	age := sts.MessageStats.OldestQueuedMessageAge(time.Now())
+	time.Sleep(10 * time.Millisecond)
+	// the age increases as the head message waits.
+	sts, _ = sm.GetClientStats("cid")
+	a.True(sts.MessageStats.OldestQueuedMessageAge(time.Now()) > age)
+	a.Equal(now, sts.MessageStats.OldestQueuedAt)
+	a.Equal(now.Add(-time.Second), sm.GetGlobalStats().MessageStats.OldestQueuedAt)
+
+	// the head message has been delivered.
+	q.mu.Lock()
+	q.headAt = time.Time{}
+	q.mu.Unlock()
+	sts, _ = sm.GetClientStats("cid")
+	a.EqualValues(0, sts.MessageStats.OldestQueuedMessageAge(time.Now()))
+
+	sm.removeQueueStore("cid2")
+	a.True(sm.GetGlobalStats().MessageStats.OldestQueuedAt.IsZero())
+}
+
+func TestStatsManager_publishRate(t *testing.T) {
+	a := assert.New(t)
+	var r rateMeter
+	now := time.Unix(100, 0)
+	r.add(now, 10)
+	r.add(now.Add(500*time.Millisecond), 20)
+	m, b := r.rate(now.Add(900 * time.Millisecond))
+	a.EqualValues(0, m)
+	a.EqualValues(0, b)
+	m, b = r.rate(now.Add(1500 * time.Millisecond))
+	a.EqualValues(2, m)
+	a.EqualValues(30, b)
+	// no message in the last second.
+	m, b = r.rate(now.Add(2500 * time.Millisecond))
+	a.EqualValues(0, m)
+	a.EqualValues(0, b)
+}
+
+func TestStatsManager_lastPacketReceivedAt(t *testing.T) {
+	a := assert.New(t)
+	sm := newStatsManager(mem.NewStore())
+	sm.packetSent(&packets.Pingresp{}, "cid")
+	sts, _ := sm.GetClientStats("cid")
+	a.True(sts.LastPacketReceivedAt.IsZero())
+
+	// PINGREQ counts as activity.
+	before := time.Now()
+	sm.packetReceived(&packets.Pingreq{}, "cid")
+	sts, _ = sm.GetClientStats("cid")
+	a.False(sts.LastPacketReceivedAt.Before(before))
+}
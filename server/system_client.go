@@ -0,0 +1,26 @@
+package server
+
+import (
+	"time"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// newSystemClient returns the detachedClient which represents the broker itself.
+func newSystemClient(clientID string) *detachedClient {
+	return &detachedClient{
+		opts: &ClientOptions{
+			ClientID: clientID,
+		},
+		version:     packets.Version5,
+		connectedAt: time.Now(),
+		system:      true,
+	}
+}
+
+// IsSystemClient reports whether the client is the system client, see config.MQTT.SystemClientID.
+// The hooks can use it to recognize the broker-generated messages, and optionally trust them.
+func IsSystemClient(client Client) bool {
+	d, ok := client.(*detachedClient)
+	return ok && d.system
+}
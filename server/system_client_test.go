@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestPublishService_Publish_systemClient(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	q := &countQueue{}
+	srv.queueStore["sub"] = q
+	srv.subscriptionsDB.Subscribe("sub", &gmqtt.Subscription{
+		TopicFilter: "#",
+		QoS:         packets.Qos1,
+	})
+
+	var arrived Client
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		arrived = client
+		if req.Message.Topic == "denied" {
+			return errors.New("denied")
+		}
+		return nil
+	}
+
+	// the broker-generated messages bypass the hook if the system client is not configured.
+	srv.Publisher().Publish(&gmqtt.Message{Topic: "a"})
+	a.Nil(arrived)
+	a.EqualValues(1, q.added)
+
+	srv.systemClient = newSystemClient("$gmqtt")
+	srv.Publisher().Publish(&gmqtt.Message{Topic: "a"})
+	a.True(IsSystemClient(arrived))
+	a.Equal("$gmqtt", arrived.ClientOptions().ClientID)
+	a.EqualValues(2, q.added)
+
+	srv.Publisher().Publish(&gmqtt.Message{Topic: "denied"})
+	a.EqualValues(2, q.added)
+
+	// the detached clients of the real clients are not the system client.
+	a.False(IsSystemClient(&detachedClient{opts: &ClientOptions{ClientID: "$gmqtt"}}))
+}
+
+func TestPublishService_PublishRetained(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	srv.config().TopicPolicy.Rules = []config.TopicPolicyRule{{TopicFilter: "cmd/#", NoRetain: true}}
+	srv.config().MQTT.MaxRetainedMessageBytes = 3
+	srv.config().MQTT.RetainedLimitNack = true
+	srv.applyRetainedLimits(srv.config().MQTT)
+	q := &countQueue{}
+	srv.queueStore["sub"] = q
+	srv.subscriptionsDB.Subscribe("sub", &gmqtt.Subscription{
+		TopicFilter: "#",
+		QoS:         packets.Qos1,
+	})
+	srv.systemClient = newSystemClient("$gmqtt")
+	srv.hooks.OnMsgArrived = func(ctx context.Context, client Client, req *MsgArrivedRequest) error {
+		if req.Message.Topic == "denied" {
+			return errors.New("denied")
+		}
+		req.Message.Payload = bytes.ToUpper(req.Message.Payload)
+		return nil
+	}
+	pub := srv.Publisher()
+
+	// the message returned by the hook is retained.
+	a.Nil(pub.PublishRetained(&gmqtt.Message{Topic: "a", Payload: []byte("abc"), Retained: true}))
+	if rm := srv.retainedDB.GetRetainedMessage("a"); a.NotNil(rm) {
+		a.Equal([]byte("ABC"), rm.Payload)
+	}
+	a.EqualValues(1, q.added)
+
+	// the rejected messages are neither retained nor delivered.
+	a.NotNil(pub.PublishRetained(&gmqtt.Message{Topic: "denied", Payload: []byte("abc"), Retained: true}))
+	a.NotNil(pub.PublishRetained(&gmqtt.Message{Topic: "cmd/a", Payload: []byte("abc"), Retained: true}))
+	a.NotNil(pub.PublishRetained(&gmqtt.Message{Topic: "b", Payload: []byte("abcd"), Retained: true}))
+	a.Nil(srv.retainedDB.GetRetainedMessage("denied"))
+	a.Nil(srv.retainedDB.GetRetainedMessage("cmd/a"))
+	a.Nil(srv.retainedDB.GetRetainedMessage("b"))
+	a.EqualValues(1, q.added)
+
+	// the empty payload removes the retained message.
+	a.Nil(pub.PublishRetained(&gmqtt.Message{Topic: "a", Retained: true}))
+	a.Nil(srv.retainedDB.GetRetainedMessage("a"))
+	a.EqualValues(2, q.added)
+
+	// Publish does not store the retained message.
+	pub.Publish(&gmqtt.Message{Topic: "c", Payload: []byte("abc"), Retained: true})
+	a.Nil(srv.retainedDB.GetRetainedMessage("c"))
+	a.EqualValues(3, q.added)
+}
+
+func TestClient_connectHandler_systemClientID(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.config().MQTT.SystemClientID = "$gmqtt"
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+
+	for _, v := range []struct {
+		version packets.Version
+		code    codes.Code
+	}{
+		{version: packets.Version5, code: codes.ClientIdentifierNotValid},
+		{version: packets.Version311, code: codes.V3IdentifierRejected},
+	} {
+		conn := &packets.Connect{
+			Version:  v.version,
+			ClientID: []byte("$gmqtt"),
+		}
+		if v.version == packets.Version5 {
+			conn.Properties = &packets.Properties{}
+		}
+		_, _, err = c.connectHandler(conn)
+		a.Equal(v.code, converError(err).Code)
+	}
+}
@@ -8,7 +8,7 @@ import (
 type NewTopicAliasManager func(config config.Config, maxAlias uint16, clientID string) TopicAliasManager
 
 // TopicAliasManager manage the topic alias for a V5 client.
-// see topicalias/fifo for more details.
+// see topicalias/fifo and topicalias/lru for more details.
 type TopicAliasManager interface {
 	// Check return the alias number and whether the alias exist.
 	// For examples:
@@ -18,3 +18,16 @@ type TopicAliasManager interface {
 	// If the Publish alias not exist, but the manager decides not to assign alias, it return the 0 and false.
 	Check(publish *packets.Publish) (alias uint16, exist bool)
 }
+
+// TopicAliasPrimer is an optional interface for TopicAliasManager to support config.TopicAliasManager.PrimeOnResume.
+// The topic aliases are only valid within a network connection, so the primed aliases are not known by the client
+// until the full topic name is sent with the alias again.
+type TopicAliasPrimer interface {
+	// HotTopics returns the topics which have aliases, the most used topic first.
+	// It is called when the client disconnects and the session is stored.
+	HotTopics() []string
+	// Prime assigns the aliases to the given topics in order when the session resumes.
+	// Check must return the primed alias and false on the first use of each primed alias,
+	// so that the full topic name is sent to establish the alias.
+	Prime(topics []string)
+}
@@ -0,0 +1,20 @@
+package server
+
+import "net"
+
+// topicAliasMaxListener is a net.Listener which overrides the Topic Alias Maximum of the accepted connections.
+type topicAliasMaxListener struct {
+	net.Listener
+	max uint16
+}
+
+// NewTopicAliasMaxListener returns a net.Listener which overrides config.MQTT.TopicAliasMax for the connections accepted by it.
+// The value is advertised in the CONNACK Topic Alias Maximum property, and the PUBLISH packets with a Topic Alias
+// greater than it are treated as a protocol error. 0 disables the inbound topic alias of the listener.
+// The OnBasicAuth and OnEnhancedAuth hooks can still override it by AuthOptions.TopicAliasMax.
+func NewTopicAliasMaxListener(l net.Listener, max uint16) net.Listener {
+	return &topicAliasMaxListener{
+		Listener: l,
+		max:      max,
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestNewTopicAliasMaxListener(t *testing.T) {
+	a := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer l.Close()
+	s := newTCPListenerState(NewNamedListener(NewTopicAliasMaxListener(l, 0), "public"))
+	a.Equal("public", s.name)
+	if a.NotNil(s.topicAliasMax) {
+		a.EqualValues(0, *s.topicAliasMax)
+	}
+	conn := &packets.Connect{
+		Version:    packets.Version5,
+		ClientID:   []byte("cid"),
+		Properties: &packets.Properties{},
+	}
+	srv := defaultServer()
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version5
+	s.bind(c)
+	a.EqualValues(0, c.defaultAuthOptions(conn).TopicAliasMax)
+
+	// no override
+	c, err = srv.newClient(noopConn{})
+	a.Nil(err)
+	c.version = packets.Version5
+	newWebsocketState(&WsServer{Server: &http.Server{}}).bind(c)
+	a.Equal(srv.config().MQTT.TopicAliasMax, c.defaultAuthOptions(conn).TopicAliasMax)
+
+	max := uint16(3)
+	newWebsocketState(&WsServer{Server: &http.Server{}, TopicAliasMax: &max}).bind(c)
+	a.EqualValues(3, c.defaultAuthOptions(conn).TopicAliasMax)
+}
+
+func TestClient_writeLoop_topicAlias(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	c, err := srv.newClient(sc)
+	a.Nil(err)
+	c.version = packets.Version5
+	c.opts.ClientTopicAliasMax = 1
+	mgr := NewMockTopicAliasManager(ctrl)
+	c.topicAliasManager = mgr
+	gomock.InOrder(
+		mgr.EXPECT().Check(gomock.Any()).Return(uint16(1), false),
+		mgr.EXPECT().Check(gomock.Any()).Return(uint16(1), true),
+	)
+	var delivered []*gmqtt.Message
+	srv.hooks.OnDelivered = func(ctx context.Context, client Client, msg *gmqtt.Message) {
+		delivered = append(delivered, msg)
+		// the hook must not clobber the packet being sent.
+		msg.CorrelationData[0] = 'x'
+	}
+	go c.writeLoop()
+	defer c.setError(nil)
+
+	r := packets.NewReader(cc)
+	r.SetVersion(packets.Version5)
+	for i := 0; i < 2; i++ {
+		c.out <- &packets.Publish{
+			Version:    packets.Version5,
+			TopicName:  []byte("hot"),
+			Payload:    []byte("payload"),
+			Properties: &packets.Properties{
+				ResponseTopic:   []byte("reply"),
+				CorrelationData: []byte("id"),
+			},
+		}
+		p, err := r.ReadPacket()
+		a.Nil(err)
+		pub := p.(*packets.Publish)
+		a.EqualValues(1, *pub.Properties.TopicAlias)
+		// the request/response properties survive the topic alias substitution.
+		a.Equal([]byte("reply"), pub.Properties.ResponseTopic)
+		a.Equal([]byte("id"), pub.Properties.CorrelationData)
+		if a.Len(delivered, i+1) {
+			// the hook receives the full topic name.
+			a.Equal("hot", delivered[i].Topic)
+		}
+		if i == 0 {
+			// the full topic name is sent to establish the alias.
+			a.Equal([]byte("hot"), pub.TopicName)
+		} else {
+			// the alias is reused.
+			a.Empty(pub.TopicName)
+		}
+	}
+}
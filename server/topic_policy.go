@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// TopicPolicy is the message-property policy of a topic, see config.TopicPolicy.
+type TopicPolicy struct {
+	// MinQoS is the minimum QoS of the messages.
+	MinQoS uint8
+	// MaxQoS is the maximum QoS of the messages.
+	MaxQoS uint8
+	// NoRetain indicates whether the messages must not be retained.
+	NoRetain bool
+}
+
+// levelRank returns the specificity of a topic filter level.
+func levelRank(level string) int {
+	switch level {
+	case "#":
+		return 0
+	case "+":
+		return 1
+	}
+	return 2
+}
+
+// moreSpecific reports whether the topic filter a is more specific than b, both of them match the same topic name.
+// The filters are compared level by level, a literal level is more specific than "+", which is more specific than "#".
+func moreSpecific(a, b string) bool {
+	la, lb := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if ra, rb := levelRank(la[i]), levelRank(lb[i]); ra != rb {
+			return ra > rb
+		}
+	}
+	// the extra level of the longer filter must be "#", which matches the parent level.
+	return len(la) < len(lb)
+}
+
+// matchTopicPolicyRule returns the most specific rule which matches the topic name, nil if not found.
+func matchTopicPolicyRule(rules []config.TopicPolicyRule, topic string) *config.TopicPolicyRule {
+	var rs *config.TopicPolicyRule
+	for i := range rules {
+		r := &rules[i]
+		if !packets.TopicMatch([]byte(topic), []byte(r.TopicFilter)) {
+			continue
+		}
+		if rs == nil || moreSpecific(r.TopicFilter, rs.TopicFilter) {
+			rs = r
+		}
+	}
+	return rs
+}
+
+// topicPolicy is the default topic policy, see config.TopicPolicy.
+func (srv *server) topicPolicy(ctx context.Context, client Client, topic string) *TopicPolicy {
+	rule := matchTopicPolicyRule(srv.config().TopicPolicy.Rules, topic)
+	if rule == nil {
+		return nil
+	}
+	p := &TopicPolicy{
+		MinQoS:   rule.MinQoS,
+		MaxQoS:   packets.Qos2,
+		NoRetain: rule.NoRetain,
+	}
+	if rule.MaxQoS != nil {
+		p.MaxQoS = *rule.MaxQoS
+	}
+	return p
+}
+
+// checkTopicPolicy returns the error to reject the message if it violates the policy of the topic.
+func (client *client) checkTopicPolicy(msg *gmqtt.Message) error {
+	return client.server.checkTopicPolicy(client, msg)
+}
+
+// checkTopicPolicy returns the error to reject the message published by the client if it violates the policy of the topic,
+// the client is nil for the broker-generated messages if config.MQTT.SystemClientID is not set.
+func (srv *server) checkTopicPolicy(client Client, msg *gmqtt.Message) error {
+	hook := srv.hooks.OnTopicPolicy
+	if hook == nil {
+		hook = srv.topicPolicy
+	}
+	p := hook(context.Background(), client, msg.Topic)
+	if p == nil {
+		return nil
+	}
+	var reason string
+	if msg.QoS < p.MinQoS || msg.QoS > p.MaxQoS {
+		reason = fmt.Sprintf("QoS %d is not allowed on the topic, the QoS must be in [%d, %d]", msg.QoS, p.MinQoS, p.MaxQoS)
+	} else if msg.Retained && p.NoRetain {
+		reason = "retain is not allowed on the topic"
+	} else {
+		return nil
+	}
+	return &codes.Error{
+		Code: codes.ImplementationSpecificError,
+		ErrorDetails: codes.ErrorDetails{
+			ReasonString: []byte(reason),
+		},
+	}
+}
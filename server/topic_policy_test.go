@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestMatchTopicPolicyRule(t *testing.T) {
+	a := assert.New(t)
+	rules := []config.TopicPolicyRule{
+		{TopicFilter: "#"},
+		{TopicFilter: "cmd/#"},
+		{TopicFilter: "cmd/+"},
+		{TopicFilter: "cmd/+/#"},
+		{TopicFilter: "cmd/a/+"},
+		{TopicFilter: "+/a/b"},
+		{TopicFilter: "cmd/a/b"},
+	}
+	for topic, expected := range map[string]string{
+		"cmd/a/b": "cmd/a/b",
+		"cmd/a/c": "cmd/a/+",
+		"cmd/b/c": "cmd/+/#",
+		"cmd/b":   "cmd/+",
+		"cmd":     "cmd/#",
+		"x/a/b":   "+/a/b",
+		"x":       "#",
+	} {
+		r := matchTopicPolicyRule(rules, topic)
+		if a.NotNil(r, topic) {
+			a.Equal(expected, r.TopicFilter, topic)
+		}
+	}
+	a.Nil(matchTopicPolicyRule(rules, "$SYS/a"))
+	a.Nil(matchTopicPolicyRule(nil, "cmd"))
+}
+
+func TestClient_publishHandler_topicPolicy(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	qos0 := packets.Qos0
+	srv.config().TopicPolicy = config.TopicPolicy{
+		Rules: []config.TopicPolicyRule{
+			{TopicFilter: "cmd/#", MinQoS: packets.Qos1, NoRetain: true},
+			{TopicFilter: "cmd/telemetry", MaxQoS: &qos0},
+		},
+	}
+	_, err := srv.subscriptionsDB.Subscribe("sub", &gmqtt.Subscription{TopicFilter: "#", QoS: packets.Qos1})
+	a.Nil(err)
+	var received []string
+	mockQueue := queue.NewMockStore(ctrl)
+	mockQueue.EXPECT().Add(gomock.Any()).Do(func(elem *queue.Elem) {
+		received = append(received, elem.MessageWithID.(*queue.Publish).Topic)
+	}).AnyTimes()
+	srv.queueStore["sub"] = mockQueue
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	c.opts.RetainAvailable = true
+	c.opts.RequestProblemInfo = true
+	c.version = packets.Version5
+
+	publish := func(topic string, retain bool) *packets.Puback {
+		a.Nil(c.publishHandler(&packets.Publish{
+			Version:    packets.Version5,
+			Qos:        packets.Qos1,
+			PacketID:   1,
+			Retain:     retain,
+			TopicName:  []byte(topic),
+			Payload:    []byte("payload"),
+			Properties: &packets.Properties{},
+		}))
+		return (<-c.out).(*packets.Puback)
+	}
+	// violates the max QoS of the most specific rule.
+	ack := publish("cmd/telemetry", false)
+	a.Equal(codes.ImplementationSpecificError, ack.Code)
+	a.Contains(string(ack.Properties.ReasonString), "QoS 1 is not allowed")
+
+	// violates the no-retain rule.
+	ack = publish("cmd/reboot", true)
+	a.Equal(codes.ImplementationSpecificError, ack.Code)
+	a.Equal("retain is not allowed on the topic", string(ack.Properties.ReasonString))
+	a.Nil(srv.retainedDB.GetRetainedMessage("cmd/reboot"))
+	a.Empty(received)
+
+	ack = publish("cmd/reboot", false)
+	a.Equal(codes.Success, ack.Code)
+	ack = publish("other", true)
+	a.Equal(codes.Success, ack.Code)
+	a.NotNil(srv.retainedDB.GetRetainedMessage("other"))
+	a.Equal([]string{"cmd/reboot", "other"}, received)
+
+	// the hook replaces the policy.
+	srv.hooks.OnTopicPolicy = func(ctx context.Context, client Client, topic string) *TopicPolicy {
+		return nil
+	}
+	ack = publish("cmd/telemetry", true)
+	a.Equal(codes.Success, ack.Code)
+}
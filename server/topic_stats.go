@@ -0,0 +1,136 @@
+package server
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// TopicStats is the publish statistics of a topic, see TopTopicsReader.
+type TopicStats struct {
+	TopicName string
+	// PublishTotal is the estimated number of the messages published to the topic.
+	// It may be overestimated by up to Error, but never underestimated.
+	PublishTotal uint64
+	// PublishBytes is the payload bytes of the messages published to the topic since it was tracked,
+	// thus it may be underestimated if the topic has been evicted before.
+	PublishBytes uint64
+	// Error is the maximum overestimation of PublishTotal,
+	// which is the count inherited from the evicted topic when the topic was tracked.
+	Error uint64
+}
+
+// TopTopicsReader is an optional interface for StatsReader to read the most published topics, see config.TopicStats.
+type TopTopicsReader interface {
+	// TopTopics returns at most n topics in the descending order of PublishTotal.
+	// It returns false if config.TopicStats is disabled.
+	TopTopics(n int) (rs []TopicStats, enabled bool)
+}
+
+var _ TopTopicsReader = (*statsManager)(nil)
+
+// TopTopics implements TopTopicsReader.
+func (s *statsManager) TopTopics(n int) ([]TopicStats, bool) {
+	if s.topicTracker == nil {
+		return nil, false
+	}
+	return s.topicTracker.top(n), true
+}
+
+func (s *statsManager) topicPublished(topicName string, size int) {
+	if s == nil || s.topicTracker == nil {
+		return
+	}
+	s.topicTracker.add(topicName, size)
+}
+
+type topicCounter struct {
+	TopicStats
+	// index is the index in topicHeap.
+	index int
+}
+
+// topicHeap is the min-heap of the counters ordered by PublishTotal.
+type topicHeap []*topicCounter
+
+func (h topicHeap) Len() int           { return len(h) }
+func (h topicHeap) Less(i, j int) bool { return h[i].PublishTotal < h[j].PublishTotal }
+func (h topicHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *topicHeap) Push(x interface{}) {
+	c := x.(*topicCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *topicHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// topicTracker tracks the most published topics in at most capacity counters by the Space-Saving algorithm.
+// If all counters are in use, the untracked topic replaces the topic with the minimum count and inherits the count,
+// so that every topic published more than 1/capacity of all messages is guaranteed to be tracked.
+type topicTracker struct {
+	mu       sync.Mutex
+	capacity int
+	counters map[string]*topicCounter
+	heap     topicHeap
+}
+
+func newTopicTracker(capacity int) *topicTracker {
+	return &topicTracker{
+		capacity: capacity,
+		counters: make(map[string]*topicCounter),
+	}
+}
+
+func (t *topicTracker) add(topicName string, size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.counters[topicName]; c != nil {
+		c.PublishTotal++
+		c.PublishBytes += uint64(size)
+		heap.Fix(&t.heap, c.index)
+		return
+	}
+	if len(t.heap) < t.capacity {
+		c := &topicCounter{TopicStats: TopicStats{TopicName: topicName, PublishTotal: 1, PublishBytes: uint64(size)}}
+		heap.Push(&t.heap, c)
+		t.counters[topicName] = c
+		return
+	}
+	c := t.heap[0]
+	delete(t.counters, c.TopicName)
+	c.TopicStats = TopicStats{
+		TopicName:    topicName,
+		PublishTotal: c.PublishTotal + 1,
+		PublishBytes: uint64(size),
+		Error:        c.PublishTotal,
+	}
+	t.counters[topicName] = c
+	heap.Fix(&t.heap, 0)
+}
+
+func (t *topicTracker) top(n int) []TopicStats {
+	t.mu.Lock()
+	rs := make([]TopicStats, 0, len(t.heap))
+	for _, v := range t.heap {
+		rs = append(rs, v.TopicStats)
+	}
+	t.mu.Unlock()
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].PublishTotal != rs[j].PublishTotal {
+			return rs[i].PublishTotal > rs[j].PublishTotal
+		}
+		return rs[i].TopicName < rs[j].TopicName
+	})
+	if n < len(rs) {
+		rs = rs[:n]
+	}
+	return rs
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+)
+
+func TestTopicTracker(t *testing.T) {
+	a := assert.New(t)
+	tr := newTopicTracker(2)
+	tr.add("a", 1)
+	tr.add("b", 2)
+	tr.add("a", 3)
+	a.Equal([]TopicStats{
+		{TopicName: "a", PublishTotal: 2, PublishBytes: 4},
+		{TopicName: "b", PublishTotal: 1, PublishBytes: 2},
+	}, tr.top(10))
+	// "c" replaces the least published "b" and inherits the count.
+	tr.add("c", 5)
+	a.Equal([]TopicStats{
+		{TopicName: "a", PublishTotal: 2, PublishBytes: 4},
+		{TopicName: "c", PublishTotal: 2, PublishBytes: 5, Error: 1},
+	}, tr.top(10))
+	a.Len(tr.counters, 2)
+	a.Equal([]TopicStats{{TopicName: "a", PublishTotal: 2, PublishBytes: 4}}, tr.top(1))
+}
+
+func TestTopicTracker_skewed(t *testing.T) {
+	a := assert.New(t)
+	tr := newTopicTracker(50)
+	var topics []string
+	// hot/0 is published 5000 times, hot/1 4000 times, ..., hot/4 1000 times.
+	for i := 0; i < 5; i++ {
+		for j := 0; j < (5-i)*1000; j++ {
+			topics = append(topics, "hot/"+strconv.Itoa(i))
+		}
+	}
+	// 10000 distinct topics which are published once.
+	for i := 0; i < 10000; i++ {
+		topics = append(topics, "cold/"+strconv.Itoa(i))
+	}
+	r := rand.New(rand.NewSource(1))
+	r.Shuffle(len(topics), func(i, j int) {
+		topics[i], topics[j] = topics[j], topics[i]
+	})
+	for _, v := range topics {
+		tr.add(v, 10)
+	}
+	a.Len(tr.counters, 50)
+	rs := tr.top(5)
+	a.Len(rs, 5)
+	for i, v := range rs {
+		a.Equal("hot/"+strconv.Itoa(i), v.TopicName)
+		exact := uint64((5 - i) * 1000)
+		a.True(v.PublishTotal >= exact)
+		a.True(v.PublishTotal-v.Error <= exact)
+		a.True(v.PublishBytes <= exact*10)
+	}
+}
+
+func TestStatsManager_TopTopics(t *testing.T) {
+	a := assert.New(t)
+	s := newStatsManager(mem.NewStore())
+	s.topicPublished("a", 1)
+	rs, enabled := s.TopTopics(10)
+	a.False(enabled)
+	a.Nil(rs)
+
+	s.topicTracker = newTopicTracker(10)
+	s.topicPublished("a", 1)
+	rs, enabled = s.TopTopics(10)
+	a.True(enabled)
+	a.Equal([]TopicStats{{TopicName: "a", PublishTotal: 1, PublishBytes: 1}}, rs)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/persistence/unack"
+)
+
+// errTransferTargetChanged is returned by transferSessionLocked if the target session is created or removed
+// while the lock is released, the transfer is retried with the current state.
+var errTransferTargetChanged = errors.New("the target session has changed")
+
+// TransferSessionResult is the result of ClientService.TransferSession.
+type TransferSessionResult struct {
+	// Subscriptions is the number of subscriptions moved to the target session.
+	Subscriptions int
+	// Messages is the number of queued messages moved to the target session.
+	Messages int
+	// Dropped is the number of queued elements which are not moved, see ClientService.TransferSession.
+	Dropped int
+	// Created indicates whether the target session is created by the transfer.
+	Created bool
+}
+
+// transferTarget is the target session created by TransferSession before it is installed.
+type transferTarget struct {
+	session *gmqtt.Session
+	queue   queue.Store
+	unack   unack.Store
+}
+
+// TransferSession implements ClientService.
+func (c *clientService) TransferSession(fromClientID, toClientID string) (rs TransferSessionResult, err error) {
+	if fromClientID == toClientID {
+		return rs, errors.New("the source and target client id must be different")
+	}
+	srv := c.srv
+	var subs []*gmqtt.Subscription
+	for {
+		srv.mu.Lock()
+		err = srv.checkTransferLocked(fromClientID, toClientID)
+		createTarget := !srv.sessionExistsLocked(toClientID)
+		srv.mu.Unlock()
+		if err != nil {
+			return rs, err
+		}
+		// the target stores are created without holding the lock, because it may involve the I/O of the persistence.
+		var target *transferTarget
+		if createTarget {
+			if target, err = srv.newTransferTarget(fromClientID, toClientID); err != nil {
+				return rs, err
+			}
+		}
+		srv.mu.Lock()
+		rs, subs, err = srv.transferSessionLocked(fromClientID, toClientID, target)
+		srv.mu.Unlock()
+		if target != nil && !rs.Created {
+			if qerr := target.queue.Clean(); qerr != nil {
+				zaplog.Error("fail to clean the queue of the unused target session", zap.String("client_id", toClientID), zap.Error(qerr))
+			}
+		}
+		if err != errTransferTargetChanged {
+			break
+		}
+	}
+	if err != nil {
+		return rs, err
+	}
+	// both sessions are disconnected, the hooks are called in the same way as ClientService.Unsubscribe.
+	for _, v := range subs {
+		if srv.hooks.OnUnsubscribed != nil {
+			srv.hooks.OnUnsubscribed(context.Background(), &detachedClient{opts: &ClientOptions{ClientID: fromClientID}}, v.GetFullTopicName())
+		}
+		if srv.hooks.OnSubscribed != nil {
+			srv.hooks.OnSubscribed(context.Background(), &detachedClient{opts: &ClientOptions{ClientID: toClientID}}, v)
+		}
+	}
+	zaplog.Info("session transferred",
+		zap.String("from_client_id", fromClientID),
+		zap.String("to_client_id", toClientID),
+		zap.Int("subscriptions", rs.Subscriptions),
+		zap.Int("messages", rs.Messages),
+		zap.Int("dropped", rs.Dropped),
+		zap.Bool("created", rs.Created))
+	return rs, nil
+}
+
+// checkTransferLocked returns the error if the source session can not be transferred to the target.
+func (srv *server) checkTransferLocked(fromClientID, toClientID string) error {
+	_, fromConnected := srv.clients[fromClientID]
+	_, toConnected := srv.clients[toClientID]
+	if fromConnected || toConnected {
+		return ErrClientConnected
+	}
+	from := srv.queueStore[fromClientID]
+	if _, ok := srv.offlineClients[fromClientID]; !ok || from == nil {
+		return ErrSessionNotFound
+	}
+	if _, ok := from.(queue.Drainer); !ok {
+		return ErrMigrateNotSupported
+	}
+	return nil
+}
+
+// sessionExistsLocked returns whether the disconnected session of the client exists.
+func (srv *server) sessionExistsLocked(clientID string) bool {
+	_, ok := srv.offlineClients[clientID]
+	return ok && srv.queueStore[clientID] != nil
+}
+
+// transferSessionLocked moves the subscriptions and then the queue of the source session to the target session,
+// the target is installed first if it is not nil. Any step failed rolls back the previous steps,
+// and the source session is removed once everything is moved.
+func (srv *server) transferSessionLocked(fromClientID, toClientID string, target *transferTarget) (rs TransferSessionResult, subs []*gmqtt.Subscription, err error) {
+	// the state may have changed while the lock was released.
+	if err = srv.checkTransferLocked(fromClientID, toClientID); err != nil {
+		return rs, nil, err
+	}
+	if srv.sessionExistsLocked(toClientID) == (target != nil) {
+		return rs, nil, errTransferTargetChanged
+	}
+	rollbackTarget := func() {}
+	if target != nil {
+		if err = srv.sessionStore.Set(target.session); err != nil {
+			return rs, nil, err
+		}
+		srv.queueStore[toClientID] = target.queue
+		srv.unackStore[toClientID] = target.unack
+		srv.statsManager.setQueueStore(toClientID, target.queue)
+		srv.offlineClients[toClientID] = srv.offlineClients[fromClientID]
+		rollbackTarget = func() {
+			delete(srv.queueStore, toClientID)
+			delete(srv.unackStore, toClientID)
+			delete(srv.offlineClients, toClientID)
+			srv.statsManager.removeQueueStore(toClientID)
+			if err := srv.sessionStore.Remove(toClientID); err != nil {
+				zaplog.Error("fail to remove the target session on rollback", zap.String("client_id", toClientID), zap.Error(err))
+			}
+		}
+	}
+
+	existing := make(map[string]struct{})
+	srv.subscriptionsDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+		existing[sub.GetFullTopicName()] = struct{}{}
+		return true
+	}, subscription.IterationOptions{
+		Type:     subscription.TypeAll,
+		ClientID: toClientID,
+	})
+	srv.subscriptionsDB.Iterate(func(clientID string, sub *gmqtt.Subscription) bool {
+		subs = append(subs, sub.Copy())
+		return true
+	}, subscription.IterationOptions{
+		Type:     subscription.TypeAll,
+		ClientID: fromClientID,
+	})
+	// rollbackSubs restores the subscriptions of both sessions, the subscriptions that the target already had are kept.
+	rollbackSubs := func(unsubscribed bool) {
+		var added []string
+		for _, v := range subs {
+			if _, ok := existing[v.GetFullTopicName()]; !ok {
+				added = append(added, v.GetFullTopicName())
+			}
+		}
+		if len(added) != 0 {
+			if err := srv.subscriptionsDB.Unsubscribe(toClientID, added...); err != nil {
+				zaplog.Error("fail to remove the target subscriptions on rollback", zap.String("client_id", toClientID), zap.Error(err))
+			}
+		}
+		if unsubscribed {
+			if _, err := srv.subscriptionsDB.Subscribe(fromClientID, subs...); err != nil {
+				zaplog.Error("fail to restore the source subscriptions on rollback", zap.String("client_id", fromClientID), zap.Error(err))
+			}
+		}
+	}
+	if len(subs) != 0 {
+		if _, err = srv.subscriptionsDB.Subscribe(toClientID, subs...); err != nil {
+			rollbackSubs(false)
+			rollbackTarget()
+			return rs, nil, err
+		}
+		if err = srv.subscriptionsDB.UnsubscribeAll(fromClientID); err != nil {
+			// UnsubscribeAll may have removed some of them.
+			rollbackSubs(true)
+			rollbackTarget()
+			return rs, nil, err
+		}
+	}
+	// the inflight messages are delivered to the target as new messages, because the packet ids only make sense in the source session.
+	rs.Messages, rs.Dropped, err = srv.migrateQueueLocked(fromClientID, toClientID, srv.queueStore[fromClientID].(queue.Drainer), MigrateQueueOptions{
+		IncludeInflight: true,
+		Append:          true,
+	})
+	if err != nil {
+		rollbackSubs(len(subs) != 0)
+		rollbackTarget()
+		return rs, nil, err
+	}
+	rs.Subscriptions = len(subs)
+	rs.Created = target != nil
+
+	// The unack store only holds the packet ids of the inbound QoS 2 messages which have been routed on receipt,
+	// so discarding it loses no message.
+	delete(srv.unackStore, fromClientID)
+	if err := srv.removeSessionLocked(fromClientID); err != nil {
+		zaplog.Error("fail to remove the transferred session", zap.String("client_id", fromClientID), zap.Error(err))
+	}
+	srv.statsManager.sessionTransferred(fromClientID, rs.Created)
+	return rs, subs, nil
+}
+
+// newTransferTarget creates the stores of the target session with the expiry of the source session.
+func (srv *server) newTransferTarget(fromClientID, toClientID string) (*transferTarget, error) {
+	sess, err := srv.sessionStore.Get(fromClientID)
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil {
+		return nil, ErrSessionNotFound
+	}
+	notifier := srv.defaultNotifier(toClientID)
+	q, err := srv.persistence.NewQueueStore(*srv.config(), notifier, toClientID)
+	if err != nil {
+		return nil, err
+	}
+	err = q.Init(&queue.InitOptions{
+		CleanStart: true,
+		Notifier:   notifier,
+		Clock:      srv.clock,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ua, err := srv.persistence.NewUnackStore(*srv.config(), toClientID)
+	if err != nil {
+		return nil, err
+	}
+	if err = ua.Init(true); err != nil {
+		return nil, err
+	}
+	return &transferTarget{
+		session: &gmqtt.Session{
+			ClientID:       toClientID,
+			ExpiryInterval: sess.ExpiryInterval,
+			ConnectedAt:    srv.clock.Now(),
+		},
+		queue: q,
+		unack: ua,
+	}, nil
+}
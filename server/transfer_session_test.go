@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	session_mem "github.com/DrmagicE/gmqtt/persistence/session/mem"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/persistence/unack"
+	unack_mem "github.com/DrmagicE/gmqtt/persistence/unack/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// initSliceQueue is a sliceQueue which can be initialized as a new session.
+type initSliceQueue struct {
+	sliceQueue
+}
+
+func (q *initSliceQueue) Init(opts *queue.InitOptions) error {
+	if opts.CleanStart {
+		q.elems = nil
+	}
+	return nil
+}
+
+func subscriptionsOf(srv *server, clientID string) (topics []string) {
+	srv.subscriptionsDB.Iterate(func(_ string, sub *gmqtt.Subscription) bool {
+		topics = append(topics, sub.GetFullTopicName())
+		return true
+	}, subscription.IterationOptions{Type: subscription.TypeAll, ClientID: clientID})
+	return topics
+}
+
+func newTransferServer(ctrl *gomock.Controller) (*server, *clientService) {
+	srv := defaultServer()
+	srv.sessionStore = session_mem.New()
+	srv.subscriptionsDB = mem.NewStore()
+	srv.statsManager = newStatsManager(srv.subscriptionsDB)
+	p := NewMockPersistence(ctrl)
+	p.EXPECT().NewQueueStore(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ config.Config, _ queue.Notifier, clientID string) (queue.Store, error) {
+			// the target is created without holding srv.mu.
+			locked := make(chan struct{})
+			go func() {
+				srv.mu.Lock()
+				srv.mu.Unlock()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+			case <-time.After(time.Second):
+				return nil, errors.New("the queue store is created under srv.mu")
+			}
+			return &initSliceQueue{sliceQueue{elems: []*queue.Elem{newPublishElem("stale", packets.Qos0, 0)}}}, nil
+		}).AnyTimes()
+	p.EXPECT().NewUnackStore(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ config.Config, clientID string) (unack.Store, error) {
+			return unack_mem.New(unack_mem.Options{ClientID: clientID}), nil
+		}).AnyTimes()
+	srv.persistence = p
+	return srv, &clientService{srv: srv}
+}
+
+func addOfflineSession(t *testing.T, srv *server, clientID string, q queue.Store, topics ...string) {
+	a := assert.New(t)
+	srv.offlineClients[clientID] = srv.clock.Now().Add(time.Hour)
+	a.Nil(srv.sessionStore.Set(&gmqtt.Session{ClientID: clientID, ExpiryInterval: 3600}))
+	srv.queueStore[clientID] = q
+	for _, v := range topics {
+		shareName, filter := subscription.SplitTopic(v)
+		_, err := srv.subscriptionsDB.Subscribe(clientID, &gmqtt.Subscription{ShareName: shareName, TopicFilter: filter, QoS: packets.Qos1})
+		a.Nil(err)
+	}
+}
+
+func TestClientService_TransferSession(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv, cs := newTransferServer(ctrl)
+	var subscribed, unsubscribed []string
+	srv.hooks.OnSubscribed = func(ctx context.Context, client Client, sub *gmqtt.Subscription) {
+		subscribed = append(subscribed, client.ClientOptions().ClientID+":"+sub.GetFullTopicName())
+	}
+	srv.hooks.OnUnsubscribed = func(ctx context.Context, client Client, topicName string) {
+		unsubscribed = append(unsubscribed, client.ClientOptions().ClientID+":"+topicName)
+	}
+
+	from := &sliceQueue{elems: newMigrateElems()}
+	addOfflineSession(t, srv, "old", from, "a", "$share/g/b")
+
+	expiry := srv.offlineClients["old"]
+	rs, err := cs.TransferSession("old", "new")
+	a.Nil(err)
+	// the inflight PUBREL is dropped.
+	a.Equal(TransferSessionResult{Subscriptions: 2, Messages: 3, Dropped: 1, Created: true}, rs)
+
+	// the source is removed.
+	a.Empty(from.elems)
+	a.Empty(subscriptionsOf(srv, "old"))
+	a.NotContains(srv.offlineClients, "old")
+	a.NotContains(srv.queueStore, "old")
+	sess, err := srv.sessionStore.Get("old")
+	a.Nil(err)
+	a.Nil(sess)
+	// the target inherits everything in order.
+	to := srv.queueStore["new"].(*initSliceQueue)
+	a.Equal([]string{"inflight", "a", "b"}, topicsOf(to.elems))
+	a.ElementsMatch([]string{"a", "$share/g/b"}, subscriptionsOf(srv, "new"))
+	sess, err = srv.sessionStore.Get("new")
+	a.Nil(err)
+	a.EqualValues(3600, sess.ExpiryInterval)
+	a.Equal(expiry, srv.offlineClients["new"])
+	a.NotNil(srv.unackStore["new"])
+	a.ElementsMatch([]string{"old:a", "old:$share/g/b"}, unsubscribed)
+	a.ElementsMatch([]string{"new:a", "new:$share/g/b"}, subscribed)
+
+	// the messages are appended to the existing target session.
+	addOfflineSession(t, srv, "old2", &sliceQueue{elems: []*queue.Elem{newPublishElem("c", packets.Qos1, 0)}}, "c")
+	rs, err = cs.TransferSession("old2", "new")
+	a.Nil(err)
+	a.Equal(TransferSessionResult{Subscriptions: 1, Messages: 1}, rs)
+	a.Equal([]string{"inflight", "a", "b", "c"}, topicsOf(to.elems))
+	a.ElementsMatch([]string{"a", "$share/g/b", "c"}, subscriptionsOf(srv, "new"))
+}
+
+func TestClientService_TransferSession_error(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	srv, cs := newTransferServer(ctrl)
+	from := &sliceQueue{elems: newMigrateElems()}
+	addOfflineSession(t, srv, "old", from, "a")
+
+	_, err := cs.TransferSession("old", "old")
+	a.Error(err)
+	_, err = cs.TransferSession("notexist", "new")
+	a.Equal(ErrSessionNotFound, err)
+
+	srv.clients["online"] = &client{}
+	_, err = cs.TransferSession("old", "online")
+	a.Equal(ErrClientConnected, err)
+	srv.clients["old"] = &client{}
+	_, err = cs.TransferSession("old", "new")
+	a.Equal(ErrClientConnected, err)
+	delete(srv.clients, "old")
+
+	addOfflineSession(t, srv, "unsupported", &countQueue{})
+	_, err = cs.TransferSession("unsupported", "new")
+	a.Equal(ErrMigrateNotSupported, err)
+
+	// nothing is moved on error.
+	a.Len(from.elems, 4)
+	a.Equal([]string{"a"}, subscriptionsOf(srv, "old"))
+	a.NotContains(srv.queueStore, "new")
+}
+
+// failSubStore fails to subscribe or unsubscribe all for the given client ids.
+type failSubStore struct {
+	subscription.Store
+	failSubscribe      string
+	failUnsubscribeAll string
+}
+
+func (f *failSubStore) Subscribe(clientID string, subscriptions ...*gmqtt.Subscription) (subscription.SubscribeResult, error) {
+	if clientID == f.failSubscribe {
+		// the first one is subscribed before the failure.
+		_, _ = f.Store.Subscribe(clientID, subscriptions[0])
+		return nil, errors.New("subscribe error")
+	}
+	return f.Store.Subscribe(clientID, subscriptions...)
+}
+
+func (f *failSubStore) UnsubscribeAll(clientID string) error {
+	if clientID == f.failUnsubscribeAll {
+		return errors.New("unsubscribe error")
+	}
+	return f.Store.UnsubscribeAll(clientID)
+}
+
+// failDrainQueue fails to drain.
+type failDrainQueue struct {
+	sliceQueue
+}
+
+func (q *failDrainQueue) Drain() ([]*queue.Elem, error) {
+	return nil, errors.New("drain error")
+}
+
+func TestClientService_TransferSession_rollback(t *testing.T) {
+	var tt = []struct {
+		name               string
+		failSubscribe      bool
+		failUnsubscribeAll bool
+		failDrain          bool
+	}{
+		{name: "subscribe", failSubscribe: true},
+		{name: "unsubscribe_all", failUnsubscribeAll: true},
+		{name: "drain", failDrain: true},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			for _, targetExists := range []bool{false, true} {
+				a := assert.New(t)
+				ctrl := gomock.NewController(t)
+				srv, cs := newTransferServer(ctrl)
+				fs := &failSubStore{Store: srv.subscriptionsDB}
+				srv.subscriptionsDB = fs
+				var from queue.Store
+				fromQueue := &sliceQueue{elems: newMigrateElems()}
+				from = fromQueue
+				if v.failDrain {
+					fq := &failDrainQueue{sliceQueue{elems: newMigrateElems()}}
+					from, fromQueue = fq, &fq.sliceQueue
+				}
+				addOfflineSession(t, srv, "old", from, "a", "$share/g/b")
+				if targetExists {
+					addOfflineSession(t, srv, "new", &sliceQueue{}, "a")
+				}
+				if v.failSubscribe {
+					fs.failSubscribe = "new"
+				}
+				if v.failUnsubscribeAll {
+					fs.failUnsubscribeAll = "old"
+				}
+
+				_, err := cs.TransferSession("old", "new")
+				a.Error(err)
+				// the source is left as it was.
+				a.Contains(srv.offlineClients, "old")
+				a.Len(fromQueue.elems, 4)
+				a.ElementsMatch([]string{"a", "$share/g/b"}, subscriptionsOf(srv, "old"))
+				if targetExists {
+					a.Equal([]string{"a"}, subscriptionsOf(srv, "new"))
+					a.Contains(srv.offlineClients, "new")
+				} else {
+					a.Empty(subscriptionsOf(srv, "new"))
+					a.NotContains(srv.queueStore, "new")
+					a.NotContains(srv.unackStore, "new")
+					a.NotContains(srv.offlineClients, "new")
+					sess, err := srv.sessionStore.Get("new")
+					a.Nil(err)
+					a.Nil(sess)
+				}
+				ctrl.Finish()
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+)
+
+// ErrSubscriptionNotFound will be returned by ClientService.Unsubscribe if the client has not subscribed the topic filter.
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// Unsubscribe implements ClientService.
+func (c *clientService) Unsubscribe(clientID string, topicName string) error {
+	srv := c.srv
+	var found bool
+	srv.subscriptionsDB.Iterate(func(_ string, sub *gmqtt.Subscription) bool {
+		found = sub.GetFullTopicName() == topicName
+		return !found
+	}, subscription.IterationOptions{
+		Type:      subscription.TypeAll,
+		ClientID:  clientID,
+		TopicName: topicName,
+		MatchType: subscription.MatchName,
+	})
+	if !found {
+		return ErrSubscriptionNotFound
+	}
+	err := srv.subscriptionsDB.Unsubscribe(clientID, topicName)
+	if err != nil {
+		return err
+	}
+	srv.removeSharedCursor(topicName)
+	if srv.hooks.OnUnsubscribed != nil {
+		srv.hooks.OnUnsubscribed(context.Background(), c.hookClient(clientID), topicName)
+	}
+	zaplog.Info("unsubscribed by the broker",
+		zap.String("topic", topicName),
+		zap.String("client_id", clientID),
+	)
+	return nil
+}
+
+// hookClient returns the client to pass to the hooks,
+// the sessions restored from the persistence have no client until the clients reconnect.
+func (c *clientService) hookClient(clientID string) Client {
+	c.srv.mu.Lock()
+	client := c.srv.clients[clientID]
+	c.srv.mu.Unlock()
+	if client != nil {
+		return client
+	}
+	return &detachedClient{
+		opts: &ClientOptions{ClientID: clientID},
+	}
+}
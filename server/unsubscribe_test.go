@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/persistence/subscription"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+)
+
+func TestClientService_Unsubscribe(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	srv.subscriptionsDB = mem.NewStore()
+	var unsubscribed []string
+	srv.hooks.OnUnsubscribed = func(ctx context.Context, client Client, topicName string) {
+		a.Equal("cid", client.ClientOptions().ClientID)
+		unsubscribed = append(unsubscribed, topicName)
+	}
+	cs := &clientService{srv: srv}
+	_, err := srv.subscriptionsDB.Subscribe("cid", &gmqtt.Subscription{
+		TopicFilter: "a/b",
+	}, &gmqtt.Subscription{
+		ShareName:   "g",
+		TopicFilter: "a/b",
+	})
+	a.Nil(err)
+
+	a.Equal(ErrSubscriptionNotFound, cs.Unsubscribe("cid", "a/+"))
+	a.Equal(ErrSubscriptionNotFound, cs.Unsubscribe("cid", "$share/h/a/b"))
+	a.Equal(ErrSubscriptionNotFound, cs.Unsubscribe("other", "a/b"))
+
+	a.Nil(cs.Unsubscribe("cid", "$share/g/a/b"))
+	a.Equal([]string{"$share/g/a/b"}, unsubscribed)
+	subs := subscription.GetClientSubscriptions(srv.subscriptionsDB, "cid", subscription.TypeAll)
+	if a.Len(subs, 1) {
+		a.Equal("a/b", subs[0].GetFullTopicName())
+	}
+
+	// the connected client is passed to the hook.
+	c, err := srv.newClient(noopConn{})
+	a.Nil(err)
+	c.opts.ClientID = "cid"
+	srv.clients["cid"] = c
+	srv.hooks.OnUnsubscribed = func(ctx context.Context, client Client, topicName string) {
+		a.Equal(c, client)
+	}
+	a.Nil(cs.Unsubscribe("cid", "a/b"))
+	a.Empty(subscription.GetClientSubscriptions(srv.subscriptionsDB, "cid", subscription.TypeAll))
+	a.Equal(ErrSubscriptionNotFound, cs.Unsubscribe("cid", "a/b"))
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+// ErrVerifyNotSupported will be returned by VerifyQueue if the queue store does not implement queue.Verifier.
+var ErrVerifyNotSupported = errors.New("queue store does not support verification")
+
+// VerifyQueue implements ClientService.
+func (c *clientService) VerifyQueue(clientID string) ([]queue.Anomaly, error) {
+	c.srv.mu.Lock()
+	qs := c.srv.queueStore[clientID]
+	c.srv.mu.Unlock()
+	if qs == nil {
+		return nil, ErrSessionNotFound
+	}
+	v, ok := qs.(queue.Verifier)
+	if !ok {
+		return nil, ErrVerifyNotSupported
+	}
+	return v.Verify()
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+)
+
+// verifiableQueue is a queue.Store which implements queue.Verifier.
+type verifiableQueue struct {
+	sliceQueue
+}
+
+func (q *verifiableQueue) Verify() ([]queue.Anomaly, error) {
+	return queue.VerifyElems(q.elems), nil
+}
+
+func TestClientService_VerifyQueue(t *testing.T) {
+	a := assert.New(t)
+	srv := defaultServer()
+	cs := &clientService{srv: srv}
+	elems := newMigrateElems()
+	for k, v := range elems {
+		v.Seq = uint64(k + 1)
+	}
+	// the last message is queued twice.
+	elems = append(elems, elems[len(elems)-1])
+	srv.queueStore["c"] = &verifiableQueue{sliceQueue{elems: elems}}
+	srv.queueStore["not_supported"] = &sliceQueue{}
+
+	rs, err := cs.VerifyQueue("c")
+	a.Nil(err)
+	a.Equal([]queue.Anomaly{{Type: queue.AnomalyDuplicate, Index: 4, Seq: 4}}, rs)
+
+	_, err = cs.VerifyQueue("unknown")
+	a.Equal(ErrSessionNotFound, err)
+	_, err = cs.VerifyQueue("not_supported")
+	a.Equal(ErrVerifyNotSupported, err)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestNewUpgrader_compression(t *testing.T) {
+	for _, compression := range []bool{true, false} {
+		a := assert.New(t)
+		upgrade := newUpgrader(&WsServer{Compression: compression, CompressionLevel: 9})
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := upgrade(w, r)
+			if !a.Nil(err) {
+				return
+			}
+			defer c.Close()
+			conn := &wsConn{Conn: c.UnderlyingConn(), c: c}
+			p, err := packets.NewReader(conn).ReadPacket()
+			if !a.Nil(err) {
+				return
+			}
+			a.Equal("client", string(p.(*packets.Connect).ClientID))
+			a.Nil(packets.NewWriter(conn).WriteAndFlush(&packets.Connack{
+				Version: packets.Version311,
+				Code:    0,
+			}))
+		}))
+
+		dialer := &websocket.Dialer{
+			EnableCompression: true,
+			Subprotocols:      []string{"mqtt"},
+		}
+		c, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		a.Nil(err)
+		a.Equal(compression, strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"))
+
+		conn := &wsConn{Conn: c.UnderlyingConn(), c: c}
+		a.Nil(packets.NewWriter(conn).WriteAndFlush(&packets.Connect{
+			Version:       packets.Version311,
+			ProtocolName:  []byte("MQTT"),
+			ProtocolLevel: packets.Version311,
+			CleanStart:    true,
+			KeepAlive:     60,
+			ClientID:      []byte("client"),
+		}))
+		p, err := packets.NewReader(conn).ReadPacket()
+		a.Nil(err)
+		a.IsType(&packets.Connack{}, p)
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestNewUpgrader_handshake(t *testing.T) {
+	var tt = []struct {
+		name         string
+		ws           *WsServer
+		origin       string
+		subprotocols []string
+		status       int
+	}{
+		{name: "default", ws: &WsServer{}, subprotocols: []string{"mqtt"}, status: http.StatusSwitchingProtocols},
+		{name: "omit_subprotocol", ws: &WsServer{}, status: http.StatusBadRequest},
+		{name: "unsupported_subprotocol", ws: &WsServer{}, subprotocols: []string{"mqttv3.1"}, status: http.StatusBadRequest},
+		{name: "custom_subprotocol", ws: &WsServer{Subprotocols: []string{"mqtt", "mqttv3.1"}}, subprotocols: []string{"mqttv3.1"}, status: http.StatusSwitchingProtocols},
+		{
+			name:         "allowed_origin",
+			ws:           &WsServer{AllowedOrigins: []string{"https://*.example.com"}},
+			origin:       "https://App.Example.com",
+			subprotocols: []string{"mqtt"},
+			status:       http.StatusSwitchingProtocols,
+		},
+		{
+			name:         "disallowed_origin",
+			ws:           &WsServer{AllowedOrigins: []string{"https://*.example.com"}},
+			origin:       "https://evil.com",
+			subprotocols: []string{"mqtt"},
+			status:       http.StatusForbidden,
+		},
+		{
+			name:   "disallowed_origin_without_subprotocol",
+			ws:     &WsServer{AllowedOrigins: []string{"https://*.example.com"}},
+			origin: "https://evil.com",
+			status: http.StatusForbidden,
+		},
+		{name: "without_origin", ws: &WsServer{AllowedOrigins: []string{"https://*.example.com"}}, subprotocols: []string{"mqtt"}, status: http.StatusSwitchingProtocols},
+		{name: "allow_all", ws: &WsServer{AllowedOrigins: []string{"*"}}, origin: "https://evil.com", subprotocols: []string{"mqtt"}, status: http.StatusSwitchingProtocols},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			upgrade := newUpgrader(v.ws)
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := upgrade(w, r)
+				if err != nil {
+					return
+				}
+				c.Close()
+			}))
+			defer s.Close()
+
+			dialer := &websocket.Dialer{Subprotocols: v.subprotocols}
+			header := http.Header{}
+			if v.origin != "" {
+				header.Set("Origin", v.origin)
+			}
+			c, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), header)
+			if a.NotNil(resp) {
+				a.Equal(v.status, resp.StatusCode)
+			}
+			if v.status != http.StatusSwitchingProtocols {
+				a.Error(err)
+				return
+			}
+			a.Nil(err)
+			c.Close()
+		})
+	}
+}
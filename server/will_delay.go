@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+)
+
+// willDelayKey is the context key of the spec decision, which is returned by the innermost OnWillDelay hook.
+type willDelayKey struct{}
+
+type willDecision struct {
+	delay   time.Duration
+	publish bool
+}
+
+// specWillDelay is the innermost OnWillDelay hook, see OnWillDelay.
+func specWillDelay(ctx context.Context, clientID string, disconnectReason byte, will *gmqtt.Message) (time.Duration, bool) {
+	d, _ := ctx.Value(willDelayKey{}).(willDecision)
+	return d.delay, d.publish
+}
+
+// willDelay returns the delay of the will message and whether to publish it.
+// delay and publish are the decision made by the spec, which can be overridden by the OnWillDelay hook.
+func (srv *server) willDelay(client *client, will *gmqtt.Message, delay time.Duration, publish bool) (time.Duration, bool) {
+	if srv.hooks.OnWillDelay == nil {
+		return delay, publish
+	}
+	ctx := context.WithValue(context.Background(), willDelayKey{}, willDecision{delay: delay, publish: publish})
+	delay, publish = srv.hooks.OnWillDelay(ctx, client.opts.ClientID, client.disconnectReason(), will)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, publish
+}
+
+// disconnectReason returns the reason code of the disconnection, see OnWillDelay.
+func (client *client) disconnectReason() byte {
+	if client.disconnect != nil {
+		return client.disconnect.Code
+	}
+	if code, ok := client.err.(*codes.Error); ok {
+		return code.Code
+	}
+	return codes.UnspecifiedError
+}
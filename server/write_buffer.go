@@ -0,0 +1,170 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+// defaultWriteBufferCap is the capacity of the write buffer if config.MQTT.WriteBufferSize is 0.
+const defaultWriteBufferCap = 8
+
+func writeBufferCap(size int) int {
+	if size <= 0 {
+		return defaultWriteBufferCap
+	}
+	return size
+}
+
+// pendingWrites is the pending list of the packets read from the queue for config.WriteBufferDropOldest,
+// the packets are moved to the write buffer in order by client.forwardPending.
+type pendingWrites struct {
+	mu   sync.Mutex
+	size int
+	pkts []packets.Packet
+	// notEmpty and notFull are signaled without blocking after a packet is pushed or popped.
+	notEmpty chan struct{}
+	notFull  chan struct{}
+}
+
+func newPendingWrites(size int) *pendingWrites {
+	return &pendingWrites{
+		size:     size,
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push appends the packet to the list. If the list is full, the oldest QoS 0 PUBLISH packet, including pkt itself,
+// is dropped and returned. It returns false if the list is full and neither pkt nor the list has QoS 0 PUBLISH packet,
+// the caller should wait for notFull and try again.
+func (p *pendingWrites) push(pkt packets.Packet) (dropped *packets.Publish, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pkts) >= p.size {
+		for i, v := range p.pkts {
+			if pub, ok := v.(*packets.Publish); ok && pub.Qos == packets.Qos0 {
+				dropped = pub
+				p.pkts = append(p.pkts[:i], p.pkts[i+1:]...)
+				break
+			}
+		}
+		if dropped == nil {
+			if pub, ok := pkt.(*packets.Publish); ok && pub.Qos == packets.Qos0 {
+				return pub, true
+			}
+			return nil, false
+		}
+	}
+	p.pkts = append(p.pkts, pkt)
+	signal(p.notEmpty)
+	return dropped, true
+}
+
+// pop removes and returns the first packet, it returns nil if the list is empty.
+func (p *pendingWrites) pop() packets.Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pkts) == 0 {
+		return nil
+	}
+	pkt := p.pkts[0]
+	p.pkts[0] = nil
+	p.pkts = p.pkts[1:]
+	signal(p.notFull)
+	return pkt
+}
+
+// writeDelivery writes the PUBLISH or PUBREL packet read from the queue according to config.MQTT.WriteBufferPolicy.
+// It returns ErrWriteBufferFull if the client should be disconnected.
+func (client *client) writeDelivery(pkt packets.Packet) error {
+	timeout := client.config.MQTT.WriteBufferTimeout
+	switch client.config.MQTT.WriteBufferPolicy {
+	case config.WriteBufferDisconnect:
+		select {
+		case <-client.close:
+		case client.out <- pkt:
+		default:
+			return client.writeBufferFull(pkt)
+		}
+		return nil
+	case config.WriteBufferDropOldest:
+		return client.pushPending(pkt, timeout)
+	default:
+		if timeout == 0 {
+			client.write(pkt)
+			return nil
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-client.close:
+		case client.out <- pkt:
+		case <-t.C:
+			return client.writeBufferFull(pkt)
+		}
+		return nil
+	}
+}
+
+// pushPending pushes the packet to the pending list, it waits for the list if there is no QoS 0 message to drop.
+func (client *client) pushPending(pkt packets.Packet, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		dropped, ok := client.pending.push(pkt)
+		if dropped != nil {
+			client.queueNotifier.notifyDropped(gmqtt.MessageFromPublish(dropped), queue.ErrDropWriteBufferFull)
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-client.close:
+			return nil
+		case <-client.pending.notFull:
+		case <-expired:
+			return client.writeBufferFull(pkt)
+		}
+	}
+}
+
+// forwardPending moves the pending packets to the write buffer in order until the client is closed.
+func (client *client) forwardPending() {
+	for {
+		pkt := client.pending.pop()
+		if pkt == nil {
+			select {
+			case <-client.close:
+				return
+			case <-client.pending.notEmpty:
+			}
+			continue
+		}
+		client.write(pkt)
+	}
+}
+
+// writeBufferFull reports the QoS 0 message which can not be written as dropped, and returns ErrWriteBufferFull.
+// The QoS 1 and QoS 2 messages remain inflight in the queue, they are redelivered after the client reconnects.
+func (client *client) writeBufferFull(pkt packets.Packet) error {
+	if pub, ok := pkt.(*packets.Publish); ok && pub.Qos == packets.Qos0 {
+		client.queueNotifier.notifyDropped(gmqtt.MessageFromPublish(pub), queue.ErrDropWriteBufferFull)
+	}
+	return ErrWriteBufferFull
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/persistence/queue"
+	"github.com/DrmagicE/gmqtt/persistence/subscription/mem"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestPendingWrites(t *testing.T) {
+	a := assert.New(t)
+	p := newPendingWrites(2)
+	q0 := &packets.Publish{Qos: packets.Qos0, TopicName: []byte("0")}
+	q1 := &packets.Publish{Qos: packets.Qos1, PacketID: 1}
+	pubrel := &packets.Pubrel{PacketID: 2}
+
+	dropped, ok := p.push(q0)
+	a.True(ok)
+	a.Nil(dropped)
+	dropped, ok = p.push(q1)
+	a.True(ok)
+	a.Nil(dropped)
+	// the oldest QoS 0 message is dropped.
+	dropped, ok = p.push(pubrel)
+	a.True(ok)
+	a.Equal(q0, dropped)
+	// no QoS 0 message in the list, the incoming QoS 0 message is the oldest one.
+	newQ0 := &packets.Publish{Qos: packets.Qos0, TopicName: []byte("1")}
+	dropped, ok = p.push(newQ0)
+	a.True(ok)
+	a.Equal(newQ0, dropped)
+	dropped, ok = p.push(&packets.Publish{Qos: packets.Qos2, PacketID: 3})
+	a.False(ok)
+	a.Nil(dropped)
+
+	a.Equal(q1, p.pop())
+	a.Len(p.notFull, 1)
+	a.Equal(pubrel, p.pop())
+	a.Nil(p.pop())
+}
+
+// newSlowClient returns a client whose write buffer is full and nobody reads it, as if the socket is slow.
+func newSlowClient(t *testing.T, ctrl *gomock.Controller, policy string, timeout time.Duration) (*client, *queue.MockStore) {
+	srv := defaultServer()
+	srv.statsManager = newStatsManager(mem.NewStore())
+	srv.config().MQTT.WriteBufferSize = 1
+	srv.config().MQTT.WriteBufferPolicy = policy
+	srv.config().MQTT.WriteBufferTimeout = timeout
+	c, err := srv.newClient(noopConn{})
+	assert.Nil(t, err)
+	c.opts.ClientID = "cid"
+	c.version = packets.Version311
+	c.opts.MaxInflight = 10
+	c.newPacketIDLimiter(c.opts.MaxInflight)
+	// the queue store is a strict mock, any unexpected call such as Remove or Clean fails the test.
+	qs := queue.NewMockStore(ctrl)
+	c.queueStore = qs
+	c.out <- &packets.Pingresp{}
+	return c, qs
+}
+
+func newPublishElem(topic string, qos uint8, id packets.PacketID) *queue.Elem {
+	return &queue.Elem{
+		At: time.Now(),
+		MessageWithID: &queue.Publish{
+			Message: &gmqtt.Message{Topic: topic, QoS: qos, PacketID: id},
+		},
+	}
+}
+
+func TestClient_pollNewMessages_writeBufferFull(t *testing.T) {
+	var tt = []struct {
+		name    string
+		policy  string
+		timeout time.Duration
+	}{
+		{name: "disconnect", policy: config.WriteBufferDisconnect},
+		{name: "block_with_timeout", policy: config.WriteBufferBlock, timeout: 10 * time.Millisecond},
+	}
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			c, qs := newSlowClient(t, ctrl, v.policy, v.timeout)
+
+			ids := c.pl.pollPacketIDs(1)
+			qs.EXPECT().Read(ids).Return([]*queue.Elem{newPublishElem("qos0", packets.Qos0, 0)}, nil)
+			_, err := c.pollNewMessages(ids)
+			a.Equal(ErrWriteBufferFull, err)
+			sts, _ := c.server.statsManager.GetClientStats("cid")
+			a.EqualValues(1, sts.MessageStats.Qos0.DroppedTotal.WriteBufferFull)
+			a.EqualValues(0, sts.MessageStats.Qos0.DroppedTotal.QueueFull)
+
+			// the QoS 1 message remains inflight in the queue.
+			qs.EXPECT().Read(ids).Return([]*queue.Elem{newPublishElem("qos1", packets.Qos1, ids[0])}, nil)
+			_, err = c.pollNewMessages(ids)
+			a.Equal(ErrWriteBufferFull, err)
+			sts, _ = c.server.statsManager.GetClientStats("cid")
+			a.EqualValues(0, sts.MessageStats.Qos1.GetDroppedTotal())
+			a.Len(c.out, 1)
+		})
+	}
+}
+
+func TestClient_pollNewMessages_writeBufferDropOldest(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	c, qs := newSlowClient(t, ctrl, config.WriteBufferDropOldest, 10*time.Millisecond)
+	reasons := make(chan DropReason, 10)
+	c.queueNotifier.dispatcher = newDropDispatcher(func(ctx context.Context, clientID string, msg *gmqtt.Message, reason DropReason) {
+		reasons <- reason
+	}, 10)
+	go c.queueNotifier.dispatcher.run(c.close)
+
+	ids := c.pl.pollPacketIDs(2)
+	qs.EXPECT().Read(ids).Return([]*queue.Elem{
+		newPublishElem("1", packets.Qos0, 0),
+		newPublishElem("2", packets.Qos1, ids[0]),
+		newPublishElem("3", packets.Qos0, 0),
+	}, nil)
+	// the pending list holds 1 packet, "1" is dropped for "2", and "3" is dropped as the oldest QoS 0 message.
+	unused, err := c.pollNewMessages(ids)
+	a.Nil(err)
+	a.Equal(ids[1:], unused)
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-reasons:
+			a.Equal(DropWriteBufferFull, r)
+		case <-time.After(time.Second):
+			a.FailNow("OnMessageDropped not called")
+		}
+	}
+	sts, _ := c.server.statsManager.GetClientStats("cid")
+	a.EqualValues(2, sts.MessageStats.Qos0.DroppedTotal.WriteBufferFull)
+
+	// the QoS 1 message waits for the pending list until the timeout.
+	qs.EXPECT().Read(unused).Return([]*queue.Elem{newPublishElem("4", packets.Qos1, unused[0])}, nil)
+	_, err = c.pollNewMessages(unused)
+	a.Equal(ErrWriteBufferFull, err)
+	sts, _ = c.server.statsManager.GetClientStats("cid")
+	a.EqualValues(0, sts.MessageStats.Qos1.GetDroppedTotal())
+
+	// the pending packets are written in order once the socket catches up.
+	go c.forwardPending()
+	a.IsType(&packets.Pingresp{}, <-c.out)
+	select {
+	case p := <-c.out:
+		a.Equal("2", string(p.(*packets.Publish).TopicName))
+	case <-time.After(time.Second):
+		a.FailNow("pending packet not forwarded")
+	}
+	close(c.close)
+}
@@ -26,6 +26,9 @@ type Subscription struct {
 	RetainAsPublished bool
 	// RetainHandling the Retain Handling option.
 	RetainHandling byte
+	// Batch indicates whether the subscriber opts in the server-side message batching.
+	// It is set by the "gmqtt-batch" user property of the SUBSCRIBE packet.
+	Batch bool
 }
 
 // GetFullTopicName returns the full topic name of the subscription.
@@ -46,6 +49,7 @@ func (s *Subscription) Copy() *Subscription {
 		NoLocal:           s.NoLocal,
 		RetainAsPublished: s.RetainAsPublished,
 		RetainHandling:    s.RetainHandling,
+		Batch:             s.Batch,
 	}
 }
 
@@ -61,5 +65,9 @@ func (s *Subscription) Validate() error {
 	if s.RetainHandling != 0 && s.RetainHandling != 1 && s.RetainHandling != 2 {
 		return errors.New("invalid retain handling")
 	}
+	// [MQTT-3.8.3-4]
+	if s.ShareName != "" && s.NoLocal {
+		return errors.New("no local is not allowed on shared subscriptions")
+	}
 	return nil
 }
@@ -2,6 +2,7 @@ package fifo
 
 import (
 	"container/list"
+	"sort"
 
 	"github.com/DrmagicE/gmqtt/config"
 	"github.com/DrmagicE/gmqtt/pkg/packets"
@@ -9,6 +10,7 @@ import (
 )
 
 var _ server.TopicAliasManager = (*Queue)(nil)
+var _ server.TopicAliasPrimer = (*Queue)(nil)
 
 func init() {
 	server.RegisterTopicAliasMgrFactory("fifo", New)
@@ -21,7 +23,7 @@ func New(config config.Config, maxAlias uint16, clientID string) server.TopicAli
 		topicAlias: &topicAlias{
 			max:   int(maxAlias),
 			alias: list.New(),
-			index: make(map[string]uint16),
+			index: make(map[string]*list.Element),
 		},
 	}
 }
@@ -34,19 +36,29 @@ type Queue struct {
 type topicAlias struct {
 	max   int
 	alias *list.List
-	// topic name => alias
-	index map[string]uint16
+	// topic name => element of alias
+	index map[string]*list.Element
 }
 type aliasElem struct {
 	topic string
 	alias uint16
+	// hits is the number of times the alias is used.
+	hits uint64
+	// primed indicates whether the alias is primed and has not been sent to the client.
+	primed bool
 }
 
 func (q *Queue) Check(publish *packets.Publish) (alias uint16, exist bool) {
 	topicName := string(publish.TopicName)
 	// alias exist
-	if a, ok := q.topicAlias.index[topicName]; ok {
-		return a, true
+	if e, ok := q.topicAlias.index[topicName]; ok {
+		elem := e.Value.(*aliasElem)
+		elem.hits++
+		if elem.primed {
+			elem.primed = false
+			return elem.alias, false
+		}
+		return elem.alias, true
 	}
 	l := q.topicAlias.alias.Len()
 	// alias has been exhausted
@@ -59,10 +71,44 @@ func (q *Queue) Check(publish *packets.Publish) (alias uint16, exist bool) {
 	} else {
 		alias = uint16(l + 1)
 	}
-	q.topicAlias.alias.PushBack(&aliasElem{
+	q.topicAlias.index[topicName] = q.topicAlias.alias.PushBack(&aliasElem{
 		topic: topicName,
 		alias: alias,
+		hits:  1,
 	})
-	q.topicAlias.index[topicName] = alias
 	return
 }
+
+// HotTopics implements server.TopicAliasPrimer.
+func (q *Queue) HotTopics() []string {
+	elems := make([]*aliasElem, 0, q.topicAlias.alias.Len())
+	// the newer alias first if the hits are equal.
+	for e := q.topicAlias.alias.Back(); e != nil; e = e.Prev() {
+		elems = append(elems, e.Value.(*aliasElem))
+	}
+	sort.SliceStable(elems, func(i, j int) bool {
+		return elems[i].hits > elems[j].hits
+	})
+	topics := make([]string, len(elems))
+	for i, v := range elems {
+		topics[i] = v.topic
+	}
+	return topics
+}
+
+// Prime implements server.TopicAliasPrimer.
+// The hottest topic is pushed back last, so that it is evicted last.
+func (q *Queue) Prime(topics []string) {
+	if len(topics) > q.topicAlias.max {
+		topics = topics[:q.topicAlias.max]
+	}
+	q.topicAlias.alias.Init()
+	q.topicAlias.index = make(map[string]*list.Element)
+	for i := len(topics) - 1; i >= 0; i-- {
+		q.topicAlias.index[topics[i]] = q.topicAlias.alias.PushBack(&aliasElem{
+			topic:  topics[i],
+			alias:  uint16(i + 1),
+			primed: true,
+		})
+	}
+}
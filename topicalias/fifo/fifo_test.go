@@ -45,3 +45,42 @@ func TestQueue(t *testing.T) {
 	a.EqualValues(1, alias)
 
 }
+
+func TestQueue_Prime(t *testing.T) {
+	a := assert.New(t)
+	check := func(m *Queue, topic string) (uint16, bool) {
+		return m.Check(&packets.Publish{TopicName: []byte(topic)})
+	}
+	max := uint16(3)
+	prev := New(config.DefaultConfig(), max, "clientID").(*Queue)
+	for _, topic := range []string{"a", "b", "c", "c", "c", "b"} {
+		check(prev, topic)
+	}
+	a.Equal([]string{"c", "b", "a"}, prev.HotTopics())
+
+	// the client reconnects with a smaller topic alias maximum.
+	m := New(config.DefaultConfig(), 2, "clientID").(*Queue)
+	m.Prime(prev.HotTopics())
+	a.Equal(2, m.topicAlias.alias.Len())
+
+	// the full topic name must be sent on the first use of the primed alias.
+	alias, ok := check(m, "b")
+	a.False(ok)
+	a.EqualValues(2, alias)
+	alias, ok = check(m, "b")
+	a.True(ok)
+	a.EqualValues(2, alias)
+
+	alias, ok = check(m, "c")
+	a.False(ok)
+	a.EqualValues(1, alias)
+	alias, ok = check(m, "c")
+	a.True(ok)
+	a.EqualValues(1, alias)
+
+	// topic a is not primed, it evicts the alias of topic b.
+	alias, ok = check(m, "a")
+	a.False(ok)
+	a.EqualValues(2, alias)
+	a.Equal(2, m.topicAlias.alias.Len())
+}
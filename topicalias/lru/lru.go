@@ -0,0 +1,112 @@
+package lru
+
+import (
+	"container/list"
+	"sort"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+var _ server.TopicAliasManager = (*Cache)(nil)
+var _ server.TopicAliasPrimer = (*Cache)(nil)
+
+func init() {
+	server.RegisterTopicAliasMgrFactory(config.TopicAliasMgrTypeLRU, New)
+}
+
+// New is the constructor of Cache.
+func New(config config.Config, maxAlias uint16, clientID string) server.TopicAliasManager {
+	return &Cache{
+		clientID: clientID,
+		max:      int(maxAlias),
+		alias:    list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// Cache is the lru cache which store all topic alias for one client.
+// The most recently used alias is at the front of the list.
+type Cache struct {
+	clientID string
+	max      int
+	alias    *list.List
+	// topic name => element of alias
+	index map[string]*list.Element
+}
+
+type aliasElem struct {
+	topic string
+	alias uint16
+	// hits is the number of times the alias is used.
+	hits uint64
+	// primed indicates whether the alias is primed and has not been sent to the client.
+	primed bool
+}
+
+func (c *Cache) Check(publish *packets.Publish) (alias uint16, exist bool) {
+	topicName := string(publish.TopicName)
+	// alias exist
+	if e, ok := c.index[topicName]; ok {
+		c.alias.MoveToFront(e)
+		elem := e.Value.(*aliasElem)
+		elem.hits++
+		if elem.primed {
+			elem.primed = false
+			return elem.alias, false
+		}
+		return elem.alias, true
+	}
+	l := c.alias.Len()
+	// alias has been exhausted, evict the least recently used one.
+	if l == c.max {
+		last := c.alias.Back()
+		elem := last.Value.(*aliasElem)
+		c.alias.Remove(last)
+		delete(c.index, elem.topic)
+		alias = elem.alias
+	} else {
+		alias = uint16(l + 1)
+	}
+	c.index[topicName] = c.alias.PushFront(&aliasElem{
+		topic: topicName,
+		alias: alias,
+		hits:  1,
+	})
+	return
+}
+
+// HotTopics implements server.TopicAliasPrimer.
+func (c *Cache) HotTopics() []string {
+	elems := make([]*aliasElem, 0, c.alias.Len())
+	// the more recently used alias first if the hits are equal.
+	for e := c.alias.Front(); e != nil; e = e.Next() {
+		elems = append(elems, e.Value.(*aliasElem))
+	}
+	sort.SliceStable(elems, func(i, j int) bool {
+		return elems[i].hits > elems[j].hits
+	})
+	topics := make([]string, len(elems))
+	for i, v := range elems {
+		topics[i] = v.topic
+	}
+	return topics
+}
+
+// Prime implements server.TopicAliasPrimer.
+// The hottest topic is at the front, so that it is evicted last.
+func (c *Cache) Prime(topics []string) {
+	if len(topics) > c.max {
+		topics = topics[:c.max]
+	}
+	c.alias.Init()
+	c.index = make(map[string]*list.Element)
+	for i, v := range topics {
+		c.index[v] = c.alias.PushBack(&aliasElem{
+			topic:  v,
+			alias:  uint16(i + 1),
+			primed: true,
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package lru
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+)
+
+func TestCache(t *testing.T) {
+	a := assert.New(t)
+
+	cid := "clientID"
+	max := uint16(3)
+	c := New(config.DefaultConfig(), max, cid).(*Cache)
+	for i := uint16(1); i <= max; i++ {
+		alias, ok := c.Check(&packets.Publish{
+			TopicName: []byte(strconv.Itoa(int(i))),
+		})
+		a.Equal(i, alias)
+		a.False(ok)
+	}
+	a.Equal(3, c.alias.Len())
+
+	// touch topic 1, now topic 2 is the least recently used one.
+	alias, ok := c.Check(&packets.Publish{TopicName: []byte("1")})
+	a.True(ok)
+	a.EqualValues(1, alias)
+
+	// the cache is full, the new topic evicts the alias of topic 2 and the full topic must be sent.
+	alias, ok = c.Check(&packets.Publish{TopicName: []byte("new")})
+	a.False(ok)
+	a.EqualValues(2, alias)
+	a.NotContains(c.index, "2")
+	a.Equal(3, c.alias.Len())
+
+	// topic 2 is new again, it evicts topic 3.
+	alias, ok = c.Check(&packets.Publish{TopicName: []byte("2")})
+	a.False(ok)
+	a.EqualValues(3, alias)
+
+	for topic, want := range map[string]uint16{"1": 1, "new": 2, "2": 3} {
+		alias, ok = c.Check(&packets.Publish{TopicName: []byte(topic)})
+		a.True(ok)
+		a.Equal(want, alias)
+	}
+}
+
+func TestCache_Prime(t *testing.T) {
+	a := assert.New(t)
+	check := func(m *Cache, topic string) (uint16, bool) {
+		return m.Check(&packets.Publish{TopicName: []byte(topic)})
+	}
+	max := uint16(3)
+	prev := New(config.DefaultConfig(), max, "clientID").(*Cache)
+	for _, topic := range []string{"a", "b", "c", "c", "c", "b"} {
+		check(prev, topic)
+	}
+	a.Equal([]string{"c", "b", "a"}, prev.HotTopics())
+
+	// the client reconnects with a smaller topic alias maximum.
+	m := New(config.DefaultConfig(), 2, "clientID").(*Cache)
+	m.Prime(prev.HotTopics())
+	a.Equal(2, m.alias.Len())
+
+	// the full topic name must be sent on the first use of the primed alias.
+	alias, ok := check(m, "b")
+	a.False(ok)
+	a.EqualValues(2, alias)
+	alias, ok = check(m, "b")
+	a.True(ok)
+	a.EqualValues(2, alias)
+
+	alias, ok = check(m, "c")
+	a.False(ok)
+	a.EqualValues(1, alias)
+	alias, ok = check(m, "c")
+	a.True(ok)
+	a.EqualValues(1, alias)
+
+	// topic a is not primed, it evicts the alias of topic b.
+	alias, ok = check(m, "a")
+	a.False(ok)
+	a.EqualValues(2, alias)
+	a.Equal(2, m.alias.Len())
+}